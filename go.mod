@@ -3,6 +3,7 @@ module github.com/c2FmZQ/tlsproxy
 go 1.22.1
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/beevik/etree v1.4.0
 	github.com/c2FmZQ/storage v0.2.2
 	github.com/c2FmZQ/tpm v0.3.0
@@ -11,6 +12,7 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/google/go-tpm-tools v0.4.3
 	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/klauspost/compress v1.17.8
 	github.com/pires/go-proxyproto v0.7.0
 	github.com/quic-go/quic-go v0.44.0
 	github.com/russellhaering/goxmldsig v1.4.0
@@ -30,12 +30,16 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
@@ -53,10 +57,19 @@ func main() {
 	versionFlag := flag.Bool("v", false, "Show the version.")
 	revokeFlag := flag.String("revoke-all-certificates", "", "Revoke all cached certificates. The value is the revocation code: unspecified, keyCompromise, superseded, or cessationOfOperation")
 	passphraseFlag := flag.String("passphrase", os.Getenv("TLSPROXY_PASSPHRASE"), "The passphrase to encrypt the TLS keys on disk.")
+	rotateKeyFlag := flag.Bool("rotate-master-key", false, "Replace the master key and re-encrypt the cache directory with it, then exit. Use the admin API when the proxy is running.")
+	newPassphraseFlag := flag.String("new-passphrase", os.Getenv("TLSPROXY_NEW_PASSPHRASE"), "Re-encrypt the master keys with this new passphrase, then exit. Use the admin API when the proxy is running.")
+	exportKeyFlag := flag.String("export-master-key", "", "Write the master key, encrypted with the passphrase, to this file, then exit.")
+	importKeyFlag := flag.String("import-master-key", "", "Restore the master key from a file created with --export-master-key, then exit.")
 	shutdownGraceFlag := flag.Duration("shutdown-grace-period", time.Minute, "The shutdown grace period.")
 	testFlag := flag.Bool("use-ephemeral-certificate-manager", false, "Use an ephemeral certificate manager. This is for testing purposes only.")
 	stdoutFlag := flag.Bool("stdout", false, "Log to STDOUT.")
 	quietFlag := flag.Bool("quiet", os.Getenv("TLSPROXY_QUIET") == "true", "Turn off logging after start-up.")
+	checkConfigFlag := flag.Bool("check-config", false, "Validate the config file, then exit. With --admin-url, also show the differences with the running config.")
+	checkOIDCFlag := flag.Bool("check-oidc-discovery", false, "With --check-config, also check that the discovery documents of the OIDC providers can be fetched.")
+	adminURLFlag := flag.String("admin-url", "", "With --check-config, the URL of the CONSOLE backend whose admin API returns the running config, e.g. https://admin.example.com")
+	adminCertFlag := flag.String("admin-client-cert", "", "With --admin-url, the client certificate file to authenticate with the admin API.")
+	adminKeyFlag := flag.String("admin-client-key", "", "With --admin-url, the client key file to authenticate with the admin API.")
 	flag.Parse()
 
 	if *versionFlag {
@@ -74,6 +87,13 @@ func main() {
 	if err != nil {
 		log.Fatalf("ERR %v", err)
 	}
+	if *checkConfigFlag {
+		opts := proxy.CheckConfigOptions{OIDCDiscovery: *checkOIDCFlag}
+		if err := checkConfig(ctx, cfg, opts, *adminURLFlag, *adminCertFlag, *adminKeyFlag); err != nil {
+			log.Fatalf("ERR %v", err)
+		}
+		os.Exit(0)
+	}
 	var p *proxy.Proxy
 	if *testFlag {
 		log.Print("WRN Using ephemeral certificate manager")
@@ -85,6 +105,17 @@ func main() {
 		if !cfg.AcceptTOS {
 			log.Fatal("acceptTOS must be set to true in the config file")
 		}
+		if *importKeyFlag != "" {
+			b, err := os.ReadFile(*importKeyFlag)
+			if err != nil {
+				log.Fatalf("ERR %v", err)
+			}
+			if err := proxy.ImportMasterKey(cfg, []byte(*passphraseFlag), b); err != nil {
+				log.Fatalf("ERR ImportMasterKey: %v", err)
+			}
+			log.Print("INF Master key imported")
+			os.Exit(0)
+		}
 		p, err = proxy.New(cfg, []byte(*passphraseFlag))
 	}
 	if err != nil {
@@ -96,39 +127,169 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if !*testFlag && (*rotateKeyFlag || *newPassphraseFlag != "" || *exportKeyFlag != "") {
+		if err := masterKeyCommands(p, *passphraseFlag, *rotateKeyFlag, *newPassphraseFlag, *exportKeyFlag); err != nil {
+			log.Fatalf("ERR %v", err)
+		}
+		os.Exit(0)
+	}
 	if err := p.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
+	p.SetConfigFile(*configFile)
 	if *quietFlag {
 		log.SetOutput(io.Discard)
 	}
-	go configLoop(ctx, p, *configFile)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go configLoop(ctx, p, *configFile, hup)
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT)
 	signal.Notify(ch, syscall.SIGTERM)
-	sig := <-ch
-	log.Printf("INF Received signal %d (%s)", sig, sig)
+	signal.Notify(ch, syscall.SIGUSR2)
+	for {
+		sig := <-ch
+		log.Printf("INF Received signal %d (%s)", sig, sig)
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		// SIGUSR2 starts a new process with the same binary path and
+		// arguments, e.g. after the binary was updated. The current
+		// process exits after the active connections have finished.
+		if err := upgrade(ctx, p); err != nil {
+			log.Printf("ERR %v", err)
+			continue
+		}
+		break
+	}
 
 	ctx, canc := context.WithTimeout(ctx, *shutdownGraceFlag)
 	defer canc()
 	p.Shutdown(ctx)
 }
 
-func configLoop(ctx context.Context, p *proxy.Proxy, file string) {
+// configLoop reloads the config file when it changes, or when the process
+// receives a SIGHUP. Invalid configs are rejected and the proxy keeps using
+// the current one.
+func configLoop(ctx context.Context, p *proxy.Proxy, file string, hup <-chan os.Signal) {
+	lastMod := configModTime(file)
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(30 * time.Second):
+		case sig := <-hup:
+			log.Printf("INF Received signal %d (%s), reloading config", sig, sig)
+		case <-time.After(5 * time.Second):
+			if configModTime(file).Equal(lastMod) {
+				continue
+			}
 		}
+		lastMod = configModTime(file)
 		cfg, err := proxy.ReadConfig(file)
 		if err != nil {
-			log.Printf("ERR %v", err)
+			log.Printf("ERR Config not reloaded: %v", err)
 			continue
 		}
 		if err := p.Reconfigure(cfg); err != nil {
-			log.Printf("ERR %v", err)
+			log.Printf("ERR Config not reloaded: %v", err)
 		}
 	}
 }
+
+// checkConfig validates cfg and, when adminURL is set, prints the
+// differences between the running config and cfg.
+func checkConfig(ctx context.Context, cfg *proxy.Config, opts proxy.CheckConfigOptions, adminURL, certFile, keyFile string) error {
+	if err := proxy.CheckConfig(ctx, cfg, opts); err != nil {
+		return err
+	}
+	os.Stdout.WriteString("Config OK\n")
+	if adminURL == "" {
+		return nil
+	}
+	tc := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tc},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(adminURL, "/")+"/api/config", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("running config: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+	diff, err := proxy.ConfigDiff(b, cfg)
+	if err != nil {
+		return err
+	}
+	if len(diff) == 0 {
+		os.Stdout.WriteString("No differences with the running config\n")
+		return nil
+	}
+	os.Stdout.WriteString("Differences with the running config:\n")
+	for _, line := range diff {
+		os.Stdout.WriteString(line + "\n")
+	}
+	return nil
+}
+
+// masterKeyCommands rotates the master key, changes the passphrase, and/or
+// exports the master key, in that order.
+func masterKeyCommands(p *proxy.Proxy, passphrase string, rotate bool, newPassphrase, exportFile string) error {
+	if rotate {
+		if _, err := p.RotateMasterKey([]byte(passphrase)); err != nil {
+			return err
+		}
+	}
+	if newPassphrase != "" {
+		if err := p.ChangePassphrase([]byte(passphrase), []byte(newPassphrase)); err != nil {
+			return err
+		}
+	}
+	if exportFile != "" {
+		b, err := p.ExportMasterKey()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(exportFile, b, 0o600); err != nil {
+			return err
+		}
+		log.Printf("INF Master key exported to %s", exportFile)
+	}
+	return nil
+}
+
+func upgrade(ctx context.Context, p *proxy.Proxy) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	return p.Upgrade(ctx, exe, os.Args[1:]...)
+}
+
+func configModTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/accesslog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logsink"
+)
+
+// SetAccessLogWriter sets the io.Writer where the access log is written when
+// the access log is enabled without a file, syslog, or journald destination.
+// The default is the standard output.
+func (p *Proxy) SetAccessLogWriter(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accessLogWriter = w
+	if p.cfg == nil || p.cfg.AccessLog == nil || p.cfg.AccessLog.File != "" || p.cfg.AccessLog.Syslog || p.cfg.AccessLog.Journald {
+		return
+	}
+	if err := p.setAccessLogOutput(p.cfg.AccessLog); err != nil {
+		log.Printf("ERR Access log: %v", err)
+	}
+}
+
+// setAccessLogOutput opens the access log destination specified in cfg, and
+// closes the previous one. p.mu must be locked.
+func (p *Proxy) setAccessLogOutput(cfg *ConfigAccessLog) error {
+	var w io.Writer
+	var closer io.Closer
+	var format string
+	switch {
+	case cfg == nil:
+	case cfg.File != "":
+		f, err := accesslog.NewRotatingFile(cfg.File, int64(cfg.MaxSize)<<20, cfg.MaxFiles)
+		if err != nil {
+			return err
+		}
+		w, closer, format = f, f, cfg.Format
+	case cfg.Syslog || cfg.Journald:
+		s, err := cfg.sink().open()
+		if err != nil {
+			return err
+		}
+		lw := logsink.NewWriter(s, slog.LevelInfo)
+		w, closer, format = lw, lw, cfg.Format
+	case p.accessLogWriter != nil:
+		w, format = p.accessLogWriter, cfg.Format
+	default:
+		w, format = os.Stdout, cfg.Format
+	}
+	if _, err := p.accessLog.SetOutput(w, format); err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}
+	if p.accessLogCloser != nil {
+		p.accessLogCloser.Close()
+	}
+	p.accessLogCloser = closer
+	return nil
+}
+
+// logConnEnd records the end of a connection in the access log of its
+// backend, and ends its trace span. When the backend's access log isn't
+// enabled, the connection is recorded in the main log with format and args
+// instead.
+func logConnEnd(conn anyConn, format string, args ...any) {
+	endConnSpan(conn)
+	if be := connBackend(conn); be != nil && be.accessLog != nil {
+		be.accessLog.Log(connAccessLogEntry(conn))
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func connAccessLogEntry(conn anyConn) *accesslog.Entry {
+	ac := annotatedConn(conn)
+	startTime := ac.Annotation(startTimeKey, time.Time{}).(time.Time)
+	hsTime := ac.Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	dialTime := ac.Annotation(dialDoneKey, time.Time{}).(time.Time)
+	e := &accesslog.Entry{
+		Time:          startTime,
+		Type:          accesslog.TypeConnection,
+		RemoteAddr:    conn.RemoteAddr().String(),
+		ServerName:    idnaToUnicode(connServerName(conn)),
+		Mode:          connMode(conn),
+		ALPNProto:     connProto(conn),
+		User:          certSummary(connClientCert(conn)),
+		JA3:           connJA3(conn),
+		JA4:           connJA4(conn),
+		BytesReceived: ac.BytesReceived(),
+		BytesSent:     ac.BytesSent(),
+		Duration:      time.Since(startTime),
+	}
+	if intConn := connIntConn(conn); intConn != nil {
+		e.BackendAddr = intConn.RemoteAddr().String()
+	}
+	if !hsTime.IsZero() {
+		e.HandshakeTime = hsTime.Sub(startTime)
+	}
+	if !dialTime.IsZero() {
+		if hsTime.IsZero() {
+			hsTime = startTime
+		}
+		e.DialTime = dialTime.Sub(hsTime)
+	}
+	return e
+}
+
+// accessLogHandler records the HTTP requests in the backend's access log.
+func (be *Backend) accessLogHandler(next http.Handler) http.Handler {
+	if be.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			e := &accesslog.Entry{
+				Time:       start,
+				Type:       accesslog.TypeRequest,
+				RemoteAddr: req.RemoteAddr,
+				Method:     req.Method,
+				URI:        req.RequestURI,
+				HTTPProto:  req.Proto,
+				Status:     rw.status,
+				Referer:    req.Referer(),
+				UserAgent:  userAgent(req),
+				BytesSent:  rw.size,
+				Duration:   time.Since(start),
+			}
+			if req.ContentLength > 0 {
+				e.BytesReceived = req.ContentLength
+			}
+			if e.Status == 0 {
+				e.Status = http.StatusOK
+			}
+			if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+				e.RemoteAddr = conn.RemoteAddr().String()
+				e.ServerName = idnaToUnicode(connServerName(conn))
+				e.Mode = connMode(conn)
+				e.ALPNProto = connProto(conn)
+				e.User = certSummary(connClientCert(conn))
+			}
+			if rw.user != "" {
+				e.User = rw.user
+			}
+			be.accessLog.Log(e)
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newHTTPServer(t, ctx, "backend2", nil)
+	be3 := newTCPServer(t, ctx, "backend3", nil)
+
+	falseValue := false
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr:  "localhost:0",
+			TLSAddr:   "localhost:0",
+			CacheDir:  t.TempDir(),
+			MaxOpen:   100,
+			AccessLog: &ConfigAccessLog{},
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"tcp.example.com"},
+					Addresses:   []string{be1.listener.Addr().String()},
+				},
+				{
+					ServerNames: []string{"http.example.com"},
+					Addresses:   []string{be2.String()},
+					Mode:        "HTTP",
+				},
+				{
+					ServerNames: []string{"nolog.example.com"},
+					Addresses:   []string{be3.listener.Addr().String()},
+					AccessLog:   &falseValue,
+				},
+			},
+		},
+		extCA,
+	)
+	var buf syncBuffer
+	proxy.SetAccessLogWriter(&buf)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	if _, _, err := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if _, _, err := httpGet("http.example.com", proxy.listener.Addr().String(), "/foo", extCA, nil); err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	if _, _, err := tlsGet("nolog.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+
+	type entry struct {
+		Type       string `json:"type"`
+		ServerName string `json:"serverName"`
+		Mode       string `json:"mode"`
+		URI        string `json:"uri"`
+		Status     int    `json:"status"`
+		BytesSent  int64  `json:"bytesSent"`
+	}
+	var entries []entry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		entries = nil
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var e entry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("json.Unmarshal(%q): %v", line, err)
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) >= 2 {
+			break
+		}
+	}
+	var gotTCP, gotReq bool
+	for _, e := range entries {
+		switch {
+		case e.ServerName == "nolog.example.com":
+			t.Errorf("Unexpected access log entry: %+v", e)
+		case e.Type == "connection" && e.ServerName == "tcp.example.com" && e.Mode == "TCP" && e.BytesSent > 0:
+			gotTCP = true
+		case e.Type == "request" && e.ServerName == "http.example.com" && e.URI == "/foo" && e.Status == 200:
+			gotReq = true
+		default:
+			t.Errorf("Unexpected access log entry: %+v", e)
+		}
+	}
+	if !gotTCP || !gotReq {
+		t.Errorf("Missing access log entries. Got %+v", entries)
+	}
+}
@@ -0,0 +1,136 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package proxy
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// matchACL returns true if any of the rules in acl matches. A rule is one or
+// more terms separated by &&. It matches when matchTerm returns true for all
+// its terms.
+func matchACL(acl []string, matchTerm func(string) bool) bool {
+	for _, rule := range acl {
+		if matchACLRule(rule, matchTerm) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchACLRule(rule string, matchTerm func(string) bool) bool {
+	for _, term := range strings.Split(rule, "&&") {
+		if !matchTerm(strings.TrimSpace(term)) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateACL checks the syntax of the rules in acl.
+func validateACL(acl []string) error {
+	for i, rule := range acl {
+		for _, term := range strings.Split(rule, "&&") {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				return fmt.Errorf("[%d]: empty term in %q", i, rule)
+			}
+			if v, ok := strings.CutPrefix(term, "CLAIM:"); ok {
+				if name, _, ok := strings.Cut(v, "="); !ok || name == "" {
+					return fmt.Errorf("[%d]: invalid claim term %q, expected CLAIM:name=value", i, term)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// certACLTerm returns a function that matches ACL terms against cert.
+func certACLTerm(cert *x509.Certificate) func(string) bool {
+	subject := cert.Subject.String()
+	return func(term string) bool {
+		if subject != "" && (term == subject || term == "SUBJECT:"+subject) {
+			return true
+		}
+		if v, ok := strings.CutPrefix(term, "DNS:"); ok {
+			return slices.Contains(cert.DNSNames, v)
+		}
+		if v, ok := strings.CutPrefix(term, "EMAIL:"); ok {
+			if strings.HasPrefix(v, "@") {
+				return slices.ContainsFunc(cert.EmailAddresses, func(e string) bool {
+					return strings.HasSuffix(e, v)
+				})
+			}
+			return slices.Contains(cert.EmailAddresses, v)
+		}
+		if v, ok := strings.CutPrefix(term, "URI:"); ok {
+			return slices.ContainsFunc(cert.URIs, func(u *url.URL) bool {
+				return u.String() == v
+			})
+		}
+		return false
+	}
+}
+
+// claimsACLTerm returns a function that matches ACL terms against the
+// claims of an authenticated user.
+func claimsACLTerm(claims jwt.MapClaims) func(string) bool {
+	email, _ := claims["email"].(string)
+	_, domain, _ := strings.Cut(email, "@")
+	return func(term string) bool {
+		if email != "" && term == email {
+			return true
+		}
+		if domain != "" && term == "@"+domain {
+			return true
+		}
+		if v, ok := strings.CutPrefix(term, "CLAIM:"); ok {
+			name, value, _ := strings.Cut(v, "=")
+			return claimHasValue(claims[name], value)
+		}
+		return false
+	}
+}
+
+func claimHasValue(claim any, value string) bool {
+	switch c := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return c == value
+	case []any:
+		return slices.ContainsFunc(c, func(v any) bool {
+			return claimHasValue(v, value)
+		})
+	case []string:
+		return slices.Contains(c, value)
+	default:
+		return fmt.Sprint(c) == value
+	}
+}
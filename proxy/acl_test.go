@@ -0,0 +1,117 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package proxy
+
+import (
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthorizeACL(t *testing.T) {
+	cert := newTestClientCert(t).Leaf
+	for _, tc := range []struct {
+		acl     *[]string
+		denyACL []string
+		want    bool
+	}{
+		{acl: nil, want: true},
+		{acl: &[]string{}, want: false},
+		{acl: &[]string{"CN=Bob,O=Org"}, want: true},
+		{acl: &[]string{"SUBJECT:CN=Bob,O=Org"}, want: true},
+		{acl: &[]string{"SUBJECT:CN=Alice"}, want: false},
+		{acl: &[]string{"DNS:b.example.com"}, want: true},
+		{acl: &[]string{"EMAIL:bob@example.com"}, want: true},
+		{acl: &[]string{"EMAIL:@example.com"}, want: true},
+		{acl: &[]string{"EMAIL:@example.org"}, want: false},
+		{acl: &[]string{"URI:spiffe://example.com/bob"}, want: true},
+		{acl: &[]string{"EMAIL:@example.com && URI:spiffe://example.com/bob"}, want: true},
+		{acl: &[]string{"EMAIL:@example.com && URI:spiffe://example.com/admin"}, want: false},
+		{acl: &[]string{"EMAIL:@example.org", "DNS:bob.example.com"}, want: true},
+		{acl: nil, denyACL: []string{"EMAIL:bob@example.com"}, want: false},
+		{acl: nil, denyACL: []string{"EMAIL:alice@example.com"}, want: true},
+		{acl: &[]string{"EMAIL:@example.com"}, denyACL: []string{"DNS:bob.example.com"}, want: false},
+	} {
+		be := &Backend{ClientAuth: &ClientAuth{ACL: tc.acl, DenyACL: tc.denyACL}}
+		if got := be.authorize(cert) == nil; got != tc.want {
+			var acl []string
+			if tc.acl != nil {
+				acl = *tc.acl
+			}
+			t.Errorf("authorize() with ACL %q DenyACL %q = %v, want %v", acl, tc.denyACL, got, tc.want)
+		}
+	}
+}
+
+func TestSSOACL(t *testing.T) {
+	claims := jwt.MapClaims{
+		"email":  "bob@example.com",
+		"groups": []any{"users", "admins"},
+		"dept":   "eng",
+	}
+	for _, tc := range []struct {
+		acl     *[]string
+		denyACL []string
+		want    bool
+	}{
+		{acl: nil, want: true},
+		{acl: &[]string{}, want: false},
+		{acl: &[]string{"bob@example.com"}, want: true},
+		{acl: &[]string{"@example.com"}, want: true},
+		{acl: &[]string{"@example.org"}, want: false},
+		{acl: &[]string{"CLAIM:groups=admins"}, want: true},
+		{acl: &[]string{"CLAIM:groups=ops"}, want: false},
+		{acl: &[]string{"CLAIM:dept=eng"}, want: true},
+		{acl: &[]string{"CLAIM:missing=x"}, want: false},
+		{acl: &[]string{"@example.com && CLAIM:groups=admins"}, want: true},
+		{acl: &[]string{"@example.com && CLAIM:groups=ops"}, want: false},
+		{acl: &[]string{"@example.com"}, denyACL: []string{"CLAIM:dept=eng"}, want: false},
+		{acl: nil, denyACL: []string{"CLAIM:groups=ops"}, want: true},
+	} {
+		sso := &BackendSSO{ACL: tc.acl, DenyACL: tc.denyACL}
+		if got := sso.allows(claims); got != tc.want {
+			var acl []string
+			if tc.acl != nil {
+				acl = *tc.acl
+			}
+			t.Errorf("allows() with ACL %q DenyACL %q = %v, want %v", acl, tc.denyACL, got, tc.want)
+		}
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	for _, tc := range []struct {
+		acl     []string
+		wantErr bool
+	}{
+		{acl: nil},
+		{acl: []string{"bob@example.com", "@example.com && CLAIM:groups=admins"}},
+		{acl: []string{"CLAIM:groups"}, wantErr: true},
+		{acl: []string{"CLAIM:=admins"}, wantErr: true},
+		{acl: []string{"@example.com &&"}, wantErr: true},
+	} {
+		if err := validateACL(tc.acl); (err != nil) != tc.wantErr {
+			t.Errorf("validateACL(%q) = %v, wantErr %v", tc.acl, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/dns01"
+)
+
+// acmeCache is a wrapper around the autocert cache that records an event
+// every time a new certificate is stored, i.e. when a certificate is issued or
+// renewed.
+type acmeCache struct {
+	autocert.Cache
+	recordEvent func(string)
+}
+
+func (c *acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		return err
+	}
+	if c.recordEvent != nil && isACMECertKey(key) {
+		c.recordEvent("acme certificate issued")
+	}
+	return nil
+}
+
+// isACMECertKey returns true if key is the cache key of a certificate, as
+// opposed to an account key or a challenge token.
+func isACMECertKey(key string) bool {
+	return !strings.HasPrefix(key, "acme_account") && !strings.HasSuffix(key, "+token") && !strings.HasSuffix(key, "+http-01")
+}
+
+// dns01Domains returns the domains that get their certificates with the
+// dns-01 challenge, with their DNS providers.
+func dns01Domains(providers []*ConfigDNSProvider) ([]dns01.Domain, error) {
+	var out []dns01.Domain
+	for _, dp := range providers {
+		provider, err := newDNSProvider(dp)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range dp.Domains {
+			out = append(out, dns01.Domain{
+				Name:             d,
+				Provider:         provider,
+				PropagationDelay: dp.PropagationDelay,
+			})
+		}
+	}
+	return out, nil
+}
+
+func newDNSProvider(dp *ConfigDNSProvider) (dns01.Provider, error) {
+	switch dp.Type {
+	case "cloudflare":
+		return &dns01.Cloudflare{
+			APIToken: dp.APIToken,
+			ZoneID:   dp.ZoneID,
+		}, nil
+	case "route53":
+		return &dns01.Route53{
+			AccessKeyID:     dp.AccessKeyID,
+			SecretAccessKey: dp.SecretAccessKey,
+			HostedZoneID:    dp.HostedZoneID,
+		}, nil
+	case "rfc2136":
+		secret, err := base64.StdEncoding.DecodeString(dp.TSIGSecret)
+		if err != nil {
+			return nil, err
+		}
+		return &dns01.RFC2136{
+			Nameserver:    dp.Nameserver,
+			Zone:          dp.Zone,
+			TSIGKeyName:   dp.TSIGKeyName,
+			TSIGSecret:    secret,
+			TSIGAlgorithm: dp.TSIGAlgorithm,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown DNS provider type %q", dp.Type)
+	}
+}
@@ -0,0 +1,467 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	acmeStagingName      = "letsencrypt-staging"
+	acmeStagingDirectory = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	// acmeStagingPrefix is the prefix of the cache keys of the staging
+	// certificates, so that they are never confused with production
+	// certificates.
+	acmeStagingPrefix = "staging+"
+)
+
+// acmeManager obtains and renews certificates with autocert from one or
+// more ACME certificate authorities. The CA is selected by server name, and
+// each CA has its own account key.
+type acmeManager struct {
+	cache autocert.Cache
+	queue *issuanceQueue
+
+	mu  sync.RWMutex
+	def *acmeCA
+	cas []*acmeCA
+}
+
+// acmeCA is an ACME certificate authority. cfg is nil for the built-in
+// default CA, i.e. Let's Encrypt. Only manager can change, and it is
+// guarded by acmeManager.mu.
+type acmeCA struct {
+	cfg     *ConfigACMECA
+	email   string
+	suffix  string
+	prefix  string
+	manager *autocert.Manager
+}
+
+func newACMEManager(cache autocert.Cache, email string) *acmeManager {
+	m := &acmeManager{
+		cache: cache,
+		queue: newIssuanceQueue(),
+	}
+	m.def = m.newCA(nil, email, "", "")
+	return m
+}
+
+// newCA returns a new CA. The account key is stored with suffix, and the
+// certificates with prefix.
+func (m *acmeManager) newCA(cfg *ConfigACMECA, email, suffix, prefix string) *acmeCA {
+	ca := &acmeCA{cfg: cfg, email: email, suffix: suffix, prefix: prefix}
+	ca.manager = m.newAutocertManager(ca)
+	return ca
+}
+
+func (m *acmeManager) newAutocertManager(ca *acmeCA) *autocert.Manager {
+	var cache autocert.Cache = m.cache
+	if ca.suffix != "" || ca.prefix != "" {
+		cache = &acmeAccountCache{Cache: m.cache, keyName: ca.accountKeyName(), prefix: ca.prefix}
+	}
+	mgr := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  cache,
+		Email:  ca.email,
+		Client: ca.newClient(nil),
+		HostPolicy: func(ctx context.Context, host string) error {
+			return m.queue.admit(ctx, host, ca)
+		},
+	}
+	if ca.cfg != nil && ca.cfg.EABKeyID != "" {
+		mgr.ExternalAccountBinding = ca.eab()
+	}
+	return mgr
+}
+
+func (ca *acmeCA) name() string {
+	if ca.cfg == nil {
+		return "letsencrypt"
+	}
+	return ca.cfg.Name
+}
+
+// isLetsEncrypt returns true if the CA is Let's Encrypt, production or
+// staging.
+func (ca *acmeCA) isLetsEncrypt() bool {
+	return ca.cfg == nil || ca.cfg.DirectoryURL == acmeStagingDirectory
+}
+
+func (ca *acmeCA) directoryURL() string {
+	if ca.cfg == nil {
+		return autocert.DefaultACMEDirectory
+	}
+	return ca.cfg.DirectoryURL
+}
+
+func (ca *acmeCA) eab() *acme.ExternalAccountBinding {
+	if ca.cfg == nil || ca.cfg.EABKeyID == "" {
+		return nil
+	}
+	return &acme.ExternalAccountBinding{
+		KID: ca.cfg.EABKeyID,
+		Key: ca.cfg.eabHMACKey,
+	}
+}
+
+func (ca *acmeCA) httpClient() *http.Client {
+	if ca.cfg == nil || ca.cfg.rootCAs == nil {
+		return nil
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: ca.cfg.rootCAs},
+		},
+	}
+}
+
+func (ca *acmeCA) newClient(key crypto.Signer) *acme.Client {
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: ca.directoryURL(),
+		HTTPClient:   ca.httpClient(),
+		UserAgent:    "tlsproxy",
+	}
+}
+
+// accountKeyName is the cache key of the CA's account key. The default CA
+// uses the same key as autocert.
+func (ca *acmeCA) accountKeyName() string {
+	return acmeAccountKey + ca.suffix
+}
+
+// rotationTimeName is the cache key of the time when the CA's account key
+// was last rotated.
+func (ca *acmeCA) rotationTimeName() string {
+	return "acme_account+time" + ca.suffix
+}
+
+// sameAccount returns true if ca and other use the same ACME account.
+func (ca *acmeCA) sameAccount(other *acmeCA) bool {
+	if ca.suffix != other.suffix || ca.prefix != other.prefix || ca.email != other.email || (ca.cfg == nil) != (other.cfg == nil) {
+		return false
+	}
+	if ca.cfg == nil {
+		return true
+	}
+	return ca.cfg.DirectoryURL == other.cfg.DirectoryURL &&
+		ca.cfg.EABKeyID == other.cfg.EABKeyID &&
+		ca.cfg.EABHMACKey == other.cfg.EABHMACKey &&
+		slices.Equal(ca.cfg.RootCAs, other.cfg.RootCAs)
+}
+
+// setConfig updates the list of CAs. The CAs that use the same account as
+// before keep their autocert manager.
+func (m *acmeManager) setConfig(cfg *ConfigACME, email string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing := append([]*acmeCA{m.def}, m.cas...)
+	reuse := func(ca *acmeCA) *acmeCA {
+		for _, e := range existing {
+			if e.sameAccount(ca) {
+				ca.manager = e.manager
+				break
+			}
+		}
+		return ca
+	}
+	var def *acmeCA
+	var cas []*acmeCA
+	if cfg != nil {
+		for _, c := range cfg.CertificateAuthorities {
+			if len(c.Domains) == 0 {
+				def = reuse(m.newCA(c, email, "", ""))
+				continue
+			}
+			cas = append(cas, reuse(m.newCA(c, email, "+"+c.Name, "")))
+		}
+		if def == nil && cfg.Staging {
+			staging := &ConfigACMECA{
+				Name:         acmeStagingName,
+				DirectoryURL: acmeStagingDirectory,
+			}
+			def = reuse(m.newCA(staging, email, "+"+acmeStagingName, acmeStagingPrefix))
+		}
+	}
+	if def == nil {
+		def = reuse(m.newCA(nil, email, "", ""))
+	}
+	m.def = def
+	m.cas = cas
+	if cfg != nil {
+		m.queue.setConcurrency(cfg.MaxConcurrentIssuance)
+	} else {
+		m.queue.setConcurrency(1)
+	}
+}
+
+// forName returns the CA that issues the certificate for serverName.
+func (m *acmeManager) forName(serverName string) *acmeCA {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ca := m.def
+	var matchLen int
+	for _, c := range m.cas {
+		for _, d := range c.cfg.Domains {
+			if (serverName == d || strings.HasSuffix(serverName, "."+d)) && len(d) > matchLen {
+				ca = c
+				matchLen = len(d)
+			}
+		}
+	}
+	return ca
+}
+
+// autocertManager returns the autocert manager of the CA that issues the
+// certificate for serverName.
+func (m *acmeManager) autocertManager(serverName string) *autocert.Manager {
+	ca := m.forName(serverName)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return ca.manager
+}
+
+// defaultAccount returns the directory URL, the External Account Binding,
+// and the HTTP client of the default CA.
+func (m *acmeManager) defaultAccount() (string, *acme.ExternalAccountBinding, *http.Client) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.def.directoryURL(), m.def.eab(), m.def.httpClient()
+}
+
+// setNames sets the server names that get their certificates from the
+// ACME CAs.
+func (m *acmeManager) setNames(names []string) {
+	cas := make(map[string]*acmeCA, len(names))
+	for _, name := range names {
+		cas[name] = m.forName(name)
+	}
+	m.queue.setNames(cas)
+}
+
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := m.autocertManager(hello.ServerName).GetCertificate(hello)
+	if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		var notAfter time.Time
+		if cert != nil && cert.Leaf != nil {
+			notAfter = cert.Leaf.NotAfter
+		}
+		m.queue.done(strings.TrimSuffix(idnaToASCII(hello.ServerName), "."), notAfter, err)
+	}
+	return cert, err
+}
+
+func (m *acmeManager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos: []string{
+			"h2", "http/1.1",
+			acme.ALPNProto,
+		},
+	}
+}
+
+func (m *acmeManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		m.autocertManager(hostFromReq(req)).HTTPHandler(fallback).ServeHTTP(w, req)
+	})
+}
+
+// accountClient returns an ACME client for the account that issued the
+// certificate for serverName.
+func (m *acmeManager) accountClient(ctx context.Context, serverName string) (*acme.Client, error) {
+	ca := m.forName(serverName)
+	key, err := m.accountKey(ctx, ca.accountKeyName())
+	if err != nil {
+		return nil, err
+	}
+	return ca.newClient(key), nil
+}
+
+func (m *acmeManager) accountKey(ctx context.Context, name string) (crypto.Signer, error) {
+	pemAccountKey, err := m.cache.Get(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key: %w", err)
+	}
+	derAccountKey, _ := pem.Decode(pemAccountKey)
+	if derAccountKey == nil {
+		return nil, errors.New("invalid account key")
+	}
+	accountKey, err := parsePrivateKey(derAccountKey.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key: %w", err)
+	}
+	return accountKey, nil
+}
+
+// rotateAccountKeys replaces the account keys that are older than maxAge.
+// It returns the names of the CAs whose keys were rotated.
+func (m *acmeManager) rotateAccountKeys(ctx context.Context, maxAge time.Duration) ([]string, error) {
+	m.mu.RLock()
+	cas := append([]*acmeCA{m.def}, m.cas...)
+	m.mu.RUnlock()
+
+	var rotated []string
+	var errs []error
+	now := time.Now().UTC()
+	for _, ca := range cas {
+		key, err := m.accountKey(ctx, ca.accountKeyName())
+		if errors.Is(err, autocert.ErrCacheMiss) {
+			// The account isn't registered yet.
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+			continue
+		}
+		b, err := m.cache.Get(ctx, ca.rotationTimeName())
+		if errors.Is(err, autocert.ErrCacheMiss) {
+			// Start the clock.
+			if err := m.cache.Put(ctx, ca.rotationTimeName(), []byte(now.Format(time.RFC3339))); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+			}
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, string(b)); err == nil && now.Sub(t) < maxAge {
+			continue
+		}
+		newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return rotated, err
+		}
+		der, err := x509.MarshalECPrivateKey(newKey)
+		if err != nil {
+			return rotated, err
+		}
+		if err := ca.newClient(key).AccountKeyRollover(ctx, newKey); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+			continue
+		}
+		if err := m.cache.Put(ctx, ca.accountKeyName(), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})); err != nil {
+			// The CA already has the new key. There is no way to
+			// recover from this.
+			errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+			continue
+		}
+		if err := m.cache.Put(ctx, ca.rotationTimeName(), []byte(now.Format(time.RFC3339))); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ca.name(), err))
+		}
+		// The autocert manager keeps its ACME client with the old key.
+		m.mu.Lock()
+		mgr := m.newAutocertManager(ca)
+		for _, c := range append([]*acmeCA{m.def}, m.cas...) {
+			if c.sameAccount(ca) {
+				c.manager = mgr
+			}
+		}
+		m.mu.Unlock()
+		rotated = append(rotated, ca.name())
+	}
+	return rotated, errors.Join(errs...)
+}
+
+// acmeAccountCache is a wrapper around the autocert cache that stores the
+// account key under a different name, so that each CA has its own account,
+// and optionally adds a prefix to the other keys.
+type acmeAccountCache struct {
+	autocert.Cache
+	keyName string
+	prefix  string
+}
+
+func (c *acmeAccountCache) key(key string) string {
+	if key == acmeAccountKey {
+		return c.keyName
+	}
+	return c.prefix + key
+}
+
+func (c *acmeAccountCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return c.Cache.Get(ctx, c.key(key))
+}
+
+func (c *acmeAccountCache) Put(ctx context.Context, key string, data []byte) error {
+	return c.Cache.Put(ctx, c.key(key), data)
+}
+
+func (c *acmeAccountCache) Delete(ctx context.Context, key string) error {
+	return c.Cache.Delete(ctx, c.key(key))
+}
+
+// acmeKeyRotationLoop rotates the ACME account keys periodically.
+func (p *Proxy) acmeKeyRotationLoop(ctx context.Context) {
+	m, ok := p.certManager.(*acmeManager)
+	if !ok {
+		return
+	}
+	for {
+		p.mu.RLock()
+		acfg := p.cfg.ACME
+		p.mu.RUnlock()
+		if acfg != nil && acfg.AccountKeyRotation > 0 {
+			rotated, err := m.rotateAccountKeys(ctx, acfg.AccountKeyRotation)
+			for _, name := range rotated {
+				log.Printf("INF Rotated ACME account key for %s", name)
+				p.recordEvent("acme account key rotated")
+			}
+			if len(rotated) > 0 && p.dns01 != nil {
+				// Reset the dns01 client, which may be using the
+				// default CA's old key.
+				p.dns01.SetAccount(m.defaultAccount())
+			}
+			if err != nil && ctx.Err() == nil {
+				log.Printf("ERR ACME account key rotation: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
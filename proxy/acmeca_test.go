@@ -0,0 +1,96 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEManager(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	m := newACMEManager(cache, "admin@example.com")
+	if got, want := m.forName("www.example.com").directoryURL(), autocert.DefaultACMEDirectory; got != want {
+		t.Errorf("directoryURL = %q, want %q", got, want)
+	}
+
+	cfg := &ConfigACME{
+		CertificateAuthorities: []*ConfigACMECA{
+			{Name: "zerossl", DirectoryURL: "https://acme.zerossl.com/v2/DV90"},
+			{Name: "internal", DirectoryURL: "https://ca.example.com/acme/directory", Domains: []string{"example.com"}},
+			{Name: "dev", DirectoryURL: "https://ca.example.com/acme/dev/directory", Domains: []string{"dev.example.com"}},
+		},
+	}
+	m.setConfig(cfg, "admin@example.com")
+	for _, tc := range []struct {
+		serverName string
+		want       string
+	}{
+		{"example.org", "zerossl"},
+		{"example.com", "internal"},
+		{"www.example.com", "internal"},
+		{"notexample.com", "zerossl"},
+		{"dev.example.com", "dev"},
+		{"www.dev.example.com", "dev"},
+	} {
+		if got := m.forName(tc.serverName).name(); got != tc.want {
+			t.Errorf("forName(%q) = %q, want %q", tc.serverName, got, tc.want)
+		}
+	}
+
+	// The autocert managers are kept when the accounts don't change.
+	internal := m.autocertManager("example.com")
+	zerossl := m.autocertManager("example.org")
+	cfg2 := &ConfigACME{
+		CertificateAuthorities: []*ConfigACMECA{
+			{Name: "zerossl", DirectoryURL: "https://acme.zerossl.com/v2/DV90", EABKeyID: "kid", EABHMACKey: "c2VjcmV0"},
+			{Name: "internal", DirectoryURL: "https://ca.example.com/acme/directory", Domains: []string{"example.com", "example.net"}},
+		},
+	}
+	m.setConfig(cfg2, "admin@example.com")
+	if m.autocertManager("example.net") != internal {
+		t.Error("internal CA manager was replaced")
+	}
+	if m.autocertManager("example.org") == zerossl {
+		t.Error("zerossl CA manager was not replaced")
+	}
+	if got, want := m.forName("dev.example.com").name(), "internal"; got != want {
+		t.Errorf("forName(dev.example.com) = %q, want %q", got, want)
+	}
+
+	// Each CA has its own account key.
+	ctx := context.Background()
+	ac := internal.Cache
+	if err := ac.Put(ctx, acmeAccountKey, []byte("internal key")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, err := cache.Get(ctx, acmeAccountKey); err != autocert.ErrCacheMiss {
+		t.Errorf("Get(%q) = %v, want ErrCacheMiss", acmeAccountKey, err)
+	}
+	if b, err := cache.Get(ctx, acmeAccountKey+"+internal"); err != nil || string(b) != "internal key" {
+		t.Errorf("Get(%q) = %q, %v", acmeAccountKey+"+internal", b, err)
+	}
+}
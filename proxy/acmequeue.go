@@ -0,0 +1,522 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	issuanceMinBackoff = 5 * time.Minute
+	issuanceMaxBackoff = 24 * time.Hour
+
+	// Let's Encrypt issues at most 50 certificates per registered domain
+	// per week.
+	// https://letsencrypt.org/docs/rate-limits/
+	maxCertsPerDomain    = 50
+	certsPerDomainWindow = 7 * 24 * time.Hour
+	defaultRateLimitWait = time.Hour
+
+	// maxUnconfiguredNames is the maximum number of server names that
+	// aren't configured explicitly, e.g. the ones that match
+	// ServerNameRegexps, that are tracked at the same time.
+	maxUnconfiguredNames = 1000
+)
+
+// The issuance status of a server name.
+const (
+	issuancePending     = "pending"
+	issuanceIssuing     = "issuing"
+	issuanceValid       = "valid"
+	issuanceFailed      = "failed"
+	issuanceRateLimited = "rate limited"
+	issuanceInvalid     = "invalid"
+)
+
+// issuanceQueue controls the issuance of ACME certificates. The number of
+// concurrent certificate requests is limited. Server names that fail are retried with
+// exponential backoff, and the rate limits of the CA are respected. In the
+// meantime, TLS handshakes for these names fail immediately instead of
+// triggering a new attempt.
+type issuanceQueue struct {
+	recordEvent func(string)
+	// onDemand returns the backend that allows name, which isn't
+	// configured, to get a certificate on demand, and the maximum number
+	// of certificates that this backend can request on demand per week.
+	// It returns false if name can't get a certificate on demand.
+	onDemand func(name string) (backend string, maxPerWeek int, ok bool)
+
+	mu             sync.Mutex
+	sem            chan struct{}
+	names          map[string]*issuanceState
+	issued         map[string][]time.Time
+	onDemandIssued map[string][]time.Time
+	pausedUntil    time.Time
+}
+
+type issuanceState struct {
+	ca          string
+	status      string
+	err         string
+	failures    int
+	nextAttempt time.Time
+	notAfter    time.Time
+	configured  bool
+	waiting     int
+	held        []chan struct{}
+}
+
+// issuanceStatus is the issuance status of one server name.
+type issuanceStatus struct {
+	ServerName  string
+	CA          string
+	Status      string
+	Error       string
+	NextAttempt time.Time
+	NotAfter    time.Time
+}
+
+func newIssuanceQueue() *issuanceQueue {
+	return &issuanceQueue{
+		sem:            make(chan struct{}, 1),
+		names:          make(map[string]*issuanceState),
+		issued:         make(map[string][]time.Time),
+		onDemandIssued: make(map[string][]time.Time),
+	}
+}
+
+// acmeServerNames returns the configured server names that get their
+// certificates from the ACME CAs with the http-01 or tls-alpn-01 challenges.
+func (p *Proxy) acmeServerNames(cfg *Config) []string {
+	var names []string
+	for _, be := range cfg.Backends {
+		if be.staticCert != nil || be.Mode == ModeTLSPassthrough || be.Mode == ModeQUICPassthrough {
+			continue
+		}
+		for _, sn := range be.ServerNames {
+			if sn == CatchAllServerName || (p.dns01 != nil && p.dns01.Covers(sn)) {
+				continue
+			}
+			names = append(names, sn)
+		}
+	}
+	return names
+}
+
+// acmeOnDemand returns the backend that allows name, a server name that
+// isn't configured explicitly, to get a certificate on demand, and the
+// maximum number of certificates that this backend can request on demand
+// per week.
+func (p *Proxy) acmeOnDemand(name string) (string, int, bool) {
+	be, err := p.backend(name)
+	if err != nil || be.OnDemandCertificates == nil || be.staticCert != nil {
+		return "", 0, false
+	}
+	if be.Mode == ModeTLSPassthrough || be.Mode == ModeQUICPassthrough {
+		return "", 0, false
+	}
+	if p.dns01 != nil && p.dns01.Covers(name) {
+		return "", 0, false
+	}
+	return be.displayName(), be.OnDemandCertificates.MaxPerWeek, true
+}
+
+// setConcurrency sets the maximum number of concurrent certificate
+// requests. The requests that are already in progress are not affected.
+func (q *issuanceQueue) setConcurrency(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	if cap(q.sem) != n {
+		q.sem = make(chan struct{}, n)
+	}
+}
+
+// validateACMEName returns an error if the CA can't issue a certificate for
+// name.
+func validateACMEName(name string, ca *acmeCA) error {
+	if net.ParseIP(name) != nil {
+		return errors.New("IP addresses are not supported")
+	}
+	if !strings.Contains(name, ".") {
+		return errors.New("not a fully qualified domain name")
+	}
+	if strings.HasPrefix(name, "*.") {
+		return errors.New("wildcard names require the dns-01 challenge")
+	}
+	if ca.isLetsEncrypt() {
+		if suffix, icann := publicsuffix.PublicSuffix(name); !icann && !strings.Contains(suffix, ".") {
+			return fmt.Errorf("%q is not a public domain", suffix)
+		}
+	}
+	return nil
+}
+
+// setNames sets the configured server names, with their CAs. Names that
+// aren't configured anymore are forgotten, unless they are waiting for a
+// retry.
+func (q *issuanceQueue) setNames(names map[string]*acmeCA) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string]*issuanceState, len(names))
+	for name, ca := range names {
+		st := q.names[name]
+		if st == nil || st.ca != ca.name() {
+			st = &issuanceState{ca: ca.name(), status: issuancePending}
+		}
+		st.configured = true
+		if err := validateACMEName(name, ca); err != nil {
+			if st.status != issuanceInvalid {
+				log.Printf("WRN ACME: %s: %v", idnaToUnicode(name), err)
+			}
+			st.status = issuanceInvalid
+			st.err = err.Error()
+		} else if st.status == issuanceInvalid {
+			st.status = issuancePending
+			st.err = ""
+		}
+		out[name] = st
+	}
+	now := time.Now()
+	for name, st := range q.names {
+		if _, ok := out[name]; !ok && now.Before(st.nextAttempt) {
+			st.configured = false
+			out[name] = st
+		}
+	}
+	q.names = out
+}
+
+// setValid records that name has a valid certificate, e.g. one that was
+// found in the cache.
+func (q *issuanceQueue) setValid(name string, notAfter time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if st := q.names[name]; st != nil && len(st.held) == 0 {
+		st.status = issuanceValid
+		st.err = ""
+		st.failures = 0
+		st.nextAttempt = time.Time{}
+		st.notAfter = notAfter
+	}
+}
+
+// admit is called by autocert before a new certificate is requested for
+// name. It returns an error when the request shouldn't be sent now.
+// Otherwise, it waits for its turn. done must be called after the request.
+func (q *issuanceQueue) admit(ctx context.Context, name string, ca *acmeCA) error {
+	var (
+		backend    string
+		maxPerWeek int
+		onDemand   bool
+	)
+	if q.onDemand != nil {
+		backend, maxPerWeek, onDemand = q.onDemand(name)
+	}
+	now := time.Now()
+	q.mu.Lock()
+	st := q.names[name]
+	if st == nil {
+		// A name that isn't configured explicitly, e.g. one that
+		// matches ServerNameRegexps. Each new name counts against
+		// the backend's on-demand allowance.
+		if !onDemand {
+			q.mu.Unlock()
+			return fmt.Errorf("acme: %s: on-demand certificates are not enabled", name)
+		}
+		if q.pruneUnconfigured(now) >= maxUnconfiguredNames {
+			q.mu.Unlock()
+			return fmt.Errorf("acme: %s: too many server names that aren't configured", name)
+		}
+		recent := slices.DeleteFunc(q.onDemandIssued[backend], func(t time.Time) bool {
+			return now.Sub(t) >= certsPerDomainWindow
+		})
+		if len(recent) >= maxPerWeek {
+			q.onDemandIssued[backend] = recent
+			q.mu.Unlock()
+			return fmt.Errorf("acme: %s: too many on-demand certificates for %s", name, backend)
+		}
+		q.onDemandIssued[backend] = append(recent, now)
+		st = &issuanceState{ca: ca.name(), status: issuancePending}
+		if err := validateACMEName(name, ca); err != nil {
+			st.status = issuanceInvalid
+			st.err = err.Error()
+		}
+		q.names[name] = st
+	}
+	if st.status == issuanceInvalid {
+		q.mu.Unlock()
+		return fmt.Errorf("acme: %s: %s", name, st.err)
+	}
+	if now.Before(q.pausedUntil) {
+		st.status = issuanceRateLimited
+		st.nextAttempt = q.pausedUntil
+		q.mu.Unlock()
+		return fmt.Errorf("acme: %s: rate limited until %s", name, q.pausedUntil.Format(time.RFC3339))
+	}
+	if now.Before(st.nextAttempt) {
+		q.mu.Unlock()
+		return fmt.Errorf("acme: %s: next attempt at %s: %s", name, st.nextAttempt.Format(time.RFC3339), st.err)
+	}
+	// The per-domain limit of Let's Encrypt is also applied to the other
+	// CAs, which have similar limits.
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		domain = name
+	}
+	var recent []time.Time
+	for _, t := range q.issued[domain] {
+		if now.Sub(t) < certsPerDomainWindow {
+			recent = append(recent, t)
+		}
+	}
+	q.issued[domain] = recent
+	if len(recent) >= maxCertsPerDomain {
+		st.status = issuanceRateLimited
+		st.nextAttempt = recent[0].Add(certsPerDomainWindow)
+		st.err = fmt.Sprintf("too many certificates for %s", domain)
+		q.mu.Unlock()
+		return fmt.Errorf("acme: %s: %s", name, st.err)
+	}
+	sem := q.sem
+	st.waiting++
+	q.mu.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		q.mu.Lock()
+		st.waiting--
+		q.mu.Unlock()
+		return ctx.Err()
+	}
+	q.mu.Lock()
+	st.waiting--
+	st.status = issuanceIssuing
+	st.held = append(st.held, sem)
+	q.mu.Unlock()
+	return nil
+}
+
+// pruneUnconfigured forgets the server names that aren't configured, and
+// that aren't being issued or waiting for a retry. It returns the number of
+// unconfigured names that are left. q.mu must be held.
+func (q *issuanceQueue) pruneUnconfigured(now time.Time) int {
+	var n int
+	for name, st := range q.names {
+		if st.configured {
+			continue
+		}
+		if st.waiting == 0 && len(st.held) == 0 && !now.Before(st.nextAttempt) {
+			delete(q.names, name)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// done records the result of a certificate request for name.
+func (q *issuanceQueue) done(name string, notAfter time.Time, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := q.names[name]
+	if st == nil {
+		return
+	}
+	if len(st.held) == 0 {
+		// The certificate was already available, or no request was
+		// sent.
+		if err == nil {
+			st.status = issuanceValid
+			st.notAfter = notAfter
+		}
+		return
+	}
+	<-st.held[len(st.held)-1]
+	st.held = st.held[:len(st.held)-1]
+
+	now := time.Now()
+	if err == nil {
+		st.status = issuanceValid
+		st.err = ""
+		st.failures = 0
+		st.nextAttempt = time.Time{}
+		st.notAfter = notAfter
+		domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+		if err != nil {
+			domain = name
+		}
+		q.issued[domain] = append(q.issued[domain], now)
+		return
+	}
+	st.err = err.Error()
+	var ae *acme.Error
+	if errors.As(err, &ae) {
+		if d, ok := acme.RateLimit(ae); ok {
+			if d <= 0 {
+				d = defaultRateLimitWait
+			}
+			q.pausedUntil = now.Add(d)
+			st.status = issuanceRateLimited
+			st.nextAttempt = q.pausedUntil
+			log.Printf("WRN ACME: rate limited until %s: %v", q.pausedUntil.Format(time.RFC3339), err)
+			if q.recordEvent != nil {
+				q.recordEvent("acme rate limited")
+			}
+			return
+		}
+	}
+	st.failures++
+	backoff := issuanceMaxBackoff
+	if st.failures < 10 {
+		backoff = min(issuanceMinBackoff<<(st.failures-1), issuanceMaxBackoff)
+	}
+	st.status = issuanceFailed
+	st.nextAttempt = now.Add(backoff)
+	log.Printf("ERR ACME: %s: %v (next attempt in %s)", idnaToUnicode(name), err, backoff)
+	if q.recordEvent != nil {
+		q.recordEvent("acme certificate error")
+	}
+}
+
+// status returns the issuance status of all the server names.
+func (q *issuanceQueue) status() []issuanceStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]issuanceStatus, 0, len(q.names))
+	for name, st := range q.names {
+		out = append(out, issuanceStatus{
+			ServerName:  idnaToUnicode(name),
+			CA:          st.ca,
+			Status:      st.status,
+			Error:       st.err,
+			NextAttempt: st.nextAttempt,
+			NotAfter:    st.notAfter,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ServerName < out[j].ServerName
+	})
+	return out
+}
+
+// prewarmNames returns the configured server names whose certificates can be
+// requested now.
+func (q *issuanceQueue) prewarmNames() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	if now.Before(q.pausedUntil) {
+		return nil
+	}
+	var names []string
+	for name, st := range q.names {
+		if !st.configured || st.status == issuanceInvalid || now.Before(st.nextAttempt) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prewarm obtains the certificates of the configured server names, or loads
+// them from the cache. It returns the number of certificates that are ready.
+func (m *acmeManager) prewarm(ctx context.Context) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var count int
+	for _, name := range m.queue.prewarmNames() {
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// autocert wants a ClientHelloInfo. Create one with
+			// reasonable values.
+			hello := &tls.ClientHelloInfo{
+				ServerName:      name,
+				SupportedCurves: []tls.CurveID{tls.CurveP256},
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+				},
+			}
+			if _, err := m.GetCertificate(hello); err == nil {
+				mu.Lock()
+				count++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return count
+}
+
+// prewarmLoop obtains the certificates of the configured server names when
+// the proxy starts and every time the config changes, if Prewarm is set.
+func (p *Proxy) prewarmLoop(ctx context.Context) {
+	m, ok := p.certManager.(*acmeManager)
+	if !ok {
+		return
+	}
+	// The config was already loaded.
+	select {
+	case <-p.prewarmCh:
+	default:
+	}
+	for {
+		p.mu.RLock()
+		acfg := p.cfg.ACME
+		p.mu.RUnlock()
+		if acfg != nil && acfg.Prewarm {
+			if n := m.prewarm(ctx); n > 0 {
+				log.Printf("INF ACME: %d certificate(s) ready", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.prewarmCh:
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestValidateACMEName(t *testing.T) {
+	le := &acmeCA{}
+	private := &acmeCA{cfg: &ConfigACMECA{Name: "private", DirectoryURL: "https://ca.example.com/acme/directory"}}
+	for _, tc := range []struct {
+		name    string
+		ca      *acmeCA
+		wantErr bool
+	}{
+		{"www.example.com", le, false},
+		{"foo.github.io", le, false},
+		{"192.168.0.1", le, true},
+		{"localhost", le, true},
+		{"*.example.com", le, true},
+		{"host.internal", le, true},
+		{"host.internal", private, false},
+	} {
+		if err := validateACMEName(tc.name, tc.ca); (err != nil) != tc.wantErr {
+			t.Errorf("validateACMEName(%q, %s) = %v, want err %v", tc.name, tc.ca.name(), err, tc.wantErr)
+		}
+	}
+}
+
+func TestIssuanceQueue(t *testing.T) {
+	ctx := context.Background()
+	ca := &acmeCA{}
+	q := newIssuanceQueue()
+	q.onDemand = func(string) (string, int, bool) { return "example.com", 10, true }
+	q.setNames(map[string]*acmeCA{
+		"www.example.com": ca,
+		"bad.internal":    ca,
+	})
+
+	status := func(name string) issuanceStatus {
+		t.Helper()
+		for _, st := range q.status() {
+			if st.ServerName == name {
+				return st
+			}
+		}
+		t.Fatalf("%s not found", name)
+		return issuanceStatus{}
+	}
+	if got, want := status("www.example.com").Status, issuancePending; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	if got, want := status("bad.internal").Status, issuanceInvalid; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	if err := q.admit(ctx, "bad.internal", ca); err == nil {
+		t.Error("admit(bad.internal) succeeded unexpectedly")
+	}
+
+	// A failure is retried after a backoff.
+	if err := q.admit(ctx, "www.example.com", ca); err != nil {
+		t.Fatalf("admit() = %v", err)
+	}
+	if got, want := status("www.example.com").Status, issuanceIssuing; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	q.done("www.example.com", time.Time{}, errors.New("challenge failed"))
+	st := status("www.example.com")
+	if st.Status != issuanceFailed || st.Error != "challenge failed" {
+		t.Errorf("status = %+v", st)
+	}
+	if d := time.Until(st.NextAttempt); d < issuanceMinBackoff-time.Minute || d > issuanceMinBackoff {
+		t.Errorf("next attempt in %s, want %s", d, issuanceMinBackoff)
+	}
+	if err := q.admit(ctx, "www.example.com", ca); err == nil {
+		t.Error("admit() succeeded during backoff")
+	}
+
+	// A rate limit error pauses all the names.
+	q.names["www.example.com"].nextAttempt = time.Time{}
+	if err := q.admit(ctx, "www.example.com", ca); err != nil {
+		t.Fatalf("admit() = %v", err)
+	}
+	q.done("www.example.com", time.Time{}, &acme.Error{
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+		Header:      http.Header{"Retry-After": []string{"3600"}},
+	})
+	if got, want := status("www.example.com").Status, issuanceRateLimited; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+	if err := q.admit(ctx, "other.example.com", ca); err == nil {
+		t.Error("admit(other.example.com) succeeded while rate limited")
+	}
+
+	// Success.
+	q.pausedUntil = time.Time{}
+	q.names["www.example.com"].nextAttempt = time.Time{}
+	if err := q.admit(ctx, "www.example.com", ca); err != nil {
+		t.Fatalf("admit() = %v", err)
+	}
+	notAfter := time.Now().Add(90 * 24 * time.Hour)
+	q.done("www.example.com", notAfter, nil)
+	if st := status("www.example.com"); st.Status != issuanceValid || st.Error != "" || !st.NotAfter.Equal(notAfter) {
+		t.Errorf("status = %+v", st)
+	}
+	if got := len(q.issued["example.com"]); got != 1 {
+		t.Errorf("issued = %d, want 1", got)
+	}
+
+	// Too many certificates for the same registered domain.
+	for range maxCertsPerDomain {
+		q.issued["example.com"] = append(q.issued["example.com"], time.Now())
+	}
+	if err := q.admit(ctx, "new.example.com", ca); err == nil {
+		t.Error("admit(new.example.com) succeeded with too many certificates")
+	}
+	private := &acmeCA{cfg: &ConfigACMECA{Name: "private", DirectoryURL: "https://ca.example.com/acme/directory"}}
+	if err := q.admit(ctx, "private.example.com", private); err == nil {
+		t.Error("admit(private.example.com) succeeded with too many certificates")
+	}
+
+	// Names that are waiting for a retry are kept when they are removed
+	// from the config.
+	q.setNames(nil)
+	var names []string
+	for _, st := range q.status() {
+		names = append(names, st.ServerName)
+	}
+	if got, want := names, []string{"new.example.com", "other.example.com", "private.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func TestIssuanceConcurrency(t *testing.T) {
+	ca := &acmeCA{}
+	q := newIssuanceQueue()
+	q.onDemand = func(string) (string, int, bool) { return "example.com", 10, true }
+	q.setConcurrency(2)
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		if err := q.admit(context.Background(), name, ca); err != nil {
+			t.Fatalf("admit(%q) = %v", name, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := q.admit(ctx, "c.example.com", ca); err != context.DeadlineExceeded {
+		t.Fatalf("admit(c.example.com) = %v, want %v", err, context.DeadlineExceeded)
+	}
+	q.done("a.example.com", time.Now().Add(time.Hour), nil)
+	if err := q.admit(context.Background(), "c.example.com", ca); err != nil {
+		t.Fatalf("admit(c.example.com) = %v", err)
+	}
+}
+
+func TestIssuanceOnDemand(t *testing.T) {
+	ctx := context.Background()
+	ca := &acmeCA{}
+	q := newIssuanceQueue()
+	q.setConcurrency(10)
+	if err := q.admit(ctx, "a.example.com", ca); err == nil || !strings.Contains(err.Error(), "on-demand certificates are not enabled") {
+		t.Errorf("admit(a.example.com) = %v", err)
+	}
+
+	q.onDemand = func(name string) (string, int, bool) {
+		return "*.example.com", 2, strings.HasSuffix(name, ".example.com")
+	}
+	if err := q.admit(ctx, "a.example.net", ca); err == nil {
+		t.Error("admit(a.example.net) succeeded unexpectedly")
+	}
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		if err := q.admit(ctx, name, ca); err != nil {
+			t.Fatalf("admit(%s) = %v", name, err)
+		}
+		q.done(name, time.Time{}, errors.New("failed"))
+	}
+	if err := q.admit(ctx, "c.example.com", ca); err == nil || !strings.Contains(err.Error(), "too many on-demand certificates") {
+		t.Errorf("admit(c.example.com) = %v", err)
+	}
+	// A name that was already admitted doesn't count again.
+	q.names["a.example.com"].nextAttempt = time.Time{}
+	if err := q.admit(ctx, "a.example.com", ca); err != nil {
+		t.Errorf("admit(a.example.com) = %v", err)
+	}
+	// The allowance is per week.
+	for i := range q.onDemandIssued["*.example.com"] {
+		q.onDemandIssued["*.example.com"][i] = time.Now().Add(-certsPerDomainWindow)
+	}
+	if err := q.admit(ctx, "c.example.com", ca); err != nil {
+		t.Errorf("admit(c.example.com) = %v", err)
+	}
+}
+
+func TestIssuanceUnconfiguredLimit(t *testing.T) {
+	ctx := context.Background()
+	ca := &acmeCA{}
+	q := newIssuanceQueue()
+	q.onDemand = func(string) (string, int, bool) { return "example.com", 2 * maxUnconfiguredNames, true }
+	for i := range maxUnconfiguredNames {
+		name := fmt.Sprintf("host%d.example.com", i)
+		if err := q.admit(ctx, name, ca); err != nil {
+			t.Fatalf("admit(%s) = %v", name, err)
+		}
+		q.done(name, time.Time{}, errors.New("failed"))
+		delete(q.issued, "example.com")
+	}
+	if err := q.admit(ctx, "new.example.com", ca); err == nil || !strings.Contains(err.Error(), "too many server names") {
+		t.Errorf("admit(new.example.com) = %v", err)
+	}
+
+	// The names are forgotten after their backoff.
+	for _, st := range q.names {
+		st.nextAttempt = time.Time{}
+	}
+	if err := q.admit(ctx, "new.example.com", ca); err != nil {
+		t.Errorf("admit(new.example.com) = %v", err)
+	}
+	if got := len(q.names); got != 1 {
+		t.Errorf("len(names) = %d, want 1", got)
+	}
+}
+
+func TestACMEOnDemand(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:       []string{"*.example.com"},
+				ServerNameRegexps: []string{`app-[0-9]+\.example\.org`},
+				Addresses:         []string{"127.0.0.1:1"},
+			},
+			{
+				ServerNameRegexps:    []string{`[a-z]+\.example\.net`},
+				Addresses:            []string{"127.0.0.1:1"},
+				OnDemandCertificates: &OnDemandCertificates{MaxPerWeek: 5},
+			},
+		},
+	}
+	p := newTestProxy(cfg, extCA)
+	for _, name := range []string{"www.example.com", "app-1.example.org", "unknown.example.org"} {
+		if _, _, ok := p.acmeOnDemand(name); ok {
+			t.Errorf("acmeOnDemand(%s) = true", name)
+		}
+	}
+	if backend, max, ok := p.acmeOnDemand("www.example.net"); !ok || backend != `[a-z]+\.example\.net` || max != 5 {
+		t.Errorf("acmeOnDemand(www.example.net) = %q, %d, %v", backend, max, ok)
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	ctx := context.Background()
+	cache := autocert.DirCache(t.TempDir())
+
+	// The certificate of www.example.com is already in the cache.
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, templ, templ, privKey.Public(), privKey)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKCS8PrivateKey: %v", err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	if err := cache.Put(ctx, "www.example.com", data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	m := newACMEManager(cache, "")
+	m.setConfig(&ConfigACME{
+		CertificateAuthorities: []*ConfigACMECA{
+			{Name: "unreachable", DirectoryURL: "http://127.0.0.1:1/directory"},
+		},
+		MaxConcurrentIssuance: 2,
+	}, "")
+	m.setNames([]string{"www.example.com", "new.example.com", "localhost"})
+
+	if got, want := m.prewarm(ctx), 1; got != want {
+		t.Errorf("prewarm() = %d, want %d", got, want)
+	}
+	got := make(map[string]string)
+	for _, st := range m.queue.status() {
+		got[st.ServerName] = st.Status
+	}
+	want := map[string]string{
+		"www.example.com": issuanceValid,
+		"new.example.com": issuanceFailed,
+		"localhost":       issuanceInvalid,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("status[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+	if got, want := m.queue.prewarmNames(), []string{"www.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("prewarmNames() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,177 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/consul"
+)
+
+const (
+	defaultAddressRefreshInterval = 30 * time.Second
+	addressRetryInterval          = 5 * time.Second
+)
+
+// addressResolver gets a backend's server addresses from a DNS SRV record or
+// a Consul service, and refreshes them periodically. The addresses are
+// replaced atomically.
+type addressResolver struct {
+	cfg    AddressDiscovery
+	addrs  atomic.Pointer[[]string]
+	cancel context.CancelFunc
+
+	lookupSRV func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+func newAddressResolver(cfg AddressDiscovery) *addressResolver {
+	return &addressResolver{
+		cfg:       cfg,
+		lookupSRV: net.DefaultResolver.LookupSRV,
+	}
+}
+
+// start resolves the addresses and refreshes them periodically until ctx is
+// canceled or stop is called.
+func (r *addressResolver) start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	err := r.resolve(ctx)
+	go func() {
+		for {
+			interval := r.cfg.RefreshInterval
+			if interval == 0 {
+				interval = defaultAddressRefreshInterval
+			}
+			if err != nil {
+				interval = min(interval, addressRetryInterval)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			err = r.resolve(ctx)
+		}
+	}()
+}
+
+func (r *addressResolver) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+func (r *addressResolver) name() string {
+	if r.cfg.SRV != "" {
+		return "SRV " + r.cfg.SRV
+	}
+	return "Consul service " + r.cfg.ConsulService
+}
+
+func (r *addressResolver) resolve(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var addrs []string
+	var err error
+	if r.cfg.SRV != "" {
+		addrs, err = r.resolveSRV(ctx)
+	} else {
+		addrs, err = r.resolveConsul(ctx)
+	}
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		if ctx.Err() == nil || r.addrs.Load() == nil {
+			log.Printf("ERR %s: %v", r.name(), err)
+		}
+		return err
+	}
+	slices.Sort(addrs)
+	if old := r.addrs.Load(); old == nil || !slices.Equal(*old, addrs) {
+		log.Printf("INF %s: %s", r.name(), strings.Join(addrs, " "))
+	}
+	r.addrs.Store(&addrs)
+	return nil
+}
+
+func (r *addressResolver) resolveSRV(ctx context.Context) ([]string, error) {
+	_, records, err := r.lookupSRV(ctx, "", "", r.cfg.SRV)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, rec := range records {
+		// The records are sorted by priority.
+		if rec.Priority != records[0].Priority {
+			break
+		}
+		if rec.Target == "." {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+	}
+	return addrs, nil
+}
+
+func (r *addressResolver) resolveConsul(ctx context.Context) ([]string, error) {
+	client, err := consul.New(r.cfg.ConsulAddress, r.cfg.ConsulToken)
+	if err != nil {
+		return nil, err
+	}
+	return client.HealthyAddresses(ctx, r.cfg.ConsulService, r.cfg.ConsulTag)
+}
+
+// addresses returns the current addresses. The list is empty until the
+// addresses are resolved successfully.
+func (r *addressResolver) addresses() []string {
+	addrs := r.addrs.Load()
+	if addrs == nil {
+		return nil
+	}
+	return *addrs
+}
+
+// addresses returns the backend's server addresses.
+func (be *Backend) addresses() []string {
+	if be.addrResolver != nil {
+		return be.addrResolver.addresses()
+	}
+	if len(be.AddressGroups) > 0 {
+		var out []string
+		for _, g := range be.AddressGroups {
+			out = append(out, g.Addresses...)
+		}
+		return out
+	}
+	return be.Addresses
+}
@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestAddressDiscoverySRV(t *testing.T) {
+	r := newAddressResolver(AddressDiscovery{SRV: "_x._tcp.example.com"})
+	r.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", []*net.SRV{
+			{Target: "b.example.com.", Port: 443, Priority: 10},
+			{Target: "a.example.com.", Port: 8443, Priority: 10},
+			{Target: "c.example.com.", Port: 443, Priority: 20},
+		}, nil
+	}
+	if err := r.resolve(context.Background()); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if got, want := r.addresses(), []string{"a.example.com:8443", "b.example.com:443"}; !slices.Equal(got, want) {
+		t.Errorf("addresses() = %q, want %q", got, want)
+	}
+
+	// The previous addresses are kept when a lookup fails.
+	r.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if err := r.resolve(context.Background()); err == nil {
+		t.Fatal("resolve should fail")
+	}
+	if got := r.addresses(); len(got) != 2 {
+		t.Errorf("addresses() = %q, want the previous addresses", got)
+	}
+}
+
+func TestAddressDiscoveryConsul(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	var mu sync.Mutex
+	healthy := be1.listener.Addr().(*net.TCPAddr)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/health/service/foo" || req.FormValue("passing") != "true" || req.FormValue("tag") != "blue" {
+			http.NotFound(w, req)
+			return
+		}
+		if got, want := req.Header.Get("X-Consul-Token"), "secret"; got != want {
+			t.Errorf("X-Consul-Token = %q, want %q", got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode([]map[string]any{{
+			"Node":    map[string]any{"Address": healthy.IP.String()},
+			"Service": map[string]any{"Port": healthy.Port},
+		}})
+	}))
+	defer consul.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"foo.example.com"},
+				AddressDiscovery: &AddressDiscovery{
+					ConsulService:   "foo",
+					ConsulTag:       "blue",
+					ConsulAddress:   consul.URL,
+					ConsulToken:     "secret",
+					RefreshInterval: 100 * time.Millisecond,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func() string {
+		got, _, err := tlsGet("foo.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+		return got
+	}
+	if got, want := get(), "Hello from backend1\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	mu.Lock()
+	healthy = be2.listener.Addr().(*net.TCPAddr)
+	mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	if got, want := get(), "Hello from backend2\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,510 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// errNotFound is returned by the admin API when the requested object doesn't
+// exist.
+var errNotFound = errors.New("not found")
+
+// adminHandlers returns the handlers of the admin API. They are added to the
+// console backend, which enforces its own authentication and authorization
+// policies.
+func (p *Proxy) adminHandlers() []localHandler {
+	return []localHandler{
+		{desc: "Admin API: Config", path: "/api/config", handler: logHandler(adminGet(p.adminConfig)), role: consoleRoleViewer},
+		{desc: "Admin API: Update Config", path: "/api/config/update", handler: logHandler(adminPost(p.adminUpdateConfig)), role: consoleRoleAdmin},
+		{desc: "Admin API: Config Revisions", path: "/api/config/revisions", handler: logHandler(adminGet(p.adminConfigRevisions)), role: consoleRoleViewer},
+		{desc: "Admin API: Rollback Config", path: "/api/config/rollback", handler: logHandler(adminPost(p.adminRollbackConfig)), role: consoleRoleAdmin},
+		{desc: "Admin API: Connections", path: "/api/connections", handler: logHandler(adminGet(p.adminConnections)), role: consoleRoleViewer},
+		{desc: "Admin API: Close Connection", path: "/api/connections/close", handler: logHandler(adminPost(p.adminCloseConnection)), role: consoleRoleAdmin},
+		{desc: "Admin API: Handshake Transcripts", path: "/api/transcripts", handler: logHandler(adminGet(p.adminTranscripts)), role: consoleRoleViewer},
+		{desc: "Admin API: Events", path: "/api/events", handler: logHandler(adminGet(p.adminEvents)), role: consoleRoleViewer},
+		{desc: "Admin API: Backends", path: "/api/backends", handler: logHandler(adminGet(p.adminBackends)), role: consoleRoleViewer},
+		{desc: "Admin API: Drain Backend", path: "/api/backends/drain", handler: logHandler(adminPost(p.adminDrainBackend)), role: consoleRoleAdmin},
+		{desc: "Admin API: Enable Backend", path: "/api/backends/enable", handler: logHandler(adminPost(p.adminEnableBackend)), role: consoleRoleAdmin},
+		{desc: "Admin API: Response Caches", path: "/api/cache", handler: logHandler(adminGet(p.adminCacheStats)), role: consoleRoleViewer},
+		{desc: "Admin API: Purge Response Cache", path: "/api/cache/purge", handler: logHandler(adminPost(p.adminPurgeCache)), role: consoleRoleAdmin},
+		{desc: "Admin API: Traffic Splits", path: "/api/traffic-split", handler: logHandler(adminGet(p.adminTrafficSplits)), role: consoleRoleViewer},
+		{desc: "Admin API: Set Traffic Split Weight", path: "/api/traffic-split/weight", handler: logHandler(adminPost(p.adminSetSplitWeight)), role: consoleRoleAdmin},
+		{desc: "Admin API: Certificates", path: "/api/certificates", handler: logHandler(adminGet(p.adminCertificates)), role: consoleRoleViewer},
+		{desc: "Admin API: Renew Certificate", path: "/api/certificates/renew", handler: logHandler(adminPost(p.adminRenewCertificate)), role: consoleRoleAdmin},
+		{desc: "Admin API: Rotate Master Key", path: "/api/masterkey/rotate", handler: logHandler(adminPost(p.adminRotateMasterKey)), role: consoleRoleAdmin},
+		{desc: "Admin API: Change Passphrase", path: "/api/masterkey/passphrase", handler: logHandler(adminPost(p.adminChangePassphrase)), role: consoleRoleAdmin},
+		{desc: "Admin API: Export Master Key", path: "/api/masterkey/export", handler: logHandler(adminPost(p.adminExportMasterKey)), role: consoleRoleAdmin},
+		{desc: "Admin API: Key Store CSR", path: "/api/keystores/csr", handler: logHandler(adminPost(p.adminKeyStoreCSR)), role: consoleRoleAdmin},
+	}
+}
+
+// adminGet returns a handler that responds to GET requests with the JSON
+// encoding of the value returned by f.
+func adminGet(f func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req.ParseForm()
+		v, err := f(req)
+		adminRespond(w, v, err)
+	}
+}
+
+// adminPost returns a handler that responds to POST requests with the JSON
+// encoding of the value returned by f. The requests must have the
+// x-csrf-check header, and must not come from another site.
+func adminPost(f func(*http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if v := req.Header.Get("x-csrf-check"); v != "1" {
+			log.Printf("ERR x-csrf-check: %v", v)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !sameOriginRequest(req) {
+			log.Printf("ERR cross-origin admin request: origin=%q sec-fetch-site=%q", req.Header.Get("Origin"), req.Header.Get("Sec-Fetch-Site"))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		req.ParseForm()
+		v, err := f(req)
+		adminRespond(w, v, err)
+	}
+}
+
+// sameOriginRequest returns false when the browser indicates that req was
+// sent by a page from another origin. Requests from other clients, e.g. curl,
+// don't have these headers.
+func sameOriginRequest(req *http.Request) bool {
+	switch req.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == req.Host
+}
+
+func adminRespond(w http.ResponseWriter, v any, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errors.ErrUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("ERR admin api: %v", err)
+	}
+}
+
+// adminConfig returns the current config, with secrets redacted. The field
+// names are the same as in the config file.
+func (p *Proxy) adminConfig(*http.Request) (any, error) {
+	p.mu.RLock()
+	cfg := p.cfg.redacted()
+	p.mu.RUnlock()
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]any
+	if err := yaml.Unmarshal(b, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type adminConnection struct {
+	ID            uint64    `json:"id"`
+	Type          string    `json:"type"`
+	SourceAddr    string    `json:"sourceAddr"`
+	LocalAddr     string    `json:"localAddr"`
+	ServerName    string    `json:"serverName,omitempty"`
+	Mode          string    `json:"mode,omitempty"`
+	Proto         string    `json:"proto,omitempty"`
+	HTTPUpgrade   string    `json:"httpUpgrade,omitempty"`
+	ProxyProto    string    `json:"proxyProto,omitempty"`
+	ClientID      string    `json:"clientId,omitempty"`
+	BackendAddr   string    `json:"backendAddr,omitempty"`
+	DialAttempts  int       `json:"dialAttempts,omitempty"`
+	BackendFamily string    `json:"backendFamily,omitempty"`
+	JA3           string    `json:"ja3,omitempty"`
+	JA4           string    `json:"ja4,omitempty"`
+	StartTime     time.Time `json:"startTime"`
+	Duration      string    `json:"duration"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+}
+
+// adminConnections returns the incoming connections that are currently open,
+// with their annotations. The serverName parameter filters the connections by
+// server name.
+func (p *Proxy) adminConnections(req *http.Request) (any, error) {
+	serverName := idnaToASCII(req.Form.Get("serverName"))
+	conns := p.Connections()
+	out := make([]adminConnection, 0, len(conns))
+	for _, c := range conns {
+		if serverName != "" && c.ServerName != serverName {
+			continue
+		}
+		ac := adminConnection{
+			ID:            c.ID,
+			Type:          c.Type,
+			SourceAddr:    c.RemoteAddr.Network() + ":" + c.RemoteAddr.String(),
+			LocalAddr:     c.LocalAddr.Network() + ":" + c.LocalAddr.String(),
+			ServerName:    idnaToUnicode(c.ServerName),
+			Mode:          c.Mode,
+			Proto:         c.ALPNProto,
+			HTTPUpgrade:   c.HTTPUpgrade,
+			ProxyProto:    c.ProxyProtocol,
+			ClientID:      certSummary(c.ClientCert),
+			DialAttempts:  c.DialAttempts,
+			BackendFamily: c.BackendFamily,
+			JA3:           c.JA3,
+			JA4:           c.JA4,
+			StartTime:     c.StartTime,
+			Duration:      time.Since(c.StartTime).Truncate(time.Millisecond).String(),
+			BytesSent:     c.BytesSent,
+			BytesReceived: c.BytesReceived,
+		}
+		if c.BackendAddr != nil {
+			ac.BackendAddr = c.BackendAddr.Network() + ":" + c.BackendAddr.String()
+		}
+		out = append(out, ac)
+	}
+	return out, nil
+}
+
+// adminCloseConnection closes the incoming connection with the given id.
+func (p *Proxy) adminCloseConnection(req *http.Request) (any, error) {
+	id, err := strconv.ParseUint(req.Form.Get("id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid id")
+	}
+	c := p.inConns.find(id)
+	if c == nil {
+		return nil, errNotFound
+	}
+	log.Printf("INF Admin API: closing connection %d from %s", id, c.RemoteAddr())
+	p.recordEvent("connection closed by admin")
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return map[string]any{"closed": id}, nil
+}
+
+type adminBackend struct {
+	ServerNames       []string `json:"serverNames"`
+	Mode              string   `json:"mode"`
+	Addresses         []string `json:"addresses,omitempty"`
+	Drained           bool     `json:"drained"`
+	OpenConnections   int      `json:"openConnections"`
+	QueuedConnections int      `json:"queuedConnections,omitempty"`
+	UnhealthyAddrs    []string `json:"unhealthyAddresses,omitempty"`
+	NumConnections    int64    `json:"numConnections"`
+	BytesSent         int64    `json:"bytesSent"`
+	BytesReceived     int64    `json:"bytesReceived"`
+	EgressRate        float64  `json:"egressRate"`
+	IngressRate       float64  `json:"ingressRate"`
+}
+
+// adminBackends returns the configured backends with their metrics.
+func (p *Proxy) adminBackends(*http.Request) (any, error) {
+	open := make(map[*Backend]int)
+	for _, c := range p.inConns.slice() {
+		if be := connBackend(c); be != nil {
+			open[be]++
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make([]adminBackend, 0, len(p.cfg.Backends))
+	for _, be := range p.cfg.Backends {
+		ab := adminBackend{
+			ServerNames:     make([]string, 0, len(be.ServerNames)),
+			Mode:            be.Mode,
+			Addresses:       be.addresses(),
+			Drained:         be.isDrained(p.drained),
+			OpenConnections: open[be],
+		}
+		if be.quota != nil {
+			_, ab.QueuedConnections = be.quota.stats()
+		}
+		ab.QueuedConnections += be.queueLen()
+		ab.UnhealthyAddrs = be.unhealthyAddresses()
+		for _, sn := range be.ServerNames {
+			ab.ServerNames = append(ab.ServerNames, idnaToUnicode(sn))
+			m := p.metrics[sn]
+			if m == nil {
+				continue
+			}
+			ab.NumConnections += m.numConnections.Value()
+			ab.BytesSent += m.numBytesSent.Value()
+			ab.BytesReceived += m.numBytesReceived.Value()
+			ab.EgressRate += m.numBytesSent.Rate(time.Minute)
+			ab.IngressRate += m.numBytesReceived.Rate(time.Minute)
+		}
+		out = append(out, ab)
+	}
+	return out, nil
+}
+
+// adminDrainBackend stops sending new connections to a backend. The
+// connections that are already open are not affected.
+func (p *Proxy) adminDrainBackend(req *http.Request) (any, error) {
+	return p.setDrained(req.Form.Get("serverName"), true)
+}
+
+// adminEnableBackend reverses the effect of adminDrainBackend.
+func (p *Proxy) adminEnableBackend(req *http.Request) (any, error) {
+	return p.setDrained(req.Form.Get("serverName"), false)
+}
+
+func (p *Proxy) setDrained(serverName string, drained bool) (any, error) {
+	serverName = idnaToASCII(serverName)
+	if serverName == "" {
+		return nil, errors.New("serverName must be set")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := slices.IndexFunc(p.cfg.Backends, func(be *Backend) bool {
+		return slices.Contains(be.ServerNames, serverName)
+	})
+	if i < 0 {
+		return nil, errNotFound
+	}
+	be := p.cfg.Backends[i]
+	if p.drained == nil {
+		p.drained = make(map[string]bool)
+	}
+	for _, sn := range be.ServerNames {
+		if drained {
+			p.drained[sn] = true
+		} else {
+			delete(p.drained, sn)
+		}
+	}
+	if drained {
+		log.Printf("INF Admin API: draining backend %s", serverName)
+		p.recordEvent("backend drained")
+	} else {
+		log.Printf("INF Admin API: enabling backend %s", serverName)
+		p.recordEvent("backend enabled")
+	}
+	return map[string]any{"serverNames": be.ServerNames, "drained": drained}, nil
+}
+
+// isDrained returns true if the backend was drained with the admin API.
+// Drained backends don't accept new connections.
+func (be *Backend) isDrained(drained map[string]bool) bool {
+	for _, sn := range be.ServerNames {
+		if drained[sn] {
+			return true
+		}
+	}
+	return false
+}
+
+type adminCertificate struct {
+	Source      string    `json:"source"`
+	Key         string    `json:"key,omitempty"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsNames,omitempty"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	ServerNames []string  `json:"serverNames,omitempty"`
+}
+
+// adminCertificates returns the certificates that are loaded from files and
+// the ones that are obtained with ACME.
+func (p *Proxy) adminCertificates(req *http.Request) (any, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), 30*time.Second)
+	defer cancel()
+	out := p.certificateInventory(ctx)
+	if out == nil {
+		out = []adminCertificate{}
+	}
+	return out, nil
+}
+
+func newAdminCertificate(source string, cert *tls.Certificate) adminCertificate {
+	return adminCertificate{
+		Source:    source,
+		Subject:   cert.Leaf.Subject.String(),
+		Issuer:    cert.Leaf.Issuer.String(),
+		DNSNames:  cert.Leaf.DNSNames,
+		NotBefore: cert.Leaf.NotBefore,
+		NotAfter:  cert.Leaf.NotAfter,
+	}
+}
+
+// adminRenewCertificate reloads the certificate of a backend that has
+// CertFile and KeyFile. ACME certificates are renewed automatically before
+// they expire and can't be renewed on demand.
+func (p *Proxy) adminRenewCertificate(req *http.Request) (any, error) {
+	serverName := idnaToASCII(req.Form.Get("serverName"))
+	if serverName == "" {
+		return nil, errors.New("serverName must be set")
+	}
+	p.mu.RLock()
+	i := slices.IndexFunc(p.cfg.Backends, func(be *Backend) bool {
+		return slices.Contains(be.ServerNames, serverName)
+	})
+	var sc *staticCert
+	if i >= 0 {
+		sc = p.cfg.Backends[i].staticCert
+	}
+	p.mu.RUnlock()
+	if i < 0 {
+		return nil, errNotFound
+	}
+	if sc == nil {
+		return nil, fmt.Errorf("%w: ACME certificates are renewed automatically", errors.ErrUnsupported)
+	}
+	if err := sc.reload(); err != nil {
+		return nil, err
+	}
+	log.Printf("INF Admin API: reloaded certificate of %s", serverName)
+	return newAdminCertificate("file", sc.current()), nil
+}
+
+// adminRotateMasterKey replaces the master key of the local storage. The
+// current passphrase is required.
+func (p *Proxy) adminRotateMasterKey(req *http.Request) (any, error) {
+	passphrase := req.PostForm.Get("passphrase")
+	if passphrase == "" {
+		return nil, errors.New("passphrase must be set")
+	}
+	n, err := p.RotateMasterKey([]byte(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	log.Print("INF Admin API: rotated master key")
+	return map[string]any{"reencryptedFiles": n}, nil
+}
+
+// adminChangePassphrase re-encrypts the master keys with a new passphrase.
+func (p *Proxy) adminChangePassphrase(req *http.Request) (any, error) {
+	passphrase := req.PostForm.Get("passphrase")
+	newPassphrase := req.PostForm.Get("newPassphrase")
+	if passphrase == "" || newPassphrase == "" {
+		return nil, errors.New("passphrase and newPassphrase must be set")
+	}
+	if err := p.ChangePassphrase([]byte(passphrase), []byte(newPassphrase)); err != nil {
+		return nil, err
+	}
+	log.Print("INF Admin API: changed passphrase")
+	return map[string]any{"changed": true}, nil
+}
+
+// adminExportMasterKey returns the master key of the local storage, encrypted
+// with the passphrase. It is a POST request so that it can't be triggered by
+// simply following a link.
+func (p *Proxy) adminExportMasterKey(*http.Request) (any, error) {
+	b, err := p.ExportMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	log.Print("INF Admin API: exported master key")
+	return map[string]any{"masterKey": base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// adminKeyStoreCSR returns a certificate signing request for a key in one of
+// the key stores, e.g. to get a certificate for a new TPM key.
+func (p *Proxy) adminKeyStoreCSR(req *http.Request) (any, error) {
+	name := req.PostForm.Get("keyStore")
+	keyID := req.PostForm.Get("keyId")
+	serverNames := req.PostForm["serverName"]
+	if name == "" || keyID == "" || len(serverNames) == 0 {
+		return nil, errors.New("keyStore, keyId, and serverName must be set")
+	}
+	for i, n := range serverNames {
+		serverNames[i] = idnaToASCII(n)
+	}
+	p.mu.RLock()
+	i := slices.IndexFunc(p.cfg.KeyStores, func(ks *ConfigKeyStore) bool {
+		return ks.Name == name
+	})
+	var ks *ConfigKeyStore
+	if i >= 0 {
+		ks = p.cfg.KeyStores[i]
+	}
+	p.mu.RUnlock()
+	if ks == nil {
+		return nil, errNotFound
+	}
+	signer, err := ks.provider.Signer(req.Context(), keyID)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: serverNames[0]},
+		DNSNames: serverNames,
+	}, signer)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("INF Admin API: created CSR for %s in key store %s", keyID, name)
+	return map[string]any{"csr": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))}, nil
+}
@@ -0,0 +1,215 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestAdminAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	adminCert, err := intCA.GetCert("admin.example.com")
+	if err != nil {
+		t.Fatalf("intCA.GetCert: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{be1.listener.Addr().String()},
+				},
+				{
+					ServerNames: []string{"console.example.com"},
+					Mode:        "CONSOLE",
+					ClientAuth: &ClientAuth{
+						Mode:    ClientAuthRequest,
+						RootCAs: []string{intCA.RootCAPEM()},
+					},
+					ConsoleAuth: &ConsoleAuth{
+						Admins: []string{"DNS:admin.example.com"},
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	call := func(method, path string, form url.Values) (int, string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		h := proxy.adminHandlers()
+		for _, hh := range h {
+			if hh.path == path {
+				w := httptest.NewRecorder()
+				hh.handler.ServeHTTP(w, req)
+				return w.Code, w.Body.String()
+			}
+		}
+		t.Fatalf("no handler for %s", path)
+		return 0, ""
+	}
+
+	if _, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+
+	// The admin API is available on the console backend.
+	got, _, err := httpGet("console.example.com", proxy.listener.Addr().String(), "/api/backends", extCA, []tls.Certificate{*adminCert})
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	var backends []adminBackend
+	if _, body, ok := strings.Cut(got, "\n"); !ok || json.Unmarshal([]byte(body), &backends) != nil {
+		t.Fatalf("Unexpected response: %q", got)
+	}
+	if len(backends) != 2 || backends[0].ServerNames[0] != "example.com" || backends[0].NumConnections != 1 {
+		t.Errorf("backends = %#v", backends)
+	}
+
+	// The console page has a button to close each connection.
+	if got, _, err := httpGet("console.example.com", proxy.listener.Addr().String(), "/", extCA, []tls.Certificate{*adminCert}); err != nil {
+		t.Fatalf("httpGet: %v", err)
+	} else if !strings.Contains(got, `<button class="close-button" data-id="`) {
+		t.Errorf("Console page has no close button. Got:\n%s", got)
+	}
+
+	if code, body := call(http.MethodGet, "/api/config", nil); code != 200 || !strings.Contains(body, `"serverNames": [`) {
+		t.Errorf("config = %d %s", code, body)
+	}
+	if code, body := call(http.MethodPost, "/api/config", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST config = %d %s", code, body)
+	}
+
+	// Drain and enable a backend.
+	if code, body := call(http.MethodPost, "/api/backends/drain", url.Values{"serverName": {"example.com"}}); code != 200 {
+		t.Fatalf("drain = %d %s", code, body)
+	}
+	if _, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err == nil {
+		t.Error("tlsGet succeeded on drained backend")
+	}
+	if code, body := call(http.MethodPost, "/api/backends/enable", url.Values{"serverName": {"example.com"}}); code != 200 {
+		t.Fatalf("enable = %d %s", code, body)
+	}
+	if _, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Errorf("tlsGet: %v", err)
+	}
+	if code, _ := call(http.MethodPost, "/api/backends/drain", url.Values{"serverName": {"foo.example.com"}}); code != http.StatusNotFound {
+		t.Errorf("drain unknown backend = %d", code)
+	}
+
+	// Open a connection and close it with the admin API.
+	conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName:   "console.example.com",
+		RootCAs:      extCA.RootCACertPool(),
+		Certificates: []tls.Certificate{*adminCert},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+
+	var id uint64
+	for range 50 {
+		_, body := call(http.MethodGet, "/api/connections", url.Values{})
+		var conns []adminConnection
+		if err := json.Unmarshal([]byte(body), &conns); err != nil {
+			t.Fatalf("json.Unmarshal(%q): %v", body, err)
+		}
+		for _, c := range conns {
+			if c.ServerName == "console.example.com" && c.SourceAddr == "tcp:"+conn.LocalAddr().String() {
+				id = c.ID
+			}
+		}
+		if id != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if id == 0 {
+		t.Fatal("connection not found")
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/connections/close", nil)
+	w := httptest.NewRecorder()
+	proxy.adminHandlers()[5].handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("close without x-csrf-check = %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/connections/close", nil)
+	req.Header.Set("x-csrf-check", "1")
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	proxy.adminHandlers()[5].handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("close from another origin = %d", w.Code)
+	}
+	if code, body := call(http.MethodPost, "/api/connections/close", url.Values{"id": {strconv.FormatUint(id, 10)}}); code != 200 {
+		t.Fatalf("close = %d %s", code, body)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection still open")
+	}
+
+	// Certificates from the test cert manager aren't listed, and can't be
+	// renewed.
+	if code, body := call(http.MethodGet, "/api/certificates", nil); code != 200 || strings.TrimSpace(body) != "[]" {
+		t.Errorf("certificates = %d %s", code, body)
+	}
+	if code, body := call(http.MethodPost, "/api/certificates/renew", url.Values{"serverName": {"example.com"}}); code != http.StatusNotImplemented {
+		t.Errorf("renew = %d %s", code, body)
+	}
+}
@@ -0,0 +1,230 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultHandshakeQueueTimeout = 5 * time.Second
+
+var (
+	errHandshakeQueueFull    = errors.New("too many handshakes in progress")
+	errHandshakeQueueTimeout = errors.New("timed out waiting for a handshake worker")
+)
+
+// handshakePool limits the number of TLS handshakes that are in progress at
+// the same time. The connections that arrive when all the workers are busy
+// wait in a queue, where the clients that resume a previous session, i.e.
+// cheap handshakes, go before the others. When the queue is full, new
+// connections are dropped right away, unless they resume a session and they
+// can take the place of one that doesn't.
+type handshakePool struct {
+	mu           sync.Mutex
+	workers      int
+	queueSize    int
+	queueTimeout time.Duration
+	active       int
+	// resumed and full are the FIFO queues of connections waiting for a
+	// worker, with and without session resumption.
+	resumed []*handshakeWaiter
+	full    []*handshakeWaiter
+
+	admitted atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Int64
+	timedOut atomic.Int64
+}
+
+type handshakeWaiter struct {
+	// ch receives nil when the waiter gets a worker, or an error when it
+	// is evicted from the queue.
+	ch chan error
+}
+
+func newHandshakePool(cfg *ConfigHandshakeAdmission) *handshakePool {
+	hp := &handshakePool{}
+	hp.setConfig(cfg)
+	return hp
+}
+
+// setConfig updates the pool's parameters. The waiting connections get the
+// new workers, if any.
+func (hp *handshakePool) setConfig(cfg *ConfigHandshakeAdmission) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	hp.workers = cfg.MaxHandshakes
+	hp.queueSize = cfg.QueueSize
+	hp.queueTimeout = cfg.QueueTimeout
+	if hp.queueTimeout == 0 {
+		hp.queueTimeout = defaultHandshakeQueueTimeout
+	}
+	for hp.active < hp.workers && hp.wakeOne() {
+	}
+}
+
+// acquire waits for a worker, and returns the function that releases it.
+func (hp *handshakePool) acquire(ctx context.Context, resumption bool) (func(), error) {
+	hp.mu.Lock()
+	if hp.active < hp.workers {
+		hp.active++
+		hp.mu.Unlock()
+		hp.admitted.Add(1)
+		return hp.releaseFunc(), nil
+	}
+	if len(hp.resumed)+len(hp.full) >= hp.queueSize {
+		if !resumption || len(hp.full) == 0 {
+			hp.mu.Unlock()
+			hp.rejected.Add(1)
+			return nil, errHandshakeQueueFull
+		}
+		// Evict the most recent connection that doesn't resume a
+		// session.
+		last := hp.full[len(hp.full)-1]
+		hp.full = hp.full[:len(hp.full)-1]
+		last.ch <- errHandshakeQueueFull
+	}
+	w := &handshakeWaiter{ch: make(chan error, 1)}
+	if resumption {
+		hp.resumed = append(hp.resumed, w)
+	} else {
+		hp.full = append(hp.full, w)
+	}
+	timer := time.NewTimer(hp.queueTimeout)
+	defer timer.Stop()
+	hp.mu.Unlock()
+
+	var err error
+	select {
+	case err = <-w.ch:
+	case <-timer.C:
+		err = hp.cancel(w, errHandshakeQueueTimeout)
+	case <-ctx.Done():
+		err = hp.cancel(w, ctx.Err())
+	}
+	switch {
+	case err == nil:
+		hp.queued.Add(1)
+		return hp.releaseFunc(), nil
+	case errors.Is(err, errHandshakeQueueTimeout):
+		hp.timedOut.Add(1)
+	default:
+		hp.rejected.Add(1)
+	}
+	return nil, err
+}
+
+// cancel removes w from the queue and returns err, or returns the result that
+// w already received.
+func (hp *handshakePool) cancel(w *handshakeWaiter, err error) error {
+	hp.mu.Lock()
+	removed := hp.remove(w)
+	hp.mu.Unlock()
+	if !removed {
+		return <-w.ch
+	}
+	return err
+}
+
+func (hp *handshakePool) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			hp.mu.Lock()
+			defer hp.mu.Unlock()
+			hp.active--
+			for hp.active < hp.workers && hp.wakeOne() {
+			}
+		})
+	}
+}
+
+// wakeOne gives a worker to the first waiter. The caller must hold hp.mu.
+func (hp *handshakePool) wakeOne() bool {
+	var w *handshakeWaiter
+	switch {
+	case len(hp.resumed) > 0:
+		w, hp.resumed = hp.resumed[0], hp.resumed[1:]
+	case len(hp.full) > 0:
+		w, hp.full = hp.full[0], hp.full[1:]
+	default:
+		return false
+	}
+	hp.active++
+	w.ch <- nil
+	return true
+}
+
+// remove removes w from the queues. The caller must hold hp.mu.
+func (hp *handshakePool) remove(w *handshakeWaiter) bool {
+	for _, q := range []*[]*handshakeWaiter{&hp.resumed, &hp.full} {
+		for i, v := range *q {
+			if v == w {
+				*q = append((*q)[:i], (*q)[i+1:]...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stats returns the number of handshakes in progress, and the number of
+// connections waiting in the queue.
+func (hp *handshakePool) stats() (active, queued int) {
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	return hp.active, len(hp.resumed) + len(hp.full)
+}
+
+// setHandshakePool creates or updates the handshake pool.
+func (p *Proxy) setHandshakePool(cfg *Config) {
+	if cfg.HandshakeAdmission == nil {
+		p.handshakePool.Store(nil)
+		return
+	}
+	if hp := p.handshakePool.Load(); hp != nil {
+		hp.setConfig(cfg.HandshakeAdmission)
+		return
+	}
+	p.handshakePool.Store(newHandshakePool(cfg.HandshakeAdmission))
+}
+
+// admitHandshake waits for a handshake worker for conn. The worker is
+// released when the TLS handshake is done, or when the connection is closed.
+func (p *Proxy) admitHandshake(conn anyConn, resumption bool) error {
+	hp := p.handshakePool.Load()
+	if hp == nil {
+		return nil
+	}
+	release, err := hp.acquire(p.ctx, resumption)
+	if err != nil {
+		return err
+	}
+	onHandshakeDone(conn, release)
+	return nil
+}
@@ -0,0 +1,230 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestHandshakePool(t *testing.T) {
+	hp := newHandshakePool(&ConfigHandshakeAdmission{
+		MaxHandshakes: 1,
+		QueueSize:     2,
+		QueueTimeout:  time.Minute,
+	})
+	ctx := context.Background()
+
+	release1, err := hp.acquire(ctx, false)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	type result struct {
+		name    string
+		release func()
+		err     error
+	}
+	ch := make(chan result)
+	waitQueued := func(n int) {
+		for {
+			if _, queued := hp.stats(); queued == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wait := func(name string, resumption bool, queued int) {
+		go func() {
+			release, err := hp.acquire(ctx, resumption)
+			ch <- result{name, release, err}
+		}()
+		waitQueued(queued)
+	}
+	// Two connections without resumption fill the queue.
+	wait("full1", false, 1)
+	wait("full2", false, 2)
+	// A third one is rejected right away.
+	if _, err := hp.acquire(ctx, false); !errors.Is(err, errHandshakeQueueFull) {
+		t.Fatalf("acquire() = %v, want %v", err, errHandshakeQueueFull)
+	}
+	// A resumption evicts the last one, full2.
+	wait("resumed", true, 2)
+	if r := <-ch; r.name != "full2" || !errors.Is(r.err, errHandshakeQueueFull) {
+		t.Fatalf("Got %s %v, want full2 %v", r.name, r.err, errHandshakeQueueFull)
+	}
+
+	// The resumption gets the next worker, then full1.
+	release1()
+	r := <-ch
+	if r.name != "resumed" || r.err != nil {
+		t.Fatalf("Got %s %v, want resumed", r.name, r.err)
+	}
+	r.release()
+	r.release() // no-op
+	r = <-ch
+	if r.name != "full1" || r.err != nil {
+		t.Fatalf("Got %s %v, want full1", r.name, r.err)
+	}
+	if active, queued := hp.stats(); active != 1 || queued != 0 {
+		t.Errorf("stats() = %d, %d, want 1, 0", active, queued)
+	}
+	r.release()
+
+	if got, want := hp.admitted.Load(), int64(1); got != want {
+		t.Errorf("admitted = %d, want %d", got, want)
+	}
+	if got, want := hp.queued.Load(), int64(2); got != want {
+		t.Errorf("queued = %d, want %d", got, want)
+	}
+	if got, want := hp.rejected.Load(), int64(2); got != want {
+		t.Errorf("rejected = %d, want %d", got, want)
+	}
+
+	// Timeout.
+	hp.setConfig(&ConfigHandshakeAdmission{
+		MaxHandshakes: 1,
+		QueueSize:     1,
+		QueueTimeout:  10 * time.Millisecond,
+	})
+	release, err := hp.acquire(ctx, false)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := hp.acquire(ctx, false); !errors.Is(err, errHandshakeQueueTimeout) {
+		t.Errorf("acquire() = %v, want %v", err, errHandshakeQueueTimeout)
+	}
+	// More workers wake up the waiting connections.
+	wait("more", false, 1)
+	hp.setConfig(&ConfigHandshakeAdmission{
+		MaxHandshakes: 2,
+		QueueSize:     1,
+		QueueTimeout:  time.Minute,
+	})
+	if r := <-ch; r.name != "more" || r.err != nil {
+		t.Fatalf("Got %s %v, want more", r.name, r.err)
+	}
+	release()
+}
+
+// stallHandshake sends a ClientHello to addr and never completes the
+// handshake.
+func stallHandshake(t *testing.T, addr, serverName string) net.Conn {
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	// Read the ClientHello record.
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(server, hdr); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	if _, err := conn.Write(append(hdr, body...)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return conn
+}
+
+func TestHandshakeAdmission(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		HandshakeAdmission: &ConfigHandshakeAdmission{
+			MaxHandshakes: 1,
+			QueueSize:     1,
+			QueueTimeout:  100 * time.Millisecond,
+		},
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	stalled := stallHandshake(t, addr, "www.example.com")
+	defer stalled.Close()
+	hp := proxy.handshakePool.Load()
+	for {
+		if active, _ := hp.stats(); active == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil); err == nil {
+		t.Fatal("tlsGet succeeded unexpectedly")
+	}
+	if got, want := hp.timedOut.Load(), int64(1); got != want {
+		t.Errorf("timedOut = %d, want %d", got, want)
+	}
+
+	stalled.Close()
+	for {
+		if active, _ := hp.stats(); active == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	got, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+	if active, queued := hp.stats(); active != 0 || queued != 0 {
+		t.Errorf("stats() = %d, %d, want 0, 0", active, queued)
+	}
+}
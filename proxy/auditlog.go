@@ -0,0 +1,160 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/accesslog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logsink"
+)
+
+// setAuditLogOutput opens the audit log destination specified in cfg, and
+// closes the previous one. p.mu must be locked.
+func (p *Proxy) setAuditLogOutput(cfg *ConfigAuditLog) error {
+	var w io.Writer
+	var closer io.Closer
+	var prune func()
+	switch {
+	case cfg == nil:
+	case cfg.File != "":
+		last, err := auditlog.LastEntry(cfg.File)
+		if err != nil {
+			return err
+		}
+		p.auditLog.Resume(last)
+		f, err := accesslog.NewRotatingFile(cfg.File, int64(cfg.MaxSize)<<20, cfg.MaxFiles)
+		if err != nil {
+			return err
+		}
+		w, closer = f, f
+		if cfg.MaxAge > 0 {
+			name, maxAge := cfg.File, cfg.MaxAge
+			prune = func() {
+				if err := auditlog.Prune(name, maxAge); err != nil {
+					log.Printf("ERR Audit log: %v", err)
+				}
+			}
+		}
+	case cfg.Syslog:
+		s, err := cfg.sink().open()
+		if err != nil {
+			return err
+		}
+		lw := logsink.NewWriter(s, slog.LevelInfo)
+		w, closer = lw, lw
+	}
+	p.auditLog.SetOutput(w, prune)
+	if p.auditLogCloser != nil {
+		p.auditLogCloser.Close()
+	}
+	p.auditLogCloser = closer
+	return nil
+}
+
+// audit records e in the audit log, when it is enabled.
+func (p *Proxy) audit(e *auditlog.Entry) {
+	if err := p.auditLog.Log(e); err != nil {
+		log.Printf("ERR Audit log: %v", err)
+	}
+}
+
+// auditClientCert records the decision to accept or reject a client
+// certificate in the audit log.
+func (p *Proxy) auditClientCert(serverName, cert, result string, details ...string) {
+	p.audit(&auditlog.Entry{
+		Type:       auditlog.TypeClientCert,
+		Actor:      cert,
+		ServerName: idnaToUnicode(serverName),
+		Action:     "handshake",
+		Result:     result,
+		Details:    details,
+	})
+}
+
+// auditLogin records a user login in the audit log.
+func (p *Proxy) auditLogin(provider, email, host string) {
+	p.audit(&auditlog.Entry{
+		Type:       auditlog.TypeLogin,
+		Actor:      email,
+		ServerName: idnaToUnicode(host),
+		Action:     "login",
+		Details:    []string{"provider:" + provider},
+	})
+}
+
+// auditIPDenied records a connection that was rejected by the backend's IP
+// ACLs in the audit log.
+func (p *Proxy) auditIPDenied(addr net.Addr, serverName string) {
+	p.audit(&auditlog.Entry{
+		Type:       auditlog.TypeACL,
+		RemoteAddr: addr.String(),
+		ServerName: serverName,
+		Action:     "connect",
+		Result:     auditlog.ResultDeny,
+		Details:    []string{"ip"},
+	})
+}
+
+// auditRequest records an event about an HTTP request in the audit log.
+func (be *Backend) auditRequest(req *http.Request, typ, result string, details ...string) {
+	if be.audit == nil {
+		return
+	}
+	e := &auditlog.Entry{
+		Type:       typ,
+		Actor:      reqActor(req),
+		RemoteAddr: req.RemoteAddr,
+		ServerName: idnaToUnicode(hostFromReq(req)),
+		Action:     req.Method + " " + req.URL.Path,
+		Result:     result,
+		Details:    details,
+	}
+	be.audit(e)
+}
+
+// reqActor returns the identity of the user who sent req, from their SSO
+// claims and/or their client certificate.
+func reqActor(req *http.Request) string {
+	var ids []string
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		if email, _ := claims["email"].(string); email != "" {
+			ids = append(ids, email)
+		}
+	}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		ids = append(ids, certSummary(req.TLS.PeerCertificates[0]))
+	} else if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		if sum := certSummary(connClientCert(conn)); sum != "" {
+			ids = append(ids, sum)
+		}
+	}
+	return strings.Join(ids, " ")
+}
@@ -0,0 +1,138 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		AuditLog: &ConfigAuditLog{
+			File: auditFile,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+				ClientAuth: &ClientAuth{
+					RootCAs: []string{intCA.RootCAPEM()},
+					ACL:     &[]string{"DNS:allowed.example.com"},
+				},
+			},
+			{
+				ServerNames: []string{"console.example.com"},
+				Mode:        "CONSOLE",
+				ClientAuth: &ClientAuth{
+					Mode:    ClientAuthRequest,
+					RootCAs: []string{intCA.RootCAPEM()},
+				},
+				ConsoleAuth: &ConsoleAuth{
+					Admins: []string{"DNS:admin.example.com"},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, name := range []string{"allowed.example.com", "denied.example.com"} {
+		c, err := intCA.GetCert(name)
+		if err != nil {
+			t.Fatalf("intCA.GetCert: %v", err)
+		}
+		got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "", extCA, []tls.Certificate{*c}, nil)
+		if (name == "allowed.example.com") != (err == nil && got == "Hello from backend1\n") {
+			t.Errorf("tlsGet(%s) = %q, %v", name, got, err)
+		}
+	}
+	adminCert, err := intCA.GetCert("admin.example.com")
+	if err != nil {
+		t.Fatalf("intCA.GetCert: %v", err)
+	}
+	if _, _, err := httpGet("console.example.com", proxy.listener.Addr().String(), "/api/backends", extCA, []tls.Certificate{*adminCert}); err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	cfg = cfg.clone()
+	cfg.Backends[0].ServerNames = append(cfg.Backends[0].ServerNames, "www.example.com")
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+
+	b, err := os.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("os.ReadFile: %v", err)
+	}
+	if _, err := auditlog.Verify(bytes.NewReader(b), nil); err != nil {
+		t.Fatalf("auditlog.Verify: %v\n%s", err, b)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		for _, want := range []string{
+			`"type":"clientCert","actor":"SUBJECT:CN=allowed.example.com;DNS:allowed.example.com","serverName":"example.com","action":"handshake","result":"allow"`,
+			`"type":"clientCert","actor":"SUBJECT:CN=denied.example.com;DNS:denied.example.com","serverName":"example.com","action":"handshake","result":"deny"`,
+			`"type":"admin",`,
+			`"serverName":"console.example.com","action":"GET /api/backends","result":"allow"`,
+			`"type":"config","action":"reconfigure","details":[`,
+		} {
+			if strings.Contains(line, want) && !slices.Contains(got, want) {
+				got = append(got, want)
+			}
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("Audit log has %q. Got:\n%s", got, b)
+	}
+}
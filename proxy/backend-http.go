@@ -28,8 +28,11 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	_ "embed"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net"
 	"net/http"
@@ -46,15 +49,23 @@ import (
 	"time"
 
 	"golang.org/x/net/http2"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tracing"
 )
 
 const (
-	hstsHeader = "Strict-Transport-Security"
-	hstsValue  = "max-age=2592000" // 30 days
-
-	viaHeader           = "Via"
-	hostHeader          = "Host"
-	xForwardedForHeader = "X-Forwarded-For"
+	hstsHeader        = "Strict-Transport-Security"
+	hstsValue         = "max-age=2592000" // 30 days
+	defaultHSTSMaxAge = 30 * 24 * time.Hour
+
+	viaHeader             = "Via"
+	hostHeader            = "Host"
+	xForwardedForHeader   = "X-Forwarded-For"
+	xForwardedHostHeader  = "X-Forwarded-Host"
+	xForwardedProtoHeader = "X-Forwarded-Proto"
+	forwardedHeader       = "Forwarded"
+	traceparentHeader     = "Traceparent"
+	xAccelBufferingHeader = "X-Accel-Buffering"
 )
 
 type ctxURLKeyType int
@@ -62,8 +73,15 @@ type ctxURLKeyType int
 var (
 	ctxURLKey        ctxURLKeyType = 1
 	ctxOverrideIDKey ctxURLKeyType = 2
+	ctxSpanKey       ctxURLKeyType = 3
+	// ctxAddressGroupKey is the address group picked for the request.
+	ctxAddressGroupKey ctxURLKeyType = 4
 
 	commaRE = regexp.MustCompile(`, *`)
+
+	//go:embed dirlist-template.html
+	dirListEmbed    string
+	dirListTemplate = template.Must(template.New("dirlist").Parse(dirListEmbed))
 )
 
 func logPanic(req *http.Request, recovered any) {
@@ -164,12 +182,23 @@ func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, do
 			redirectPermanently(w, req, cleanPath+"/")
 			return
 		}
-		p = filepath.Join(p, "index.html")
-		if s, err := os.Stat(p); err != nil || s.IsDir() {
+		var index string
+		for _, n := range be.StaticFiles.indexFiles() {
+			if s, err := os.Stat(filepath.Join(p, n)); err == nil && !s.IsDir() {
+				index = filepath.Join(p, n)
+				break
+			}
+		}
+		if index == "" {
+			if be.StaticFiles != nil && be.StaticFiles.DirectoryListing {
+				be.serveDirectoryListing(w, req, p, cleanPath, cleanPath != prefix && cleanPath != "/")
+				return
+			}
 			log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, userAgent(req))
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
+		p = index
 	} else if strings.HasSuffix(cleanPath, "/") {
 		redirectPermanently(w, req, strings.TrimSuffix(cleanPath, "/"))
 		return
@@ -180,23 +209,98 @@ func (be *Backend) serveStaticFiles(w http.ResponseWriter, req *http.Request, do
 		return
 	}
 	defer f.Close()
-	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+	if fi, err = f.Stat(); err != nil || !fi.Mode().IsRegular() {
 		log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, userAgent(req))
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 	log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusOK, userAgent(req))
 	be.setAltSvc(w.Header(), req)
+	// The ETag lets http.ServeContent handle If-None-Match and If-Range.
+	w.Header().Set("Etag", fmt.Sprintf(`W/"%x-%x"`, fi.Size(), fi.ModTime().UnixNano()))
+	if be.StaticFiles != nil && be.StaticFiles.CacheControl != "" {
+		w.Header().Set("Cache-Control", be.StaticFiles.CacheControl)
+	}
 	http.ServeContent(w, req, p, fi.ModTime(), f)
 }
 
+// serveDirectoryListing serves an HTML page with the content of directory dir.
+// Names that start with a dot are never listed.
+func (be *Backend) serveDirectoryListing(w http.ResponseWriter, req *http.Request, dir, cleanPath string, hasParent bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, userAgent(req))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	type entry struct {
+		Name    string
+		Href    string
+		Size    string
+		ModTime string
+	}
+	data := struct {
+		Path    string
+		Parent  bool
+		Entries []entry
+	}{
+		Path:   cleanPath,
+		Parent: hasParent,
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || strings.Contains(name, `\`) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		ent := entry{
+			Name:    name,
+			Href:    (&url.URL{Path: name}).EscapedPath(),
+			ModTime: fi.ModTime().UTC().Format(time.DateTime),
+		}
+		if fi.IsDir() {
+			ent.Name += "/"
+			ent.Href += "/"
+		} else {
+			ent.Size = strconv.FormatInt(fi.Size(), 10)
+		}
+		// Names that contain a colon could be mistaken for a URL
+		// scheme.
+		if strings.Contains(name, ":") {
+			ent.Href = "./" + ent.Href
+		}
+		data.Entries = append(data.Entries, ent)
+	}
+	log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusOK, userAgent(req))
+	be.setAltSvc(w.Header(), req)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if be.StaticFiles.CacheControl != "" {
+		w.Header().Set("Cache-Control", be.StaticFiles.CacheControl)
+	}
+	dirListTemplate.Execute(w, data)
+}
+
 // reverseProxy returns an HTTP handler for backends that act as a reverse
 // proxy for remote servers. This handler can also serve local endpoints.
 func (be *Backend) reverseProxy() http.Handler {
 	reverseProxy := &httputil.ReverseProxy{
 		Director:       be.reverseProxyDirector,
-		Transport:      be.reverseProxyTransport(),
+		Transport:      be.cacheTransport(be.httpTransport),
 		ModifyResponse: be.reverseProxyModifyResponse,
+		ErrorHandler:   be.reverseProxyErrorHandler,
+		FlushInterval:  be.Streaming.flushInterval(),
+	}
+	// streamingProxy handles the requests for the streaming paths. It
+	// bypasses the response cache, and flushes after each write.
+	streamingProxy := &httputil.ReverseProxy{
+		Director:       be.reverseProxyDirector,
+		Transport:      be.httpTransport,
+		ModifyResponse: be.reverseProxyModifyResponse,
+		ErrorHandler:   be.reverseProxyErrorHandler,
+		FlushInterval:  -1,
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -230,7 +334,7 @@ func (be *Backend) reverseProxy() http.Handler {
 			req.URL.Scheme = "http"
 		}
 
-		if !slices.Contains(be.ServerNames, req.URL.Hostname()) {
+		if !be.hasServerName(req.URL.Hostname()) {
 			if req.Body != nil {
 				req.Body.Close()
 			}
@@ -241,10 +345,15 @@ func (be *Backend) reverseProxy() http.Handler {
 
 		// Apply the forward rate limit. The first request was already
 		// counted when the connection was established.
-		if conn, ok := ctx.Value(connCtxKey).(annotatedConnection); ok {
+		if c, ok := ctx.Value(connCtxKey).(anyConn); ok {
+			conn := annotatedConn(c)
 			if !conn.Annotation(requestFlagKey, false).(bool) {
 				conn.SetAnnotation(requestFlagKey, true)
-			} else if err := be.connLimit.Wait(ctx); err != nil {
+			} else if err := be.waitForward(ctx); errors.Is(err, errBackendBusy) {
+				w.Header().Set("Retry-After", be.retryAfter())
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
 				http.Error(w, "ctx", http.StatusInternalServerError)
 				return
 			}
@@ -261,6 +370,9 @@ func (be *Backend) reverseProxy() http.Handler {
 		sanitizePath := be.SanitizePath == nil || *be.SanitizePath
 	L:
 		for i, po := range be.PathOverrides {
+			if len(po.Methods) > 0 && !slices.Contains(po.Methods, req.Method) {
+				continue
+			}
 			for _, prefix := range po.Paths {
 				if cleanPath+"/" == prefix {
 					redirectPermanently(w, req, cleanPath+"/")
@@ -282,10 +394,18 @@ func (be *Backend) reverseProxy() http.Handler {
 				break L
 			}
 		}
-		if len(be.Addresses) == 0 {
+		if len(be.Addresses) == 0 && be.AddressDiscovery == nil && len(be.AddressGroups) == 0 {
 			be.serveStaticFiles(w, req, be.DocumentRoot, "")
 			return
 		}
+		// Pick the address group for this request. Each group has its
+		// own connections.
+		if override == "" && be.split != nil {
+			g := be.split.pick()
+			g.requests.Add(1)
+			ctx = context.WithValue(ctx, ctxAddressGroupKey, g)
+			override = "group;" + g.name
+		}
 
 		hostKey := bytes.NewBufferString(serverName + ";" + override)
 		if proxyProtoVersion > 0 {
@@ -316,12 +436,26 @@ func (be *Backend) reverseProxy() http.Handler {
 		if sanitizePath {
 			req.URL.Path = cleanPath
 		}
-		reverseProxy.ServeHTTP(w, req.WithContext(ctx))
+		be.mirror.send(req, host)
+		if isWebSocketUpgrade(req) {
+			be.proxyWebSocket(w, req.WithContext(ctx))
+			return
+		}
+		if be.Streaming.isStreamingPath(cleanPath) {
+			streamingProxy.ServeHTTP(&streamWriter{ResponseWriter: w, stream: true}, req.WithContext(ctx))
+			return
+		}
+		be.Compression.handler(&streamWriter{ResponseWriter: w}, req.WithContext(ctx), reverseProxy)
 	})
 }
 
 func (be *Backend) setAltSvc(header http.Header, req *http.Request) {
-	if be.http3Server == nil {
+	// http3Server is reset by close() when the backend stops, possibly
+	// while responses are still being forwarded.
+	be.state.mu.Lock()
+	h3 := be.http3Server
+	be.state.mu.Unlock()
+	if h3 == nil {
 		return
 	}
 	if req.TLS != nil && req.TLS.NegotiatedProtocol == "h3" {
@@ -334,6 +468,9 @@ func (be *Backend) setAltSvc(header http.Header, req *http.Request) {
 	if port == "" {
 		port = "443"
 	}
+	if be.altSvcPort > 0 {
+		port = strconv.Itoa(be.altSvcPort)
+	}
 	if p, err := strconv.Atoi(port); err == nil && p > 0 && p < 65536 {
 		header.Set("Alt-Svc", fmt.Sprintf("h3=\":%d\"; ma=2592000;", p))
 	}
@@ -355,6 +492,9 @@ func (be *Backend) handleLocalEndpointsAndAuthorize(w http.ResponseWriter, req *
 		if !be.localHandlers[hi].ssoBypass && !be.enforceSSOPolicy(w, req) {
 			return false
 		}
+		if !be.authorizeConsole(w, req, be.localHandlers[hi].role) {
+			return false
+		}
 		if cleanPath != req.URL.Path {
 			redirectPermanently(w, req, cleanPath)
 			return false
@@ -382,20 +522,146 @@ func (be *Backend) handleLocalEndpointsAndAuthorize(w http.ResponseWriter, req *
 }
 
 func (be *Backend) reverseProxyDirector(req *http.Request) {
-	req.Header.Del(xForwardedForHeader)
+	be.setForwardedHeaders(req)
 	req.Header.Del(xFCCHeader)
 	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 && be.ClientAuth != nil && len(be.ClientAuth.AddClientCertHeader) > 0 {
 		addXFCCHeader(req, be.ClientAuth.AddClientCertHeader)
 	}
+	if be.ClientAuth != nil && len(be.ClientAuth.ClientCertHeaders) > 0 {
+		addClientCertHeaders(req, be.ClientAuth.ClientCertHeaders)
+	}
+	if span, ok := req.Context().Value(ctxSpanKey).(*tracing.Span); ok && span.Context().IsValid() {
+		req.Header.Set(traceparentHeader, span.Context().Traceparent())
+	}
+	if be.HeaderPolicy != nil {
+		be.HeaderPolicy.Request.apply(req.Header)
+	}
+}
+
+// setForwardedHeaders sets the X-Forwarded-* and Forwarded headers according
+// to be.ForwardedHeaders. X-Forwarded-For is set by httputil.ReverseProxy,
+// which appends the client's IP address to the existing value, unless the
+// header is nil.
+func (be *Backend) setForwardedHeaders(req *http.Request) {
+	fh := be.ForwardedHeaders
+	if fh == nil {
+		req.Header.Del(xForwardedForHeader)
+		return
+	}
+	if fh.Mode != ForwardedAppend {
+		req.Header.Del(xForwardedHostHeader)
+		req.Header.Del(xForwardedProtoHeader)
+		req.Header.Del(forwardedHeader)
+		req.Header.Del(xForwardedForHeader)
+	}
+	if fh.Mode == ForwardedStrip {
+		req.Header[xForwardedForHeader] = nil
+		return
+	}
+	host := req.Host
+	if host == "" {
+		host = req.Header.Get(hostHeader)
+	}
+	if *fh.XForwarded {
+		appendHeader(req.Header, xForwardedHostHeader, host)
+		appendHeader(req.Header, xForwardedProtoHeader, "https")
+	}
+	if fh.Forwarded {
+		elem := "for=" + forwardedNode(req.RemoteAddr) + ";proto=https"
+		if host != "" {
+			elem += ";host=" + forwardedValue(host)
+		}
+		appendHeader(req.Header, forwardedHeader, elem)
+	}
+}
+
+// hopHeaders are the hop-by-hop headers that are removed from the requests
+// that the proxy sends itself. https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers, and the headers listed in
+// the Connection header, from h.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// appendClientIP adds the IP address from remoteAddr to X-Forwarded-For,
+// like httputil.ReverseProxy does, unless the header was set to nil.
+func appendClientIP(h http.Header, remoteAddr string) {
+	if v, ok := h[xForwardedForHeader]; ok && v == nil {
+		return
+	}
+	if ip, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		appendHeader(h, xForwardedForHeader, ip)
+	}
 }
 
-type funcRoundTripper func(req *http.Request) (*http.Response, error)
+func appendHeader(h http.Header, key, value string) {
+	if v := h.Values(key); len(v) > 0 {
+		value = strings.Join(v, ", ") + ", " + value
+	}
+	h.Set(key, value)
+}
 
-func (rt funcRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	return rt(req)
+// forwardedNode returns the node value of the Forwarded header for addr.
+// https://www.rfc-editor.org/rfc/rfc7239#section-6
+func forwardedNode(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return `"[` + ip.String() + `]"`
+	}
+	if host == "" {
+		return "unknown"
+	}
+	return forwardedValue(host)
 }
 
-func (be *Backend) reverseProxyTransport() http.RoundTripper {
+// forwardedValue returns v as a token, or as a quoted string if needed.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// backendTransport is the http.RoundTripper used by reverse proxy backends.
+// It keeps a pool of connections for each protocol.
+type backendTransport struct {
+	be *Backend
+	h1 *http.Transport
+	h2 *http2.Transport
+	h3 http.RoundTripper
+}
+
+func (be *Backend) reverseProxyTransport() *backendTransport {
+	ht := be.HTTPTransport
+	if ht == nil {
+		ht = &HTTPTransport{
+			MaxIdleConns:         100,
+			MaxIdleConnsPerHost:  http.DefaultMaxIdleConnsPerHost,
+			IdleConnTimeout:      10 * time.Second,
+			HTTP2ReadIdleTimeout: 10 * time.Second,
+		}
+	}
 	h1 := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return be.dial(ctx)
@@ -403,8 +669,10 @@ func (be *Backend) reverseProxyTransport() http.RoundTripper {
 		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			return be.dial(ctx)
 		},
-		MaxIdleConns:          100,
-		IdleConnTimeout:       10 * time.Second,
+		MaxIdleConns:          ht.MaxIdleConns,
+		MaxIdleConnsPerHost:   ht.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       ht.MaxConnsPerHost,
+		IdleConnTimeout:       ht.IdleConnTimeout,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 	h2 := &http2.Transport{
@@ -413,41 +681,85 @@ func (be *Backend) reverseProxyTransport() http.RoundTripper {
 		},
 		DisableCompression: true,
 		AllowHTTP:          true,
-		ReadIdleTimeout:    10 * time.Second,
+		IdleConnTimeout:    ht.IdleConnTimeout,
+		ReadIdleTimeout:    ht.HTTP2ReadIdleTimeout,
 		WriteByteTimeout:   30 * time.Second,
 		CountError: func(errType string) {
 			be.recordEvent("http2 client error: " + errType)
 		},
 	}
-	h3 := be.http3Transport()
+	return &backendTransport{
+		be: be,
+		h1: h1,
+		h2: h2,
+		h3: be.http3Transport(),
+	}
+}
 
-	return funcRoundTripper(func(req *http.Request) (*http.Response, error) {
-		// Connection upgrades, e.g. websocket, must use http/1.
-		if req.ProtoMajor == 1 && strings.ToLower(req.Header.Get("connection")) == "upgrade" {
-			return h1.RoundTrip(req)
-		}
+// CloseIdleConnections closes the idle connections in all the pools.
+func (t *backendTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+	if c, ok := t.h3.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
 
-		proto := "http/1.1"
-		if id, ok := req.Context().Value(ctxOverrideIDKey).(int); ok && id >= 0 && id < len(be.PathOverrides) && be.PathOverrides[id].BackendProto != nil {
-			proto = *be.PathOverrides[id].BackendProto
-		} else if be.BackendProto != nil {
-			proto = *be.BackendProto
-		}
-		if proto == "" && req.TLS != nil && req.TLS.NegotiatedProtocol != "" {
-			proto = req.TLS.NegotiatedProtocol
-		}
-		if proto == "h3" && h3 != nil {
-			return h3.RoundTrip(req)
-		}
-		if proto == "h2" {
-			return h2.RoundTrip(req)
-		}
-		return h1.RoundTrip(req)
-	})
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	be := t.be
+	// Connection upgrades, e.g. websocket, must use http/1.
+	if req.ProtoMajor == 1 && strings.ToLower(req.Header.Get("connection")) == "upgrade" {
+		return t.h1.RoundTrip(req)
+	}
+
+	proto := "http/1.1"
+	if id, ok := req.Context().Value(ctxOverrideIDKey).(int); ok && id >= 0 && id < len(be.PathOverrides) && be.PathOverrides[id].BackendProto != nil {
+		proto = *be.PathOverrides[id].BackendProto
+	} else if be.BackendProto != nil {
+		proto = *be.BackendProto
+	}
+	if proto == "" && req.TLS != nil && req.TLS.NegotiatedProtocol != "" {
+		proto = req.TLS.NegotiatedProtocol
+	}
+	if proto == "h3" && t.h3 != nil {
+		return t.h3.RoundTrip(req)
+	}
+	// gRPC requires HTTP/2. Its trailers can't be sent with http/1.1.
+	if proto == "h2" || proto == "h2c" || isGRPCRequest(req) {
+		return t.h2.RoundTrip(req)
+	}
+	return t.h1.RoundTrip(req)
+}
+
+// isGRPCRequest returns true if req is a gRPC request. gRPC-Web requests
+// aren't included because they work with any version of HTTP.
+func isGRPCRequest(req *http.Request) bool {
+	ct := req.Header.Get("content-type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// reverseProxyErrorHandler is called when the request can't be forwarded to
+// the backend. gRPC clients get a gRPC UNAVAILABLE status, which they know how
+// to handle, instead of a 502 Bad Gateway.
+func (be *Backend) reverseProxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	url, _ := req.Context().Value(ctxURLKey).(string)
+	log.Printf("ERR %s ➔ %s %s ➔ %v (%q)", formatReqDesc(req), req.Method, url, err, userAgent(req))
+	countGroupError(req)
+	if !isGRPCRequest(req) {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("content-type", "application/grpc")
+	w.Header().Set("grpc-status", "14")
+	w.Header().Set("grpc-message", "backend%20unavailable")
+	w.WriteHeader(http.StatusOK)
 }
 
 func (be *Backend) reverseProxyModifyResponse(resp *http.Response) error {
 	req := resp.Request
+	if resp.StatusCode >= 500 {
+		countGroupError(req)
+	}
 	if resp.StatusCode == http.StatusSwitchingProtocols {
 		if c, ok := req.Context().Value(connCtxKey).(anyConn); ok {
 			annotatedConn(c).SetAnnotation(httpUpgradeKey, resp.Header.Get("upgrade"))
@@ -460,11 +772,14 @@ func (be *Backend) reverseProxyModifyResponse(resp *http.Response) error {
 	url, _ := req.Context().Value(ctxURLKey).(string)
 	log.Printf("PRX %s ➔ %s %s ➔ status:%d%s (%q)", formatReqDesc(req), req.Method, url, resp.StatusCode, cl, userAgent(req))
 
-	if resp.StatusCode != http.StatusMisdirectedRequest && resp.Header.Get(hstsHeader) == "" {
-		resp.Header.Set(hstsHeader, hstsValue)
+	if v := be.HSTS.value(); v != "" && resp.StatusCode != http.StatusMisdirectedRequest && resp.Header.Get(hstsHeader) == "" {
+		resp.Header.Set(hstsHeader, v)
 	}
 	if resp.StatusCode >= 200 && resp.StatusCode < 400 && resp.Header.Get("Alt-Svc") == "" {
 		be.setAltSvc(resp.Header, req)
 	}
+	if be.HeaderPolicy != nil {
+		be.HeaderPolicy.Response.apply(resp.Header)
+	}
 	return nil
 }
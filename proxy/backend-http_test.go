@@ -0,0 +1,749 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	trueValue, falseValue := true, false
+	for _, tc := range []struct {
+		desc       string
+		fh         *ForwardedHeaders
+		remoteAddr string
+		in         http.Header
+		want       http.Header
+	}{
+		{
+			desc:       "Default",
+			remoteAddr: "192.168.0.1:1234",
+			in: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Proto": {"http"},
+			},
+			want: http.Header{
+				"X-Forwarded-Proto": {"http"},
+			},
+		},
+		{
+			desc:       "Replace",
+			fh:         &ForwardedHeaders{Mode: ForwardedReplace, XForwarded: &trueValue, Forwarded: true},
+			remoteAddr: "192.168.0.1:1234",
+			in: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Host":  {"evil.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			want: http.Header{
+				"X-Forwarded-Host":  {"www.example.com"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=192.168.0.1;proto=https;host=www.example.com"},
+			},
+		},
+		{
+			desc:       "Append",
+			fh:         &ForwardedHeaders{Mode: ForwardedAppend, XForwarded: &trueValue, Forwarded: true},
+			remoteAddr: "[2001:db8::1]:1234",
+			in: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Host":  {"foo.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=1.2.3.4", "for=5.6.7.8"},
+			},
+			want: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Host":  {"foo.example.com, www.example.com"},
+				"X-Forwarded-Proto": {"http, https"},
+				"Forwarded":         {`for=1.2.3.4, for=5.6.7.8, for="[2001:db8::1]";proto=https;host=www.example.com`},
+			},
+		},
+		{
+			desc:       "Forwarded only",
+			fh:         &ForwardedHeaders{Mode: ForwardedReplace, XForwarded: &falseValue, Forwarded: true},
+			remoteAddr: "192.168.0.1:1234",
+			in: http.Header{
+				"X-Forwarded-Host": {"evil.example.com"},
+			},
+			want: http.Header{
+				"Forwarded": {"for=192.168.0.1;proto=https;host=www.example.com"},
+			},
+		},
+		{
+			desc:       "Strip",
+			fh:         &ForwardedHeaders{Mode: ForwardedStrip, XForwarded: &trueValue, Forwarded: true},
+			remoteAddr: "192.168.0.1:1234",
+			in: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Forwarded-Host":  {"evil.example.com"},
+				"X-Forwarded-Proto": {"http"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			want: http.Header{
+				"X-Forwarded-For": nil,
+			},
+		},
+	} {
+		be := &Backend{ForwardedHeaders: tc.fh}
+		req := &http.Request{
+			Host:       "www.example.com",
+			RemoteAddr: tc.remoteAddr,
+			Header:     tc.in,
+		}
+		be.setForwardedHeaders(req)
+		if got := req.Header; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: Got %#v, want %#v", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestHSTSValue(t *testing.T) {
+	for _, tc := range []struct {
+		hsts *HSTS
+		want string
+	}{
+		{hsts: nil, want: "max-age=2592000"},
+		{hsts: &HSTS{}, want: "max-age=2592000"},
+		{hsts: &HSTS{Disabled: true}, want: ""},
+		{hsts: &HSTS{MaxAge: time.Hour}, want: "max-age=3600"},
+		{hsts: &HSTS{MaxAge: 365 * 24 * time.Hour, IncludeSubDomains: true, Preload: true}, want: "max-age=31536000; includeSubDomains; preload"},
+	} {
+		if got := tc.hsts.value(); got != tc.want {
+			t.Errorf("%#v.value() = %q, want %q", tc.hsts, got, tc.want)
+		}
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	rules := &HeaderRules{
+		Remove: []string{"Server", "x-powered-by"},
+		Set: map[string]string{
+			"X-Frame-Options": "DENY",
+		},
+		Add: map[string]string{
+			"Content-Security-Policy": "default-src 'self'",
+			"Referrer-Policy":         "no-referrer",
+		},
+	}
+	if err := rules.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	h := http.Header{
+		"Server":          {"foo/1.0"},
+		"X-Powered-By":    {"bar"},
+		"X-Frame-Options": {"SAMEORIGIN"},
+		"Referrer-Policy": {"origin"},
+		"Content-Type":    {"text/plain"},
+	}
+	rules.apply(h)
+	want := http.Header{
+		"X-Frame-Options":         {"DENY"},
+		"Referrer-Policy":         {"origin"},
+		"Content-Security-Policy": {"default-src 'self'"},
+		"Content-Type":            {"text/plain"},
+	}
+	if !reflect.DeepEqual(h, want) {
+		t.Errorf("Got %#v, want %#v", h, want)
+	}
+
+	for _, r := range []*HeaderRules{
+		{Remove: []string{"bad header"}},
+		{Set: map[string]string{"X-Foo": "bad\nvalue"}},
+		{Add: map[string]string{"": "foo"}},
+	} {
+		if err := r.check(); err == nil {
+			t.Errorf("check(%#v) should have failed", r)
+		}
+	}
+}
+
+func TestHTTPLimitsHandler(t *testing.T) {
+	be := &Backend{
+		HTTPLimits: &HTTPLimits{
+			MaxBodyBytes:          10,
+			MaxConcurrentRequests: 1,
+		},
+		recordEvent: func(string) {},
+	}
+	block := make(chan struct{})
+	started := make(chan struct{})
+	handler := be.httpLimitsHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			started <- struct{}{}
+			<-block
+			return
+		}
+		if _, err := io.ReadAll(req.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}))
+
+	for _, tc := range []struct {
+		body          io.Reader
+		contentLength int64
+		want          int
+	}{
+		{body: strings.NewReader("0123456789"), contentLength: 10, want: http.StatusOK},
+		{body: strings.NewReader("0123456789A"), contentLength: 11, want: http.StatusRequestEntityTooLarge},
+		{body: strings.NewReader("0123456789A"), contentLength: -1, want: http.StatusRequestEntityTooLarge},
+	} {
+		req := httptest.NewRequest("POST", "/", tc.body)
+		req.ContentLength = tc.contentLength
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Code; got != tc.want {
+			t.Errorf("ContentLength %d: Code = %d, want %d", tc.contentLength, got, tc.want)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/block", nil))
+		close(done)
+	}()
+	<-started
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got, want := w.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Concurrent request: Code = %d, want %d", got, want)
+	}
+	close(block)
+	<-done
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Errorf("Sequential request: Code = %d, want %d", got, want)
+	}
+}
+
+type fakeEarlyConn struct {
+	done chan struct{}
+}
+
+func (c fakeEarlyConn) HandshakeComplete() <-chan struct{} {
+	return c.done
+}
+
+func TestEarlyDataHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		earlyData   *EarlyData
+		method      string
+		header      bool
+		inHandshake bool
+		want        int
+		wantHeader  string
+	}{
+		{name: "not early", method: "POST", want: http.StatusOK},
+		{name: "GET", method: "GET", header: true, want: http.StatusOK, wantHeader: "1"},
+		{name: "POST", method: "POST", header: true, want: http.StatusTooEarly},
+		{name: "QUIC GET", method: "GET", inHandshake: true, want: http.StatusOK, wantHeader: "1"},
+		{name: "QUIC POST", method: "POST", inHandshake: true, want: http.StatusTooEarly},
+		{name: "disabled", earlyData: &EarlyData{Enable: new(bool)}, method: "GET", header: true, want: http.StatusTooEarly},
+		{name: "methods", earlyData: &EarlyData{Methods: []string{"POST"}}, method: "POST", header: true, want: http.StatusOK, wantHeader: "1"},
+		{name: "methods GET", earlyData: &EarlyData{Methods: []string{"POST"}}, method: "GET", header: true, want: http.StatusTooEarly},
+	} {
+		be := &Backend{
+			EarlyData: tc.earlyData,
+			state:     new(backendState),
+		}
+		var gotHeader string
+		handler := be.earlyDataHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			gotHeader = req.Header.Get("Early-Data")
+		}))
+		req := httptest.NewRequest(tc.method, "/", nil)
+		if tc.header {
+			req.Header.Set("Early-Data", "1")
+		}
+		done := make(chan struct{})
+		if !tc.inHandshake {
+			close(done)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), connCtxKey, fakeEarlyConn{done}))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if got := w.Code; got != tc.want {
+			t.Errorf("[%s] Code = %d, want %d", tc.name, got, tc.want)
+		}
+		if got := gotHeader; got != tc.wantHeader {
+			t.Errorf("[%s] Early-Data = %q, want %q", tc.name, got, tc.wantHeader)
+		}
+		var wantAccepted, wantRejected int64
+		if tc.want == http.StatusTooEarly {
+			wantRejected = 1
+		} else if tc.wantHeader != "" {
+			wantAccepted = 1
+		}
+		if got := be.state.earlyDataAccepted.Load(); got != wantAccepted {
+			t.Errorf("[%s] earlyDataAccepted = %d, want %d", tc.name, got, wantAccepted)
+		}
+		if got := be.state.earlyDataRejected.Load(); got != wantRejected {
+			t.Errorf("[%s] earlyDataRejected = %d, want %d", tc.name, got, wantRejected)
+		}
+	}
+}
+
+func TestPlaintextHTTPHandler(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "CONSOLE",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	handler := proxy.plaintextHTTPHandler()
+
+	for _, tc := range []struct {
+		redirectHTTP bool
+		method       string
+		url          string
+		wantCode     int
+		wantLocation string
+	}{
+		{method: "GET", url: "http://www.example.com/foo?a=b", wantCode: http.StatusFound, wantLocation: "https://www.example.com/foo?a=b"},
+		{method: "GET", url: "http://other.example.com/", wantCode: http.StatusFound, wantLocation: "https://other.example.com/"},
+		{method: "POST", url: "http://www.example.com/", wantCode: http.StatusBadRequest},
+		{redirectHTTP: true, method: "GET", url: "http://www.example.com:8080/foo?a=b", wantCode: http.StatusMovedPermanently, wantLocation: "https://www.example.com/foo?a=b"},
+		{redirectHTTP: true, method: "POST", url: "http://WWW.example.com/", wantCode: http.StatusMovedPermanently, wantLocation: "https://WWW.example.com/"},
+		{redirectHTTP: true, method: "GET", url: "http://other.example.com/", wantCode: http.StatusNotFound},
+	} {
+		proxy.mu.Lock()
+		proxy.cfg.RedirectHTTP = tc.redirectHTTP
+		proxy.mu.Unlock()
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.url, nil))
+		if got, want := w.Code, tc.wantCode; got != want {
+			t.Errorf("%s %s: Code = %d, want %d", tc.method, tc.url, got, want)
+		}
+		if got, want := w.Header().Get("Location"), tc.wantLocation; got != want {
+			t.Errorf("%s %s: Location = %q, want %q", tc.method, tc.url, got, want)
+		}
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"192.168.0.1:1234", "192.168.0.1"},
+		{"[2001:db8::1]:1234", `"[2001:db8::1]"`},
+		{"", "unknown"},
+	} {
+		if got := forwardedNode(tc.in); got != tc.want {
+			t.Errorf("forwardedNode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	if got, want := forwardedValue("example.com:8443"), `"example.com:8443"`; got != want {
+		t.Errorf("forwardedValue() = %q, want %q", got, want)
+	}
+}
+
+func TestPathOverrideMethods(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newHTTPServer(t, ctx, "backend1", nil)
+	be2 := newHTTPServer(t, ctx, "backend2", nil)
+	be3 := newHTTPServer(t, ctx, "backend3", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"www.example.com"},
+					Addresses:   []string{be1.String()},
+					Mode:        "HTTP",
+					PathOverrides: []*PathOverride{
+						{
+							Paths:     []string{"/api/"},
+							Methods:   []string{"post", "PUT"},
+							Addresses: []string{be2.String()},
+						},
+						{
+							Paths:     []string{"/api/", "/static/"},
+							Addresses: []string{be3.String()},
+						},
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: "www.example.com",
+					RootCAs:    extCA.RootCACertPool(),
+				})
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+	for _, tc := range []struct {
+		method, path, want string
+	}{
+		{http.MethodGet, "/", "[backend1] /\n"},
+		{http.MethodGet, "/api/foo", "[backend3] /api/foo\n"},
+		{http.MethodPost, "/api/foo", "[backend2] /api/foo\n"},
+		{http.MethodPut, "/api/foo", "[backend2] /api/foo\n"},
+		{http.MethodPost, "/static/foo", "[backend3] /static/foo\n"},
+		{http.MethodPost, "/other", "[backend1] /other\n"},
+	} {
+		req, err := http.NewRequest(tc.method, "https://www.example.com"+tc.path, strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		if got := string(body); got != tc.want {
+			t.Errorf("%s %s: got %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestHTTPTransportPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	var newConns atomic.Int32
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &http.Server{
+		Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s\n", r.Proto, r.RequestURI)
+		}), &http2.Server{}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns.Add(1)
+			}
+		},
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	h2 := "h2"
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"h1.example.com"},
+					Addresses:   []string{l.Addr().String()},
+					Mode:        "HTTP",
+					HTTPTransport: &HTTPTransport{
+						MaxIdleConnsPerHost: 10,
+						IdleConnTimeout:     time.Minute,
+					},
+				},
+				{
+					ServerNames:  []string{"h2.example.com"},
+					Addresses:    []string{l.Addr().String()},
+					Mode:         "HTTP",
+					BackendProto: &h2,
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"h1.example.com", "HTTP/1.1 /foo\n"},
+		{"h2.example.com", "HTTP/2.0 /foo\n"},
+	} {
+		newConns.Store(0)
+		for i := 0; i < 5; i++ {
+			got, _, err := httpGet(tc.host, proxy.listener.Addr().String(), "/foo", extCA, nil)
+			if err != nil {
+				t.Fatalf("%s: httpGet: %v", tc.host, err)
+			}
+			if _, body, _ := strings.Cut(got, "\n"); body != tc.want {
+				t.Errorf("%s: got %q, want %q", tc.host, body, tc.want)
+			}
+		}
+		if got, want := newConns.Load(), int32(1); got != want {
+			t.Errorf("%s: backend connections = %d, want %d", tc.host, got, want)
+		}
+	}
+}
+
+func TestGRPCProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// A fake gRPC server that only speaks h2c.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &http.Server{
+		Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor != 2 {
+				http.Error(w, "not http/2", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("content-type", "application/grpc")
+			w.Header().Set("trailer", "grpc-status, grpc-message")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "%s %s", r.Header.Get("te"), body)
+			w.Header().Set("grpc-status", "0")
+			w.Header().Set("grpc-message", "OK")
+		}), &http2.Server{}),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	closed, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	closed.Close()
+
+	h2cProto := "h2c"
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"grpc.example.com"},
+					Addresses:   []string{l.Addr().String()},
+					Mode:        "HTTP",
+				},
+				{
+					ServerNames:  []string{"h2c.example.com"},
+					Addresses:    []string{l.Addr().String()},
+					Mode:         "HTTP",
+					BackendProto: &h2cProto,
+				},
+				{
+					ServerNames: []string{"down.example.com"},
+					Addresses:   []string{closed.Addr().String()},
+					Mode:        "HTTP",
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			DialTLSContext: func(ctx context.Context, _, _ string, tc *tls.Config) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), tc)
+			},
+			TLSClientConfig: &tls.Config{
+				RootCAs: extCA.RootCACertPool(),
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	for _, tc := range []struct {
+		host, contentType string
+		wantBody          string
+		wantStatus        string
+	}{
+		{host: "grpc.example.com", contentType: "application/grpc", wantBody: "trailers hello", wantStatus: "0"},
+		{host: "grpc.example.com", contentType: "application/grpc+proto", wantBody: "trailers hello", wantStatus: "0"},
+		{host: "grpc.example.com", contentType: "text/plain", wantBody: "not http/2\n"},
+		{host: "h2c.example.com", contentType: "text/plain", wantBody: "trailers hello", wantStatus: "0"},
+		{host: "down.example.com", contentType: "application/grpc", wantStatus: "14"},
+	} {
+		req, err := http.NewRequest(http.MethodPost, "https://"+tc.host+"/foo.Service/Method", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		req.Header.Set("content-type", tc.contentType)
+		req.Header.Set("te", "trailers")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.host, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: body: %v", tc.host, err)
+		}
+		if got, want := string(body), tc.wantBody; got != want {
+			t.Errorf("%s %s: body = %q, want %q", tc.host, tc.contentType, got, want)
+		}
+		status := resp.Trailer.Get("grpc-status")
+		if status == "" {
+			status = resp.Header.Get("grpc-status")
+		}
+		if got, want := status, tc.wantStatus; got != want {
+			t.Errorf("%s %s: grpc-status = %q, want %q", tc.host, tc.contentType, got, want)
+		}
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	beA := newHTTPServer(t, ctx, "a", nil)
+	beB := newHTTPServer(t, ctx, "b", nil)
+	beC := newHTTPServer(t, ctx, "c", nil)
+	beD := newHTTPServer(t, ctx, "d", nil)
+
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"a.example.com", "a2.example.com"},
+				Addresses:   []string{beA.String()},
+				Mode:        ModeHTTP,
+				HostRouting: &HostRouting{
+					MatchSNI: true,
+					RouteTo:  []string{"b.example.com"},
+				},
+			},
+			{
+				ServerNames: []string{"b.example.com"},
+				Addresses:   []string{beB.String()},
+				Mode:        ModeHTTP,
+			},
+			{
+				ServerNames: []string{"c.example.com"},
+				Addresses:   []string{beC.String()},
+				Mode:        ModeHTTP,
+				HostRouting: &HostRouting{
+					Rewrite: true,
+				},
+			},
+			{
+				ServerNames: []string{"d.example.com"},
+				Addresses:   []string{beD.String()},
+				Mode:        ModeHTTP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	for _, tc := range []struct {
+		sni, host, want string
+	}{
+		{"a.example.com", "a.example.com", "[a] /foo\n"},
+		{"a.example.com", "b.example.com", "[b] /foo\n"},
+		{"a.example.com", "a2.example.com", "Misdirected Request\n"},
+		{"a.example.com", "d.example.com", "Misdirected Request\n"},
+		{"c.example.com", "d.example.com", "[c] /foo\n"},
+		{"d.example.com", "b.example.com", "Misdirected Request\n"},
+	} {
+		got, _, err := tlsGet(tc.sni, addr, "GET /foo HTTP/1.0\r\nHost: "+tc.host+"\r\n\r\n", ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet(%q, %q): %v", tc.sni, tc.host, err)
+		}
+		if !strings.HasSuffix(got, tc.want) {
+			t.Errorf("tlsGet(%q, %q) = %q, want %q", tc.sni, tc.host, got, tc.want)
+		}
+	}
+}
@@ -32,13 +32,13 @@ import (
 	"html/template"
 	"log"
 	"net/http"
-	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/passkeys"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
@@ -89,6 +89,7 @@ func claimsFromCtx(ctx context.Context) jwt.MapClaims {
 func (be *Backend) authenticateUser(w http.ResponseWriter, req **http.Request) bool {
 	(*req).Header.Del(xTLSProxyUserIDHeader)
 	if be.SSO != nil {
+		(*req).Header.Del(be.SSO.userIDHeader())
 		claims, cont := be.checkCookies(w, *req)
 		if !cont {
 			return false
@@ -96,15 +97,25 @@ func (be *Backend) authenticateUser(w http.ResponseWriter, req **http.Request) b
 		if claims != nil {
 			if email, ok := claims["email"].(string); ok && email != "" {
 				if be.SSO.SetUserIDHeader {
-					(*req).Header.Set(xTLSProxyUserIDHeader, email)
+					(*req).Header.Set(be.SSO.userIDHeader(), email)
 				}
 				*req = (*req).WithContext(context.WithValue((*req).Context(), authCtxKey, claims))
+				if rw, ok := w.(*responseRecorder); ok {
+					rw.user = email
+				}
 			}
 		}
 	}
 	return true
 }
 
+func (sso *BackendSSO) userIDHeader() string {
+	if sso.UserIDHeader != "" {
+		return sso.UserIDHeader
+	}
+	return xTLSProxyUserIDHeader
+}
+
 func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request) (jwt.MapClaims, bool) {
 	// If a valid ID Token is in the authorization header, use it and
 	// ignore the cookies.
@@ -128,7 +139,7 @@ func (be *Backend) checkCookies(w http.ResponseWriter, req *http.Request) (jwt.M
 		return authClaims, true
 	}
 
-	if !slices.Contains(be.ServerNames, hostFromReq(req)) {
+	if !be.hasServerName(hostFromReq(req)) {
 		return authClaims, true
 	}
 
@@ -215,6 +226,9 @@ func (be *Backend) serveLogin(w http.ResponseWriter, req *http.Request) {
 
 func (be *Backend) serveLogout(w http.ResponseWriter, req *http.Request) {
 	if be.SSO != nil {
+		if claimsFromCtx(req.Context()) != nil {
+			be.auditRequest(req, auditlog.TypeLogout, "")
+		}
 		be.SSO.cm.ClearCookies(w)
 	}
 	req.ParseForm()
@@ -316,9 +330,9 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 	}
 	userID, _ := claims["email"].(string)
 	host := connServerName(req.Context().Value(connCtxKey).(anyConn))
-	_, userDomain, _ := strings.Cut(userID, "@")
-	if be.SSO.ACL != nil && !slices.Contains(*be.SSO.ACL, userID) && !slices.Contains(*be.SSO.ACL, "@"+userDomain) {
+	if !be.SSO.allows(claims) {
 		be.recordEvent(fmt.Sprintf("deny SSO %s to %s", userID, idnaToUnicode(host)))
+		be.auditRequest(req, auditlog.TypeACL, auditlog.ResultDeny, "sso")
 		log.Printf("REQ %s ➔ %s %s ➔ status:%d (SSO) (%q)", formatReqDesc(req), req.Method, req.RequestURI, http.StatusForbidden, userAgent(req))
 		be.servePermissionDenied(w, req)
 		return false
@@ -330,6 +344,16 @@ func (be *Backend) enforceSSOPolicy(w http.ResponseWriter, req *http.Request) bo
 	return true
 }
 
+// allows returns true if the user identified by claims is allowed by the ACL
+// and DenyACL.
+func (sso *BackendSSO) allows(claims jwt.MapClaims) bool {
+	match := claimsACLTerm(claims)
+	if matchACL(sso.DenyACL, match) {
+		return false
+	}
+	return sso.ACL == nil || matchACL(*sso.ACL, match)
+}
+
 func pathMatches(prefixes []string, path string) bool {
 	if len(prefixes) == 0 {
 		return true
@@ -110,6 +110,36 @@ func TestAuthenticateUser(t *testing.T) {
 	}
 }
 
+func TestAuthenticateUserCustomHeader(t *testing.T) {
+	proxy := newBackendSSOTestProxy(t)
+	be := proxy.cfg.Backends[0]
+	be.SSO.GenerateIDTokens = false
+	be.SSO.UserIDHeader = "X-Auth-Email"
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.Header.Set("x-auth-email", "imposter")
+	req.Header.Set("x-tlsproxy-user-id", "imposter")
+	if cont := be.authenticateUser(httptest.NewRecorder(), &req); !cont {
+		t.Fatal("authenticateUser() = false")
+	}
+	if got := req.Header.Get("x-auth-email"); got != "" {
+		t.Errorf("x-auth-email = %q, want empty", got)
+	}
+
+	if err := setAuthCookie(req, "bob@", "example.com", "https://example.com/", proxy.tokenManager); err != nil {
+		t.Fatalf("setAuthCookie: %v", err)
+	}
+	if cont := be.authenticateUser(httptest.NewRecorder(), &req); !cont {
+		t.Fatal("authenticateUser() = false")
+	}
+	if got, want := req.Header.Get("x-auth-email"), "bob@"; got != want {
+		t.Errorf("x-auth-email = %q, want %q", got, want)
+	}
+	if got := req.Header.Get("x-tlsproxy-user-id"); got != "" {
+		t.Errorf("x-tlsproxy-user-id = %q, want empty", got)
+	}
+}
+
 func TestEnforceSSOPolicy(t *testing.T) {
 	proxy := newBackendSSOTestProxy(t)
 
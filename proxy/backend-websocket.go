@@ -0,0 +1,240 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// webSocketHandshakeTimeout is the amount of time allowed for the backend
+// server to respond to a WebSocket opening handshake.
+const webSocketHandshakeTimeout = 30 * time.Second
+
+// isWebSocketUpgrade returns true if req is a WebSocket opening handshake.
+// WebSockets over HTTP/2 (RFC 8441) aren't supported.
+func isWebSocketUpgrade(req *http.Request) bool {
+	return req.ProtoMajor == 1 &&
+		httpguts.HeaderValuesContainsToken(req.Header["Connection"], "upgrade") &&
+		strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// proxyWebSocket forwards a WebSocket opening handshake to the backend. When
+// the backend accepts it, the client's connection is hijacked and bridged to
+// the backend's connection, like in TCP mode, so that the bytes are counted,
+// and the connection is shown with its destination in the metrics.
+func (be *Backend) proxyWebSocket(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	outreq := req.Clone(ctx)
+	outreq.RequestURI = ""
+	outreq.Close = false
+	removeHopHeaders(outreq.Header)
+	be.reverseProxyDirector(outreq)
+	appendClientIP(outreq.Header, req.RemoteAddr)
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", req.Header.Get("Upgrade"))
+
+	intConn, err := be.dialRetry(ctx, "http/1.1")
+	if err != nil {
+		be.recordEvent("dial error")
+		be.reverseProxyErrorHandler(w, req, err)
+		return
+	}
+	intConn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	if err := outreq.Write(intConn); err != nil {
+		intConn.Close()
+		be.reverseProxyErrorHandler(w, req, err)
+		return
+	}
+	br := bufio.NewReader(intConn)
+	resp, err := http.ReadResponse(br, outreq)
+	if err != nil {
+		intConn.Close()
+		be.reverseProxyErrorHandler(w, req, err)
+		return
+	}
+	intConn.SetDeadline(time.Time{})
+	resp.Request = req
+	if err := be.reverseProxyModifyResponse(resp); err != nil {
+		resp.Body.Close()
+		intConn.Close()
+		be.reverseProxyErrorHandler(w, req, err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The backend rejected the handshake. Its response is sent to
+		// the client as is.
+		defer intConn.Close()
+		defer resp.Body.Close()
+		removeHopHeaders(resp.Header)
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), req.Header.Get("Upgrade")) {
+		intConn.Close()
+		be.reverseProxyErrorHandler(w, req, fmt.Errorf("backend switched to protocol %q", resp.Header.Get("Upgrade")))
+		return
+	}
+
+	extConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		intConn.Close()
+		be.reverseProxyErrorHandler(w, req, err)
+		return
+	}
+	// The deadlines set by the HTTP server, e.g. WriteTimeout, don't
+	// apply to WebSocket connections.
+	extConn.SetDeadline(time.Time{})
+
+	// Send the backend's response, and the data that the backend and the
+	// client sent after the handshake, if any.
+	fmt.Fprintf(brw, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		brw.Write(b)
+	}
+	err = brw.Flush()
+	if n := brw.Reader.Buffered(); err == nil && n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		_, err = intConn.Write(b)
+	}
+	if err != nil {
+		extConn.Close()
+		intConn.Close()
+		log.Printf("ERR %s ➔ WebSocket: %v", formatReqDesc(req), err)
+		return
+	}
+
+	if c, ok := ctx.Value(connCtxKey).(anyConn); ok {
+		annotatedConn(c).SetAnnotation(internalConnKey, intConn)
+		if be.countWebSocket != nil {
+			defer be.countWebSocket(be.metricsServerName(connServerName(c)))()
+		}
+	}
+	log.Printf("STR %s ➔ WebSocket ➔ %s", formatReqDesc(req), intConn.RemoteAddr())
+	if err := be.bridgeWebSocket(extConn, intConn); err != nil {
+		log.Printf("DBG %s ➔ WebSocket: %v", formatReqDesc(req), err)
+	}
+}
+
+// bridgeWebSocket copies the data between the client and the backend until
+// either side closes its connection, or until the backend's WebSocketLimits
+// are reached.
+func (be *Backend) bridgeWebSocket(extConn, intConn net.Conn) error {
+	var once sync.Once
+	closeConns := func() {
+		once.Do(func() {
+			extConn.Close()
+			intConn.Close()
+		})
+	}
+	defer closeConns()
+
+	if wl := be.WebSocketLimits; wl != nil {
+		if wl.MaxLifetime > 0 {
+			t := time.AfterFunc(wl.MaxLifetime, func() {
+				be.recordEvent("websocket max lifetime")
+				closeConns()
+			})
+			defer t.Stop()
+		}
+		if wl.IdleTimeout > 0 {
+			var last atomic.Int64
+			last.Store(time.Now().UnixNano())
+			extConn = &activityConn{Conn: extConn, last: &last}
+			intConn = &activityConn{Conn: intConn, last: &last}
+			var mu sync.Mutex
+			var t *time.Timer
+			mu.Lock()
+			t = time.AfterFunc(wl.IdleTimeout, func() {
+				idle := time.Since(time.Unix(0, last.Load()))
+				if idle >= wl.IdleTimeout {
+					be.recordEvent("websocket idle timeout")
+					closeConns()
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				t.Reset(wl.IdleTimeout - idle)
+			})
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				t.Stop()
+			}()
+		}
+	}
+
+	pool := netw.BufferPoolFor(be.CopyBufferSize)
+	ch := make(chan error)
+	go func() {
+		_, err := netw.Copy(extConn, intConn, pool)
+		closeConns()
+		ch <- err
+	}()
+	var retErr error
+	if _, err := netw.Copy(intConn, extConn, pool); err != nil && !errors.Is(err, net.ErrClosed) {
+		retErr = fmt.Errorf("[ext➔ int]: %w", unwrapErr(err))
+	}
+	closeConns()
+	if err := <-ch; err != nil && !errors.Is(err, net.ErrClosed) {
+		retErr = fmt.Errorf("[int➔ ext]: %w", unwrapErr(err))
+	}
+	return retErr
+}
+
+// activityConn records the time of the last successful read.
+type activityConn struct {
+	net.Conn
+	last *atomic.Int64
+}
+
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestHTTPWebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer be.Close()
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"ws.example.com"},
+					Mode:        "HTTP",
+					Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+					WebSocketLimits: &WebSocketLimits{
+						IdleTimeout: time.Second,
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	cfg, err := websocket.NewConfig("wss://ws.example.com/echo", "https://ws.example.com")
+	if err != nil {
+		t.Fatalf("websocket.NewConfig: %v", err)
+	}
+	conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName: "ws.example.com",
+		RootCAs:    extCA.RootCACertPool(),
+		NextProtos: []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		t.Fatalf("websocket.NewClient: %v", err)
+	}
+	defer ws.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatalf("Receive: %v", err)
+		}
+		if got != msg {
+			t.Errorf("Receive = %q, want %q", got, msg)
+		}
+	}
+
+	proxy.mu.RLock()
+	m := proxy.metrics["ws.example.com"]
+	proxy.mu.RUnlock()
+	if got, want := m.numWebSockets.Value(), int64(1); got != want {
+		t.Errorf("numWebSockets = %d, want %d", got, want)
+	}
+	if got, want := m.openWebSockets.Load(), int64(1); got != want {
+		t.Errorf("openWebSockets = %d, want %d", got, want)
+	}
+
+	// The connection is closed by the proxy after IdleTimeout.
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	var got string
+	if err := websocket.Message.Receive(ws, &got); err != io.EOF {
+		t.Errorf("Receive: got %v, want EOF", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Connection closed after %s", d)
+	}
+	for i := 0; m.openWebSockets.Load() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("openWebSockets = %d, want 0", m.openWebSockets.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	proxy.eventsmu.Lock()
+	n := proxy.events["websocket idle timeout"]
+	proxy.eventsmu.Unlock()
+	if n != 1 {
+		t.Errorf("websocket idle timeout events = %d, want 1", n)
+	}
+}
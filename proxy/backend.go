@@ -24,24 +24,72 @@
 package proxy
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"net"
+	"net/http"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 )
 
+const (
+	// pp2TypeClientCert is the custom PROXY protocol v2 TLV type used to
+	// send the DER-encoded client certificate to the backend.
+	pp2TypeClientCert proxyproto.PP2Type = 0xE0
+	// maxClientCertTLVSize is the largest certificate that is sent in a
+	// TLV. The whole PROXY header must fit in 64 KiB.
+	maxClientCertTLVSize = 32768
+)
+
+var errBackendBusy = errors.New("backend busy")
+
+var ppTLSVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// sessionTicketLabel returns the label used to derive the backend's session
+// ticket keys. Each backend has its own keys so that a TLS session can't be
+// resumed with a different backend, which could have different client
+// authentication requirements. The regexps are part of the label so that
+// the backends that only have regexps don't share their keys.
+func (be *Backend) sessionTicketLabel() string {
+	label := strings.Join(be.ServerNames, ",")
+	if len(be.ServerNameRegexps) > 0 {
+		label += "|" + strings.Join(be.ServerNameRegexps, ",")
+	}
+	return label
+}
+
+// displayName returns the name of the backend in events and metrics.
+func (be *Backend) displayName() string {
+	switch {
+	case len(be.ServerNames) > 0:
+		return idnaToUnicode(be.ServerNames[0])
+	case len(be.ServerNameRegexps) > 0:
+		return be.ServerNameRegexps[0]
+	}
+	return be.Mode
+}
+
 func (be *Backend) incInFlight(delta int) int {
 	be.state.mu.Lock()
 	defer be.state.mu.Unlock()
@@ -59,6 +107,12 @@ func (be *Backend) close(ctx context.Context) {
 	if be.httpServer == nil {
 		return
 	}
+	if t := be.httpTransport; t != nil {
+		go t.CloseIdleConnections()
+	}
+	if m := be.mirror; m != nil {
+		go m.transport.CloseIdleConnections()
+	}
 	if ctx == nil {
 		close(be.httpConnChan)
 		go be.httpServer.Close()
@@ -69,7 +123,14 @@ func (be *Backend) close(ctx context.Context) {
 		}
 		return
 	}
-	go be.httpServer.Shutdown(ctx)
+	// Shutdown sends GOAWAY to HTTP/2 clients and waits for active
+	// requests to complete. When ctx expires, the remaining connections
+	// are closed.
+	go func(s *http.Server) {
+		if err := s.Shutdown(ctx); err != nil {
+			s.Close()
+		}
+	}(be.httpServer)
 	be.state.shutdown = true
 	if be.state.inFlight == 0 {
 		close(be.httpConnChan)
@@ -83,7 +144,7 @@ func (be *Backend) close(ctx context.Context) {
 
 func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error) {
 	var (
-		addresses          = be.Addresses
+		addresses          = be.addresses()
 		mode               = be.Mode
 		timeout            = be.ForwardTimeout
 		insecureSkipVerify = be.InsecureSkipVerify
@@ -91,6 +152,8 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 		rootCAs            = be.forwardRootCAs
 		proxyProtoVersion  = be.proxyProtocolVersion
 		next               = &be.state.next
+		group              *splitGroup
+		picked             bool
 	)
 	if id, ok := ctx.Value(ctxOverrideIDKey).(int); ok && id >= 0 && id < len(be.PathOverrides) {
 		po := be.PathOverrides[id]
@@ -102,11 +165,20 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 		rootCAs = po.forwardRootCAs
 		proxyProtoVersion = po.proxyProtocolVersion
 		next = &be.state.oNext[id]
+	} else if id, ok := ctx.Value(ctxDatabaseRouteKey).(int); ok && be.Database != nil && id >= 0 && id < len(be.Database.Routes) {
+		addresses = be.Database.Routes[id].Addresses
+		next = &be.state.dbNext[id]
+	} else if group, picked = be.addressGroup(ctx); group != nil {
+		addresses = group.addresses
+		next = &be.state.gNext[group.index]
 	}
 
 	if len(addresses) == 0 {
 		return nil, errors.New("no backend addresses")
 	}
+	if be.ForwardALPNProtos != nil && (mode == ModeTLS || mode == ModeQUIC) {
+		protos = *be.ForwardALPNProtos
+	}
 	tc := &tls.Config{
 		InsecureSkipVerify:   insecureSkipVerify,
 		ServerName:           serverName,
@@ -131,17 +203,21 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 			return nil
 		},
 	}
-	var max int
-	for {
-		be.state.mu.Lock()
-		sz := len(addresses)
-		if max == 0 {
-			max = sz
-		}
-		addr := addresses[*next]
-		*next = (*next + 1) % sz
-		be.state.mu.Unlock()
+	var preamble func(net.Conn) ([]byte, error)
+	switch {
+	case mode == ModeTLS && be.StartTLS != nil:
+		preamble = be.StartTLS.startTLS
+	case mode == ModePostgres && be.Database != nil && be.Database.ForwardTLS:
+		preamble = postgresStartTLS
+	case mode == ModeMySQL:
+		preamble = mySQLStartTLS
+	}
+	be.state.mu.Lock()
+	addrs := be.orderAddresses(ctx, addresses, next)
+	dialFunc := be.state.dialFunc
+	be.state.mu.Unlock()
 
+	for i, addr := range addrs {
 		var c net.Conn
 		var err error
 		if mode == ModeQUIC {
@@ -149,39 +225,57 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 			c, err = be.dialQUICStream(ctx, addr, tc)
 			cancel()
 		} else {
-			dialer := &net.Dialer{
-				Timeout:   timeout,
-				KeepAlive: 30 * time.Second,
+			if dialFunc != nil {
+				dctx, cancel := context.WithTimeout(ctx, timeout)
+				c, err = dialFunc(dctx, "tcp", addr)
+				cancel()
+			} else {
+				c, err = be.dialTCP(ctx, addr, timeout)
 			}
-			c, err = dialer.DialContext(ctx, "tcp", addr)
 			if err == nil && proxyProtoVersion > 0 {
 				if err = writeProxyHeader(proxyProtoVersion, c, ctx.Value(connCtxKey).(anyConn)); err != nil {
 					c.Close()
 				}
 			}
+			// A server that doesn't complete the preamble and the TLS
+			// handshake is treated like one that can't be reached.
+			if err == nil && preamble != nil {
+				c, err = be.dialStartTLS(ctx, c, tc, timeout, preamble)
+			}
 		}
+		be.reportDial(ctx, addr, err)
 		if err != nil {
-			max--
-			if max > 0 {
+			if i < len(addrs)-1 {
 				log.Printf("ERR dial %q: %v", addr, err)
 				continue
 			}
+			if picked {
+				group.errors.Add(1)
+			}
 			return nil, err
 		}
-		if mode == ModeTLS || mode == ModeHTTPS {
+		if i > 0 {
+			log.Printf("INF dial %s: failed over to %q after %d attempt(s)", be.displayName(), addr, i+1)
+		}
+		if preamble == nil && (mode == ModeTLS || mode == ModeHTTPS) {
 			c = tls.Client(c, tc)
 		}
 		wc := netw.NewConn(c)
+		be.addConnCount(addr, 1)
 		wc.OnClose(func() {
 			be.outConns.remove(wc)
+			be.addConnCount(addr, -1)
 		})
 		be.outConns.add(wc)
 		wc.SetAnnotation(startTimeKey, time.Now())
 		wc.SetAnnotation(modeKey, mode)
 		wc.SetAnnotation(protoKey, strings.Join(protos, ","))
+		family := be.countDialFamily(c)
 		if cc, ok := ctx.Value(connCtxKey).(anyConn); ok {
 			wc.SetAnnotation(serverNameKey, connServerName(cc))
 			annotatedConn(cc).SetAnnotation(internalConnKey, wc)
+			annotatedConn(cc).SetAnnotation(dialAttemptsKey, i+1)
+			annotatedConn(cc).SetAnnotation(dialFamilyKey, family)
 			if proxyProtoVersion > 0 {
 				wc.SetAnnotation(proxyProtoKey, cc.RemoteAddr().Network()+":"+cc.RemoteAddr().String())
 			}
@@ -189,6 +283,226 @@ func (be *Backend) dial(ctx context.Context, protos ...string) (net.Conn, error)
 
 		return wc, nil
 	}
+	return nil, errors.New("no backend addresses")
+}
+
+// waitForward waits until ForwardRateLimit allows a new connection or request
+// to the backend. With Backpressure, at most MaxQueue callers wait at the same
+// time, for at most QueueTimeout. errBackendBusy is returned when the caller
+// can't wait.
+func (be *Backend) waitForward(ctx context.Context) error {
+	bp := be.Backpressure
+	if bp == nil {
+		return be.connLimit.Wait(ctx)
+	}
+	if be.connLimit.Allow() {
+		return nil
+	}
+	be.state.mu.Lock()
+	if bp.MaxQueue > 0 && be.state.queued >= bp.MaxQueue {
+		be.state.mu.Unlock()
+		be.recordEvent(be.displayName() + " backend queue full")
+		return errBackendBusy
+	}
+	be.state.queued++
+	be.state.mu.Unlock()
+	defer func() {
+		be.state.mu.Lock()
+		be.state.queued--
+		be.state.mu.Unlock()
+	}()
+
+	wctx, cancel := context.WithTimeout(ctx, bp.QueueTimeout)
+	defer cancel()
+	if err := be.connLimit.Wait(wctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		be.recordEvent(be.displayName() + " backend queue timeout")
+		return errBackendBusy
+	}
+	return nil
+}
+
+// perRequestForwardLimit returns true when ForwardRateLimit is applied to each
+// HTTP request instead of each connection, so that the requests that can't
+// wait for the backend get a 503 response.
+func (be *Backend) perRequestForwardLimit() bool {
+	return be.Backpressure != nil && (be.Mode == ModeHTTP || be.Mode == ModeHTTPS)
+}
+
+// queueLen returns the number of connections and requests that are waiting
+// for ForwardRateLimit.
+func (be *Backend) queueLen() int {
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	return be.state.queued
+}
+
+// retryAfter returns the value of the Retry-After header that is sent with
+// the responses to the requests that can't wait for the backend.
+func (be *Backend) retryAfter() string {
+	d := 10 * time.Second
+	if bp := be.Backpressure; bp != nil {
+		d = bp.QueueTimeout
+	}
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// dialRetry calls dial. When none of the backend addresses can be reached, it
+// tries again up to Backpressure.DialRetries times, with an exponential
+// backoff.
+func (be *Backend) dialRetry(ctx context.Context, protos ...string) (net.Conn, error) {
+	c, err := be.dial(ctx, protos...)
+	bp := be.Backpressure
+	if err == nil || bp == nil {
+		return c, err
+	}
+	delay := bp.RetryBackoff
+	for i := 0; i < bp.DialRetries; i++ {
+		be.recordEvent(be.displayName() + " dial retry")
+		log.Printf("WRN dial %s: %v, retrying in %s", be.displayName(), err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if c, err = be.dial(ctx, protos...); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// orderAddresses returns the addresses in the order in which they should be
+// tried, according to the backend's LoadBalance policy. be.state.mu must be
+// held.
+func (be *Backend) orderAddresses(ctx context.Context, addresses []string, next *int) []string {
+	sz := len(addresses)
+	out := make([]string, 0, sz)
+	// Round robin is also used to break ties with the other policies.
+	start := *next % sz
+	*next = (start + 1) % sz
+	for i := range sz {
+		out = append(out, addresses[(start+i)%sz])
+	}
+	switch be.LoadBalance {
+	case LoadBalanceLeastConnections:
+		slices.SortStableFunc(out, func(a, b string) int {
+			return be.state.numConns[a] - be.state.numConns[b]
+		})
+	case LoadBalanceConsistentHash:
+		cc, ok := ctx.Value(connCtxKey).(anyConn)
+		if !ok {
+			break
+		}
+		client := cc.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		// Rendezvous hashing: only the clients of an address that is
+		// removed are moved to other addresses.
+		weights := make(map[string]uint64, sz)
+		for _, addr := range out {
+			h := fnv.New64a()
+			h.Write([]byte(client))
+			h.Write([]byte{0})
+			h.Write([]byte(addr))
+			weights[addr] = h.Sum64()
+		}
+		slices.SortStableFunc(out, func(a, b string) int {
+			return cmp.Compare(weights[b], weights[a])
+		})
+	}
+	if be.CircuitBreaker != nil {
+		now := time.Now()
+		slices.SortStableFunc(out, func(a, b string) int {
+			return cmp.Compare(be.circuitOpen(a, now), be.circuitOpen(b, now))
+		})
+	}
+	return out
+}
+
+// addrHealth is the circuit breaker state of a backend address.
+type addrHealth struct {
+	// failures is the number of consecutive dial failures.
+	failures int
+	// openUntil is when the address stops being skipped.
+	openUntil time.Time
+}
+
+// circuitOpen returns 1 when addr failed recently and should be skipped, and 0
+// otherwise. be.state.mu must be held.
+func (be *Backend) circuitOpen(addr string, now time.Time) int {
+	if h := be.state.health[addr]; h != nil && now.Before(h.openUntil) {
+		return 1
+	}
+	return 0
+}
+
+// reportDial updates the circuit breaker state of addr after a dial attempt.
+func (be *Backend) reportDial(ctx context.Context, addr string, err error) {
+	cb := be.CircuitBreaker
+	if cb == nil || ctx.Err() != nil {
+		return
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	h := be.state.health[addr]
+	if err == nil {
+		if h != nil && h.failures >= cb.FailureThreshold {
+			log.Printf("INF dial %s: %q is back", be.displayName(), addr)
+		}
+		delete(be.state.health, addr)
+		return
+	}
+	if h == nil {
+		if be.state.health == nil {
+			be.state.health = make(map[string]*addrHealth)
+		}
+		h = &addrHealth{}
+		be.state.health[addr] = h
+	}
+	h.failures++
+	if h.failures < cb.FailureThreshold {
+		return
+	}
+	cooldown := cb.Cooldown
+	for i := cb.FailureThreshold; i < h.failures && cooldown < cb.MaxCooldown; i++ {
+		cooldown *= 2
+	}
+	cooldown = min(cooldown, cb.MaxCooldown)
+	h.openUntil = time.Now().Add(cooldown)
+	be.recordEvent(be.displayName() + " circuit open")
+	log.Printf("WRN dial %s: skipping %q for %s after %d failure(s)", be.displayName(), addr, cooldown, h.failures)
+}
+
+// unhealthyAddresses returns the addresses that are currently skipped by the
+// circuit breaker.
+func (be *Backend) unhealthyAddresses() []string {
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	var out []string
+	now := time.Now()
+	for addr := range be.state.health {
+		if be.circuitOpen(addr, now) == 1 {
+			out = append(out, addr)
+		}
+	}
+	slices.Sort(out)
+	return out
+}
+
+func (be *Backend) addConnCount(addr string, delta int) {
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	if be.state.numConns == nil {
+		be.state.numConns = make(map[string]int)
+	}
+	if be.state.numConns[addr] += delta; be.state.numConns[addr] <= 0 {
+		delete(be.state.numConns, addr)
+	}
 }
 
 func writeProxyHeader(v byte, out io.Writer, in anyConn) error {
@@ -207,6 +521,15 @@ func writeProxyHeader(v byte, out io.Writer, in anyConn) error {
 			Value: []byte(proto),
 		})
 	}
+	if be := connBackend(in); be != nil && be.ClientAuth != nil && be.ClientAuth.AddClientCertTLVs {
+		if cert := connClientCert(in); cert != nil {
+			t, err := clientCertTLVs(in, cert)
+			if err != nil {
+				return err
+			}
+			tlvs = append(tlvs, t...)
+		}
+	}
 	if err := header.SetTLVs(tlvs); err != nil {
 		return err
 	}
@@ -216,27 +539,94 @@ func writeProxyHeader(v byte, out io.Writer, in anyConn) error {
 	return nil
 }
 
-func (be *Backend) authorize(cert *x509.Certificate) error {
-	if be.ClientAuth == nil || be.ClientAuth.ACL == nil {
-		return nil
+// clientCertTLVs returns the PROXY protocol v2 TLVs that describe the client
+// certificate: a PP2_TYPE_SSL TLV with the TLS version, the certificate's
+// common name, and the cipher, and a custom TLV with the DER-encoded
+// certificate.
+func clientCertTLVs(in anyConn, cert *x509.Certificate) ([]proxyproto.TLV, error) {
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL | tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN,
+	}
+	if tc, ok := annotatedConn(in).Annotation(tlsConnKey, nil).(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		if v, ok := ppTLSVersions[cs.Version]; ok {
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+				Type:  proxyproto.PP2_SUBTYPE_SSL_VERSION,
+				Value: []byte(v),
+			})
+		}
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+			Type:  proxyproto.PP2_SUBTYPE_SSL_CIPHER,
+			Value: []byte(tls.CipherSuiteName(cs.CipherSuite)),
+		})
 	}
-	if subject := cert.Subject.String(); subject != "" && (slices.Contains(*be.ClientAuth.ACL, subject) || slices.Contains(*be.ClientAuth.ACL, "SUBJECT:"+subject)) {
-		return nil
+	if cn := cert.Subject.CommonName; cn != "" {
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+			Type:  proxyproto.PP2_SUBTYPE_SSL_CN,
+			Value: []byte(cn),
+		})
 	}
-	for _, v := range cert.DNSNames {
-		if slices.Contains(*be.ClientAuth.ACL, "DNS:"+v) {
-			return nil
-		}
+	sslTLV, err := ssl.Marshal()
+	if err != nil {
+		return nil, err
 	}
-	for _, v := range cert.EmailAddresses {
-		if slices.Contains(*be.ClientAuth.ACL, "EMAIL:"+v) {
-			return nil
+	tlvs := []proxyproto.TLV{sslTLV}
+	if len(cert.Raw) <= maxClientCertTLVSize {
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  pp2TypeClientCert,
+			Value: cert.Raw,
+		})
+	}
+	return tlvs, nil
+}
+
+// hasServerName returns true if name is one of the backend's server names,
+// either directly, via a wildcard, or via a regular expression.
+func (be *Backend) hasServerName(name string) bool {
+	return slices.Contains(be.ServerNames, name) || slices.Contains(be.ServerNames, wildcardServerName(name)) || be.matchServerNameRegexp(name) || slices.Contains(be.ServerNames, CatchAllServerName)
+}
+
+// metricsServerName returns the name under which the metrics of a connection
+// to serverName are recorded. The connections that are only matched by the
+// catch-all name are all recorded under that name, so that clients can't
+// create an unbounded number of metrics.
+func (be *Backend) metricsServerName(serverName string) string {
+	if !slices.Contains(be.ServerNames, CatchAllServerName) || slices.Contains(be.ServerNames, serverName) || slices.Contains(be.ServerNames, wildcardServerName(serverName)) || be.matchServerNameRegexp(serverName) {
+		return serverName
+	}
+	return CatchAllServerName
+}
+
+// matchServerNameRegexp returns true if name matches one of the backend's
+// ServerNameRegexps.
+func (be *Backend) matchServerNameRegexp(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, re := range be.serverNameRegexps {
+		if re.MatchString(name) {
+			return true
 		}
 	}
-	for _, v := range cert.URIs {
-		if slices.Contains(*be.ClientAuth.ACL, "URI:"+v.String()) {
+	return false
+}
+
+func (be *Backend) authorize(cert *x509.Certificate) error {
+	if be.ClientAuth == nil || (be.ClientAuth.ACL == nil && len(be.ClientAuth.DenyACL) == 0) {
+		return nil
+	}
+	if cert == nil {
+		if be.ClientAuth.Mode == ClientAuthRequest {
 			return nil
 		}
+		return tlsAccessDenied
+	}
+	match := certACLTerm(cert)
+	if matchACL(be.ClientAuth.DenyACL, match) {
+		return tlsAccessDenied
+	}
+	if be.ClientAuth.ACL == nil || matchACL(*be.ClientAuth.ACL, match) {
+		return nil
 	}
 	return tlsAccessDenied
 }
@@ -249,6 +639,11 @@ func (be *Backend) checkIP(addr net.Addr) error {
 	case *net.UDPAddr:
 		ip = a.IP
 	default:
+		// Connections from custom listeners, e.g. in memory, don't
+		// have IP addresses. They are only allowed without IP ACLs.
+		if be.denyIPs == nil && be.denyIPLists == nil && be.allowIPs == nil && be.allowIPLists == nil {
+			return nil
+		}
 		return fmt.Errorf("can't get IP address from %T", addr)
 	}
 	if be.denyIPs != nil {
@@ -258,15 +653,27 @@ func (be *Backend) checkIP(addr net.Addr) error {
 			}
 		}
 	}
+	for _, l := range be.denyIPLists {
+		if l.contains(ip) {
+			return errAccessDenied
+		}
+	}
+	if be.allowIPs == nil && be.allowIPLists == nil {
+		return nil
+	}
 	if be.allowIPs != nil {
 		for _, n := range *be.allowIPs {
 			if n.Contains(ip) {
 				return nil
 			}
 		}
-		return errAccessDenied
 	}
-	return nil
+	for _, l := range be.allowIPLists {
+		if l.contains(ip) {
+			return nil
+		}
+	}
+	return errAccessDenied
 }
 
 func (be *Backend) bridgeConns(client, server net.Conn) error {
@@ -282,12 +689,13 @@ func (be *Backend) bridgeConns(client, server net.Conn) error {
 	if be.HalfCloseTimeout != nil {
 		timeout = *be.HalfCloseTimeout
 	}
+	pool := netw.BufferPoolFor(be.CopyBufferSize)
 	ch := make(chan error)
 	go func() {
-		ch <- forward(client, server, serverClose, timeout)
+		ch <- forward(client, server, serverClose, timeout, pool)
 	}()
 	var retErr error
-	if err := forward(server, client, clientClose, timeout); err != nil && !errors.Is(err, net.ErrClosed) {
+	if err := forward(server, client, clientClose, timeout, pool); err != nil && !errors.Is(err, net.ErrClosed) {
 		retErr = fmt.Errorf("[ext➔ int]: %w", unwrapErr(err))
 	}
 	if err := <-ch; err != nil && !errors.Is(err, net.ErrClosed) {
@@ -296,8 +704,8 @@ func (be *Backend) bridgeConns(client, server net.Conn) error {
 	return retErr
 }
 
-func forward(out net.Conn, in net.Conn, closeWhenDone bool, halfClosedTimeout time.Duration) error {
-	if _, err := io.Copy(out, in); err != nil || closeWhenDone {
+func forward(out net.Conn, in net.Conn, closeWhenDone bool, halfClosedTimeout time.Duration, pool *netw.BufferPool) error {
+	if _, err := netw.Copy(out, in, pool); err != nil || closeWhenDone {
 		out.Close()
 		in.Close()
 		return err
@@ -0,0 +1,569 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+	"golang.org/x/time/rate"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+type fakeConn struct {
+	anyConn
+	remote net.Addr
+}
+
+func (c fakeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestOrderAddresses(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1"}
+	newBackend := func(policy string) *Backend {
+		return &Backend{
+			LoadBalance: policy,
+			state:       &backendState{},
+		}
+	}
+	clientCtx := func(ip string) context.Context {
+		return context.WithValue(context.Background(), connCtxKey, anyConn(fakeConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}}))
+	}
+
+	be := newBackend(LoadBalanceRoundRobin)
+	for _, want := range [][]string{
+		{"a:1", "b:1", "c:1"},
+		{"b:1", "c:1", "a:1"},
+		{"c:1", "a:1", "b:1"},
+		{"a:1", "b:1", "c:1"},
+	} {
+		if got := be.orderAddresses(context.Background(), addrs, &be.state.next); !slices.Equal(got, want) {
+			t.Errorf("round-robin: got %v, want %v", got, want)
+		}
+	}
+
+	be = newBackend(LoadBalanceLeastConnections)
+	be.addConnCount("a:1", 2)
+	be.addConnCount("b:1", 1)
+	be.addConnCount("c:1", 1)
+	if got, want := be.orderAddresses(context.Background(), addrs, &be.state.next), []string{"b:1", "c:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("least-connections: got %v, want %v", got, want)
+	}
+	// Ties are broken with round robin.
+	if got, want := be.orderAddresses(context.Background(), addrs, &be.state.next), []string{"b:1", "c:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("least-connections: got %v, want %v", got, want)
+	}
+	if got, want := be.orderAddresses(context.Background(), addrs, &be.state.next), []string{"c:1", "b:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("least-connections: got %v, want %v", got, want)
+	}
+	be.addConnCount("a:1", -2)
+	if got, want := be.orderAddresses(context.Background(), addrs, &be.state.next)[0], "a:1"; got != want {
+		t.Errorf("least-connections: got %v, want %v", got, want)
+	}
+	if len(be.state.numConns) != 2 {
+		t.Errorf("numConns = %v", be.state.numConns)
+	}
+
+	be = newBackend(LoadBalanceConsistentHash)
+	seen := make(map[string]bool)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8"} {
+		first := be.orderAddresses(clientCtx(ip), addrs, &be.state.next)
+		for range 5 {
+			if got := be.orderAddresses(clientCtx(ip), addrs, &be.state.next); !slices.Equal(got, first) {
+				t.Errorf("consistent-hash(%s): got %v, want %v", ip, got, first)
+			}
+		}
+		seen[first[0]] = true
+		// Removing an address that isn't the client's first choice
+		// doesn't change the first choice.
+		others := slices.DeleteFunc(slices.Clone(addrs), func(a string) bool { return a == first[2] })
+		if got := be.orderAddresses(clientCtx(ip), others, &be.state.next); got[0] != first[0] {
+			t.Errorf("consistent-hash(%s): got %v, want %v first", ip, got, first[0])
+		}
+	}
+	if len(seen) < 2 {
+		t.Errorf("consistent-hash: all clients use the same address: %v", seen)
+	}
+}
+
+type fakeNetConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c fakeNetConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c fakeNetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestWriteProxyHeaderClientCert(t *testing.T) {
+	tlsCert := newTestClientCert(t)
+	cert := tlsCert.Leaf
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := netw.NewConnForTest(fakeNetConn{
+		Conn:   c1,
+		local:  &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 12345},
+	})
+	server := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	client := tls.Client(c2, &tls.Config{
+		Certificates:       []tls.Certificate{tlsCert},
+		InsecureSkipVerify: true,
+	})
+	ch := make(chan error)
+	go func() {
+		ch <- client.Handshake()
+	}()
+	if err := server.Handshake(); err != nil {
+		t.Fatalf("server.Handshake: %v", err)
+	}
+	if err := <-ch; err != nil {
+		t.Fatalf("client.Handshake: %v", err)
+	}
+	conn.SetAnnotation(tlsConnKey, server)
+	conn.SetAnnotation(serverNameKey, "example.com")
+	conn.SetAnnotation(clientCertKey, cert)
+	conn.SetAnnotation(backendKey, &Backend{
+		ClientAuth: &ClientAuth{AddClientCertTLVs: true},
+	})
+
+	var buf bytes.Buffer
+	if err := writeProxyHeader(2, &buf, conn); err != nil {
+		t.Fatalf("writeProxyHeader: %v", err)
+	}
+	header, err := proxyproto.Read(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("proxyproto.Read: %v", err)
+	}
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("header.TLVs: %v", err)
+	}
+	ssl, ok := tlvparse.FindSSL(tlvs)
+	if !ok {
+		t.Fatal("PP2_TYPE_SSL TLV not found")
+	}
+	if !ssl.ClientSSL() || !ssl.ClientCertConn() {
+		t.Errorf("ssl.Client = %x", ssl.Client)
+	}
+	if v, ok := ssl.SSLVersion(); !ok || v != "TLSv1.3" {
+		t.Errorf("SSLVersion() = %q, %v, want TLSv1.3", v, ok)
+	}
+	if cn, ok := ssl.ClientCN(); !ok || cn != "Bob" {
+		t.Errorf("ClientCN() = %q, %v, want Bob", cn, ok)
+	}
+	var found bool
+	for _, tlv := range tlvs {
+		if tlv.Type == pp2TypeClientCert {
+			found = true
+			if !bytes.Equal(tlv.Value, cert.Raw) {
+				t.Error("client cert TLV doesn't match certificate")
+			}
+		}
+	}
+	if !found {
+		t.Error("client cert TLV not found")
+	}
+
+	// Without AddClientCertTLVs, no SSL TLV is sent.
+	conn.SetAnnotation(backendKey, &Backend{ClientAuth: &ClientAuth{}})
+	buf.Reset()
+	if err := writeProxyHeader(2, &buf, conn); err != nil {
+		t.Fatalf("writeProxyHeader: %v", err)
+	}
+	if header, err = proxyproto.Read(bufio.NewReader(&buf)); err != nil {
+		t.Fatalf("proxyproto.Read: %v", err)
+	}
+	if tlvs, err = header.TLVs(); err != nil {
+		t.Fatalf("header.TLVs: %v", err)
+	}
+	if _, ok := tlvparse.FindSSL(tlvs); ok {
+		t.Error("unexpected PP2_TYPE_SSL TLV")
+	}
+}
+
+func TestForwardALPNProtos(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// The backend server replies with the server name and the protocol
+	// that it received.
+	tc := intCA.TLSConfig()
+	tc.NextProtos = []string{"imap", "pop3"}
+	l, err := tls.Listen("tcp", "localhost:0", tc)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					t.Errorf("Accept: %v", err)
+				}
+				return
+			}
+			go func(c *tls.Conn) {
+				defer c.Close()
+				if err := c.Handshake(); err != nil {
+					t.Logf("Handshake: %v", err)
+					return
+				}
+				cs := c.ConnectionState()
+				fmt.Fprintf(c, "%s %s\n", cs.ServerName, cs.NegotiatedProtocol)
+			}(conn.(*tls.Conn))
+		}
+	}()
+
+	backend := func(name, forwardName string, forwardProtos *[]string) *Backend {
+		return &Backend{
+			ServerNames:       []string{name},
+			Addresses:         []string{l.Addr().String()},
+			Mode:              "TLS",
+			ALPNProtos:        &[]string{"imap"},
+			ForwardServerName: forwardName,
+			ForwardRootCAs:    []string{intCA.RootCAPEM()},
+			ForwardALPNProtos: forwardProtos,
+		}
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			backend("default.example.com", "a.internal.example.com", nil),
+			backend("override.example.com", "b.internal.example.com", &[]string{"pop3"}),
+			backend("none.example.com", "c.internal.example.com", &[]string{}),
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{host: "default.example.com", want: "a.internal.example.com imap\n"},
+		{host: "override.example.com", want: "b.internal.example.com pop3\n"},
+		{host: "none.example.com", want: "c.internal.example.com \n"},
+	} {
+		got, _, err := tlsGet(tc.host, proxy.listener.Addr().String(), "", extCA, nil, []string{"imap"})
+		if err != nil {
+			t.Fatalf("%s: tlsGet: %v", tc.host, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: Got %q, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func TestWaitForward(t *testing.T) {
+	var events []string
+	be := &Backend{
+		ServerNames: []string{"example.com"},
+		Backpressure: &Backpressure{
+			MaxQueue:     1,
+			QueueTimeout: 100 * time.Millisecond,
+		},
+		connLimit:   rate.NewLimiter(rate.Every(time.Second), 1),
+		state:       new(backendState),
+		recordEvent: func(e string) { events = append(events, e) },
+	}
+	ctx := context.Background()
+	if err := be.waitForward(ctx); err != nil {
+		t.Fatalf("waitForward: %v", err)
+	}
+	if err := be.waitForward(ctx); err != errBackendBusy {
+		t.Fatalf("waitForward: %v, want %v", err, errBackendBusy)
+	}
+
+	be.Backpressure.QueueTimeout = 5 * time.Second
+	done := make(chan error)
+	go func() {
+		done <- be.waitForward(ctx)
+	}()
+	for be.queueLen() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := be.waitForward(ctx); err != errBackendBusy {
+		t.Fatalf("waitForward: %v, want %v", err, errBackendBusy)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("queued waitForward: %v", err)
+	}
+	if got, want := be.retryAfter(), "5"; got != want {
+		t.Errorf("retryAfter() = %q, want %q", got, want)
+	}
+	want := []string{"example.com backend queue timeout", "example.com backend queue full"}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// The address of the TCP backend doesn't accept connections until
+	// after the proxy's first dial attempt.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	tcpAddr := l.Addr().String()
+	l.Close()
+
+	httpAddr := newHTTPServer(t, ctx, "http", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"tcp.example.com"},
+				Addresses:   []string{tcpAddr},
+				Mode:        ModeTCP,
+				Backpressure: &Backpressure{
+					DialRetries:  5,
+					RetryBackoff: 50 * time.Millisecond,
+				},
+			},
+			{
+				ServerNames:      []string{"http.example.com"},
+				Addresses:        []string{httpAddr.String()},
+				Mode:             ModeHTTP,
+				ForwardRateLimit: 1,
+				Backpressure: &Backpressure{
+					QueueTimeout: 100 * time.Millisecond,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	time.AfterFunc(75*time.Millisecond, func() {
+		l, err := net.Listen("tcp", tcpAddr)
+		if err != nil {
+			t.Errorf("Listen: %v", err)
+			return
+		}
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, "Hello from tcp")
+			conn.Close()
+		}
+	})
+	got, _, err := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "", ca, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from tcp\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	var statuses []string
+	for range 3 {
+		got, _, err := httpGet("http.example.com", proxy.listener.Addr().String(), "/", ca, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		statuses = append(statuses, strings.SplitN(got, "\n", 2)[0])
+	}
+	want := []string{
+		"HTTP/2.0 200 OK",
+		"HTTP/2.0 503 Service Unavailable",
+		"HTTP/2.0 503 Service Unavailable",
+	}
+	if !slices.Equal(statuses, want) {
+		t.Errorf("Got %q, want %q", statuses, want)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var events []string
+	be := &Backend{
+		ServerNames: []string{"example.com"},
+		CircuitBreaker: &CircuitBreaker{
+			FailureThreshold: 2,
+			Cooldown:         time.Minute,
+			MaxCooldown:      3 * time.Minute,
+		},
+		state:       &backendState{},
+		recordEvent: func(e string) { events = append(events, e) },
+	}
+	ctx := context.Background()
+	addrs := []string{"a:1", "b:1", "c:1"}
+	errDial := errors.New("dial error")
+
+	cooldown := func(addr string) time.Duration {
+		h := be.state.health[addr]
+		if h == nil || h.openUntil.IsZero() {
+			return 0
+		}
+		return time.Until(h.openUntil).Round(time.Minute)
+	}
+	for _, want := range []time.Duration{0, 0, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		if got := cooldown("a:1"); got != want {
+			t.Errorf("cooldown = %s, want %s", got, want)
+		}
+		be.reportDial(ctx, "a:1", errDial)
+	}
+	if got, want := be.unhealthyAddresses(), []string{"a:1"}; !slices.Equal(got, want) {
+		t.Errorf("unhealthyAddresses() = %v, want %v", got, want)
+	}
+	// The unhealthy address is tried last.
+	if got, want := be.orderAddresses(ctx, addrs, &be.state.next), []string{"b:1", "c:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("orderAddresses() = %v, want %v", got, want)
+	}
+	be.reportDial(ctx, "a:1", nil)
+	if got := be.unhealthyAddresses(); len(got) != 0 {
+		t.Errorf("unhealthyAddresses() = %v, want none", got)
+	}
+	// Back to round robin.
+	be.orderAddresses(ctx, addrs, &be.state.next)
+	if got, want := be.orderAddresses(ctx, addrs, &be.state.next), []string{"c:1", "a:1", "b:1"}; !slices.Equal(got, want) {
+		t.Errorf("orderAddresses() = %v, want %v", got, want)
+	}
+
+	// Failures caused by canceled contexts don't count.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	be.reportDial(cctx, "b:1", errDial)
+	be.reportDial(cctx, "b:1", errDial)
+	if got := be.unhealthyAddresses(); len(got) != 0 {
+		t.Errorf("unhealthyAddresses() = %v, want none", got)
+	}
+	if got, want := len(events), 4; got != want {
+		t.Errorf("len(events) = %d, want %d", got, want)
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	deadAddr := l.Addr().String()
+	l.Close()
+	live := newTCPServer(t, ctx, "live", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:    []string{"example.com"},
+				Addresses:      []string{deadAddr, live.listener.Addr().String()},
+				Mode:           ModeTCP,
+				CircuitBreaker: &CircuitBreaker{},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for range 4 {
+		got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "", ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+		if want := "Hello from live\n"; got != want {
+			t.Errorf("Got %q, want %q", got, want)
+		}
+	}
+	be := proxy.cfg.Backends[0]
+	if got, want := be.unhealthyAddresses(), []string{deadAddr}; !slices.Equal(got, want) {
+		t.Errorf("unhealthyAddresses() = %v, want %v", got, want)
+	}
+	// The dead address was only tried once.
+	if got := be.state.health[deadAddr].failures; got != 1 {
+		t.Errorf("failures = %d, want 1", got)
+	}
+}
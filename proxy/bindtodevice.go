@@ -20,22 +20,29 @@
 // LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
-
-//go:build pprof
+//go:build linux
 
 package proxy
 
 import (
-	"net/http"
-	"net/http/pprof"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
-func addPProfHandlers(h *[]localHandler) {
-	*h = append(*h,
-		localHandler{path: "/debug/pprof", matchPrefix: true, handler: http.HandlerFunc(pprof.Index)},
-		localHandler{path: "/debug/pprof/cmdline", handler: http.HandlerFunc(pprof.Cmdline)},
-		localHandler{path: "/debug/pprof/profile", handler: http.HandlerFunc(pprof.Profile)},
-		localHandler{path: "/debug/pprof/symbol", handler: http.HandlerFunc(pprof.Symbol)},
-		localHandler{path: "/debug/pprof/trace", handler: http.HandlerFunc(pprof.Trace)},
-	)
+const bindToDeviceSupported = true
+
+// bindToDevice binds a socket to a network interface, or a VRF device.
+func bindToDevice(c syscall.RawConn, name string) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, name)
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return fmt.Errorf("SO_BINDTODEVICE %q: %w", name, serr)
+	}
+	return nil
 }
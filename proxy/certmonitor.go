@@ -0,0 +1,238 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCertMonitorInterval    = time.Hour
+	defaultCertMonitorAlertBefore = 20 * 24 * time.Hour
+)
+
+// certMonitorState contains the result of the last certificate inventory,
+// and the certificates that were already reported.
+type certMonitorState struct {
+	mu      sync.Mutex
+	certs   []adminCertificate
+	alerted map[string]bool
+}
+
+// certExpiry is the expiry of the certificate used for one server name.
+type certExpiry struct {
+	ServerName string
+	Source     string
+	NotAfter   time.Time
+	DaysLeft   float64
+}
+
+// certificateInventory returns the certificates that are loaded from files
+// and the ones that are obtained with ACME.
+func (p *Proxy) certificateInventory(ctx context.Context) []adminCertificate {
+	var out []adminCertificate
+	p.mu.RLock()
+	for _, be := range p.cfg.Backends {
+		if be.staticCert == nil {
+			continue
+		}
+		cert := be.staticCert.current()
+		if cert == nil || cert.Leaf == nil {
+			continue
+		}
+		ac := newAdminCertificate("file", cert)
+		ac.Key = be.CertFile
+		if !isFileName(ac.Key) {
+			ac.Key = ""
+		}
+		ac.ServerNames = be.ServerNames
+		out = append(out, ac)
+	}
+	p.mu.RUnlock()
+
+	if certs, err := p.acmeAllCerts(ctx); err == nil {
+		keys := make([]string, 0, len(certs))
+		for k := range certs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ac := newAdminCertificate("acme", certs[k])
+			ac.Key = k
+			out = append(out, ac)
+		}
+	}
+	return out
+}
+
+// certificateExpiry returns the expiry of the certificates from the last
+// inventory, per server name.
+func (p *Proxy) certificateExpiry() []certExpiry {
+	now := time.Now()
+	var out []certExpiry
+	p.certMonitor.mu.Lock()
+	for _, c := range p.certMonitor.certs {
+		for _, sn := range c.names() {
+			out = append(out, certExpiry{
+				ServerName: idnaToUnicode(sn),
+				Source:     c.Source,
+				NotAfter:   c.NotAfter,
+				DaysLeft:   c.NotAfter.Sub(now).Hours() / 24,
+			})
+		}
+	}
+	p.certMonitor.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].ServerName == out[j].ServerName {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].ServerName < out[j].ServerName
+	})
+	return out
+}
+
+// names returns the server names that use the certificate.
+func (c adminCertificate) names() []string {
+	if len(c.ServerNames) > 0 {
+		return c.ServerNames
+	}
+	return c.DNSNames
+}
+
+// certMonitorLoop takes an inventory of the certificates periodically.
+func (p *Proxy) certMonitorLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		p.mu.RLock()
+		cm := p.cfg.CertificateMonitor
+		p.mu.RUnlock()
+		if cm == nil {
+			cm = &ConfigCertificateMonitor{
+				Interval:    defaultCertMonitorInterval,
+				AlertBefore: defaultCertMonitorAlertBefore,
+			}
+		}
+		p.checkCertificates(ctx, cm)
+		select {
+		case <-ctx.Done():
+		case <-time.After(cm.Interval):
+		}
+	}
+}
+
+// checkCertificates updates the certificate inventory, and raises an alert
+// for each certificate that expires within cm.AlertBefore. Each certificate
+// is reported only once.
+func (p *Proxy) checkCertificates(ctx context.Context, cm *ConfigCertificateMonitor) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	certs := p.certificateInventory(ctx)
+	if m, ok := p.certManager.(*acmeManager); ok {
+		for _, c := range certs {
+			if c.Source != "acme" || c.NotAfter.Before(time.Now()) {
+				continue
+			}
+			for _, sn := range c.DNSNames {
+				m.queue.setValid(sn, c.NotAfter)
+			}
+		}
+	}
+
+	now := time.Now()
+	alerted := make(map[string]bool)
+	var alerts []adminCertificate
+	p.certMonitor.mu.Lock()
+	p.certMonitor.certs = certs
+	for _, c := range certs {
+		if c.NotAfter.Sub(now) > cm.AlertBefore {
+			continue
+		}
+		key := strings.Join([]string{c.Source, c.Key, c.Subject, c.NotAfter.String()}, " ")
+		if !p.certMonitor.alerted[key] {
+			alerts = append(alerts, c)
+		}
+		alerted[key] = true
+	}
+	// Forget the certificates that were renewed or removed.
+	p.certMonitor.alerted = alerted
+	p.certMonitor.mu.Unlock()
+
+	for _, c := range alerts {
+		names := make([]string, 0, len(c.names()))
+		for _, sn := range c.names() {
+			names = append(names, idnaToUnicode(sn))
+		}
+		log.Printf("WRN Certificate for %s (%s) expires %s", strings.Join(names, ","), c.Source, c.NotAfter.Format(time.RFC3339))
+		p.recordEvent("certificate expiring " + strings.Join(names, ","))
+		if cm.WebhookURL == "" {
+			continue
+		}
+		if err := sendCertificateAlert(ctx, cm, c, now); err != nil {
+			log.Printf("ERR Certificate alert webhook: %v", err)
+		}
+	}
+}
+
+// sendCertificateAlert sends an alert about a certificate that expires soon
+// to the webhook URL.
+func sendCertificateAlert(ctx context.Context, cm *ConfigCertificateMonitor, c adminCertificate, now time.Time) error {
+	body, err := json.Marshal(struct {
+		Event       string           `json:"event"`
+		DaysLeft    int              `json:"daysLeft"`
+		Certificate adminCertificate `json:"certificate"`
+	}{
+		Event:       "certificate expiring",
+		DaysLeft:    int(c.NotAfter.Sub(now).Hours() / 24),
+		Certificate: c,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cm.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range cm.WebhookHeaders {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("user-agent", "tlsproxy")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
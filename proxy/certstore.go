@@ -0,0 +1,156 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/c2FmZQ/storage/autocertcache"
+	"github.com/c2FmZQ/storage/crypto"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/certstore"
+)
+
+const (
+	certStoreMasterKey   = "masterkey"
+	certStoreCachePrefix = "autocert/"
+)
+
+// keyedCache is an autocert cache that can list and delete its keys.
+type keyedCache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
+	Keys(ctx context.Context) ([]string, error)
+	DeleteKeys(ctx context.Context, keys []string) error
+}
+
+var (
+	_ keyedCache = (*autocertcache.Cache)(nil)
+	_ keyedCache = (*certstore.Cache)(nil)
+)
+
+// newCertificateStore returns the certstore.Store for cs.
+func newCertificateStore(ctx context.Context, cs *ConfigCertificateStore) (certstore.Store, error) {
+	switch cs.Type {
+	case "s3", "gcs":
+		return certstore.NewS3(cs.Endpoint, cs.Region, cs.Bucket, cs.AccessKeyID, cs.SecretAccessKey)
+	case "redis":
+		var tc *tls.Config
+		if cs.TLS {
+			tc = &tls.Config{}
+		}
+		return certstore.NewRedis(cs.Address, cs.Password, cs.DB, tc), nil
+	case "sql":
+		return certstore.NewSQL(ctx, cs.Driver, cs.DSN, cs.Table)
+	default:
+		return nil, fmt.Errorf("unexpected certificate store type %q", cs.Type)
+	}
+}
+
+// openCertificateStore opens the external certificate store and returns an
+// autocert cache that uses it. The master key that encrypts the cache is
+// stored in the certificate store, protected by the passphrase, so that all
+// the proxies that use the same store can decrypt it. A copy of the master
+// key is kept in CacheDir.
+//
+// When the certificate store is empty, the content of the local autocert
+// cache is copied to it.
+func openCertificateStore(cfg *Config, passphrase []byte, local keyedCache, opts ...crypto.Option) (*certstore.Cache, masterKeyFile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cs := cfg.CertificateStore
+	store, err := newCertificateStore(ctx, cs)
+	if err != nil {
+		return nil, masterKeyFile{}, fmt.Errorf("certificateStore: %w", err)
+	}
+	mkFile := filepath.Join(cfg.CacheDir, "certstore-masterkey")
+	mkName := cs.Prefix + certStoreMasterKey
+	remote, err := store.Get(ctx, mkName)
+	switch {
+	case err == nil:
+		if err := os.WriteFile(mkFile, remote, 0o600); err != nil {
+			return nil, masterKeyFile{}, err
+		}
+	case errors.Is(err, certstore.ErrNotFound):
+		remote = nil
+	default:
+		return nil, masterKeyFile{}, fmt.Errorf("certificateStore: %w", err)
+	}
+	mk, err := readOrCreateMasterKey(passphrase, mkFile, opts...)
+	if err != nil {
+		return nil, masterKeyFile{}, err
+	}
+	if remote == nil {
+		b, err := os.ReadFile(mkFile)
+		if err != nil {
+			return nil, masterKeyFile{}, err
+		}
+		if err := store.Put(ctx, mkName, b); err != nil {
+			return nil, masterKeyFile{}, fmt.Errorf("certificateStore: %w", err)
+		}
+	}
+
+	mkf := masterKeyFile{
+		mk:   mk,
+		file: mkFile,
+		upload: func(data []byte) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			return store.Put(ctx, mkName, data)
+		},
+	}
+	cache := certstore.NewCache(store, cs.Prefix+certStoreCachePrefix, mk)
+	keys, err := cache.Keys(ctx)
+	if err != nil {
+		return nil, masterKeyFile{}, fmt.Errorf("certificateStore: %w", err)
+	}
+	if len(keys) > 0 {
+		return cache, mkf, nil
+	}
+	if keys, err = local.Keys(ctx); err != nil {
+		return nil, masterKeyFile{}, err
+	}
+	for _, k := range keys {
+		v, err := local.Get(ctx, k)
+		if err != nil {
+			return nil, masterKeyFile{}, err
+		}
+		if err := cache.Put(ctx, k, v); err != nil {
+			return nil, masterKeyFile{}, fmt.Errorf("certificateStore: %w", err)
+		}
+	}
+	if len(keys) > 0 {
+		log.Printf("INF Copied %d entries from the local certificate cache to the %s certificate store", len(keys), cs.Type)
+	}
+	return cache, mkf, nil
+}
@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCertificateStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(req.URL.Path, "/bucket/")
+		switch req.Method {
+		case http.MethodGet:
+			if key == "" {
+				io.WriteString(w, "<ListBucketResult>")
+				for k := range objects {
+					if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+						io.WriteString(w, "<Contents><Key>"+k+"</Key></Contents>")
+					}
+				}
+				io.WriteString(w, "</ListBucketResult>")
+				return
+			}
+			v, ok := objects[key]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(v)
+		case http.MethodPut:
+			objects[key], _ = io.ReadAll(req.Body)
+		case http.MethodDelete:
+			delete(objects, key)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	localDir := t.TempDir()
+	newProxy := func(cacheDir string, withStore bool) *Proxy {
+		cfg := &Config{
+			HTTPAddr:  "localhost:0",
+			TLSAddr:   "localhost:0",
+			CacheDir:  cacheDir,
+			AcceptTOS: true,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{"192.168.0.1:443"},
+					Mode:        ModeTCP,
+				},
+			},
+		}
+		if withStore {
+			cfg.CertificateStore = &ConfigCertificateStore{
+				Type:            "s3",
+				Prefix:          "tlsproxy/",
+				Endpoint:        srv.URL,
+				Bucket:          "bucket",
+				AccessKeyID:     "keyid",
+				SecretAccessKey: "secret",
+			}
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("cfg.Check: %v", err)
+		}
+		p, err := New(cfg, []byte("test"))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return p
+	}
+
+	// Local cache only.
+	p0 := newProxy(localDir, false)
+	cache, err := p0.autocertCache()
+	if err != nil {
+		t.Fatalf("autocertCache: %v", err)
+	}
+	if err := cache.Put(ctx, "example.com", []byte("certificate")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The local cache is copied to the empty certificate store.
+	newProxy(localDir, true)
+	mu.Lock()
+	if _, ok := objects["tlsproxy/masterkey"]; !ok {
+		t.Error("masterkey not in certificate store")
+	}
+	if v, ok := objects["tlsproxy/autocert/example.com"]; !ok || string(v) == "certificate" {
+		t.Errorf("example.com = %q, %v, want encrypted value", v, ok)
+	}
+	mu.Unlock()
+
+	// Another proxy, with a new cache directory, can read the
+	// certificates.
+	p2 := newProxy(t.TempDir(), true)
+	if cache, err = p2.autocertCache(); err != nil {
+		t.Fatalf("autocertCache: %v", err)
+	}
+	got, err := cache.Get(ctx, "example.com")
+	if err != nil || string(got) != "certificate" {
+		t.Errorf("Get() = %q, %v, want certificate", got, err)
+	}
+	keys, err := cache.Keys(ctx)
+	if err != nil || len(keys) != 1 || keys[0] != "example.com" {
+		t.Errorf("Keys() = %q, %v, want [example.com]", keys, err)
+	}
+
+	cfg := &Config{
+		AcceptTOS:        true,
+		HWBacked:         true,
+		CacheDir:         t.TempDir(),
+		CertificateStore: &ConfigCertificateStore{Type: "redis", Address: "localhost:6379"},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with HWBacked succeeded")
+	}
+	cfg.HWBacked = false
+	cfg.CertificateStore = &ConfigCertificateStore{Type: "sql", Driver: "nonexistent"}
+	if err := cfg.Check(); err == nil {
+		t.Error("Check() with unregistered sql driver succeeded")
+	}
+}
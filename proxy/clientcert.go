@@ -0,0 +1,196 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
+)
+
+const (
+	// forwardClientCertsFile is where the client certificates issued by
+	// the local PKIs for backend connections are stored.
+	forwardClientCertsFile = "forward-client-certs"
+	// defaultForwardClientCertLifetime is the default lifetime of the
+	// client certificates issued by the local PKIs.
+	defaultForwardClientCertLifetime = 7 * 24 * time.Hour
+)
+
+// issuedClientCert is a client certificate and its private key, in DER
+// format.
+type issuedClientCert struct {
+	Cert []byte `json:"cert"`
+	Key  []byte `json:"key"`
+}
+
+// forwardClientCertFunc returns the function that gets the client certificate
+// to present to the backend servers, as configured in be.ForwardClientCert.
+func (p *Proxy) forwardClientCertFunc(be *Backend, pkis map[string]*pki.PKIManager) func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	fc := be.ForwardClientCert
+	var getCert func() (*tls.Certificate, error)
+	if fc.staticCert != nil {
+		getCert = func() (*tls.Certificate, error) {
+			return fc.staticCert.getCertificate(nil)
+		}
+	} else {
+		cn := fc.CommonName
+		if cn == "" {
+			cn = be.ServerNames[0]
+		}
+		lifetime := fc.Lifetime
+		if lifetime == 0 {
+			lifetime = defaultForwardClientCertLifetime
+		}
+		c := &pkiClientCert{
+			store:    p.store,
+			pki:      pkis[fc.PKI],
+			key:      fc.PKI + "/" + cn,
+			cn:       cn,
+			lifetime: lifetime,
+		}
+		getCert = c.getCertificate
+	}
+	return func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return getCert()
+		}
+	}
+}
+
+// pkiClientCert is a client certificate issued by a local PKI. It is saved
+// in the proxy's storage so that it can be reused after a restart or a config
+// change, and it is renewed when two thirds of its lifetime have passed.
+type pkiClientCert struct {
+	store    *storage.Storage
+	pki      *pki.PKIManager
+	key      string
+	cn       string
+	lifetime time.Duration
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+func (c *pkiClientCert) getCertificate() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && !needsRenewal(c.cert.Leaf) {
+		return c.cert, nil
+	}
+	cert, err := c.loadOrIssue()
+	if err != nil {
+		if c.cert != nil && time.Now().Before(c.cert.Leaf.NotAfter) {
+			// Keep using the current certificate until it expires.
+			log.Printf("ERR Renewing client certificate %s: %v", c.key, err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert = cert
+	return cert, nil
+}
+
+// loadOrIssue returns the certificate from storage if it doesn't need to be
+// renewed yet. Otherwise, it issues a new certificate and saves it.
+func (c *pkiClientCert) loadOrIssue() (cert *tls.Certificate, retErr error) {
+	c.store.CreateEmptyFile(forwardClientCertsFile, map[string]*issuedClientCert{})
+	var certs map[string]*issuedClientCert
+	commit, err := c.store.OpenForUpdate(forwardClientCertsFile, &certs)
+	if err != nil {
+		return nil, err
+	}
+	defer commit(false, &retErr)
+	if certs == nil {
+		certs = make(map[string]*issuedClientCert)
+	}
+	if ic, ok := certs[c.key]; ok {
+		if cert, err := ic.tlsCertificate(); err == nil && !needsRenewal(cert.Leaf) {
+			return cert, nil
+		}
+	}
+	if c.pki == nil {
+		return nil, errors.New("pki not found")
+	}
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := c.pki.IssueCertificateWithLifetime(&x509.CertificateRequest{
+		PublicKey: &privKey.PublicKey,
+		Subject:   pkix.Name{CommonName: c.cn},
+	}, c.lifetime)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	ic := &issuedClientCert{Cert: raw, Key: key}
+	if cert, err = ic.tlsCertificate(); err != nil {
+		return nil, err
+	}
+	certs[c.key] = ic
+	if err := commit(true, nil); err != nil {
+		return nil, err
+	}
+	log.Printf("INF Issued client certificate %s, expires %s", c.key, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return cert, nil
+}
+
+func (ic *issuedClientCert) tlsCertificate() (*tls.Certificate, error) {
+	leaf, err := x509.ParseCertificate(ic.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(ic.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{ic.Cert},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// needsRenewal returns true when two thirds of the certificate's lifetime
+// have passed.
+func needsRenewal(cert *x509.Certificate) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return time.Now().After(cert.NotBefore.Add(lifetime * 2 / 3))
+}
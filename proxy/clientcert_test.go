@@ -0,0 +1,223 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestForwardClientCert(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	clientCA, err := certmanager.New("client-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertFiles(t, clientCA, "static-client", certFile, keyFile)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		PKI: []*ConfigPKI{
+			{Name: "TEST CA"},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"console.example.com"},
+				Mode:        "CONSOLE",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	pkiCA, err := proxy.pkis["TEST CA"].CACert()
+	if err != nil {
+		t.Fatalf("CACert: %v", err)
+	}
+	clientCAs := clientCA.RootCACertPool()
+	clientCAs.AddCert(pkiCA)
+	be := newClientCertServer(t, ctx, intCA, clientCAs)
+
+	backend := func(name string, fc *ForwardClientCert) *Backend {
+		return &Backend{
+			ServerNames:       []string{name},
+			Addresses:         []string{be.String()},
+			Mode:              "TLS",
+			ForwardRootCAs:    []string{intCA.RootCAPEM()},
+			ForwardServerName: "backend.internal.example.com",
+			ForwardClientCert: fc,
+		}
+	}
+	cfg = &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: cfg.CacheDir,
+		MaxOpen:  100,
+		PKI: []*ConfigPKI{
+			{Name: "TEST CA"},
+		},
+		Backends: []*Backend{
+			backend("default.example.com", nil),
+			backend("static.example.com", &ForwardClientCert{
+				CertFile: certFile,
+				KeyFile:  keyFile,
+			}),
+			backend("pki.example.com", &ForwardClientCert{
+				PKI: "TEST CA",
+			}),
+			backend("pki-cn.example.com", &ForwardClientCert{
+				PKI:        "TEST CA",
+				CommonName: "custom-name",
+				Lifetime:   time.Hour,
+			}),
+		},
+	}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+
+	for _, tc := range []struct {
+		host string
+		want string
+	}{
+		{host: "default.example.com", want: ""},
+		{host: "static.example.com", want: "Hello static-client\n"},
+		{host: "pki.example.com", want: "Hello pki.example.com\n"},
+		{host: "pki-cn.example.com", want: "Hello custom-name\n"},
+	} {
+		got, _, err := tlsGet(tc.host, proxy.listener.Addr().String(), "", extCA, nil, nil)
+		if err != nil {
+			t.Fatalf("%s: tlsGet: %v", tc.host, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: Got %q, want %q", tc.host, got, tc.want)
+		}
+	}
+
+	var certs map[string]*issuedClientCert
+	if err := proxy.store.ReadDataFile(forwardClientCertsFile, &certs); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if got, want := len(certs), 2; got != want {
+		t.Fatalf("len(certs) = %d, want %d", got, want)
+	}
+	saved := certs["TEST CA/custom-name"].Cert
+
+	// The saved certificate is reused after a config change.
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if _, _, err := tlsGet("pki-cn.example.com", proxy.listener.Addr().String(), "", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	certs = nil
+	if err := proxy.store.ReadDataFile(forwardClientCertsFile, &certs); err != nil {
+		t.Fatalf("ReadDataFile: %v", err)
+	}
+	if got := certs["TEST CA/custom-name"].Cert; string(got) != string(saved) {
+		t.Error("client certificate was re-issued")
+	}
+}
+
+func TestNeedsRenewal(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		notBefore, notAfter time.Time
+		want                bool
+	}{
+		{notBefore: now.Add(-time.Hour), notAfter: now.Add(2 * time.Hour), want: false},
+		{notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(59 * time.Minute), want: true},
+		{notBefore: now.Add(-2 * time.Hour), notAfter: now.Add(-time.Hour), want: true},
+	} {
+		cert := &x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notAfter}
+		if got := needsRenewal(cert); got != tc.want {
+			t.Errorf("needsRenewal(%s, %s) = %v, want %v", tc.notBefore, tc.notAfter, got, tc.want)
+		}
+	}
+}
+
+// newClientCertServer starts a TLS server that requires a client certificate
+// and replies with the client certificate's common name.
+func newClientCertServer(t *testing.T, ctx context.Context, ca *certmanager.CertManager, clientCAs *x509.CertPool) net.Addr {
+	tc := ca.TLSConfig()
+	tc.ClientAuth = tls.RequireAndVerifyClientCert
+	tc.ClientCAs = clientCAs
+	l, err := tls.Listen("tcp", "localhost:0", tc)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					break
+				}
+				t.Errorf("Accept: %v", err)
+				continue
+			}
+			go func(c *tls.Conn) {
+				defer c.Close()
+				if err := c.Handshake(); err != nil {
+					t.Logf("Handshake: %v", err)
+					return
+				}
+				fmt.Fprintf(c, "Hello %s\n", c.ConnectionState().PeerCertificates[0].Subject.CommonName)
+			}(conn.(*tls.Conn))
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	return l.Addr()
+}
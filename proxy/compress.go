@@ -0,0 +1,245 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// encoder is implemented by the gzip, brotli, and zstd writers.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() any {
+		return gzip.NewWriter(nil)
+	}},
+	"br": {New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	"zstd": {New: func() any {
+		// Browsers don't support windows larger than 8 MiB.
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+		return w
+	}},
+}
+
+// handler compresses the responses of next when the client accepts
+// one of the configured encodings, and the response has a compressible
+// content type and isn't already compressed.
+func (c *Compression) handler(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	if c == nil || req.Method == http.MethodHead {
+		next.ServeHTTP(w, req)
+		return
+	}
+	encoding := c.negotiate(req.Header.Get("Accept-Encoding"))
+	cw := &compressWriter{
+		ResponseWriter: w,
+		cfg:            c,
+		encoding:       encoding,
+	}
+	defer cw.close()
+	next.ServeHTTP(cw, req)
+}
+
+// negotiate returns the preferred encoding that the client accepts, or an
+// empty string.
+func (c *Compression) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	for _, e := range c.Encodings {
+		if ok, exists := accepted[e]; ok || (!exists && accepted["*"]) {
+			return e
+		}
+	}
+	return ""
+}
+
+// compressible returns true when the responses with this content type can
+// be compressed.
+func (c *Compression) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mt == "text/event-stream" {
+		return false
+	}
+	for _, ct := range c.ContentTypes {
+		if ct == mt || (strings.HasSuffix(ct, "/*") && strings.HasPrefix(mt, ct[:len(ct)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the response body. When the size of the response
+// isn't known in advance, the beginning of the body is buffered until it
+// reaches MinSize or is flushed. Smaller responses aren't compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg      *Compression
+	encoding string
+
+	status  int
+	pending bool
+	buf     []byte
+	done    bool
+	enc     encoder
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.status != 0 || w.done {
+		return
+	}
+	if code >= 100 && code < 200 {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	h := w.Header()
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || strings.EqualFold(h.Get(xAccelBufferingHeader), "no") || !w.cfg.compressible(h.Get("Content-Type")) {
+		w.passThrough()
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if w.encoding == "" || strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		w.passThrough()
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err != nil || n < int64(w.cfg.MinSize) {
+			w.passThrough()
+			return
+		}
+		w.startCompression()
+		return
+	}
+	w.pending = true
+}
+
+func (w *compressWriter) passThrough() {
+	w.done = true
+	w.pending = false
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *compressWriter) startCompression() {
+	w.done = true
+	w.pending = false
+	h := w.Header()
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.enc = encoderPools[w.encoding].Get().(encoder)
+	w.enc.Reset(w.ResponseWriter)
+	if len(w.buf) > 0 {
+		w.enc.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.enc != nil:
+		return w.enc.Write(b)
+	case w.pending:
+		w.buf = append(w.buf, b...)
+		if len(w.buf) >= w.cfg.MinSize {
+			w.startCompression()
+		}
+		return len(b), nil
+	default:
+		return w.ResponseWriter.Write(b)
+	}
+}
+
+func (w *compressWriter) Flush() {
+	if w.pending {
+		// Streamed responses are compressed as they come, regardless
+		// of their size. The headers aren't sent before the first
+		// bytes of the body.
+		if len(w.buf) == 0 {
+			return
+		}
+		w.startCompression()
+	}
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// close writes the buffered data, or the end of the compressed stream.
+func (w *compressWriter) close() {
+	if w.pending {
+		w.passThrough()
+	}
+	if w.enc != nil {
+		w.enc.Close()
+		w.enc.Reset(nil)
+		encoderPools[w.encoding].Put(w.enc)
+		w.enc = nil
+	}
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
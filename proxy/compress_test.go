@@ -0,0 +1,201 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	c := &Compression{}
+	if err := c.check(); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	for _, tc := range []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0, gzip;q=0.5", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "br"},
+	} {
+		if got := c.negotiate(tc.accept); got != tc.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		ct   string
+		want bool
+	}{
+		{"text/html; charset=utf-8", true},
+		{"application/json", true},
+		{"image/png", false},
+		{"text/event-stream", false},
+		{"", false},
+	} {
+		if got := c.compressible(tc.ct); got != tc.want {
+			t.Errorf("compressible(%q) = %v, want %v", tc.ct, got, tc.want)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	large := strings.Repeat(`{"hello":"world"}`, 200)
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/gzipped":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(large))
+			gz.Close()
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte(large))
+		}
+	}))
+	defer be.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+				Mode:        "HTTP",
+				Compression: &Compression{},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: "www.example.com",
+					RootCAs:    extCA.RootCACertPool(),
+				})
+			},
+		},
+	}
+	get := func(path, accept string) (http.Header, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "https://www.example.com"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		defer resp.Body.Close()
+		var r io.Reader = resp.Body
+		switch resp.Header.Get("Content-Encoding") {
+		case "gzip":
+			if r, err = gzip.NewReader(r); err != nil {
+				t.Fatalf("gzip.NewReader: %v", err)
+			}
+		case "br":
+			r = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				t.Fatalf("zstd.NewReader: %v", err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		return resp.Header, string(b)
+	}
+
+	for _, tc := range []struct {
+		path, accept string
+		wantEncoding string
+		wantBody     string
+	}{
+		{"/", "gzip", "gzip", large},
+		{"/", "gzip, br", "br", large},
+		{"/", "gzip, br, zstd", "zstd", large},
+		{"/", "identity", "", large},
+		{"/small", "gzip", "", "{}"},
+		{"/image", "gzip", "", large},
+		{"/gzipped", "gzip, br", "gzip", large},
+	} {
+		h, body := get(tc.path, tc.accept)
+		if got := h.Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("GET %s (%s): Content-Encoding = %q, want %q", tc.path, tc.accept, got, tc.wantEncoding)
+		}
+		if body != tc.wantBody {
+			t.Errorf("GET %s (%s): body = %q", tc.path, tc.accept, body)
+		}
+		if tc.path == "/" && tc.wantEncoding != "" && h.Get("ETag") != `W/"v1"` {
+			t.Errorf("GET %s (%s): ETag = %q", tc.path, tc.accept, h.Get("ETag"))
+		}
+	}
+}
@@ -28,6 +28,8 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -38,18 +40,33 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/http/httpguts"
 	"golang.org/x/time/rate"
 	yaml "gopkg.in/yaml.v3"
 
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/accesslog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/consul"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/dns01"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/docker"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/flowexport"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/httpcache"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/jwks"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/keystore"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logging"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/resolver"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/secrets"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tracing"
 )
 
 const (
@@ -62,6 +79,60 @@ const (
 	ModeHTTPS          = "HTTPS"
 	ModeLocal          = "LOCAL"
 	ModeConsole        = "CONSOLE"
+	ModeWebSocket      = "WEBSOCKET"
+	ModeRedirect       = "REDIRECT"
+	// ModeQUICPassthrough backends receive QUIC connections from
+	// QUICPassthroughAddr, without decryption.
+	ModeQUICPassthrough = "QUICPASSTHROUGH"
+	// ModeProxy backends are HTTPS forward proxies. Authenticated clients
+	// open tunnels to the destinations allowed by ForwardProxy with
+	// CONNECT requests.
+	ModeProxy = "PROXY"
+	// ModeSOCKS5 backends speak SOCKS5 over TLS. Authenticated clients
+	// connect to the destinations allowed by ForwardProxy.
+	ModeSOCKS5 = "SOCKS5"
+	// ModePostgres backends receive PostgreSQL connections that start
+	// with an SSLRequest, or with direct TLS. The connections are routed
+	// with the database and user names of the startup message.
+	ModePostgres = "POSTGRES"
+	// ModeMySQL backends receive MySQL connections from MySQLAddr. The
+	// proxy relays the server's greeting and terminates the TLS connection
+	// that the client requests.
+	ModeMySQL = "MYSQL"
+
+	LoadBalanceRoundRobin       = "round-robin"
+	LoadBalanceLeastConnections = "least-connections"
+	LoadBalanceConsistentHash   = "consistent-hash"
+
+	ForwardedReplace = "replace"
+	ForwardedAppend  = "append"
+	ForwardedStrip   = "strip"
+
+	RevocationHardFail = "hard-fail"
+	RevocationSoftFail = "soft-fail"
+
+	ClientAuthRequire = "require"
+	ClientAuthRequest = "request"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	// CatchAllServerName matches all the server names that don't match
+	// any other backend.
+	CatchAllServerName = "*"
+
+	RejectAlert  = "alert"
+	RejectClose  = "close"
+	RejectTarpit = "tarpit"
+	RejectRoute  = "route"
+
+	QuotaClose = "close"
+	QuotaQueue = "queue"
+
+	StartTLSSMTP = "smtp"
+	StartTLSIMAP = "imap"
+	StartTLSPOP3 = "pop3"
+	StartTLSLDAP = "ldap"
 )
 
 var (
@@ -74,6 +145,74 @@ var (
 		ModeHTTPS,
 		ModeLocal,
 		ModeConsole,
+		ModeWebSocket,
+		ModeRedirect,
+		ModeQUICPassthrough,
+		ModeProxy,
+		ModeSOCKS5,
+		ModePostgres,
+		ModeMySQL,
+	}
+	validStartTLSProtocols = []string{
+		StartTLSSMTP,
+		StartTLSIMAP,
+		StartTLSPOP3,
+		StartTLSLDAP,
+	}
+	validLoadBalancePolicies = []string{
+		LoadBalanceRoundRobin,
+		LoadBalanceLeastConnections,
+		LoadBalanceConsistentHash,
+	}
+	validForwardedModes = []string{
+		ForwardedReplace,
+		ForwardedAppend,
+		ForwardedStrip,
+	}
+	validLogFormats = []string{
+		LogFormatText,
+		LogFormatJSON,
+	}
+	validRevocationPolicies = []string{
+		RevocationHardFail,
+		RevocationSoftFail,
+	}
+	validClientAuthModes = []string{
+		ClientAuthRequire,
+		ClientAuthRequest,
+	}
+	defaultCompressionEncodings = []string{
+		"zstd",
+		"br",
+		"gzip",
+	}
+	defaultCompressionContentTypes = []string{
+		"text/*",
+		"application/javascript",
+		"application/json",
+		"application/manifest+json",
+		"application/wasm",
+		"application/xml",
+		"image/svg+xml",
+	}
+	validRejectActions = []string{
+		RejectAlert,
+		RejectClose,
+		RejectTarpit,
+		RejectRoute,
+	}
+	validQuotaActions = []string{
+		QuotaClose,
+		QuotaQueue,
+	}
+	validSSHKeyTypes = []string{
+		"ecdsa-p256",
+		"ecdsa-p384",
+		"ecdsa-p521",
+		"ed25519",
+		"rsa-2048",
+		"rsa-3072",
+		"rsa-4096",
 	}
 	validXFCCFields = []string{
 		"cert",
@@ -83,6 +222,14 @@ var (
 		"uri",
 		"dns",
 	}
+	validClientCertHeaderFields = []string{
+		"cert",
+		"hash",
+		"subject",
+		"dns",
+		"email",
+		"uri",
+	}
 	// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
 	defaultALPNProtos       = &[]string{"h2", "http/1.1"}
 	defaultALPNProtosPlusH3 = &[]string{"h3", "h2", "http/1.1"}
@@ -93,7 +240,49 @@ var (
 )
 
 // Config is the TLS proxy configuration.
+//
+// The secrets in the config, e.g. clientSecret, apiToken, or password, can
+// be references to secrets in external stores. They are resolved when the
+// config is read. The references are:
+//   - file:<path>[#<key>] for the content of a file. The path is relative
+//     to the config file's directory, or to the directory in the
+//     TLSPROXY_SECRETS_DIR environment variable, e.g. /run/secrets, and
+//     can't refer to files outside of them, even with symbolic links.
+//   - env:<name>[#<key>] for the value of an environment variable.
+//   - vault:<path>#<key> for a secret in HashiCorp Vault, e.g.
+//     vault:secret/data/tlsproxy#clientSecret. The VAULT_ADDR and
+//     VAULT_TOKEN environment variables must be set.
+//   - aws-secretsmanager:<name>[#<key>] for a secret in AWS Secrets
+//     Manager. The AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_REGION
+//     environment variables must be set.
+//
+// With #<key>, the secret is a JSON object, and the reference is replaced
+// with the value of key.
+//
+// The configs applied with the admin API can only use the references that
+// are already in the config file.
 type Config struct {
+	// Version is the version of the config format. Configs without a
+	// version are version 1. They are migrated to the current version,
+	// 2, when they are read. Version 2 renames rateLimit.exemptIps to
+	// exemptIPs.
+	Version int `yaml:"version,omitempty"`
+	// Include is a list of file name patterns, e.g. conf.d/*.yaml, of
+	// other YAML files that are merged into the config when it is read.
+	// The patterns are relative to the config file's directory, and
+	// can't refer to files outside of it. The list sections of the
+	// included files, e.g. backends, are appended to the config's. The
+	// other sections can't be set in more than one file. Changes to the
+	// included files are applied when the config file changes, or on
+	// SIGHUP.
+	//
+	// In all the files, ${NAME} in a value is replaced with the value
+	// of the environment variable NAME, e.g. for secrets like
+	// clientSecret, and $$ is replaced with $. The environment
+	// variables that start with TLSPROXY_ can't be used. The configs
+	// applied with the admin API can only use the variables that the
+	// config file already uses.
+	Include []string `yaml:"include,omitempty"`
 	// Definitions is a section where yaml anchors can be defined. It is
 	// otherwise ignored by the proxy.
 	Definitions any `yaml:"definitions,omitempty"`
@@ -104,12 +293,68 @@ type Config struct {
 	// port 443.
 	// See https://letsencrypt.org/docs/challenge-types/
 	HTTPAddr string `yaml:"httpAddr,omitempty"`
+	// RedirectHTTP indicates that the plaintext HTTP requests received on
+	// HTTPAddr, other than ACME challenges, should be permanently
+	// redirected (301) to https:// when the host is one of the backends'
+	// server names. Requests for other hosts get a 404 error. By default,
+	// GET and HEAD requests are redirected temporarily (302) for any host,
+	// and other requests are rejected.
+	RedirectHTTP bool `yaml:"redirectHttp,omitempty"`
 	// TLSAddr is the address where the proxy will receive TLS connections
 	// and forward them to the backends.
 	TLSAddr string `yaml:"tlsAddr"`
+	// TLSListenerShards is the number of sockets that listen on TLSAddr,
+	// each with its own accept loop, for very high connection rates. The
+	// sockets are opened with SO_REUSEPORT, and the kernel distributes
+	// the incoming connections between them. It is only supported on
+	// Linux. With systemd socket activation, the socket unit must have
+	// ReusePort=yes. The default is 1. It can't be changed without a
+	// restart.
+	TLSListenerShards int `yaml:"tlsListenerShards,omitempty"`
+	// HandshakeWorkers is the maximum number of connections per listener
+	// shard that can be in their TLS handshake at the same time. When
+	// all the workers of a shard are busy, the shard stops accepting
+	// connections until one of the handshakes is done, and the pending
+	// connections wait in the kernel's queue. The default is 0, i.e. no
+	// limit. It can't be changed without a restart.
+	HandshakeWorkers int `yaml:"handshakeWorkers,omitempty"`
+	// HandshakeAdmission limits the number of TLS handshakes that are in
+	// progress at the same time, across all the listeners, e.g. to
+	// survive handshake floods.
+	HandshakeAdmission *ConfigHandshakeAdmission `yaml:"handshakeAdmission,omitempty"`
+	// ClientHelloTimeout is the maximum amount of time to wait for the
+	// client to send its TLS ClientHello (and the PROXY protocol header,
+	// if any). Connections that don't send a complete ClientHello in time
+	// are closed. The default is 10s.
+	ClientHelloTimeout time.Duration `yaml:"clientHelloTimeout,omitempty"`
+	// MaxClientHelloSize is the maximum size, in bytes, of the TLS record
+	// that contains the ClientHello. Larger ClientHellos are rejected. The
+	// value must be between 512 and 16384. The default is 16384.
+	MaxClientHelloSize int `yaml:"maxClientHelloSize,omitempty"`
+	// TLSDebug enables features to debug TLS interop problems with
+	// clients. They should not be enabled in production.
+	TLSDebug *ConfigTLSDebug `yaml:"tlsDebug,omitempty"`
 	// EnableQUIC specifies whether the QUIC protocol should be enabled.
 	// The default is true if the binary is compiled with QUIC support.
 	EnableQUIC *bool `yaml:"enableQUIC,omitempty"`
+	// QUICAddr is the UDP address where the proxy will receive QUIC
+	// connections, including HTTP/3. The default is the same address as
+	// TLSAddr. When it is set, its port is advertised to HTTP clients with
+	// the Alt-Svc header, so it should be reachable from the clients on
+	// that same port. It can't be changed without a restart.
+	QUICAddr string `yaml:"quicAddr,omitempty"`
+	// QUICPassthroughAddr is the UDP address where the proxy will receive
+	// QUIC connections for QUICPASSTHROUGH backends. The connections are
+	// routed with the server name from the client's Initial packets and
+	// forwarded to the backends without being decrypted. This address
+	// must be different from QUICAddr.
+	QUICPassthroughAddr string `yaml:"quicPassthroughAddr,omitempty"`
+	// MySQLAddr is the TCP address where the proxy will receive MySQL
+	// connections for the MYSQL backend. MySQL servers speak first, before
+	// the clients request TLS, so these connections can't be received on
+	// TLSAddr, and they can't be routed by server name. Only one backend
+	// can use MYSQL mode.
+	MySQLAddr string `yaml:"mySQLAddr,omitempty"`
 	// AcceptProxyHeaderFrom is a list of CIDRs. The PROXY protocol is
 	// enabled for incoming TCP connections originating from IP addresses
 	// within one of these CIDRs. By default, the proxy protocol is not
@@ -127,9 +372,31 @@ type Config struct {
 	// CacheDir is the directory where the proxy stores its data, e.g. TLS
 	// certificates, OCSP responses, etc.
 	CacheDir string `yaml:"cacheDir,omitempty"`
+	// SharedCacheDir is a directory that is shared by multiple proxies,
+	// e.g. on a network filesystem, for high availability. When it is
+	// set, the proxies share the ACME certificate cache, the TLS session
+	// ticket keys, the keys that sign authentication tokens, the OIDC
+	// login states, and the ban list. The data is encrypted with a master
+	// key that is stored in SharedCacheDir and protected by the same
+	// passphrase on all the proxies. SharedCacheDir cannot be used with
+	// HWBacked, and it cannot be changed without restarting the proxy.
+	SharedCacheDir string `yaml:"sharedCacheDir,omitempty"`
+	// CertificateStore is an optional external storage backend for the
+	// ACME certificate cache, e.g. S3, GCS, Redis, or a SQL database.
+	// It lets clustered deployments and ephemeral containers keep their
+	// certificates without a persistent or shared filesystem. The
+	// values are encrypted with a master key that is itself stored in
+	// the certificate store, protected by the passphrase. The
+	// CertificateStore cannot be used with HWBacked, and it cannot be
+	// changed without restarting the proxy.
+	CertificateStore *ConfigCertificateStore `yaml:"certificateStore,omitempty"`
 	// DefaultServerName is the server name to use when the TLS client
 	// doesn't use the Server Name Indication (SNI) extension.
 	DefaultServerName string `yaml:"defaultServerName,omitempty"`
+	// NoSNISniffing chooses the backend of the connections without SNI
+	// by looking at the first bytes that the client sends after the TLS
+	// handshake, instead of always using DefaultServerName.
+	NoSNISniffing *ConfigNoSNISniffing `yaml:"noSNISniffing,omitempty"`
 	// Backends is the list of service backends.
 	Backends []*Backend `yaml:"backends"`
 	// Email is optionally sent to Let's Encrypt when registering a new
@@ -141,6 +408,11 @@ type Config struct {
 	RevokeUnusedCertificates *bool `yaml:"revokeUnusedCertificates,omitempty"`
 	// MaxOpen is the maximum number of open incoming connections.
 	MaxOpen int `yaml:"maxOpen,omitempty"`
+	// ConnectionQuota limits the number of concurrent connections from
+	// each client IP address, across all the backends. Its
+	// MaxConnections must be zero, the global limit is MaxOpen.
+	// Connections over MaxOpen are always closed.
+	ConnectionQuota *ConnectionQuota `yaml:"connectionQuota,omitempty"`
 	// AcceptTOS indicates acceptance of the Let's Encrypt Terms of Service.
 	// See https://letsencrypt.org/repository/
 	AcceptTOS bool `yaml:"acceptTOS"`
@@ -155,774 +427,3835 @@ type Config struct {
 	// PKI is a list of locally hosted and managed Certificate Authorities
 	// that can be used to authenticate TLS clients and backend servers.
 	PKI []*ConfigPKI `yaml:"pki,omitempty"`
+	// SSHCertificateAuthorities is a list of locally hosted SSH
+	// Certificate Authorities that issue short-lived certificates to
+	// authenticated users.
+	SSHCertificateAuthorities []*ConfigSSHCertificateAuthority `yaml:"sshCertificateAuthorities,omitempty"`
 	// BWLimits is the list of named bandwidth limit groups.
 	// Each backend can be associated with one group. The group's limits
 	// are shared between all the backends associated with it.
 	BWLimits []*BWLimit `yaml:"bwLimits,omitempty"`
+	// IPLists is a list of named lists of IP network addresses that are
+	// loaded from files or URLs, and refreshed periodically. Backends can
+	// use them with AllowIPLists and DenyIPLists.
+	IPLists []*ConfigIPList `yaml:"ipLists,omitempty"`
+	// ThreatFeeds drops the connections from IP addresses that appear in
+	// IP reputation lists, e.g. the Spamhaus DROP list or the abuse.ch
+	// blocklists, as soon as they are accepted, before the TLS handshake.
+	ThreatFeeds *ConfigThreatFeeds `yaml:"threatFeeds,omitempty"`
+	// DrainTimeout is the amount of time that existing connections are
+	// allowed to continue after their backend is removed or changed by a
+	// config change. HTTP clients are asked to go away immediately, and
+	// the connections that are still open after DrainTimeout are closed.
+	// The default is 1 minute.
+	DrainTimeout *time.Duration `yaml:"drainTimeout,omitempty"`
+	// ConfigRevisions is the number of previous configs that are kept in
+	// CacheDir when the config is changed with the admin API, so that they
+	// can be restored. The default is 10.
+	ConfigRevisions int `yaml:"configRevisions,omitempty"`
+	// EventHistorySize is the number of recent events that are kept with
+	// their time, severity, and connection, so that incidents can be
+	// reconstructed. They are shown on the console and by /api/events.
+	// The default is 1000.
+	EventHistorySize int `yaml:"eventHistorySize,omitempty"`
+	// SessionTicketKeyRotation is the amount of time between rotations of
+	// the keys that encrypt TLS session tickets. The keys are stored
+	// encrypted in CacheDir. Proxies that use the same CacheDir and
+	// passphrase share the same keys, so that clients can resume their
+	// TLS sessions with any of them, e.g. behind DNS round-robin. The
+	// default is 24 hours.
+	SessionTicketKeyRotation time.Duration `yaml:"sessionTicketKeyRotation,omitempty"`
+	// DNSProviders is a list of DNS providers used to get certificates
+	// with the ACME dns-01 challenge. The dns-01 challenge is required to
+	// get wildcard certificates, e.g. for *.example.com.
+	DNSProviders []*ConfigDNSProvider `yaml:"dnsProviders,omitempty"`
+	// ACME configures the ACME certificate authorities that issue the
+	// certificates, e.g. ZeroSSL, Buypass, or a private ACME CA like
+	// step-ca or Vault. The default is Let's Encrypt.
+	ACME *ConfigACME `yaml:"acme,omitempty"`
+	// KeyStores is a list of key stores where private keys are kept
+	// instead of on disk, e.g. a cloud key management service or a
+	// Trusted Platform Module. Backends use them with KeyStore and
+	// KeyID. To protect the master key with the TPM, use HWBacked.
+	KeyStores []*ConfigKeyStore `yaml:"keyStores,omitempty"`
+	// AccessLog enables the access log. When it is enabled, connections
+	// and HTTP requests are recorded in the access log instead of the
+	// main log. Backends can opt out with their AccessLog field.
+	AccessLog *ConfigAccessLog `yaml:"accessLog,omitempty"`
+	// AuditLog enables the audit log, a tamper-evident record of security
+	// relevant events: IP, SSO, and console access denials, client
+	// certificate decisions, logins and logouts, config changes, and the
+	// use of the console and admin API.
+	AuditLog *ConfigAuditLog `yaml:"auditLog,omitempty"`
+	// FlowExport enables the export of a flow record for each incoming
+	// connection when it ends, e.g. for network accounting.
+	FlowExport *ConfigFlowExport `yaml:"flowExport,omitempty"`
+	// Tracing enables OpenTelemetry tracing. Each connection gets a
+	// span, and, in HTTP and HTTPS modes, each request gets a child span
+	// that is propagated to the backend with the traceparent header.
+	Tracing *ConfigTracing `yaml:"tracing,omitempty"`
+
+	// Log configures the proxy's log messages, i.e. everything except
+	// the access log. By default, messages are written in plain text.
+	Log *ConfigLog `yaml:"log,omitempty"`
+
+	// RateLimit enables rate limiting of incoming connections by client
+	// IP address and by client certificate subject, and temporary bans of
+	// IP addresses that cause too many errors.
+	RateLimit *ConfigRateLimit `yaml:"rateLimit,omitempty"`
+
+	// DockerDiscovery enables the discovery of backends from the labels
+	// of running Docker containers.
+	DockerDiscovery *ConfigDockerDiscovery `yaml:"dockerDiscovery,omitempty"`
+
+	// RejectPolicy controls what happens to TLS connections with a server
+	// name that doesn't match any backend, and to connections from clients
+	// that are denied by a backend's AllowIPs, DenyIPs, AllowIPLists,
+	// DenyIPLists, AllowFingerprints, or DenyFingerprints. By default, the
+	// proxy responds with an unrecognized_name alert.
+	RejectPolicy *ConfigRejectPolicy `yaml:"rejectPolicy,omitempty"`
+
+	// CertificateMonitor configures the periodic inventory of the
+	// certificates, i.e. the ones obtained with ACME and the ones loaded
+	// from files, and the alerts that are raised when a certificate isn't
+	// renewed in time. The inventory is always enabled. The days before
+	// each certificate expires are exported in the metrics and shown on
+	// the console.
+	CertificateMonitor *ConfigCertificateMonitor `yaml:"certificateMonitor,omitempty"`
 
 	acceptProxyHeaderFrom []*net.IPNet
+	// secretRefs are the references of the secrets that were resolved
+	// when the config was read, by secret name.
+	secretRefs map[string]string
 }
 
-// BWLimit is a named bandwidth limit configuration.
-type BWLimit struct {
-	// Name is the name of the group.
-	Name string `yaml:"name"`
-	// Ingress is the ingress limit, in bytes per second.
-	Ingress float64 `yaml:"ingress"`
-	// Egress is the engress limit, in bytes per second.
-	Egress float64 `yaml:"egress"`
+// SyslogConfig contains the syslog parameters of the log config sections.
+// They are only used when the section's Syslog is set, except for the tag
+// and facility, which are also used with Journald.
+type SyslogConfig struct {
+	// SyslogNetwork and SyslogAddress are the network and address of the
+	// syslog server, e.g. udp and 192.168.0.1:514. Valid networks are
+	// udp, tcp, tls, unix, and unixgram. Remote servers receive RFC 5424
+	// messages. By default, the local syslog server is used.
+	SyslogNetwork string `yaml:"syslogNetwork,omitempty"`
+	SyslogAddress string `yaml:"syslogAddress,omitempty"`
+	// SyslogCACert is the name of a file that contains the PEM-encoded CA
+	// certificates used to verify the syslog server with the tls network.
+	// By default, the system's root CAs are used.
+	SyslogCACert string `yaml:"syslogCACert,omitempty"`
+	// SyslogTag is the syslog tag. The default is tlsproxy.
+	SyslogTag string `yaml:"syslogTag,omitempty"`
+	// SyslogFacility is the syslog facility, e.g. daemon (default), user,
+	// authpriv, or local0 to local7.
+	SyslogFacility string `yaml:"syslogFacility,omitempty"`
 }
 
-// Backend encapsulates the data of one backend.
-type Backend struct {
-	// ServerNames is the list of all the server names for this service,
-	// e.g. example.com, www.example.com.
-	// Internationalized names are converted to ascii using the IDNA2008
-	// lookup standard as implemented by golang.org/x/net/idna.
-	ServerNames []string `yaml:"serverNames"`
-	// ClientAuth specifies that the TLS client's identity must be verified.
-	ClientAuth *ClientAuth `yaml:"clientAuth,omitempty"`
-	// AllowIPs specifies a list of IP network addresses to allow, in CIDR
-	// format, e.g. 192.168.0.0/24.
-	//
-	// The rules are applied in this order:
-	// * If DenyIPs is specified, the remote addr must not match any of the
-	//   IP addresses in the list.
-	// * If AllowIPs is specified, the remote addr must match at least one
-	//   of the IP addresses on the list.
-	//
-	// If an IP address is blocked, the client receives a TLS "unrecognized
-	// name" alert, as if it connected to an unknown server name.
-	AllowIPs *[]string `yaml:"allowIPs,omitempty"`
-	// DenyIPs specifies a list of IP network addresses to deny, in CIDR
-	// format, e.g. 192.168.0.0/24. See AllowIPs.
-	DenyIPs *[]string `yaml:"denyIPs,omitempty"`
-	// SSO indicates that the backend requires user authentication, and
-	// specifies which identity provider to use and who's allowed to
-	// connect.
-	SSO *BackendSSO `yaml:"sso,omitempty"`
-	// ExportJWKS is the path where to export the proxy's JSON Web Key Set.
-	// This should only be set when SSO is enabled and JSON Web Tokens are
-	// generated for the users to authenticate with the backends.
-	ExportJWKS string `yaml:"exportJwks,omitempty"`
-	// ALPNProtos specifies the list of ALPN procotols supported by this
-	// backend. The ACME acme-tls/1 protocol doesn't need to be specified.
-	//
-	// The default values are:
-	//  * [h2, http/1.1] when QUIC is not enabled
-	//  * [h3, h2, http/1.1] when QUIC is enabled and Mode is one of:
-	//      HTTP, HTTPS, QUIC, LOCAL, CONSOLE
-	//
-	// Set the value to an empty slice [] to disable ALPN.
-	// The negotiated protocol is forwarded to the backends that use TLS.
-	//
-	// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
-	ALPNProtos *[]string `yaml:"alpnProtos,flow,omitempty"`
-	// BackendProto specifies which protocol to use when forwarding an HTTPS
-	// request to the backend. This field is only valid in modes HTTP and
-	// HTTPS.
-	// The value should be an ALPN protocol, e.g.: http/1.1, h2, or h3. The default is http/1.1.
-	// If the value is set explicitly to "", the same protocol used by the
-	// client will be used with the backend.
-	BackendProto *string `yaml:"backendProto,omitempty"`
-	// Mode controls how the proxy communicates with the backend.
-	// - PLAINTEXT: Use a plaintext, non-encrypted, TCP connection. This is
-	// the the default mode.
-	//        CLIENT --TLS--> PROXY ----> BACKEND SERVER
-	// - TLS: Open a new TLS connection. Set ForwardServerName, ForwardRootCAs,
-	//     and/or InsecureSkipVerify to verify the identity of the server.
-	//        CLIENT --TLS--> PROXY --TLS--> BACKEND SERVER
-	// - TLSPASSTHROUGH: Forward the whole TLS connection to the backend.
-	//     In this mode, the proxy terminates the TCP connection, but not
-	//     the TLS connection. The proxy uses the information from the TLS
-	//     ClientHello message to route the TLS data to the right backend.
-	//     It cannot see the plaintext data, and it cannot enforce client
-	//     authentication & authorization.
-	//                +-TCP-PROXY-TCP-+
-	//        CLIENT -+------TLS------+-> BACKEND SERVER
-	// - QUIC: Open a new QUIC connection. If the incoming connection is
-	//     TLS, forward the data on a single bidirectional QUIC stream. If
-	//     the incoming connection is QUIC, forward all streams.
-	//        CLIENT --TLS---> PROXY --QUIC STREAM--> BACKEND SERVER
-	//     Or
-	//        CLIENT --QUIC--> PROXY --QUIC--> BACKEND SERVER
-	// - HTTP: Parses the incoming connection as HTTPS and forwards the
-	//     requests to the backends as HTTP requests.
-	//        CLIENT --HTTPS--> PROXY --HTTP--> BACKEND SERVER
-	// - HTTPS: Parses the incoming connection as HTTPS and forwards the
-	//     requests to the backends as HTTPS requests.
-	//        CLIENT --HTTPS--> PROXY --HTTPS--> BACKEND SERVER
-	// - LOCAL: Behaves exactly like HTTP and HTTPS without backend
-	//     addresses. This mode is intended for local handlers like Oauth2
-	//     redirects.
-	//        CLIENT --HTTPS--> PROXY
-	// - CONSOLE: Indicates that this backend is handled by the proxy itself
-	//     to report its status and metrics. It is strongly recommended
-	//     to use it with ClientAuth and ACL. Otherwise, information from
-	//     the proxy's configuration can be leaked to anyone who knows the
-	//     backend's server name.
-	//        CLIENT --TLS--> PROXY CONSOLE
-	//
-	// QUIC
-	//
-	// If the incoming connection is QUIC and Mode is TCP or TLS, each QUIC
-	// stream is treated like an incoming TLS connection.
-	//                               ,--STREAM1--> BACKEND SERVER
-	//        CLIENT --QUIC--> PROXY +--STREAM2--> BACKEND SERVER
-	//                               `--STREAM3--> BACKEND SERVER
-	// If Mode is QUIC, all streams are forwards to the backend server.
-	//        CLIENT --QUIC--> PROXY --QUIC--> BACKEND SERVER
-	Mode string `yaml:"mode"`
-	// DocumentRoot indicates local files should be served from this
-	// directory. This option is only valid when Addresses is empty.
-	DocumentRoot string `yaml:"documentRoot,omitempty"`
-	// BWLimit is the name of the bandwidth limit policy to apply to this
-	// backend. All backends using the same policy are subject to common
-	// limits.
-	BWLimit string `yaml:"bwLimit,omitempty"`
-	// Addresses is a list of server addresses where requests are forwarded.
-	// When more than one address are specified, requests are distributed
-	// using a simple round robin.
-	Addresses []string `yaml:"addresses,omitempty"`
-	// InsecureSkipVerify disabled the verification of the backend server's
-	// TLS certificate. See https://pkg.go.dev/crypto/tls#Config
-	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
-	// ForwardRateLimit specifies how fast requests can be forwarded to the
-	// backend servers. It applies to forwarding connections, and to
-	// forwarding HTTP requests. The default value is 5 requests per second.
-	ForwardRateLimit int `yaml:"forwardRateLimit"`
-	// ForwardServerName is the ServerName to send in the TLS handshake with
-	// the backend server. It is also used to verify the server's identify.
-	// This is particularly useful when the addresses use IP addresses
-	// instead of hostnames.
-	ForwardServerName string `yaml:"forwardServerName,omitempty"`
-	// ForwardRootCAs a list of:
-	// - CA names defined in the PKI section,
-	// - File names that contain PEM-encoded certificates, or
-	// - PEM-encoded certificates.
-	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
-	// ForwardTimeout is the connection timeout to backend servers. If
-	// Addresses contains multiple addresses, this timeout indicates how
-	// long to wait before trying the next address in the list. The default
-	// value is 30 seconds.
-	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
-	// PathOverrides specifies different backend parameters for some path
-	// prefixes.
-	// Paths are matched by prefix in the order that they are listed here.
-	PathOverrides []*PathOverride `yaml:"pathOverrides,omitempty"`
-	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
-	// value is the version of the protocol to use, e.g. v1 or v2.
-	// By default, the proxy protocol is not enabled.
-	// See https://github.com/haproxy/haproxy/blob/master/doc/proxy-protocol.txt
-	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
-	// SanitizePath indicates that the request's path should be sanitized
-	// before forwarding the request to the backend. The default is true.
-	// The only reason to set this field is if the backend service somehow
-	// depends on the unsanitized version of the path.
-	//
-	// Examples:
-	//   // -> /
-	//   /. -> /
-	//   /foo/../bar -> /bar
-	//   /../../ -> /
-	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
+// ConfigLog contains the parameters of the proxy's log. When this section is
+// present, each message is a structured record with a level, and a component
+// attribute.
+type ConfigLog struct {
+	// Format is the format of the log records. Valid values are text
+	// (default) and json.
+	Format string `yaml:"format,omitempty"`
+	// Level is the minimum level of the messages to log. Valid values are
+	// debug, info (default), warn, and error.
+	Level string `yaml:"level,omitempty"`
+	// Components overrides Level for some components, e.g.
+	// acme: debug. Valid components are: acme, bridge, handshake, http,
+	// oidc, passkeys, pki, proxy, quic, revocation, sso, tokenmanager,
+	// and tracing.
+	Components map[string]string `yaml:"components,omitempty"`
+	// Syslog indicates that the log records should be sent to syslog
+	// instead of the standard error. The levels are mapped to the syslog
+	// severities: debug, info, warning, and err.
+	Syslog bool `yaml:"syslog,omitempty"`
+	// SyslogConfig contains the parameters of the syslog server.
+	SyslogConfig `yaml:",inline"`
+	// Journald indicates that the log records should be sent to
+	// systemd-journald, with their level mapped to the PRIORITY field.
+	Journald bool `yaml:"journald,omitempty"`
+}
 
-	// TCP connections consist of two streams of data:
-	//
-	//    CLIENT --> SERVER
-	//    CLIENT <-- SERVER
-	//
-	// The CLIENT and the SERVER can send data to each other at the same.
-	// When one stream is closed, the other one can remain open and continue
-	// to transmit data indefinitely. The TCP connection is closed when both
-	// streams are closed. (Either end can close the whole connection at any
-	// time too)
-	//
-	// This is a normal feature of TCP connections, but very few
-	// applications / protocols use half-close connections.
-	//
-	// There are some broken clients and network devices doing Network
-	// Address Translation (NAT) that never close their end of the
-	// connection. This can result in TCP connections staying open doing
-	// nothing, but still using resources for a very long time.
-	//
-	// The parameters below can be used to control the behavior of the proxy
-	// when connections are half-closed. The default values should be
-	// appropriate for well-behaved servers and occasionally broken clients.
+// ConfigIPList is a named list of IP network addresses that is loaded from a
+// file or a URL. The list has one IP address or network address in CIDR
+// format per line, e.g. 192.168.0.0/24. Empty lines and comments starting with
+// # or ; are ignored.
+type ConfigIPList struct {
+	// Name is the name of the list.
+	Name string `yaml:"name"`
+	// Source is the absolute path of a file, or a http(s) URL, where the
+	// list is loaded from.
+	Source string `yaml:"source"`
+	// RefreshInterval is how often the list is reloaded. The default is
+	// 1 hour. When a reload fails, the previous list continues to be
+	// used.
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+}
 
-	// ServerCloseEndsConnection indicates that the proxy will close the
-	// whole TCP connection when the server closes its end of it. The
-	// default value is true.
-	ServerCloseEndsConnection *bool `yaml:"serverCloseEndsConnection,omitempty"`
-	// ClientCloseEndsConnection indicates that the proxy will close the
-	// whole TCP connection when the client closes its end of it. The
-	// default value is false.
-	ClientCloseEndsConnection *bool `yaml:"clientCloseEndsConnection,omitempty"`
-	// HalfCloseTimeout is the amount of time to keep the TCP connection
-	// open when one stream is closed. The default value is 1 minute.
-	HalfCloseTimeout *time.Duration `yaml:"halfCloseTimeout,omitempty"`
+// ConfigThreatFeeds specifies which IP lists are used as threat feeds, and
+// what happens to the connections from the IP addresses in them.
+type ConfigThreatFeeds struct {
+	// IPLists is a list of IP list names, from the ipLists section, e.g.
+	//
+	//   ipLists:
+	//   - name: spamhaus-drop
+	//     source: https://www.spamhaus.org/drop/drop.txt
+	//   - name: feodo
+	//     source: https://feodotracker.abuse.ch/downloads/ipblocklist.txt
+	IPLists []string `yaml:"ipLists"`
+	// Action is what to do with the connections from the listed IP
+	// addresses. Valid values are:
+	//   - close: close the connection immediately (default).
+	//   - tarpit: keep the connection open without sending anything for
+	//     TarpitDelay, then close it.
+	Action string `yaml:"action,omitempty"`
+	// TarpitDelay is how long connections are held open when Action is
+	// tarpit. The default is 10 seconds.
+	TarpitDelay time.Duration `yaml:"tarpitDelay,omitempty"`
+	// ExemptIPs is a list of IP network addresses in CIDR format that are
+	// never dropped, even when they appear in a threat feed.
+	ExemptIPs []string `yaml:"exemptIPs,omitempty"`
 
-	recordEvent   func(string)
-	tm            *tokenmanager.TokenManager
-	quicTransport io.Closer
+	exemptIPs []*net.IPNet
+}
 
-	tlsConfig            *tls.Config
-	tlsConfigQUIC        *tls.Config
-	forwardRootCAs       *x509.CertPool
-	getClientCert        func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
-	pkiMap               map[string]*pki.PKIManager
-	ocspCache            *ocspcache.OCSPCache
-	bwLimit              *bwLimit
-	connLimit            *rate.Limiter
-	proxyProtocolVersion byte
+// ConfigDockerDiscovery contains the parameters of the Docker backend
+// discovery. Each running container that has a <labelPrefix>.servername label
+// becomes a backend, and the backend is removed when the container stops. The
+// following container labels are used:
+//
+//   - <labelPrefix>.servername: the server names, separated by commas.
+//   - <labelPrefix>.port: the container port to connect to. It is optional
+//     when the container exposes only one port.
+//   - <labelPrefix>.mode: the backend mode. The default is HTTP.
+//   - <labelPrefix>.backendproto: the BackendProto of HTTP and HTTPS
+//     backends.
+//   - <labelPrefix>.network: the Docker network to use to reach the
+//     container. It overrides Network.
+//
+// Backends in the config file take precedence over discovered backends with
+// the same server names.
+type ConfigDockerDiscovery struct {
+	// Endpoint is the address of the Docker API. The default is
+	// unix:///var/run/docker.sock. Plain TCP endpoints, e.g.
+	// tcp://127.0.0.1:2375, are also supported.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// LabelPrefix is the prefix of the container labels. The default is
+	// tlsproxy.
+	LabelPrefix string `yaml:"labelPrefix,omitempty"`
+	// Network is the Docker network to use to reach the containers. It
+	// is optional when the containers are attached to only one network.
+	Network string `yaml:"network,omitempty"`
+	// Interval is how often the list of containers is refreshed. Changes
+	// are also detected immediately by watching the Docker events. The
+	// default is 30 seconds.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Template is a backend whose parameters are used for all the
+	// discovered backends, e.g. ClientAuth or SSO. Its ServerNames and
+	// Addresses must be empty.
+	Template *Backend `yaml:"template,omitempty"`
+}
 
-	allowIPs *[]*net.IPNet
-	denyIPs  *[]*net.IPNet
+// ConfigRateLimit contains the rate limiting parameters. These limits apply
+// to all backends.
+type ConfigRateLimit struct {
+	// ConnectionsPerIP is the number of new connections per second that
+	// are allowed from each client IP address. Zero means no limit.
+	ConnectionsPerIP float64 `yaml:"connectionsPerIp,omitempty"`
+	// ConnectionsPerSubject is the number of new connections per second
+	// that are allowed for each client certificate subject. Zero means no
+	// limit.
+	ConnectionsPerSubject float64 `yaml:"connectionsPerSubject,omitempty"`
+	// Burst is the number of connections that can exceed the rate limits
+	// in a burst. The default is 10.
+	Burst int `yaml:"burst,omitempty"`
+	// BanThreshold is the number of errors from a client IP address within
+	// BanWindow that cause the IP address to be banned. Errors are invalid
+	// ClientHellos, TLS handshake failures, access denied events, and
+	// wrong SOCKS5 or forward proxy credentials.
+	// Zero means IP addresses are never banned.
+	BanThreshold int `yaml:"banThreshold,omitempty"`
+	// BanWindow is the amount of time during which errors are counted.
+	// The default is 1 minute.
+	BanWindow time.Duration `yaml:"banWindow,omitempty"`
+	// BanDuration is the amount of time that IP addresses are banned for.
+	// The default is 10 minutes.
+	BanDuration time.Duration `yaml:"banDuration,omitempty"`
+	// ExemptIPs is a list of IP network addresses, in CIDR format, that
+	// are never rate limited or banned.
+	ExemptIPs []string `yaml:"exemptIPs,omitempty"`
+	// Tarpit keeps the new connections from banned IP addresses open,
+	// reading from them at 1 byte per second, instead of closing them
+	// immediately. This slows down scanners.
+	Tarpit bool `yaml:"tarpit,omitempty"`
+	// MaxTarpitConnections is the maximum number of connections that are
+	// tarpitted at the same time. The connections over the limit are
+	// closed immediately. The default is 100.
+	MaxTarpitConnections int `yaml:"maxTarpitConnections,omitempty"`
+	// TarpitDuration is the maximum amount of time that a connection is
+	// tarpitted. The default is 5 minutes.
+	TarpitDuration time.Duration `yaml:"tarpitDuration,omitempty"`
 
-	httpServer    *http.Server
-	httpConnChan  chan net.Conn
-	http3Server   io.Closer
-	localHandlers []localHandler
-	outConns      *connTracker
+	exemptIPs []*net.IPNet
+}
 
-	state *backendState
+// ConnectionQuota limits the number of concurrent connections.
+type ConnectionQuota struct {
+	// MaxConnections is the maximum number of concurrent connections.
+	// Zero means no limit.
+	MaxConnections int `yaml:"maxConnections,omitempty"`
+	// MaxConnectionsPerIP is the maximum number of concurrent
+	// connections from each client IP address. Zero means no limit.
+	MaxConnectionsPerIP int `yaml:"maxConnectionsPerIp,omitempty"`
+	// Action is what to do with the connections that are over the
+	// limits. Valid values are:
+	//   - close: close the connection immediately (default).
+	//   - queue: wait up to QueueTimeout for other connections to end,
+	//     then close the connection if it is still over the limits.
+	//     Queued connections count against MaxOpen.
+	Action string `yaml:"action,omitempty"`
+	// QueueTimeout is how long connections wait in the queue when Action
+	// is queue. The default is 10 seconds.
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
 }
 
-type backendState struct {
-	mu       sync.Mutex
-	inFlight int
-	shutdown bool
-	next     int
-	oNext    []int
+// check validates the limits and sets the default values.
+func (cq *ConnectionQuota) check() error {
+	if cq.MaxConnections < 0 {
+		return errors.New("MaxConnections: value cannot be negative")
+	}
+	if cq.MaxConnectionsPerIP < 0 {
+		return errors.New("MaxConnectionsPerIP: value cannot be negative")
+	}
+	if cq.Action == "" {
+		cq.Action = QuotaClose
+	}
+	cq.Action = strings.ToLower(cq.Action)
+	if !slices.Contains(validQuotaActions, cq.Action) {
+		return fmt.Errorf("Action: value %q must be one of %v", cq.Action, validQuotaActions)
+	}
+	if cq.QueueTimeout < 0 {
+		return errors.New("QueueTimeout: value must be positive")
+	}
+	if cq.QueueTimeout == 0 {
+		cq.QueueTimeout = 10 * time.Second
+	}
+	return nil
 }
 
-type localHandler struct {
-	desc        string
-	host        string
-	path        string
-	handler     http.Handler
-	ssoBypass   bool
-	matchPrefix bool
-	isCallback  bool
+// Backpressure controls the queue of connections and requests that wait for
+// a saturated backend, and the retries when the backend servers can't be
+// reached.
+type Backpressure struct {
+	// MaxQueue is the maximum number of connections, and HTTP requests,
+	// that can wait for ForwardRateLimit at the same time. The others are
+	// rejected immediately. Zero means no limit.
+	MaxQueue int `yaml:"maxQueue,omitempty"`
+	// QueueTimeout is the maximum amount of time that connections and
+	// HTTP requests wait for ForwardRateLimit. The default is 10 seconds.
+	//
+	// In HTTP and HTTPS modes, the requests that are rejected get a 503
+	// Service Unavailable response with a Retry-After header. In the
+	// other modes, the connections are closed.
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
+	// DialRetries is the number of times to try all the backend addresses
+	// again when none of them can be reached, in TCP, TLS,
+	// TLSPASSTHROUGH, QUIC, and WEBSOCKET modes. Each retry starts with a
+	// different address. The default is 0.
+	DialRetries int `yaml:"dialRetries,omitempty"`
+	// RetryBackoff is the amount of time to wait before the first retry.
+	// It doubles with each retry. The default is 100 milliseconds.
+	RetryBackoff time.Duration `yaml:"retryBackoff,omitempty"`
 }
 
-// ClientAuth specifies how to authenticate and authorize the TLS client's
-// identity.
-type ClientAuth struct {
-	// ACL optionally specifies which client identities are allowed to use
-	// this service. A nil value disabled the authorization check and allows
-	// any valid client certificate. Otherwise, the value is a slice of
-	// Subject or Subject Alternate Name strings from the client X509
-	// certificate, e.g. SUBJECT:CN=Bob or EMAIL:bob@example.com
-	ACL *[]string `yaml:"acl,omitempty"`
-	// RootCAs a list of:
-	// - CA names defined in the PKI section,
-	// - File names that contain PEM-encoded certificates, or
-	// - PEM-encoded certificates.
-	RootCAs []string `yaml:"rootCAs,omitempty"`
-	// AddClientCertHeader indicates which fields of the HTTP
-	// X-Forwarded-Client-Cert header should be added to the request when
-	// Mode is HTTP or HTTPS.
-	AddClientCertHeader []string `yaml:"addClientCertHeader,omitempty"`
+// CircuitBreaker controls how long the backend addresses that fail are
+// skipped. The skipped addresses are only tried when all the other addresses
+// fail. After the cooldown, the next connection tries the address again, and
+// the cooldown doubles if it fails again.
+//
+// A dial fails when the connection, the PROXY header, or the STARTTLS,
+// Postgres, or MySQL preamble fails. Each connection tries each address at
+// most once, without waiting between the addresses. Instead of a backoff,
+// the cooldown keeps the addresses that fail repeatedly from being tried
+// again, and Backpressure.DialRetries tries all the addresses again with an
+// exponential backoff.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive dial failures after
+	// which an address is skipped. The default is 1.
+	FailureThreshold int `yaml:"failureThreshold,omitempty"`
+	// Cooldown is how long an address is skipped after FailureThreshold
+	// consecutive failures. The default is 5 seconds.
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+	// MaxCooldown is the maximum value of the cooldown. The default is 5
+	// minutes.
+	MaxCooldown time.Duration `yaml:"maxCooldown,omitempty"`
 }
 
-// ConfigOIDC contains the parameters of an OIDC provider.
-type ConfigOIDC struct {
-	// Name is the name of the provider. It is used internally only.
-	Name string `yaml:"name"`
-	// DiscoveryURL is the discovery URL of the OIDC provider. If set, it
-	// is used to discover the values of AuthEndpoint and TokenEndpoint.
-	DiscoveryURL string `yaml:"discoveryUrl,omitempty"`
-	// AuthEndpoint is the authorization endpoint. It must be set only if
-	// DiscoveryURL is not set.
-	AuthEndpoint string `yaml:"authorizationEndpoint,omitempty"`
-	// Scopes is the list of scopes to request. The default list ("openid",
-	// "email") returns only the user's email address.
-	// To get the user's name and picture, add the "profile" scope with
-	// google, or the "public_profile" scope with facebook, i.e.
-	// {"openid", "email", "profile"} or {"openid", "email",
-	// "public_profile"}.
-	Scopes []string `yaml:"scopes,flow,omitempty"`
-	// HostedDomain specifies that the HD param should be used.
-	// This parameter is used by Google is restrict the login process to
-	// one hosted domain, e.g. example.com. An empty or unspecified value
-	// means accounts from any domain will be accepted.
-	// https://developers.google.com/identity/openid-connect/openid-connect#hd-param
-	HostedDomain string `yaml:"hostedDomain,omitempty"`
-	// TokenEndpoint is the token endpoint. It must be set only if
-	// DiscoveryURL is not set.
-	TokenEndpoint string `yaml:"tokenEndpoint,omitempty"`
-	// UserinfoEndpoint is the userinfo endpoint. It must be set only if
-	// DiscoveryURL is not set and the token endpoint doesn't return an
-	// ID token.
-	UserinfoEndpoint string `yaml:"userinfoEndpoint,omitempty"`
-	// RedirectURL is the OAUTH2 redirect URL. It must be managed by the
-	// proxy.
-	RedirectURL string `yaml:"redirectUrl"`
-	// ClientID is the Client ID.
-	ClientID string `yaml:"clientId"`
-	// ClientSecret is the Client Secret.
-	ClientSecret string `yaml:"clientSecret"`
-	// Domain, if set, determine the domain where the user identities will
-	// be valid. Only set this if all host names in the domain are served
-	// by this proxy.
-	Domain string `yaml:"domain,omitempty"`
+// ConfigRejectPolicy specifies how rejected connections are handled.
+type ConfigRejectPolicy struct {
+	// Action is what to do with the rejected connections. Valid values
+	// are:
+	//   - alert: send a TLS unrecognized_name alert and close the
+	//     connection (default).
+	//   - close: close the connection without sending anything, so that
+	//     scanners can't tell whether the proxy is there.
+	//   - tarpit: keep the connection open without sending anything for
+	//     TarpitDelay, then close it. Tarpitted connections count against
+	//     MaxOpen.
+	//   - route: send the connection to the backend of ServerName, e.g. a
+	//     LOCAL backend with a friendly error page, or a honeypot.
+	Action string `yaml:"action,omitempty"`
+	// TarpitDelay is how long connections are held open when Action is
+	// tarpit. The default is 10 seconds.
+	TarpitDelay time.Duration `yaml:"tarpitDelay,omitempty"`
+	// ServerName is the server name of the backend that receives the
+	// rejected connections when Action is route. When that backend also
+	// denies the client, the connection is closed.
+	ServerName string `yaml:"serverName,omitempty"`
 }
 
-// ConfigSAML contains the parameters of a SAML identity provider.
-type ConfigSAML struct {
-	// Name is the name of the provider. It is used internally only.
-	Name     string `yaml:"name"`
-	SSOURL   string `yaml:"ssoUrl"`
-	EntityID string `yaml:"entityId"`
-	Certs    string `yaml:"certs"`
-	ACSURL   string `yaml:"acsUrl"`
-	// Domain, if set, determine the domain where the user identities will
-	// be valid. Only set this if all host names in the domain are served
-	// by this proxy.
-	Domain string `yaml:"domain,omitempty"`
+// ConfigCertificateMonitor specifies how certificates are monitored.
+type ConfigCertificateMonitor struct {
+	// Interval is how often the certificates are checked. The default is
+	// 1 hour.
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// AlertBefore is the time before expiry at which an alert is raised
+	// for a certificate that hasn't been renewed. ACME certificates are
+	// normally renewed 30 days before they expire. The default is 20 days.
+	AlertBefore time.Duration `yaml:"alertBefore,omitempty"`
+	// WebhookURL is an optional URL where the alerts are sent in JSON
+	// format with a POST request. Each certificate is reported once.
+	WebhookURL string `yaml:"webhookUrl,omitempty"`
+	// WebhookHeaders are HTTP headers to add to the webhook requests,
+	// e.g. for authentication.
+	WebhookHeaders map[string]string `yaml:"webhookHeaders,omitempty"`
 }
 
-// ConfigPasskey contains the parameters of a Passkey manager.
-type ConfigPasskey struct {
-	// Name is the name of the provider. It is used internally only.
-	Name string `yaml:"name"`
-	// IdentityProvider is the name of another identity provider that will
-	// be used to authenticate the user before registering their first
-	// passkey.
-	IdentityProvider string `yaml:"identityProvider"`
-	// RefreshInterval is the amount of time after which users must
-	// re-authenticate with the other identity provider.
-	// The value is a go duration, e.g. '500h'
-	// The default value of 0 means no re-authentication is required.
-	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
-	// Endpoint is a URL on this proxy that will handle the passkey
-	// authentication.
-	Endpoint string `yaml:"endpoint"`
-	// Domain, if set, determine the domain where the user identities will
-	// be valid. Only set this if all host names in the domain are served
-	// by this proxy.
-	Domain string `yaml:"domain,omitempty"`
+// ConfigCertificateStore specifies an external storage backend for the
+// certificates.
+type ConfigCertificateStore struct {
+	// Type is the type of storage: s3, gcs, redis, or sql.
+	Type string `yaml:"type"`
+	// Prefix is prepended to all the keys, so that the same bucket,
+	// database, or table can be used for other things, or by
+	// independent groups of proxies.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Endpoint is the base URL of the S3 API, e.g.
+	// https://s3.us-west-2.amazonaws.com or the URL of a compatible
+	// service like MinIO. The default is https://s3.<region>.amazonaws.com
+	// with s3, and https://storage.googleapis.com with gcs.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Region is the region of the bucket. The default is us-east-1 with
+	// s3, and auto with gcs.
+	Region string `yaml:"region,omitempty"`
+	// Bucket is the name of the bucket where the objects are stored.
+	Bucket string `yaml:"bucket,omitempty"`
+	// AccessKeyID and SecretAccessKey are the credentials for s3. With
+	// gcs, they are an HMAC key of a service account.
+	AccessKeyID     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+
+	// Address is the host:port of the redis server.
+	Address string `yaml:"address,omitempty"`
+	// Password is the redis password, if any.
+	Password string `yaml:"password,omitempty"`
+	// DB is the redis database number.
+	DB int `yaml:"db,omitempty"`
+	// TLS indicates that the connection to the redis server uses TLS.
+	TLS bool `yaml:"tls,omitempty"`
+
+	// Driver is the name of the database/sql driver, e.g. postgres or
+	// mysql. The driver must be registered by the program, i.e. it must
+	// be imported. The tlsproxy binary doesn't include any.
+	Driver string `yaml:"driver,omitempty"`
+	// DSN is the data source name, whose format depends on the driver.
+	DSN string `yaml:"dsn,omitempty"`
+	// Table is the name of the table where the data is stored. It is
+	// created automatically. The default is tlsproxy_certificates.
+	Table string `yaml:"table,omitempty"`
 }
 
-// ConfigPKI defines the parameters of a local Certificate Authority.
-type ConfigPKI struct {
-	// Name is the name of the CA.
-	Name string `yaml:"name"`
-	// KeyType is type of cryptographic key to use with this CA. Valid
-	// values are: ecdsa-p224, ecdsa-p256, ecdsa-p394, ecdsa-p521, ed25519,
-	// rsa-2048, rsa-3072, and rsa-4096.
-	KeyType string `yaml:"keyType,omitempty"`
-	// IssuingCertificateURLs is a list of URLs that return the X509
-	// certificate of the CA.
-	IssuingCertificateURLs []string `yaml:"issuingCertificateUrls,omitempty"`
-	// CRLDistributionPoints is a list of URLs that return the Certificate
-	// Revocation List for this CA.
-	CRLDistributionPoints []string `yaml:"crlDistributionPoints,omitempty"`
-	// OCSPServer is a list of URLs that serve the Online Certificate Status
-	// Protocol (OCSP) for this CA.
-	// https://en.wikipedia.org/wiki/Online_Certificate_Status_Protocol
-	OCSPServer []string `yaml:"ocspServers,omitempty"`
-	// Endpoint is the URL where users can manage their certificates. It
-	// should be on a backend with restricted access and/or forceReAuth
-	// enabled.
+// ConfigTracing is the configuration of OpenTelemetry tracing.
+type ConfigTracing struct {
+	// Endpoint is the URL of the OTLP/HTTP traces endpoint, e.g.
+	// http://localhost:4318/v1/traces. The spans are sent in JSON
+	// encoding.
 	Endpoint string `yaml:"endpoint"`
-	// Admins is a list of users who are allowed to perform administrative
-	// tasks on the CA, e.g. revoke any certificate.
-	Admins []string `yaml:"admins"`
+	// Headers are HTTP headers to add to the export requests, e.g. for
+	// authentication.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// ServiceName is the value of the service.name resource attribute.
+	// The default is tlsproxy.
+	ServiceName string `yaml:"serviceName,omitempty"`
+	// SampleRatio is the fraction of traces to sample, between 0 and 1.
+	// Requests with a sampled traceparent are always sampled. The
+	// default is 1.
+	SampleRatio *float64 `yaml:"sampleRatio,omitempty"`
 }
 
-// BackendSSO specifies the identity parameters to use for a backend.
-type BackendSSO struct {
-	// Provider is the the name of an identity provider defined in
-	// Config.OIDCProviders.
-	Provider string `yaml:"provider"`
-	// ForceReAuth is the time duration after which the user has to
-	// authenticate again. By default, users don't have to authenticate
-	// again until their token expires.
-	ForceReAuth time.Duration `yaml:"forceReAuth,omitempty"`
-	// ACL restricts which user identity can access this backend. It is a
-	// list of email addresses and/or domains, e.g. "bob@example.com", or
-	// "@example.com"
-	// If ACL is nil, all identities are allowed. If ACL is an empty list,
-	// nobody is allowed.
-	ACL *[]string `yaml:"acl,omitempty"`
-	// Paths lists the path prefixes for which this policy will be enforced.
-	// If Paths is empty, the policy applies to all paths.
-	Paths []string `yaml:"paths,omitempty"`
-	// SetUserIDHeader indicates that the x-tlsproxy-user-id header should
-	// be set with the email address of the user.
-	SetUserIDHeader bool `yaml:"setUserIdHeader,omitempty"`
-	// GenerateIDTokens indicates that the proxy should generate ID tokens
-	// for authenticated users.
-	GenerateIDTokens bool `yaml:"generateIdTokens,omitempty"`
-	// LocalOIDCServer is used to configure a local OpenID Provider to
-	// authenticate users with backend services that support OpenID Connect.
-	LocalOIDCServer *LocalOIDCServer `yaml:"localOIDCServer,omitempty"`
-
-	p         identityProvider
-	cm        *cookiemanager.CookieManager
-	actualIDP string
+// ConfigAccessLog is the configuration of the access log. When none of File,
+// Syslog, or Journald is set, the access log is written to the standard
+// output, or to the io.Writer set with Proxy.SetAccessLogWriter.
+type ConfigAccessLog struct {
+	// Format is the format of the access log entries. Valid values are
+	// json and combined (Apache combined log format). The default is json.
+	Format string `yaml:"format,omitempty"`
+	// File is the name of the access log file. The file is rotated when
+	// it reaches MaxSize.
+	File string `yaml:"file,omitempty"`
+	// MaxSize is the maximum size of the access log file, in MiB, before
+	// it is rotated. The default is 100.
+	MaxSize int `yaml:"maxSize,omitempty"`
+	// MaxFiles is the number of rotated files to keep. The default is 5.
+	MaxFiles int `yaml:"maxFiles,omitempty"`
+	// Syslog indicates that the access log entries should be sent to
+	// syslog. The entries of HTTP requests that failed with a 5xx status
+	// have the warning severity, and the others have the info severity.
+	Syslog bool `yaml:"syslog,omitempty"`
+	// SyslogConfig contains the parameters of the syslog server.
+	SyslogConfig `yaml:",inline"`
+	// Journald indicates that the access log entries should be sent to
+	// systemd-journald, with the same priorities as with syslog.
+	Journald bool `yaml:"journald,omitempty"`
 }
 
-// PathOverride specifies different backend parameters for some path prefixes.
-type PathOverride struct {
-	// Paths is the list of path prefixes for which these parameters apply.
-	Paths []string `yaml:"paths"`
-	// Addresses is a list of server addresses where requests are forwarded.
-	// When more than one address are specified, requests are distributed
-	// using a simple round robin.
-	Addresses []string `yaml:"addresses,omitempty"`
-	// Mode is either HTTP or HTTPS.
-	Mode string `yaml:"mode"`
-	// DocumentRoot indicates local files should be served from this
-	// directory. This option is only valid when Addresses is empty.
-	DocumentRoot string `yaml:"documentRoot,omitempty"`
-	// BackendProto specifies which protocol to use when forwarding an HTTPS
-	// request to the backend. This field is only valid in modes HTTP and
-	// HTTPS.
-	// The value should be an ALPN protocol, e.g.: http/1.1, h2, or h3.
-	// If the value is set explicitly to "", the same protocol used by the
-	//  client will be used with the backend.
-	BackendProto *string `yaml:"backendProto,omitempty"`
-	// InsecureSkipVerify disabled the verification of the backend server's
-	// TLS certificate. See https://pkg.go.dev/crypto/tls#Config
-	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
-	// ForwardServerName is the ServerName to send in the TLS handshake with
-	// the backend server. It is also used to verify the server's identify.
-	// This is particularly useful when the addresses use IP addresses
-	// instead of hostnames.
-	ForwardServerName string `yaml:"forwardServerName,omitempty"`
-	// ForwardRootCAs a list of:
-	// - CA names defined in the PKI section,
-	// - File names that contain PEM-encoded certificates, or
-	// - PEM-encoded certificates.
-	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
-	// ForwardTimeout is the connection timeout to backend servers. If
-	// Addresses contains multiple addresses, this timeout indicates how
-	// long to wait before trying the next address in the list. The default
-	// value is 30 seconds.
-	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
-	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
-	// value is the version of the protocol to use, e.g. v1 or v2.
-	// By default, the proxy protocol is not enabled.
-	// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
-	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
-	// SanitizePath indicates that the request's path should be sanitized
-	// before forwarding the request to the backend.
-	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
-
-	forwardRootCAs       *x509.CertPool
-	proxyProtocolVersion byte
+// ConfigAuditLog is the configuration of the audit log. The entries are JSON
+// objects, one per line, and each entry contains the SHA-256 hash of the
+// previous one, so that changes to the log can be detected. Either File or
+// Syslog must be set.
+type ConfigAuditLog struct {
+	// File is the name of the audit log file. The file is rotated when it
+	// reaches MaxSize. The hash chain continues across rotations and
+	// restarts.
+	File string `yaml:"file,omitempty"`
+	// MaxSize is the maximum size of the audit log file, in MiB, before
+	// it is rotated. The default is 100.
+	MaxSize int `yaml:"maxSize,omitempty"`
+	// MaxFiles is the number of rotated files to keep. The default is 10.
+	MaxFiles int `yaml:"maxFiles,omitempty"`
+	// MaxAge is the retention period of the rotated files. Rotated files
+	// that are older are deleted. By default, they are only deleted when
+	// there are more than MaxFiles.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+	// Syslog indicates that the audit log entries should be sent to
+	// syslog.
+	Syslog bool `yaml:"syslog,omitempty"`
+	// SyslogConfig contains the parameters of the syslog server.
+	SyslogConfig `yaml:",inline"`
 }
 
-// LocalOIDCServer is used to configure a local OpenID Provider to
-// authenticate users with backend services that support OpenID Connect.
-// When this is enabled, tlsproxy will add a few endpoints to this
-// backend:
-// - <PathPrefix>/.well-known/openid-configuration
-// - <PathPrefix>/authorization
-// - <PathPrefix>/token
-// - <PathPrefix>/jwks
-type LocalOIDCServer struct {
-	// PathPrefix specifies how the endpoint paths are constructed. It is
-	// generally fine to leave it empty.
-	PathPrefix string `yaml:"pathPrefix,omitempty"`
-	// Clients is the list of all authorized clients and their
-	// configurations.
-	Clients []*LocalOIDCClient `yaml:"clients,omitempty"`
-	// RewriteRules are used to rewrite existing claims or create new claims
-	// from existing ones.
-	RewriteRules []*LocalOIDCRewriteRule `yaml:"rewriteRules,omitempty"`
+// ConfigFlowExport is the configuration of the flow export. Each record
+// contains the start and end times of the connection, the client's address,
+// the proxy's address, the protocol (tcp or udp), the number of bytes received
+// from and sent to the client, the server name, the mode, the subject of the
+// client certificate, and the backend address. The records are sent in the
+// background. When the collector can't keep up, they are dropped.
+type ConfigFlowExport struct {
+	// Collector is the address of the collector, e.g. 192.168.0.10:4739.
+	Collector string `yaml:"collector"`
+	// Network is udp (default) or tcp.
+	Network string `yaml:"network,omitempty"`
+	// Format is the format of the records. Valid values are json (default),
+	// one JSON object per line, or per datagram with udp, and ipfix
+	// (RFC 7011).
+	Format string `yaml:"format,omitempty"`
+	// ObservationDomainID is the IPFIX observation domain ID.
+	ObservationDomainID uint32 `yaml:"observationDomainId,omitempty"`
+	// EnterpriseNumber is the IANA private enterprise number of the IPFIX
+	// information elements that don't have a standard equivalent: server
+	// name (1), client certificate subject (2), mode (3), and backend
+	// address (4), all strings. When it isn't set, these elements are
+	// omitted from the IPFIX records. The bytes sent to the client are
+	// exported as reverseOctetDeltaCount (RFC 5103).
+	EnterpriseNumber uint32 `yaml:"enterpriseNumber,omitempty"`
+	// QueueSize is the maximum number of records waiting to be sent. The
+	// default is 1024.
+	QueueSize int `yaml:"queueSize,omitempty"`
 }
 
-// LocalOIDCClient contains the parameters of one OIDC client that is allowed
-// to connect to the local OIDC server. All the fields must be shared with the
-// client application.
-type LocalOIDCClient struct {
-	// ID is the OAUTH2 client ID. It should a unique string that's hard to
-	// guess. See https://www.oauth.com/oauth2-servers/client-registration/client-id-secret/
-	ID string `yaml:"id"`
-	// Secret is the OAUTH2 secret for the client. It should be a random
-	// string generated with something like:
-	//  dd if=/dev/random bs=32 count=1 | base64
-	Secret string `yaml:"secret"`
-	// RedirectURI is where the authorization endpoint will redirect the
-	// user once the authorization code has been granted.
-	RedirectURI []string `yaml:"redirectUri"`
+// ConfigTLSDebug is the configuration of the TLS debugging features.
+type ConfigTLSDebug struct {
+	// KeyLogFile is the name of a file where the secrets of the TLS
+	// connections from the clients are written, in the NSS key log
+	// format, like with SSLKEYLOGFILE. Tools like Wireshark use them to
+	// decrypt captured traffic. Anyone who has this file can decrypt the
+	// TLS connections, so it should only be used to debug problems with
+	// test clients, and removed afterwards. A relative path is relative
+	// to the config file's directory. It can't be changed with the admin
+	// API. The default is no key log.
+	KeyLogFile string `yaml:"keyLogFile,omitempty"`
+	// Transcripts is the number of handshake transcripts of the recent
+	// connections to keep. A transcript records the details of the
+	// ClientHello, the backend that was selected, the handshake result,
+	// and the events of one connection. The transcripts are shown on the
+	// console's Connections tab and returned by /api/transcripts. The
+	// default is 0, i.e. no transcripts.
+	Transcripts int `yaml:"transcripts,omitempty"`
 }
 
-// LocalOIDCRewriteRule define how to rewrite existing claims or create new
-// claims from existing ones.
-// The following example uses the "email" claim to create a "preferred_username"
-// claim by removing the domain name.
+// ConfigNoSNISniffing is the configuration of the protocol sniffing of the
+// connections without SNI. These connections are first routed to
+// DefaultServerName, whose certificate is used for the TLS handshake. Then,
+// the sniffers are tried in order on the first bytes received from the
+// client, and the first one that matches chooses the backend. When none
+// matches, the connection stays on DefaultServerName.
 //
-//	InputClaim: "email"
-//	OutputClaim: "preferred_username"
-//	Regex: "^([^@]+)@example.com$"
-//	Value: "$1"
-type LocalOIDCRewriteRule struct {
-	InputClaim  string `yaml:"inputClaim"`
-	OutputClaim string `yaml:"outputClaim"`
-	Regex       string `yaml:"regex"`
-	Value       string `yaml:"value"`
+// Sniffing only applies when the backend of DefaultServerName is in mode
+// CONSOLE, LOCAL, HTTP, HTTPS, WEBSOCKET, REDIRECT, PROXY, TCP, or TLS, and
+// the connection doesn't use HTTP/2. The chosen backend must be in one of
+// these modes too, and it can't have ClientAuth. Protocols where the server
+// speaks first can't be sniffed.
+type ConfigNoSNISniffing struct {
+	// Sniffers is the list of sniffers, in order of priority.
+	Sniffers []*Sniffer `yaml:"sniffers"`
+	// Timeout is the maximum amount of time to wait for the client to
+	// send enough bytes for the sniffers. The default is 1s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
 }
 
-func (cfg *Config) serialize() []byte {
-	if cfg == nil {
+// Sniffer recognizes a protocol from the first bytes of a connection.
+type Sniffer struct {
+	// Protocol is one of:
+	//   - http: an HTTP/1 request. The backend is chosen with the Host
+	//     header, unless ServerName is set.
+	//   - ssh: an SSH client banner.
+	//   - prefix: the bytes of Prefix.
+	Protocol string `yaml:"protocol"`
+	// Prefix is the string that the connection must start with. It is
+	// required with Protocol prefix.
+	Prefix string `yaml:"prefix,omitempty"`
+	// ServerName is the server name of the backend to use when the
+	// sniffer matches. It is required with Protocol ssh and prefix.
+	ServerName string `yaml:"serverName,omitempty"`
+}
+
+// ConfigHandshakeAdmission is the configuration of the handshake admission
+// control. The connections that arrive when MaxHandshakes handshakes are in
+// progress wait in a queue. The clients that resume a previous TLS session,
+// i.e. that need a cheap handshake, go before the others, and they can take
+// the place of another connection when the queue is full. The connections
+// that can't be queued are dropped before their TLS handshake. Connections to
+// TLSPASSTHROUGH backends don't count, since their handshake is done by the
+// backend.
+type ConfigHandshakeAdmission struct {
+	// MaxHandshakes is the maximum number of TLS handshakes in progress.
+	MaxHandshakes int `yaml:"maxHandshakes"`
+	// QueueSize is the maximum number of connections waiting for a
+	// handshake to finish. The default is the same as MaxHandshakes.
+	QueueSize int `yaml:"queueSize,omitempty"`
+	// QueueTimeout is the maximum amount of time that a connection waits
+	// in the queue. The default is 5 seconds.
+	QueueTimeout time.Duration `yaml:"queueTimeout,omitempty"`
+}
+
+// ConfigKeyStore is the configuration of a key store.
+type ConfigKeyStore struct {
+	// Name is the name of the key store, used in the backend's KeyStore
+	// field.
+	Name string `yaml:"name"`
+	// Type is the type of key store:
+	//  - awskms: the AWS Key Management Service. The key IDs are key
+	//    IDs, key ARNs, or alias names, e.g. alias/tlsproxy.
+	//  - tpm: the Trusted Platform Module. The key IDs are absolute file
+	//    names where the keys are saved, wrapped by the TPM. A new ECDSA
+	//    key is created when the file doesn't exist.
+	// Programs that embed the proxy can add other types, e.g. pkcs11,
+	// with keystore.Register.
+	Type string `yaml:"type"`
+	// Region, Endpoint, AccessKeyID, and SecretAccessKey are used with
+	// awskms. The default Endpoint is https://kms.<region>.amazonaws.com/
+	Region          string `yaml:"region,omitempty"`
+	Endpoint        string `yaml:"endpoint,omitempty"`
+	AccessKeyID     string `yaml:"accessKeyId,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	// Options are passed to the key stores that are added with
+	// keystore.Register, e.g. the PKCS#11 module, token label, and PIN.
+	Options map[string]string `yaml:"options,omitempty"`
+
+	provider keystore.Provider
+}
+
+// ConfigACME is the configuration of the ACME certificate authorities.
+type ConfigACME struct {
+	// CertificateAuthorities is a list of ACME CAs. The CA without
+	// Domains, if any, is used for all the server names that don't match
+	// the Domains of another CA. Otherwise, Let's Encrypt is used for
+	// them. Certificates obtained with the dns-01 challenge always use
+	// the default CA.
+	CertificateAuthorities []*ConfigACMECA `yaml:"certificateAuthorities,omitempty"`
+	// AccountKeyRotation is the amount of time between rotations of the
+	// ACME account keys. The default is 0, i.e. the keys are never
+	// rotated.
+	AccountKeyRotation time.Duration `yaml:"accountKeyRotation,omitempty"`
+	// Staging indicates that the Let's Encrypt staging environment should
+	// be used instead of production when there is no default CA, e.g.
+	// for testing. The staging certificates aren't trusted by browsers,
+	// and they are stored separately from the production certificates.
+	// Certificates obtained with the dns-01 challenge are not affected.
+	Staging bool `yaml:"staging,omitempty"`
+	// Prewarm indicates that the certificates of all the configured
+	// server names should be obtained, or loaded from the cache, when the
+	// proxy starts and when the config changes, instead of when the first
+	// client connects.
+	Prewarm bool `yaml:"prewarm,omitempty"`
+	// MaxConcurrentIssuance is the maximum number of certificate requests
+	// that are sent to the CAs at the same time. The default is 1.
+	MaxConcurrentIssuance int `yaml:"maxConcurrentIssuance,omitempty"`
+}
+
+// ConfigACMECA is the configuration of an ACME certificate authority.
+type ConfigACMECA struct {
+	// Name is the name of the CA. Each CA has its own ACME account.
+	Name string `yaml:"name"`
+	// DirectoryURL is the URL of the CA's ACME directory, e.g.
+	// https://acme.zerossl.com/v2/DV90
+	DirectoryURL string `yaml:"directoryUrl"`
+	// EABKeyID and EABHMACKey are the External Account Binding
+	// credentials that some CAs require to register new accounts. The
+	// HMAC key is base64url-encoded, as provided by the CA.
+	EABKeyID   string `yaml:"eabKeyId,omitempty"`
+	EABHMACKey string `yaml:"eabHmacKey,omitempty"`
+	// RootCAs is a list of CA certificates that are trusted to
+	// authenticate the ACME server, e.g. for private CAs, in addition to
+	// the system's root CAs. Each value is a file name or PEM-encoded
+	// data.
+	RootCAs []string `yaml:"rootCAs,omitempty"`
+	// Domains is the list of domains that get their certificates from
+	// this CA, including their subdomains. When a server name matches
+	// more than one CA, the longest domain wins.
+	Domains []string `yaml:"domains,omitempty"`
+
+	eabHMACKey []byte
+	rootCAs    *x509.CertPool
+}
+
+// ConfigDNSProvider is the configuration of a DNS provider for the ACME
+// dns-01 challenge.
+type ConfigDNSProvider struct {
+	// Type is the type of DNS provider. Valid values are: cloudflare,
+	// route53, and rfc2136.
+	Type string `yaml:"type"`
+	// Domains is the list of domains that use this DNS provider. The
+	// certificate for each domain covers the domain itself and all its
+	// direct subdomains, e.g. example.com and *.example.com. Backends
+	// that use any of these server names get their certificate via the
+	// dns-01 challenge.
+	Domains []string `yaml:"domains"`
+	// PropagationDelay is the amount of time to wait after creating the
+	// DNS records before asking the ACME server to verify them. The
+	// default is 30s.
+	PropagationDelay time.Duration `yaml:"propagationDelay,omitempty"`
+
+	// APIToken is the Cloudflare API token. It needs the Zone.DNS edit
+	// permission.
+	APIToken string `yaml:"apiToken,omitempty"`
+	// ZoneID is the Cloudflare zone ID.
+	ZoneID string `yaml:"zoneId,omitempty"`
+
+	// AccessKeyID is the AWS access key ID for Route 53.
+	AccessKeyID string `yaml:"accessKeyId,omitempty"`
+	// SecretAccessKey is the AWS secret access key for Route 53.
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+	// HostedZoneID is the Route 53 hosted zone ID.
+	HostedZoneID string `yaml:"hostedZoneId,omitempty"`
+
+	// Nameserver is the address of the primary name server that accepts
+	// RFC 2136 dynamic updates, e.g. ns1.example.com:53.
+	Nameserver string `yaml:"nameserver,omitempty"`
+	// Zone is the name of the DNS zone to update with RFC 2136.
+	Zone string `yaml:"zone,omitempty"`
+	// TSIGKeyName is the name of the TSIG key used to authenticate RFC
+	// 2136 updates.
+	TSIGKeyName string `yaml:"tsigKeyName,omitempty"`
+	// TSIGSecret is the base64-encoded TSIG key.
+	TSIGSecret string `yaml:"tsigSecret,omitempty"`
+	// TSIGAlgorithm is the TSIG algorithm. Valid values are hmac-sha1,
+	// hmac-sha256, and hmac-sha512. The default is hmac-sha256.
+	TSIGAlgorithm string `yaml:"tsigAlgorithm,omitempty"`
+}
+
+// ForwardedHeaders specifies how the X-Forwarded-For, X-Forwarded-Host,
+// X-Forwarded-Proto, and Forwarded headers are sent to the backend.
+type ForwardedHeaders struct {
+	// Mode specifies what to do with the headers that were sent by the
+	// client. Valid values are:
+	//   - replace: the client's values are discarded (default).
+	//   - append: the proxy's values are appended to the client's values.
+	//     This should only be used when the client is a trusted proxy.
+	//   - strip: all the headers are removed, and none are added.
+	Mode string `yaml:"mode,omitempty"`
+	// XForwarded indicates that X-Forwarded-For, X-Forwarded-Host, and
+	// X-Forwarded-Proto should be sent. X-Forwarded-For is always sent
+	// unless Mode is strip. The default is true.
+	XForwarded *bool `yaml:"xForwarded,omitempty"`
+	// Forwarded indicates that the Forwarded header should be sent.
+	// See https://www.rfc-editor.org/rfc/rfc7239. The default is false.
+	Forwarded bool `yaml:"forwarded,omitempty"`
+}
+
+// ResponseCache contains the parameters of a backend's response cache. The
+// cache is purged with the admin API's /api/cache/purge endpoint.
+type ResponseCache struct {
+	// MaxSize is the maximum size of the responses kept in memory, in
+	// MiB. The default is 64.
+	MaxSize int `yaml:"maxSize,omitempty"`
+	// MaxObjectSize is the maximum size of a response body that can be
+	// stored, in KiB. The default is 1024.
+	MaxObjectSize int `yaml:"maxObjectSize,omitempty"`
+	// DiskSize is the maximum size of the responses kept on disk, in MiB.
+	// When it is set, the responses that are evicted from memory are
+	// saved, encrypted, in CacheDir. They are deleted when the proxy
+	// stops or when the cache config changes.
+	DiskSize int `yaml:"diskSize,omitempty"`
+	// TTLOverrides replace the freshness lifetime of the responses to
+	// the requests for some paths. Responses that aren't allowed to be
+	// stored, e.g. with Cache-Control: no-store or private, still aren't
+	// stored.
+	TTLOverrides []*CacheTTLOverride `yaml:"ttlOverrides,omitempty"`
+}
+
+func (rc *ResponseCache) check() error {
+	if rc.MaxSize < 0 || rc.MaxObjectSize < 0 || rc.DiskSize < 0 {
+		return errors.New("MaxSize, MaxObjectSize, DiskSize: values cannot be negative")
+	}
+	if rc.MaxSize == 0 {
+		rc.MaxSize = 64
+	}
+	if rc.MaxObjectSize == 0 {
+		rc.MaxObjectSize = 1024
+	}
+	for i, o := range rc.TTLOverrides {
+		if len(o.Paths) == 0 {
+			return fmt.Errorf("TTLOverrides[%d].Paths: must not be empty", i)
+		}
+		for j, p := range o.Paths {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("TTLOverrides[%d].Paths[%d]: must start with /", i, j)
+			}
+		}
+		if o.TTL < 0 {
+			return fmt.Errorf("TTLOverrides[%d].TTL: value cannot be negative", i)
+		}
+	}
+	return nil
+}
+
+// ttl returns the TTL override for path.
+func (rc *ResponseCache) ttl(path string) (time.Duration, bool) {
+	for _, o := range rc.TTLOverrides {
+		for _, p := range o.Paths {
+			if strings.HasPrefix(path, p) {
+				return o.TTL, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// CacheTTLOverride sets the freshness lifetime of the responses to the
+// requests for some paths.
+type CacheTTLOverride struct {
+	// Paths is a list of path prefixes, e.g. /static/.
+	Paths []string `yaml:"paths"`
+	// TTL is how long the responses are fresh, i.e. served from the cache
+	// without contacting the backend. Zero means that the responses are
+	// always revalidated.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Compression controls which responses are compressed, and how.
+type Compression struct {
+	// Encodings is the list of content codings that can be used, in
+	// order of preference. Valid values are zstd, br, and gzip. The
+	// default is [zstd, br, gzip].
+	Encodings []string `yaml:"encodings,omitempty"`
+	// ContentTypes is the list of MIME types of the responses that are
+	// compressed. A trailing /* matches all the subtypes, e.g. text/*.
+	// The default is text/*, application/javascript, application/json,
+	// application/manifest+json, application/wasm, application/xml, and
+	// image/svg+xml. Server-sent events are never compressed.
+	ContentTypes []string `yaml:"contentTypes,omitempty"`
+	// MinSize is the minimum size of the responses that are compressed,
+	// in bytes. The default is 1024.
+	MinSize int `yaml:"minSize,omitempty"`
+}
+
+func (c *Compression) check() error {
+	if len(c.Encodings) == 0 {
+		c.Encodings = slices.Clone(defaultCompressionEncodings)
+	}
+	for i, e := range c.Encodings {
+		c.Encodings[i] = strings.ToLower(e)
+		if !slices.Contains(defaultCompressionEncodings, c.Encodings[i]) {
+			return fmt.Errorf("Encodings[%d]: value %q must be one of %v", i, e, defaultCompressionEncodings)
+		}
+	}
+	if len(c.ContentTypes) == 0 {
+		c.ContentTypes = slices.Clone(defaultCompressionContentTypes)
+	}
+	for i, ct := range c.ContentTypes {
+		c.ContentTypes[i] = strings.ToLower(ct)
+		if typ, sub, ok := strings.Cut(ct, "/"); !ok || typ == "" || sub == "" {
+			return fmt.Errorf("ContentTypes[%d]: invalid MIME type %q", i, ct)
+		}
+	}
+	if c.MinSize < 0 {
+		return errors.New("MinSize: value cannot be negative")
+	}
+	if c.MinSize == 0 {
+		c.MinSize = 1024
+	}
+	return nil
+}
+
+// Streaming controls how the responses are flushed to the clients. The
+// server-sent events (text/event-stream), and the responses with the
+// X-Accel-Buffering: no header, are always flushed after each write and never
+// compressed, even without this config.
+type Streaming struct {
+	// FlushInterval is how often the responses are flushed to the clients
+	// while they are copied. Zero means that the responses with a known
+	// length are only flushed when the buffer is full. A negative value
+	// means that all the responses are flushed after each write. The
+	// responses with an unknown length are always flushed after each
+	// write.
+	FlushInterval time.Duration `yaml:"flushInterval,omitempty"`
+	// Paths is a list of path prefixes of streaming endpoints, e.g.
+	// /events/. The responses to the requests for these paths are flushed
+	// after each write, starting with the headers, and they are never
+	// compressed or stored in the response cache.
+	Paths []string `yaml:"paths,omitempty"`
+}
+
+func (s *Streaming) check() error {
+	for i, p := range s.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("Paths[%d]: must start with /", i)
+		}
+	}
+	return nil
+}
+
+// flushInterval returns the FlushInterval of the reverse proxy.
+func (s *Streaming) flushInterval() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return s.FlushInterval
+}
+
+// isStreamingPath returns true if path is one of the streaming endpoints.
+func (s *Streaming) isStreamingPath(path string) bool {
+	if s == nil {
+		return false
+	}
+	for _, p := range s.Paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocketLimits contains the limits of the WebSocket connections that are
+// proxied to the backend servers.
+type WebSocketLimits struct {
+	// MaxLifetime is the maximum duration of a WebSocket connection. The
+	// default is no limit.
+	MaxLifetime time.Duration `yaml:"maxLifetime,omitempty"`
+	// IdleTimeout is the amount of time after which a WebSocket
+	// connection is closed when no data is sent in either direction.
+	// The default is no limit.
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+}
+
+// AddressGroup is a group of server addresses that receives a share of a
+// backend's traffic.
+type AddressGroup struct {
+	// Name identifies the group in the admin API and in the metrics,
+	// e.g. stable or canary.
+	Name string `yaml:"name"`
+	// Addresses is a list of server addresses, e.g. 192.168.0.10:8080.
+	Addresses []string `yaml:"addresses"`
+	// Weight is the relative share of the traffic that the group
+	// receives. With weights 95 and 5, the groups receive 95% and 5% of
+	// the traffic. Zero means that the group receives no traffic.
+	Weight int `yaml:"weight"`
+}
+
+// Mirror contains the parameters of the shadow backend that receives a copy
+// of the requests. The copies are sent asynchronously, after the requests are
+// authorized, and they don't affect the responses to the clients.
+type Mirror struct {
+	// Addresses is a list of server addresses, e.g. 192.168.0.10:8080.
+	// One of them is chosen randomly for each mirrored request.
+	Addresses []string `yaml:"addresses"`
+	// Mode is either HTTP or HTTPS. The default is the backend's mode.
+	Mode string `yaml:"mode,omitempty"`
+	// InsecureSkipVerify disables the verification of the shadow
+	// backend's TLS certificate in HTTPS mode.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// Percent is the percentage of the requests that are mirrored, between
+	// 0 and 100. The default is 100.
+	Percent *float64 `yaml:"percent,omitempty"`
+	// MaxBodySize is the maximum size of a request body that can be
+	// mirrored, in bytes. The body is read before the request is
+	// forwarded to the backend. Requests with larger bodies aren't
+	// mirrored. The default is 1048576.
+	MaxBodySize int64 `yaml:"maxBodySize,omitempty"`
+	// MaxConcurrentRequests is the maximum number of mirrored requests
+	// that can be in flight at the same time. When it is reached, the
+	// requests aren't mirrored. The default is 100.
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests,omitempty"`
+	// Timeout is the maximum duration of a mirrored request. The default
+	// is 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+func (m *Mirror) check(mode string) error {
+	if len(m.Addresses) == 0 {
+		return errors.New("Addresses: must not be empty")
+	}
+	for i, addr := range m.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("Addresses[%d]: %w", i, err)
+		}
+	}
+	if m.Mode == "" {
+		m.Mode = mode
+	}
+	m.Mode = strings.ToUpper(m.Mode)
+	if m.Mode != ModeHTTP && m.Mode != ModeHTTPS {
+		return fmt.Errorf("Mode: value %q must be one of [%s %s]", m.Mode, ModeHTTP, ModeHTTPS)
+	}
+	if m.Percent == nil {
+		v := 100.0
+		m.Percent = &v
+	}
+	if *m.Percent < 0 || *m.Percent > 100 {
+		return errors.New("Percent: value must be between 0 and 100")
+	}
+	if m.MaxBodySize < 0 || m.MaxConcurrentRequests < 0 || m.Timeout < 0 {
+		return errors.New("MaxBodySize, MaxConcurrentRequests, Timeout: values cannot be negative")
+	}
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = 1 << 20
+	}
+	if m.MaxConcurrentRequests == 0 {
+		m.MaxConcurrentRequests = 100
+	}
+	if m.Timeout == 0 {
+		m.Timeout = 10 * time.Second
+	}
+	return nil
+}
+
+// HSTS specifies the value of the Strict-Transport-Security header.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Strict-Transport-Security
+type HSTS struct {
+	// Disabled indicates that the header should not be added.
+	Disabled bool `yaml:"disabled,omitempty"`
+	// MaxAge is how long browsers should remember to only use HTTPS. The
+	// value is rounded down to the second. The default is 30 days.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+	// IncludeSubDomains indicates that the policy also applies to all the
+	// subdomains.
+	IncludeSubDomains bool `yaml:"includeSubDomains,omitempty"`
+	// Preload indicates that the domain can be included in the browsers'
+	// HSTS preload lists. It requires IncludeSubDomains and a MaxAge of
+	// at least one year.
+	// See https://hstspreload.org/
+	Preload bool `yaml:"preload,omitempty"`
+}
+
+// value returns the value of the Strict-Transport-Security header, or an
+// empty string if the header is disabled.
+func (h *HSTS) value() string {
+	if h == nil {
+		return hstsValue
+	}
+	if h.Disabled {
+		return ""
+	}
+	maxAge := h.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultHSTSMaxAge
+	}
+	v := fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if h.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// StaticFiles specifies how local files are served.
+type StaticFiles struct {
+	// IndexFiles is the list of file names to look for, in order, when
+	// a directory is requested. The default is index.html.
+	IndexFiles []string `yaml:"indexFiles,omitempty"`
+	// DirectoryListing indicates that the content of directories that
+	// don't have an index file should be listed. Names that start with a
+	// dot are never listed. By default, these requests are denied.
+	DirectoryListing bool `yaml:"directoryListing,omitempty"`
+	// CacheControl is the value of the Cache-Control header to send with
+	// the files, e.g. "public, max-age=3600". By default, no Cache-Control
+	// header is sent. Range requests and conditional requests with
+	// If-Modified-Since or If-None-Match are always supported.
+	CacheControl string `yaml:"cacheControl,omitempty"`
+}
+
+// Redirect specifies how requests are redirected in REDIRECT mode.
+type Redirect struct {
+	// URL is the location where the requests are redirected. It can be an
+	// absolute URL or an absolute path, and it can contain the following
+	// placeholders:
+	//   {host}  the host name of the request, without the port
+	//   {path}  the path of the request
+	//   {query} the query string of the request, including the leading
+	//           '?', or an empty string
+	//   {uri}   the same as {path}{query}
+	// For example, https://www.{host}{uri} redirects an apex domain to its
+	// www subdomain, and https://new.example.com{uri} redirects all the
+	// requests to a new host name, preserving the path.
+	URL string `yaml:"url"`
+	// StatusCode is the HTTP status code of the redirect responses: 301,
+	// 302, 307, or 308. The default is 301.
+	StatusCode int `yaml:"statusCode,omitempty"`
+}
+
+// check validates the URL template and the status code.
+func (r *Redirect) check() error {
+	switch r.StatusCode {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("StatusCode: invalid value %d", r.StatusCode)
+	}
+	loc := r.expand("example.com", "/path", "?q=1")
+	if strings.ContainsAny(loc, "{}") {
+		return fmt.Errorf("URL: unknown placeholder in %q", r.URL)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return fmt.Errorf("URL: %w", err)
+	}
+	if u.IsAbs() {
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("URL: must be an http or https URL, or an absolute path")
+		}
+	} else if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(loc, "//") {
+		return fmt.Errorf("URL: must be an http or https URL, or an absolute path")
+	}
+	return nil
+}
+
+// ConsoleAuth separates the users of a CONSOLE backend into roles. Admins can
+// use all the endpoints, including the admin API endpoints that change the
+// proxy's state and the debugging endpoints. Viewers can only use the endpoints
+// that show the metrics, the connections, the config, etc. Users who have
+// neither role are denied access. Every request is logged with the user's
+// identity and role.
+//
+// Users are identified by their SSO claims and/or their client certificate.
+// The rules have the same syntax as SSO.ACL and ClientAuth.ACL, e.g.
+// bob@example.com, @example.com, CLAIM:groups=admins, or
+// "SUBJECT:CN=Bob && URI:spiffe://example.com/admin".
+type ConsoleAuth struct {
+	// Admins is a list of rules that match the users with the admin role.
+	Admins []string `yaml:"admins,omitempty"`
+	// Viewers is a list of rules that match the users with the read-only
+	// role.
+	Viewers []string `yaml:"viewers,omitempty"`
+}
+
+// check validates the rules.
+func (ca *ConsoleAuth) check() error {
+	if len(ca.Admins) == 0 {
+		return errors.New("Admins: at least one rule is required")
+	}
+	if err := validateACL(ca.Admins); err != nil {
+		return fmt.Errorf("Admins%w", err)
+	}
+	if err := validateACL(ca.Viewers); err != nil {
+		return fmt.Errorf("Viewers%w", err)
+	}
+	return nil
+}
+
+// ConsoleDebug enables the debugging endpoints of a CONSOLE backend. They
+// are all disabled by default.
+type ConsoleDebug struct {
+	// PProf enables the /debug/pprof endpoints, which return CPU, heap,
+	// goroutine, etc profiles.
+	PProf bool `yaml:"pprof,omitempty"`
+	// Trace enables the /debug/pprof/trace endpoint, which captures an
+	// execution trace with runtime/trace, e.g. for 5 seconds with
+	// ?seconds=5.
+	Trace bool `yaml:"trace,omitempty"`
+	// Expvar enables the /debug/vars endpoint, which returns the
+	// exported variables, e.g. the memory statistics, in JSON format.
+	Expvar bool `yaml:"expvar,omitempty"`
+	// Runtime enables the /debug/runtime endpoints. /debug/runtime
+	// returns the runtime settings and statistics, /debug/runtime/set
+	// changes GOMAXPROCS, the GC percent (GOGC), and the memory limit
+	// (GOMEMLIMIT), and /debug/runtime/gc runs a garbage collection and
+	// returns as much memory as possible to the operating system. The
+	// settings changed with /debug/runtime/set are not persisted.
+	Runtime bool `yaml:"runtime,omitempty"`
+}
+
+// StartTLS specifies how the proxy upgrades the connections to the backend
+// servers to TLS with STARTTLS, in TLS mode. The clients use implicit TLS,
+// e.g. SMTPS on port 465 or LDAPS on port 636, and the backend servers only
+// need to support STARTTLS on their plaintext port.
+//
+//	CLIENT --TLS--> PROXY --PLAINTEXT+STARTTLS--> BACKEND SERVER
+type StartTLS struct {
+	// Protocol is the application protocol of the backend servers: smtp,
+	// imap, pop3, or ldap. For smtp, imap, and pop3, the server's
+	// greeting is sent to the client after the TLS handshake with the
+	// backend, as if the backend used implicit TLS.
+	Protocol string `yaml:"protocol"`
+	// EHLOName is the host name that the proxy sends with the EHLO command
+	// when Protocol is smtp. The default is localhost.
+	EHLOName string `yaml:"ehloName,omitempty"`
+}
+
+// check validates the protocol.
+func (st *StartTLS) check() error {
+	if !slices.Contains(validStartTLSProtocols, st.Protocol) {
+		return fmt.Errorf("Protocol: value %q must be one of %v", st.Protocol, validStartTLSProtocols)
+	}
+	if st.EHLOName != "" && st.Protocol != StartTLSSMTP {
+		return fmt.Errorf("EHLOName: only valid when Protocol is %s", StartTLSSMTP)
+	}
+	if strings.ContainsAny(st.EHLOName, " \r\n") {
+		return fmt.Errorf("EHLOName: invalid value %q", st.EHLOName)
+	}
+	return nil
+}
+
+// Database specifies how database connections are forwarded in POSTGRES and
+// MYSQL modes.
+type Database struct {
+	// Routes send PostgreSQL connections to different addresses based on
+	// the database and user names of the client's startup message, e.g.
+	// to send each database to its own server. The routes are tried in
+	// order, and the backend's Addresses are used when none match. Routes
+	// are only valid in POSTGRES mode. MySQL clients only send their user
+	// name after the server's greeting, which is needed to authenticate.
+	Routes []*DatabaseRoute `yaml:"routes,omitempty"`
+	// ForwardTLS indicates that the connections to the backend servers
+	// use TLS, after an SSLRequest, in POSTGRES mode. Set
+	// ForwardServerName, ForwardRootCAs, and/or InsecureSkipVerify to
+	// verify the identity of the servers. In MYSQL mode, the connections
+	// to the backend servers always use TLS.
+	ForwardTLS bool `yaml:"forwardTLS,omitempty"`
+}
+
+// DatabaseRoute sends PostgreSQL connections for some databases and/or users
+// to a different set of addresses.
+type DatabaseRoute struct {
+	// Database is the name of the database to match. An empty value
+	// matches all the databases.
+	Database string `yaml:"database,omitempty"`
+	// User is the name of the user to match. An empty value matches all
+	// the users.
+	User string `yaml:"user,omitempty"`
+	// Addresses is a list of server addresses where the matching
+	// connections are forwarded, according to the backend's LoadBalance
+	// policy.
+	Addresses []string `yaml:"addresses"`
+}
+
+// check validates the routes.
+func (db *Database) check(mode string) error {
+	if len(db.Routes) > 0 && mode != ModePostgres {
+		return fmt.Errorf("Routes: only valid in mode %s", ModePostgres)
+	}
+	if db.ForwardTLS && mode != ModePostgres {
+		return fmt.Errorf("ForwardTLS: only valid in mode %s", ModePostgres)
+	}
+	for i, r := range db.Routes {
+		if r.Database == "" && r.User == "" {
+			return fmt.Errorf("Routes[%d]: Database or User must be set", i)
+		}
+		if len(r.Addresses) == 0 {
+			return fmt.Errorf("Routes[%d].Addresses: at least one address is required", i)
+		}
+	}
+	return nil
+}
+
+// ForwardProxy specifies how the forward proxy is used in PROXY and SOCKS5
+// modes.
+//
+// Clients are identified by their TLS client certificate, when ClientAuth is
+// set, and/or with a user name and password: in the Proxy-Authorization
+// header (Basic scheme) in PROXY mode, or with the SOCKS5 username/password
+// authentication method (RFC 1929) in SOCKS5 mode.
+type ForwardProxy struct {
+	// Users is a list of users who can authenticate with a user name and
+	// password.
+	Users []*ForwardProxyUser `yaml:"users,omitempty"`
+	// Rules determine which destinations the clients can reach. A
+	// CONNECT request is allowed when at least one rule matches both the
+	// client and the destination.
+	Rules []*ForwardProxyRule `yaml:"rules"`
+}
+
+// ForwardProxyUser is a user of the forward proxy.
+type ForwardProxyUser struct {
+	// Name is the user name.
+	Name string `yaml:"name"`
+	// PasswordHash is the bcrypt hash of the user's password, e.g. from
+	// htpasswd -nBC 10 <name>
+	PasswordHash string `yaml:"passwordHash"`
+}
+
+// ForwardProxyRule allows some clients to reach some destinations.
+type ForwardProxyRule struct {
+	// ACL specifies which clients the rule applies to. A nil value
+	// matches all the authenticated clients. Otherwise, the value is a
+	// list of rules with the same syntax as ClientAuth.ACL, plus
+	// USER:<name> for the users authenticated with a user name and
+	// password.
+	ACL *[]string `yaml:"acl,omitempty"`
+	// Destinations is a list of host:port patterns, e.g.
+	// "*.example.com:443" or "192.168.0.0/16:*". The host can be a host
+	// name, a domain wildcard like *.example.com, an IP address, a CIDR,
+	// or * to match any host. The port can be a number, or * to match any
+	// port. Host names and domain wildcards only match host names, and IP
+	// addresses and CIDRs only match IP addresses. Host names are matched
+	// as requested by the client, before they are resolved.
+	Destinations []string `yaml:"destinations"`
+	// AllowUDP indicates that the clients can also send UDP datagrams to
+	// the destinations with CONNECT-UDP (RFC 9298) over HTTP/3, in PROXY
+	// mode. By default, only TCP is allowed.
+	AllowUDP bool `yaml:"allowUDP,omitempty"`
+
+	dests []*destinationPattern
+}
+
+// check validates the users and the rules.
+func (fp *ForwardProxy) check() error {
+	users := make(map[string]bool)
+	for i, u := range fp.Users {
+		if u.Name == "" || strings.Contains(u.Name, ":") {
+			return fmt.Errorf("Users[%d].Name: invalid name %q", i, u.Name)
+		}
+		if users[u.Name] {
+			return fmt.Errorf("Users[%d].Name: duplicate name %q", i, u.Name)
+		}
+		users[u.Name] = true
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return fmt.Errorf("Users[%d].PasswordHash: %w", i, err)
+		}
+	}
+	if len(fp.Rules) == 0 {
+		return errors.New("Rules: at least one rule is required")
+	}
+	for i, r := range fp.Rules {
+		if r.ACL != nil {
+			if err := validateACL(*r.ACL); err != nil {
+				return fmt.Errorf("Rules[%d].ACL%w", i, err)
+			}
+		}
+		if len(r.Destinations) == 0 {
+			return fmt.Errorf("Rules[%d].Destinations: at least one destination is required", i)
+		}
+		r.dests = nil
+		for j, d := range r.Destinations {
+			dp, err := parseDestinationPattern(d)
+			if err != nil {
+				return fmt.Errorf("Rules[%d].Destinations[%d]: %w", i, j, err)
+			}
+			r.dests = append(r.dests, dp)
+		}
+	}
+	return nil
+}
+
+func (sf *StaticFiles) indexFiles() []string {
+	if sf == nil || len(sf.IndexFiles) == 0 {
+		return []string{"index.html"}
+	}
+	return sf.IndexFiles
+}
+
+// HeaderPolicy specifies how to modify HTTP request and response headers.
+type HeaderPolicy struct {
+	// Request modifies the headers of the requests that are forwarded
+	// to the backend servers.
+	Request *HeaderRules `yaml:"request,omitempty"`
+	// Response modifies the headers of the responses from the backend
+	// servers.
+	Response *HeaderRules `yaml:"response,omitempty"`
+}
+
+// HeaderRules specifies headers to remove, set, and add. The rules are applied
+// in that order.
+type HeaderRules struct {
+	// Remove is a list of header names to remove.
+	Remove []string `yaml:"remove,omitempty"`
+	// Set is a map of header names to values. The headers are set to
+	// these values, replacing any existing values.
+	Set map[string]string `yaml:"set,omitempty"`
+	// Add is a map of header names to values. The headers are set to
+	// these values only when they don't already exist, i.e. the backend
+	// server's values take precedence.
+	Add map[string]string `yaml:"add,omitempty"`
+}
+
+// apply applies the rules to h.
+func (r *HeaderRules) apply(h http.Header) {
+	if r == nil {
+		return
+	}
+	for _, k := range r.Remove {
+		h.Del(k)
+	}
+	for k, v := range r.Set {
+		h.Set(k, v)
+	}
+	for k, v := range r.Add {
+		if h.Get(k) == "" {
+			h.Set(k, v)
+		}
+	}
+}
+
+// check validates the header names and values.
+func (r *HeaderRules) check() error {
+	if r == nil {
 		return nil
 	}
-	b, _ := yaml.Marshal(cfg)
-	return b
-}
-
-func (cfg *Config) equal(other *Config) bool {
-	a := cfg.serialize()
-	b := other.serialize()
-	return bytes.Equal(a, b)
-}
-
-func (cfg *Config) clone() *Config {
-	b := cfg.serialize()
-	var out Config
-	yaml.Unmarshal(b, &out)
-	return &out
-}
+	for _, k := range r.Remove {
+		if !httpguts.ValidHeaderFieldName(k) {
+			return fmt.Errorf("Remove: invalid header name %q", k)
+		}
+	}
+	for name, m := range map[string]map[string]string{"Set": r.Set, "Add": r.Add} {
+		for k, v := range m {
+			if !httpguts.ValidHeaderFieldName(k) {
+				return fmt.Errorf("%s: invalid header name %q", name, k)
+			}
+			if !httpguts.ValidHeaderFieldValue(v) {
+				return fmt.Errorf("%s[%s]: invalid header value %q", name, k, v)
+			}
+		}
+	}
+	return nil
+}
+
+// HTTPTransport specifies how connections to the backend servers are pooled
+// and reused. Idle connections are shared by all the requests that go to the
+// same server name and path override.
+type HTTPTransport struct {
+	// MaxIdleConns is the maximum number of idle connections to keep open
+	// across all the backend servers. The default is 100.
+	MaxIdleConns int `yaml:"maxIdleConns,omitempty"`
+	// MaxIdleConnsPerHost is the maximum number of idle connections to
+	// keep open for each server name and path override. The default is 2.
+	MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost,omitempty"`
+	// MaxConnsPerHost limits the total number of connections for each
+	// server name and path override, including connections that are in
+	// use. Requests wait for a connection when the limit is reached. The
+	// default is 0, i.e. no limit.
+	MaxConnsPerHost int `yaml:"maxConnsPerHost,omitempty"`
+	// IdleConnTimeout is the amount of time an idle connection remains in
+	// the pool before it is closed. The default is 10 seconds.
+	IdleConnTimeout time.Duration `yaml:"idleConnTimeout,omitempty"`
+	// HTTP2ReadIdleTimeout is the amount of time after which a health
+	// check is sent on an idle HTTP/2 connection, when BackendProto is h2.
+	// The default is 10 seconds.
+	HTTP2ReadIdleTimeout time.Duration `yaml:"http2ReadIdleTimeout,omitempty"`
+}
+
+// HTTPLimits specifies the limits of the internal HTTP servers that receive
+// the clients' requests. The timeouts apply to HTTP/1 and HTTP/2.
+type HTTPLimits struct {
+	// MaxHeaderBytes is the maximum size of the request headers. The
+	// default is 1 MB.
+	MaxHeaderBytes int `yaml:"maxHeaderBytes,omitempty"`
+	// MaxBodyBytes is the maximum size of the request bodies. Larger
+	// requests get a 413 error. The default is no limit.
+	MaxBodyBytes int64 `yaml:"maxBodyBytes,omitempty"`
+	// MaxConcurrentRequests is the maximum number of requests that are
+	// handled concurrently. Requests above this limit get a 503 error.
+	// The default is no limit.
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests,omitempty"`
+	// ReadHeaderTimeout is the amount of time allowed to read the request
+	// headers. The default is 30 seconds.
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout,omitempty"`
+	// ReadTimeout is the maximum duration for reading the entire request,
+	// including the body. The default is 24 hours.
+	ReadTimeout time.Duration `yaml:"readTimeout,omitempty"`
+	// WriteTimeout is the maximum duration before timing out writes of
+	// the response. The default is 24 hours.
+	WriteTimeout time.Duration `yaml:"writeTimeout,omitempty"`
+	// IdleTimeout is the maximum amount of time to wait for the next
+	// request on a keep-alive connection. The default is 30 seconds.
+	IdleTimeout time.Duration `yaml:"idleTimeout,omitempty"`
+}
+
+// EarlyData is the policy for the HTTP requests that are sent in TLS 1.3
+// early data (0-RTT). Early data saves a round trip when a client resumes a
+// session, but it can be replayed by an attacker. The requests that aren't
+// accepted get a 425 (Too Early) response, and the clients send them again
+// after the handshake (RFC 8470).
+//
+// A request is sent in early data when it arrives on a QUIC connection
+// before the end of the handshake, or when it has the Early-Data: 1 header,
+// which is added by the TLS terminators that accept early data in front of
+// the proxy. Note that the proxy itself doesn't accept early data on its own
+// TLS and QUIC listeners.
+type EarlyData struct {
+	// Enable specifies whether any requests are accepted in early data.
+	// The default is true.
+	Enable *bool `yaml:"enable,omitempty"`
+	// Methods is the list of HTTP methods that are accepted in early
+	// data. The default is GET, HEAD, and OPTIONS. Other methods, e.g.
+	// POST, are not idempotent and should not be replayed.
+	Methods []string `yaml:"methods,omitempty"`
+}
+
+// HostRouting is the policy for the HTTP requests whose Host header doesn't
+// match the server name of their TLS connection. Clients can send such
+// requests on purpose, or reuse a connection for multiple server names when
+// the certificate is valid for all of them (HTTP/2 connection coalescing).
+//
+// Without HostRouting, only HTTP and HTTPS backends check the Host header, and
+// they accept any of their server names. With HostRouting, the requests for
+// the server names in RouteTo are handled by their backends, and the other
+// requests that don't match are rewritten or rejected with status 421
+// (Misdirected Request), after which the clients open a new connection.
+type HostRouting struct {
+	// MatchSNI requires the Host header to be the server name of the TLS
+	// connection. By default, any of the backend's server names is
+	// accepted.
+	MatchSNI bool `yaml:"matchSNI,omitempty"`
+	// Rewrite replaces the Host header of the requests that don't match
+	// with the server name of the TLS connection, instead of rejecting
+	// them.
+	Rewrite bool `yaml:"rewrite,omitempty"`
+	// RouteTo is a list of server names of other backends, e.g. backends
+	// that share a certificate with this one. The requests with these
+	// names in their Host header are handled by these backends, after
+	// checking their IP address restrictions. The other backends must be
+	// in HTTP, HTTPS, CONSOLE, LOCAL, WEBSOCKET, or REDIRECT mode, and
+	// they can't have ClientAuth.
+	RouteTo []string `yaml:"routeTo,omitempty"`
+}
+
+// BWLimit is a named bandwidth limit configuration.
+type BWLimit struct {
+	// Name is the name of the group.
+	Name string `yaml:"name"`
+	// Ingress is the ingress limit, in bytes per second.
+	Ingress float64 `yaml:"ingress"`
+	// Egress is the engress limit, in bytes per second.
+	Egress float64 `yaml:"egress"`
+}
+
+// OnDemandCertificates limits the certificates that a backend can request
+// on demand.
+type OnDemandCertificates struct {
+	// MaxPerWeek is the maximum number of server names that can get a
+	// certificate on demand in any 7-day period.
+	MaxPerWeek int `yaml:"maxPerWeek"`
+}
+
+// Backend encapsulates the data of one backend.
+type Backend struct {
+	// ServerNames is the list of all the server names for this service,
+	// e.g. example.com, www.example.com.
+	// Internationalized names are converted to ascii using the IDNA2008
+	// lookup standard as implemented by golang.org/x/net/idna.
+	//
+	// A wildcard name, e.g. *.example.com, matches any direct subdomain
+	// that isn't otherwise matched by another backend. The certificate
+	// for wildcard names should be obtained with a DNS provider (see
+	// DNSProviders). Otherwise, with OnDemandCertificates, each subdomain
+	// gets its own certificate.
+	//
+	// The catch-all name, "*", matches all the server names that aren't
+	// matched by any other backend, including connections without SNI
+	// when DefaultServerName isn't set. Instead of responding with an
+	// unrecognized_name alert, the proxy sends these connections to this
+	// backend, e.g. to show a friendly error page or to observe scanners.
+	// Unless Mode is TLSPASSTHROUGH, CertFile and KeyFile must be set.
+	// They are the default certificate presented to these clients.
+	ServerNames []string `yaml:"serverNames"`
+	// ServerNameRegexps is an optional list of regular expressions that
+	// match server names for this service, e.g. [a-z]+-[0-9]+\.example\.com
+	// The expressions must match the whole server name.
+	//
+	// Exact server names take precedence over wildcard names, which take
+	// precedence over regular expressions. Regular expressions are tried
+	// in the order that the backends are listed in the config. The
+	// matching server names must be covered by a DNS provider or by
+	// CertFile, unless OnDemandCertificates is set.
+	ServerNameRegexps []string `yaml:"serverNameRegexps,omitempty"`
+	// OnDemandCertificates allows the server names that match a wildcard
+	// name or ServerNameRegexps, and that aren't covered by a DNS
+	// provider or by CertFile, to get their own certificates from the
+	// ACME CA when a client first connects with them. Without it, the
+	// TLS handshakes for these names fail, so that clients can't make
+	// the proxy request certificates for arbitrary names.
+	OnDemandCertificates *OnDemandCertificates `yaml:"onDemandCertificates,omitempty"`
+	// CertFile and KeyFile optionally specify the certificate chain and
+	// private key to use for this backend's server names, instead of
+	// getting certificates from Let's Encrypt. The values are either
+	// file names (absolute paths) or PEM-encoded data. The files are
+	// reloaded automatically when they change.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// KeyStore and KeyID specify that the private key of CertFile is
+	// KeyID in one of the KeyStores, instead of KeyFile.
+	KeyStore string `yaml:"keyStore,omitempty"`
+	KeyID    string `yaml:"keyId,omitempty"`
+	// ClientAuth specifies that the TLS client's identity must be verified.
+	ClientAuth *ClientAuth `yaml:"clientAuth,omitempty"`
+	// AllowIPs specifies a list of IP network addresses to allow, in CIDR
+	// format, e.g. 192.168.0.0/24.
+	//
+	// The rules are applied in this order:
+	// * If DenyIPs is specified, the remote addr must not match any of the
+	//   IP addresses in the list.
+	// * If AllowIPs is specified, the remote addr must match at least one
+	//   of the IP addresses on the list.
+	//
+	// If an IP address is blocked, the client is rejected as if it
+	// connected to an unknown server name. See RejectPolicy.
+	AllowIPs *[]string `yaml:"allowIPs,omitempty"`
+	// DenyIPs specifies a list of IP network addresses to deny, in CIDR
+	// format, e.g. 192.168.0.0/24. See AllowIPs.
+	DenyIPs *[]string `yaml:"denyIPs,omitempty"`
+	// AllowIPLists is a list of IP list names, from the ipLists section,
+	// to allow in addition to AllowIPs. When AllowIPLists is set, the
+	// remote addr must match AllowIPs or one of the lists.
+	AllowIPLists []string `yaml:"allowIPLists,omitempty"`
+	// DenyIPLists is a list of IP list names, from the ipLists section,
+	// to deny in addition to DenyIPs.
+	DenyIPLists []string `yaml:"denyIPLists,omitempty"`
+	// AllowFingerprints is a list of JA3 or JA4 TLS client fingerprints.
+	// When it is set, only clients with one of these fingerprints can
+	// connect. JA3 fingerprints are MD5 hashes in hex, e.g.
+	// 773906b0efdefa24a7f2b8eb6985bf37. JA4 fingerprints look like
+	// t13d1516h2_8daaf6152771_e5627efa2ab1. The fingerprints of incoming
+	// connections are logged and shown on the CONSOLE backend.
+	AllowFingerprints []string `yaml:"allowFingerprints,omitempty"`
+	// DenyFingerprints is a list of JA3 or JA4 TLS client fingerprints to
+	// block, e.g. from known scanners or bots. See AllowFingerprints.
+	DenyFingerprints []string `yaml:"denyFingerprints,omitempty"`
+	// SSO indicates that the backend requires user authentication, and
+	// specifies which identity provider to use and who's allowed to
+	// connect.
+	SSO *BackendSSO `yaml:"sso,omitempty"`
+	// JWTAuth validates the JSON Web Tokens in the Authorization header
+	// of the requests, in HTTP and HTTPS modes, e.g. for API backends.
+	JWTAuth *JWTAuth `yaml:"jwtAuth,omitempty"`
+	// ExportJWKS is the path where to export the proxy's JSON Web Key Set.
+	// This should only be set when SSO is enabled and JSON Web Tokens are
+	// generated for the users to authenticate with the backends.
+	ExportJWKS string `yaml:"exportJwks,omitempty"`
+	// WhoAmI enables the /.tlsproxy/whoami endpoint, which returns what
+	// the proxy knows about the client's connection in JSON format: the
+	// client's IP address, the TLS version, cipher suite, ALPN protocol,
+	// server name, client certificate, and the names of the IP lists that
+	// contain the client's IP address, e.g. per-country lists for geo
+	// information. It is useful to debug client configurations. This
+	// field is only valid in modes HTTP, HTTPS, and LOCAL.
+	WhoAmI bool `yaml:"whoami,omitempty"`
+	// ALPNProtos specifies the list of ALPN procotols supported by this
+	// backend. The ACME acme-tls/1 protocol doesn't need to be specified.
+	//
+	// The default values are:
+	//  * [h2, http/1.1] when QUIC is not enabled
+	//  * [h3, h2, http/1.1] when QUIC is enabled and Mode is one of:
+	//      HTTP, HTTPS, QUIC, LOCAL, CONSOLE
+	//
+	// Set the value to an empty slice [] to disable ALPN.
+	// The negotiated protocol is forwarded to the backends that use TLS.
+	//
+	// https://www.iana.org/assignments/tls-extensiontype-values/tls-extensiontype-values.xhtml#alpn-protocol-ids
+	ALPNProtos *[]string `yaml:"alpnProtos,flow,omitempty"`
+	// BackendProto specifies which protocol to use when forwarding an HTTPS
+	// request to the backend. This field is only valid in modes HTTP and
+	// HTTPS.
+	// The value should be an ALPN protocol, e.g.: http/1.1, h2, or h3. The default is http/1.1.
+	// If the value is set explicitly to "", the same protocol used by the
+	// client will be used with the backend.
+	// In HTTP mode, h2 is used with prior knowledge, i.e. h2c without
+	// upgrade. The value h2c can also be used explicitly in HTTP mode.
+	// gRPC requests always use HTTP/2, unless the value is h3, so that
+	// gRPC services work behind HTTP backends with the default value.
+	BackendProto *string `yaml:"backendProto,omitempty"`
+	// Mode controls how the proxy communicates with the backend.
+	// - PLAINTEXT: Use a plaintext, non-encrypted, TCP connection. This is
+	// the the default mode.
+	//        CLIENT --TLS--> PROXY ----> BACKEND SERVER
+	// - TLS: Open a new TLS connection. Set ForwardServerName, ForwardRootCAs,
+	//     and/or InsecureSkipVerify to verify the identity of the server.
+	//        CLIENT --TLS--> PROXY --TLS--> BACKEND SERVER
+	// - TLSPASSTHROUGH: Forward the whole TLS connection to the backend.
+	//     In this mode, the proxy terminates the TCP connection, but not
+	//     the TLS connection. The proxy uses the information from the TLS
+	//     ClientHello message to route the TLS data to the right backend.
+	//     It cannot see the plaintext data, and it cannot enforce client
+	//     authentication & authorization.
+	//                +-TCP-PROXY-TCP-+
+	//        CLIENT -+------TLS------+-> BACKEND SERVER
+	// - QUIC: Open a new QUIC connection. If the incoming connection is
+	//     TLS, forward the data on a single bidirectional QUIC stream. If
+	//     the incoming connection is QUIC, forward all streams.
+	//        CLIENT --TLS---> PROXY --QUIC STREAM--> BACKEND SERVER
+	//     Or
+	//        CLIENT --QUIC--> PROXY --QUIC--> BACKEND SERVER
+	// - HTTP: Parses the incoming connection as HTTPS and forwards the
+	//     requests to the backends as HTTP requests.
+	//        CLIENT --HTTPS--> PROXY --HTTP--> BACKEND SERVER
+	// - HTTPS: Parses the incoming connection as HTTPS and forwards the
+	//     requests to the backends as HTTPS requests.
+	//        CLIENT --HTTPS--> PROXY --HTTPS--> BACKEND SERVER
+	// - LOCAL: Behaves exactly like HTTP and HTTPS without backend
+	//     addresses. This mode is intended for local handlers like Oauth2
+	//     redirects.
+	//        CLIENT --HTTPS--> PROXY
+	// - CONSOLE: Indicates that this backend is handled by the proxy itself
+	//     to report its status and metrics. It is strongly recommended
+	//     to use it with ClientAuth and ACL. Otherwise, information from
+	//     the proxy's configuration can be leaked to anyone who knows the
+	//     backend's server name.
+	//        CLIENT --TLS--> PROXY CONSOLE
+	// - WEBSOCKET: Accepts WebSocket connections and forwards the content
+	//     of the messages to the backends as a TCP stream. This lets
+	//     browsers reach TCP services. Cross-origin requests are rejected.
+	//        CLIENT --HTTPS+WEBSOCKET--> PROXY --TCP--> BACKEND SERVER
+	// - REDIRECT: Indicates that the proxy responds to all the requests
+	//     with a redirect to another URL, as specified by Redirect. This
+	//     backend doesn't have any addresses. It is useful to redirect an
+	//     apex domain to its www subdomain, or a host name that moved.
+	//        CLIENT --HTTPS--> PROXY
+	// - QUICPASSTHROUGH: Like TLSPASSTHROUGH, but for QUIC connections
+	//     received on QUICPassthroughAddr. The UDP datagrams are forwarded
+	//     to the backends, whose addresses are UDP addresses. The backends
+	//     need to have their own TLS certificates. Clients that change
+	//     address during the connection, e.g. with connection migration,
+	//     aren't supported.
+	//        CLIENT --QUIC--> PROXY --UDP--> BACKEND SERVER
+	//
+	// QUIC
+	//
+	// If the incoming connection is QUIC and Mode is TCP or TLS, each QUIC
+	// stream is treated like an incoming TLS connection.
+	//                               ,--STREAM1--> BACKEND SERVER
+	//        CLIENT --QUIC--> PROXY +--STREAM2--> BACKEND SERVER
+	//                               `--STREAM3--> BACKEND SERVER
+	// If Mode is QUIC, all streams are forwards to the backend server.
+	//        CLIENT --QUIC--> PROXY --QUIC--> BACKEND SERVER
+	Mode string `yaml:"mode"`
+	// DocumentRoot indicates local files should be served from this
+	// directory. This option is only valid when Addresses is empty.
+	DocumentRoot string `yaml:"documentRoot,omitempty"`
+	// StaticFiles controls how the files in DocumentRoot, and in the
+	// DocumentRoot of PathOverrides, are served.
+	StaticFiles *StaticFiles `yaml:"staticFiles,omitempty"`
+	// Redirect specifies where requests are redirected. It is required,
+	// and only valid, when Mode is REDIRECT.
+	Redirect *Redirect `yaml:"redirect,omitempty"`
+	// ForwardProxy specifies who can use the forward proxy, and which
+	// destinations they can reach. It is required, and only valid, when
+	// Mode is PROXY or SOCKS5.
+	ForwardProxy *ForwardProxy `yaml:"forwardProxy,omitempty"`
+	// Database specifies how the connections are forwarded in POSTGRES
+	// and MYSQL modes.
+	Database *Database `yaml:"database,omitempty"`
+	// ConsoleAuth specifies who can view the console, and who can change
+	// the proxy's state with the admin API, when Mode is CONSOLE. The
+	// users are authenticated with SSO and/or ClientAuth. The admin API
+	// and the debugging endpoints are only available with ConsoleAuth.
+	ConsoleAuth *ConsoleAuth `yaml:"consoleAuth,omitempty"`
+	// ConsoleDebug enables the debugging endpoints of the console, when
+	// Mode is CONSOLE. ConsoleAuth must be set, and only admins can use
+	// them.
+	ConsoleDebug *ConsoleDebug `yaml:"consoleDebug,omitempty"`
+	// BWLimit is the name of the bandwidth limit policy to apply to this
+	// backend. All backends using the same policy are subject to common
+	// limits.
+	BWLimit string `yaml:"bwLimit,omitempty"`
+	// Addresses is a list of server addresses where requests are forwarded.
+	// When more than one address are specified, requests are distributed
+	// according to LoadBalance.
+	Addresses []string `yaml:"addresses,omitempty"`
+	// AddressDiscovery gets the server addresses dynamically from a DNS
+	// SRV record or from a Consul service, instead of Addresses.
+	AddressDiscovery *AddressDiscovery `yaml:"addressDiscovery,omitempty"`
+	// AddressGroups splits the traffic between groups of server addresses,
+	// instead of Addresses, e.g. to send 5% of the traffic to a canary
+	// deployment. A group is chosen randomly, according to the weights,
+	// for each HTTP request, or for each connection in the other modes.
+	// LoadBalance picks an address in the group. The weights can be
+	// changed with the admin API's /api/traffic-split/weight endpoint.
+	AddressGroups []*AddressGroup `yaml:"addressGroups,omitempty"`
+	// LoadBalance is the policy used to pick an address when there are
+	// more than one. Valid values are:
+	//   - round-robin: each address is used in turn (default).
+	//   - least-connections: the address with the fewest open connections
+	//     from this backend is used.
+	//   - consistent-hash: the address is chosen based on the client's IP
+	//     address, such that the same client uses the same address as long
+	//     as it is available.
+	// If the connection to the chosen address fails, the other addresses
+	// are tried in order of preference. The policy also applies to
+	// PathOverrides.
+	LoadBalance string `yaml:"loadBalance,omitempty"`
+	// InsecureSkipVerify disabled the verification of the backend server's
+	// TLS certificate. See https://pkg.go.dev/crypto/tls#Config
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// ForwardRateLimit specifies how fast requests can be forwarded to the
+	// backend servers. It applies to forwarding connections, and to
+	// forwarding HTTP requests. The default value is 5 requests per second.
+	ForwardRateLimit int `yaml:"forwardRateLimit"`
+	// ForwardServerName is the ServerName to send in the TLS handshake with
+	// the backend server. It is also used to verify the server's identify.
+	// This is particularly useful when the addresses use IP addresses
+	// instead of hostnames.
+	ForwardServerName string `yaml:"forwardServerName,omitempty"`
+	// ForwardALPNProtos is the list of ALPN protocols to offer in the TLS
+	// handshake with the backend server in TLS and QUIC modes. By default,
+	// the proxy offers the protocol that was negotiated with the client,
+	// if any. An empty list means that no protocols are offered.
+	ForwardALPNProtos *[]string `yaml:"forwardAlpnProtos,flow,omitempty"`
+	// ForwardRootCAs a list of:
+	// - CA names defined in the PKI section,
+	// - File names that contain PEM-encoded certificates, or
+	// - PEM-encoded certificates.
+	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
+	// StartTLS specifies that the connections to the backend servers start
+	// in plaintext and are upgraded to TLS with STARTTLS. It is only valid
+	// when Mode is TLS.
+	StartTLS *StartTLS `yaml:"startTLS,omitempty"`
+	// ForwardClientCert specifies the client certificate to present to
+	// the backend servers when the connection to the backend uses TLS,
+	// i.e. in TLS, HTTPS, and QUIC modes, including PathOverrides. By
+	// default, the proxy presents the same certificate that it uses for
+	// the server name of the incoming connection.
+	ForwardClientCert *ForwardClientCert `yaml:"forwardClientCert,omitempty"`
+	// ForwardTimeout is the connection timeout to backend servers. If
+	// Addresses contains multiple addresses, this timeout indicates how
+	// long to wait before trying the next address in the list. The default
+	// value is 30 seconds.
+	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
+	// DialSourceAddress is the local IP address that the connections to
+	// the backend servers originate from, e.g. on multi-homed hosts or
+	// with policy routing. It is not supported in QUIC mode, and it isn't
+	// used with a DialFunc.
+	DialSourceAddress string `yaml:"dialSourceAddress,omitempty"`
+	// DialInterface is the name of the network interface, or VRF device,
+	// that the connections to the backend servers are bound to, e.g.
+	// eth1. It is only supported on Linux, and it may require the
+	// CAP_NET_RAW capability. It is not supported in QUIC mode, and it
+	// isn't used with a DialFunc.
+	DialInterface string `yaml:"dialInterface,omitempty"`
+	// DialAddressFamily controls which addresses are used when a backend
+	// server's host name has both IPv6 and IPv4 addresses. Valid values
+	// are ipv6-first (default), ipv4-first, ipv6-only, and ipv4-only.
+	// The connection attempts alternate between the two families, per
+	// RFC 8305 (Happy Eyeballs), and the first connection that is
+	// established is used. With DialSourceAddress, only the addresses of
+	// its family are used.
+	DialAddressFamily string `yaml:"dialAddressFamily,omitempty"`
+	// DialAttemptDelay is how long to wait for a connection attempt
+	// before starting the next one in parallel, when a backend server's
+	// host name has multiple addresses. The default is 250ms.
+	DialAttemptDelay time.Duration `yaml:"dialAttemptDelay,omitempty"`
+	// Resolver specifies the DNS servers that resolve the host names of
+	// the backend servers, and of the AddressDiscovery SRV record,
+	// instead of the system resolver, e.g. for split-horizon DNS. The
+	// answers are cached for their TTL.
+	Resolver *DNSResolver `yaml:"resolver,omitempty"`
+	// PathOverrides specifies different backend parameters for some path
+	// prefixes, and optionally some HTTP methods. This allows one server
+	// name to front multiple services, e.g. /api/ and /static/.
+	// Paths are matched by prefix in the order that they are listed here.
+	PathOverrides []*PathOverride `yaml:"pathOverrides,omitempty"`
+	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
+	// value is the version of the protocol to use, either v1 or v2. With
+	// v2, the server name and the negotiated ALPN protocol are also sent
+	// as TLVs. The PROXY protocol is not supported in QUIC mode.
+	// By default, the proxy protocol is not enabled.
+	// See https://github.com/haproxy/haproxy/blob/master/doc/proxy-protocol.txt
+	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
+	// SanitizePath indicates that the request's path should be sanitized
+	// before forwarding the request to the backend. The default is true.
+	// The only reason to set this field is if the backend service somehow
+	// depends on the unsanitized version of the path.
+	//
+	// Examples:
+	//   // -> /
+	//   /. -> /
+	//   /foo/../bar -> /bar
+	//   /../../ -> /
+	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
+	// ForwardedHeaders controls the headers that tell the backend about
+	// the original client request in HTTP and HTTPS modes. By default,
+	// X-Forwarded-For is set to the client's IP address, and the other
+	// headers are forwarded unchanged.
+	ForwardedHeaders *ForwardedHeaders `yaml:"forwardedHeaders,omitempty"`
+	// HSTS controls the Strict-Transport-Security header that is added to
+	// the responses from the backend servers in HTTP and HTTPS modes,
+	// unless the backend server sets it. By default, the header is
+	// max-age=2592000 (30 days).
+	HSTS *HSTS `yaml:"hsts,omitempty"`
+	// HeaderPolicy modifies the headers of the requests that are forwarded
+	// to the backend servers, and of the responses that are sent back to
+	// the clients, in HTTP and HTTPS modes, e.g. to add a
+	// Content-Security-Policy, X-Frame-Options, Referrer-Policy, or CORS
+	// headers.
+	HeaderPolicy *HeaderPolicy `yaml:"headerPolicy,omitempty"`
+	// ResponseCache enables a shared HTTP cache, as specified in RFC 9111,
+	// for the responses to GET requests in HTTP and HTTPS modes. The
+	// responses are stored only when the backend servers allow it with
+	// their Cache-Control and Expires headers, or when TTLOverrides apply.
+	// The responses to requests with credentials, e.g. an Authorization
+	// header, cookies, or a client certificate, are stored only when
+	// they are explicitly public, with public, s-maxage, or
+	// must-revalidate.
+	ResponseCache *ResponseCache `yaml:"responseCache,omitempty"`
+	// Compression enables the compression of the responses from the
+	// backend servers in HTTP and HTTPS modes, when the clients accept
+	// it and the backend servers didn't compress them.
+	Compression *Compression `yaml:"compression,omitempty"`
+	// Mirror sends a copy of some of the requests to a shadow backend in
+	// HTTP and HTTPS modes, e.g. to test a new version of a service with
+	// real traffic. The responses from the shadow backend are discarded.
+	Mirror *Mirror `yaml:"mirror,omitempty"`
+	// WebSocketLimits bounds the duration of the WebSocket connections
+	// that are proxied in HTTP and HTTPS modes.
+	WebSocketLimits *WebSocketLimits `yaml:"webSocketLimits,omitempty"`
+	// Streaming controls how the responses from the backend servers are
+	// flushed to the clients in HTTP and HTTPS modes, e.g. for
+	// server-sent events and long polling.
+	Streaming *Streaming `yaml:"streaming,omitempty"`
+	// HTTPTransport controls how connections to the backend servers are
+	// pooled and reused in HTTP and HTTPS modes.
+	HTTPTransport *HTTPTransport `yaml:"httpTransport,omitempty"`
+	// HTTPLimits controls the sizes, timeouts, and concurrency of the
+	// HTTP requests that the proxy accepts from the clients in HTTP,
+	// HTTPS, CONSOLE, LOCAL, WEBSOCKET, and REDIRECT modes.
+	HTTPLimits *HTTPLimits `yaml:"httpLimits,omitempty"`
+	// EarlyData controls which HTTP requests are accepted when they are
+	// sent in TLS 1.3 early data (0-RTT), in HTTP, HTTPS, CONSOLE, LOCAL,
+	// WEBSOCKET, REDIRECT, and PROXY modes. By default, only the requests
+	// with safe methods are accepted.
+	EarlyData *EarlyData `yaml:"earlyData,omitempty"`
+	// HostRouting controls how the Host header of the HTTP requests is
+	// validated, and which requests are routed to other backends, in
+	// HTTP, HTTPS, CONSOLE, LOCAL, WEBSOCKET, and REDIRECT modes.
+	HostRouting *HostRouting `yaml:"hostRouting,omitempty"`
+	// ConnectionQuota limits the number of concurrent connections to
+	// this backend, in total and from each client IP address.
+	ConnectionQuota *ConnectionQuota `yaml:"connectionQuota,omitempty"`
+	// Backpressure controls what happens when the backend is saturated,
+	// i.e. when ForwardRateLimit is exceeded, or when none of the backend
+	// servers can be reached. By default, connections wait for
+	// ForwardRateLimit indefinitely, and are closed when the backend
+	// servers can't be reached.
+	Backpressure *Backpressure `yaml:"backpressure,omitempty"`
+	// CircuitBreaker skips the backend addresses that failed recently,
+	// including the addresses of PathOverrides. By default, all the
+	// addresses are tried every time, in the order determined by
+	// LoadBalance.
+	CircuitBreaker *CircuitBreaker `yaml:"circuitBreaker,omitempty"`
+
+	// TCP connections consist of two streams of data:
+	//
+	//    CLIENT --> SERVER
+	//    CLIENT <-- SERVER
+	//
+	// The CLIENT and the SERVER can send data to each other at the same.
+	// When one stream is closed, the other one can remain open and continue
+	// to transmit data indefinitely. The TCP connection is closed when both
+	// streams are closed. (Either end can close the whole connection at any
+	// time too)
+	//
+	// This is a normal feature of TCP connections, but very few
+	// applications / protocols use half-close connections.
+	//
+	// There are some broken clients and network devices doing Network
+	// Address Translation (NAT) that never close their end of the
+	// connection. This can result in TCP connections staying open doing
+	// nothing, but still using resources for a very long time.
+	//
+	// The parameters below can be used to control the behavior of the proxy
+	// when connections are half-closed. The default values should be
+	// appropriate for well-behaved servers and occasionally broken clients.
+
+	// ServerCloseEndsConnection indicates that the proxy will close the
+	// whole TCP connection when the server closes its end of it. The
+	// default value is true.
+	ServerCloseEndsConnection *bool `yaml:"serverCloseEndsConnection,omitempty"`
+	// ClientCloseEndsConnection indicates that the proxy will close the
+	// whole TCP connection when the client closes its end of it. The
+	// default value is false.
+	ClientCloseEndsConnection *bool `yaml:"clientCloseEndsConnection,omitempty"`
+	// HalfCloseTimeout is the amount of time to keep the TCP connection
+	// open when one stream is closed. The default value is 1 minute.
+	HalfCloseTimeout *time.Duration `yaml:"halfCloseTimeout,omitempty"`
+	// CopyBufferSize is the size of the buffers used to copy the data
+	// between the client and the backend, in bytes. Small buffers use less
+	// memory with many chatty connections, while large buffers are more
+	// efficient for bulk transfers. The buffers are pooled and shared by
+	// all the backends that use the same size. The value must be between
+	// 1024 and 16777216. The default value is 32768.
+	CopyBufferSize int `yaml:"copyBufferSize,omitempty"`
+	// AccessLog indicates whether connections and requests to this backend
+	// are recorded in the access log, when the access log is enabled. The
+	// default is true.
+	AccessLog *bool `yaml:"accessLog,omitempty"`
+
+	recordEvent    func(string)
+	reportFailure  func(net.Addr)
+	countWebSocket func(serverName string) func()
+	audit          func(*auditlog.Entry)
+	tm             *tokenmanager.TokenManager
+	quicTransport  io.Closer
+	altSvcPort     int
+	accessLog      *accesslog.Logger
+	tracer         *tracing.Tracer
+
+	tlsConfig            *tls.Config
+	tlsConfigQUIC        *tls.Config
+	forwardRootCAs       *x509.CertPool
+	getClientCert        func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	pkiMap               map[string]*pki.PKIManager
+	ocspCache            *ocspcache.OCSPCache
+	jwksCache            *jwks.Cache
+	bwLimit              *bwLimit
+	connLimit            *rate.Limiter
+	proxyProtocolVersion byte
+	dialSourceIP         net.IP
+	serverNameRegexps    []*regexp.Regexp
+	staticCert           *staticCert
+
+	allowIPs     *[]*net.IPNet
+	denyIPs      *[]*net.IPNet
+	allowIPLists []*ipList
+	denyIPLists  []*ipList
+	addrResolver *addressResolver
+	dnsResolver  *resolver.Resolver
+
+	httpServer    *http.Server
+	httpConnChan  chan net.Conn
+	httpHandler   http.Handler
+	hostRoutes    map[string]*Backend
+	http3Server   io.Closer
+	httpTransport *backendTransport
+	respCache     *httpcache.Cache
+	mirror        *mirror
+	split         *trafficSplit
+	localHandlers []localHandler
+	outConns      *connTracker
+	quota         *connQuota
+
+	state *backendState
+}
+
+type backendState struct {
+	mu       sync.Mutex
+	inFlight int
+	shutdown bool
+	next     int
+	oNext    []int
+	dbNext   []int
+	gNext    []int
+	// numConns is the number of open connections to each address.
+	numConns map[string]int
+	// queued is the number of connections and requests that are waiting
+	// for ForwardRateLimit.
+	queued int
+	// health is the circuit breaker state of the addresses that failed.
+	health map[string]*addrHealth
+	// dialFunc is the function set with Proxy.SetDialFunc.
+	dialFunc DialFunc
+	// dialsIPv4 and dialsIPv6 are the number of connections to the
+	// backend servers that were established with each address family.
+	dialsIPv4 atomic.Int64
+	dialsIPv6 atomic.Int64
+	// earlyDataAccepted and earlyDataRejected are the number of requests
+	// received in early data that were accepted and rejected.
+	earlyDataAccepted atomic.Int64
+	earlyDataRejected atomic.Int64
+}
+
+type localHandler struct {
+	desc        string
+	host        string
+	path        string
+	handler     http.Handler
+	ssoBypass   bool
+	matchPrefix bool
+	isCallback  bool
+	// role is the console role required to use the handler when the
+	// backend has ConsoleAuth.
+	role consoleRole
+}
+
+// ClientAuth specifies how to authenticate and authorize the TLS client's
+// identity.
+type ClientAuth struct {
+	// Mode determines whether client certificates are required. Valid
+	// values are:
+	//  - require (default): clients must present a valid certificate.
+	//  - request: clients are asked for a certificate, and connections
+	//    without one are allowed. Certificates that are presented must
+	//    still be valid. ACL and DenyACL only apply to clients that
+	//    present a certificate.
+	// The certificate is requested during the handshake. TLS 1.3
+	// post-handshake authentication isn't supported.
+	Mode string `yaml:"mode,omitempty"`
+	// ACL optionally specifies which client identities are allowed to use
+	// this service. A nil value disabled the authorization check and allows
+	// any valid client certificate. Otherwise, the value is a slice of
+	// Subject or Subject Alternate Name strings from the client X509
+	// certificate, e.g. SUBJECT:CN=Bob, DNS:bob.example.com,
+	// EMAIL:bob@example.com, EMAIL:@example.com (any email address in
+	// the domain), or URI:spiffe://example.com/bob
+	//
+	// Multiple terms can be combined with &&, e.g.
+	// "EMAIL:@example.com && URI:spiffe://example.com/admin". A rule
+	// matches when all its terms match.
+	ACL *[]string `yaml:"acl,omitempty"`
+	// DenyACL optionally specifies which client identities are NOT allowed
+	// to use this service, using the same syntax as ACL. DenyACL takes
+	// precedence over ACL.
+	DenyACL []string `yaml:"denyAcl,omitempty"`
+	// RootCAs a list of:
+	// - CA names defined in the PKI section,
+	// - File names that contain PEM-encoded certificates, or
+	// - PEM-encoded certificates.
+	RootCAs []string `yaml:"rootCAs,omitempty"`
+	// AddClientCertHeader indicates which fields of the HTTP
+	// X-Forwarded-Client-Cert header should be added to the request when
+	// Mode is HTTP or HTTPS.
+	AddClientCertHeader []string `yaml:"addClientCertHeader,omitempty"`
+	// ClientCertHeaders specifies HTTP headers to add to the request
+	// with individual fields of the client certificate when Mode is HTTP
+	// or HTTPS. The keys are field names and the values are header names,
+	// e.g. subject: X-Client-Cert-Subject
+	// The valid fields are:
+	//  - cert: the URL-encoded PEM client certificate.
+	//  - hash: the hex-encoded SHA-256 fingerprint of the certificate.
+	//  - subject: the certificate's subject.
+	//  - dns: the comma-separated DNS SANs.
+	//  - email: the comma-separated email SANs.
+	//  - uri: the comma-separated URI SANs.
+	// Headers with these names sent by the client are always removed.
+	ClientCertHeaders map[string]string `yaml:"clientCertHeaders,omitempty"`
+	// AddClientCertTLVs indicates that the client certificate should be
+	// sent to the backend in PROXY protocol v2 TLVs. A PP2_TYPE_SSL TLV is
+	// added with the TLS version, the certificate's common name, and
+	// the cipher. The DER-encoded certificate is added in a custom TLV of
+	// type 0xE0. This requires ProxyProtocolVersion v2.
+	AddClientCertTLVs bool `yaml:"addClientCertTLVs,omitempty"`
+	// CRLs is a list of Certificate Revocation Lists to check client
+	// certificates against. Each value is either a http(s) URL or a file
+	// name. The CRLs can be DER or PEM encoded. They are cached until
+	// their NextUpdate time, or for at most one hour.
+	// Client certificates with OCSP servers and client certificates
+	// issued by CAs from the PKI section are always checked.
+	CRLs []string `yaml:"crls,omitempty"`
+	// RevocationPolicy determines what happens when the revocation status
+	// of a client certificate can't be determined, e.g. when the OCSP
+	// server or a CRL is unavailable. Valid values are:
+	//  - hard-fail (default): the connection is rejected.
+	//  - soft-fail: the connection is allowed.
+	// Revoked certificates are always rejected.
+	RevocationPolicy string `yaml:"revocationPolicy,omitempty"`
+}
+
+// ConfigOIDC contains the parameters of an OIDC provider.
+type ConfigOIDC struct {
+	// Name is the name of the provider. It is used internally only.
+	Name string `yaml:"name"`
+	// DiscoveryURL is the discovery URL of the OIDC provider. If set, it
+	// is used to discover the values of AuthEndpoint and TokenEndpoint.
+	DiscoveryURL string `yaml:"discoveryUrl,omitempty"`
+	// AuthEndpoint is the authorization endpoint. It must be set only if
+	// DiscoveryURL is not set.
+	AuthEndpoint string `yaml:"authorizationEndpoint,omitempty"`
+	// Scopes is the list of scopes to request. The default list ("openid",
+	// "email") returns only the user's email address.
+	// To get the user's name and picture, add the "profile" scope with
+	// google, or the "public_profile" scope with facebook, i.e.
+	// {"openid", "email", "profile"} or {"openid", "email",
+	// "public_profile"}.
+	Scopes []string `yaml:"scopes,flow,omitempty"`
+	// HostedDomain specifies that the HD param should be used.
+	// This parameter is used by Google is restrict the login process to
+	// one hosted domain, e.g. example.com. An empty or unspecified value
+	// means accounts from any domain will be accepted.
+	// https://developers.google.com/identity/openid-connect/openid-connect#hd-param
+	HostedDomain string `yaml:"hostedDomain,omitempty"`
+	// TokenEndpoint is the token endpoint. It must be set only if
+	// DiscoveryURL is not set.
+	TokenEndpoint string `yaml:"tokenEndpoint,omitempty"`
+	// UserinfoEndpoint is the userinfo endpoint. It must be set only if
+	// DiscoveryURL is not set and the token endpoint doesn't return an
+	// ID token.
+	UserinfoEndpoint string `yaml:"userinfoEndpoint,omitempty"`
+	// RedirectURL is the OAUTH2 redirect URL. It must be managed by the
+	// proxy.
+	RedirectURL string `yaml:"redirectUrl"`
+	// ClientID is the Client ID.
+	ClientID string `yaml:"clientId"`
+	// ClientSecret is the Client Secret.
+	ClientSecret string `yaml:"clientSecret"`
+	// Domain, if set, determine the domain where the user identities will
+	// be valid. Only set this if all host names in the domain are served
+	// by this proxy.
+	Domain string `yaml:"domain,omitempty"`
+}
+
+// ConfigSAML contains the parameters of a SAML identity provider.
+type ConfigSAML struct {
+	// Name is the name of the provider. It is used internally only.
+	Name string `yaml:"name"`
+	// SSOURL is the IdP's single sign-on URL where authentication
+	// requests are sent.
+	SSOURL string `yaml:"ssoUrl"`
+	// EntityID is the service provider's entity ID, i.e. the issuer of
+	// the authentication requests.
+	EntityID string `yaml:"entityId"`
+	// Certs is the IdP's PEM-encoded certificate(s), or the name of a
+	// file that contains them. They are used to validate the signature of
+	// the SAML assertions.
+	Certs string `yaml:"certs"`
+	// ACSURL is the assertion consumer service URL, i.e. where the IdP
+	// sends the SAML responses.
+	ACSURL string `yaml:"acsUrl"`
+	// Domain, if set, determine the domain where the user identities will
+	// be valid. Only set this if all host names in the domain are served
+	// by this proxy.
+	Domain string `yaml:"domain,omitempty"`
+}
+
+// ConfigPasskey contains the parameters of a Passkey manager.
+type ConfigPasskey struct {
+	// Name is the name of the provider. It is used internally only.
+	Name string `yaml:"name"`
+	// IdentityProvider is the name of another identity provider that will
+	// be used to authenticate the user before registering their first
+	// passkey.
+	IdentityProvider string `yaml:"identityProvider"`
+	// RefreshInterval is the amount of time after which users must
+	// re-authenticate with the other identity provider.
+	// The value is a go duration, e.g. '500h'
+	// The default value of 0 means no re-authentication is required.
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+	// Endpoint is a URL on this proxy that will handle the passkey
+	// authentication.
+	Endpoint string `yaml:"endpoint"`
+	// Domain, if set, determine the domain where the user identities will
+	// be valid. Only set this if all host names in the domain are served
+	// by this proxy.
+	Domain string `yaml:"domain,omitempty"`
+}
+
+// ConfigPKI defines the parameters of a local Certificate Authority.
+type ConfigPKI struct {
+	// Name is the name of the CA.
+	Name string `yaml:"name"`
+	// KeyType is type of cryptographic key to use with this CA. Valid
+	// values are: ecdsa-p224, ecdsa-p256, ecdsa-p394, ecdsa-p521, ed25519,
+	// rsa-2048, rsa-3072, and rsa-4096.
+	KeyType string `yaml:"keyType,omitempty"`
+	// IssuingCertificateURLs is a list of URLs that return the X509
+	// certificate of the CA.
+	IssuingCertificateURLs []string `yaml:"issuingCertificateUrls,omitempty"`
+	// CRLDistributionPoints is a list of URLs that return the Certificate
+	// Revocation List for this CA.
+	CRLDistributionPoints []string `yaml:"crlDistributionPoints,omitempty"`
+	// OCSPServer is a list of URLs that serve the Online Certificate Status
+	// Protocol (OCSP) for this CA.
+	// https://en.wikipedia.org/wiki/Online_Certificate_Status_Protocol
+	OCSPServer []string `yaml:"ocspServers,omitempty"`
+	// Endpoint is the URL where users can manage their certificates. It
+	// should be on a backend with restricted access and/or forceReAuth
+	// enabled.
+	Endpoint string `yaml:"endpoint"`
+	// ESTEndpoint is the base URL of an Enrollment over Secure Transport
+	// (EST) server for this CA, e.g.
+	// https://pki.example.com/.well-known/est. It implements the
+	// /cacerts and /simpleenroll operations (RFC 7030). Enrollment
+	// requires SSO, and certificates are issued to the authenticated
+	// user.
+	ESTEndpoint string `yaml:"estEndpoint,omitempty"`
+	// Admins is a list of users who are allowed to perform administrative
+	// tasks on the CA, e.g. revoke any certificate.
+	Admins []string `yaml:"admins"`
+}
+
+// ConfigSSHCertificateAuthority defines an SSH Certificate Authority. The CA's
+// private key is stored in the proxy's encrypted storage.
+//
+// SSH servers that trust the CA's public key, e.g. with TrustedUserCAKeys in
+// sshd_config, accept the certificates issued to the users. The principals
+// of the certificates are the user's email address and the part of the email
+// address before the @.
+type ConfigSSHCertificateAuthority struct {
+	// Name is the name of the CA.
+	Name string `yaml:"name"`
+	// KeyType is type of cryptographic key to use with this CA. Valid
+	// values are: ecdsa-p256, ecdsa-p384, ecdsa-p521, ed25519, rsa-2048,
+	// rsa-3072, and rsa-4096. The default is ed25519.
+	KeyType string `yaml:"keyType,omitempty"`
+	// PublicKeyEndpoint is the URL where the CA's public key is published.
+	PublicKeyEndpoint string `yaml:"publicKeyEndpoint,omitempty"`
+	// CertificateEndpoint is the URL where users can get certificates. It
+	// must be on a LOCAL or CONSOLE backend with SSO.
+	CertificateEndpoint string `yaml:"certificateEndpoint"`
+	// MaximumCertificateLifetime is the maximum lifetime of the
+	// certificates issued by this CA. The default is 10 minutes.
+	MaximumCertificateLifetime time.Duration `yaml:"maximumCertificateLifetime,omitempty"`
+}
+
+// JWTAuth validates the JSON Web Tokens (JWTs) that the clients send as
+// bearer tokens in the Authorization header, e.g. the access tokens of an
+// OAuth 2.0 authorization server. The requests without a valid token are
+// rejected with status 401 (Unauthorized), and the claims of the valid tokens
+// can be forwarded to the backend in request headers.
+//
+// The tokens must be signed with RS256, RS384, RS512, PS256, PS384, PS512,
+// ES256, ES384, ES512, or EdDSA, with a key from the key set of their issuer.
+type JWTAuth struct {
+	// Issuers is the list of trusted token issuers.
+	Issuers []*JWTIssuer `yaml:"issuers"`
+	// Audiences is the list of accepted audiences. When it is set, the
+	// tokens must have one of them in their aud claim.
+	Audiences []string `yaml:"audiences,omitempty"`
+	// ClockSkew is the amount of clock skew to tolerate when checking
+	// the exp, nbf, and iat claims. The default is 1m.
+	ClockSkew time.Duration `yaml:"clockSkew,omitempty"`
+	// Optional lets the requests without an Authorization header through,
+	// without claim headers. The requests with an invalid token are
+	// always rejected.
+	Optional bool `yaml:"optional,omitempty"`
+	// ClaimHeaders maps claim names to the request headers where their
+	// values are forwarded to the backend, e.g. sub: X-User-ID. These
+	// headers are always removed from the incoming requests. Lists of
+	// strings are joined with commas, and objects are JSON-encoded.
+	ClaimHeaders map[string]string `yaml:"claimHeaders,omitempty"`
+	// StripToken removes the Authorization header from the requests after
+	// the token is validated.
+	StripToken bool `yaml:"stripToken,omitempty"`
+}
+
+// JWTIssuer is a trusted issuer of JSON Web Tokens.
+type JWTIssuer struct {
+	// Issuer is the value of the iss claim of the tokens from this issuer.
+	Issuer string `yaml:"issuer"`
+	// JWKS is the URL of the JSON Web Key Set with the issuer's public
+	// keys, e.g. https://idp.example.com/.well-known/jwks.json, or the
+	// name of a file that contains it.
+	JWKS string `yaml:"jwks"`
+	// RefreshInterval is the amount of time that the key set is cached.
+	// The key set is also fetched again, at most once per minute, when a
+	// token has an unknown key ID. The default is 1h.
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+}
+
+// BackendSSO specifies the identity parameters to use for a backend.
+type BackendSSO struct {
+	// Provider is the the name of an identity provider defined in
+	// Config.OIDCProviders.
+	Provider string `yaml:"provider"`
+	// ForceReAuth is the time duration after which the user has to
+	// authenticate again. By default, users don't have to authenticate
+	// again until their token expires.
+	ForceReAuth time.Duration `yaml:"forceReAuth,omitempty"`
+	// ACL restricts which user identity can access this backend. It is a
+	// list of email addresses and/or domains, e.g. "bob@example.com", or
+	// "@example.com", and/or claims from the identity provider, e.g.
+	// "CLAIM:groups=admins". A claim rule matches when the claim's value,
+	// or one of its values if the claim is a list, is equal to the
+	// specified value. With SAML, the claims are the attributes of the
+	// assertion.
+	//
+	// Multiple terms can be combined with &&, e.g.
+	// "@example.com && CLAIM:groups=admins". A rule matches when all its
+	// terms match.
+	//
+	// If ACL is nil, all identities are allowed. If ACL is an empty list,
+	// nobody is allowed.
+	//
+	// With passkeys, only email addresses and domains are used to decide
+	// who can register a passkey.
+	ACL *[]string `yaml:"acl,omitempty"`
+	// DenyACL optionally specifies which user identities are NOT allowed
+	// to access this backend, using the same syntax as ACL. DenyACL takes
+	// precedence over ACL.
+	DenyACL []string `yaml:"denyAcl,omitempty"`
+	// Paths lists the path prefixes for which this policy will be enforced.
+	// If Paths is empty, the policy applies to all paths.
+	Paths []string `yaml:"paths,omitempty"`
+	// SetUserIDHeader indicates that the x-tlsproxy-user-id header should
+	// be set with the email address of the user.
+	SetUserIDHeader bool `yaml:"setUserIdHeader,omitempty"`
+	// UserIDHeader is the name of the header to set with the email
+	// address of the user when SetUserIDHeader is true, e.g.
+	// X-Auth-Email. The default is x-tlsproxy-user-id. Headers with this
+	// name sent by the client are always removed.
+	UserIDHeader string `yaml:"userIdHeader,omitempty"`
+	// GenerateIDTokens indicates that the proxy should generate ID tokens
+	// for authenticated users.
+	GenerateIDTokens bool `yaml:"generateIdTokens,omitempty"`
+	// LocalOIDCServer is used to configure a local OpenID Provider to
+	// authenticate users with backend services that support OpenID Connect.
+	LocalOIDCServer *LocalOIDCServer `yaml:"localOIDCServer,omitempty"`
+
+	p         identityProvider
+	cm        *cookiemanager.CookieManager
+	actualIDP string
+}
+
+// AddressDiscovery specifies where to get a backend's server addresses. One of
+// SRV or ConsulService must be set. The addresses are refreshed periodically,
+// and the last addresses that were found continue to be used when a refresh
+// fails.
+type AddressDiscovery struct {
+	// SRV is the name of a DNS SRV record, e.g. _https._tcp.example.com.
+	// Only the targets with the lowest priority value are used.
+	SRV string `yaml:"srv,omitempty"`
+	// ConsulService is the name of a Consul service. Only the instances
+	// that pass all their health checks are used.
+	ConsulService string `yaml:"consulService,omitempty"`
+	// ConsulTag optionally selects only the instances of ConsulService
+	// that have this tag.
+	ConsulTag string `yaml:"consulTag,omitempty"`
+	// ConsulAddress is the address of the Consul agent's HTTP API. The
+	// default is the value of the CONSUL_HTTP_ADDR environment variable,
+	// or http://127.0.0.1:8500.
+	ConsulAddress string `yaml:"consulAddress,omitempty"`
+	// ConsulToken is the ACL token to use with the Consul API. The
+	// default is the value of the CONSUL_HTTP_TOKEN environment variable.
+	ConsulToken string `yaml:"consulToken,omitempty"`
+	// RefreshInterval is how often the addresses are refreshed. The
+	// default is 30 seconds.
+	RefreshInterval time.Duration `yaml:"refreshInterval,omitempty"`
+}
+
+// DNSResolver specifies how to resolve a backend's host names.
+type DNSResolver struct {
+	// Servers are the DNS servers to query, in order. Each one is either
+	// an IP address with an optional port, e.g. 192.168.0.53 or
+	// [2001:db8::53]:5353, or a URL:
+	//   - udp://host[:port] (default port 53)
+	//   - tcp://host[:port] (default port 53)
+	//   - tls://host[:port] (DNS over TLS, default port 853)
+	//   - https://host/path (DNS over HTTPS)
+	// The host names in the URLs are resolved with the system resolver.
+	// When Servers is empty, the nameservers from /etc/resolv.conf are
+	// used.
+	Servers []string `yaml:"servers,omitempty"`
+	// RootCAs is a list of:
+	//  - file names that contain PEM-encoded certificates, or
+	//  - PEM-encoded certificates
+	// to verify the DNS over TLS and DNS over HTTPS servers. The default
+	// is to use the system's root CAs.
+	RootCAs []string `yaml:"rootCAs,omitempty"`
+	// Timeout is the maximum amount of time to wait for an answer from
+	// each server. The default is 5 seconds.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// MinTTL and MaxTTL are the minimum and maximum amount of time to
+	// cache the answers, regardless of their TTL. The default MaxTTL is
+	// 1 hour.
+	MinTTL time.Duration `yaml:"minTTL,omitempty"`
+	MaxTTL time.Duration `yaml:"maxTTL,omitempty"`
+	// NegativeTTL is the maximum amount of time to cache the answers
+	// that say that a name doesn't exist, or that it doesn't have any
+	// address of the requested family. The default is 30 seconds.
+	NegativeTTL time.Duration `yaml:"negativeTTL,omitempty"`
+	// CacheSize is the maximum number of answers to cache. The default
+	// is 1024.
+	CacheSize int `yaml:"cacheSize,omitempty"`
+
+	rootCAs *x509.CertPool
+}
+
+// ForwardClientCert specifies the client certificate that the proxy presents
+// to backend servers. Either CertFile and KeyFile, or PKI must be set.
+type ForwardClientCert struct {
+	// CertFile and KeyFile specify a static certificate chain and private
+	// key. The values are either file names (absolute paths) or
+	// PEM-encoded data. The files are reloaded automatically when they
+	// change.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// KeyStore and KeyID specify that the private key of CertFile is
+	// KeyID in one of the KeyStores, instead of KeyFile.
+	KeyStore string `yaml:"keyStore,omitempty"`
+	KeyID    string `yaml:"keyId,omitempty"`
+	// PKI is the name of a CA defined in the PKI section. The proxy gets
+	// a client certificate from this CA, and renews it automatically
+	// when two thirds of its lifetime have passed.
+	PKI string `yaml:"pki,omitempty"`
+	// CommonName is the subject common name of the certificate issued by
+	// PKI. The default is the backend's first server name.
+	CommonName string `yaml:"commonName,omitempty"`
+	// Lifetime is the lifetime of the certificate issued by PKI. The
+	// default is 7 days.
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+
+	staticCert *staticCert
+}
+
+// PathOverride specifies different backend parameters for some path prefixes.
+type PathOverride struct {
+	// Paths is the list of path prefixes for which these parameters apply.
+	Paths []string `yaml:"paths"`
+	// Methods is an optional list of HTTP methods, e.g. GET or POST, for
+	// which these parameters apply. When empty, all methods match.
+	Methods []string `yaml:"methods,omitempty"`
+	// Addresses is a list of server addresses where requests are forwarded.
+	// When more than one address are specified, requests are distributed
+	// using a simple round robin.
+	Addresses []string `yaml:"addresses,omitempty"`
+	// Mode is either HTTP or HTTPS.
+	Mode string `yaml:"mode"`
+	// DocumentRoot indicates local files should be served from this
+	// directory. This option is only valid when Addresses is empty.
+	DocumentRoot string `yaml:"documentRoot,omitempty"`
+	// BackendProto specifies which protocol to use when forwarding an HTTPS
+	// request to the backend. This field is only valid in modes HTTP and
+	// HTTPS.
+	// The value should be an ALPN protocol, e.g.: http/1.1, h2, or h3.
+	// If the value is set explicitly to "", the same protocol used by the
+	//  client will be used with the backend.
+	BackendProto *string `yaml:"backendProto,omitempty"`
+	// InsecureSkipVerify disabled the verification of the backend server's
+	// TLS certificate. See https://pkg.go.dev/crypto/tls#Config
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify,omitempty"`
+	// ForwardServerName is the ServerName to send in the TLS handshake with
+	// the backend server. It is also used to verify the server's identify.
+	// This is particularly useful when the addresses use IP addresses
+	// instead of hostnames.
+	ForwardServerName string `yaml:"forwardServerName,omitempty"`
+	// ForwardRootCAs a list of:
+	// - CA names defined in the PKI section,
+	// - File names that contain PEM-encoded certificates, or
+	// - PEM-encoded certificates.
+	ForwardRootCAs []string `yaml:"forwardRootCAs,omitempty"`
+	// ForwardTimeout is the connection timeout to backend servers. If
+	// Addresses contains multiple addresses, this timeout indicates how
+	// long to wait before trying the next address in the list. The default
+	// value is 30 seconds.
+	ForwardTimeout time.Duration `yaml:"forwardTimeout"`
+	// ProxyProtocolVersion enables the PROXY protocol on this backend. The
+	// value is the version of the protocol to use, e.g. v1 or v2.
+	// By default, the proxy protocol is not enabled.
+	// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+	ProxyProtocolVersion string `yaml:"proxyProtocolVersion,omitempty"`
+	// SanitizePath indicates that the request's path should be sanitized
+	// before forwarding the request to the backend.
+	SanitizePath *bool `yaml:"sanitizePath,omitempty"`
+
+	forwardRootCAs       *x509.CertPool
+	proxyProtocolVersion byte
+}
+
+// LocalOIDCServer is used to configure a local OpenID Provider to
+// authenticate users with backend services that support OpenID Connect.
+// When this is enabled, tlsproxy will add a few endpoints to this
+// backend:
+// - <PathPrefix>/.well-known/openid-configuration
+// - <PathPrefix>/authorization
+// - <PathPrefix>/token
+// - <PathPrefix>/jwks
+type LocalOIDCServer struct {
+	// PathPrefix specifies how the endpoint paths are constructed. It is
+	// generally fine to leave it empty.
+	PathPrefix string `yaml:"pathPrefix,omitempty"`
+	// Clients is the list of all authorized clients and their
+	// configurations.
+	Clients []*LocalOIDCClient `yaml:"clients,omitempty"`
+	// RewriteRules are used to rewrite existing claims or create new claims
+	// from existing ones.
+	RewriteRules []*LocalOIDCRewriteRule `yaml:"rewriteRules,omitempty"`
+}
+
+// LocalOIDCClient contains the parameters of one OIDC client that is allowed
+// to connect to the local OIDC server. All the fields must be shared with the
+// client application.
+type LocalOIDCClient struct {
+	// ID is the OAUTH2 client ID. It should a unique string that's hard to
+	// guess. See https://www.oauth.com/oauth2-servers/client-registration/client-id-secret/
+	ID string `yaml:"id"`
+	// Secret is the OAUTH2 secret for the client. It should be a random
+	// string generated with something like:
+	//  dd if=/dev/random bs=32 count=1 | base64
+	Secret string `yaml:"secret"`
+	// RedirectURI is where the authorization endpoint will redirect the
+	// user once the authorization code has been granted.
+	RedirectURI []string `yaml:"redirectUri"`
+}
+
+// LocalOIDCRewriteRule define how to rewrite existing claims or create new
+// claims from existing ones.
+// The following example uses the "email" claim to create a "preferred_username"
+// claim by removing the domain name.
+//
+//	InputClaim: "email"
+//	OutputClaim: "preferred_username"
+//	Regex: "^([^@]+)@example.com$"
+//	Value: "$1"
+type LocalOIDCRewriteRule struct {
+	InputClaim  string `yaml:"inputClaim"`
+	OutputClaim string `yaml:"outputClaim"`
+	Regex       string `yaml:"regex"`
+	Value       string `yaml:"value"`
+}
+
+func (cfg *Config) serialize() []byte {
+	if cfg == nil {
+		return nil
+	}
+	b, _ := yaml.Marshal(cfg)
+	return b
+}
+
+// redacted returns a copy of the config without secrets.
+func (cfg *Config) redacted() *Config {
+	cfg = cfg.clone()
+	for _, p := range cfg.OIDCProviders {
+		p.ClientSecret = redactedValue
+	}
+	if cs := cfg.CertificateStore; cs != nil {
+		if cs.SecretAccessKey != "" {
+			cs.SecretAccessKey = redactedValue
+		}
+		if cs.Password != "" {
+			cs.Password = redactedValue
+		}
+		if cs.DSN != "" {
+			cs.DSN = redactedValue
+		}
+	}
+	if cfg.Tracing != nil {
+		for k := range cfg.Tracing.Headers {
+			cfg.Tracing.Headers[k] = redactedValue
+		}
+	}
+	if cm := cfg.CertificateMonitor; cm != nil {
+		for k := range cm.WebhookHeaders {
+			cm.WebhookHeaders[k] = redactedValue
+		}
+		cm.WebhookURL = redactURL(cm.WebhookURL)
+	}
+	if cfg.ACME != nil {
+		for _, ca := range cfg.ACME.CertificateAuthorities {
+			if ca.EABHMACKey != "" {
+				ca.EABHMACKey = redactedValue
+			}
+		}
+	}
+	for _, ks := range cfg.KeyStores {
+		if ks.SecretAccessKey != "" {
+			ks.SecretAccessKey = redactedValue
+		}
+		for k := range ks.Options {
+			ks.Options[k] = redactedValue
+		}
+	}
+	for _, dp := range cfg.DNSProviders {
+		if dp.APIToken != "" {
+			dp.APIToken = redactedValue
+		}
+		if dp.SecretAccessKey != "" {
+			dp.SecretAccessKey = redactedValue
+		}
+		if dp.TSIGSecret != "" {
+			dp.TSIGSecret = redactedValue
+		}
+	}
+	for _, be := range cfg.Backends {
+		if ad := be.AddressDiscovery; ad != nil && ad.ConsulToken != "" {
+			ad.ConsulToken = redactedValue
+		}
+		if be.KeyFile != "" && !isFileName(be.KeyFile) {
+			be.KeyFile = redactedValue
+		}
+		if fc := be.ForwardClientCert; fc != nil && fc.KeyFile != "" && !isFileName(fc.KeyFile) {
+			fc.KeyFile = redactedValue
+		}
+		if be.SSO == nil || be.SSO.LocalOIDCServer == nil {
+			continue
+		}
+		for _, client := range be.SSO.LocalOIDCServer.Clients {
+			client.Secret = redactedValue
+		}
+	}
+	cfg.restoreSecretRefs()
+	return cfg
+}
+
+// redactURL removes the user info and the query, which can contain
+// credentials, from a URL.
+func redactURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedValue
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+func (cfg *Config) equal(other *Config) bool {
+	a := cfg.serialize()
+	b := other.serialize()
+	return bytes.Equal(a, b)
+}
+
+func (cfg *Config) clone() *Config {
+	b := cfg.serialize()
+	var out Config
+	yaml.Unmarshal(b, &out)
+	out.secretRefs = cfg.secretRefs
+	return &out
+}
+
+func (be *Backend) clone() *Backend {
+	b, _ := yaml.Marshal(be)
+	var out Backend
+	yaml.Unmarshal(b, &out)
+	return &out
+}
+
+// Check checks that the Config is valid, sets some default values, and
+// initializes internal data structures.
+func (cfg *Config) Check() error {
+	cfg.Definitions = nil
+	if cfg.Version == 0 {
+		cfg.Version = currentConfigVersion
+	}
+	if cfg.Version != currentConfigVersion {
+		return fmt.Errorf("Version: value %d is not supported, the current version is %d", cfg.Version, currentConfigVersion)
+	}
+	if len(cfg.Include) > 0 {
+		return errors.New("Include: the included files must be merged with ReadConfig")
+	}
+	if cfg.CacheDir == "" {
+		d, err := os.UserCacheDir()
+		if err != nil {
+			return errors.New("CacheDir must be set in config")
+		}
+		cfg.CacheDir = filepath.Join(d, "tlsproxy", "letsencrypt")
+	}
+	if cfg.TLSAddr == "" {
+		cfg.TLSAddr = ":10443"
+	}
+	if cfg.TLSListenerShards < 0 || cfg.TLSListenerShards > maxTLSListenerShards {
+		return fmt.Errorf("TLSListenerShards: value must be between 1 and %d", maxTLSListenerShards)
+	}
+	if cfg.TLSListenerShards > 1 && !reusePortSupported {
+		return errors.New("TLSListenerShards: not supported on this platform")
+	}
+	if cfg.HandshakeWorkers < 0 {
+		return errors.New("HandshakeWorkers: value must not be negative")
+	}
+	if td := cfg.TLSDebug; td != nil {
+		if td.Transcripts < 0 || td.Transcripts > maxTranscriptHistorySize {
+			return fmt.Errorf("tlsDebug.transcripts: value must be between 0 and %d", maxTranscriptHistorySize)
+		}
+	}
+	if ns := cfg.NoSNISniffing; ns != nil {
+		if len(ns.Sniffers) == 0 {
+			return errors.New("noSNISniffing.sniffers: must not be empty")
+		}
+		if ns.Timeout < 0 {
+			return errors.New("noSNISniffing.timeout: value must not be negative")
+		}
+		for i, sn := range ns.Sniffers {
+			switch sn.Protocol {
+			case sniffHTTP, sniffSSH:
+				if sn.Prefix != "" {
+					return fmt.Errorf("noSNISniffing.sniffers[%d].prefix: only valid with protocol %s", i, sniffPrefix)
+				}
+			case sniffPrefix:
+				if sn.Prefix == "" || len(sn.Prefix) > maxSniffSize {
+					return fmt.Errorf("noSNISniffing.sniffers[%d].prefix: length must be between 1 and %d", i, maxSniffSize)
+				}
+			default:
+				return fmt.Errorf("noSNISniffing.sniffers[%d].protocol: value %q must be one of %v", i, sn.Protocol, []string{sniffHTTP, sniffSSH, sniffPrefix})
+			}
+			if sn.ServerName == "" && sn.Protocol != sniffHTTP {
+				return fmt.Errorf("noSNISniffing.sniffers[%d].serverName: must be set with protocol %s", i, sn.Protocol)
+			}
+			sn.ServerName = idnaToASCII(sn.ServerName)
+		}
+	}
+	if cfg.ClientHelloTimeout < 0 {
+		return errors.New("ClientHelloTimeout: value must not be negative")
+	}
+	if cfg.MaxClientHelloSize != 0 && (cfg.MaxClientHelloSize < minClientHelloSize || cfg.MaxClientHelloSize > maxClientHelloSize) {
+		return fmt.Errorf("MaxClientHelloSize: value must be between %d and %d", minClientHelloSize, maxClientHelloSize)
+	}
+	if cfg.MaxOpen == 0 {
+		n, err := openFileLimit()
+		if err != nil {
+			return errors.New("MaxOpen: value must be set")
+		}
+		cfg.MaxOpen = n/2 - 100
+	}
+	if cfg.DrainTimeout == nil {
+		v := time.Minute
+		cfg.DrainTimeout = &v
+	}
+	if cfg.ConfigRevisions < 0 {
+		return errors.New("ConfigRevisions: value must not be negative")
+	}
+	if cfg.ConfigRevisions > 0 && !slices.ContainsFunc(cfg.Backends, func(be *Backend) bool {
+		return strings.ToUpper(be.Mode) == ModeConsole && be.ConsoleAuth != nil
+	}) {
+		return errors.New("ConfigRevisions: the admin API requires a CONSOLE backend with ConsoleAuth")
+	}
+	if cfg.EventHistorySize < 0 {
+		return errors.New("EventHistorySize: value must not be negative")
+	}
+	if cfg.SharedCacheDir != "" {
+		if cfg.HWBacked {
+			return errors.New("SharedCacheDir cannot be used with HWBacked")
+		}
+		if filepath.Clean(cfg.SharedCacheDir) == filepath.Clean(cfg.CacheDir) {
+			return errors.New("SharedCacheDir must be different from CacheDir")
+		}
+	}
+	if cs := cfg.CertificateStore; cs != nil {
+		if cfg.HWBacked {
+			return errors.New("CertificateStore cannot be used with HWBacked")
+		}
+		switch cs.Type {
+		case "s3", "gcs":
+			if cs.Region == "" {
+				cs.Region = "us-east-1"
+				if cs.Type == "gcs" {
+					cs.Region = "auto"
+				}
+			}
+			if cs.Endpoint == "" {
+				cs.Endpoint = "https://s3." + cs.Region + ".amazonaws.com"
+				if cs.Type == "gcs" {
+					cs.Endpoint = "https://storage.googleapis.com"
+				}
+			}
+			if u, err := url.Parse(cs.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("certificateStore.Endpoint: invalid URL %q", cs.Endpoint)
+			}
+			if cs.Bucket == "" {
+				return errors.New("certificateStore.Bucket: must be set")
+			}
+			if cs.AccessKeyID == "" || cs.SecretAccessKey == "" {
+				return errors.New("certificateStore.AccessKeyID, SecretAccessKey: must be set")
+			}
+		case "redis":
+			if _, _, err := net.SplitHostPort(cs.Address); err != nil {
+				return fmt.Errorf("certificateStore.Address: %w", err)
+			}
+			if cs.DB < 0 {
+				return errors.New("certificateStore.DB: value must not be negative")
+			}
+		case "sql":
+			if !slices.Contains(sql.Drivers(), cs.Driver) {
+				return fmt.Errorf("certificateStore.Driver: %q is not a registered driver", cs.Driver)
+			}
+			if cs.Table == "" {
+				cs.Table = "tlsproxy_certificates"
+			}
+		default:
+			return fmt.Errorf("certificateStore.Type: unexpected value %q", cs.Type)
+		}
+	}
+	if *cfg.DrainTimeout < 0 {
+		return errors.New("DrainTimeout: value must not be negative")
+	}
+	if cfg.SessionTicketKeyRotation != 0 && cfg.SessionTicketKeyRotation < time.Minute {
+		return errors.New("SessionTicketKeyRotation: value must be at least 1 minute")
+	}
+	if al := cfg.AccessLog; al != nil {
+		if al.Format == "" {
+			al.Format = accesslog.FormatJSON
+		}
+		if al.Format != accesslog.FormatJSON && al.Format != accesslog.FormatCombined {
+			return fmt.Errorf("accessLog.format: invalid value %q", al.Format)
+		}
+		if al.File != "" && (al.Syslog || al.Journald) {
+			return errors.New("accessLog: file and syslog or journald can't both be set")
+		}
+		if al.MaxSize == 0 {
+			al.MaxSize = 100
+		}
+		if al.MaxSize < 0 {
+			return errors.New("accessLog.maxSize: value must not be negative")
+		}
+		if al.MaxFiles == 0 {
+			al.MaxFiles = 5
+		}
+		if al.MaxFiles < 0 {
+			return errors.New("accessLog.maxFiles: value must not be negative")
+		}
+		if err := al.sink().check("accessLog"); err != nil {
+			return err
+		}
+	}
+	if al := cfg.AuditLog; al != nil {
+		if (al.File == "") == !al.Syslog {
+			return errors.New("auditLog: exactly one of file or syslog must be set")
+		}
+		if al.MaxSize == 0 {
+			al.MaxSize = 100
+		}
+		if al.MaxSize < 0 {
+			return errors.New("auditLog.maxSize: value must not be negative")
+		}
+		if al.MaxFiles == 0 {
+			al.MaxFiles = 10
+		}
+		if al.MaxFiles < 0 {
+			return errors.New("auditLog.maxFiles: value must not be negative")
+		}
+		if al.MaxAge < 0 {
+			return errors.New("auditLog.maxAge: value must not be negative")
+		}
+		if err := al.sink().check("auditLog"); err != nil {
+			return err
+		}
+	}
+	if fe := cfg.FlowExport; fe != nil {
+		if _, _, err := net.SplitHostPort(fe.Collector); err != nil {
+			return fmt.Errorf("flowExport.collector: invalid address %q", fe.Collector)
+		}
+		if fe.Network == "" {
+			fe.Network = "udp"
+		}
+		if fe.Network != "udp" && fe.Network != "tcp" {
+			return fmt.Errorf("flowExport.network: invalid value %q", fe.Network)
+		}
+		if fe.Format == "" {
+			fe.Format = flowexport.FormatJSON
+		}
+		if fe.Format != flowexport.FormatJSON && fe.Format != flowexport.FormatIPFIX {
+			return fmt.Errorf("flowExport.format: invalid value %q", fe.Format)
+		}
+		if fe.QueueSize == 0 {
+			fe.QueueSize = 1024
+		}
+		if fe.QueueSize < 0 {
+			return errors.New("flowExport.queueSize: value must not be negative")
+		}
+	}
+	if ha := cfg.HandshakeAdmission; ha != nil {
+		if ha.MaxHandshakes <= 0 {
+			return errors.New("handshakeAdmission.maxHandshakes: value must be greater than 0")
+		}
+		if ha.QueueSize == 0 {
+			ha.QueueSize = ha.MaxHandshakes
+		}
+		if ha.QueueSize < 0 {
+			return errors.New("handshakeAdmission.queueSize: value must not be negative")
+		}
+		if ha.QueueTimeout == 0 {
+			ha.QueueTimeout = defaultHandshakeQueueTimeout
+		}
+		if ha.QueueTimeout < 0 {
+			return errors.New("handshakeAdmission.queueTimeout: value must not be negative")
+		}
+	}
+	if tc := cfg.Tracing; tc != nil {
+		u, err := url.Parse(tc.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing.endpoint: invalid URL %q", tc.Endpoint)
+		}
+		if tc.SampleRatio == nil {
+			v := 1.0
+			tc.SampleRatio = &v
+		}
+		if *tc.SampleRatio < 0 || *tc.SampleRatio > 1 {
+			return errors.New("tracing.sampleRatio: value must be between 0 and 1")
+		}
+	}
+	if cfg.EnableQUIC == nil {
+		v := quicIsEnabled
+		cfg.EnableQUIC = &v
+	}
+	if *cfg.EnableQUIC && !quicIsEnabled {
+		return errors.New("EnableQUIC: QUIC is not supported in this binary")
+	}
+	if cfg.QUICPassthroughAddr != "" {
+		if _, err := net.ResolveUDPAddr("udp", cfg.QUICPassthroughAddr); err != nil {
+			return fmt.Errorf("QUICPassthroughAddr: %w", err)
+		}
+	}
+	if cfg.MySQLAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", cfg.MySQLAddr); err != nil {
+			return fmt.Errorf("MySQLAddr: %w", err)
+		}
+	}
+	if cfg.QUICAddr != "" {
+		if !*cfg.EnableQUIC {
+			return errors.New("QUICAddr: QUIC is not enabled")
+		}
+		if _, err := net.ResolveUDPAddr("udp", cfg.QUICAddr); err != nil {
+			return fmt.Errorf("QUICAddr: %w", err)
+		}
+	}
+	cfg.acceptProxyHeaderFrom = make([]*net.IPNet, len(cfg.AcceptProxyHeaderFrom))
+	for i, c := range cfg.AcceptProxyHeaderFrom {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return fmt.Errorf("AcceptProxyHeaderFrom[%d]: %w", i, err)
+		}
+		cfg.acceptProxyHeaderFrom[i] = n
+	}
+
+	cfg.DefaultServerName = idnaToASCII(cfg.DefaultServerName)
+
+	identityProviders := make(map[string]bool)
+	for i, oi := range cfg.OIDCProviders {
+		if identityProviders[oi.Name] {
+			return fmt.Errorf("oidc[%d].Name: duplicate provider name %q", i, oi.Name)
+		}
+		identityProviders[oi.Name] = true
+
+		if (oi.AuthEndpoint == "" || oi.TokenEndpoint == "") && oi.DiscoveryURL == "" {
+			return fmt.Errorf("oidc[%d] AuthEndpoint and TokenEndpoint must be set unless DiscoveryURL is set", i)
+		}
+		if oi.DiscoveryURL != "" {
+			if _, err := url.Parse(oi.DiscoveryURL); err != nil {
+				return fmt.Errorf("oidc[%d].DiscoveryURL: %v", i, err)
+			}
+		}
+		if oi.AuthEndpoint != "" {
+			if _, err := url.Parse(oi.AuthEndpoint); err != nil {
+				return fmt.Errorf("oidc[%d].AuthEndpoint: %v", i, err)
+			}
+		}
+		if oi.TokenEndpoint != "" {
+			if _, err := url.Parse(oi.TokenEndpoint); err != nil {
+				return fmt.Errorf("oidc[%d].TokenEndpoint: %v", i, err)
+			}
+		}
+		if oi.RedirectURL == "" {
+			return fmt.Errorf("oidc[%d].RedirectURL must be set", i)
+		}
+		if _, err := url.Parse(oi.RedirectURL); err != nil {
+			return fmt.Errorf("oidc[%d].RedirectURL: %v", i, err)
+		}
+		if oi.ClientID == "" {
+			return fmt.Errorf("oidc[%d].ClientID must be set", i)
+		}
+		if oi.ClientSecret == "" {
+			return fmt.Errorf("oidc[%d].ClientSecret must be set", i)
+		}
+		if oi.Domain != "" {
+			oi.Domain = idnaToASCII(oi.Domain)
+			host, _, _, err := hostAndPath(oi.RedirectURL)
+			if err != nil {
+				return fmt.Errorf("oidc[%d].RedirectURL %q: %v", i, oi.RedirectURL, err)
+			}
+			if !strings.HasSuffix(host, oi.Domain) {
+				return fmt.Errorf("oidc[%d].Domain %q must be part of RedirectURL (%s)", i, oi.Domain, host)
+			}
+		}
+	}
+	for i, s := range cfg.SAMLProviders {
+		if identityProviders[s.Name] {
+			return fmt.Errorf("saml[%d].Name: duplicate provider name %q", i, s.Name)
+		}
+		identityProviders[s.Name] = true
+		if s.SSOURL == "" {
+			return fmt.Errorf("saml[%d].SSOURL must be set", i)
+		}
+		if s.EntityID == "" {
+			return fmt.Errorf("saml[%d].EntityID must be set", i)
+		}
+		if s.Certs == "" {
+			return fmt.Errorf("saml[%d].Certs must be set", i)
+		}
+		if s.ACSURL == "" {
+			return fmt.Errorf("saml[%d].ACSURL must be set", i)
+		}
+		if s.Domain != "" {
+			s.Domain = idnaToASCII(s.Domain)
+			host, _, _, err := hostAndPath(s.ACSURL)
+			if err != nil {
+				return fmt.Errorf("saml[%d].ACSURL %q: %v", i, s.ACSURL, err)
+			}
+			if !strings.HasSuffix(host, s.Domain) {
+				return fmt.Errorf("saml[%d].Domain %q must be part of ACSURL (%s)", i, s.Domain, host)
+			}
+		}
+	}
+	for i, pp := range cfg.PasskeyProviders {
+		if identityProviders[pp.Name] {
+			return fmt.Errorf("passkey[%d].Name: duplicate provider name %q", i, pp.Name)
+		}
+		identityProviders[pp.Name] = true
+		if pp.Endpoint == "" {
+			return fmt.Errorf("passkey[%d].Endpoint must be set", i)
+		}
+		if pp.IdentityProvider == "" {
+			return fmt.Errorf("passkey[%d].IdentityProvider must be set", i)
+		}
+		if _, ok := identityProviders[pp.IdentityProvider]; !ok {
+			return fmt.Errorf("passkey[%d].IdentityProvider has unexpected value %q", i, pp.IdentityProvider)
+		}
+		if pp.Domain != "" {
+			pp.Domain = idnaToASCII(pp.Domain)
+			host, _, _, err := hostAndPath(pp.Endpoint)
+			if err != nil {
+				return fmt.Errorf("passkey[%d].Endpoint %q: %v", i, pp.Endpoint, err)
+			}
+			if !strings.HasSuffix(host, pp.Domain) {
+				return fmt.Errorf("passkey[%d].Domain %q must be part of Endpoint (%s)", i, pp.Domain, host)
+			}
+		}
+	}
+
+	var numMySQL int
+	for i, be := range cfg.Backends {
+		be.state = new(backendState)
+		be.state.oNext = make([]int, len(be.PathOverrides))
+		if be.Database != nil {
+			be.state.dbNext = make([]int, len(be.Database.Routes))
+		}
+		be.state.gNext = make([]int, len(be.AddressGroups))
+		be.Mode = strings.ToUpper(be.Mode)
+		if be.Mode == "" || be.Mode == ModePlaintext {
+			be.Mode = ModeTCP
+		}
+		if !slices.Contains(validModes, be.Mode) {
+			return fmt.Errorf("backend[%d].Mode: value %q must be one of %v", i, be.Mode, validModes)
+		}
+		if be.Mode == ModeTLSPassthrough && be.ClientAuth != nil {
+			return fmt.Errorf("backend[%d].ClientAuth: client auth is not compatible with TLS Passthrough", i)
+		}
+		if be.Mode == ModeMySQL {
+			if cfg.MySQLAddr == "" {
+				return fmt.Errorf("backend[%d].Mode: MySQLAddr must be set for mode %s", i, be.Mode)
+			}
+			if numMySQL++; numMySQL > 1 {
+				return fmt.Errorf("backend[%d].Mode: only one backend can use mode %s", i, be.Mode)
+			}
+			if len(be.ServerNames) == 0 || slices.Contains(be.ServerNames, CatchAllServerName) {
+				return fmt.Errorf("backend[%d].ServerNames: mode %s requires at least one server name, and no catch-all", i, be.Mode)
+			}
+		}
+		if be.Mode == ModeQUICPassthrough {
+			if cfg.QUICPassthroughAddr == "" {
+				return fmt.Errorf("backend[%d].Mode: QUICPassthroughAddr must be set for mode %s", i, be.Mode)
+			}
+			if be.ClientAuth != nil || be.SSO != nil {
+				return fmt.Errorf("backend[%d]: client auth and SSO are not compatible with QUIC Passthrough", i)
+			}
+		}
+		if be.ALPNProtos == nil && be.Mode == ModeWebSocket {
+			// WebSocket connections require HTTP/1.1.
+			be.ALPNProtos = &[]string{"http/1.1"}
+		}
+		if be.ALPNProtos == nil && be.Mode == ModePostgres {
+			// PostgreSQL 17 clients require the postgresql protocol,
+			// and older clients don't use ALPN.
+			be.ALPNProtos = &[]string{"postgresql"}
+		}
+		if be.ALPNProtos == nil && be.Mode == ModeMySQL {
+			be.ALPNProtos = &[]string{}
+		}
+		if be.ALPNProtos == nil && be.Mode == ModeProxy {
+			// CONNECT tunnels require HTTP/1.1, and CONNECT-UDP requires
+			// HTTP/3.
+			if *cfg.EnableQUIC {
+				be.ALPNProtos = &[]string{"h3", "http/1.1"}
+			} else {
+				be.ALPNProtos = &[]string{"http/1.1"}
+			}
+		}
+		if be.ALPNProtos == nil {
+			if *cfg.EnableQUIC && (be.Mode == ModeHTTP || be.Mode == ModeHTTPS || be.Mode == ModeQUIC || be.Mode == ModeLocal || be.Mode == ModeConsole || be.Mode == ModeRedirect) {
+				be.ALPNProtos = defaultALPNProtosPlusH3
+			} else {
+				be.ALPNProtos = defaultALPNProtos
+			}
+		}
+		if be.BackendProto != nil && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+			return fmt.Errorf("backend[%d].BackendProto: field is not valid in mode %s", i, be.Mode)
+		}
+		if be.BackendProto != nil && *be.BackendProto == "h2c" && be.Mode != ModeHTTP {
+			return fmt.Errorf("backend[%d].BackendProto: h2c is only valid in mode %s", i, ModeHTTP)
+		}
+		if st := be.StartTLS; st != nil {
+			if be.Mode != ModeTLS {
+				return fmt.Errorf("backend[%d].StartTLS: field is not valid in mode %s", i, be.Mode)
+			}
+			if err := st.check(); err != nil {
+				return fmt.Errorf("backend[%d].StartTLS.%w", i, err)
+			}
+		}
+		if be.ForwardALPNProtos != nil {
+			if be.Mode != ModeTLS && be.Mode != ModeQUIC {
+				return fmt.Errorf("backend[%d].ForwardALPNProtos: field is not valid in mode %s", i, be.Mode)
+			}
+			if be.Mode == ModeQUIC && len(*be.ForwardALPNProtos) == 0 {
+				return fmt.Errorf("backend[%d].ForwardALPNProtos: QUIC requires at least one protocol", i)
+			}
+		}
+		if be.Mode == ModeQUIC {
+			var falsex bool
+			if be.ServerCloseEndsConnection == nil {
+				be.ServerCloseEndsConnection = &falsex
+			}
+			if be.ClientCloseEndsConnection == nil {
+				be.ClientCloseEndsConnection = &falsex
+			}
+		}
+	}
+
+	serverNames := make(map[string]*Backend)
+	beKeys := make(map[beKey]bool)
+	quicPassthroughNames := make(map[string]bool)
+	for i, be := range cfg.Backends {
+		for j, sn := range be.ServerNames {
+			sn = idnaToASCII(sn)
+			be.ServerNames[j] = sn
+			// QUIC passthrough connections are received on a different
+			// address. Their server names don't conflict with the other
+			// backends.
+			if be.Mode == ModeQUICPassthrough {
+				if quicPassthroughNames[sn] {
+					return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q", i, sn)
+				}
+				quicPassthroughNames[sn] = true
+				continue
+			}
+			if serverNames[sn] == nil {
+				serverNames[sn] = be
+			} else if len(*be.ALPNProtos) == 0 {
+				return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q", i, sn)
+			}
+			for _, proto := range *be.ALPNProtos {
+				key := beKey{serverName: sn, proto: proto}
+				if beKeys[key] {
+					return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q alpnProto %q combination", i, sn, proto)
+				}
+				beKeys[key] = true
+			}
+		}
+	}
 
-// Check checks that the Config is valid, sets some default values, and
-// initializes internal data structures.
-func (cfg *Config) Check() error {
-	cfg.Definitions = nil
-	if cfg.CacheDir == "" {
-		d, err := os.UserCacheDir()
-		if err != nil {
-			return errors.New("CacheDir must be set in config")
+	pkis := make(map[string]bool)
+	for i, p := range cfg.PKI {
+		if pkis[p.Name] {
+			return fmt.Errorf("pki[%d].Name: duplicate name %q", i, p.Name)
+		}
+		pkis[p.Name] = true
+		if p.Endpoint != "" {
+			host, _, _, err := hostAndPath(p.Endpoint)
+			if err != nil {
+				return fmt.Errorf("pki[%d].Endpoint %q: %v", i, p.Endpoint, err)
+			}
+			if be := serverNames[host]; be == nil {
+				return fmt.Errorf("pki[%d].Endpoint %q: backend not found", i, p.Endpoint)
+			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("pki[%d].Endpoint %q: backend must have mode %s or %s, found %s", i, p.Endpoint, ModeLocal, ModeConsole, mode)
+			}
+		}
+		if p.ESTEndpoint != "" {
+			host, _, _, err := hostAndPath(p.ESTEndpoint)
+			if err != nil {
+				return fmt.Errorf("pki[%d].ESTEndpoint %q: %v", i, p.ESTEndpoint, err)
+			}
+			if be := serverNames[host]; be == nil {
+				return fmt.Errorf("pki[%d].ESTEndpoint %q: backend not found", i, p.ESTEndpoint)
+			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("pki[%d].ESTEndpoint %q: backend must have mode %s or %s, found %s", i, p.ESTEndpoint, ModeLocal, ModeConsole, mode)
+			} else if be.SSO == nil {
+				return fmt.Errorf("pki[%d].ESTEndpoint %q: backend must have SSO", i, p.ESTEndpoint)
+			}
 		}
-		cfg.CacheDir = filepath.Join(d, "tlsproxy", "letsencrypt")
-	}
-	if cfg.TLSAddr == "" {
-		cfg.TLSAddr = ":10443"
 	}
-	if cfg.MaxOpen == 0 {
-		n, err := openFileLimit()
-		if err != nil {
-			return errors.New("MaxOpen: value must be set")
+
+	if l := cfg.Log; l != nil {
+		if l.Format != "" && !slices.Contains(validLogFormats, l.Format) {
+			return fmt.Errorf("log.Format: value %q must be one of %v", l.Format, validLogFormats)
+		}
+		if _, err := logging.ParseLevel(l.Level); err != nil {
+			return fmt.Errorf("log.Level: %w", err)
+		}
+		for c, v := range l.Components {
+			if !slices.Contains(validLogComponents, c) {
+				return fmt.Errorf("log.Components: invalid component %q, valid values are %v", c, validLogComponents)
+			}
+			if _, err := logging.ParseLevel(v); err != nil {
+				return fmt.Errorf("log.Components[%s]: %w", c, err)
+			}
+		}
+		if err := l.sink().check("log"); err != nil {
+			return err
 		}
-		cfg.MaxOpen = n/2 - 100
 	}
-	if cfg.EnableQUIC == nil {
-		v := quicIsEnabled
-		cfg.EnableQUIC = &v
+
+	ipLists := make(map[string]bool)
+	for i, l := range cfg.IPLists {
+		if l.Name == "" {
+			return fmt.Errorf("ipLists[%d].Name: must be set", i)
+		}
+		if ipLists[l.Name] {
+			return fmt.Errorf("ipLists[%d].Name: duplicate name %q", i, l.Name)
+		}
+		ipLists[l.Name] = true
+		if u, err := url.Parse(l.Source); err != nil || (u.Scheme != "https" && u.Scheme != "http" && !isFileName(l.Source)) {
+			return fmt.Errorf("ipLists[%d].Source: must be an absolute path or a http(s) URL", i)
+		}
+		if l.RefreshInterval < 0 {
+			return fmt.Errorf("ipLists[%d].RefreshInterval: must be positive", i)
+		}
+		if l.RefreshInterval == 0 {
+			l.RefreshInterval = time.Hour
+		}
 	}
-	if *cfg.EnableQUIC && !quicIsEnabled {
-		return errors.New("EnableQUIC: QUIC is not supported in this binary")
+
+	if tf := cfg.ThreatFeeds; tf != nil {
+		if len(tf.IPLists) == 0 {
+			return errors.New("threatFeeds.IPLists: must not be empty")
+		}
+		for i, n := range tf.IPLists {
+			if !ipLists[n] {
+				return fmt.Errorf("threatFeeds.IPLists[%d]: undefined name %q", i, n)
+			}
+		}
+		if tf.Action == "" {
+			tf.Action = RejectClose
+		}
+		tf.Action = strings.ToLower(tf.Action)
+		if tf.Action != RejectClose && tf.Action != RejectTarpit {
+			return fmt.Errorf("threatFeeds.Action: value %q must be one of [%s %s]", tf.Action, RejectClose, RejectTarpit)
+		}
+		if tf.TarpitDelay < 0 {
+			return errors.New("threatFeeds.TarpitDelay: value must be positive")
+		}
+		if tf.TarpitDelay == 0 {
+			tf.TarpitDelay = 10 * time.Second
+		}
+		tf.exemptIPs = nil
+		for i, c := range tf.ExemptIPs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("threatFeeds.ExemptIPs[%d]: %w", i, err)
+			}
+			tf.exemptIPs = append(tf.exemptIPs, n)
+		}
 	}
-	cfg.acceptProxyHeaderFrom = make([]*net.IPNet, len(cfg.AcceptProxyHeaderFrom))
-	for i, c := range cfg.AcceptProxyHeaderFrom {
-		_, n, err := net.ParseCIDR(c)
-		if err != nil {
-			return fmt.Errorf("AcceptProxyHeaderFrom[%d]: %w", i, err)
+
+	if rl := cfg.RateLimit; rl != nil {
+		if rl.ConnectionsPerIP < 0 || rl.ConnectionsPerSubject < 0 || rl.Burst < 0 || rl.BanThreshold < 0 || rl.BanWindow < 0 || rl.BanDuration < 0 || rl.MaxTarpitConnections < 0 || rl.TarpitDuration < 0 {
+			return errors.New("rateLimit: values must be positive")
+		}
+		if rl.Tarpit && rl.BanThreshold == 0 {
+			return errors.New("rateLimit.Tarpit: requires BanThreshold")
+		}
+		if rl.MaxTarpitConnections == 0 {
+			rl.MaxTarpitConnections = 100
+		}
+		if rl.TarpitDuration == 0 {
+			rl.TarpitDuration = 5 * time.Minute
+		}
+		if rl.Burst == 0 {
+			rl.Burst = 10
+		}
+		if rl.BanWindow == 0 {
+			rl.BanWindow = time.Minute
+		}
+		if rl.BanDuration == 0 {
+			rl.BanDuration = 10 * time.Minute
+		}
+		rl.exemptIPs = nil
+		for i, c := range rl.ExemptIPs {
+			_, n, err := net.ParseCIDR(c)
+			if err != nil {
+				return fmt.Errorf("rateLimit.ExemptIPs[%d]: %w", i, err)
+			}
+			rl.exemptIPs = append(rl.exemptIPs, n)
 		}
-		cfg.acceptProxyHeaderFrom[i] = n
 	}
 
-	cfg.DefaultServerName = idnaToASCII(cfg.DefaultServerName)
+	if dd := cfg.DockerDiscovery; dd != nil {
+		if _, err := docker.New(dd.Endpoint); err != nil {
+			return fmt.Errorf("dockerDiscovery.Endpoint: %w", err)
+		}
+		if dd.Interval < 0 {
+			return errors.New("dockerDiscovery.Interval: value must be positive")
+		}
+		if t := dd.Template; t != nil && (len(t.ServerNames) > 0 || len(t.ServerNameRegexps) > 0 || len(t.Addresses) > 0) {
+			return errors.New("dockerDiscovery.Template: ServerNames and Addresses must be empty")
+		}
+	}
 
-	identityProviders := make(map[string]bool)
-	for i, oi := range cfg.OIDCProviders {
-		if identityProviders[oi.Name] {
-			return fmt.Errorf("oidc[%d].Name: duplicate provider name %q", i, oi.Name)
+	if cq := cfg.ConnectionQuota; cq != nil {
+		if cq.MaxConnections != 0 {
+			return errors.New("connectionQuota.MaxConnections: must be zero, use MaxOpen instead")
 		}
-		identityProviders[oi.Name] = true
+		if err := cq.check(); err != nil {
+			return fmt.Errorf("connectionQuota.%w", err)
+		}
+	}
 
-		if (oi.AuthEndpoint == "" || oi.TokenEndpoint == "") && oi.DiscoveryURL == "" {
-			return fmt.Errorf("oidc[%d] AuthEndpoint and TokenEndpoint must be set unless DiscoveryURL is set", i)
+	if rp := cfg.RejectPolicy; rp != nil {
+		if rp.Action == "" {
+			rp.Action = RejectAlert
 		}
-		if oi.DiscoveryURL != "" {
-			if _, err := url.Parse(oi.DiscoveryURL); err != nil {
-				return fmt.Errorf("oidc[%d].DiscoveryURL: %v", i, err)
-			}
+		rp.Action = strings.ToLower(rp.Action)
+		if !slices.Contains(validRejectActions, rp.Action) {
+			return fmt.Errorf("rejectPolicy.Action: value %q must be one of %v", rp.Action, validRejectActions)
 		}
-		if oi.AuthEndpoint != "" {
-			if _, err := url.Parse(oi.AuthEndpoint); err != nil {
-				return fmt.Errorf("oidc[%d].AuthEndpoint: %v", i, err)
+		if rp.TarpitDelay < 0 {
+			return errors.New("rejectPolicy.TarpitDelay: value must be positive")
+		}
+		if rp.TarpitDelay == 0 {
+			rp.TarpitDelay = 10 * time.Second
+		}
+		rp.ServerName = idnaToASCII(rp.ServerName)
+		if (rp.Action == RejectRoute) != (rp.ServerName != "") {
+			return fmt.Errorf("rejectPolicy.ServerName: must be set when Action is %s, and only then", RejectRoute)
+		}
+		if rp.ServerName != "" {
+			// The rejected connections can have any server name. The
+			// backend needs a static certificate so that the proxy
+			// doesn't try to get one from Let's Encrypt for them.
+			if be := serverNames[rp.ServerName]; be == nil {
+				return fmt.Errorf("rejectPolicy.ServerName: backend %q not found", rp.ServerName)
+			} else if be.CertFile == "" && be.Mode != ModeTLSPassthrough {
+				return fmt.Errorf("rejectPolicy.ServerName: backend %q must have a CertFile", rp.ServerName)
 			}
 		}
-		if oi.TokenEndpoint != "" {
-			if _, err := url.Parse(oi.TokenEndpoint); err != nil {
-				return fmt.Errorf("oidc[%d].TokenEndpoint: %v", i, err)
+	}
+
+	if cm := cfg.CertificateMonitor; cm != nil {
+		if cm.Interval < 0 {
+			return errors.New("certificateMonitor.Interval: value must be positive")
+		}
+		if cm.Interval == 0 {
+			cm.Interval = defaultCertMonitorInterval
+		}
+		if cm.AlertBefore < 0 {
+			return errors.New("certificateMonitor.AlertBefore: value must be positive")
+		}
+		if cm.AlertBefore == 0 {
+			cm.AlertBefore = defaultCertMonitorAlertBefore
+		}
+		if cm.WebhookURL != "" {
+			u, err := url.Parse(cm.WebhookURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("certificateMonitor.WebhookURL: invalid URL %q", cm.WebhookURL)
 			}
 		}
-		if oi.RedirectURL == "" {
-			return fmt.Errorf("oidc[%d].RedirectURL must be set", i)
+	}
+
+	sshCAs := make(map[string]bool)
+	for i, ca := range cfg.SSHCertificateAuthorities {
+		if sshCAs[ca.Name] {
+			return fmt.Errorf("sshCertificateAuthorities[%d].Name: duplicate name %q", i, ca.Name)
 		}
-		if _, err := url.Parse(oi.RedirectURL); err != nil {
-			return fmt.Errorf("oidc[%d].RedirectURL: %v", i, err)
+		sshCAs[ca.Name] = true
+		if ca.KeyType != "" && !slices.Contains(validSSHKeyTypes, strings.ToLower(ca.KeyType)) {
+			return fmt.Errorf("sshCertificateAuthorities[%d].KeyType: value %q must be one of %v", i, ca.KeyType, validSSHKeyTypes)
 		}
-		if oi.ClientID == "" {
-			return fmt.Errorf("oidc[%d].ClientID must be set", i)
+		if ca.MaximumCertificateLifetime < 0 {
+			return fmt.Errorf("sshCertificateAuthorities[%d].MaximumCertificateLifetime: must be positive", i)
 		}
-		if oi.ClientSecret == "" {
-			return fmt.Errorf("oidc[%d].ClientSecret must be set", i)
+		if ca.CertificateEndpoint == "" {
+			return fmt.Errorf("sshCertificateAuthorities[%d].CertificateEndpoint: must be set", i)
 		}
-		if oi.Domain != "" {
-			oi.Domain = idnaToASCII(oi.Domain)
-			host, _, _, err := hostAndPath(oi.RedirectURL)
+		for _, ep := range []struct {
+			field, value string
+			needSSO      bool
+		}{
+			{"PublicKeyEndpoint", ca.PublicKeyEndpoint, false},
+			{"CertificateEndpoint", ca.CertificateEndpoint, true},
+		} {
+			if ep.value == "" {
+				continue
+			}
+			host, _, _, err := hostAndPath(ep.value)
 			if err != nil {
-				return fmt.Errorf("oidc[%d].RedirectURL %q: %v", i, oi.RedirectURL, err)
+				return fmt.Errorf("sshCertificateAuthorities[%d].%s %q: %v", i, ep.field, ep.value, err)
 			}
-			if !strings.HasSuffix(host, oi.Domain) {
-				return fmt.Errorf("oidc[%d].Domain %q must be part of RedirectURL (%s)", i, oi.Domain, host)
+			be := serverNames[host]
+			if be == nil {
+				return fmt.Errorf("sshCertificateAuthorities[%d].%s %q: backend not found", i, ep.field, ep.value)
+			}
+			if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
+				return fmt.Errorf("sshCertificateAuthorities[%d].%s %q: backend must have mode %s or %s, found %s", i, ep.field, ep.value, ModeLocal, ModeConsole, mode)
+			}
+			if ep.needSSO && be.SSO == nil {
+				return fmt.Errorf("sshCertificateAuthorities[%d].%s %q: backend must have SSO", i, ep.field, ep.value)
 			}
 		}
 	}
-	for i, s := range cfg.SAMLProviders {
-		if identityProviders[s.Name] {
-			return fmt.Errorf("saml[%d].Name: duplicate provider name %q", i, s.Name)
+
+	bwLimits := make(map[string]bool)
+	for i, l := range cfg.BWLimits {
+		if bwLimits[l.Name] {
+			return fmt.Errorf("bwLimit[%d].Name: duplicate name %q", i, l.Name)
 		}
-		identityProviders[s.Name] = true
-		if s.SSOURL == "" {
-			return fmt.Errorf("saml[%d].SSOURL must be set", i)
+		bwLimits[l.Name] = true
+	}
+
+	dnsDomains := make(map[string]bool)
+	for i, dp := range cfg.DNSProviders {
+		dp.Type = strings.ToLower(dp.Type)
+		switch dp.Type {
+		case "cloudflare":
+			if dp.APIToken == "" || dp.ZoneID == "" {
+				return fmt.Errorf("dnsProviders[%d]: APIToken and ZoneID must be set", i)
+			}
+		case "route53":
+			if dp.AccessKeyID == "" || dp.SecretAccessKey == "" || dp.HostedZoneID == "" {
+				return fmt.Errorf("dnsProviders[%d]: AccessKeyID, SecretAccessKey, and HostedZoneID must be set", i)
+			}
+		case "rfc2136":
+			if dp.Nameserver == "" || dp.Zone == "" {
+				return fmt.Errorf("dnsProviders[%d]: Nameserver and Zone must be set", i)
+			}
+			if _, _, err := net.SplitHostPort(dp.Nameserver); err != nil {
+				return fmt.Errorf("dnsProviders[%d].Nameserver: %w", i, err)
+			}
+			if dp.TSIGKeyName != "" {
+				if _, err := base64.StdEncoding.DecodeString(dp.TSIGSecret); err != nil || dp.TSIGSecret == "" {
+					return fmt.Errorf("dnsProviders[%d].TSIGSecret: must be a base64-encoded key", i)
+				}
+			}
+			if a := strings.ToLower(dp.TSIGAlgorithm); a != "" && dns01.TSIGAlgorithms[strings.TrimSuffix(a, ".")+"."] == nil {
+				return fmt.Errorf("dnsProviders[%d].TSIGAlgorithm: unsupported algorithm %q", i, dp.TSIGAlgorithm)
+			}
+		default:
+			return fmt.Errorf("dnsProviders[%d].Type: invalid value %q, expected cloudflare, route53, or rfc2136", i, dp.Type)
 		}
-		if s.EntityID == "" {
-			return fmt.Errorf("saml[%d].EntityID must be set", i)
+		if len(dp.Domains) == 0 {
+			return fmt.Errorf("dnsProviders[%d].Domains: must have at least one domain", i)
 		}
-		if s.Certs == "" {
-			return fmt.Errorf("saml[%d].Certs must be set", i)
+		for j, d := range dp.Domains {
+			d = idnaToASCII(strings.TrimPrefix(strings.TrimSuffix(d, "."), "*."))
+			dp.Domains[j] = d
+			if !strings.Contains(d, ".") {
+				return fmt.Errorf("dnsProviders[%d].Domains[%d]: invalid domain %q", i, j, d)
+			}
+			if dnsDomains[d] {
+				return fmt.Errorf("dnsProviders[%d].Domains[%d]: duplicate domain %q", i, j, d)
+			}
+			dnsDomains[d] = true
 		}
-		if s.ACSURL == "" {
-			return fmt.Errorf("saml[%d].ACSURL must be set", i)
+	}
+
+	keyStores := make(map[string]*ConfigKeyStore)
+	for i, ks := range cfg.KeyStores {
+		if ks.Name == "" {
+			return fmt.Errorf("keyStores[%d].Name: must be set", i)
 		}
-		if s.Domain != "" {
-			s.Domain = idnaToASCII(s.Domain)
-			host, _, _, err := hostAndPath(s.ACSURL)
-			if err != nil {
-				return fmt.Errorf("saml[%d].ACSURL %q: %v", i, s.ACSURL, err)
+		if keyStores[ks.Name] != nil {
+			return fmt.Errorf("keyStores[%d].Name: duplicate name %q", i, ks.Name)
+		}
+		keyStores[ks.Name] = ks
+		p, err := newKeyStoreProvider(ks)
+		if err != nil {
+			return fmt.Errorf("keyStores[%d]: %w", i, err)
+		}
+		ks.provider = p
+	}
+
+	if acfg := cfg.ACME; acfg != nil {
+		if acfg.AccountKeyRotation < 0 {
+			return errors.New("acme.AccountKeyRotation: value must be positive")
+		}
+		if acfg.MaxConcurrentIssuance < 0 {
+			return errors.New("acme.MaxConcurrentIssuance: value must be positive")
+		}
+		if acfg.MaxConcurrentIssuance == 0 {
+			acfg.MaxConcurrentIssuance = 1
+		}
+		caNames := make(map[string]bool)
+		caDomains := make(map[string]bool)
+		var hasDefault bool
+		for i, ca := range acfg.CertificateAuthorities {
+			if ca.Name == "" || strings.ContainsAny(ca.Name, "+/ ") || ca.Name == acmeStagingName {
+				return fmt.Errorf("acme.CertificateAuthorities[%d].Name: invalid name %q", i, ca.Name)
 			}
-			if !strings.HasSuffix(host, s.Domain) {
-				return fmt.Errorf("saml[%d].Domain %q must be part of ACSURL (%s)", i, s.Domain, host)
+			if caNames[ca.Name] {
+				return fmt.Errorf("acme.CertificateAuthorities[%d].Name: duplicate name %q", i, ca.Name)
+			}
+			caNames[ca.Name] = true
+			u, err := url.Parse(ca.DirectoryURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("acme.CertificateAuthorities[%d].DirectoryURL: invalid URL %q", i, ca.DirectoryURL)
+			}
+			if (ca.EABKeyID == "") != (ca.EABHMACKey == "") {
+				return fmt.Errorf("acme.CertificateAuthorities[%d]: EABKeyID and EABHMACKey must be set together", i)
+			}
+			ca.eabHMACKey = nil
+			if ca.EABHMACKey != "" {
+				key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(ca.EABHMACKey, "="))
+				if err != nil {
+					return fmt.Errorf("acme.CertificateAuthorities[%d].EABHMACKey: must be a base64url-encoded key", i)
+				}
+				ca.eabHMACKey = key
+			}
+			ca.rootCAs = nil
+			if len(ca.RootCAs) > 0 {
+				pool, err := x509.SystemCertPool()
+				if err != nil {
+					pool = x509.NewCertPool()
+				}
+				for j, n := range ca.RootCAs {
+					if err := loadCerts(pool, n); err != nil {
+						return fmt.Errorf("acme.CertificateAuthorities[%d].RootCAs[%d]: %w", i, j, err)
+					}
+				}
+				ca.rootCAs = pool
+			}
+			if len(ca.Domains) == 0 {
+				if hasDefault {
+					return fmt.Errorf("acme.CertificateAuthorities[%d].Domains: only one CA can be the default", i)
+				}
+				hasDefault = true
+			}
+			for j, d := range ca.Domains {
+				d = idnaToASCII(strings.TrimPrefix(strings.TrimSuffix(d, "."), "*."))
+				ca.Domains[j] = d
+				if !strings.Contains(d, ".") {
+					return fmt.Errorf("acme.CertificateAuthorities[%d].Domains[%d]: invalid domain %q", i, j, d)
+				}
+				if caDomains[d] {
+					return fmt.Errorf("acme.CertificateAuthorities[%d].Domains[%d]: duplicate domain %q", i, j, d)
+				}
+				caDomains[d] = true
 			}
 		}
+		if acfg.Staging && hasDefault {
+			return errors.New("acme.Staging: only valid when Let's Encrypt is the default CA")
+		}
 	}
-	for i, pp := range cfg.PasskeyProviders {
-		if identityProviders[pp.Name] {
-			return fmt.Errorf("passkey[%d].Name: duplicate provider name %q", i, pp.Name)
+
+	for i, be := range cfg.Backends {
+		if len(be.ServerNames) == 0 && len(be.ServerNameRegexps) == 0 {
+			return fmt.Errorf("backend[%d].ServerNames: backend must have at least one server name", i)
 		}
-		identityProviders[pp.Name] = true
-		if pp.Endpoint == "" {
-			return fmt.Errorf("passkey[%d].Endpoint must be set", i)
+		be.serverNameRegexps = nil
+		for j, expr := range be.ServerNameRegexps {
+			re, err := regexp.Compile(`^(?:` + expr + `)$`)
+			if err != nil {
+				return fmt.Errorf("backend[%d].ServerNameRegexps[%d]: %w", i, j, err)
+			}
+			be.serverNameRegexps = append(be.serverNameRegexps, re)
 		}
-		if pp.IdentityProvider == "" {
-			return fmt.Errorf("passkey[%d].IdentityProvider must be set", i)
+		if be.KeyStore != "" {
+			if be.KeyFile != "" {
+				return fmt.Errorf("backend[%d]: KeyFile and KeyStore are mutually exclusive", i)
+			}
+			if keyStores[be.KeyStore] == nil {
+				return fmt.Errorf("backend[%d].KeyStore: unknown key store %q", i, be.KeyStore)
+			}
+			if be.KeyID == "" || be.CertFile == "" {
+				return fmt.Errorf("backend[%d]: KeyStore requires KeyID and CertFile", i)
+			}
+		} else if be.KeyID != "" {
+			return fmt.Errorf("backend[%d].KeyID: requires KeyStore", i)
+		} else if (be.CertFile == "") != (be.KeyFile == "") {
+			return fmt.Errorf("backend[%d]: CertFile and KeyFile must be set together", i)
 		}
-		if _, ok := identityProviders[pp.IdentityProvider]; !ok {
-			return fmt.Errorf("passkey[%d].IdentityProvider has unexpected value %q", i, pp.IdentityProvider)
+		if slices.Contains(be.ServerNames, CatchAllServerName) {
+			if be.Mode == ModeQUICPassthrough {
+				return fmt.Errorf("backend[%d].ServerNames: %q is not valid in mode %s", i, CatchAllServerName, be.Mode)
+			}
+			if be.CertFile == "" && be.Mode != ModeTLSPassthrough {
+				return fmt.Errorf("backend[%d].CertFile: must be set when ServerNames contains %q", i, CatchAllServerName)
+			}
+		}
+		if be.CertFile != "" {
+			if be.Mode == ModeTLSPassthrough || be.Mode == ModeQUICPassthrough {
+				return fmt.Errorf("backend[%d].CertFile: not compatible with TLS Passthrough", i)
+			}
+		}
+		if od := be.OnDemandCertificates; od != nil {
+			if be.Mode == ModeTLSPassthrough || be.Mode == ModeQUICPassthrough {
+				return fmt.Errorf("backend[%d].OnDemandCertificates: field is not valid in mode %s", i, be.Mode)
+			}
+			if od.MaxPerWeek < 1 {
+				return fmt.Errorf("backend[%d].OnDemandCertificates.MaxPerWeek: must be at least 1", i)
+			}
+		}
+		if fc := be.ForwardClientCert; fc != nil {
+			if fc.KeyStore != "" {
+				if fc.KeyFile != "" {
+					return fmt.Errorf("backend[%d].ForwardClientCert: KeyFile and KeyStore are mutually exclusive", i)
+				}
+				if keyStores[fc.KeyStore] == nil {
+					return fmt.Errorf("backend[%d].ForwardClientCert.KeyStore: unknown key store %q", i, fc.KeyStore)
+				}
+				if fc.KeyID == "" || fc.CertFile == "" {
+					return fmt.Errorf("backend[%d].ForwardClientCert: KeyStore requires KeyID and CertFile", i)
+				}
+			} else if fc.KeyID != "" {
+				return fmt.Errorf("backend[%d].ForwardClientCert.KeyID: requires KeyStore", i)
+			} else if (fc.CertFile == "") != (fc.KeyFile == "") {
+				return fmt.Errorf("backend[%d].ForwardClientCert: CertFile and KeyFile must be set together", i)
+			}
+			if (fc.CertFile == "") == (fc.PKI == "") {
+				return fmt.Errorf("backend[%d].ForwardClientCert: exactly one of CertFile or PKI must be set", i)
+			}
+			if fc.PKI == "" && (fc.CommonName != "" || fc.Lifetime != 0) {
+				return fmt.Errorf("backend[%d].ForwardClientCert: CommonName and Lifetime require PKI", i)
+			}
+			if fc.PKI != "" && !slices.ContainsFunc(cfg.PKI, func(pp *ConfigPKI) bool { return pp.Name == fc.PKI }) {
+				return fmt.Errorf("backend[%d].ForwardClientCert.PKI: unknown PKI %q", i, fc.PKI)
+			}
+			if fc.PKI != "" && fc.CommonName == "" && (len(be.ServerNames) == 0 || be.ServerNames[0] == CatchAllServerName) {
+				return fmt.Errorf("backend[%d].ForwardClientCert.CommonName: must be set when ServerNames is empty or starts with %q", i, CatchAllServerName)
+			}
+			if fc.Lifetime < 0 {
+				return fmt.Errorf("backend[%d].ForwardClientCert.Lifetime: must be positive", i)
+			}
+		}
+		if ad := be.AddressDiscovery; ad != nil {
+			if len(be.Addresses) > 0 {
+				return fmt.Errorf("backend[%d].AddressDiscovery: Addresses must be empty", i)
+			}
+			if (ad.SRV == "") == (ad.ConsulService == "") {
+				return fmt.Errorf("backend[%d].AddressDiscovery: exactly one of SRV or ConsulService must be set", i)
+			}
+			if ad.ConsulService == "" && (ad.ConsulTag != "" || ad.ConsulAddress != "" || ad.ConsulToken != "") {
+				return fmt.Errorf("backend[%d].AddressDiscovery: Consul parameters require ConsulService", i)
+			}
+			if ad.ConsulService != "" {
+				if _, err := consul.New(ad.ConsulAddress, ad.ConsulToken); err != nil {
+					return fmt.Errorf("backend[%d].AddressDiscovery.ConsulAddress: %w", i, err)
+				}
+			}
+			if ad.RefreshInterval < 0 {
+				return fmt.Errorf("backend[%d].AddressDiscovery.RefreshInterval: must be positive", i)
+			}
 		}
-		if pp.Domain != "" {
-			pp.Domain = idnaToASCII(pp.Domain)
-			host, _, _, err := hostAndPath(pp.Endpoint)
-			if err != nil {
-				return fmt.Errorf("passkey[%d].Endpoint %q: %v", i, pp.Endpoint, err)
+		if len(be.AddressGroups) > 0 {
+			if len(be.Addresses) > 0 || be.AddressDiscovery != nil {
+				return fmt.Errorf("backend[%d].AddressGroups: Addresses and AddressDiscovery must be empty", i)
 			}
-			if !strings.HasSuffix(host, pp.Domain) {
-				return fmt.Errorf("passkey[%d].Domain %q must be part of Endpoint (%s)", i, pp.Domain, host)
+			var total int
+			names := make(map[string]bool)
+			for j, g := range be.AddressGroups {
+				if g.Name == "" || names[g.Name] {
+					return fmt.Errorf("backend[%d].AddressGroups[%d].Name: must be set and unique", i, j)
+				}
+				names[g.Name] = true
+				if len(g.Addresses) == 0 {
+					return fmt.Errorf("backend[%d].AddressGroups[%d].Addresses: at least one address is required", i, j)
+				}
+				if g.Weight < 0 {
+					return fmt.Errorf("backend[%d].AddressGroups[%d].Weight: value cannot be negative", i, j)
+				}
+				total += g.Weight
+			}
+			if total == 0 {
+				return fmt.Errorf("backend[%d].AddressGroups: at least one group must have a positive weight", i)
 			}
 		}
-	}
-
-	for i, be := range cfg.Backends {
-		be.state = new(backendState)
-		be.state.oNext = make([]int, len(be.PathOverrides))
-		be.Mode = strings.ToUpper(be.Mode)
-		if be.Mode == "" || be.Mode == ModePlaintext {
-			be.Mode = ModeTCP
+		hasAddresses := len(be.Addresses) > 0 || be.AddressDiscovery != nil || len(be.AddressGroups) > 0
+		if !hasAddresses && be.Mode != ModeConsole && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal && be.Mode != ModeRedirect && be.Mode != ModeProxy && be.Mode != ModeSOCKS5 {
+			return fmt.Errorf("backend[%d].Addresses: backend must have at least one address", i)
 		}
-		if !slices.Contains(validModes, be.Mode) {
-			return fmt.Errorf("backend[%d].Mode: value %q must be one of %v", i, be.Mode, validModes)
+		if hasAddresses && (be.Mode == ModeConsole || be.Mode == ModeLocal || be.Mode == ModeRedirect || be.Mode == ModeProxy || be.Mode == ModeSOCKS5) {
+			return fmt.Errorf("backend[%d].Addresses: Addresses should be empty when Mode is CONSOLE, LOCAL, REDIRECT, PROXY, or SOCKS5", i)
 		}
-		if be.Mode == ModeTLSPassthrough && be.ClientAuth != nil {
-			return fmt.Errorf("backend[%d].ClientAuth: client auth is not compatible with TLS Passthrough", i)
+		if (be.Mode == ModeRedirect) != (be.Redirect != nil) {
+			return fmt.Errorf("backend[%d].Redirect: must be set when Mode is %s, and only then", i, ModeRedirect)
 		}
-		if be.ALPNProtos == nil {
-			if *cfg.EnableQUIC && (be.Mode == ModeHTTP || be.Mode == ModeHTTPS || be.Mode == ModeQUIC || be.Mode == ModeLocal || be.Mode == ModeConsole) {
-				be.ALPNProtos = defaultALPNProtosPlusH3
-			} else {
-				be.ALPNProtos = defaultALPNProtos
+		if r := be.Redirect; r != nil {
+			if err := r.check(); err != nil {
+				return fmt.Errorf("backend[%d].Redirect.%w", i, err)
+			}
+			if be.DocumentRoot != "" {
+				return fmt.Errorf("backend[%d].DocumentRoot is not valid in mode %s", i, be.Mode)
 			}
 		}
-		if be.BackendProto != nil && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
-			return fmt.Errorf("backend[%d].BackendProto: field is not valid in mode %s", i, be.Mode)
+		if (be.Mode == ModeProxy || be.Mode == ModeSOCKS5) != (be.ForwardProxy != nil) {
+			return fmt.Errorf("backend[%d].ForwardProxy: must be set when Mode is %s or %s, and only then", i, ModeProxy, ModeSOCKS5)
 		}
-		if be.Mode == ModeQUIC {
-			var falsex bool
-			if be.ServerCloseEndsConnection == nil {
-				be.ServerCloseEndsConnection = &falsex
+		if db := be.Database; db != nil {
+			if be.Mode != ModePostgres && be.Mode != ModeMySQL {
+				return fmt.Errorf("backend[%d].Database: field is not valid in mode %s", i, be.Mode)
 			}
-			if be.ClientCloseEndsConnection == nil {
-				be.ClientCloseEndsConnection = &falsex
+			if err := db.check(be.Mode); err != nil {
+				return fmt.Errorf("backend[%d].Database.%w", i, err)
 			}
 		}
-	}
-
-	serverNames := make(map[string]*Backend)
-	beKeys := make(map[beKey]bool)
-	for i, be := range cfg.Backends {
-		for j, sn := range be.ServerNames {
-			sn = idnaToASCII(sn)
-			be.ServerNames[j] = sn
-			if serverNames[sn] == nil {
-				serverNames[sn] = be
-			} else if len(*be.ALPNProtos) == 0 {
-				return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q", i, sn)
+		if ca := be.ConsoleAuth; ca != nil {
+			if be.Mode != ModeConsole {
+				return fmt.Errorf("backend[%d].ConsoleAuth: field is not valid in mode %s", i, be.Mode)
 			}
-			for _, proto := range *be.ALPNProtos {
-				key := beKey{serverName: sn, proto: proto}
-				if beKeys[key] {
-					return fmt.Errorf("backend[%d].ServerNames: duplicate server name %q alpnProto %q combination", i, sn, proto)
-				}
-				beKeys[key] = true
+			if err := ca.check(); err != nil {
+				return fmt.Errorf("backend[%d].ConsoleAuth.%w", i, err)
+			}
+			if be.SSO == nil && be.ClientAuth == nil {
+				return fmt.Errorf("backend[%d].ConsoleAuth: SSO or ClientAuth is required to authenticate the users", i)
 			}
 		}
-	}
-
-	pkis := make(map[string]bool)
-	for i, p := range cfg.PKI {
-		if pkis[p.Name] {
-			return fmt.Errorf("pki[%d].Name: duplicate name %q", i, p.Name)
-		}
-		pkis[p.Name] = true
-		if p.Endpoint != "" {
-			host, _, _, err := hostAndPath(p.Endpoint)
-			if err != nil {
-				return fmt.Errorf("pki[%d].Endpoint %q: %v", i, p.Endpoint, err)
+		if be.ConsoleDebug != nil {
+			if be.Mode != ModeConsole {
+				return fmt.Errorf("backend[%d].ConsoleDebug: field is not valid in mode %s", i, be.Mode)
 			}
-			if be := serverNames[host]; be == nil {
-				return fmt.Errorf("pki[%d].Endpoint %q: backend not found", i, p.Endpoint)
-			} else if mode := strings.ToUpper(be.Mode); mode != ModeLocal && mode != ModeConsole {
-				return fmt.Errorf("pki[%d].Endpoint %q: backend must have mode %s or %s, found %s", i, p.Endpoint, ModeLocal, ModeConsole, mode)
+			if be.ConsoleAuth == nil {
+				return fmt.Errorf("backend[%d].ConsoleDebug: ConsoleAuth must be set", i)
 			}
 		}
-	}
-
-	bwLimits := make(map[string]bool)
-	for i, l := range cfg.BWLimits {
-		if bwLimits[l.Name] {
-			return fmt.Errorf("bwLimit[%d].Name: duplicate name %q", i, l.Name)
-		}
-		bwLimits[l.Name] = true
-	}
-
-	for i, be := range cfg.Backends {
-		if len(be.ServerNames) == 0 {
-			return fmt.Errorf("backend[%d].ServerNames: backend must have at least one server name", i)
-		}
-		if len(be.Addresses) == 0 && be.Mode != ModeConsole && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
-			return fmt.Errorf("backend[%d].Addresses: backend must have at least one address", i)
+		if fp := be.ForwardProxy; fp != nil {
+			if err := fp.check(); err != nil {
+				return fmt.Errorf("backend[%d].ForwardProxy.%w", i, err)
+			}
+			if be.ClientAuth == nil && len(fp.Users) == 0 {
+				return fmt.Errorf("backend[%d].ForwardProxy: ClientAuth or Users is required to authenticate the clients", i)
+			}
+			if be.SSO != nil {
+				return fmt.Errorf("backend[%d].SSO is not valid in mode %s", i, be.Mode)
+			}
+			if be.DocumentRoot != "" {
+				return fmt.Errorf("backend[%d].DocumentRoot is not valid in mode %s", i, be.Mode)
+			}
+			if be.Mode == ModeProxy && slices.ContainsFunc(*be.ALPNProtos, func(p string) bool { return p != "http/1.1" && p != "h3" }) {
+				return fmt.Errorf("backend[%d].ALPNProtos: only http/1.1 and h3 are supported in mode %s", i, be.Mode)
+			}
 		}
-		if len(be.Addresses) > 0 && (be.Mode == ModeConsole || be.Mode == ModeLocal) {
-			return fmt.Errorf("backend[%d].Addresses: Addresses should be empty when Mode is CONSOLE or LOCAL", i)
+		if sf := be.StaticFiles; sf != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
+				return fmt.Errorf("backend[%d].StaticFiles is not valid in mode %s", i, be.Mode)
+			}
+			for j, n := range sf.IndexFiles {
+				if n == "" || strings.HasPrefix(n, ".") || strings.ContainsAny(n, `/\`) {
+					return fmt.Errorf("backend[%d].StaticFiles.IndexFiles[%d]: invalid file name %q", i, j, n)
+				}
+			}
+			if !httpguts.ValidHeaderFieldValue(sf.CacheControl) {
+				return fmt.Errorf("backend[%d].StaticFiles.CacheControl: invalid value %q", i, sf.CacheControl)
+			}
 		}
-		if be.DocumentRoot != "" && len(be.Addresses) != 0 {
+		if be.DocumentRoot != "" && hasAddresses {
 			return fmt.Errorf("backend[%d].DocumentRoot: only valid when Addresses is empty", i)
 		}
 		if n := be.BWLimit; n != "" && !bwLimits[n] {
@@ -938,17 +4271,64 @@ func (cfg *Config) Check() error {
 					return fmt.Errorf("backend[%d].ClientAuth.RootCAs[%d]: %w", i, j, err)
 				}
 			}
+			if be.ClientAuth.ACL != nil {
+				if err := validateACL(*be.ClientAuth.ACL); err != nil {
+					return fmt.Errorf("backend[%d].ClientAuth.ACL%w", i, err)
+				}
+			}
+			if err := validateACL(be.ClientAuth.DenyACL); err != nil {
+				return fmt.Errorf("backend[%d].ClientAuth.DenyACL%w", i, err)
+			}
+			for j, c := range be.ClientAuth.CRLs {
+				if strings.HasPrefix(c, "https://") || strings.HasPrefix(c, "http://") {
+					if _, err := url.Parse(c); err != nil {
+						return fmt.Errorf("backend[%d].ClientAuth.CRLs[%d]: %w", i, j, err)
+					}
+					continue
+				}
+				if _, err := os.Stat(c); err != nil {
+					return fmt.Errorf("backend[%d].ClientAuth.CRLs[%d]: %w", i, j, err)
+				}
+			}
+			if m := be.ClientAuth.Mode; m != "" && !slices.Contains(validClientAuthModes, m) {
+				return fmt.Errorf("backend[%d].ClientAuth.Mode: value %q must be one of %v", i, m, validClientAuthModes)
+			}
+			if p := be.ClientAuth.RevocationPolicy; p != "" && !slices.Contains(validRevocationPolicies, p) {
+				return fmt.Errorf("backend[%d].ClientAuth.RevocationPolicy: value %q must be one of %v", i, be.ClientAuth.RevocationPolicy, validRevocationPolicies)
+			}
 			for _, f := range be.ClientAuth.AddClientCertHeader {
 				if !slices.Contains(validXFCCFields, strings.ToLower(f)) {
 					return fmt.Errorf("backend[%d].ClientAuth.AddClientCertHeader: invalid field %q, valid values are %v", i, f, validXFCCFields)
 				}
 			}
+			if len(be.ClientAuth.ClientCertHeaders) > 0 && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ClientAuth.ClientCertHeaders is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			for f, h := range be.ClientAuth.ClientCertHeaders {
+				if !slices.Contains(validClientCertHeaderFields, f) {
+					return fmt.Errorf("backend[%d].ClientAuth.ClientCertHeaders: invalid field %q, valid values are %v", i, f, validClientCertHeaderFields)
+				}
+				if !httpguts.ValidHeaderFieldName(h) {
+					return fmt.Errorf("backend[%d].ClientAuth.ClientCertHeaders[%s]: invalid header name %q", i, f, h)
+				}
+			}
 		}
 
 		if be.SSO != nil {
 			if !identityProviders[be.SSO.Provider] {
 				return fmt.Errorf("backend[%d].SSO.Provider: unknown provider %q", i, be.SSO.Provider)
 			}
+			if be.SSO.ACL != nil {
+				if err := validateACL(*be.SSO.ACL); err != nil {
+					return fmt.Errorf("backend[%d].SSO.ACL%w", i, err)
+				}
+			}
+			if err := validateACL(be.SSO.DenyACL); err != nil {
+				return fmt.Errorf("backend[%d].SSO.DenyACL%w", i, err)
+			}
+			if h := be.SSO.UserIDHeader; h != "" && !httpguts.ValidHeaderFieldName(h) {
+				return fmt.Errorf("backend[%d].SSO.UserIDHeader: invalid header name %q", i, h)
+			}
 			if be.SSO.LocalOIDCServer != nil {
 				for j, client := range be.SSO.LocalOIDCServer.Clients {
 					if client.ID == "" {
@@ -989,6 +4369,63 @@ func (cfg *Config) Check() error {
 		if be.ForwardTimeout == 0 {
 			be.ForwardTimeout = 30 * time.Second
 		}
+		if be.DialSourceAddress != "" && be.Mode == ModeQUIC {
+			return fmt.Errorf("backend[%d].DialSourceAddress: field is not valid in mode %s", i, be.Mode)
+		}
+		if be.DialInterface != "" && be.Mode == ModeQUIC {
+			return fmt.Errorf("backend[%d].DialInterface: field is not valid in mode %s", i, be.Mode)
+		}
+		be.dialSourceIP = nil
+		if be.DialSourceAddress != "" {
+			if be.dialSourceIP = net.ParseIP(be.DialSourceAddress); be.dialSourceIP == nil {
+				return fmt.Errorf("backend[%d].DialSourceAddress: invalid IP address %q", i, be.DialSourceAddress)
+			}
+		}
+		if be.DialInterface != "" && !bindToDeviceSupported {
+			return fmt.Errorf("backend[%d].DialInterface: not supported on this platform", i)
+		}
+		be.DialAddressFamily = strings.ToLower(be.DialAddressFamily)
+		if be.DialAddressFamily == "" {
+			be.DialAddressFamily = DialIPv6First
+		}
+		if !slices.Contains(validDialAddressFamilies, be.DialAddressFamily) {
+			return fmt.Errorf("backend[%d].DialAddressFamily: value %q must be one of %v", i, be.DialAddressFamily, validDialAddressFamilies)
+		}
+		if be.DialAttemptDelay == 0 {
+			be.DialAttemptDelay = defaultDialAttemptDelay
+		}
+		if be.DialAttemptDelay < 10*time.Millisecond || be.DialAttemptDelay > 2*time.Second {
+			return fmt.Errorf("backend[%d].DialAttemptDelay: value must be between 10ms and 2s", i)
+		}
+		if res := be.Resolver; res != nil {
+			for j, s := range res.Servers {
+				if err := resolver.CheckServer(s); err != nil {
+					return fmt.Errorf("backend[%d].Resolver.Servers[%d]: %w", i, j, err)
+				}
+			}
+			res.rootCAs = nil
+			if len(res.RootCAs) > 0 {
+				res.rootCAs = x509.NewCertPool()
+			}
+			for j, n := range res.RootCAs {
+				if err := loadCerts(res.rootCAs, n); err != nil {
+					return fmt.Errorf("backend[%d].Resolver.RootCAs[%d]: %w", i, j, err)
+				}
+			}
+			if res.Timeout < 0 || res.MinTTL < 0 || res.MaxTTL < 0 || res.NegativeTTL < 0 || res.CacheSize < 0 {
+				return fmt.Errorf("backend[%d].Resolver: values must not be negative", i)
+			}
+			if res.MaxTTL > 0 && res.MinTTL > res.MaxTTL {
+				return fmt.Errorf("backend[%d].Resolver.MinTTL: value must not be greater than MaxTTL", i)
+			}
+		}
+		be.LoadBalance = strings.ToLower(be.LoadBalance)
+		if be.LoadBalance == "" {
+			be.LoadBalance = LoadBalanceRoundRobin
+		}
+		if !slices.Contains(validLoadBalancePolicies, be.LoadBalance) {
+			return fmt.Errorf("backend[%d].LoadBalance: value %q must be one of %v", i, be.LoadBalance, validLoadBalancePolicies)
+		}
 		if be.AllowIPs != nil {
 			ips := make([]*net.IPNet, 0, len(*be.AllowIPs))
 			for j, c := range *be.AllowIPs {
@@ -1000,6 +4437,26 @@ func (cfg *Config) Check() error {
 			}
 			be.allowIPs = &ips
 		}
+		for j, n := range be.AllowIPLists {
+			if !ipLists[n] {
+				return fmt.Errorf("backend[%d].AllowIPLists[%d]: undefined name %q", i, j, n)
+			}
+		}
+		for j, n := range be.DenyIPLists {
+			if !ipLists[n] {
+				return fmt.Errorf("backend[%d].DenyIPLists[%d]: undefined name %q", i, j, n)
+			}
+		}
+		for j, fp := range be.AllowFingerprints {
+			if !validateFingerprint(fp) {
+				return fmt.Errorf("backend[%d].AllowFingerprints[%d]: invalid JA3 or JA4 fingerprint %q", i, j, fp)
+			}
+		}
+		for j, fp := range be.DenyFingerprints {
+			if !validateFingerprint(fp) {
+				return fmt.Errorf("backend[%d].DenyFingerprints[%d]: invalid JA3 or JA4 fingerprint %q", i, j, fp)
+			}
+		}
 		if be.DenyIPs != nil {
 			ips := make([]*net.IPNet, 0, len(*be.DenyIPs))
 			for j, c := range *be.DenyIPs {
@@ -1021,7 +4478,252 @@ func (cfg *Config) Check() error {
 			return fmt.Errorf("backend[%d].ProxyProtocolVersion: %w", i, err)
 		}
 		be.proxyProtocolVersion = ver
+		if ver > 0 && (be.Mode == ModeQUIC || be.Mode == ModeQUICPassthrough) {
+			return fmt.Errorf("backend[%d].ProxyProtocolVersion: not supported in mode %s", i, be.Mode)
+		}
+		if be.ClientAuth != nil && be.ClientAuth.AddClientCertTLVs && ver != 2 {
+			return fmt.Errorf("backend[%d].ClientAuth.AddClientCertTLVs: requires ProxyProtocolVersion v2", i)
+		}
 
+		if fh := be.ForwardedHeaders; fh != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ForwardedHeaders is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if fh.Mode == "" {
+				fh.Mode = ForwardedReplace
+			}
+			if !slices.Contains(validForwardedModes, fh.Mode) {
+				return fmt.Errorf("backend[%d].ForwardedHeaders.Mode: value %q must be one of %v", i, fh.Mode, validForwardedModes)
+			}
+			if fh.XForwarded == nil {
+				v := true
+				fh.XForwarded = &v
+			}
+		}
+		if be.WhoAmI && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeLocal {
+			return fmt.Errorf("backend[%d].WhoAmI is only valid in %s, %s, or %s mode", i, ModeHTTP, ModeHTTPS, ModeLocal)
+		}
+		if c := be.Compression; c != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].Compression is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if err := c.check(); err != nil {
+				return fmt.Errorf("backend[%d].Compression.%w", i, err)
+			}
+		}
+		if wl := be.WebSocketLimits; wl != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].WebSocketLimits is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if wl.MaxLifetime < 0 || wl.IdleTimeout < 0 {
+				return fmt.Errorf("backend[%d].WebSocketLimits: MaxLifetime and IdleTimeout cannot be negative", i)
+			}
+		}
+		if s := be.Streaming; s != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].Streaming is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if err := s.check(); err != nil {
+				return fmt.Errorf("backend[%d].Streaming.%w", i, err)
+			}
+		}
+		if m := be.Mirror; m != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].Mirror is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if err := m.check(be.Mode); err != nil {
+				return fmt.Errorf("backend[%d].Mirror.%w", i, err)
+			}
+		}
+		if rc := be.ResponseCache; rc != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].ResponseCache is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if err := rc.check(); err != nil {
+				return fmt.Errorf("backend[%d].ResponseCache.%w", i, err)
+			}
+		}
+		if hp := be.HeaderPolicy; hp != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].HeaderPolicy is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if err := hp.Request.check(); err != nil {
+				return fmt.Errorf("backend[%d].HeaderPolicy.Request.%w", i, err)
+			}
+			if err := hp.Response.check(); err != nil {
+				return fmt.Errorf("backend[%d].HeaderPolicy.Response.%w", i, err)
+			}
+		}
+		if h := be.HSTS; h != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].HSTS is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if h.MaxAge < 0 {
+				return fmt.Errorf("backend[%d].HSTS.MaxAge: must be positive", i)
+			}
+			maxAge := h.MaxAge
+			if maxAge == 0 {
+				maxAge = defaultHSTSMaxAge
+			}
+			if h.Preload && (!h.IncludeSubDomains || maxAge < 365*24*time.Hour) {
+				return fmt.Errorf("backend[%d].HSTS.Preload: requires IncludeSubDomains and a MaxAge of at least one year", i)
+			}
+		}
+		if be.CopyBufferSize != 0 && (be.CopyBufferSize < 1024 || be.CopyBufferSize > 16<<20) {
+			return fmt.Errorf("backend[%d].CopyBufferSize: value %d must be between 1024 and 16777216", i, be.CopyBufferSize)
+		}
+		if ht := be.HTTPTransport; ht != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].HTTPTransport is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
+			}
+			if ht.MaxIdleConns < 0 || ht.MaxIdleConnsPerHost < 0 || ht.MaxConnsPerHost < 0 {
+				return fmt.Errorf("backend[%d].HTTPTransport: connection limits cannot be negative", i)
+			}
+			if ht.IdleConnTimeout < 0 || ht.HTTP2ReadIdleTimeout < 0 {
+				return fmt.Errorf("backend[%d].HTTPTransport: timeouts cannot be negative", i)
+			}
+			if ht.MaxIdleConns == 0 {
+				ht.MaxIdleConns = 100
+			}
+			if ht.MaxIdleConnsPerHost == 0 {
+				ht.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+			}
+			if ht.IdleConnTimeout == 0 {
+				ht.IdleConnTimeout = 10 * time.Second
+			}
+			if ht.HTTP2ReadIdleTimeout == 0 {
+				ht.HTTP2ReadIdleTimeout = 10 * time.Second
+			}
+		}
+		if cq := be.ConnectionQuota; cq != nil {
+			if err := cq.check(); err != nil {
+				return fmt.Errorf("backend[%d].ConnectionQuota.%w", i, err)
+			}
+		}
+		if bp := be.Backpressure; bp != nil {
+			if be.Mode == ModeQUICPassthrough {
+				return fmt.Errorf("backend[%d].Backpressure is not valid in mode %s", i, be.Mode)
+			}
+			if bp.MaxQueue < 0 || bp.QueueTimeout < 0 || bp.DialRetries < 0 || bp.RetryBackoff < 0 {
+				return fmt.Errorf("backend[%d].Backpressure: values cannot be negative", i)
+			}
+			if bp.DialRetries > 0 && be.Mode != ModeTCP && be.Mode != ModeTLS && be.Mode != ModeTLSPassthrough && be.Mode != ModeQUIC && be.Mode != ModeWebSocket {
+				return fmt.Errorf("backend[%d].Backpressure.DialRetries is not valid in mode %s", i, be.Mode)
+			}
+			if bp.QueueTimeout == 0 {
+				bp.QueueTimeout = 10 * time.Second
+			}
+			if bp.RetryBackoff == 0 {
+				bp.RetryBackoff = 100 * time.Millisecond
+			}
+		}
+		if cb := be.CircuitBreaker; cb != nil {
+			if be.Mode == ModeConsole || be.Mode == ModeLocal || be.Mode == ModeRedirect || be.Mode == ModeQUICPassthrough || be.Mode == ModeProxy || be.Mode == ModeSOCKS5 {
+				return fmt.Errorf("backend[%d].CircuitBreaker is not valid in mode %s", i, be.Mode)
+			}
+			if cb.FailureThreshold < 0 || cb.Cooldown < 0 || cb.MaxCooldown < 0 {
+				return fmt.Errorf("backend[%d].CircuitBreaker: values cannot be negative", i)
+			}
+			if cb.FailureThreshold == 0 {
+				cb.FailureThreshold = 1
+			}
+			if cb.Cooldown == 0 {
+				cb.Cooldown = 5 * time.Second
+			}
+			if cb.MaxCooldown == 0 {
+				cb.MaxCooldown = 5 * time.Minute
+			}
+			if cb.MaxCooldown < cb.Cooldown {
+				return fmt.Errorf("backend[%d].CircuitBreaker.MaxCooldown: must be at least Cooldown", i)
+			}
+		}
+		if ed := be.EarlyData; ed != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeConsole && be.Mode != ModeLocal && be.Mode != ModeWebSocket && be.Mode != ModeRedirect && be.Mode != ModeProxy {
+				return fmt.Errorf("backend[%d].EarlyData is not valid in mode %s", i, be.Mode)
+			}
+			for j, m := range ed.Methods {
+				if m == "" || strings.ToUpper(m) != m || strings.ContainsAny(m, " \t") {
+					return fmt.Errorf("backend[%d].EarlyData.Methods[%d]: invalid method %q", i, j, m)
+				}
+			}
+		}
+		if ja := be.JWTAuth; ja != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
+				return fmt.Errorf("backend[%d].JWTAuth is not valid in mode %s", i, be.Mode)
+			}
+			if len(ja.Issuers) == 0 {
+				return fmt.Errorf("backend[%d].JWTAuth.Issuers: must not be empty", i)
+			}
+			issuers := make(map[string]bool)
+			for j, iss := range ja.Issuers {
+				if iss.Issuer == "" || issuers[iss.Issuer] {
+					return fmt.Errorf("backend[%d].JWTAuth.Issuers[%d].Issuer: must be set and unique", i, j)
+				}
+				issuers[iss.Issuer] = true
+				if iss.JWKS == "" {
+					return fmt.Errorf("backend[%d].JWTAuth.Issuers[%d].JWKS: must be set", i, j)
+				}
+				if iss.RefreshInterval < 0 {
+					return fmt.Errorf("backend[%d].JWTAuth.Issuers[%d].RefreshInterval: value must not be negative", i, j)
+				}
+			}
+			if ja.ClockSkew < 0 {
+				return fmt.Errorf("backend[%d].JWTAuth.ClockSkew: value must not be negative", i)
+			}
+			if ja.ClockSkew == 0 {
+				ja.ClockSkew = time.Minute
+			}
+			for claim, h := range ja.ClaimHeaders {
+				if claim == "" || !httpguts.ValidHeaderFieldName(h) {
+					return fmt.Errorf("backend[%d].JWTAuth.ClaimHeaders: invalid claim %q or header name %q", i, claim, h)
+				}
+			}
+		}
+		if hr := be.HostRouting; hr != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeConsole && be.Mode != ModeLocal && be.Mode != ModeWebSocket && be.Mode != ModeRedirect {
+				return fmt.Errorf("backend[%d].HostRouting is not valid in mode %s", i, be.Mode)
+			}
+			for j, sn := range hr.RouteTo {
+				sn = idnaToASCII(sn)
+				hr.RouteTo[j] = sn
+				switch other := serverNames[sn]; {
+				case other == nil:
+					return fmt.Errorf("backend[%d].HostRouting.RouteTo[%d]: backend %q not found", i, j, sn)
+				case other == be:
+					return fmt.Errorf("backend[%d].HostRouting.RouteTo[%d]: %q is a server name of this backend", i, j, sn)
+				case other.Mode != ModeHTTP && other.Mode != ModeHTTPS && other.Mode != ModeConsole && other.Mode != ModeLocal && other.Mode != ModeWebSocket && other.Mode != ModeRedirect:
+					return fmt.Errorf("backend[%d].HostRouting.RouteTo[%d]: backend %q has mode %s", i, j, sn, other.Mode)
+				case other.ClientAuth != nil:
+					return fmt.Errorf("backend[%d].HostRouting.RouteTo[%d]: backend %q has ClientAuth", i, j, sn)
+				}
+			}
+		}
+		if hl := be.HTTPLimits; hl != nil {
+			if be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeConsole && be.Mode != ModeLocal && be.Mode != ModeWebSocket && be.Mode != ModeRedirect && be.Mode != ModeProxy {
+				return fmt.Errorf("backend[%d].HTTPLimits is not valid in mode %s", i, be.Mode)
+			}
+			if hl.MaxHeaderBytes < 0 || hl.MaxBodyBytes < 0 || hl.MaxConcurrentRequests < 0 {
+				return fmt.Errorf("backend[%d].HTTPLimits: limits cannot be negative", i)
+			}
+			if hl.ReadHeaderTimeout < 0 || hl.ReadTimeout < 0 || hl.WriteTimeout < 0 || hl.IdleTimeout < 0 {
+				return fmt.Errorf("backend[%d].HTTPLimits: timeouts cannot be negative", i)
+			}
+			if hl.MaxHeaderBytes == 0 {
+				hl.MaxHeaderBytes = http.DefaultMaxHeaderBytes
+			}
+			if hl.ReadHeaderTimeout == 0 {
+				hl.ReadHeaderTimeout = 30 * time.Second
+			}
+			if hl.ReadTimeout == 0 {
+				hl.ReadTimeout = 24 * time.Hour
+			}
+			if hl.WriteTimeout == 0 {
+				hl.WriteTimeout = 24 * time.Hour
+			}
+			if hl.IdleTimeout == 0 {
+				hl.IdleTimeout = 30 * time.Second
+			}
+		}
 		if len(be.PathOverrides) > 0 && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
 			return fmt.Errorf("backend[%d].PathOverrides is only valid in %s or %s mode", i, ModeHTTP, ModeHTTPS)
 		}
@@ -1034,6 +4736,12 @@ func (cfg *Config) Check() error {
 					return fmt.Errorf("backend[%d].PathOverrides[%d].Paths[%d]: must start and end with /", i, j, k)
 				}
 			}
+			for k, m := range po.Methods {
+				po.Methods[k] = strings.ToUpper(m)
+				if !httpguts.ValidHeaderFieldName(m) {
+					return fmt.Errorf("backend[%d].PathOverrides[%d].Methods[%d]: invalid method %q", i, j, k, m)
+				}
+			}
 			if po.Mode == "" {
 				po.Mode = be.Mode
 			}
@@ -1041,6 +4749,9 @@ func (cfg *Config) Check() error {
 			if po.Mode != ModeHTTP && po.Mode != ModeHTTPS {
 				return fmt.Errorf("backend[%d].PathOverrides[%d].Mode: must be either %s or %s", i, j, ModeHTTP, ModeHTTPS)
 			}
+			if po.BackendProto != nil && *po.BackendProto == "h2c" && po.Mode != ModeHTTP {
+				return fmt.Errorf("backend[%d].PathOverrides[%d].BackendProto: h2c is only valid in mode %s", i, j, ModeHTTP)
+			}
 			pool := x509.NewCertPool()
 			for k, n := range po.ForwardRootCAs {
 				if pkis[n] {
@@ -1061,6 +4772,11 @@ func (cfg *Config) Check() error {
 			po.proxyProtocolVersion = ver
 		}
 	}
+	if cfg.SharedCacheDir != "" {
+		if err := os.MkdirAll(cfg.SharedCacheDir, 0o700); err != nil {
+			return err
+		}
+	}
 	return os.MkdirAll(cfg.CacheDir, 0o700)
 }
 
@@ -1068,14 +4784,14 @@ func validateProxyProtoVersion(s string) (byte, error) {
 	if s == "" {
 		return 0, nil
 	}
-	if len(s) < 2 || s[0] != 'v' {
+	switch strings.ToLower(s) {
+	case "v1":
+		return 1, nil
+	case "v2":
+		return 2, nil
+	default:
 		return 0, fmt.Errorf("invalid value %q, expected v1 or v2", s)
 	}
-	v, err := strconv.ParseInt(s[1:], 10, 8)
-	if err != nil {
-		return 0, err
-	}
-	return byte(v), nil
 }
 
 // ReadConfig reads and validates a YAML config file.
@@ -1085,15 +4801,54 @@ func ReadConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return decodeConfig(f, filepath.Dir(filename))
+}
+
+// decodeConfig decodes and checks a YAML config. The included files are
+// read from dir.
+func decodeConfig(r io.Reader, dir string) (*Config, error) {
+	cfg, err := parseConfig(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveAndCheck(dir); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-	dec := yaml.NewDecoder(f)
+// parseConfig decodes a YAML config, without resolving the secrets or
+// checking it.
+func parseConfig(r io.Reader, dir string) (*Config, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxConfigSize {
+		return nil, errors.New("config too large")
+	}
+	if b, err = preprocessConfig(b, dir); err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(b))
 	dec.KnownFields(true)
 	var cfg Config
 	if err := dec.Decode(&cfg); err != nil {
 		return nil, err
 	}
-	if err := cfg.Check(); err != nil {
-		return nil, err
-	}
 	return &cfg, nil
 }
+
+// resolveAndCheck resolves the secrets and the relative paths of a config
+// returned by parseConfig, and checks it. The paths are relative to dir.
+func (cfg *Config) resolveAndCheck(dir string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := cfg.resolveSecrets(ctx, secrets.New(dir)); err != nil {
+		return err
+	}
+	if td := cfg.TLSDebug; td != nil && td.KeyLogFile != "" && !filepath.IsAbs(td.KeyLogFile) {
+		td.KeyLogFile = filepath.Join(dir, td.KeyLogFile)
+	}
+	return cfg.Check()
+}
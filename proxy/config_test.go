@@ -58,10 +58,12 @@ func TestReadConfig(t *testing.T) {
 	}
 
 	want := &Config{
-		HTTPAddr: ":10080",
-		TLSAddr:  ":10443",
-		CacheDir: got.CacheDir,
-		MaxOpen:  got.MaxOpen,
+		Version:      currentConfigVersion,
+		HTTPAddr:     ":10080",
+		RedirectHTTP: true,
+		TLSAddr:      ":10443",
+		CacheDir:     got.CacheDir,
+		MaxOpen:      got.MaxOpen,
 		Backends: []*Backend{
 			{
 				ServerNames: []string{
@@ -73,10 +75,13 @@ func TestReadConfig(t *testing.T) {
 					"192.168.0.11:80",
 					"192.168.0.12:80",
 				},
-				ForwardRateLimit: 5,
-				Mode:             "HTTP",
-				ALPNProtos:       &[]string{"h2", "http/1.1"},
-				ForwardTimeout:   30 * time.Second,
+				ForwardRateLimit:  5,
+				Mode:              "HTTP",
+				ALPNProtos:        &[]string{"h2", "http/1.1"},
+				ForwardTimeout:    30 * time.Second,
+				LoadBalance:       "round-robin",
+				DialAddressFamily: "ipv6-first",
+				DialAttemptDelay:  250 * time.Millisecond,
 			},
 			{
 				ServerNames: []string{
@@ -90,6 +95,9 @@ func TestReadConfig(t *testing.T) {
 				ALPNProtos:         &[]string{"h2", "http/1.1"},
 				InsecureSkipVerify: true,
 				ForwardTimeout:     30 * time.Second,
+				LoadBalance:        "round-robin",
+				DialAddressFamily:  "ipv6-first",
+				DialAttemptDelay:   250 * time.Millisecond,
 			},
 			{
 				ServerNames: []string{
@@ -107,6 +115,9 @@ func TestReadConfig(t *testing.T) {
 				ForwardServerName: "secure-internal.example.com",
 				ForwardRootCAs:    []string{demoCert},
 				ForwardTimeout:    30 * time.Second,
+				LoadBalance:       "round-robin",
+				DialAddressFamily: "ipv6-first",
+				DialAttemptDelay:  250 * time.Millisecond,
 			},
 			{
 				ServerNames: []string{
@@ -121,7 +132,10 @@ func TestReadConfig(t *testing.T) {
 				ClientAuth: &ClientAuth{
 					RootCAs: []string{demoCert},
 				},
-				ForwardTimeout: 30 * time.Second,
+				ForwardTimeout:    30 * time.Second,
+				LoadBalance:       "round-robin",
+				DialAddressFamily: "ipv6-first",
+				DialAttemptDelay:  250 * time.Millisecond,
 			},
 			{
 				ServerNames: []string{
@@ -130,15 +144,20 @@ func TestReadConfig(t *testing.T) {
 				Addresses: []string{
 					"192.168.3.30:5443",
 				},
-				ForwardRateLimit: 5,
-				Mode:             "TLSPASSTHROUGH",
-				ALPNProtos:       &[]string{"h2", "http/1.1"},
-				ForwardTimeout:   30 * time.Second,
+				ForwardRateLimit:  5,
+				Mode:              "TLSPASSTHROUGH",
+				ALPNProtos:        &[]string{"h2", "http/1.1"},
+				ForwardTimeout:    30 * time.Second,
+				LoadBalance:       "round-robin",
+				DialAddressFamily: "ipv6-first",
+				DialAttemptDelay:  250 * time.Millisecond,
 			},
 		},
 	}
 	v := quicIsEnabled
 	want.EnableQUIC = &v
+	drainTimeout := time.Minute
+	want.DrainTimeout = &drainTimeout
 	if quicIsEnabled {
 		for _, be := range want.Backends {
 			if be.Mode == ModeHTTP || be.Mode == ModeHTTPS {
@@ -154,3 +173,164 @@ func TestReadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateProxyProtoVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    byte
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "v1", want: 1},
+		{in: "v2", want: 2},
+		{in: "V2", want: 2},
+		{in: "v0", wantErr: true},
+		{in: "v3", wantErr: true},
+		{in: "2", wantErr: true},
+		{in: "v-1", wantErr: true},
+	} {
+		got, err := validateProxyProtoVersion(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateProxyProtoVersion(%q) err = %v, want err %v", tc.in, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("validateProxyProtoVersion(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDNSProvidersConfig(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		dp      []*ConfigDNSProvider
+		wantErr bool
+	}{
+		{
+			desc: "cloudflare",
+			dp:   []*ConfigDNSProvider{{Type: "Cloudflare", Domains: []string{"*.example.com"}, APIToken: "x", ZoneID: "y"}},
+		},
+		{
+			desc:    "cloudflare missing token",
+			dp:      []*ConfigDNSProvider{{Type: "cloudflare", Domains: []string{"example.com"}, ZoneID: "y"}},
+			wantErr: true,
+		},
+		{
+			desc: "route53",
+			dp:   []*ConfigDNSProvider{{Type: "route53", Domains: []string{"example.com"}, AccessKeyID: "a", SecretAccessKey: "b", HostedZoneID: "c"}},
+		},
+		{
+			desc: "rfc2136",
+			dp:   []*ConfigDNSProvider{{Type: "rfc2136", Domains: []string{"example.com"}, Nameserver: "ns1.example.com:53", Zone: "example.com", TSIGKeyName: "key", TSIGSecret: "c2VjcmV0", TSIGAlgorithm: "hmac-sha512"}},
+		},
+		{
+			desc:    "rfc2136 bad secret",
+			dp:      []*ConfigDNSProvider{{Type: "rfc2136", Domains: []string{"example.com"}, Nameserver: "ns1.example.com:53", Zone: "example.com", TSIGKeyName: "key", TSIGSecret: "!!!"}},
+			wantErr: true,
+		},
+		{
+			desc:    "rfc2136 bad algorithm",
+			dp:      []*ConfigDNSProvider{{Type: "rfc2136", Domains: []string{"example.com"}, Nameserver: "ns1.example.com:53", Zone: "example.com", TSIGAlgorithm: "hmac-md5"}},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown type",
+			dp:      []*ConfigDNSProvider{{Type: "foo", Domains: []string{"example.com"}}},
+			wantErr: true,
+		},
+		{
+			desc:    "no domains",
+			dp:      []*ConfigDNSProvider{{Type: "cloudflare", APIToken: "x", ZoneID: "y"}},
+			wantErr: true,
+		},
+		{
+			desc: "duplicate domain",
+			dp: []*ConfigDNSProvider{
+				{Type: "cloudflare", Domains: []string{"example.com"}, APIToken: "x", ZoneID: "y"},
+				{Type: "cloudflare", Domains: []string{"*.example.com"}, APIToken: "x", ZoneID: "y"},
+			},
+			wantErr: true,
+		},
+	} {
+		cfg := &Config{
+			CacheDir:     t.TempDir(),
+			MaxOpen:      100,
+			DNSProviders: tc.dp,
+		}
+		if err := cfg.Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, want err %v", tc.desc, err, tc.wantErr)
+		}
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		cas     []*ConfigACMECA
+		wantErr bool
+	}{
+		{
+			desc: "zerossl with eab",
+			cas:  []*ConfigACMECA{{Name: "zerossl", DirectoryURL: "https://acme.zerossl.com/v2/DV90", EABKeyID: "kid", EABHMACKey: "c2VjcmV0LWtleQ"}},
+		},
+		{
+			desc:    "eab without hmac key",
+			cas:     []*ConfigACMECA{{Name: "zerossl", DirectoryURL: "https://acme.zerossl.com/v2/DV90", EABKeyID: "kid"}},
+			wantErr: true,
+		},
+		{
+			desc:    "bad hmac key",
+			cas:     []*ConfigACMECA{{Name: "zerossl", DirectoryURL: "https://acme.zerossl.com/v2/DV90", EABKeyID: "kid", EABHMACKey: "!!!"}},
+			wantErr: true,
+		},
+		{
+			desc:    "bad url",
+			cas:     []*ConfigACMECA{{Name: "private", DirectoryURL: "ftp://ca.example.com/"}},
+			wantErr: true,
+		},
+		{
+			desc:    "bad name",
+			cas:     []*ConfigACMECA{{Name: "a+b", DirectoryURL: "https://ca.example.com/acme/directory"}},
+			wantErr: true,
+		},
+		{
+			desc: "per domain",
+			cas: []*ConfigACMECA{
+				{Name: "default", DirectoryURL: "https://acme.zerossl.com/v2/DV90"},
+				{Name: "private", DirectoryURL: "https://ca.example.com/acme/directory", Domains: []string{"internal.example.com"}},
+			},
+		},
+		{
+			desc: "two defaults",
+			cas: []*ConfigACMECA{
+				{Name: "one", DirectoryURL: "https://acme.zerossl.com/v2/DV90"},
+				{Name: "two", DirectoryURL: "https://ca.example.com/acme/directory"},
+			},
+			wantErr: true,
+		},
+		{
+			desc: "duplicate name",
+			cas: []*ConfigACMECA{
+				{Name: "one", DirectoryURL: "https://acme.zerossl.com/v2/DV90", Domains: []string{"example.com"}},
+				{Name: "one", DirectoryURL: "https://ca.example.com/acme/directory", Domains: []string{"example.org"}},
+			},
+			wantErr: true,
+		},
+		{
+			desc: "duplicate domain",
+			cas: []*ConfigACMECA{
+				{Name: "one", DirectoryURL: "https://acme.zerossl.com/v2/DV90", Domains: []string{"example.com"}},
+				{Name: "two", DirectoryURL: "https://ca.example.com/acme/directory", Domains: []string{"*.example.com"}},
+			},
+			wantErr: true,
+		},
+	} {
+		cfg := &Config{
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			ACME:     &ConfigACME{CertificateAuthorities: tc.cas},
+		}
+		if err := cfg.Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, want err %v", tc.desc, err, tc.wantErr)
+		}
+	}
+}
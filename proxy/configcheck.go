@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/oidc"
+)
+
+// CheckConfigOptions are the options of CheckConfig.
+type CheckConfigOptions struct {
+	// OIDCDiscovery enables the check that the discovery documents of
+	// the OIDC providers can be fetched.
+	OIDCDiscovery bool
+	// HTTPClient is the HTTP client to use. The default is a client with
+	// a 30 second timeout.
+	HTTPClient *http.Client
+}
+
+// CheckConfig validates a config that was read with ReadConfig, without
+// starting the proxy. In addition to the checks done by ReadConfig, it
+// loads the static certificates and keys, validates the DNS providers,
+// and optionally fetches the OIDC discovery documents. It returns all the
+// problems that it finds.
+func CheckConfig(ctx context.Context, cfg *Config, opts CheckConfigOptions) error {
+	var errs []error
+	if err := cfg.loadStaticCerts(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := dns01Domains(cfg.DNSProviders); err != nil {
+		errs = append(errs, fmt.Errorf("dnsProviders: %w", err))
+	}
+	if opts.OIDCDiscovery {
+		client := opts.HTTPClient
+		if client == nil {
+			client = &http.Client{Timeout: 30 * time.Second}
+		}
+		for i, pp := range cfg.OIDCProviders {
+			if pp.DiscoveryURL == "" {
+				continue
+			}
+			if _, err := oidc.Discover(ctx, client, pp.DiscoveryURL); err != nil {
+				errs = append(errs, fmt.Errorf("oidc[%d].DiscoveryURL: %w", i, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ConfigDiff returns the lines that differ between the running config, as
+// returned by the /api/config endpoint of the admin API, and cfg, prefixed
+// with - for removed lines and + for added lines. Secrets are redacted.
+func ConfigDiff(running []byte, cfg *Config) ([]string, error) {
+	var rc Config
+	if err := yaml.Unmarshal(running, &rc); err != nil {
+		return nil, fmt.Errorf("running config: %w", err)
+	}
+	// The secrets in the running config are already redacted.
+	linesA := strings.Split(strings.TrimSuffix(string(rc.serialize()), "\n"), "\n")
+	linesB := strings.Split(strings.TrimSuffix(string(cfg.redacted().serialize()), "\n"), "\n")
+	return diffLines(linesA, linesB), nil
+}
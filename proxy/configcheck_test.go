@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestCheckConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"authorization_endpoint":"https://idp.example.com/auth","token_endpoint":"https://idp.example.com/token"}`))
+	}))
+	defer srv.Close()
+
+	cfg := &Config{
+		CacheDir: t.TempDir(),
+		OIDCProviders: []*ConfigOIDC{
+			{
+				Name:         "good",
+				DiscoveryURL: srv.URL + "/.well-known/openid-configuration",
+				RedirectURL:  "https://login.example.com/oidc/good",
+				ClientID:     "tlsproxy",
+				ClientSecret: "secret",
+			},
+			{
+				Name:         "bad",
+				DiscoveryURL: srv.URL + "/not-found",
+				RedirectURL:  "https://login.example.com/oidc/bad",
+				ClientID:     "tlsproxy",
+				ClientSecret: "secret",
+			},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{"192.168.0.10:80"},
+				Mode:        ModeHTTP,
+			},
+		},
+	}
+	if err := cfg.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	ctx := context.Background()
+	if err := CheckConfig(ctx, cfg, CheckConfigOptions{}); err != nil {
+		t.Errorf("CheckConfig() = %v", err)
+	}
+	err := CheckConfig(ctx, cfg, CheckConfigOptions{OIDCDiscovery: true})
+	if err == nil || !strings.Contains(err.Error(), "oidc[1].DiscoveryURL") || strings.Contains(err.Error(), "oidc[0]") {
+		t.Errorf("CheckConfig(OIDCDiscovery) = %v, want oidc[1] error", err)
+	}
+
+	cfg.Backends[0].CertFile = "/does/not/exist.pem"
+	if err := CheckConfig(ctx, cfg, CheckConfigOptions{}); err == nil || !strings.Contains(err.Error(), "backend[0].CertFile") {
+		t.Errorf("CheckConfig(CertFile) = %v, want backend[0].CertFile error", err)
+	}
+}
+
+func TestConfigDiffRunning(t *testing.T) {
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		OIDCProviders: []*ConfigOIDC{
+			{
+				Name:          "idp",
+				AuthEndpoint:  "https://idp.example.com/auth",
+				TokenEndpoint: "https://idp.example.com/token",
+				RedirectURL:   "https://login.example.com/oidc/idp",
+				ClientID:      "tlsproxy",
+				ClientSecret:  "secret",
+			},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{"192.168.0.10:80"},
+				Mode:        ModeHTTP,
+			},
+		},
+	}
+	proxy := newTestProxy(cfg.clone(), extCA)
+	running, err := proxy.adminConfig(nil)
+	if err != nil {
+		t.Fatalf("adminConfig: %v", err)
+	}
+	b, err := json.Marshal(running)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	local := cfg.clone()
+	if err := local.Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	diff, err := ConfigDiff(b, local)
+	if err != nil {
+		t.Fatalf("ConfigDiff: %v", err)
+	}
+	if len(diff) != 0 {
+		t.Errorf("ConfigDiff() = %q, want no differences", diff)
+	}
+
+	local.MaxOpen = 200
+	local.OIDCProviders[0].ClientSecret = "other"
+	if diff, err = ConfigDiff(b, local); err != nil {
+		t.Fatalf("ConfigDiff: %v", err)
+	}
+	if want := []string{"- maxOpen: 100", "+ maxOpen: 200"}; !slices.Equal(diff, want) {
+		t.Errorf("ConfigDiff() = %q, want %q", diff, want)
+	}
+}
@@ -0,0 +1,72 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want []string
+	}{
+		{a: "", b: "", want: nil},
+		{a: "a b c", b: "a b c", want: nil},
+		{a: "a b c", b: "a x c", want: []string{"- b", "+ x"}},
+		{a: "a b c", b: "a b c d", want: []string{"+ d"}},
+		{a: "a b c", b: "b c", want: []string{"- a"}},
+		{a: "a b c d", b: "a c e", want: []string{"- b", "- d", "+ e"}},
+	} {
+		if got := diffLines(strings.Fields(tc.a), strings.Fields(tc.b)); !slices.Equal(got, tc.want) {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	a := &Config{
+		TLSAddr: ":443",
+		OIDCProviders: []*ConfigOIDC{
+			{Name: "idp", ClientSecret: "secret1"},
+		},
+		Backends: []*Backend{
+			{ServerNames: []string{"example.com"}, Addresses: []string{"192.168.0.1:80"}},
+		},
+	}
+	b := a.clone()
+	b.OIDCProviders[0].ClientSecret = "secret2"
+	b.Backends[0].Addresses = append(b.Backends[0].Addresses, "192.168.0.2:80")
+
+	got := configDiff(a, b)
+	want := []string{"+         - 192.168.0.2:80"}
+	if !slices.Equal(got, want) {
+		t.Errorf("configDiff() = %q, want %q", got, want)
+	}
+	if got := configDiff(a, a.clone()); got != nil {
+		t.Errorf("configDiff() = %q, want nil", got)
+	}
+}
@@ -0,0 +1,402 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/secrets"
+)
+
+const (
+	configRevisionsDir     = "config-revisions"
+	defaultConfigRevisions = 10
+	maxConfigSize          = 4 << 20
+	redactedValue          = "**REDACTED**"
+)
+
+var configRevisionRE = regexp.MustCompile(`^[0-9]{8}-[0-9]{6}\.[0-9]{9}$`)
+
+// SetConfigFile sets the name of the config file. When it is set, the
+// configs applied with the admin API are also written to this file, so that
+// they are kept when the proxy restarts.
+func (p *Proxy) SetConfigFile(filename string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configFile = filename
+}
+
+// configDir returns the directory of the config file, where the included
+// files are.
+func (p *Proxy) configDir() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.configFile == "" {
+		return "."
+	}
+	return filepath.Dir(p.configFile)
+}
+
+type adminConfigUpdate struct {
+	DryRun   bool     `json:"dryRun,omitempty"`
+	Revision string   `json:"revision,omitempty"`
+	Diff     []string `json:"diff"`
+}
+
+type adminConfigRevision struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+}
+
+// adminUpdateConfig validates the YAML config in the request body, or in the
+// config form field, and applies it. The previous config is saved as a
+// revision. With dryRun=true, the config is only validated.
+func (p *Proxy) adminUpdateConfig(req *http.Request) (any, error) {
+	b := []byte(req.PostForm.Get("config"))
+	if len(b) == 0 {
+		var err error
+		if b, err = io.ReadAll(io.LimitReader(req.Body, maxConfigSize+1)); err != nil {
+			return nil, err
+		}
+	}
+	if len(b) > maxConfigSize {
+		return nil, errors.New("config too large")
+	}
+	if bytes.Contains(b, []byte(redactedValue)) {
+		return nil, errors.New("config contains redacted values, replace them with the actual secrets")
+	}
+	if err := p.checkNewSecretRefs(b); err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(bytes.NewReader(b), p.configDir())
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveAndCheck(p.configDir()); err != nil {
+		return nil, err
+	}
+	if err := p.checkKeyLogFile(cfg); err != nil {
+		return nil, err
+	}
+	if err := p.validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	dryRun, _ := strconv.ParseBool(req.Form.Get("dryRun"))
+	if dryRun {
+		return adminConfigUpdate{DryRun: true, Diff: p.baseConfigDiff(cfg)}, nil
+	}
+	return p.applyConfig(b, cfg)
+}
+
+// checkNewSecretRefs returns an error if the config b references secrets or
+// environment variables that the config file doesn't reference. Otherwise,
+// the admin API could be used to read any secret or environment variable
+// that the proxy has access to, e.g. in the diff. The variables are checked
+// before b is parsed, so that their values can't show up in parse errors.
+func (p *Proxy) checkNewSecretRefs(b []byte) error {
+	p.mu.RLock()
+	file := p.configFile
+	p.mu.RUnlock()
+	var onDisk []byte
+	if file != "" {
+		var err error
+		if onDisk, err = os.ReadFile(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	names, err := configEnvRefs(b)
+	if err != nil {
+		return err
+	}
+	knownNames, err := configEnvRefs(onDisk)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, name := range names {
+		if !slices.Contains(knownNames, name) {
+			return fmt.Errorf("variable %s: new variables can't be added with the admin API", name)
+		}
+	}
+
+	cfg, err := parseConfig(bytes.NewReader(b), p.configDir())
+	if err != nil {
+		return err
+	}
+	r := secrets.New(p.configDir())
+	refs := cfg.unresolvedSecretRefs(r)
+	if len(refs) == 0 {
+		return nil
+	}
+	var known []string
+	if onDisk != nil {
+		onDiskCfg, err := parseConfig(bytes.NewReader(onDisk), filepath.Dir(file))
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, s := range onDiskCfg.unresolvedSecretRefs(r) {
+			known = append(known, s.value)
+		}
+	}
+	for _, s := range refs {
+		if !slices.Contains(known, s.value) {
+			return fmt.Errorf("%s: new secret references can't be added with the admin API", s.name)
+		}
+	}
+	return nil
+}
+
+// checkKeyLogFile returns an error if cfg changes the TLS key log file.
+// Otherwise, the admin API could be used to get the TLS secrets, or to
+// append to any file that the proxy can write.
+func (p *Proxy) checkKeyLogFile(cfg *Config) error {
+	p.mu.RLock()
+	cur := p.cfg
+	p.mu.RUnlock()
+	var curFile, file string
+	if cur != nil && cur.TLSDebug != nil {
+		curFile = cur.TLSDebug.KeyLogFile
+	}
+	if cfg.TLSDebug != nil {
+		file = cfg.TLSDebug.KeyLogFile
+	}
+	if file != curFile {
+		return errors.New("tlsDebug.keyLogFile: can't be changed with the admin API")
+	}
+	return nil
+}
+
+// adminConfigRevisions returns the saved config revisions, most recent first.
+func (p *Proxy) adminConfigRevisions(*http.Request) (any, error) {
+	return p.configRevisions()
+}
+
+// adminRollbackConfig applies a saved config revision. The default is the
+// most recent one. The current config is saved as a new revision, so the
+// rollback can itself be undone.
+func (p *Proxy) adminRollbackConfig(req *http.Request) (any, error) {
+	id := req.Form.Get("revision")
+	if id == "" {
+		revs, err := p.configRevisions()
+		if err != nil {
+			return nil, err
+		}
+		if len(revs) == 0 {
+			return nil, errNotFound
+		}
+		id = revs[0].ID
+	}
+	if !configRevisionRE.MatchString(id) {
+		return nil, fmt.Errorf("invalid revision %q", id)
+	}
+	b, err := os.ReadFile(filepath.Join(p.configRevisionsDir(), id+".yaml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := decodeConfig(bytes.NewReader(b), p.configDir())
+	if err != nil {
+		return nil, err
+	}
+	if err := p.validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return p.applyConfig(b, cfg)
+}
+
+// validateConfig checks that cfg can be applied, without changing anything.
+func (p *Proxy) validateConfig(cfg *Config) error {
+	cfg = cfg.clone()
+	if err := cfg.Check(); err != nil {
+		return err
+	}
+	p.mu.RLock()
+	err := p.checkRestartOptions(cfg)
+	p.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	if _, err := dns01Domains(cfg.DNSProviders); err != nil {
+		return err
+	}
+	return cfg.loadStaticCerts()
+}
+
+// baseConfigDiff returns the differences between the config that was last
+// applied with Reconfigure and cfg.
+func (p *Proxy) baseConfigDiff(cfg *Config) []string {
+	p.discovery.mu.Lock()
+	defer p.discovery.mu.Unlock()
+	return configDiff(p.discovery.cfg, cfg)
+}
+
+// applyConfig saves the current config as a revision, and applies cfg. If
+// cfg can't be applied, the previous config is restored. When the config
+// file is set, b is written to it.
+func (p *Proxy) applyConfig(b []byte, cfg *Config) (any, error) {
+	p.configEditMu.Lock()
+	defer p.configEditMu.Unlock()
+
+	p.discovery.mu.Lock()
+	prev := p.discovery.cfg.clone()
+	p.discovery.mu.Unlock()
+
+	p.mu.RLock()
+	file := p.configFile
+	p.mu.RUnlock()
+
+	// The previous config is saved as it is in the config file, with its
+	// includes, variables, and secret references. Without a config file,
+	// the running config is saved.
+	var prevBytes []byte
+	if file != "" {
+		var err error
+		if prevBytes, err = os.ReadFile(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if prevBytes == nil {
+		prevRefs := prev.clone()
+		prevRefs.restoreSecretRefs()
+		prevBytes = prevRefs.serialize()
+	}
+
+	diff := configDiff(prev, cfg)
+	id, err := p.saveConfigRevision(prevBytes, prev.ConfigRevisions)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Reconfigure(cfg); err != nil {
+		if err := p.Reconfigure(prev); err != nil {
+			log.Printf("ERR Restoring previous config: %v", err)
+		}
+		return nil, err
+	}
+	log.Printf("INF Config changed with the admin API, previous config saved as revision %s", id)
+
+	if file != "" {
+		if err := writeFileAtomic(file, b); err != nil {
+			return nil, fmt.Errorf("config applied, but not saved: %w", err)
+		}
+	}
+	return adminConfigUpdate{Revision: id, Diff: diff}, nil
+}
+
+func (p *Proxy) configRevisionsDir() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return filepath.Join(p.cfg.CacheDir, configRevisionsDir)
+}
+
+// saveConfigRevision saves b as a new revision, and deletes the oldest
+// revisions over keep.
+func (p *Proxy) saveConfigRevision(b []byte, keep int) (string, error) {
+	if keep == 0 {
+		keep = defaultConfigRevisions
+	}
+	dir := p.configRevisionsDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format("20060102-150405.000000000")
+	if err := os.WriteFile(filepath.Join(dir, id+".yaml"), b, 0o600); err != nil {
+		return "", err
+	}
+	revs, err := p.configRevisions()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range revs[min(keep, len(revs)):] {
+		if err := os.Remove(filepath.Join(dir, r.ID+".yaml")); err != nil {
+			log.Printf("ERR Config revision: %v", err)
+		}
+	}
+	return id, nil
+}
+
+// configRevisions returns the saved config revisions, most recent first.
+func (p *Proxy) configRevisions() ([]adminConfigRevision, error) {
+	entries, err := os.ReadDir(p.configRevisionsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return []adminConfigRevision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	revs := []adminConfigRevision{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".yaml")
+		if !ok || !configRevisionRE.MatchString(id) {
+			continue
+		}
+		t, err := time.Parse("20060102-150405.000000000", id)
+		if err != nil {
+			continue
+		}
+		revs = append(revs, adminConfigRevision{ID: id, Time: t})
+	}
+	slices.SortFunc(revs, func(a, b adminConfigRevision) int {
+		return strings.Compare(b.ID, a.ID)
+	})
+	return revs, nil
+}
+
+// writeFileAtomic replaces the content of name with b.
+func writeFileAtomic(name string, b []byte) error {
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(name); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,249 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestAdminConfigEdit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	cfg := &Config{
+		HTTPAddr:        "localhost:0",
+		TLSAddr:         "localhost:0",
+		CacheDir:        t.TempDir(),
+		MaxOpen:         100,
+		ConfigRevisions: 2,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+			},
+			{
+				ServerNames: []string{"console.example.com"},
+				Mode:        "CONSOLE",
+				ClientAuth: &ClientAuth{
+					Mode:    ClientAuthRequest,
+					RootCAs: []string{extCA.RootCAPEM()},
+				},
+				ConsoleAuth: &ConsoleAuth{
+					Admins: []string{"DNS:admin.example.com"},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	proxy.SetConfigFile(configFile)
+
+	call := func(path string, form url.Values, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path+"?"+form.Encode(), strings.NewReader(body))
+		req.Header.Set("content-type", "application/yaml")
+		req.Header.Set("x-csrf-check", "1")
+		if body == "" {
+			req.Method = http.MethodGet
+		}
+		for _, h := range proxy.adminHandlers() {
+			if h.path == path {
+				w := httptest.NewRecorder()
+				h.handler.ServeHTTP(w, req)
+				return w.Code, w.Body.String()
+			}
+		}
+		t.Fatalf("no handler for %s", path)
+		return 0, ""
+	}
+	post := func(path string, form url.Values) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		for _, h := range proxy.adminHandlers() {
+			if h.path == path {
+				w := httptest.NewRecorder()
+				h.handler.ServeHTTP(w, req)
+				return w.Code, w.Body.String()
+			}
+		}
+		t.Fatalf("no handler for %s", path)
+		return 0, ""
+	}
+	get := func(name string) string {
+		got, _, err := tlsGet(name, proxy.listener.Addr().String(), "", extCA, nil, nil)
+		if err != nil {
+			return err.Error()
+		}
+		return got
+	}
+
+	newCfg := cfg.clone()
+	newCfg.Backends[0].Addresses = []string{be2.listener.Addr().String()}
+	b, err := yaml.Marshal(newCfg)
+	if err != nil {
+		t.Fatalf("yaml.Marshal: %v", err)
+	}
+
+	// Dry run.
+	code, body := call("/api/config/update", url.Values{"dryRun": {"true"}}, string(b))
+	if code != 200 || !strings.Contains(body, be2.listener.Addr().String()) {
+		t.Fatalf("dry run = %d %s", code, body)
+	}
+	if got, want := get("example.com"), "Hello from backend1\n"; got != want {
+		t.Errorf("after dry run got %q, want %q", got, want)
+	}
+
+	// Invalid configs are rejected.
+	for _, bad := range []string{
+		"foo: bar\n",
+		"backends:\n- serverNames: [example.com]\n  mode: FOO\n",
+		strings.Replace(string(b), "maxOpen: 100", "maxOpen: 100\noidc:\n- name: foo\n  clientSecret: '**REDACTED**'", 1),
+	} {
+		if code, body := call("/api/config/update", nil, bad); code != http.StatusBadRequest {
+			t.Errorf("update(%q) = %d %s", bad, code, body)
+		}
+	}
+
+	// The config file is saved as a revision as it is.
+	orig, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("yaml.Marshal: %v", err)
+	}
+	orig = append([]byte("# The original config.\n"), orig...)
+	if err := os.WriteFile(configFile, orig, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	// Apply.
+	code, body = call("/api/config/update", nil, string(b))
+	if code != 200 {
+		t.Fatalf("update = %d %s", code, body)
+	}
+	var update adminConfigUpdate
+	if err := json.Unmarshal([]byte(body), &update); err != nil || update.Revision == "" {
+		t.Fatalf("update = %q, %v", body, err)
+	}
+	if got, want := get("example.com"), "Hello from backend2\n"; got != want {
+		t.Errorf("after update got %q, want %q", got, want)
+	}
+	if saved, err := os.ReadFile(configFile); err != nil || string(saved) != string(b) {
+		t.Errorf("config file = %q, %v", saved, err)
+	}
+	if rev, err := os.ReadFile(filepath.Join(proxy.configRevisionsDir(), update.Revision+".yaml")); err != nil || string(rev) != string(orig) {
+		t.Errorf("revision = %q, %v", rev, err)
+	}
+
+	// Rollback to the previous revision.
+	if code, body := post("/api/config/rollback", nil); code != 200 {
+		t.Fatalf("rollback = %d %s", code, body)
+	}
+	if got, want := get("example.com"), "Hello from backend1\n"; got != want {
+		t.Errorf("after rollback got %q, want %q", got, want)
+	}
+	// And undo the rollback.
+	if code, body := post("/api/config/rollback", nil); code != 200 {
+		t.Fatalf("rollback = %d %s", code, body)
+	}
+	if got, want := get("example.com"), "Hello from backend2\n"; got != want {
+		t.Errorf("after second rollback got %q, want %q", got, want)
+	}
+
+	// Only ConfigRevisions revisions are kept.
+	code, body = call("/api/config/revisions", nil, "")
+	var revs []adminConfigRevision
+	if err := json.Unmarshal([]byte(body), &revs); code != 200 || err != nil {
+		t.Fatalf("revisions = %d %q, %v", code, body, err)
+	}
+	if len(revs) != 2 || revs[0].ID <= revs[1].ID {
+		t.Errorf("revisions = %+v", revs)
+	}
+	if code, body := post("/api/config/rollback", url.Values{"revision": {"../../etc/passwd"}}); code != http.StatusBadRequest {
+		t.Errorf("rollback(bad revision) = %d %s", code, body)
+	}
+	if code, body := post("/api/config/rollback", url.Values{"revision": {"20000101-000000.000000000"}}); code != http.StatusNotFound {
+		t.Errorf("rollback(unknown revision) = %d %s", code, body)
+	}
+
+	// Only the secret references that are in the config file can be used.
+	t.Setenv("TEST_OIDC_SECRET", "s3cr3t")
+	withRef := func(ref string) string {
+		return strings.Replace(string(b), "maxOpen: 100", "maxOpen: 100\noidc:\n- name: idp\n  discoveryUrl: https://idp.example.com/.well-known/openid-configuration\n  redirectUrl: https://login.example.com/oidc/idp\n  clientId: tlsproxy\n  clientSecret: "+ref, 1)
+	}
+	for _, ref := range []string{"env:TEST_OIDC_SECRET", "file:../../etc/passwd"} {
+		if code, body := call("/api/config/update", url.Values{"dryRun": {"true"}}, withRef(ref)); code != http.StatusBadRequest || !strings.Contains(body, "new secret references can't be added") {
+			t.Errorf("update(%s) = %d %s", ref, code, body)
+		}
+	}
+	if err := os.WriteFile(configFile, []byte(withRef("env:TEST_OIDC_SECRET")), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if code, body := call("/api/config/update", url.Values{"dryRun": {"true"}}, withRef("env:TEST_OIDC_SECRET")); code != 200 {
+		t.Errorf("update(known ref) = %d %s", code, body)
+	}
+
+	// Only the variables that are in the config file can be used.
+	t.Setenv("SOME_SECRET_VAR", "hunter2")
+	withVar := strings.Replace(string(b), "- example.com", "- ${SOME_SECRET_VAR}.example.com", 1)
+	for _, form := range []url.Values{{"dryRun": {"true"}}, nil} {
+		code, body := call("/api/config/update", form, withVar)
+		if code != http.StatusBadRequest || !strings.Contains(body, "new variables can't be added") {
+			t.Errorf("update(%v, new variable) = %d %s", form, code, body)
+		}
+		if strings.Contains(body, "hunter2") {
+			t.Errorf("update(%v, new variable) leaked the value: %s", form, body)
+		}
+	}
+	if code, body := call("/api/config", nil, ""); strings.Contains(body, "hunter2") {
+		t.Errorf("config = %d %s", code, body)
+	}
+	if err := os.WriteFile(configFile, []byte(withVar), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if code, body := call("/api/config/update", url.Values{"dryRun": {"true"}}, withVar); code != 200 {
+		t.Errorf("update(known variable) = %d %s", code, body)
+	}
+}
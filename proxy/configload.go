@@ -0,0 +1,311 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the version of the config format that Check
+// accepts. Older configs are migrated by preprocessConfig.
+const currentConfigVersion = 2
+
+// configMigrations are the changes needed to migrate a config from one
+// version to the next. configMigrations[i] migrates version i+1 to i+2.
+var configMigrations = []func(root *yaml.Node) error{
+	migrateConfigV1,
+}
+
+// preprocessConfig merges the included files, expands the environment
+// variables, and migrates the config to the current version. It returns
+// the YAML config that is ready to be decoded.
+func preprocessConfig(b []byte, dir string) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return b, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New("config must be a map")
+	}
+	if err := includeConfigFiles(root, dir); err != nil {
+		return nil, err
+	}
+	if err := expandConfigEnv(root); err != nil {
+		return nil, err
+	}
+	if err := migrateConfig(root); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(&doc)
+}
+
+// mapValue returns the value of key in the mapping node m, or nil.
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// deleteMapKey removes key from the mapping node m.
+func deleteMapKey(m *yaml.Node, key string) {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			m.Content = slices.Delete(m.Content, i, i+2)
+			return
+		}
+	}
+}
+
+func includeConfigFiles(root *yaml.Node, dir string) error {
+	inc := mapValue(root, "include")
+	if inc == nil {
+		return nil
+	}
+	deleteMapKey(root, "include")
+	var patterns []string
+	if err := inc.Decode(&patterns); err != nil {
+		return fmt.Errorf("include: %w", err)
+	}
+	for _, pattern := range patterns {
+		if !filepath.IsLocal(pattern) {
+			return fmt.Errorf("include: %q must be a local path", pattern)
+		}
+		files, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return fmt.Errorf("include: %q: %w", pattern, err)
+		}
+		for _, file := range files {
+			if err := includeConfigFile(root, file); err != nil {
+				return fmt.Errorf("include: %s: %w", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+func includeConfigFile(root *yaml.Node, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxConfigSize {
+		return errors.New("file too large")
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return errors.New("must be a map")
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		switch key.Value {
+		case "include", "version":
+			return fmt.Errorf("%s can only be set in the main config file", key.Value)
+		}
+		cur := mapValue(root, key.Value)
+		switch {
+		case cur == nil:
+			root.Content = append(root.Content, key, value)
+		case cur.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			cur.Content = append(cur.Content, value.Content...)
+		default:
+			return fmt.Errorf("%s is already set", key.Value)
+		}
+	}
+	return nil
+}
+
+// expandConfigEnv replaces ${NAME} with the value of the environment
+// variable NAME in all the scalar values under n.
+func expandConfigEnv(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 1; i < len(n.Content); i += 2 {
+			if err := expandConfigEnv(n.Content[i]); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := expandConfigEnv(c); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(n.Value, "$") {
+			return nil
+		}
+		v, err := expandEnv(n.Value)
+		if err != nil {
+			return err
+		}
+		n.Value = v
+		if n.Style == 0 {
+			// Let the value be resolved again, e.g. as an int.
+			n.Tag = ""
+		}
+	}
+	return nil
+}
+
+func expandEnv(s string) (string, error) {
+	return expandVars(s, func(name string) (string, error) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("variable %s is not set", name)
+		}
+		return v, nil
+	})
+}
+
+// configEnvRefs returns the names of the environment variables that the
+// YAML config b references, without reading the included files.
+func configEnvRefs(b []byte) ([]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	var names []string
+	var walk func(n *yaml.Node) error
+	walk = func(n *yaml.Node) error {
+		if n.Kind == yaml.ScalarNode {
+			_, err := expandVars(n.Value, func(name string) (string, error) {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+				return "", nil
+			})
+			return err
+		}
+		for _, c := range n.Content {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(&doc); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// expandVars replaces ${NAME} in s with the value returned by lookup, and
+// $$ with $.
+func expandVars(s string, lookup func(name string) (string, error)) (string, error) {
+	var buf bytes.Buffer
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		buf.WriteString(s[:i])
+		s = s[i+1:]
+		switch s[0] {
+		case '$':
+			buf.WriteByte('$')
+			s = s[1:]
+		case '{':
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable in %q", "$"+s)
+			}
+			name := s[1:end]
+			s = s[end+1:]
+			if name == "" {
+				return "", errors.New("empty variable name")
+			}
+			if strings.HasPrefix(name, "TLSPROXY_") {
+				return "", fmt.Errorf("variable %s can't be used in the config", name)
+			}
+			v, err := lookup(name)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(v)
+		default:
+			buf.WriteByte('$')
+		}
+	}
+}
+
+func migrateConfig(root *yaml.Node) error {
+	version := 1
+	vn := mapValue(root, "version")
+	if vn != nil {
+		if err := vn.Decode(&version); err != nil {
+			return fmt.Errorf("version: %w", err)
+		}
+	}
+	if version < 1 || version > currentConfigVersion {
+		return fmt.Errorf("version: value %d is not supported, the current version is %d", version, currentConfigVersion)
+	}
+	for _, m := range configMigrations[version-1:] {
+		if err := m(root); err != nil {
+			return err
+		}
+	}
+	deleteMapKey(root, "version")
+	root.Content = append([]*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "version"},
+		{Kind: yaml.ScalarNode, Value: fmt.Sprint(currentConfigVersion)},
+	}, root.Content...)
+	return nil
+}
+
+// migrateConfigV1 renames rateLimit.exemptIps to exemptIPs.
+func migrateConfigV1(root *yaml.Node) error {
+	rl := mapValue(root, "rateLimit")
+	if rl == nil || rl.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(rl.Content); i += 2 {
+		if rl.Content[i].Value == "exemptIps" {
+			rl.Content[i].Value = "exemptIPs"
+		}
+	}
+	return nil
+}
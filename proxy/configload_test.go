@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigInclude(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "conf.d"), 0o700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	files := map[string]string{
+		"config.yaml": `
+include:
+- conf.d/*.yaml
+cacheDir: ` + dir + `
+tlsDebug:
+  keyLogFile: keylog
+backends:
+- serverNames: [www.example.com]
+  mode: http
+  addresses: [192.168.0.10:80]
+`,
+		"conf.d/a.yaml": `
+backends:
+- serverNames: [a.example.com]
+  mode: http
+  addresses: ["${TEST_BACKEND_ADDR}"]
+rateLimit:
+  exemptIps: [10.0.0.0/8]
+`,
+		"conf.d/b.yaml": `
+email: admin$$x@example.com
+backends:
+- serverNames: [b.example.com]
+  mode: http
+  addresses: [192.168.0.12:80]
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	t.Setenv("TEST_BACKEND_ADDR", "192.168.0.11:80")
+
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if got, want := cfg.Version, currentConfigVersion; got != want {
+		t.Errorf("Version = %d, want %d", got, want)
+	}
+	if got, want := cfg.Email, "admin$x@example.com"; got != want {
+		t.Errorf("Email = %q, want %q", got, want)
+	}
+	var names []string
+	for _, be := range cfg.Backends {
+		names = append(names, be.ServerNames...)
+	}
+	if got, want := strings.Join(names, ","), "www.example.com,a.example.com,b.example.com"; got != want {
+		t.Fatalf("ServerNames = %q, want %q", got, want)
+	}
+	if got, want := cfg.Backends[1].Addresses[0], "192.168.0.11:80"; got != want {
+		t.Errorf("Addresses[0] = %q, want %q", got, want)
+	}
+	if rl := cfg.RateLimit; rl == nil || len(rl.ExemptIPs) != 1 || rl.ExemptIPs[0] != "10.0.0.0/8" {
+		t.Errorf("RateLimit = %#v, want ExemptIPs [10.0.0.0/8]", rl)
+	}
+	if got, want := cfg.TLSDebug.KeyLogFile, filepath.Join(dir, "keylog"); got != want {
+		t.Errorf("KeyLogFile = %q, want %q", got, want)
+	}
+}
+
+func TestConfigPreprocessErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "email.yaml"), []byte("email: other@example.com\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	t.Setenv("TLSPROXY_TEST_SECRET", "secret")
+
+	for _, tc := range []struct {
+		name, config, wantErr string
+	}{
+		{"future version", "version: 3\n", "not supported"},
+		{"non-local include", "include: [../other.yaml]\n", "must be a local path"},
+		{"duplicate key", "email: admin@example.com\ninclude: [email.yaml]\n", "email is already set"},
+		{"undefined variable", "email: ${TEST_UNDEFINED_VARIABLE}\n", "is not set"},
+		{"reserved variable", "email: ${TLSPROXY_TEST_SECRET}\n", "can't be used"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeConfig(strings.NewReader(tc.config), dir)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("decodeConfig() err = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
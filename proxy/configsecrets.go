@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/secrets"
+)
+
+// configSecret is a secret value in the config.
+type configSecret struct {
+	name  string
+	value string
+	set   func(string)
+}
+
+// secrets returns the values in the config that can be references to
+// secrets in external stores.
+func (cfg *Config) secrets() []configSecret {
+	var out []configSecret
+	add := func(name string, p *string) {
+		if *p != "" {
+			out = append(out, configSecret{name: name, value: *p, set: func(v string) { *p = v }})
+		}
+	}
+	addMap := func(name string, m map[string]string) {
+		for k := range m {
+			out = append(out, configSecret{name: fmt.Sprintf("%s[%s]", name, k), value: m[k], set: func(v string) { m[k] = v }})
+		}
+	}
+	for i, p := range cfg.OIDCProviders {
+		add(fmt.Sprintf("oidc[%d].clientSecret", i), &p.ClientSecret)
+	}
+	if cs := cfg.CertificateStore; cs != nil {
+		add("certificateStore.secretAccessKey", &cs.SecretAccessKey)
+		add("certificateStore.password", &cs.Password)
+	}
+	if cfg.Tracing != nil {
+		addMap("tracing.headers", cfg.Tracing.Headers)
+	}
+	if cm := cfg.CertificateMonitor; cm != nil {
+		add("certificateMonitor.webhookUrl", &cm.WebhookURL)
+		addMap("certificateMonitor.webhookHeaders", cm.WebhookHeaders)
+	}
+	if cfg.ACME != nil {
+		for i, ca := range cfg.ACME.CertificateAuthorities {
+			add(fmt.Sprintf("acme.certificateAuthorities[%d].eabHmacKey", i), &ca.EABHMACKey)
+		}
+	}
+	for i, ks := range cfg.KeyStores {
+		add(fmt.Sprintf("keyStores[%d].secretAccessKey", i), &ks.SecretAccessKey)
+		addMap(fmt.Sprintf("keyStores[%d].options", i), ks.Options)
+	}
+	for i, dp := range cfg.DNSProviders {
+		add(fmt.Sprintf("dnsProviders[%d].apiToken", i), &dp.APIToken)
+		add(fmt.Sprintf("dnsProviders[%d].secretAccessKey", i), &dp.SecretAccessKey)
+		add(fmt.Sprintf("dnsProviders[%d].tsigSecret", i), &dp.TSIGSecret)
+	}
+	for i, be := range cfg.Backends {
+		if ad := be.AddressDiscovery; ad != nil {
+			add(fmt.Sprintf("backends[%d].addressDiscovery.consulToken", i), &ad.ConsulToken)
+		}
+		if be.SSO == nil || be.SSO.LocalOIDCServer == nil {
+			continue
+		}
+		for j, client := range be.SSO.LocalOIDCServer.Clients {
+			add(fmt.Sprintf("backends[%d].sso.localOIDCServer.clients[%d].secret", i, j), &client.Secret)
+		}
+	}
+	return out
+}
+
+// unresolvedSecretRefs returns the values in the config that are
+// references to secrets, before they are resolved.
+func (cfg *Config) unresolvedSecretRefs(r *secrets.Resolver) []configSecret {
+	var out []configSecret
+	for _, s := range cfg.secrets() {
+		if r.IsRef(s.value) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// resolveSecrets replaces the references to secrets in external stores
+// with the secrets. The references are kept, so that they can be restored
+// when the config is shown or saved.
+func (cfg *Config) resolveSecrets(ctx context.Context, r *secrets.Resolver) error {
+	cfg.secretRefs = nil
+	for _, s := range cfg.secrets() {
+		if !r.IsRef(s.value) {
+			continue
+		}
+		v, err := r.Resolve(ctx, s.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		if cfg.secretRefs == nil {
+			cfg.secretRefs = make(map[string]string)
+		}
+		cfg.secretRefs[s.name] = s.value
+		s.set(v)
+	}
+	return nil
+}
+
+// restoreSecretRefs replaces the resolved secrets with their references.
+func (cfg *Config) restoreSecretRefs() {
+	if len(cfg.secretRefs) == 0 {
+		return
+	}
+	for _, s := range cfg.secrets() {
+		if ref, exists := cfg.secretRefs[s.name]; exists {
+			s.set(ref)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigSecrets(t *testing.T) {
+	dir := t.TempDir()
+	config := `
+cacheDir: ` + dir + `
+oidc:
+- name: idp
+  discoveryUrl: https://idp.example.com/.well-known/openid-configuration
+  redirectUrl: https://login.example.com/oidc/idp
+  clientId: tlsproxy
+  clientSecret: file:oidc-secret.json#clientSecret
+backends:
+- serverNames: [www.example.com]
+  mode: http
+  addresses: [192.168.0.10:80]
+`
+	for name, content := range map[string]string{
+		"config.yaml":      config,
+		"oidc-secret.json": `{"clientSecret": "s3cr3t"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	cfg, err := ReadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if got, want := cfg.OIDCProviders[0].ClientSecret, "s3cr3t"; got != want {
+		t.Errorf("ClientSecret = %q, want %q", got, want)
+	}
+	ref := "file:oidc-secret.json#clientSecret"
+	if got := cfg.clone().redacted().OIDCProviders[0].ClientSecret; got != ref {
+		t.Errorf("redacted ClientSecret = %q, want %q", got, ref)
+	}
+	if b := cfg.redacted().serialize(); strings.Contains(string(b), "s3cr3t") {
+		t.Errorf("redacted config contains the secret:\n%s", b)
+	}
+
+	os.WriteFile(filepath.Join(dir, "oidc-secret.json"), []byte(`{}`), 0o600)
+	if _, err := ReadConfig(filepath.Join(dir, "config.yaml")); err == nil || !strings.Contains(err.Error(), "oidc[0].clientSecret") {
+		t.Errorf("ReadConfig() err = %v, want oidc[0].clientSecret error", err)
+	}
+}
@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/x509"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// ConnInfo describes an incoming connection.
+type ConnInfo struct {
+	// ID is the connection's unique ID.
+	ID uint64
+	// Type is TLS or QUIC.
+	Type string
+	// RemoteAddr and LocalAddr are the addresses of the connection.
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+	// ServerName is the server name requested by the client, if any.
+	ServerName string
+	// Mode is the mode of the backend that handles the connection, if
+	// any.
+	Mode string
+	// ALPNProto is the ALPN protocol that was negotiated, if any.
+	ALPNProto string
+	// HTTPUpgrade is the protocol that the connection was upgraded to,
+	// e.g. websocket, if any.
+	HTTPUpgrade string
+	// ProxyProtocol is the version of the PROXY protocol header that was
+	// sent to the backend, if any.
+	ProxyProtocol string
+	// ClientCert is the client's certificate, if any.
+	ClientCert *x509.Certificate
+	// JA3 and JA4 are the fingerprints of the client's TLS hello.
+	JA3 string
+	JA4 string
+	// BackendAddr is the address of the backend server that the
+	// connection is forwarded to, if any, and DialAttempts is the number
+	// of attempts that it took to connect to it. BackendFamily is the
+	// address family of BackendAddr, ipv4 or ipv6.
+	BackendAddr   net.Addr
+	DialAttempts  int
+	BackendFamily string
+	// StartTime is when the connection was accepted.
+	StartTime time.Time
+	// HandshakeTime is how long the TLS handshake took, and DialTime is
+	// how long it took to connect to the backend server after the
+	// handshake. They are zero until the handshake is done, or the
+	// connection to the backend server is established.
+	HandshakeTime time.Duration
+	DialTime      time.Duration
+	// BytesSent and BytesReceived are the number of bytes sent to, and
+	// received from, the client.
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// Connections returns the incoming connections that are currently open,
+// ordered by ID.
+func (p *Proxy) Connections() []ConnInfo {
+	conns := p.inConns.slice()
+	out := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		out = append(out, newConnInfo(c))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Connection returns the incoming connection with the given ID, if it is
+// open.
+func (p *Proxy) Connection(id uint64) (ConnInfo, bool) {
+	c := p.inConns.find(id)
+	if c == nil {
+		return ConnInfo{}, false
+	}
+	return newConnInfo(c), true
+}
+
+func newConnInfo(c annotatedConnection) ConnInfo {
+	ci := ConnInfo{
+		ID:            connID(c),
+		RemoteAddr:    c.RemoteAddr(),
+		LocalAddr:     c.LocalAddr(),
+		ServerName:    connServerName(c),
+		Mode:          connMode(c),
+		ALPNProto:     connProto(c),
+		HTTPUpgrade:   connHTTPUpgrade(c),
+		ProxyProtocol: connProxyProto(c),
+		ClientCert:    connClientCert(c),
+		JA3:           connJA3(c),
+		JA4:           connJA4(c),
+		StartTime:     c.Annotation(startTimeKey, time.Time{}).(time.Time),
+		BytesSent:     c.BytesSent(),
+		BytesReceived: c.BytesReceived(),
+	}
+	switch c.(type) {
+	case *netw.Conn:
+		ci.Type = "TLS"
+	case *netw.QUICConn:
+		ci.Type = "QUIC"
+	}
+	hsTime := c.Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	if !hsTime.IsZero() {
+		ci.HandshakeTime = hsTime.Sub(ci.StartTime)
+	}
+	dialStart := hsTime
+	if dialStart.IsZero() {
+		dialStart = ci.StartTime
+	}
+	if dialTime := c.Annotation(dialDoneKey, time.Time{}).(time.Time); !dialTime.IsZero() && !dialTime.Before(dialStart) {
+		ci.DialTime = dialTime.Sub(dialStart)
+	}
+	if intConn := connIntConn(c); intConn != nil {
+		ci.BackendAddr = intConn.RemoteAddr()
+		ci.DialAttempts = connDialAttempts(c)
+		ci.BackendFamily, _ = c.Annotation(dialFamilyKey, "").(string)
+	}
+	return ci
+}
@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestConnInfo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"echo.example.com"},
+				Addresses:   []string{l.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName: "echo.example.com",
+		RootCAs:    extCA.RootCACertPool(),
+		NextProtos: []string{"http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("Hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "Hello\n" {
+		t.Fatalf("ReadString() = %q, %v", line, err)
+	}
+
+	conns := proxy.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("Connections() = %#v, want 1 connection", conns)
+	}
+	ci := conns[0]
+	if got, want := ci.Type, "TLS"; got != want {
+		t.Errorf("Type = %q, want %q", got, want)
+	}
+	if got, want := ci.ServerName, "echo.example.com"; got != want {
+		t.Errorf("ServerName = %q, want %q", got, want)
+	}
+	if got, want := ci.Mode, ModeTCP; got != want {
+		t.Errorf("Mode = %q, want %q", got, want)
+	}
+	if got, want := ci.ALPNProto, "http/1.1"; got != want {
+		t.Errorf("ALPNProto = %q, want %q", got, want)
+	}
+	if got, want := ci.RemoteAddr.String(), conn.LocalAddr().String(); got != want {
+		t.Errorf("RemoteAddr = %q, want %q", got, want)
+	}
+	if ci.BackendAddr == nil || ci.BackendAddr.String() != l.Addr().String() {
+		t.Errorf("BackendAddr = %v, want %v", ci.BackendAddr, l.Addr())
+	}
+	if ci.DialAttempts != 1 {
+		t.Errorf("DialAttempts = %d, want 1", ci.DialAttempts)
+	}
+	if ci.HandshakeTime <= 0 || ci.StartTime.IsZero() {
+		t.Errorf("HandshakeTime = %v, StartTime = %v", ci.HandshakeTime, ci.StartTime)
+	}
+	if ci.BytesSent == 0 || ci.BytesReceived == 0 {
+		t.Errorf("BytesSent = %d, BytesReceived = %d", ci.BytesSent, ci.BytesReceived)
+	}
+	if ci.JA4 == "" {
+		t.Error("JA4 is empty")
+	}
+
+	if got, ok := proxy.Connection(ci.ID); !ok || got.ID != ci.ID {
+		t.Errorf("Connection(%d) = %#v, %v", ci.ID, got, ok)
+	}
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := proxy.Connection(ci.ID); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Connection(%d) still open after close", ci.ID)
+		}
+	}
+}
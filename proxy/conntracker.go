@@ -38,8 +38,9 @@ type connKey struct {
 }
 
 type connTracker struct {
-	mu    sync.Mutex
-	conns map[connKey]annotatedConnection
+	mu     sync.Mutex
+	conns  map[connKey]annotatedConnection
+	nextID uint64
 }
 
 func (t *connTracker) slice() []annotatedConnection {
@@ -58,6 +59,8 @@ func (t *connTracker) add(c annotatedConnection) int {
 	if t.conns == nil {
 		t.conns = make(map[connKey]annotatedConnection)
 	}
+	t.nextID++
+	c.SetAnnotation(connIDKey, t.nextID)
 	cc := localNetConn(c)
 	t.conns[connKey{src: cc.LocalAddr(), dst: cc.RemoteAddr()}] = c
 	return len(t.conns)
@@ -70,3 +73,15 @@ func (t *connTracker) remove(c annotatedConnection) int {
 	delete(t.conns, connKey{src: cc.LocalAddr(), dst: cc.RemoteAddr()})
 	return len(t.conns)
 }
+
+// find returns the connection with the given ID.
+func (t *connTracker) find(id uint64) annotatedConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, v := range t.conns {
+		if connID(v) == id {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/x509"
+	"log"
+	"net/http"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
+)
+
+// consoleRole is the role of a user on a CONSOLE backend with ConsoleAuth.
+type consoleRole int
+
+const (
+	consoleRoleNone consoleRole = iota
+	consoleRoleViewer
+	consoleRoleAdmin
+)
+
+func (r consoleRole) String() string {
+	switch r {
+	case consoleRoleViewer:
+		return "viewer"
+	case consoleRoleAdmin:
+		return "admin"
+	default:
+		return "none"
+	}
+}
+
+// role returns the role of the user who sent req, based on their SSO claims
+// and client certificate.
+func (ca *ConsoleAuth) role(req *http.Request) consoleRole {
+	var matchers []func(string) bool
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		matchers = append(matchers, claimsACLTerm(claims))
+	}
+	var cert *x509.Certificate
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert = req.TLS.PeerCertificates[0]
+	} else if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		cert = connClientCert(conn)
+	}
+	if cert != nil {
+		matchers = append(matchers, certACLTerm(cert))
+	}
+	if len(matchers) == 0 {
+		return consoleRoleNone
+	}
+	match := func(term string) bool {
+		for _, m := range matchers {
+			if m(term) {
+				return true
+			}
+		}
+		return false
+	}
+	if matchACL(ca.Admins, match) {
+		return consoleRoleAdmin
+	}
+	if matchACL(ca.Viewers, match) {
+		return consoleRoleViewer
+	}
+	return consoleRoleNone
+}
+
+// authorizeConsole checks that the user has the role required by the
+// handler, and records the request in the log and in the audit log. It
+// returns true if the request should be served.
+func (be *Backend) authorizeConsole(w http.ResponseWriter, req *http.Request, required consoleRole) bool {
+	if required == consoleRoleNone {
+		return true
+	}
+	// Without ConsoleAuth, nobody has a role.
+	role := consoleRoleNone
+	if be.ConsoleAuth != nil {
+		role = be.ConsoleAuth.role(req)
+	}
+	if role < required {
+		log.Printf("AUD %s ➔ %s %s ➔ denied, role:%s required:%s", formatReqDesc(req), req.Method, req.URL.Path, role, required)
+		be.auditRequest(req, auditlog.TypeAdmin, auditlog.ResultDeny, "role:"+role.String(), "required:"+required.String())
+		be.recordEvent("console access denied")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	log.Printf("AUD %s ➔ %s %s ➔ role:%s", formatReqDesc(req), req.Method, req.URL.Path, role)
+	be.auditRequest(req, auditlog.TypeAdmin, auditlog.ResultAllow, "role:"+role.String())
+	return true
+}
@@ -0,0 +1,268 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestConsoleAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{be1.listener.Addr().String()},
+				},
+				{
+					ServerNames: []string{"console.example.com"},
+					Mode:        "CONSOLE",
+					ClientAuth: &ClientAuth{
+						Mode:    ClientAuthRequest,
+						RootCAs: []string{intCA.RootCAPEM()},
+					},
+					ConsoleAuth: &ConsoleAuth{
+						Admins:  []string{"DNS:admin.example.com"},
+						Viewers: []string{"SUBJECT:CN=viewer.example.com"},
+					},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	call := func(certName, method, path string, form url.Values) int {
+		var certs []tls.Certificate
+		if certName != "" {
+			c, err := intCA.GetCert(certName)
+			if err != nil {
+				t.Fatalf("intCA.GetCert: %v", err)
+			}
+			certs = append(certs, *c)
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+					return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+						ServerName:   "console.example.com",
+						RootCAs:      extCA.RootCACertPool(),
+						Certificates: certs,
+					})
+				},
+			},
+			Timeout: 5 * time.Second,
+		}
+		req, err := http.NewRequest(method, "https://console.example.com"+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	drain := url.Values{"serverName": {"example.com"}}
+	for _, tc := range []struct {
+		cert   string
+		method string
+		path   string
+		form   url.Values
+		want   int
+	}{
+		{"", http.MethodGet, "/", nil, http.StatusForbidden},
+		{"", http.MethodGet, "/api/backends", nil, http.StatusForbidden},
+		{"other.example.com", http.MethodGet, "/api/backends", nil, http.StatusForbidden},
+		{"viewer.example.com", http.MethodGet, "/", nil, http.StatusOK},
+		{"viewer.example.com", http.MethodGet, "/api/backends", nil, http.StatusOK},
+		{"viewer.example.com", http.MethodPost, "/api/backends/drain", drain, http.StatusForbidden},
+		{"admin.example.com", http.MethodGet, "/api/backends", nil, http.StatusOK},
+		{"admin.example.com", http.MethodPost, "/api/backends/drain", drain, http.StatusOK},
+		{"admin.example.com", http.MethodPost, "/api/backends/enable", drain, http.StatusOK},
+	} {
+		if got := call(tc.cert, tc.method, tc.path, tc.form); got != tc.want {
+			t.Errorf("[%s] %s %s = %d, want %d", tc.cert, tc.method, tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestConsoleAuthCheck(t *testing.T) {
+	for _, tc := range []struct {
+		be        *Backend
+		revisions int
+		wantErr   string
+	}{
+		{
+			be: &Backend{
+				Mode:        ModeConsole,
+				ClientAuth:  &ClientAuth{},
+				ConsoleAuth: &ConsoleAuth{Admins: []string{"DNS:admin.example.com"}},
+			},
+		},
+		{
+			be: &Backend{
+				Mode:        ModeConsole,
+				ConsoleAuth: &ConsoleAuth{Admins: []string{"DNS:admin.example.com"}},
+			},
+			wantErr: "SSO or ClientAuth is required",
+		},
+		{
+			be: &Backend{
+				Mode:        ModeConsole,
+				ClientAuth:  &ClientAuth{},
+				ConsoleAuth: &ConsoleAuth{Viewers: []string{"DNS:viewer.example.com"}},
+			},
+			wantErr: "Admins: at least one rule is required",
+		},
+		{
+			be: &Backend{
+				Mode:        ModeLocal,
+				ClientAuth:  &ClientAuth{},
+				ConsoleAuth: &ConsoleAuth{Admins: []string{"DNS:admin.example.com"}},
+			},
+			wantErr: "field is not valid in mode LOCAL",
+		},
+		{
+			be: &Backend{
+				Mode:         ModeConsole,
+				ClientAuth:   &ClientAuth{},
+				ConsoleDebug: &ConsoleDebug{PProf: true},
+			},
+			wantErr: "ConsoleDebug: ConsoleAuth must be set",
+		},
+		{
+			be: &Backend{
+				Mode:        ModeConsole,
+				ClientAuth:  &ClientAuth{},
+				ConsoleAuth: &ConsoleAuth{Admins: []string{"DNS:admin.example.com"}},
+			},
+			revisions: 2,
+		},
+		{
+			be: &Backend{
+				Mode:       ModeConsole,
+				ClientAuth: &ClientAuth{},
+			},
+			revisions: 2,
+			wantErr:   "ConfigRevisions: the admin API requires a CONSOLE backend with ConsoleAuth",
+		},
+	} {
+		tc.be.ServerNames = []string{"console.example.com"}
+		cfg := &Config{
+			CacheDir:        t.TempDir(),
+			ConfigRevisions: tc.revisions,
+			Backends:        []*Backend{tc.be},
+		}
+		err := cfg.Check()
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("Check() = %v", err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("Check() = %v, want %q", err, tc.wantErr)
+		}
+	}
+}
+
+func TestConsoleWithoutConsoleAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"console.example.com"},
+					Mode:        "CONSOLE",
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	// The metrics are still available, but the admin API isn't.
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/", "HTTP/2.0 200 OK"},
+		{"/api/backends", "HTTP/2.0 404 Not Found"},
+		{"/api/config", "HTTP/2.0 404 Not Found"},
+	} {
+		got, _, err := httpGet("console.example.com", proxy.listener.Addr().String(), tc.path, extCA, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("GET %s = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const (
+	// PostgreSQL request codes and protocol version, from the frontend/
+	// backend protocol.
+	pgSSLRequestCode    = 80877103
+	pgGSSENCRequestCode = 80877104
+	pgCancelRequestCode = 80877102
+	pgProtocolVersion3  = 3 << 16
+	// pgMaxStartupLen is the maximum length of a startup message.
+	pgMaxStartupLen = 10000
+
+	// MySQL capability flags.
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+	// mysqlMaxPacketLen is the maximum length of the packets that the
+	// proxy reads before the TLS handshake.
+	mysqlMaxPacketLen = 4096
+
+	databaseHandshakeTimeout = 30 * time.Second
+)
+
+var ctxDatabaseRouteKey ctxKey = 2
+
+// peekPostgresSSLRequest checks whether the connection starts with a
+// PostgreSQL SSLRequest. If so, the request is consumed and accepted, and the
+// client starts a TLS handshake next. A GSSENCRequest, which libpq may send
+// before the SSLRequest, is declined.
+func peekPostgresSSLRequest(conn *netw.Conn) (bool, error) {
+	for {
+		var buf [8]byte
+		if _, err := conn.Peek(buf[:1]); err != nil || buf[0] != 0 {
+			// Not a PostgreSQL request. Let peekClientHello report the
+			// error, if any.
+			return false, nil
+		}
+		if _, err := conn.Peek(buf[:]); err != nil {
+			return false, err
+		}
+		if binary.BigEndian.Uint32(buf[:4]) != 8 {
+			return false, nil
+		}
+		var reply byte
+		switch binary.BigEndian.Uint32(buf[4:]) {
+		case pgSSLRequestCode:
+			reply = 'S'
+		case pgGSSENCRequestCode:
+			reply = 'N'
+		default:
+			return false, nil
+		}
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return false, err
+		}
+		if _, err := conn.Write([]byte{reply}); err != nil {
+			return false, err
+		}
+		if reply == 'S' {
+			return true, nil
+		}
+	}
+}
+
+// handleDatabaseConnection handles a connection to a POSTGRES or MYSQL
+// backend, after the TLS handshake with the client.
+func (p *Proxy) handleDatabaseConnection(extConn *tls.Conn, intConn net.Conn) {
+	if !p.authorizeTLSConnection(extConn) {
+		return
+	}
+	serverName := connServerName(extConn)
+	be := connBackend(extConn)
+
+	var startup []byte
+	var desc string
+	if be.Mode == ModePostgres {
+		if err := be.waitForward(p.ctx); err != nil {
+			p.recordEvent(err.Error())
+			log.Printf("ERR [-] %s ➔  %q Wait: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+			return
+		}
+		extConn.SetReadDeadline(time.Now().Add(databaseHandshakeTimeout))
+		msg, params, err := readPostgresStartup(extConn)
+		if err != nil {
+			log.Printf("BAD [-] %s ➔ %q Startup: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+			return
+		}
+		extConn.SetReadDeadline(time.Time{})
+		startup = msg
+		ctx := context.WithValue(p.ctx, connCtxKey, extConn)
+		if id := be.Database.route(params["database"], params["user"]); id >= 0 {
+			ctx = context.WithValue(ctx, ctxDatabaseRouteKey, id)
+		}
+		if intConn, err = be.dialRetry(ctx); err != nil {
+			p.recordEvent("dial error")
+			log.Printf("ERR [-] %s ➔  %q Dial: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+			return
+		}
+		defer intConn.Close()
+		setKeepAlive(intConn)
+		annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
+		p.observeDial(extConn, be)
+		var ids []string
+		if user := params["user"]; user != "" {
+			ids = append(ids, user+"@"+params["database"])
+		}
+		desc = formatConnDesc(annotatedConn(extConn), ids...)
+	} else {
+		desc = formatConnDesc(annotatedConn(extConn))
+	}
+	log.Printf("CON %s", desc)
+
+	if len(startup) > 0 {
+		if _, err := intConn.Write(startup); err != nil {
+			log.Printf("ERR %s %v", desc, err)
+			return
+		}
+	}
+	if err := be.bridgeConns(extConn, intConn); err != nil {
+		log.Printf("DBG %s %v", desc, err)
+	}
+
+	startTime := annotatedConn(extConn).Annotation(startTimeKey, time.Time{}).(time.Time)
+	hsTime := annotatedConn(extConn).Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
+	totalTime := time.Since(startTime).Truncate(time.Millisecond)
+	hsDur, dialDur := hsTime.Sub(startTime), dialTime.Sub(hsTime)
+	if be.Mode == ModeMySQL {
+		// The connection to the backend is opened before the handshake.
+		hsDur, dialDur = hsTime.Sub(dialTime), dialTime.Sub(startTime)
+	}
+
+	logConnEnd(extConn, "END %s; HS:%s Dial:%s Dur:%s Recv:%d Sent:%d", desc,
+		hsDur.Truncate(time.Millisecond), dialDur.Truncate(time.Millisecond), totalTime,
+		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
+}
+
+// route returns the index of the first route that matches the database and
+// user, or -1.
+func (db *Database) route(database, user string) int {
+	if db == nil {
+		return -1
+	}
+	for i, r := range db.Routes {
+		if (r.Database == "" || r.Database == database) && (r.User == "" || r.User == user) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readPostgresStartup reads the client's startup message. It returns the
+// whole message, to forward to the backend, and its parameters. Cancel
+// requests have no parameters.
+func readPostgresStartup(r io.Reader) ([]byte, map[string]string, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length < 8 || length > pgMaxStartupLen {
+		return nil, nil, fmt.Errorf("invalid length %d", length)
+	}
+	msg := make([]byte, length)
+	copy(msg, hdr[:])
+	if _, err := io.ReadFull(r, msg[8:]); err != nil {
+		return nil, nil, err
+	}
+	params := make(map[string]string)
+	code := binary.BigEndian.Uint32(hdr[4:])
+	switch {
+	case code == pgCancelRequestCode:
+		return msg, params, nil
+	case code>>16 != pgProtocolVersion3>>16:
+		return nil, nil, fmt.Errorf("unsupported protocol version or request %d", code)
+	}
+	fields := msg[8:]
+	for {
+		key, rest, ok := cutNul(fields)
+		if !ok {
+			return nil, nil, errors.New("invalid startup message")
+		}
+		if key == "" {
+			break
+		}
+		value, rest, ok := cutNul(rest)
+		if !ok {
+			return nil, nil, errors.New("invalid startup message")
+		}
+		params[key] = value
+		fields = rest
+	}
+	if params["database"] == "" {
+		params["database"] = params["user"]
+	}
+	return msg, params, nil
+}
+
+func cutNul(b []byte) (string, []byte, bool) {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i]), b[i+1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// postgresStartTLS asks the backend server to start a TLS handshake with an
+// SSLRequest.
+func postgresStartTLS(conn net.Conn) ([]byte, error) {
+	req := binary.BigEndian.AppendUint32(nil, 8)
+	req = binary.BigEndian.AppendUint32(req, pgSSLRequestCode)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != 'S' {
+		return nil, errors.New("server doesn't support TLS")
+	}
+	return nil, nil
+}
+
+// mySQLStartTLS reads the backend server's greeting and requests a TLS
+// handshake. It returns the greeting, which is relayed to the client.
+func mySQLStartTLS(conn net.Conn) ([]byte, error) {
+	greeting, err := readMySQLPacket(conn)
+	if err != nil {
+		return nil, err
+	}
+	caps, charset, err := parseMySQLGreeting(greeting[4:])
+	if err != nil {
+		return nil, err
+	}
+	if caps&mysqlClientSSL == 0 {
+		return nil, errors.New("server doesn't support TLS")
+	}
+	// The client's capabilities are sent again in its handshake response,
+	// after the TLS handshake. This request only needs to ask for TLS.
+	req := []byte{32, 0, 0, 1}
+	req = binary.LittleEndian.AppendUint32(req, mysqlClientLongPassword|mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConnection|mysqlClientPluginAuth)
+	req = binary.LittleEndian.AppendUint32(req, 1<<24-1)
+	req = append(req, charset)
+	req = append(req, make([]byte, 23)...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	return greeting, nil
+}
+
+// parseMySQLGreeting returns the capability flags and the character set of
+// a HandshakeV10 packet.
+func parseMySQLGreeting(b []byte) (uint32, byte, error) {
+	if len(b) == 0 || b[0] != 10 {
+		return 0, 0, errors.New("unexpected greeting")
+	}
+	_, rest, ok := cutNul(b[1:])
+	// connection id (4), auth-plugin-data-part-1 (8), filler (1),
+	// capability flags (2), character set (1), status flags (2),
+	// capability flags (2)
+	if !ok || len(rest) < 20 {
+		return 0, 0, errors.New("invalid greeting")
+	}
+	caps := uint32(binary.LittleEndian.Uint16(rest[13:15])) | uint32(binary.LittleEndian.Uint16(rest[18:20]))<<16
+	return caps, rest[15], nil
+}
+
+// readMySQLPacket reads one packet, including its 4-byte header.
+func readMySQLPacket(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	if length > mysqlMaxPacketLen {
+		return nil, fmt.Errorf("packet too long: %d", length)
+	}
+	pkt := make([]byte, 4+length)
+	copy(pkt, hdr[:])
+	if _, err := io.ReadFull(r, pkt[4:]); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// mySQLPreamble handles the beginning of a connection received on MySQLAddr,
+// before the TLS handshake. The proxy connects to the MYSQL backend, relays
+// the server's greeting, and reads the client's SSLRequest. It returns the
+// backend and the connection to the backend server.
+func (p *Proxy) mySQLPreamble(conn *netw.Conn) (*Backend, net.Conn, error) {
+	be := p.mySQLBackend()
+	if be == nil {
+		return nil, nil, errors.New("no MYSQL backend")
+	}
+	if err := be.checkIP(conn.RemoteAddr()); err != nil {
+		return nil, nil, err
+	}
+	conn.SetAnnotation(serverNameKey, be.ServerNames[0])
+	if err := be.waitForward(p.ctx); err != nil {
+		return nil, nil, err
+	}
+	intConn, err := be.dialRetry(context.WithValue(p.ctx, connCtxKey, conn))
+	if err != nil {
+		be.recordEvent("dial error")
+		return nil, nil, fmt.Errorf("dial: %w", err)
+	}
+	conn.SetAnnotation(dialDoneKey, time.Now())
+	p.observeDial(conn, be)
+	if err := p.mySQLExchangeGreeting(conn, intConn); err != nil {
+		intConn.Close()
+		return nil, nil, err
+	}
+	setKeepAlive(intConn)
+	return be, intConn, nil
+}
+
+func (p *Proxy) mySQLExchangeGreeting(conn, intConn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(databaseHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	greeting, err := readMySQLPacket(intConn)
+	if err != nil {
+		return fmt.Errorf("greeting: %w", err)
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	req, err := readMySQLPacket(conn)
+	if err != nil {
+		return fmt.Errorf("SSLRequest: %w", err)
+	}
+	if len(req) < 8 || binary.LittleEndian.Uint32(req[4:8])&mysqlClientSSL == 0 {
+		p.recordEvent("mysql client without TLS")
+		return errors.New("client didn't request TLS")
+	}
+	return nil
+}
+
+// mySQLBackend returns the backend in MYSQL mode, if there is one.
+func (p *Proxy) mySQLBackend() *Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, be := range p.cfg.Backends {
+		if be.Mode == ModeMySQL {
+			return be
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// newDatabaseServer starts a backend server that reads the client's first
+// message and responds with its name and the message's parameters.
+func newDatabaseServer(t *testing.T, ctx context.Context, name, mode string, tc *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	serve := func(conn net.Conn) error {
+		defer conn.Close()
+		switch mode {
+		case ModePostgres:
+			if tc != nil {
+				var req [8]byte
+				if _, err := io.ReadFull(conn, req[:]); err != nil {
+					return err
+				}
+				if binary.BigEndian.Uint32(req[4:]) != pgSSLRequestCode {
+					return fmt.Errorf("unexpected request %v", req)
+				}
+				conn.Write([]byte{'S'})
+				conn = tls.Server(conn, tc)
+			}
+			_, params, err := readPostgresStartup(conn)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(conn, "Hello from %s to %s@%s\n", name, params["user"], params["database"])
+			return err
+		case ModeMySQL:
+			greeting := []byte{10}
+			greeting = append(greeting, "8.0.0-test\x00"...)
+			greeting = append(greeting, 1, 0, 0, 0)                   // connection id
+			greeting = append(greeting, "abcdefgh\x00"...)            // auth-plugin-data-part-1, filler
+			greeting = append(greeting, 0x00, 0x8a)                   // capability flags, with CLIENT_SSL and CLIENT_PROTOCOL_41
+			greeting = append(greeting, 0x21, 0x02, 0x00, 0x08, 0x00) // character set, status flags, capability flags
+			greeting = append(greeting, make([]byte, 11)...)
+			if _, err := conn.Write(append([]byte{byte(len(greeting)), 0, 0, 0}, greeting...)); err != nil {
+				return err
+			}
+			req, err := readMySQLPacket(conn)
+			if err != nil {
+				return err
+			}
+			if len(req) != 36 || req[3] != 1 || binary.LittleEndian.Uint32(req[4:])&mysqlClientSSL == 0 {
+				return fmt.Errorf("unexpected SSLRequest %v", req)
+			}
+			conn = tls.Server(conn, tc)
+			resp, err := readMySQLPacket(conn)
+			if err != nil {
+				return err
+			}
+			if resp[3] != 2 {
+				return fmt.Errorf("unexpected sequence id %d", resp[3])
+			}
+			_, err = fmt.Fprintf(conn, "Hello from %s to %s\n", name, resp[4:])
+			return err
+		}
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					t.Errorf("[%s] Accept: %v", name, err)
+				}
+				return
+			}
+			go func() {
+				if err := serve(conn); err != nil {
+					t.Errorf("[%s] %v", name, err)
+				}
+			}()
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	return l
+}
+
+func pgStartupMessage(params ...string) []byte {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, pgProtocolVersion3)
+	for _, p := range params {
+		body = append(body, p...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+	return append(binary.BigEndian.AppendUint32(nil, uint32(4+len(body))), body...)
+}
+
+func TestDatabaseBackends(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	pg1 := newDatabaseServer(t, ctx, "pg1", ModePostgres, nil)
+	pg2 := newDatabaseServer(t, ctx, "pg2", ModePostgres, nil)
+	pg3 := newDatabaseServer(t, ctx, "pg3", ModePostgres, intCA.TLSConfig())
+	my := newDatabaseServer(t, ctx, "mysql", ModeMySQL, intCA.TLSConfig())
+
+	cfg := &Config{
+		HTTPAddr:  "localhost:0",
+		TLSAddr:   "localhost:0",
+		MySQLAddr: "localhost:0",
+		CacheDir:  t.TempDir(),
+		MaxOpen:   100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"pg.example.com"},
+				Addresses:   []string{pg1.Addr().String()},
+				Mode:        ModePostgres,
+				Database: &Database{
+					Routes: []*DatabaseRoute{
+						{Database: "analytics", Addresses: []string{pg2.Addr().String()}},
+					},
+				},
+			},
+			{
+				ServerNames:       []string{"pg-tls.example.com"},
+				Addresses:         []string{pg3.Addr().String()},
+				Mode:              ModePostgres,
+				ForwardRootCAs:    []string{intCA.RootCAPEM()},
+				ForwardServerName: "pg-internal.example.com",
+				Database: &Database{
+					ForwardTLS: true,
+				},
+			},
+			{
+				ServerNames:       []string{"mysql.example.com"},
+				Addresses:         []string{my.Addr().String()},
+				Mode:              ModeMySQL,
+				ForwardRootCAs:    []string{intCA.RootCAPEM()},
+				ForwardServerName: "mysql-internal.example.com",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	pgGet := func(name string, sslRequest bool, params ...string) (string, error) {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if sslRequest {
+			if _, err := conn.Write(binary.BigEndian.AppendUint32([]byte{0, 0, 0, 8}, pgSSLRequestCode)); err != nil {
+				return "", err
+			}
+			var reply [1]byte
+			if _, err := io.ReadFull(conn, reply[:]); err != nil {
+				return "", err
+			}
+			if reply[0] != 'S' {
+				return "", fmt.Errorf("unexpected reply %q", reply)
+			}
+		}
+		// Direct TLS requires ALPN. Older clients don't use it.
+		var protos []string
+		if !sslRequest {
+			protos = []string{"postgresql"}
+		}
+		tc := tls.Client(conn, &tls.Config{
+			ServerName: name,
+			RootCAs:    extCA.RootCACertPool(),
+			NextProtos: protos,
+		})
+		if _, err := tc.Write(pgStartupMessage(params...)); err != nil {
+			return "", err
+		}
+		b, err := io.ReadAll(tc)
+		return string(b), err
+	}
+	for _, tc := range []struct {
+		name       string
+		sslRequest bool
+		params     []string
+		want       string
+	}{
+		{"pg.example.com", true, []string{"user", "alice", "database", "app"}, "Hello from pg1 to alice@app\n"},
+		{"pg.example.com", false, []string{"user", "alice", "database", "analytics"}, "Hello from pg2 to alice@analytics\n"},
+		{"pg.example.com", true, []string{"user", "bob"}, "Hello from pg1 to bob@bob\n"},
+		{"pg-tls.example.com", true, []string{"user", "bob", "database", "app"}, "Hello from pg3 to bob@app\n"},
+	} {
+		if got, err := pgGet(tc.name, tc.sslRequest, tc.params...); err != nil || got != tc.want {
+			t.Errorf("pgGet(%q, %v) = %q, %v, want %q", tc.name, tc.params, got, err, tc.want)
+		}
+	}
+
+	conn, err := net.Dial("tcp", proxy.mySQLListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	greeting, err := readMySQLPacket(conn)
+	if err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+	if caps, _, err := parseMySQLGreeting(greeting[4:]); err != nil || caps&mysqlClientSSL == 0 {
+		t.Fatalf("parseMySQLGreeting = %x, %v", caps, err)
+	}
+	req := []byte{32, 0, 0, 1}
+	req = binary.LittleEndian.AppendUint32(req, mysqlClientProtocol41|mysqlClientSSL)
+	req = append(req, make([]byte, 28)...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("SSLRequest: %v", err)
+	}
+	tc := tls.Client(conn, &tls.Config{
+		ServerName: "mysql.example.com",
+		RootCAs:    extCA.RootCACertPool(),
+	})
+	if _, err := tc.Write([]byte{5, 0, 0, 2, 'a', 'l', 'i', 'c', 'e'}); err != nil {
+		t.Fatalf("HandshakeResponse: %v", err)
+	}
+	if got, err := io.ReadAll(tc); err != nil || string(got) != "Hello from mysql to alice\n" {
+		t.Errorf("mysql = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,172 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+)
+
+// handlers returns the debugging endpoints that are enabled.
+func (cd *ConsoleDebug) handlers() []localHandler {
+	if cd == nil {
+		return nil
+	}
+	var h []localHandler
+	if cd.PProf {
+		h = append(h,
+			localHandler{desc: "PProf", path: "/debug/pprof", matchPrefix: true, role: consoleRoleAdmin, handler: logHandler(http.HandlerFunc(pprof.Index))},
+			localHandler{desc: "PProf Command Line", path: "/debug/pprof/cmdline", role: consoleRoleAdmin, handler: logHandler(http.HandlerFunc(pprof.Cmdline))},
+			localHandler{desc: "PProf CPU Profile", path: "/debug/pprof/profile", role: consoleRoleAdmin, handler: logHandler(http.HandlerFunc(pprof.Profile))},
+			localHandler{desc: "PProf Symbols", path: "/debug/pprof/symbol", role: consoleRoleAdmin, handler: logHandler(http.HandlerFunc(pprof.Symbol))},
+		)
+	}
+	if cd.Trace {
+		h = append(h, localHandler{desc: "Execution Trace", path: "/debug/pprof/trace", role: consoleRoleAdmin, handler: logHandler(http.HandlerFunc(pprof.Trace))})
+	} else if cd.PProf {
+		// Otherwise, /debug/pprof/trace would be served by pprof.Index.
+		h = append(h, localHandler{path: "/debug/pprof/trace", role: consoleRoleAdmin, handler: http.NotFoundHandler()})
+	}
+	if cd.Expvar {
+		h = append(h, localHandler{desc: "Exported Variables", path: "/debug/vars", role: consoleRoleAdmin, handler: logHandler(expvar.Handler())})
+	}
+	if cd.Runtime {
+		h = append(h,
+			localHandler{desc: "Runtime", path: "/debug/runtime", role: consoleRoleAdmin, handler: logHandler(adminGet(debugRuntime))},
+			localHandler{desc: "Runtime Settings", path: "/debug/runtime/set", role: consoleRoleAdmin, handler: logHandler(adminPost(debugRuntimeSet))},
+			localHandler{desc: "Runtime GC", path: "/debug/runtime/gc", role: consoleRoleAdmin, handler: logHandler(adminPost(debugRuntimeGC))},
+		)
+	}
+	return h
+}
+
+type debugRuntimeInfo struct {
+	GoVersion      string `json:"goVersion"`
+	NumCPU         int    `json:"numCPU"`
+	GOMAXPROCS     int    `json:"gomaxprocs"`
+	GCPercent      int64  `json:"gcPercent"`
+	MemoryLimit    int64  `json:"memoryLimit"`
+	NumGoroutine   int    `json:"numGoroutine"`
+	HeapAlloc      uint64 `json:"heapAlloc"`
+	HeapSys        uint64 `json:"heapSys"`
+	HeapReleased   uint64 `json:"heapReleased"`
+	Sys            uint64 `json:"sys"`
+	NumGC          uint32 `json:"numGC"`
+	PauseTotalNs   uint64 `json:"pauseTotalNs"`
+	LastGCUnixNano uint64 `json:"lastGCUnixNano"`
+}
+
+// debugRuntime returns the runtime settings and statistics.
+func debugRuntime(*http.Request) (any, error) {
+	samples := []metrics.Sample{
+		{Name: "/gc/gogc:percent"},
+		{Name: "/gc/gomemlimit:bytes"},
+	}
+	metrics.Read(samples)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	info := debugRuntimeInfo{
+		GoVersion:      runtime.Version(),
+		NumCPU:         runtime.NumCPU(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		GCPercent:      -1,
+		MemoryLimit:    math.MaxInt64,
+		NumGoroutine:   runtime.NumGoroutine(),
+		HeapAlloc:      ms.HeapAlloc,
+		HeapSys:        ms.HeapSys,
+		HeapReleased:   ms.HeapReleased,
+		Sys:            ms.Sys,
+		NumGC:          ms.NumGC,
+		PauseTotalNs:   ms.PauseTotalNs,
+		LastGCUnixNano: ms.LastGC,
+	}
+	if v := samples[0].Value; v.Kind() == metrics.KindUint64 {
+		info.GCPercent = int64(v.Uint64())
+	}
+	if v := samples[1].Value; v.Kind() == metrics.KindUint64 && v.Uint64() < math.MaxInt64 {
+		info.MemoryLimit = int64(v.Uint64())
+	}
+	return info, nil
+}
+
+// debugRuntimeSet changes the runtime settings that are set in the
+// request: gomaxprocs, gcPercent, and memoryLimit. A negative gcPercent
+// turns off the garbage collector, and a negative memoryLimit removes the
+// limit.
+func debugRuntimeSet(req *http.Request) (any, error) {
+	var changes []func()
+	if v := req.Form.Get("gomaxprocs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("gomaxprocs: must be a positive integer")
+		}
+		changes = append(changes, func() {
+			prev := runtime.GOMAXPROCS(n)
+			log.Printf("INF GOMAXPROCS changed from %d to %d", prev, n)
+		})
+	}
+	if v := req.Form.Get("gcPercent"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("gcPercent: %w", err)
+		}
+		changes = append(changes, func() {
+			prev := debug.SetGCPercent(n)
+			log.Printf("INF GC percent changed from %d to %d", prev, n)
+		})
+	}
+	if v := req.Form.Get("memoryLimit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("memoryLimit: %w", err)
+		}
+		if n < 0 {
+			n = math.MaxInt64
+		}
+		changes = append(changes, func() {
+			prev := debug.SetMemoryLimit(n)
+			log.Printf("INF Memory limit changed from %d to %d", prev, n)
+		})
+	}
+	for _, f := range changes {
+		f()
+	}
+	return debugRuntime(req)
+}
+
+// debugRuntimeGC runs a garbage collection and returns as much memory as
+// possible to the operating system.
+func debugRuntimeGC(req *http.Request) (any, error) {
+	debug.FreeOSMemory()
+	return debugRuntime(req)
+}
@@ -0,0 +1,167 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestConsoleDebug(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"console.example.com"},
+				Mode:        "CONSOLE",
+				ClientAuth: &ClientAuth{
+					Mode:    ClientAuthRequest,
+					RootCAs: []string{intCA.RootCAPEM()},
+				},
+				ConsoleAuth: &ConsoleAuth{
+					Admins:  []string{"DNS:admin.example.com"},
+					Viewers: []string{"DNS:viewer.example.com"},
+				},
+				ConsoleDebug: &ConsoleDebug{
+					PProf:   true,
+					Expvar:  true,
+					Runtime: true,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg.clone(), extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	call := func(certName, method, path string, form url.Values) (int, string) {
+		c, err := intCA.GetCert(certName)
+		if err != nil {
+			t.Fatalf("intCA.GetCert: %v", err)
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+					return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+						ServerName:   "console.example.com",
+						RootCAs:      extCA.RootCACertPool(),
+						Certificates: []tls.Certificate{*c},
+					})
+				},
+			},
+			Timeout: 5 * time.Second,
+		}
+		req, err := http.NewRequest(method, "https://console.example.com"+path, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set("x-csrf-check", "1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, tc := range []struct {
+		cert   string
+		method string
+		path   string
+		want   int
+	}{
+		{"viewer.example.com", http.MethodGet, "/debug/pprof/", http.StatusForbidden},
+		{"viewer.example.com", http.MethodGet, "/debug/vars", http.StatusForbidden},
+		{"viewer.example.com", http.MethodGet, "/debug/runtime", http.StatusForbidden},
+		{"admin.example.com", http.MethodGet, "/debug/pprof/", http.StatusOK},
+		{"admin.example.com", http.MethodGet, "/debug/pprof/goroutine", http.StatusOK},
+		{"admin.example.com", http.MethodGet, "/debug/pprof/trace", http.StatusNotFound},
+		{"admin.example.com", http.MethodGet, "/debug/vars", http.StatusOK},
+		{"admin.example.com", http.MethodGet, "/debug/runtime", http.StatusOK},
+		{"admin.example.com", http.MethodGet, "/debug/runtime/gc", http.StatusMethodNotAllowed},
+		{"admin.example.com", http.MethodPost, "/debug/runtime/gc", http.StatusOK},
+	} {
+		if got, body := call(tc.cert, tc.method, tc.path, nil); got != tc.want {
+			t.Errorf("[%s] %s %s = %d, want %d: %s", tc.cert, tc.method, tc.path, got, tc.want, body)
+		}
+	}
+
+	prev := debug.SetGCPercent(-1)
+	debug.SetGCPercent(prev)
+	defer debug.SetGCPercent(prev)
+	code, body := call("admin.example.com", http.MethodPost, "/debug/runtime/set", url.Values{"gcPercent": {"150"}})
+	if code != http.StatusOK {
+		t.Fatalf("set = %d %s", code, body)
+	}
+	var info debugRuntimeInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if info.GCPercent != 150 {
+		t.Errorf("GCPercent = %d, want 150", info.GCPercent)
+	}
+	if code, body := call("admin.example.com", http.MethodPost, "/debug/runtime/set", url.Values{"gomaxprocs": {"0"}}); code != http.StatusBadRequest {
+		t.Errorf("set(gomaxprocs=0) = %d %s", code, body)
+	}
+
+	cfg.Backends[0].ConsoleDebug = nil
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/runtime"} {
+		if code, _ := call("admin.example.com", http.MethodGet, path, nil); code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want %d", path, code, http.StatusNotFound)
+		}
+	}
+}
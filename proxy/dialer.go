@@ -0,0 +1,97 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DialFunc connects to the address of a backend server. The network is always
+// tcp. Like with net.Dialer, ctx only applies to the connection attempt, not
+// to the connection that is returned.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// SetDialFunc sets the function that connects to the backend servers of the
+// backends with serverName, e.g. to reach them over SSH, a VPN, or in memory
+// in tests. It is used for all the connections to the backend servers except
+// in QUIC mode. The function is kept when the proxy is reconfigured. A nil
+// function restores the default dialer.
+func (p *Proxy) SetDialFunc(serverName string, f DialFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sn := normalizeServerName(serverName)
+	if f == nil {
+		delete(p.dialFuncs, sn)
+	} else {
+		if p.dialFuncs == nil {
+			p.dialFuncs = make(map[string]DialFunc)
+		}
+		p.dialFuncs[sn] = f
+	}
+	if p.cfg == nil {
+		return
+	}
+	for _, be := range p.cfg.Backends {
+		be.setDialFunc(p.dialFuncs)
+	}
+}
+
+// setDialFunc sets the backend's dial function from the proxy's dialFuncs.
+func (be *Backend) setDialFunc(dialFuncs map[string]DialFunc) {
+	var f DialFunc
+	for _, sn := range be.ServerNames {
+		if f = dialFuncs[normalizeServerName(sn)]; f != nil {
+			break
+		}
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	be.state.dialFunc = f
+}
+
+// netDialer returns the dialer of the connections to the backend servers,
+// with the backend's DialSourceAddress and DialInterface.
+func (be *Backend) netDialer(network string, timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if be.dialSourceIP != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: be.dialSourceIP}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: be.dialSourceIP}
+		}
+	}
+	if name := be.DialInterface; name != "" {
+		d.Control = func(_, _ string, c syscall.RawConn) error {
+			return bindToDevice(c, name)
+		}
+	}
+	return d
+}
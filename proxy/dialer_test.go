@@ -0,0 +1,241 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// memListener is a net.Listener for in-memory connections.
+type memListener struct {
+	ch   chan net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newMemListener() *memListener {
+	return &memListener{
+		ch:   make(chan net.Conn),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr("memory")
+}
+
+func (l *memListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.ch <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "memory" }
+func (a memAddr) String() string  { return string(a) }
+
+func TestInMemoryTransport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"mem.example.com"},
+				Addresses:   []string{"backend.internal:80"},
+				Mode:        ModeTCP,
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+
+	var mu sync.Mutex
+	var dialed []string
+	proxy.SetDialFunc("MEM.example.com", func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, network+":"+addr)
+		mu.Unlock()
+		client, server := net.Pipe()
+		go func() {
+			fmt.Fprintf(server, "Hello from %s\n", addr)
+			server.Close()
+		}()
+		return client, nil
+	})
+	l := newMemListener()
+	if err := proxy.StartWithListener(ctx, l); err != nil {
+		t.Fatalf("proxy.StartWithListener: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func() (string, error) {
+		c, err := l.dial()
+		if err != nil {
+			return "", err
+		}
+		tc := tls.Client(c, &tls.Config{
+			ServerName: "mem.example.com",
+			RootCAs:    ca.RootCACertPool(),
+		})
+		defer tc.Close()
+		b, err := io.ReadAll(tc)
+		return string(b), err
+	}
+	if got, err := get(); err != nil || got != "Hello from backend.internal:80\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// The dial function is kept when the proxy is reconfigured.
+	cfg = proxy.cfg.clone()
+	cfg.Backends[0].Addresses = []string{"other.internal:80"}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if got, err := get(); err != nil || got != "Hello from other.internal:80\n" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := fmt.Sprint(dialed), "[tcp:backend.internal:80 tcp:other.internal:80]"; got != want {
+		t.Errorf("dialed = %s, want %s", got, want)
+	}
+}
+
+func TestDialSourceAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("127.0.0.2 is only a local address on linux")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			io.WriteString(conn, host)
+			conn.Close()
+		}
+	}()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"default.example.com"},
+				Addresses:   []string{l.Addr().String()},
+			},
+			{
+				ServerNames:       []string{"source.example.com"},
+				Addresses:         []string{l.Addr().String()},
+				DialSourceAddress: "127.0.0.2",
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"default.example.com", "127.0.0.1"},
+		{"source.example.com", "127.0.0.2"},
+	} {
+		got, _, err := tlsGet(tc.name, proxy.listener.Addr().String(), "", ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet(%q): %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("tlsGet(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	be := &Backend{DialInterface: "lo"}
+	conn, err := be.netDialer("tcp", time.Second).Dial("tcp", l.Addr().String())
+	if err != nil && strings.Contains(err.Error(), "operation not permitted") {
+		t.Skipf("DialInterface: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Dial with DialInterface: %v", err)
+	}
+	conn.Close()
+	be = &Backend{DialInterface: "nonexistent0"}
+	if _, err := be.netDialer("tcp", time.Second).Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Dial with a nonexistent interface didn't fail")
+	}
+}
@@ -0,0 +1,284 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/docker"
+)
+
+const (
+	defaultDockerLabelPrefix       = "tlsproxy"
+	defaultDockerDiscoveryInterval = 30 * time.Second
+)
+
+// discoveryState contains the backends that are discovered dynamically, the
+// backends that are added with AddBackend, and the config that they are
+// merged with.
+type discoveryState struct {
+	mu         sync.Mutex
+	cfg        *Config
+	backends   []*Backend
+	registered []*Backend
+	warnings   map[string]bool
+}
+
+// merge returns a copy of cfg with the registered and discovered backends.
+// Backends in cfg take precedence over registered backends, which take
+// precedence over discovered backends with the same server names.
+func (d *discoveryState) merge(cfg *Config) *Config {
+	var discovered []*Backend
+	if cfg.DockerDiscovery != nil {
+		discovered = d.backends
+	}
+	if len(d.registered) == 0 && len(discovered) == 0 {
+		return cfg
+	}
+	cfg = cfg.clone()
+	names := backendServerNames(cfg.Backends)
+	conflict := func(be *Backend) bool {
+		return slices.ContainsFunc(be.ServerNames, func(sn string) bool { return names[normalizeServerName(sn)] })
+	}
+	for _, be := range d.registered {
+		if conflict(be) {
+			log.Printf("WRN Backend %s is overridden by the config", be.displayName())
+			continue
+		}
+		cfg.Backends = append(cfg.Backends, be.clone())
+	}
+	names = backendServerNames(cfg.Backends)
+	for _, be := range discovered {
+		if conflict(be) {
+			continue
+		}
+		cfg.Backends = append(cfg.Backends, be)
+	}
+	return cfg
+}
+
+// backendServerNames returns the set of the normalized server names of
+// backends.
+func backendServerNames(backends []*Backend) map[string]bool {
+	names := make(map[string]bool)
+	for _, be := range backends {
+		for _, sn := range be.ServerNames {
+			names[normalizeServerName(sn)] = true
+		}
+	}
+	return names
+}
+
+func normalizeServerName(sn string) string {
+	return strings.ToLower(idnaToASCII(sn))
+}
+
+// setDiscoveredBackends replaces the discovered backends, and reconfigures
+// the proxy if they changed.
+func (p *Proxy) setDiscoveredBackends(backends []*Backend, warnings []string) error {
+	p.discovery.mu.Lock()
+	defer p.discovery.mu.Unlock()
+
+	w := make(map[string]bool, len(warnings))
+	for _, msg := range warnings {
+		if !p.discovery.warnings[msg] {
+			log.Printf("WRN Docker discovery: %s", msg)
+		}
+		w[msg] = true
+	}
+	p.discovery.warnings = w
+
+	a, _ := yaml.Marshal(p.discovery.backends)
+	b, _ := yaml.Marshal(backends)
+	if bytes.Equal(a, b) {
+		return nil
+	}
+	old := p.discovery.backends
+	p.discovery.backends = backends
+	if p.discovery.cfg == nil {
+		return nil
+	}
+	if err := p.reconfigure(p.discovery.merge(p.discovery.cfg)); err != nil {
+		p.discovery.backends = old
+		return err
+	}
+	return nil
+}
+
+// dockerDiscoveryLoop updates the discovered backends when Docker containers
+// start and stop. It runs until ctx is canceled.
+func (p *Proxy) dockerDiscoveryLoop(ctx context.Context) {
+	for ctx.Err() == nil {
+		p.mu.RLock()
+		dd := p.cfg.DockerDiscovery
+		p.mu.RUnlock()
+
+		interval := defaultDockerDiscoveryInterval
+		if dd != nil && dd.Interval > 0 {
+			interval = dd.Interval
+		}
+		var err error
+		if dd == nil {
+			err = p.setDiscoveredBackends(nil, nil)
+		} else if err = p.discoverDockerBackends(ctx, dd, interval); err == nil {
+			continue
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ERR Docker discovery: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// discoverDockerBackends updates the discovered backends, and then waits
+// until a container changes state or interval has passed.
+func (p *Proxy) discoverDockerBackends(ctx context.Context, dd *ConfigDockerDiscovery, interval time.Duration) error {
+	client, err := docker.New(dd.Endpoint)
+	if err != nil {
+		return err
+	}
+	label := dd.labelPrefix() + ".servername"
+	deadline := time.Now().Add(interval)
+	containers, err := client.Containers(ctx, label)
+	if err != nil {
+		return err
+	}
+	if err := p.setDiscoveredBackends(dockerBackends(dd, containers)); err != nil {
+		return err
+	}
+	if _, err := client.WaitForEvent(ctx, label, deadline); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dd *ConfigDockerDiscovery) labelPrefix() string {
+	if dd.LabelPrefix == "" {
+		return defaultDockerLabelPrefix
+	}
+	return dd.LabelPrefix
+}
+
+// dockerBackends returns the backends for the containers, and the reasons why
+// some containers were ignored.
+func dockerBackends(dd *ConfigDockerDiscovery, containers []docker.Container) ([]*Backend, []string) {
+	prefix := dd.labelPrefix() + "."
+	slices.SortFunc(containers, func(a, b docker.Container) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	var backends []*Backend
+	var warnings []string
+	seen := make(map[string]string)
+
+L:
+	for _, c := range containers {
+		var names []string
+		for _, sn := range strings.Split(c.Labels[prefix+"servername"], ",") {
+			if sn = strings.ToLower(strings.TrimSpace(sn)); sn != "" {
+				names = append(names, sn)
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		for _, sn := range names {
+			if other, exists := seen[sn]; exists {
+				warnings = append(warnings, fmt.Sprintf("container %s: server name %q is already used by container %s", c.Name, sn, other))
+				continue L
+			}
+		}
+
+		var port int
+		if v, ok := c.Labels[prefix+"port"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 65535 {
+				warnings = append(warnings, fmt.Sprintf("container %s: invalid port %q", c.Name, v))
+				continue
+			}
+			port = n
+		} else if len(c.Ports) == 1 {
+			port = c.Ports[0]
+		} else {
+			warnings = append(warnings, fmt.Sprintf("container %s: %sport label is required", c.Name, prefix))
+			continue
+		}
+
+		network := dd.Network
+		if v, ok := c.Labels[prefix+"network"]; ok {
+			network = v
+		}
+		var ip string
+		if network != "" {
+			ip = c.Networks[network]
+		} else if len(c.Networks) == 1 {
+			for _, v := range c.Networks {
+				ip = v
+			}
+		}
+		if ip == "" {
+			warnings = append(warnings, fmt.Sprintf("container %s: no IP address, network %q", c.Name, network))
+			continue
+		}
+
+		mode := ModeHTTP
+		if v, ok := c.Labels[prefix+"mode"]; ok {
+			mode = strings.ToUpper(v)
+		}
+		if !slices.Contains(validModes, mode) || mode == ModeConsole || mode == ModeLocal || mode == ModeRedirect || mode == ModeProxy || mode == ModeSOCKS5 || mode == ModeMySQL {
+			warnings = append(warnings, fmt.Sprintf("container %s: invalid mode %q", c.Name, mode))
+			continue
+		}
+
+		be := &Backend{}
+		if dd.Template != nil {
+			b, _ := yaml.Marshal(dd.Template)
+			yaml.Unmarshal(b, be)
+		}
+		be.ServerNames = names
+		be.Addresses = []string{net.JoinHostPort(ip, strconv.Itoa(port))}
+		be.Mode = mode
+		if v, ok := c.Labels[prefix+"backendproto"]; ok {
+			be.BackendProto = &v
+		}
+		for _, sn := range names {
+			seen[sn] = c.Name
+		}
+		backends = append(backends, be)
+	}
+	return backends, warnings
+}
@@ -0,0 +1,240 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/docker"
+)
+
+// fakeDocker is a fake Docker API server.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []map[string]any
+	changed    chan struct{}
+}
+
+func (d *fakeDocker) set(containers []map[string]any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers = containers
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *fakeDocker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.mu.Lock()
+	containers, changed := d.containers, d.changed
+	d.mu.Unlock()
+	switch req.URL.Path {
+	case "/containers/json":
+		json.NewEncoder(w).Encode(containers)
+	case "/events":
+		w.(http.Flusher).Flush()
+		select {
+		case <-changed:
+			w.Write([]byte(`{"status":"start"}`))
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	sock := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	fd := &fakeDocker{changed: make(chan struct{})}
+	go http.Serve(l, fd)
+	defer l.Close()
+
+	container := func(name, serverName string, addr net.Addr) map[string]any {
+		a := addr.(*net.TCPAddr)
+		return map[string]any{
+			"Id":    name,
+			"Names": []string{"/" + name},
+			"Labels": map[string]string{
+				"tlsproxy.servername": serverName,
+				"tlsproxy.port":       strconv.Itoa(a.Port),
+				"tlsproxy.mode":       "tcp",
+			},
+			"NetworkSettings": map[string]any{
+				"Networks": map[string]any{
+					"bridge": map[string]any{"IPAddress": a.IP.String()},
+				},
+			},
+		}
+	}
+	fd.set([]map[string]any{
+		container("foo", "foo.example.com", be.listener.Addr()),
+		container("dup", "static.example.com", be.listener.Addr()),
+	})
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"static.example.com"},
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+		},
+		DockerDiscovery: &ConfigDockerDiscovery{
+			Endpoint: "unix://" + sock,
+			Interval: time.Second,
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(name string) (string, error) {
+		var got string
+		var err error
+		for range 50 {
+			if got, _, err = tlsGet(name, proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return got, err
+	}
+
+	if got, err := get("foo.example.com"); err != nil || got != "Hello from backend\n" {
+		t.Errorf("foo.example.com: got %q, %v", got, err)
+	}
+	// The static backend takes precedence.
+	if got, err := get("static.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("static.example.com: got %q, %v", got, err)
+	}
+
+	fd.set([]map[string]any{
+		container("bar", "bar.example.com", be2.listener.Addr()),
+	})
+	if got, err := get("bar.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("bar.example.com: got %q, %v", got, err)
+	}
+	if _, _, err := tlsGet("foo.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err == nil {
+		t.Error("foo.example.com should be removed")
+	}
+
+	// Reloading the config keeps the discovered backends.
+	cfg.Backends[0].ServerNames = []string{"other.example.com"}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if got, err := get("bar.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("bar.example.com: got %q, %v", got, err)
+	}
+}
+
+func TestDockerBackends(t *testing.T) {
+	dd := &ConfigDockerDiscovery{
+		Network: "front",
+		Template: &Backend{
+			ALPNProtos: &[]string{"h2"},
+		},
+	}
+	containers := []docker.Container{
+		{
+			Name:     "a",
+			Labels:   map[string]string{"tlsproxy.servername": "A.example.com, a2.example.com"},
+			Networks: map[string]string{"front": "10.0.0.1", "back": "10.1.0.1"},
+			Ports:    []int{8080},
+		},
+		{
+			Name:     "b",
+			Labels:   map[string]string{"tlsproxy.servername": "b.example.com"},
+			Networks: map[string]string{"front": "10.0.0.2"},
+			Ports:    []int{80, 443},
+		},
+		{
+			Name:     "c",
+			Labels:   map[string]string{"tlsproxy.servername": "a.example.com", "tlsproxy.port": "80"},
+			Networks: map[string]string{"front": "10.0.0.3"},
+		},
+		{
+			Name:     "d",
+			Labels:   map[string]string{"tlsproxy.servername": "d.example.com", "tlsproxy.port": "443", "tlsproxy.mode": "https", "tlsproxy.backendproto": "h2", "tlsproxy.network": "back"},
+			Networks: map[string]string{"front": "10.0.0.4", "back": "10.1.0.4"},
+		},
+	}
+	backends, warnings := dockerBackends(dd, containers)
+	if got, want := len(warnings), 2; got != want {
+		t.Errorf("warnings = %q, want %d", warnings, want)
+	}
+	if got, want := len(backends), 2; got != want {
+		t.Fatalf("len(backends) = %d, want %d", got, want)
+	}
+	if got, want := backends[0].ServerNames, []string{"a.example.com", "a2.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("ServerNames = %q, want %q", got, want)
+	}
+	if got, want := backends[0].Addresses, []string{"10.0.0.1:8080"}; !slices.Equal(got, want) {
+		t.Errorf("Addresses = %q, want %q", got, want)
+	}
+	if got, want := backends[0].Mode, ModeHTTP; got != want {
+		t.Errorf("Mode = %q, want %q", got, want)
+	}
+	if backends[0].ALPNProtos == nil || !slices.Equal(*backends[0].ALPNProtos, []string{"h2"}) {
+		t.Errorf("ALPNProtos = %v, want [h2]", backends[0].ALPNProtos)
+	}
+	if got, want := backends[1].Addresses, []string{"10.1.0.4:443"}; !slices.Equal(got, want) {
+		t.Errorf("Addresses = %q, want %q", got, want)
+	}
+	if got, want := backends[1].Mode, ModeHTTPS; got != want {
+		t.Errorf("Mode = %q, want %q", got, want)
+	}
+	if backends[1].BackendProto == nil || *backends[1].BackendProto != "h2" {
+		t.Errorf("BackendProto = %v, want h2", backends[1].BackendProto)
+	}
+}
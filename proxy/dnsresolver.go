@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/resolver"
+)
+
+// addrResolverKey identifies an addressResolver. The backends that have the
+// same AddressDiscovery and DNS resolver share the same addressResolver.
+type addrResolverKey struct {
+	cfg AddressDiscovery
+	dns *resolver.Resolver
+}
+
+// key returns a string that identifies the resolver's configuration. The
+// resolvers, and their caches, are reused when the configuration changes
+// if their parameters are the same.
+func (r *DNSResolver) key() string {
+	return fmt.Sprintf("%q %q %s %s %s %s %d", r.Servers, r.RootCAs, r.Timeout, r.MinTTL, r.MaxTTL, r.NegativeTTL, r.CacheSize)
+}
+
+// newDNSResolvers returns the DNS resolvers of the backends, reusing the
+// existing ones when possible, and sets the backends' dnsResolver.
+func (p *Proxy) newDNSResolvers(cfg *Config) (map[string]*resolver.Resolver, error) {
+	resolvers := make(map[string]*resolver.Resolver)
+	for i, be := range cfg.Backends {
+		be.dnsResolver = nil
+		if be.Resolver == nil {
+			continue
+		}
+		key := be.Resolver.key()
+		if r, ok := resolvers[key]; ok {
+			be.dnsResolver = r
+			continue
+		}
+		if r, ok := p.dnsResolvers[key]; ok {
+			resolvers[key] = r
+			be.dnsResolver = r
+			continue
+		}
+		opts := resolver.Options{
+			Servers:     be.Resolver.Servers,
+			Timeout:     be.Resolver.Timeout,
+			MinTTL:      be.Resolver.MinTTL,
+			MaxTTL:      be.Resolver.MaxTTL,
+			NegativeTTL: be.Resolver.NegativeTTL,
+			CacheSize:   be.Resolver.CacheSize,
+		}
+		if be.Resolver.rootCAs != nil {
+			opts.TLSConfig = &tls.Config{RootCAs: be.Resolver.rootCAs}
+		}
+		r, err := resolver.New(opts)
+		if err != nil {
+			for k, r := range resolvers {
+				if p.dnsResolvers[k] != r {
+					r.Close()
+				}
+			}
+			return nil, fmt.Errorf("backend[%d].Resolver: %w", i, err)
+		}
+		resolvers[key] = r
+		be.dnsResolver = r
+	}
+	return resolvers, nil
+}
+
+// lookupNetIP resolves host with the backend's DNS resolver, or with the
+// system resolver.
+func (be *Backend) lookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if be.dnsResolver != nil {
+		return be.dnsResolver.LookupNetIP(ctx, network, host)
+	}
+	return lookupNetIP(ctx, network, host)
+}
+
+// resolveUDPAddr is like net.ResolveUDPAddr, but it uses the backend's DNS
+// resolver.
+func (be *Backend) resolveUDPAddr(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	if be.dnsResolver == nil {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	network := "ip"
+	switch be.DialAddressFamily {
+	case DialIPv4Only:
+		network = "ip4"
+	case DialIPv6Only:
+		network = "ip6"
+	}
+	ips, err := be.dnsResolver.LookupNetIP(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0]
+	if be.DialAddressFamily == DialIPv4First {
+		for _, v := range ips {
+			if v.Unmap().Is4() {
+				ip = v
+				break
+			}
+		}
+	}
+	p, err := net.LookupPort("udp", port)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
@@ -0,0 +1,178 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// newTestDNSServer starts a DNS server that resolves all the A queries to
+// 127.0.0.1, and returns its address and the number of queries it received.
+func newTestDNSServer(t *testing.T) (string, *atomic.Int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var count atomic.Int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			count.Add(1)
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+			}
+			resp, _ := b.Finish()
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), &count
+}
+
+func TestBackendResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dnsAddr, queries := newTestDNSServer(t)
+	be := newTCPServer(t, ctx, "backend", nil)
+	_, port, _ := net.SplitHostPort(be.listener.Addr().String())
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{net.JoinHostPort("backend.internal.", port)},
+				Mode:        ModeTCP,
+				Resolver: &DNSResolver{
+					Servers: []string{dnsAddr},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for i := 0; i < 3; i++ {
+		got, _, err := tlsGet("www.example.com", proxy.listener.Addr().String(), "", ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+		if want := "Hello from backend\n"; got != want {
+			t.Errorf("tlsGet() = %q, want %q", got, want)
+		}
+	}
+	// One A query and one AAAA query. The answers are cached.
+	if got, want := queries.Load(), int32(2); got != want {
+		t.Errorf("DNS queries = %d, want %d", got, want)
+	}
+
+	// The resolver and its cache are kept when the config changes.
+	r := proxy.cfg.Backends[0].dnsResolver
+	cfg = cfg.clone()
+	cfg.Backends[0].ServerNames = append(cfg.Backends[0].ServerNames, "other.example.com")
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if proxy.cfg.Backends[0].dnsResolver != r {
+		t.Error("DNS resolver was not reused")
+	}
+	if _, _, err := tlsGet("other.example.com", proxy.listener.Addr().String(), "", ca, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if got, want := queries.Load(), int32(2); got != want {
+		t.Errorf("DNS queries = %d, want %d", got, want)
+	}
+
+	addrs, err := proxy.cfg.Backends[0].lookupNetIP(ctx, "ip4", "foo.internal")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("lookupNetIP() = %v, %v", addrs, err)
+	}
+	ua, err := proxy.cfg.Backends[0].resolveUDPAddr(ctx, net.JoinHostPort("foo.internal", "443"))
+	if err != nil || ua.String() != "127.0.0.1:443" {
+		t.Errorf("resolveUDPAddr() = %v, %v", ua, err)
+	}
+}
+
+func TestDNSResolverCheck(t *testing.T) {
+	for _, tc := range []struct {
+		res *DNSResolver
+		ok  bool
+	}{
+		{&DNSResolver{Servers: []string{"192.168.0.53", "tls://dns.example.com", "https://dns.example.com/dns-query"}}, true},
+		{&DNSResolver{Servers: []string{"ftp://dns.example.com"}}, false},
+		{&DNSResolver{Servers: []string{"192.168.0.53"}, MinTTL: 10, MaxTTL: 5}, false},
+		{&DNSResolver{Servers: []string{"192.168.0.53"}, NegativeTTL: -1}, false},
+		{&DNSResolver{Servers: []string{"192.168.0.53"}, RootCAs: []string{"/does/not/exist"}}, false},
+	} {
+		cfg := &Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{"backend.example.com:443"},
+				Resolver:    tc.res,
+			}},
+		}
+		if err := cfg.Check(); (err == nil) != tc.ok {
+			t.Errorf("Check(%+v) = %v", tc.res, err)
+		}
+	}
+}
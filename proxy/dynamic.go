@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// AddBackend adds a backend to the proxy at runtime, e.g. for services that
+// register themselves. The backend is validated like the backends of the
+// config, and it is kept when the proxy is reconfigured. Its ServerNames
+// can't be used by the config or by another backend that was added with
+// AddBackend. The proxy uses a copy of be; later changes to be have no effect.
+func (p *Proxy) AddBackend(be *Backend) error {
+	p.discovery.mu.Lock()
+	defer p.discovery.mu.Unlock()
+	if p.discovery.cfg == nil {
+		return errors.New("proxy is not configured")
+	}
+	if len(be.ServerNames) == 0 {
+		return errors.New("ServerNames must be set")
+	}
+	names := backendServerNames(p.discovery.cfg.Backends)
+	for sn := range backendServerNames(p.discovery.registered) {
+		names[sn] = true
+	}
+	for _, sn := range be.ServerNames {
+		if names[normalizeServerName(sn)] {
+			return fmt.Errorf("server name %q is already used", sn)
+		}
+	}
+	old := p.discovery.registered
+	p.discovery.registered = append(slices.Clone(old), be.clone())
+	if err := p.reconfigure(p.discovery.merge(p.discovery.cfg)); err != nil {
+		p.discovery.registered = old
+		return err
+	}
+	return nil
+}
+
+// RemoveBackend removes the backend that was added with AddBackend for
+// serverName. Its connections are drained like after a config change.
+func (p *Proxy) RemoveBackend(serverName string) error {
+	p.discovery.mu.Lock()
+	defer p.discovery.mu.Unlock()
+	sn := normalizeServerName(serverName)
+	i := slices.IndexFunc(p.discovery.registered, func(be *Backend) bool {
+		return backendServerNames([]*Backend{be})[sn]
+	})
+	if i < 0 {
+		return fmt.Errorf("backend %q: %w", serverName, errNotFound)
+	}
+	old := p.discovery.registered
+	p.discovery.registered = slices.Delete(slices.Clone(old), i, i+1)
+	if p.discovery.cfg == nil {
+		return nil
+	}
+	if err := p.reconfigure(p.discovery.merge(p.discovery.cfg)); err != nil {
+		p.discovery.registered = old
+		return err
+	}
+	return nil
+}
+
+// ListBackends returns a copy of the backends that the proxy is currently
+// using, i.e. the backends of the config, the ones that were added with
+// AddBackend, and the ones that were discovered.
+func (p *Proxy) ListBackends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cfg == nil {
+		return nil
+	}
+	out := make([]*Backend, 0, len(p.cfg.Backends))
+	for _, be := range p.cfg.Backends {
+		out = append(out, be.clone())
+	}
+	return out
+}
@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestAddRemoveBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"static.example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(name string) (string, error) {
+		got, _, err := tlsGet(name, proxy.listener.Addr().String(), "", ca, nil, nil)
+		return got, err
+	}
+
+	dyn := &Backend{
+		ServerNames: []string{"dynamic.example.com"},
+		Addresses:   []string{be2.listener.Addr().String()},
+	}
+	if err := proxy.AddBackend(dyn); err != nil {
+		t.Fatalf("AddBackend: %v", err)
+	}
+	// Changes to the caller's backend have no effect.
+	dyn.Addresses = []string{"192.0.2.1:1"}
+	if got, err := get("dynamic.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("dynamic.example.com: got %q, %v", got, err)
+	}
+
+	for _, sn := range []string{"static.example.com", "DYNAMIC.example.com"} {
+		if err := proxy.AddBackend(&Backend{ServerNames: []string{sn}, Addresses: []string{"192.0.2.1:1"}}); err == nil {
+			t.Errorf("AddBackend(%s) should fail", sn)
+		}
+	}
+	if err := proxy.AddBackend(&Backend{ServerNames: []string{"bad.example.com"}, Mode: "FOO"}); err == nil {
+		t.Error("AddBackend with invalid backend should fail")
+	}
+
+	var names []string
+	for _, be := range proxy.ListBackends() {
+		names = append(names, be.ServerNames...)
+	}
+	if len(names) != 2 || names[0] != "static.example.com" || names[1] != "dynamic.example.com" {
+		t.Errorf("ListBackends() = %v", names)
+	}
+
+	// The dynamic backend survives config changes.
+	cfg = proxy.cfg.clone()
+	cfg.Backends = cfg.Backends[:1]
+	cfg.Backends[0].Addresses = []string{be2.listener.Addr().String()}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	if got, err := get("static.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("static.example.com: got %q, %v", got, err)
+	}
+	if got, err := get("dynamic.example.com"); err != nil || got != "Hello from backend2\n" {
+		t.Errorf("dynamic.example.com: got %q, %v", got, err)
+	}
+
+	if err := proxy.RemoveBackend("dynamic.example.com"); err != nil {
+		t.Fatalf("RemoveBackend: %v", err)
+	}
+	if _, err := get("dynamic.example.com"); err == nil {
+		t.Error("dynamic.example.com should be gone")
+	}
+	if err := proxy.RemoveBackend("dynamic.example.com"); !errors.Is(err, errNotFound) {
+		t.Errorf("RemoveBackend: %v, want %v", err, errNotFound)
+	}
+	if err := proxy.RemoveBackend("static.example.com"); !errors.Is(err, errNotFound) {
+		t.Errorf("RemoveBackend: %v, want %v", err, errNotFound)
+	}
+}
@@ -0,0 +1,252 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultEventHistorySize = 1000
+
+// EventSeverity is the severity of an event.
+type EventSeverity string
+
+const (
+	// SeverityDebug is the severity of the events that happen for every
+	// connection, e.g. "tcp connection". They are counted, but not kept
+	// in the event history.
+	SeverityDebug   EventSeverity = "debug"
+	SeverityInfo    EventSeverity = "info"
+	SeverityWarning EventSeverity = "warning"
+	SeverityError   EventSeverity = "error"
+)
+
+func (s EventSeverity) rank() int {
+	switch s {
+	case SeverityDebug:
+		return 0
+	case SeverityInfo:
+		return 1
+	case SeverityWarning:
+		return 2
+	case SeverityError:
+		return 3
+	default:
+		return -1
+	}
+}
+
+var (
+	debugEvents = map[string]bool{
+		"tcp connection":              true,
+		"quic connection":             true,
+		"quic passthrough connection": true,
+	}
+	errorEventTerms = []string{
+		"panic",
+		"error",
+		"conn chan nil",
+	}
+	warningEventTerms = []string{
+		"denied", "deny ", "reject", "failed", "soft-fail", "revoked",
+		"banned", "rate limit", "tarpit", "too many", "exceeded",
+		"mismatched", "invalid", "wrong mode", "no SNI", "timeout",
+		"max lifetime", "without TLS", "no acceptable", "CheckIP",
+		"CheckFingerprint", "threat feed", "quota", "too large",
+	}
+)
+
+// eventSeverity returns the severity of an event, based on its
+// description.
+func eventSeverity(msg string) EventSeverity {
+	if debugEvents[msg] {
+		return SeverityDebug
+	}
+	for _, t := range errorEventTerms {
+		if strings.Contains(msg, t) {
+			return SeverityError
+		}
+	}
+	for _, t := range warningEventTerms {
+		if strings.Contains(msg, t) {
+			return SeverityWarning
+		}
+	}
+	return SeverityInfo
+}
+
+// eventLog is a ring buffer of the most recent events.
+type eventLog struct {
+	buf  []Event
+	next int
+	full bool
+}
+
+// resize changes the number of events that the log keeps. The most recent
+// events are kept.
+func (l *eventLog) resize(n int) {
+	if n <= 0 {
+		n = defaultEventHistorySize
+	}
+	if n == len(l.buf) {
+		return
+	}
+	events := l.events()
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	l.buf = make([]Event, n)
+	l.next = copy(l.buf, events) % n
+	l.full = len(events) == n
+}
+
+func (l *eventLog) add(e Event) {
+	if l.buf == nil {
+		l.buf = make([]Event, defaultEventHistorySize)
+	}
+	l.buf[l.next] = e
+	l.next = (l.next + 1) % len(l.buf)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// events returns the events in the log, oldest first.
+func (l *eventLog) events() []Event {
+	if !l.full {
+		return append([]Event(nil), l.buf[:l.next]...)
+	}
+	out := make([]Event, 0, len(l.buf))
+	out = append(out, l.buf[l.next:]...)
+	return append(out, l.buf[:l.next]...)
+}
+
+// EventFilter selects the events returned by EventHistory. The zero value
+// selects all the events.
+type EventFilter struct {
+	// MinSeverity is the minimum severity of the events.
+	MinSeverity EventSeverity
+	// Contains is a string that the description or the connection of
+	// the events must contain.
+	Contains string
+	// ConnID is the ID of the connection that caused the events.
+	ConnID uint64
+	// Since is the time after which the events happened.
+	Since time.Time
+	// Limit is the maximum number of events to return. The most recent
+	// ones are returned.
+	Limit int
+}
+
+// EventHistory returns the most recent events that match the filter,
+// most recent first. The number of events that are kept is set with
+// Config.EventHistorySize.
+func (p *Proxy) EventHistory(f EventFilter) []Event {
+	p.eventsmu.Lock()
+	events := p.eventHistory.events()
+	p.eventsmu.Unlock()
+
+	out := make([]Event, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if f.Limit > 0 && len(out) >= f.Limit {
+			break
+		}
+		if !f.Since.IsZero() && !e.Time.After(f.Since) {
+			break
+		}
+		if e.Severity.rank() < f.MinSeverity.rank() {
+			continue
+		}
+		if f.ConnID != 0 && e.ConnID != f.ConnID {
+			continue
+		}
+		if f.Contains != "" && !strings.Contains(e.Description, f.Contains) && !strings.Contains(e.Conn, f.Contains) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+type adminEvent struct {
+	Time        time.Time     `json:"time"`
+	Severity    EventSeverity `json:"severity"`
+	Description string        `json:"description"`
+	ConnID      uint64        `json:"connId,omitempty"`
+	Conn        string        `json:"conn,omitempty"`
+}
+
+// adminEvents returns the event history. The severity, q, connId, since,
+// and limit parameters filter the events. since is a time in RFC 3339
+// format, or a duration, e.g. 1h for the last hour.
+func (p *Proxy) adminEvents(req *http.Request) (any, error) {
+	var f EventFilter
+	if v := req.Form.Get("severity"); v != "" {
+		f.MinSeverity = EventSeverity(v)
+		if f.MinSeverity.rank() < 0 {
+			return nil, errors.New("invalid severity")
+		}
+	}
+	f.Contains = req.Form.Get("q")
+	if v := req.Form.Get("connId"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid connId")
+		}
+		f.ConnID = id
+	}
+	if v := req.Form.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			f.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			f.Since = t
+		} else {
+			return nil, errors.New("invalid since")
+		}
+	}
+	if v := req.Form.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, errors.New("invalid limit")
+		}
+		f.Limit = n
+	}
+	events := p.EventHistory(f)
+	out := make([]adminEvent, 0, len(events))
+	for _, e := range events {
+		out = append(out, adminEvent{
+			Time:        e.Time,
+			Severity:    e.Severity,
+			Description: e.Description,
+			ConnID:      e.ConnID,
+			Conn:        e.Conn,
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,188 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestEventLog(t *testing.T) {
+	descs := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, e.Description)
+		}
+		return out
+	}
+	var l eventLog
+	l.resize(3)
+	for _, d := range []string{"a", "b"} {
+		l.add(Event{Description: d})
+	}
+	if got, want := descs(l.events()), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("events() = %q, want %q", got, want)
+	}
+	for _, d := range []string{"c", "d", "e"} {
+		l.add(Event{Description: d})
+	}
+	if got, want := descs(l.events()), []string{"c", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("events() = %q, want %q", got, want)
+	}
+	l.resize(5)
+	l.add(Event{Description: "f"})
+	if got, want := descs(l.events()), []string{"c", "d", "e", "f"}; !slices.Equal(got, want) {
+		t.Errorf("events() = %q, want %q", got, want)
+	}
+	l.resize(2)
+	if got, want := descs(l.events()), []string{"e", "f"}; !slices.Equal(got, want) {
+		t.Errorf("events() = %q, want %q", got, want)
+	}
+	l.add(Event{Description: "g"})
+	if got, want := descs(l.events()), []string{"f", "g"}; !slices.Equal(got, want) {
+		t.Errorf("events() = %q, want %q", got, want)
+	}
+}
+
+func TestEventSeverity(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want EventSeverity
+	}{
+		{"tcp connection", SeverityDebug},
+		{"config change", SeverityInfo},
+		{"allow X509 [SUBJECT:CN=bob] to example.com", SeverityInfo},
+		{"deny no cert to example.com", SeverityWarning},
+		{"tls handshake failed", SeverityWarning},
+		{"ip rate limit", SeverityWarning},
+		{"dial error", SeverityError},
+		{"panic", SeverityError},
+	} {
+		if got := eventSeverity(tc.msg); got != tc.want {
+			t.Errorf("eventSeverity(%q) = %q, want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr:         "localhost:0",
+		TLSAddr:          "localhost:0",
+		CacheDir:         t.TempDir(),
+		MaxOpen:          100,
+		EventHistorySize: 10,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+				ClientAuth:  &ClientAuth{},
+			},
+		},
+	}, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	start := time.Now()
+	proxy.recordEvent("backend drained")
+	// The client doesn't have a certificate.
+	if conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    extCA.RootCACertPool(),
+	}); err == nil {
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	var denied []Event
+	for deadline := time.Now().Add(5 * time.Second); len(denied) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		denied = proxy.EventHistory(EventFilter{MinSeverity: SeverityWarning, Contains: "deny"})
+	}
+	if len(denied) != 1 {
+		t.Fatalf("EventHistory(deny) = %#v, want 1 event", denied)
+	}
+	if e := denied[0]; e.Description != "deny no cert to example.com" || e.Severity != SeverityWarning || e.ConnID == 0 || !strings.Contains(e.Conn, "example.com") || e.Time.Before(start) {
+		t.Errorf("EventHistory(deny) = %#v", e)
+	}
+	all := proxy.EventHistory(EventFilter{})
+	if len(all) < 2 || all[len(all)-1].Description != "backend drained" {
+		t.Errorf("EventHistory() = %#v", all)
+	}
+	for _, e := range all {
+		if e.Severity == SeverityDebug {
+			t.Errorf("EventHistory() contains debug event %#v", e)
+		}
+	}
+	if got := proxy.EventHistory(EventFilter{ConnID: denied[0].ConnID}); len(got) == 0 {
+		t.Errorf("EventHistory(ConnID) = %#v", got)
+	}
+	if got := proxy.EventHistory(EventFilter{Limit: 1}); len(got) != 1 {
+		t.Errorf("EventHistory(Limit) = %#v", got)
+	}
+	if got := proxy.EventHistory(EventFilter{Since: time.Now()}); len(got) != 0 {
+		t.Errorf("EventHistory(Since) = %#v", got)
+	}
+
+	for i := 0; i < 20; i++ {
+		proxy.recordEvent("config change")
+	}
+	if got := proxy.EventHistory(EventFilter{}); len(got) != 10 {
+		t.Errorf("EventHistory() returned %d events, want 10", len(got))
+	}
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"?severity=info&q=config&limit=2", http.StatusOK, `"description": "config change"`},
+		{"?since=1h", http.StatusOK, `"severity": "info"`},
+		{"?severity=bad", http.StatusBadRequest, "invalid severity"},
+		{"?since=yesterday", http.StatusBadRequest, "invalid since"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/events"+tc.query, nil)
+		w := httptest.NewRecorder()
+		adminGet(proxy.adminEvents).ServeHTTP(w, req)
+		if w.Code != tc.code || !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("GET /api/events%s = %d %s", tc.query, w.Code, w.Body)
+		}
+	}
+}
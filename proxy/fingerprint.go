@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	ja4Pattern = regexp.MustCompile(`^[tqd][0-9a-z]{2}[di][0-9]{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`)
+)
+
+// isGREASE returns true if v is a GREASE value.
+// https://datatracker.ietf.org/doc/html/rfc8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(in []uint16) []uint16 {
+	out := make([]uint16, 0, len(in))
+	for _, v := range in {
+		if !isGREASE(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ja3 returns the JA3 fingerprint of the ClientHello.
+// https://github.com/salesforce/ja3
+func (h clientHello) ja3() string {
+	join := func(values []uint16) string {
+		s := make([]string, 0, len(values))
+		for _, v := range values {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+		return strings.Join(s, "-")
+	}
+	pf := make([]uint16, 0, len(h.PointFormats))
+	for _, v := range h.PointFormats {
+		pf = append(pf, uint16(v))
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		join(withoutGREASE(h.CipherSuites)),
+		join(withoutGREASE(h.Extensions)),
+		join(withoutGREASE(h.SupportedGroups)),
+		join(pf),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4 returns the JA4 fingerprint of the ClientHello. The transport is 't'
+// for TCP, or 'q' for QUIC.
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+func (h clientHello) ja4(transport byte) string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	version := h.Version
+	if v := withoutGREASE(h.SupportedVersions); len(v) > 0 {
+		version = slices.Max(v)
+	}
+	var ver string
+	switch version {
+	case 0x0304:
+		ver = "13"
+	case 0x0303:
+		ver = "12"
+	case 0x0302:
+		ver = "11"
+	case 0x0301:
+		ver = "10"
+	case 0x0300:
+		ver = "s3"
+	default:
+		ver = "00"
+	}
+	sni := "i"
+	if slices.Contains(extensions, 0) {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPNProtos) > 0 && h.ALPNProtos[0] != "" {
+		p := h.ALPNProtos[0]
+		first, last := p[0], p[len(p)-1]
+		if isAlnum(first) && isAlnum(last) {
+			alpn = string([]byte{first, last})
+		} else {
+			x := hex.EncodeToString([]byte{first, last})
+			alpn = x[:1] + x[3:]
+		}
+	}
+	a := fmt.Sprintf("%c%s%s%02d%02d%s", transport, ver, sni, min(len(ciphers), 99), min(len(extensions), 99), alpn)
+
+	hexList := func(values []uint16) string {
+		s := make([]string, 0, len(values))
+		for _, v := range values {
+			s = append(s, fmt.Sprintf("%04x", v))
+		}
+		return strings.Join(s, ",")
+	}
+	hash12 := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+
+	b := "000000000000"
+	if len(ciphers) > 0 {
+		sorted := slices.Clone(ciphers)
+		slices.Sort(sorted)
+		b = hash12(hexList(sorted))
+	}
+
+	c := "000000000000"
+	var exts []uint16
+	for _, e := range extensions {
+		if e != 0 && e != 16 { // SNI and ALPN
+			exts = append(exts, e)
+		}
+	}
+	if len(exts) > 0 {
+		slices.Sort(exts)
+		s := hexList(exts)
+		if sigs := withoutGREASE(h.SignatureAlgorithms); len(sigs) > 0 {
+			s += "_" + hexList(sigs)
+		}
+		c = hash12(s)
+	}
+	return a + "_" + b + "_" + c
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// checkFingerprint checks the client's JA3 and JA4 fingerprints against the
+// backend's allow and deny lists.
+func (be *Backend) checkFingerprint(ja3, ja4 string) error {
+	if slices.Contains(be.DenyFingerprints, ja3) || slices.Contains(be.DenyFingerprints, ja4) {
+		return errAccessDenied
+	}
+	if len(be.AllowFingerprints) > 0 && !slices.Contains(be.AllowFingerprints, ja3) && !slices.Contains(be.AllowFingerprints, ja4) {
+		return errAccessDenied
+	}
+	return nil
+}
+
+func validateFingerprint(fp string) bool {
+	return ja3Pattern.MatchString(fp) || ja4Pattern.MatchString(fp)
+}
@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestJA4(t *testing.T) {
+	// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md
+	hello := clientHello{
+		Version:      0x0303,
+		ServerName:   "www.example.com",
+		ALPNProtos:   []string{"h2", "http/1.1"},
+		CipherSuites: []uint16{0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+		Extensions: []uint16{
+			0x0a0a, // GREASE
+			0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x0015, 0x4469,
+		},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+		SupportedVersions:   []uint16{0x2a2a, 0x0304, 0x0303},
+	}
+	if got, want := hello.ja4('t'), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != want {
+		t.Errorf("ja4() = %q, want %q", got, want)
+	}
+	if got, want := hello.ja4('q')[:1], "q"; got != want {
+		t.Errorf("ja4('q') transport = %q, want %q", got, want)
+	}
+	if got := hello.ja3(); !validateFingerprint(got) {
+		t.Errorf("ja3() = %q, not a valid fingerprint", got)
+	}
+}
+
+func TestFingerprintACL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:       []string{"allow.example.com"},
+				Addresses:         []string{be.listener.Addr().String()},
+				AllowFingerprints: []string{"t13d1516h2_8daaf6152771_e5627efa2ab1"},
+			},
+			{
+				ServerNames: []string{"deny.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	var ja4 string
+	proxy.SetRouteFunc(func(hello *ClientHelloInfo) (*Backend, error) {
+		ja4 = hello.JA4
+		return nil, nil
+	})
+
+	if _, _, err := tlsGet("allow.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err == nil {
+		t.Error("tlsGet(allow.example.com) should fail")
+	}
+	got, _, err := tlsGet("deny.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet(deny.example.com): %v", err)
+	}
+	if want := "Hello from backend\n"; got != want {
+		t.Errorf("tlsGet(deny.example.com) = %q, want %q", got, want)
+	}
+	if !validateFingerprint(ja4) {
+		t.Fatalf("JA4 = %q, not a valid fingerprint", ja4)
+	}
+
+	cfg = cfg.clone()
+	cfg.Backends[0].AllowFingerprints = []string{ja4}
+	cfg.Backends[1].DenyFingerprints = []string{ja4}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if _, _, err := tlsGet("allow.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Errorf("tlsGet(allow.example.com): %v", err)
+	}
+	if _, _, err := tlsGet("deny.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err == nil {
+		t.Error("tlsGet(deny.example.com) should fail")
+	}
+}
@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/flowexport"
+)
+
+// setFlowExport starts the flow exporter specified in cfg, and stops the
+// previous one. The exporter is kept when its config didn't change. p.mu must
+// be locked.
+func (p *Proxy) setFlowExport(cfg *ConfigFlowExport) error {
+	old := p.flowExporter.Load()
+	if old != nil && cfg != nil && p.flowExportCfg != nil && *cfg == *p.flowExportCfg {
+		return nil
+	}
+	var e *flowexport.Exporter
+	if cfg != nil {
+		var err error
+		if e, err = flowexport.New(flowexport.Options{
+			Network:             cfg.Network,
+			Address:             cfg.Collector,
+			Format:              cfg.Format,
+			ObservationDomainID: cfg.ObservationDomainID,
+			EnterpriseNumber:    cfg.EnterpriseNumber,
+			QueueSize:           cfg.QueueSize,
+		}); err != nil {
+			return err
+		}
+	}
+	p.flowExporter.Store(e)
+	p.flowExportCfg = cfg
+	if old != nil {
+		go old.Close()
+	}
+	return nil
+}
+
+// exportFlow sends the flow record of an incoming connection that ended.
+func (p *Proxy) exportFlow(conn anyConn) {
+	e := p.flowExporter.Load()
+	if e == nil {
+		return
+	}
+	ac := annotatedConn(conn)
+	r := &flowexport.Record{
+		Start:         ac.Annotation(startTimeKey, time.Time{}).(time.Time),
+		End:           time.Now(),
+		Protocol:      "tcp",
+		Src:           addrPort(conn.RemoteAddr()),
+		Dst:           addrPort(conn.LocalAddr()),
+		ServerName:    idnaToUnicode(connServerName(conn)),
+		Mode:          connMode(conn),
+		Subject:       certSummary(connClientCert(conn)),
+		BytesReceived: ac.BytesReceived(),
+		BytesSent:     ac.BytesSent(),
+	}
+	if _, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		r.Protocol = "udp"
+	}
+	if intConn := connIntConn(conn); intConn != nil {
+		r.BackendAddr = intConn.RemoteAddr().String()
+	}
+	e.Export(r)
+}
+
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort()
+	case *net.UDPAddr:
+		return a.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
@@ -0,0 +1,103 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestFlowExport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer collector.Close()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		FlowExport: &ConfigFlowExport{
+			Collector: collector.LocalAddr().String(),
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+			},
+		},
+	}, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	if _, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	var rec struct {
+		Protocol      string `json:"protocol"`
+		Src           string `json:"src"`
+		Dst           string `json:"dst"`
+		BackendAddr   string `json:"backendAddr"`
+		ServerName    string `json:"serverName"`
+		Mode          string `json:"mode"`
+		BytesReceived int64  `json:"bytesReceived"`
+		BytesSent     int64  `json:"bytesSent"`
+	}
+	if err := json.Unmarshal(buf[:n], &rec); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf[:n], err)
+	}
+	if rec.Protocol != "tcp" || rec.ServerName != "example.com" || rec.Mode != "TCP" || rec.Dst != proxy.listener.Addr().String() || rec.BackendAddr != be.listener.Addr().String() {
+		t.Errorf("Got %+v", rec)
+	}
+	if host, _, _ := net.SplitHostPort(rec.Src); host != "127.0.0.1" {
+		t.Errorf("Src = %q", rec.Src)
+	}
+	if rec.BytesReceived == 0 || rec.BytesSent == 0 {
+		t.Errorf("Got %+v", rec)
+	}
+}
@@ -0,0 +1,373 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const (
+	// connectUDPProtocol is the :protocol pseudo-header of CONNECT-UDP
+	// requests (RFC 9298).
+	connectUDPProtocol   = "connect-udp"
+	connectUDPPathPrefix = "/.well-known/masque/udp/"
+)
+
+// forwardProxyHandler returns a handler that implements an HTTPS forward
+// proxy. Authenticated clients open tunnels to the destinations allowed by
+// the ForwardProxy rules with CONNECT requests. The tunnels are bridged to
+// new TCP connections to the destinations. Over HTTP/3, CONNECT-UDP requests
+// open UDP flows to the destinations.
+func (be *Backend) forwardProxyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(req, r)
+			}
+		}()
+		if req.Method != http.MethodConnect {
+			log.Printf("REQ %s ➔ %s %s ➔ status:%d (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusMethodNotAllowed, userAgent(req))
+			w.Header().Set("Allow", http.MethodConnect)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		target, network := req.Host, "tcp"
+		if req.Proto == connectUDPProtocol {
+			var err error
+			if target, err = connectUDPTarget(req.URL.Path); err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			network = "udp"
+		}
+		userID, matchTerm, ok := be.forwardProxyClient(req)
+		if !ok {
+			// The first request from a client usually doesn't have
+			// credentials. Only the wrong ones count as failures.
+			if c, ok := req.Context().Value(connCtxKey).(anyConn); ok && req.Header.Get("Proxy-Authorization") != "" && be.reportFailure != nil {
+				be.reportFailure(c.RemoteAddr())
+			}
+			log.Printf("REQ %s ➔ CONNECT %s ➔ status:%d (%q)", formatReqDesc(req), target, http.StatusProxyAuthRequired, userAgent(req))
+			w.Header().Set("Proxy-Authenticate", `Basic realm="tlsproxy"`)
+			http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+			return
+		}
+		if rw, ok := w.(*responseRecorder); ok {
+			rw.user = userID
+		}
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		host = normalizeDestinationHost(host)
+		if !be.ForwardProxy.allows(matchTerm, network, host, port) {
+			be.recordEvent(fmt.Sprintf("deny PROXY %s to %s", userID, idnaToUnicode(host)))
+			log.Printf("REQ %s ➔ CONNECT %s ➔ status:%d (%q)", formatReqDesc(req), target, http.StatusForbidden, userAgent(req))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		be.recordEvent(fmt.Sprintf("allow PROXY %s to %s", userID, idnaToUnicode(host)))
+		if network == "udp" {
+			be.serveConnectUDP(w, req, net.JoinHostPort(host, port))
+			return
+		}
+
+		ctx := req.Context()
+		intConn, err := be.dialDestination(ctx, network, net.JoinHostPort(host, port))
+		if err != nil {
+			be.recordEvent("dial error")
+			log.Printf("ERR %s ➔ CONNECT %s Dial: %v", formatReqDesc(req), req.Host, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		defer intConn.Close()
+
+		conn, bufrw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			log.Printf("ERR %s ➔ CONNECT %s Hijack: %v", formatReqDesc(req), req.Host, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		if c, ok := ctx.Value(connCtxKey).(anyConn); ok {
+			annotatedConn(c).SetAnnotation(httpUpgradeKey, "connect")
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			log.Printf("ERR %s ➔ CONNECT %s: %v", formatReqDesc(req), req.Host, err)
+			return
+		}
+		log.Printf("STR %s ➔ CONNECT ➔ %s", formatReqDesc(req), intConn.RemoteAddr())
+		// The client may have sent some data before receiving the
+		// response, e.g. a TLS ClientHello.
+		client := &bufferedConn{Conn: conn, r: conn}
+		if n := bufrw.Reader.Buffered(); n > 0 {
+			b, _ := bufrw.Reader.Peek(n)
+			client.r = io.MultiReader(strings.NewReader(string(b)), conn)
+		}
+		if err := be.bridgeConns(client, intConn); err != nil {
+			log.Printf("DBG %s ➔ CONNECT: %v", formatReqDesc(req), err)
+		}
+	})
+}
+
+// forwardProxyClient authenticates the client of the forward proxy with its
+// TLS client certificate and/or the Proxy-Authorization header.
+func (be *Backend) forwardProxyClient(req *http.Request) (string, func(string) bool, bool) {
+	var cert *x509.Certificate
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		cert = req.TLS.PeerCertificates[0]
+	}
+	user, password, hasPassword := proxyBasicAuth(req)
+	return be.ForwardProxy.authenticate(cert, user, password, hasPassword)
+}
+
+// authenticate identifies a client with its TLS client certificate and/or a
+// user name and password. It returns the client's identity, and a function
+// that matches ACL terms against it.
+func (fp *ForwardProxy) authenticate(cert *x509.Certificate, user, password string, hasPassword bool) (string, func(string) bool, bool) {
+	if hasPassword {
+		i := slices.IndexFunc(fp.Users, func(u *ForwardProxyUser) bool {
+			return u.Name == user
+		})
+		if i < 0 || bcrypt.CompareHashAndPassword([]byte(fp.Users[i].PasswordHash), []byte(password)) != nil {
+			return "", nil, false
+		}
+	} else {
+		user = ""
+	}
+	if user == "" && cert == nil {
+		return "", nil, false
+	}
+	var certTerm func(string) bool
+	if cert != nil {
+		certTerm = certACLTerm(cert)
+	}
+	userID := user
+	if userID == "" {
+		userID = cert.Subject.String()
+	}
+	return userID, func(term string) bool {
+		if v, ok := strings.CutPrefix(term, "USER:"); ok {
+			return user != "" && v == user
+		}
+		return certTerm != nil && certTerm(term)
+	}, true
+}
+
+// allows returns true if at least one rule matches both the client and the
+// destination. The network is tcp or udp, and the host must be normalized with
+// normalizeDestinationHost.
+func (fp *ForwardProxy) allows(matchTerm func(string) bool, network, host, port string) bool {
+	return slices.ContainsFunc(fp.Rules, func(r *ForwardProxyRule) bool {
+		if network == "udp" && !r.AllowUDP {
+			return false
+		}
+		if r.ACL != nil && !matchACL(*r.ACL, matchTerm) {
+			return false
+		}
+		return slices.ContainsFunc(r.dests, func(d *destinationPattern) bool {
+			return d.match(host, port)
+		})
+	})
+}
+
+// proxyBasicAuth returns the user name and password from the
+// Proxy-Authorization header, if it uses the Basic scheme.
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	scheme, cred, ok := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(cred))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// dialDestination connects to a destination of the forward proxy. The network
+// is tcp or udp. The backend's DialFunc, if any, is only used for tcp.
+func (be *Backend) dialDestination(ctx context.Context, network, addr string) (net.Conn, error) {
+	be.state.mu.Lock()
+	dialFunc := be.state.dialFunc
+	be.state.mu.Unlock()
+
+	var c net.Conn
+	var err error
+	if dialFunc != nil && network == "tcp" {
+		dctx, cancel := context.WithTimeout(ctx, be.ForwardTimeout)
+		c, err = dialFunc(dctx, "tcp", addr)
+		cancel()
+	} else if network == "tcp" {
+		c, err = be.dialTCP(ctx, addr, be.ForwardTimeout)
+	} else {
+		c, err = be.netDialer(network, be.ForwardTimeout).DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wc := netw.NewConn(c)
+	wc.OnClose(func() {
+		be.outConns.remove(wc)
+	})
+	be.outConns.add(wc)
+	wc.SetAnnotation(startTimeKey, time.Now())
+	wc.SetAnnotation(modeKey, be.Mode)
+	family := be.countDialFamily(c)
+	if cc, ok := ctx.Value(connCtxKey).(anyConn); ok {
+		wc.SetAnnotation(serverNameKey, connServerName(cc))
+		annotatedConn(cc).SetAnnotation(internalConnKey, wc)
+		annotatedConn(cc).SetAnnotation(dialFamilyKey, family)
+	}
+	return wc, nil
+}
+
+// connectUDPTarget returns the target host and port of a CONNECT-UDP request
+// from its path, which uses the default URI template of RFC 9298:
+// /.well-known/masque/udp/{target_host}/{target_port}/
+func connectUDPTarget(path string) (string, error) {
+	v, ok := strings.CutPrefix(path, connectUDPPathPrefix)
+	if !ok {
+		return "", fmt.Errorf("unexpected path %q", path)
+	}
+	host, v, _ := strings.Cut(v, "/")
+	port, v, _ := strings.Cut(v, "/")
+	if host == "" || port == "" || v != "" {
+		return "", fmt.Errorf("unexpected path %q", path)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// destinationPattern is a parsed ForwardProxyRule destination.
+type destinationPattern struct {
+	// host is a host name, a domain wildcard like *.example.com, or *.
+	host string
+	// ipNet is set when the pattern is an IP address or a CIDR.
+	ipNet *net.IPNet
+	// port is a port number, or *.
+	port string
+}
+
+func parseDestinationPattern(s string) (*destinationPattern, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	if port != "*" {
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	d := &destinationPattern{port: port}
+	switch {
+	case host == "*":
+		d.host = host
+	case strings.Contains(host, "/"):
+		_, n, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, err
+		}
+		d.ipNet = n
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		d.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	default:
+		name, wildcard := strings.CutPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "*/") {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		d.host = normalizeDestinationHost(name)
+		if wildcard {
+			d.host = "*." + d.host
+		}
+	}
+	return d, nil
+}
+
+// match returns true if the normalized host and the port match the pattern.
+func (d *destinationPattern) match(host, port string) bool {
+	if d.port != "*" && d.port != port {
+		return false
+	}
+	if d.host == "*" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return d.ipNet != nil && d.ipNet.Contains(ip)
+	}
+	if d.ipNet != nil {
+		return false
+	}
+	if suffix, ok := strings.CutPrefix(d.host, "*"); ok {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == d.host
+}
+
+func normalizeDestinationHost(host string) string {
+	return idnaToASCII(strings.ToLower(strings.TrimSuffix(host, ".")))
+}
+
+// bufferedConn is a net.Conn that reads from r, e.g. to return data that was
+// already buffered before the connection was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
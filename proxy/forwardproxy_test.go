@@ -0,0 +1,335 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestForwardProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	dest := newTCPServer(t, ctx, "destination", nil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"proxy.example.com"},
+				Mode:        ModeProxy,
+				ForwardProxy: &ForwardProxy{
+					Users: []*ForwardProxyUser{
+						{Name: "alice", PasswordHash: string(hash)},
+						{Name: "bob", PasswordHash: string(hash)},
+					},
+					Rules: []*ForwardProxyRule{
+						{
+							ACL:          &[]string{"USER:alice"},
+							Destinations: []string{"127.0.0.0/8:*", "[::1]:*"},
+						},
+						{
+							Destinations: []string{"*.example.com:443"},
+						},
+					},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	connect := func(target, user string) (string, error) {
+		c, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName: "proxy.example.com",
+			RootCAs:    ca.RootCACertPool(),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if user != "" {
+			fmt.Fprintf(c, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(user)))
+		}
+		fmt.Fprintf(c, "\r\n")
+		br := bufio.NewReader(c)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return resp.Status, nil
+		}
+		b, err := io.ReadAll(br)
+		return string(b), err
+	}
+
+	for _, tc := range []struct {
+		target, user, want string
+	}{
+		{target: dest.listener.Addr().String(), user: "alice:secret", want: "Hello from destination\n"},
+		{target: dest.listener.Addr().String(), user: "bob:secret", want: "403 Forbidden"},
+		{target: dest.listener.Addr().String(), user: "alice:wrong", want: "407 Proxy Authentication Required"},
+		{target: dest.listener.Addr().String(), user: "", want: "407 Proxy Authentication Required"},
+		{target: "www.example.com:80", user: "bob:secret", want: "403 Forbidden"},
+	} {
+		got, err := connect(tc.target, tc.user)
+		if err != nil {
+			t.Fatalf("connect(%q, %q): %v", tc.target, tc.user, err)
+		}
+		if got != tc.want {
+			t.Errorf("connect(%q, %q) = %q, want %q", tc.target, tc.user, got, tc.want)
+		}
+	}
+
+	got, _, err := httpGet("proxy.example.com", proxy.listener.Addr().String(), "/", ca, nil)
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	if want := "HTTP/1.1 405 Method Not Allowed\n"; len(got) < len(want) || got[:len(want)] != want {
+		t.Errorf("httpGet = %q, want %q", got, want)
+	}
+}
+
+func TestForwardProxyBan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		RateLimit: &ConfigRateLimit{
+			BanThreshold: 2,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"proxy.example.com"},
+				Mode:        ModeProxy,
+				ForwardProxy: &ForwardProxy{
+					Users: []*ForwardProxyUser{
+						{Name: "alice", PasswordHash: string(hash)},
+					},
+					Rules: []*ForwardProxyRule{
+						{Destinations: []string{"*.example.com:443"}},
+					},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	connect := func(user string) (string, error) {
+		c, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName: "proxy.example.com",
+			RootCAs:    ca.RootCACertPool(),
+		})
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n")
+		if user != "" {
+			fmt.Fprintf(c, "Proxy-Authorization: Basic %s\r\n", base64.StdEncoding.EncodeToString([]byte(user)))
+		}
+		fmt.Fprintf(c, "\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(c), &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return resp.Status, nil
+	}
+
+	// Requests without credentials don't count as failures.
+	for range 3 {
+		if got, err := connect(""); err != nil || got != "407 Proxy Authentication Required" {
+			t.Fatalf("connect() = %q, %v", got, err)
+		}
+	}
+	for range 2 {
+		if got, err := connect("alice:wrong"); err != nil || got != "407 Proxy Authentication Required" {
+			t.Fatalf("connect(alice:wrong) = %q, %v", got, err)
+		}
+	}
+	if got, err := connect("alice:secret"); err == nil {
+		t.Errorf("connect(alice:secret) = %q, want error after ban", got)
+	}
+}
+
+func TestDestinationPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, host, port string
+		want                bool
+	}{
+		{"*:*", "example.com", "443", true},
+		{"*:*", "10.1.2.3", "22", true},
+		{"*:443", "example.com", "80", false},
+		{"example.com:443", "example.com", "443", true},
+		{"Example.COM.:443", "example.com", "443", true},
+		{"example.com:443", "www.example.com", "443", false},
+		{"*.example.com:443", "www.example.com", "443", true},
+		{"*.example.com:443", "example.com", "443", false},
+		{"*.example.com:443", "wwwexample.com", "443", false},
+		{"10.0.0.0/8:*", "10.1.2.3", "22", true},
+		{"10.0.0.0/8:*", "11.1.2.3", "22", false},
+		{"10.0.0.0/8:*", "ten.example.com", "22", false},
+		{"192.168.0.1:80", "192.168.0.1", "80", true},
+		{"192.168.0.1:80", "192.168.0.2", "80", false},
+		{"[fd00::/8]:443", "fd00::1", "443", true},
+	} {
+		d, err := parseDestinationPattern(tc.pattern)
+		if err != nil {
+			t.Fatalf("parseDestinationPattern(%q): %v", tc.pattern, err)
+		}
+		if got := d.match(tc.host, tc.port); got != tc.want {
+			t.Errorf("%q.match(%q, %q) = %v, want %v", tc.pattern, tc.host, tc.port, got, tc.want)
+		}
+	}
+	for _, p := range []string{"example.com", "example.com:0", "example.com:http", "*.*.com:443", "*:", "10.0.0.0/33:80"} {
+		if _, err := parseDestinationPattern(p); err == nil {
+			t.Errorf("parseDestinationPattern(%q) didn't fail", p)
+		}
+	}
+}
+
+func TestForwardProxyConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	newCfg := func(be *Backend) *Config {
+		return &Config{
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{be},
+		}
+	}
+	users := []*ForwardProxyUser{{Name: "alice", PasswordHash: string(hash)}}
+	rules := []*ForwardProxyRule{{Destinations: []string{"*:443"}}}
+	for _, tc := range []struct {
+		name    string
+		be      *Backend
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			be:   &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ForwardProxy: &ForwardProxy{Users: users, Rules: rules}},
+		},
+		{
+			name: "socks5",
+			be:   &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeSOCKS5, ForwardProxy: &ForwardProxy{Users: users, Rules: rules}},
+		},
+		{
+			name:    "socks5 without ForwardProxy",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeSOCKS5},
+			wantErr: true,
+		},
+		{
+			name: "client auth",
+			be:   &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ClientAuth: &ClientAuth{}, ForwardProxy: &ForwardProxy{Rules: rules}},
+		},
+		{
+			name:    "no auth",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ForwardProxy: &ForwardProxy{Rules: rules}},
+			wantErr: true,
+		},
+		{
+			name:    "missing ForwardProxy",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy},
+			wantErr: true,
+		},
+		{
+			name:    "wrong mode",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeHTTP, Addresses: []string{"localhost:80"}, ForwardProxy: &ForwardProxy{Users: users, Rules: rules}},
+			wantErr: true,
+		},
+		{
+			name:    "addresses",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, Addresses: []string{"localhost:80"}, ForwardProxy: &ForwardProxy{Users: users, Rules: rules}},
+			wantErr: true,
+		},
+		{
+			name:    "no rules",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ForwardProxy: &ForwardProxy{Users: users}},
+			wantErr: true,
+		},
+		{
+			name:    "bad hash",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ForwardProxy: &ForwardProxy{Users: []*ForwardProxyUser{{Name: "bob", PasswordHash: "secret"}}, Rules: rules}},
+			wantErr: true,
+		},
+		{
+			name:    "bad destination",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ForwardProxy: &ForwardProxy{Users: users, Rules: []*ForwardProxyRule{{Destinations: []string{"example.com"}}}}},
+			wantErr: true,
+		},
+		{
+			name:    "h2",
+			be:      &Backend{ServerNames: []string{"p.example.com"}, Mode: ModeProxy, ALPNProtos: &[]string{"h2", "http/1.1"}, ForwardProxy: &ForwardProxy{Users: users, Rules: rules}},
+			wantErr: true,
+		},
+	} {
+		if err := newCfg(tc.be).Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, wantErr %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
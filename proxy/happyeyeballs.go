@@ -0,0 +1,271 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+const (
+	// DialIPv6First, the default, tries the IPv6 addresses of the backend
+	// servers first, and alternates between IPv6 and IPv4 addresses.
+	DialIPv6First = "ipv6-first"
+	// DialIPv4First is like DialIPv6First, but starts with IPv4.
+	DialIPv4First = "ipv4-first"
+	// DialIPv6Only only uses IPv6 addresses.
+	DialIPv6Only = "ipv6-only"
+	// DialIPv4Only only uses IPv4 addresses.
+	DialIPv4Only = "ipv4-only"
+
+	defaultDialAttemptDelay = 250 * time.Millisecond
+	// resolutionDelay is how long to wait for the AAAA records when the
+	// A records are received first, from RFC 8305.
+	resolutionDelay = 50 * time.Millisecond
+)
+
+var validDialAddressFamilies = []string{
+	DialIPv6First,
+	DialIPv4First,
+	DialIPv6Only,
+	DialIPv4Only,
+}
+
+// lookupNetIP is a variable for tests.
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// addrFamily returns ipv4 or ipv6.
+func addrFamily(ip netip.Addr) string {
+	if ip.Unmap().Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+type lookupResult struct {
+	ipv6  bool
+	addrs []netip.Addr
+	err   error
+}
+
+// dialTCP connects to a backend server, host:port, per RFC 8305 (Happy
+// Eyeballs v2). The IPv6 and IPv4 addresses of the host are resolved in
+// parallel, and connection attempts are started every DialAttemptDelay,
+// alternating between the address families, until one succeeds. The other
+// attempts are then canceled.
+func (be *Backend) dialTCP(ctx context.Context, addr string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		// e.g. a service name.
+		return be.netDialer("tcp", timeout).DialContext(ctx, "tcp", addr)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	family := be.DialAddressFamily
+	if be.dialSourceIP != nil {
+		// The source address determines the address family.
+		family = DialIPv6Only
+		if be.dialSourceIP.To4() != nil {
+			family = DialIPv4Only
+		}
+	}
+	useIPv6 := family != DialIPv4Only
+	useIPv4 := family != DialIPv6Only
+	preferIPv6 := family != DialIPv4First && family != DialIPv4Only
+
+	var v6, v4 []netip.Addr
+	pendingLookups := 0
+	lookups := make(chan lookupResult, 2)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Unmap().Is4() && useIPv4 {
+			v4 = append(v4, ip)
+		} else if !ip.Unmap().Is4() && useIPv6 {
+			v6 = append(v6, ip)
+		} else {
+			return nil, fmt.Errorf("dial %s: address family not allowed by %s", addr, family)
+		}
+	} else {
+		lookup := func(ipv6 bool) {
+			network := "ip4"
+			if ipv6 {
+				network = "ip6"
+			}
+			addrs, err := be.lookupNetIP(ctx, network, host)
+			lookups <- lookupResult{ipv6: ipv6, addrs: addrs, err: err}
+		}
+		if useIPv6 {
+			pendingLookups++
+			go lookup(true)
+		}
+		if useIPv4 {
+			pendingLookups++
+			go lookup(false)
+		}
+	}
+
+	results := make(chan dialResult)
+	attemptCtx, cancelAttempts := context.WithCancel(ctx)
+	defer cancelAttempts()
+	inFlight := 0
+	defer func() {
+		// Close the connections that were established after the first
+		// one.
+		cancelAttempts()
+		for ; inFlight > 0; inFlight-- {
+			if r := <-results; r.conn != nil {
+				r.conn.Close()
+			}
+		}
+	}()
+
+	attemptDelay := be.DialAttemptDelay
+	if attemptDelay == 0 {
+		attemptDelay = defaultDialAttemptDelay
+	}
+	var (
+		// canStart indicates that the next attempt can start, i.e.
+		// there is no attempt in progress, or the previous attempt
+		// failed, or attemptDelay has elapsed.
+		canStart   = true
+		nextIsIPv6 = preferIPv6
+		timer      *time.Timer
+		timerC     <-chan time.Time
+		// waitIPv6 indicates that the connection attempts wait for the
+		// IPv6 addresses, for resolutionDelay, after receiving the IPv4
+		// addresses.
+		waitIPv6 bool
+		errs     []error
+	)
+	setTimer := func(d time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(d)
+		timerC = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	next := func() (netip.Addr, bool) {
+		first, second := &v4, &v6
+		if nextIsIPv6 {
+			first, second = second, first
+		}
+		for _, q := range []*[]netip.Addr{first, second} {
+			if len(*q) > 0 {
+				ip := (*q)[0]
+				*q = (*q)[1:]
+				nextIsIPv6 = ip.Unmap().Is4()
+				return ip, true
+			}
+		}
+		return netip.Addr{}, false
+	}
+
+	for {
+		if canStart && !waitIPv6 {
+			if ip, ok := next(); ok {
+				canStart = false
+				inFlight++
+				target := netip.AddrPortFrom(ip, uint16(port)).String()
+				go func() {
+					c, err := be.netDialer("tcp", timeout).DialContext(attemptCtx, "tcp", target)
+					results <- dialResult{conn: c, err: err}
+				}()
+				setTimer(attemptDelay)
+			}
+		}
+		if inFlight == 0 && pendingLookups == 0 && len(v4) == 0 && len(v6) == 0 {
+			if len(errs) == 0 {
+				errs = append(errs, fmt.Errorf("dial %s: no addresses", addr))
+			}
+			return nil, errors.Join(errs...)
+		}
+		select {
+		case r := <-lookups:
+			pendingLookups--
+			if r.err != nil {
+				errs = append(errs, r.err)
+			}
+			if r.ipv6 {
+				v6 = append(v6, r.addrs...)
+				waitIPv6 = false
+			} else {
+				v4 = append(v4, r.addrs...)
+				if preferIPv6 && pendingLookups > 0 && inFlight == 0 {
+					waitIPv6 = true
+					setTimer(resolutionDelay)
+				}
+			}
+		case r := <-results:
+			inFlight--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			canStart = true
+		case <-timerC:
+			timerC = nil
+			canStart = true
+			waitIPv6 = false
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return nil, errors.Join(errs...)
+		}
+	}
+}
+
+// countDialFamily counts a connection to a backend server by address family,
+// and returns the family: ipv4, ipv6, or the empty string when the connection
+// doesn't use IP, e.g. with a DialFunc.
+func (be *Backend) countDialFamily(c net.Conn) string {
+	ap := addrPort(c.RemoteAddr())
+	if !ap.IsValid() {
+		return ""
+	}
+	family := addrFamily(ap.Addr())
+	if family == "ipv4" {
+		be.state.dialsIPv4.Add(1)
+	} else {
+		be.state.dialsIPv6.Add(1)
+	}
+	return family
+}
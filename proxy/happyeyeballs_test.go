@@ -0,0 +1,145 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	var slowIPv6 atomic.Bool
+	defer func(f func(context.Context, string, string) ([]netip.Addr, error)) {
+		lookupNetIP = f
+	}(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if host != "backend.example.com" {
+			return nil, &net.DNSError{Err: "not found", Name: host, IsNotFound: true}
+		}
+		if network == "ip4" {
+			return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+		}
+		if slowIPv6.Load() {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		// Nothing is listening on this address.
+		return []netip.Addr{netip.MustParseAddr("::1")}, nil
+	}
+
+	for _, tc := range []struct {
+		family   string
+		slowIPv6 bool
+		host     string
+		want     string
+	}{
+		{family: DialIPv6First, host: "backend.example.com", want: "ipv4"},
+		{family: DialIPv6First, slowIPv6: true, host: "backend.example.com", want: "ipv4"},
+		{family: DialIPv4First, host: "backend.example.com", want: "ipv4"},
+		{family: DialIPv4Only, host: "backend.example.com", want: "ipv4"},
+		{family: DialIPv6Only, host: "backend.example.com", want: ""},
+		{family: DialIPv6Only, host: "127.0.0.1", want: ""},
+		{family: DialIPv4Only, host: "127.0.0.1", want: "ipv4"},
+		{family: DialIPv4Only, host: "unknown.example.com", want: ""},
+	} {
+		slowIPv6.Store(tc.slowIPv6)
+		be := &Backend{
+			DialAddressFamily: tc.family,
+			DialAttemptDelay:  50 * time.Millisecond,
+			state:             new(backendState),
+		}
+		addr := net.JoinHostPort(tc.host, strconv.Itoa(port))
+		conn, err := be.dialTCP(context.Background(), addr, 2*time.Second)
+		if tc.want == "" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("[%s] dialTCP(%q) succeeded unexpectedly", tc.family, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] dialTCP(%q): %v", tc.family, addr, err)
+			continue
+		}
+		if got := be.countDialFamily(conn); got != tc.want {
+			t.Errorf("[%s] dialTCP(%q) family = %q, want %q", tc.family, addr, got, tc.want)
+		}
+		if got, want := be.state.dialsIPv4.Load(), int64(1); got != want {
+			t.Errorf("[%s] dialsIPv4 = %d, want %d", tc.family, got, want)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialAddressFamilyCheck(t *testing.T) {
+	for _, tc := range []struct {
+		family string
+		delay  time.Duration
+		ok     bool
+	}{
+		{family: "", ok: true},
+		{family: "IPv4-Only", ok: true},
+		{family: "ipv6-first", delay: time.Second, ok: true},
+		{family: "ipv5-only", ok: false},
+		{family: "ipv4-first", delay: time.Millisecond, ok: false},
+		{family: "ipv4-first", delay: time.Minute, ok: false},
+	} {
+		cfg := &Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			Backends: []*Backend{{
+				ServerNames:       []string{"example.com"},
+				Addresses:         []string{"backend.example.com:443"},
+				DialAddressFamily: tc.family,
+				DialAttemptDelay:  tc.delay,
+			}},
+		}
+		err := cfg.Check()
+		if (err == nil) != tc.ok {
+			t.Errorf("Check(%q, %s) = %v", tc.family, tc.delay, err)
+		}
+	}
+}
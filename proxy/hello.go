@@ -27,10 +27,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"golang.org/x/crypto/cryptobyte"
 )
 
+const (
+	defaultClientHelloTimeout = 10 * time.Second
+	minClientHelloSize        = 512
+	maxClientHelloSize        = 16384
+)
+
+var errClientHelloTooLarge = errors.New("ClientHello too large")
+
 type peeker interface {
 	Peek([]byte) (int, error)
 }
@@ -38,13 +47,30 @@ type peeker interface {
 type clientHello struct {
 	ServerName string
 	ALPNProtos []string
+	// Resumption indicates that the client is trying to resume a previous
+	// session, with a pre_shared_key (TLS 1.3) or a session ticket
+	// (TLS 1.2).
+	Resumption bool
+
+	// The following fields are used to compute the JA3 and JA4
+	// fingerprints.
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
 }
 
-func peekClientHello(c peeker) (hello clientHello, err error) {
+func peekClientHello(c peeker, maxSize int) (hello clientHello, err error) {
+	if maxSize <= 0 || maxSize > maxClientHelloSize {
+		maxSize = maxClientHelloSize
+	}
 	// Handshake packet header
 	buf := make([]byte, 5)
 	if _, err := c.Peek(buf); err != nil {
-		return hello, fmt.Errorf("packet header: %v", err)
+		return hello, fmt.Errorf("packet header: %w", err)
 	}
 	if buf[0] != 0x16 { // TLS Handshake
 		return hello, fmt.Errorf("content type 0x%x != 0x16 (%q)", buf[0], buf)
@@ -54,15 +80,22 @@ func peekClientHello(c peeker) (hello clientHello, err error) {
 		return hello, errors.New("invalid format")
 	}
 	var length uint16
-	if !s.ReadUint16(&length) || length > 16384 {
-		return hello, fmt.Errorf("packet length %d > 16384", length)
+	if !s.ReadUint16(&length) {
+		return hello, errors.New("invalid format")
+	}
+	if int(length) > maxSize {
+		return hello, fmt.Errorf("%w: packet length %d > %d", errClientHelloTooLarge, length, maxSize)
 	}
 	buf = make([]byte, 5+length)
 	if _, err := c.Peek(buf); err != nil {
-		return hello, fmt.Errorf("read packet: %v", err)
+		return hello, fmt.Errorf("read packet: %w", err)
 	}
-	buf = buf[5:]
+	return parseClientHello(buf[5:])
+}
 
+// parseClientHello parses a ClientHello handshake message and returns the
+// server name and ALPN protocols.
+func parseClientHello(buf []byte) (hello clientHello, err error) {
 	// https://datatracker.ietf.org/doc/html/rfc8446#section-4
 	//
 	// struct {
@@ -73,10 +106,13 @@ func peekClientHello(c peeker) (hello clientHello, err error) {
 	//          ...
 	//      };
 	// } Handshake;
+	if len(buf) == 0 {
+		return hello, errors.New("invalid format")
+	}
 	if buf[0] != 0x01 { // ClientHello
 		return hello, fmt.Errorf("msg_type 0x%x != 0x01", buf[0])
 	}
-	s = cryptobyte.String(buf)
+	s := cryptobyte.String(buf)
 	if !s.Skip(4) { // msg_type(1), length(3)
 		return hello, errors.New("invalid format")
 	}
@@ -96,17 +132,20 @@ func peekClientHello(c peeker) (hello clientHello, err error) {
 	//     opaque legacy_compression_methods<1..2^8-1>;
 	//     Extension extensions<8..2^16-1>;
 	//   } ClientHello;
-	if !s.Skip(34) { // ProtocolVersion(2), Random(32)
+	if !s.ReadUint16(&hello.Version) || !s.Skip(32) { // ProtocolVersion(2), Random(32)
 		return hello, errors.New("invalid format")
 	}
 
 	var len8 uint8
-	var len16 uint16
+	var cipherSuites cryptobyte.String
 	if !s.ReadUint8(&len8) || !s.Skip(int(len8)) || // legacy_session_id
-		!s.ReadUint16(&len16) || !s.Skip(int(len16)) || // cipher_suites
+		!s.ReadUint16LengthPrefixed(&cipherSuites) || // cipher_suites
 		!s.ReadUint8(&len8) || !s.Skip(int(len8)) { // legacy_compression_methods
 		return hello, errors.New("invalid format")
 	}
+	if hello.CipherSuites, err = readUint16List(cipherSuites); err != nil {
+		return hello, err
+	}
 
 	var extensions cryptobyte.String
 	if !s.ReadUint16LengthPrefixed(&extensions) {
@@ -134,6 +173,7 @@ func peekClientHello(c peeker) (hello clientHello, err error) {
 		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&data) {
 			return hello, errors.New("invalid format")
 		}
+		hello.Extensions = append(hello.Extensions, extType)
 		switch extType {
 		case 0:
 			// https://datatracker.ietf.org/doc/html/rfc6066#section-3
@@ -202,11 +242,69 @@ func peekClientHello(c peeker) (hello clientHello, err error) {
 				}
 				hello.ALPNProtos = append(hello.ALPNProtos, string(protocolName))
 			}
+		case 10, 13, 43:
+			// https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.7
+			// supported_groups(10): NamedGroup named_group_list<2..2^16-1>;
+			// https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.3
+			// signature_algorithms(13): SignatureScheme supported_signature_algorithms<2..2^16-2>;
+			// https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.1
+			// supported_versions(43): ProtocolVersion versions<2..254>;
+			var list cryptobyte.String
+			var ok bool
+			if extType == 43 {
+				ok = data.ReadUint8LengthPrefixed(&list)
+			} else {
+				ok = data.ReadUint16LengthPrefixed(&list)
+			}
+			if !ok {
+				return hello, errors.New("invalid format")
+			}
+			values, err := readUint16List(list)
+			if err != nil {
+				return hello, err
+			}
+			switch extType {
+			case 10:
+				hello.SupportedGroups = values
+			case 13:
+				hello.SignatureAlgorithms = values
+			case 43:
+				hello.SupportedVersions = values
+			}
+		case 35:
+			// https://datatracker.ietf.org/doc/html/rfc5077#section-3.2
+			// session_ticket(35): an empty extension requests a new
+			// ticket.
+			hello.Resumption = hello.Resumption || !data.Empty()
+		case 41:
+			// https://datatracker.ietf.org/doc/html/rfc8446#section-4.2.11
+			// pre_shared_key(41)
+			hello.Resumption = true
+		case 11:
+			// https://datatracker.ietf.org/doc/html/rfc8422#section-5.1.2
+			// ec_point_formats(11): ECPointFormat ec_point_format_list<1..2^8-1>
+			var list cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return hello, errors.New("invalid format")
+			}
+			hello.PointFormats = []uint8(list)
 		}
 	}
 	return hello, nil
 }
 
+func readUint16List(s cryptobyte.String) ([]uint16, error) {
+	out := make([]uint16, 0, len(s)/2)
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return nil, errors.New("invalid format")
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
 func sendCloseNotify(w io.Writer) error {
 	return sendAlert(w, 0x2 /* fatal */, 0x00 /* Close notify */)
 }
@@ -0,0 +1,132 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+type bytesPeeker []byte
+
+func (b bytesPeeker) Peek(buf []byte) (int, error) {
+	n := copy(buf, b)
+	if n < len(buf) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func TestPeekClientHelloMaxSize(t *testing.T) {
+	record := []byte{0x16, 0x03, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(record[3:], 1000)
+	record = append(record, make([]byte, 1000)...)
+
+	if _, err := peekClientHello(bytesPeeker(record), 512); !errors.Is(err, errClientHelloTooLarge) {
+		t.Errorf("peekClientHello(512) = %v, want errClientHelloTooLarge", err)
+	}
+	if _, err := peekClientHello(bytesPeeker(record), 0); err == nil || errors.Is(err, errClientHelloTooLarge) {
+		t.Errorf("peekClientHello(0) = %v, want invalid format", err)
+	}
+}
+
+func TestClientHelloLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr:              "localhost:0",
+		TLSAddr:               "localhost:0",
+		ClientHelloTimeout:    200 * time.Millisecond,
+		MaxClientHelloSize:    4096,
+		AcceptProxyHeaderFrom: []string{"127.0.0.0/8"},
+		CacheDir:              t.TempDir(),
+		MaxOpen:               100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	waitForClose := func(data []byte) {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("net.Dial: %v", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(data); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(conn); errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read() = %v, want closed", err)
+		}
+	}
+
+	// Nothing at all.
+	waitForClose(nil)
+	// Incomplete ClientHello.
+	waitForClose([]byte{0x16, 0x03, 0x01, 0x01, 0x00, 0x01})
+	// ClientHello larger than MaxClientHelloSize.
+	waitForClose([]byte{0x16, 0x03, 0x01, 0x20, 0x00})
+
+	got, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil)
+	if err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	if want := "Hello from backend\n"; got != want {
+		t.Errorf("tlsGet() = %q, want %q", got, want)
+	}
+
+	proxy.eventsmu.Lock()
+	defer proxy.eventsmu.Unlock()
+	if got, want := proxy.events["ClientHello timeout"], int64(2); got != want {
+		t.Errorf("ClientHello timeout events = %d, want %d", got, want)
+	}
+	if got, want := proxy.events["ClientHello too large"], int64(1); got != want {
+		t.Errorf("ClientHello too large events = %d, want %d", got, want)
+	}
+}
@@ -28,6 +28,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,17 +38,31 @@ type ctxKey int
 
 var connCtxKey ctxKey = 1
 
-func startInternalHTTPServer(handler http.Handler, conns <-chan net.Conn) *http.Server {
+// defaultHTTPLimits are the limits of the internal HTTP servers when the
+// backend doesn't have HTTPLimits.
+var defaultHTTPLimits = &HTTPLimits{
+	MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+	ReadHeaderTimeout: 30 * time.Second,
+	ReadTimeout:       24 * time.Hour,
+	WriteTimeout:      24 * time.Hour,
+	IdleTimeout:       30 * time.Second,
+}
+
+func startInternalHTTPServer(handler http.Handler, conns <-chan net.Conn, limits *HTTPLimits) *http.Server {
 	l := &proxyListener{
 		ch:       conns,
 		closedCh: make(chan struct{}),
 	}
+	if limits == nil {
+		limits = defaultHTTPLimits
+	}
 	s := &http.Server{
-		Handler:           handler,
-		ReadHeaderTimeout: 30 * time.Second,
-		IdleTimeout:       30 * time.Second,
-		ReadTimeout:       24 * time.Hour,
-		WriteTimeout:      24 * time.Hour,
+		Handler:           sniffedTLSHandler(handler),
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			return context.WithValue(ctx, connCtxKey, c)
 		},
@@ -55,6 +71,187 @@ func startInternalHTTPServer(handler http.Handler, conns <-chan net.Conn) *http.
 	return s
 }
 
+// sniffedTLSHandler sets req.TLS for the requests received on a sniffedConn.
+// The http server only sets it for *tls.Conn.
+func sniffedTLSHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if c, ok := req.Context().Value(connCtxKey).(*sniffedConn); ok && req.TLS == nil {
+			cs := c.ConnectionState()
+			req.TLS = &cs
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// httpLimitsHandler enforces the request body size and concurrency limits of
+// be.HTTPLimits.
+func (be *Backend) httpLimitsHandler(next http.Handler) http.Handler {
+	limits := be.HTTPLimits
+	if limits == nil || (limits.MaxBodyBytes == 0 && limits.MaxConcurrentRequests == 0) {
+		return next
+	}
+	var sem chan struct{}
+	if n := limits.MaxConcurrentRequests; n > 0 {
+		sem = make(chan struct{}, n)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				be.recordEvent("too many concurrent requests")
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		if n := limits.MaxBodyBytes; n > 0 && req.Body != nil {
+			if req.ContentLength > n {
+				req.Body.Close()
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			req.Body = http.MaxBytesReader(w, req.Body, n)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// hostRoutingHandler returns be.httpHandler, with the Host header validation
+// and routing of be.HostRouting.
+func (be *Backend) hostRoutingHandler() http.Handler {
+	hr := be.HostRouting
+	if hr == nil {
+		return be.httpHandler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, ok := req.Context().Value(connCtxKey).(anyConn)
+		if !ok {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		serverName := connServerName(conn)
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = idnaToASCII(strings.ToLower(host))
+		if host == "" || host == serverName || (!hr.MatchSNI && be.hasServerName(host)) {
+			be.httpHandler.ServeHTTP(w, req)
+			return
+		}
+		if other := be.hostRoutes[host]; other != nil {
+			if err := other.checkIP(conn.RemoteAddr()); err != nil {
+				log.Printf("REQ %s ➔ %s %s ➔ status:%d CheckIP(%s): %v", formatReqDesc(req), req.Method, req.URL.Path, http.StatusForbidden, idnaToUnicode(host), err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			be.recordEvent("host routed to " + idnaToUnicode(host))
+			other.httpHandler.ServeHTTP(w, req)
+			return
+		}
+		if hr.Rewrite {
+			be.recordEvent("host rewritten")
+			req.Host = serverName
+			be.httpHandler.ServeHTTP(w, req)
+			return
+		}
+		be.recordEvent("misdirected request")
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+	})
+}
+
+// defaultEarlyDataMethods are the methods that are accepted in early data
+// when the backend doesn't have EarlyData.Methods.
+var defaultEarlyDataMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+
+// earlyDataHandler enforces be.EarlyData. The requests that were sent in
+// early data are rejected with 425 (Too Early) unless their method is
+// allowed. The accepted requests that arrived in QUIC early data get the
+// Early-Data header, to let the backend servers make their own decision.
+func (be *Backend) earlyDataHandler(next http.Handler) http.Handler {
+	enable, methods := true, defaultEarlyDataMethods
+	if ed := be.EarlyData; ed != nil {
+		if ed.Enable != nil {
+			enable = *ed.Enable
+		}
+		if len(ed.Methods) > 0 {
+			methods = ed.Methods
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		early := req.Header.Get("Early-Data") == "1"
+		if !early && isEarlyDataConn(req.Context()) {
+			req.Header.Set("Early-Data", "1")
+			early = true
+		}
+		if !early {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !enable || !slices.Contains(methods, req.Method) {
+			be.state.earlyDataRejected.Add(1)
+			http.Error(w, "Too Early", http.StatusTooEarly)
+			return
+		}
+		be.state.earlyDataAccepted.Add(1)
+		next.ServeHTTP(w, req)
+	})
+}
+
+// isEarlyDataConn returns true if the request's connection hasn't finished
+// its handshake yet, i.e. the request was received in early data.
+func isEarlyDataConn(ctx context.Context) bool {
+	c, ok := ctx.Value(connCtxKey).(interface {
+		HandshakeComplete() <-chan struct{}
+	})
+	if !ok {
+		return false
+	}
+	select {
+	case <-c.HandshakeComplete():
+		return false
+	default:
+		return true
+	}
+}
+
+// plaintextHTTPHandler handles the requests received on HTTPAddr that aren't
+// ACME challenges. They are redirected to https://.
+func (p *Proxy) plaintextHTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.mu.RLock()
+		redirectHTTP := p.cfg.RedirectHTTP
+		p.mu.RUnlock()
+
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		if strings.Contains(host, ":") {
+			target = "https://[" + host + "]" + req.URL.RequestURI()
+		}
+		if !redirectHTTP {
+			// Same as the autocert default.
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				http.Error(w, "Use HTTPS", http.StatusBadRequest)
+				return
+			}
+			http.Redirect(w, req, target, http.StatusFound)
+			return
+		}
+		if _, err := p.backend(idnaToASCII(strings.ToLower(host))); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+	})
+}
+
 func serveHTTP(s *http.Server, l net.Listener) {
 	if err := s.Serve(l); err != net.ErrClosed && err != http.ErrServerClosed {
 		log.Printf("ERR http server exited: %v", err)
@@ -115,3 +312,37 @@ func logHandler(next http.Handler) http.Handler {
 		next.ServeHTTP(w, req)
 	})
 }
+
+// responseRecorder records the status code and the size of HTTP responses.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	// user is set by authenticateUser.
+	user string
+}
+
+func (w *responseRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *responseRecorder) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *responseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
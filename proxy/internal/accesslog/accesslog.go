@@ -0,0 +1,205 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package accesslog writes access log entries for connections and HTTP
+// requests, in JSON or in Apache combined log format.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FormatJSON writes one JSON object per line.
+	FormatJSON = "json"
+	// FormatCombined writes lines in the Apache combined log format.
+	FormatCombined = "combined"
+)
+
+const (
+	// TypeConnection is the type of entries that describe a connection.
+	TypeConnection = "connection"
+	// TypeRequest is the type of entries that describe an HTTP request.
+	TypeRequest = "request"
+)
+
+// Entry is an access log entry.
+type Entry struct {
+	Time          time.Time     `json:"time"`
+	Type          string        `json:"type"`
+	RemoteAddr    string        `json:"remoteAddr"`
+	ServerName    string        `json:"serverName,omitempty"`
+	Mode          string        `json:"mode,omitempty"`
+	ALPNProto     string        `json:"alpnProto,omitempty"`
+	User          string        `json:"user,omitempty"`
+	BackendAddr   string        `json:"backendAddr,omitempty"`
+	JA3           string        `json:"ja3,omitempty"`
+	JA4           string        `json:"ja4,omitempty"`
+	Method        string        `json:"method,omitempty"`
+	URI           string        `json:"uri,omitempty"`
+	HTTPProto     string        `json:"httpProto,omitempty"`
+	Status        int           `json:"status,omitempty"`
+	Referer       string        `json:"referer,omitempty"`
+	UserAgent     string        `json:"userAgent,omitempty"`
+	BytesReceived int64         `json:"bytesReceived"`
+	BytesSent     int64         `json:"bytesSent"`
+	Duration      time.Duration `json:"-"`
+	HandshakeTime time.Duration `json:"-"`
+	DialTime      time.Duration `json:"-"`
+}
+
+type jsonEntry struct {
+	*Entry
+	DurationMS  float64 `json:"durationMs"`
+	HandshakeMS float64 `json:"handshakeMs,omitempty"`
+	DialMS      float64 `json:"dialMs,omitempty"`
+}
+
+// Logger writes access log entries to an io.Writer. It is safe for
+// concurrent use.
+type Logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// New returns a new Logger that writes entries to w in the given format.
+func New(w io.Writer, format string) (*Logger, error) {
+	l := &Logger{}
+	if _, err := l.SetOutput(w, format); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetOutput changes the writer and the format of the access log. It returns
+// the previous writer.
+func (l *Logger) SetOutput(w io.Writer, format string) (io.Writer, error) {
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatCombined {
+		return nil, fmt.Errorf("invalid access log format %q", format)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.w
+	l.w, l.format = w, format
+	return old, nil
+}
+
+// Log writes e to the access log.
+func (l *Logger) Log(e *Entry) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	format := l.format
+	l.mu.Unlock()
+	var line []byte
+	switch format {
+	case FormatCombined:
+		line = []byte(combined(e))
+	default:
+		b, err := json.Marshal(jsonEntry{
+			Entry:       e,
+			DurationMS:  ms(e.Duration),
+			HandshakeMS: ms(e.HandshakeTime),
+			DialMS:      ms(e.DialTime),
+		})
+		if err != nil {
+			return
+		}
+		line = b
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return
+	}
+	if lw, ok := l.w.(levelWriter); ok && e.Status >= 500 {
+		lw.WriteLevel(slog.LevelWarn, line)
+		return
+	}
+	l.w.Write(line)
+}
+
+// levelWriter is implemented by writers that send each entry with a level,
+// e.g. to syslog.
+type levelWriter interface {
+	WriteLevel(level slog.Level, b []byte) (int, error)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// combined returns e in the Apache combined log format:
+//
+//	%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-agent}i"
+//
+// Connections don't have a request line. It is replaced with the server
+// name, the mode, and the ALPN protocol.
+func combined(e *Entry) string {
+	host := e.RemoteAddr
+	if i := strings.LastIndexByte(host, ':'); i > 0 {
+		host = strings.Trim(host[:i], "[]")
+	}
+	var reqLine, status string
+	if e.Type == TypeRequest {
+		reqLine = e.Method + " " + e.URI + " " + e.HTTPProto
+		status = fmt.Sprint(e.Status)
+	} else {
+		reqLine = strings.TrimSpace(e.Mode + " " + e.ServerName + " " + e.ALPNProto)
+		status = "-"
+	}
+	size := "-"
+	if e.BytesSent > 0 {
+		size = fmt.Sprint(e.BytesSent)
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %s %s %s %s",
+		host, dash(e.User), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(reqLine), status, size, quote(e.Referer), quote(e.UserAgent))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "_")
+}
+
+func quote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatJSON)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	l.Log(&Entry{
+		Time:          time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC),
+		Type:          TypeConnection,
+		RemoteAddr:    "192.168.0.1:12345",
+		ServerName:    "example.com",
+		Mode:          "TCP",
+		BytesReceived: 100,
+		BytesSent:     200,
+		Duration:      1500 * time.Millisecond,
+		DialTime:      2 * time.Millisecond,
+	})
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf.String(), err)
+	}
+	want := map[string]any{
+		"time":          "2023-10-01T12:00:00Z",
+		"type":          "connection",
+		"remoteAddr":    "192.168.0.1:12345",
+		"serverName":    "example.com",
+		"mode":          "TCP",
+		"bytesReceived": float64(100),
+		"bytesSent":     float64(200),
+		"durationMs":    float64(1500),
+		"dialMs":        float64(2),
+	}
+	if len(got) != len(want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestCombined(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatCombined)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ts := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	l.Log(&Entry{
+		Time:       ts,
+		Type:       TypeRequest,
+		RemoteAddr: "[2001:db8::1]:12345",
+		User:       "bob@example.com",
+		Method:     "GET",
+		URI:        "/foo?bar",
+		HTTPProto:  "HTTP/2.0",
+		Status:     200,
+		BytesSent:  1234,
+		UserAgent:  `Go "test"`,
+	})
+	l.Log(&Entry{
+		Time:       ts,
+		Type:       TypeConnection,
+		RemoteAddr: "192.168.0.1:12345",
+		ServerName: "example.com",
+		Mode:       "TLS",
+	})
+	want := `2001:db8::1 - bob@example.com [01/Oct/2023:12:00:00 +0000] "GET /foo?bar HTTP/2.0" 200 1234 "-" "Go \"test\""` + "\n" +
+		`192.168.0.1 - - [01/Oct/2023:12:00:00 +0000] "TLS example.com" - - "-" "-"` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	if _, err := New(&buf, "foo"); err == nil {
+		t.Error("New(foo) should fail")
+	}
+}
+
+type testLevelWriter struct {
+	levels []slog.Level
+}
+
+func (w *testLevelWriter) Write(b []byte) (int, error) {
+	return w.WriteLevel(slog.LevelInfo, b)
+}
+
+func (w *testLevelWriter) WriteLevel(level slog.Level, b []byte) (int, error) {
+	w.levels = append(w.levels, level)
+	return len(b), nil
+}
+
+func TestLevels(t *testing.T) {
+	var w testLevelWriter
+	l, err := New(&w, FormatCombined)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	l.Log(&Entry{Type: TypeConnection})
+	l.Log(&Entry{Type: TypeRequest, Status: 200})
+	l.Log(&Entry{Type: TypeRequest, Status: 404})
+	l.Log(&Entry{Type: TypeRequest, Status: 502})
+	want := []slog.Level{slog.LevelInfo, slog.LevelInfo, slog.LevelInfo, slog.LevelWarn}
+	if !slices.Equal(w.levels, want) {
+		t.Errorf("levels = %v, want %v", w.levels, want)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "logs", "access.log")
+	f, err := NewRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatalf("NewRotatingFile: %v", err)
+	}
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("Write after Close should fail")
+	}
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{name, "dddddd\n"},
+		{name + ".1", "cccccc\n"},
+		{name + ".2", "bbbbbb\n"},
+		{name + ".3", ""},
+	} {
+		b, err := os.ReadFile(tc.name)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%s should not exist", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
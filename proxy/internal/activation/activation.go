@@ -0,0 +1,233 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package activation gets the sockets that are passed to the process with the
+// systemd socket activation protocol, i.e. with the LISTEN_PID, LISTEN_FDS, and
+// LISTEN_FDNAMES environment variables. The same protocol is used to pass the
+// sockets to a new process during an upgrade, with TLSPROXY_LISTEN_PPID instead
+// of LISTEN_PID.
+//
+// See https://www.freedesktop.org/software/systemd/man/latest/sd_listen_fds.html
+package activation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed by systemd.
+	listenFDsStart = 3
+
+	// ReadyName is the name of the file that the new process uses to
+	// tell its parent that it is ready, during an upgrade.
+	ReadyName = "tlsproxy-ready"
+)
+
+type socket struct {
+	name string
+	file *os.File
+}
+
+var (
+	mu      sync.Mutex
+	once    sync.Once
+	sockets []*socket
+)
+
+// inherit returns the sockets passed to the process. The environment
+// variables are unset so that child processes don't inherit them. mu must be
+// held.
+func inherit() []*socket {
+	once.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+			os.Unsetenv("TLSPROXY_LISTEN_PPID")
+		}()
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		fromSystemd := err == nil && pid == os.Getpid()
+		ppid, err := strconv.Atoi(os.Getenv("TLSPROXY_LISTEN_PPID"))
+		fromParent := err == nil && ppid == os.Getppid()
+		if !fromSystemd && !fromParent {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := range n {
+			fd := listenFDsStart + i
+			s := &socket{
+				name: "LISTEN_FD_" + strconv.Itoa(fd),
+				file: os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)),
+			}
+			if i < len(names) && names[i] != "" {
+				s.name = names[i]
+			}
+			sockets = append(sockets, s)
+		}
+	})
+	return sockets
+}
+
+// Listener returns the passed stream socket whose name is name, or whose local
+// address is addr. It returns nil if there is no such socket. Each socket can
+// only be returned once.
+func Listener(name, addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok, err := find(name, addr, net.FileListener, func(l net.Listener) net.Addr { return l.Addr() })
+	if err != nil || !ok {
+		return nil, err
+	}
+	return l, nil
+}
+
+// PacketConn returns the passed datagram socket whose name is name, or whose
+// local address is addr. It returns nil if there is no such socket. Each
+// socket can only be returned once.
+func PacketConn(name, addr string) (net.PacketConn, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	c, ok, err := find(name, addr, net.FilePacketConn, func(c net.PacketConn) net.Addr { return c.LocalAddr() })
+	if err != nil || !ok {
+		return nil, err
+	}
+	return c, nil
+}
+
+type closer interface {
+	Close() error
+}
+
+func find[T closer](name, addr string, fromFile func(*os.File) (T, error), localAddr func(T) net.Addr) (T, bool, error) {
+	var zero T
+	socks := inherit()
+	// Sockets are matched by name first, and then by address.
+	for _, byName := range []bool{true, false} {
+		for i, s := range socks {
+			if byName && s.name != name {
+				continue
+			}
+			v, err := fromFile(s.file)
+			if err != nil {
+				// Not the right type of socket.
+				continue
+			}
+			if !byName && !matchAddr(addr, localAddr(v)) {
+				v.Close()
+				continue
+			}
+			s.file.Close()
+			sockets = append(socks[:i:i], socks[i+1:]...)
+			return v, true, nil
+		}
+	}
+	return zero, false, nil
+}
+
+// matchAddr returns true if addr, e.g. :443 or 192.168.0.1:443, refers to the
+// local address la.
+func matchAddr(addr string, la net.Addr) bool {
+	if addr == "" {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	var laIP net.IP
+	var laPort int
+	switch a := la.(type) {
+	case *net.TCPAddr:
+		laIP, laPort = a.IP, a.Port
+	case *net.UDPAddr:
+		laIP, laPort = a.IP, a.Port
+	default:
+		return false
+	}
+	if p, err := net.LookupPort("tcp", port); err != nil || p != laPort {
+		return false
+	}
+	if host == "" {
+		return laIP.IsUnspecified()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.Equal(laIP)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(laIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Env returns the environment variables that pass files with these names to
+// a child process. The files must be the first ExtraFiles of the child
+// process, in the same order.
+func Env(names []string) []string {
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		if k == "LISTEN_PID" || k == "LISTEN_FDS" || k == "LISTEN_FDNAMES" || k == "TLSPROXY_LISTEN_PPID" {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"TLSPROXY_LISTEN_PPID="+strconv.Itoa(os.Getpid()),
+	)
+}
+
+// NotifyReady tells the parent process that this process is ready, if the
+// parent is waiting for it.
+func NotifyReady() error {
+	mu.Lock()
+	defer mu.Unlock()
+	socks := inherit()
+	for i, s := range socks {
+		if s.name != ReadyName {
+			continue
+		}
+		sockets = append(socks[:i:i], socks[i+1:]...)
+		_, err := s.file.Write([]byte{1})
+		if cerr := s.file.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return nil
+}
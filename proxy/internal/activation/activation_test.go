@@ -0,0 +1,119 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package activation
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListeners(t *testing.T) {
+	once.Do(func() {})
+
+	tcp1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer tcp1.Close()
+	tcp2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer tcp2.Close()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket: %v", err)
+	}
+	defer udp.Close()
+
+	file := func(v interface{ File() (*os.File, error) }) *os.File {
+		f, err := v.File()
+		if err != nil {
+			t.Fatalf("File: %v", err)
+		}
+		return f
+	}
+	mu.Lock()
+	sockets = []*socket{
+		{name: "tls", file: file(tcp1.(*net.TCPListener))},
+		{name: "LISTEN_FD_4", file: file(tcp2.(*net.TCPListener))},
+		{name: "LISTEN_FD_5", file: file(udp.(*net.UDPConn))},
+	}
+	mu.Unlock()
+
+	if l, err := Listener("http", "127.0.0.1:1"); err != nil || l != nil {
+		t.Errorf("Listener(http) = %v, %v, want nil", l, err)
+	}
+	l, err := Listener("tls", "")
+	if err != nil || l == nil {
+		t.Fatalf("Listener(tls) = %v, %v", l, err)
+	}
+	if got, want := l.Addr().String(), tcp1.Addr().String(); got != want {
+		t.Errorf("Listener(tls) addr = %q, want %q", got, want)
+	}
+	l.Close()
+
+	l, err = Listener("http", tcp2.Addr().String())
+	if err != nil || l == nil {
+		t.Fatalf("Listener(http) = %v, %v", l, err)
+	}
+	if got, want := l.Addr().String(), tcp2.Addr().String(); got != want {
+		t.Errorf("Listener(http) addr = %q, want %q", got, want)
+	}
+	l.Close()
+
+	c, err := PacketConn("quic", udp.LocalAddr().String())
+	if err != nil || c == nil {
+		t.Fatalf("PacketConn(quic) = %v, %v", c, err)
+	}
+	if got, want := c.LocalAddr().String(), udp.LocalAddr().String(); got != want {
+		t.Errorf("PacketConn(quic) addr = %q, want %q", got, want)
+	}
+	c.Close()
+
+	if n := len(sockets); n != 0 {
+		t.Errorf("len(sockets) = %d, want 0", n)
+	}
+}
+
+func TestMatchAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr string
+		la   net.Addr
+		want bool
+	}{
+		{":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, true},
+		{":https", &net.TCPAddr{IP: net.IPv4zero, Port: 443}, true},
+		{":443", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, false},
+		{":443", &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}, false},
+		{"127.0.0.1:443", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}, true},
+		{"127.0.0.1:443", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 443}, false},
+		{"", &net.TCPAddr{IP: net.IPv6unspecified, Port: 443}, false},
+	} {
+		if got := matchAddr(tc.addr, tc.la); got != tc.want {
+			t.Errorf("matchAddr(%q, %v) = %v, want %v", tc.addr, tc.la, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package auditlog writes an append-only, tamper-evident log of security
+// relevant events. Each entry is a JSON object on its own line. Entries are
+// numbered, and each one contains the SHA-256 hash of the previous one, so
+// that entries can't be modified, removed, or reordered without breaking the
+// hash chain. Use Verify to check the chain.
+package auditlog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// TypeACL is the type of entries that record access control
+	// decisions, e.g. IP or SSO ACL denials.
+	TypeACL = "acl"
+	// TypeClientCert is the type of entries that record whether a client
+	// certificate was accepted.
+	TypeClientCert = "clientCert"
+	// TypeLogin is the type of entries that record user logins.
+	TypeLogin = "login"
+	// TypeLogout is the type of entries that record user logouts.
+	TypeLogout = "logout"
+	// TypeConfig is the type of entries that record config changes.
+	TypeConfig = "config"
+	// TypeAdmin is the type of entries that record the use of the console
+	// and the admin API.
+	TypeAdmin = "admin"
+)
+
+const (
+	// ResultAllow indicates that the action was allowed.
+	ResultAllow = "allow"
+	// ResultDeny indicates that the action was denied.
+	ResultDeny = "deny"
+)
+
+// Entry is an audit log entry.
+type Entry struct {
+	// Seq is the sequence number of the entry, starting at 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Actor is the identity of the user, if known.
+	Actor      string `json:"actor,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	ServerName string `json:"serverName,omitempty"`
+	// Action is what the actor did, e.g. "POST /api/config/update".
+	Action string `json:"action,omitempty"`
+	// Result is ResultAllow, ResultDeny, or empty.
+	Result  string   `json:"result,omitempty"`
+	Details []string `json:"details,omitempty"`
+	// PrevHash is the Hash of the previous entry, or empty for the first
+	// entry.
+	PrevHash string `json:"prevHash"`
+	// Hash is the hex-encoded SHA-256 hash of the JSON encoding of the
+	// entry with an empty Hash.
+	Hash string `json:"hash"`
+}
+
+func (e *Entry) hash() string {
+	c := *e
+	c.Hash = ""
+	b, _ := json.Marshal(&c)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Logger writes audit log entries to an io.Writer. It is safe for concurrent
+// use.
+type Logger struct {
+	mu   sync.Mutex
+	w    io.Writer
+	seq  uint64
+	prev string
+
+	prune     func()
+	lastPrune time.Time
+}
+
+// New returns a new Logger that writes entries to w. The chain starts after
+// last, which is typically the last entry of an existing log, or nil.
+func New(w io.Writer, last *Entry) *Logger {
+	l := &Logger{w: w}
+	if last != nil {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+	return l
+}
+
+// Resume makes the chain start after last, if nothing was logged yet.
+func (l *Logger) Resume(last *Entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seq == 0 && last != nil {
+		l.seq, l.prev = last.Seq, last.Hash
+	}
+}
+
+// SetOutput changes the writer of the audit log. The hash chain continues
+// where it was. If prune isn't nil, it is called at most once per hour to
+// enforce the retention policy. SetOutput returns the previous writer.
+func (l *Logger) SetOutput(w io.Writer, prune func()) io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.w
+	l.w, l.prune, l.lastPrune = w, prune, time.Time{}
+	return old
+}
+
+// Log sets the sequence number and the hashes of e, and writes it to the
+// audit log.
+func (l *Logger) Log(e *Entry) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	e.Seq = l.seq + 1
+	e.PrevHash = l.prev
+	e.Hash = e.hash()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.prev = e.Seq, e.Hash
+	if l.prune != nil && time.Since(l.lastPrune) > time.Hour {
+		l.lastPrune = time.Now()
+		go l.prune()
+	}
+	return nil
+}
+
+// Verify reads entries from r and checks the hash chain. The first entry
+// must follow prev, which can be nil when r contains the start of the log,
+// or when the continuity with the previous entries isn't checked. Verify
+// returns the last entry.
+func Verify(r io.Reader, prev *Entry) (*Entry, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for n := 1; s.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return prev, fmt.Errorf("line %d: %w", n, err)
+		}
+		if h := e.hash(); h != e.Hash {
+			return prev, fmt.Errorf("line %d: invalid hash", n)
+		}
+		if prev != nil && (e.PrevHash != prev.Hash || e.Seq != prev.Seq+1) {
+			return prev, fmt.Errorf("line %d: broken chain after entry %d", n, prev.Seq)
+		}
+		prev = &e
+	}
+	return prev, s.Err()
+}
+
+// LastEntry returns the last entry of the audit log file name, or of its most
+// recent rotated file when name is empty. It returns nil when there is no
+// log yet.
+func LastEntry(name string) (*Entry, error) {
+	for _, n := range []string{name, name + ".1"} {
+		f, err := os.Open(n)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		last, err := Verify(f, nil)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", n, err)
+		}
+		if last != nil {
+			return last, nil
+		}
+	}
+	return nil, nil
+}
+
+// Prune deletes the rotated files of the audit log file name that were last
+// modified more than maxAge ago.
+func Prune(name string, maxAge time.Duration) error {
+	matches, err := filepath.Glob(name + ".*")
+	if err != nil {
+		return err
+	}
+	re := regexp.MustCompile(`\.[0-9]+$`)
+	cutoff := time.Now().Add(-maxAge)
+	for _, m := range matches {
+		if !re.MatchString(m) {
+			continue
+		}
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		if fi.ModTime().Before(cutoff) {
+			if err := os.Remove(m); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
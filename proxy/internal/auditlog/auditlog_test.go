@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auditlog
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashChain(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, nil)
+	for _, e := range []*Entry{
+		{Type: TypeLogin, Actor: "bob@example.com", ServerName: "example.com"},
+		{Type: TypeClientCert, Actor: "SUBJECT:CN=alice", Result: ResultDeny},
+		{Type: TypeConfig, Details: []string{"+  - example.com"}},
+	} {
+		if err := l.Log(e); err != nil {
+			t.Fatalf("Log: %v", err)
+		}
+	}
+	log := buf.String()
+	last, err := Verify(strings.NewReader(log), nil)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if last.Seq != 3 || last.Type != TypeConfig {
+		t.Errorf("last = %+v", last)
+	}
+
+	lines := strings.SplitAfter(log, "\n")
+	for _, tc := range []struct {
+		name string
+		log  string
+	}{
+		{"modified", strings.Replace(log, "bob@", "eve@", 1)},
+		{"removed", lines[0] + lines[2]},
+		{"reordered", lines[1] + lines[0] + lines[2]},
+	} {
+		if _, err := Verify(strings.NewReader(tc.log), nil); err == nil {
+			t.Errorf("Verify(%s) succeeded", tc.name)
+		}
+	}
+
+	// A new logger continues the chain.
+	var buf2 bytes.Buffer
+	l2 := New(&buf2, last)
+	if err := l2.Log(&Entry{Type: TypeLogout, Actor: "bob@example.com"}); err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+	if _, err := Verify(strings.NewReader(log+buf2.String()), nil); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if _, err := Verify(strings.NewReader(buf2.String()), &Entry{Seq: 3, Hash: "foo"}); err == nil {
+		t.Error("Verify with wrong previous entry succeeded")
+	}
+}
+
+func TestLastEntryAndPrune(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "audit.log")
+
+	if last, err := LastEntry(name); err != nil || last != nil {
+		t.Fatalf("LastEntry = %v, %v", last, err)
+	}
+	var buf bytes.Buffer
+	l := New(&buf, nil)
+	l.Log(&Entry{Type: TypeAdmin, Action: "GET /"})
+	l.Log(&Entry{Type: TypeAdmin, Action: "POST /api/backends/drain"})
+	if err := os.WriteFile(name+".1", buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(name, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	last, err := LastEntry(name)
+	if err != nil || last == nil || last.Seq != 2 || last.Action != "POST /api/backends/drain" {
+		t.Fatalf("LastEntry = %+v, %v", last, err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, n := range []string{name + ".1", name + ".2"} {
+		if err := os.WriteFile(n, nil, 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if err := os.Chtimes(name+".2", old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if err := Prune(name, 24*time.Hour); err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	for n, want := range map[string]bool{name: true, name + ".1": true, name + ".2": false} {
+		if _, err := os.Stat(n); (err == nil) != want {
+			t.Errorf("Stat(%s) = %v, want exists=%v", n, err, want)
+		}
+	}
+}
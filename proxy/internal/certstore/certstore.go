@@ -0,0 +1,125 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package certstore implements storage backends for the ACME certificates and
+// the master key material, so that they can be kept outside of the local
+// cache directory, e.g. in S3, GCS, Redis, or a SQL database.
+package certstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ErrNotFound is returned by Store.Get when the key doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// Store is a simple key-value store.
+type Store interface {
+	// Get returns the value of key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put sets the value of key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Delete deletes key. It is not an error if key doesn't exist.
+	Delete(ctx context.Context, key string) error
+	// Keys returns all the keys that start with prefix.
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Encrypter encrypts and decrypts data.
+type Encrypter interface {
+	Encrypt(data []byte) ([]byte, error)
+	Decrypt(data []byte) ([]byte, error)
+}
+
+// Cache implements autocert.Cache with a Store. The values are encrypted, but
+// the keys, i.e. the server names, are not.
+type Cache struct {
+	store  Store
+	prefix string
+	enc    Encrypter
+}
+
+var _ autocert.Cache = (*Cache)(nil)
+
+// NewCache returns a Cache that stores its values in store, under prefix,
+// encrypted with enc.
+func NewCache(store Store, prefix string, enc Encrypter) *Cache {
+	return &Cache{
+		store:  store,
+		prefix: prefix,
+		enc:    enc,
+	}
+}
+
+// Get implements autocert.Cache.
+func (c *Cache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.store.Get(ctx, c.prefix+key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, autocert.ErrCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.enc.Decrypt(data)
+}
+
+// Put implements autocert.Cache.
+func (c *Cache) Put(ctx context.Context, key string, data []byte) error {
+	enc, err := c.enc.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	return c.store.Put(ctx, c.prefix+key, enc)
+}
+
+// Delete implements autocert.Cache.
+func (c *Cache) Delete(ctx context.Context, key string) error {
+	return c.store.Delete(ctx, c.prefix+key)
+}
+
+// DeleteKeys deletes multiple keys.
+func (c *Cache) DeleteKeys(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := c.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns all the keys in the cache.
+func (c *Cache) Keys(ctx context.Context) ([]string, error) {
+	keys, err := c.store.Keys(ctx, c.prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, strings.TrimPrefix(k, c.prefix))
+	}
+	return out, nil
+}
@@ -0,0 +1,453 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package certstore
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestS3Escape(t *testing.T) {
+	if got, want := s3Escape("/bucket/acme_account+key"), "/bucket/acme_account%2Bkey"; got != want {
+		t.Errorf("s3Escape() = %q, want %q", got, want)
+	}
+}
+
+func TestS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=keyid/") {
+			http.Error(w, "unauthorized", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		key, ok := strings.CutPrefix(req.URL.Path, "/bucket/")
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			if key == "" {
+				type content struct {
+					Key string
+				}
+				var result struct {
+					XMLName  xml.Name `xml:"ListBucketResult"`
+					Contents []content
+				}
+				for k := range objects {
+					if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+						result.Contents = append(result.Contents, content{k})
+					}
+				}
+				xml.NewEncoder(w).Encode(result)
+				return
+			}
+			v, ok := objects[key]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(v)
+		case http.MethodPut:
+			b, _ := io.ReadAll(req.Body)
+			objects[key] = b
+		case http.MethodDelete:
+			delete(objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewS3(srv.URL, "us-east-1", "bucket", "keyid", "secret")
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+	testStore(t, s)
+}
+
+func TestRedis(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	go fakeRedisServer(l, "password")
+
+	s := NewRedis(l.Addr().String(), "password", 0, nil)
+	defer s.Close()
+	testStore(t, s)
+
+	bad := NewRedis(l.Addr().String(), "wrong", 0, nil)
+	defer bad.Close()
+	if _, err := bad.Get(context.Background(), "foo"); err == nil {
+		t.Error("Get() with wrong password succeeded")
+	}
+}
+
+func TestSQL(t *testing.T) {
+	s, err := NewSQL(context.Background(), "certstore-fake", "", "certs")
+	if err != nil {
+		t.Fatalf("NewSQL: %v", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+
+	if _, err := NewSQL(context.Background(), "certstore-fake", "", "certs; DROP TABLE x"); err == nil {
+		t.Error("NewSQL() with invalid table name succeeded")
+	}
+	s.dollar = true
+	if got, want := s.query("INSERT INTO %s (k, v) VALUES (?, ?)"), "INSERT INTO certs (k, v) VALUES ($1, $2)"; got != want {
+		t.Errorf("query() = %q, want %q", got, want)
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{m: make(map[string][]byte)}
+	store.Put(ctx, "masterkey", []byte("not a cache entry"))
+	c := NewCache(store, "autocert/", xorEncrypter(0x55))
+
+	if _, err := c.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get() err = %v, want ErrCacheMiss", err)
+	}
+	if err := c.Put(ctx, "example.com", []byte("cert")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err := c.Put(ctx, "acme_account+key", []byte("key")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v := store.m["autocert/example.com"]; string(v) == "cert" {
+		t.Error("value isn't encrypted")
+	}
+	got, err := c.Get(ctx, "example.com")
+	if err != nil || string(got) != "cert" {
+		t.Errorf("Get() = %q, %v, want cert", got, err)
+	}
+	keys, err := c.Keys(ctx)
+	slices.Sort(keys)
+	if err != nil || !slices.Equal(keys, []string{"acme_account+key", "example.com"}) {
+		t.Errorf("Keys() = %q, %v", keys, err)
+	}
+	if err := c.DeleteKeys(ctx, keys); err != nil {
+		t.Fatalf("DeleteKeys: %v", err)
+	}
+	if keys, err := c.Keys(ctx); err != nil || len(keys) != 0 {
+		t.Errorf("Keys() = %q, %v, want none", keys, err)
+	}
+	if _, ok := store.m["masterkey"]; !ok {
+		t.Error("masterkey was deleted")
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	if _, err := s.Get(ctx, "pfx/foo"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() err = %v, want ErrNotFound", err)
+	}
+	for _, k := range []string{"pfx/foo", "pfx/acme_account+key", "pfx/*.example.com", "other"} {
+		if err := s.Put(ctx, k, []byte("value of "+k)); err != nil {
+			t.Fatalf("Put(%q): %v", k, err)
+		}
+	}
+	if err := s.Put(ctx, "pfx/foo", []byte("new value\r\n\x00")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := s.Get(ctx, "pfx/foo"); err != nil || string(got) != "new value\r\n\x00" {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+	if got, err := s.Get(ctx, "pfx/acme_account+key"); err != nil || string(got) != "value of pfx/acme_account+key" {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+	keys, err := s.Keys(ctx, "pfx/")
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	slices.Sort(keys)
+	if want := []string{"pfx/*.example.com", "pfx/acme_account+key", "pfx/foo"}; !slices.Equal(keys, want) {
+		t.Errorf("Keys() = %q, want %q", keys, want)
+	}
+	if err := s.Delete(ctx, "pfx/foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "pfx/foo"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "pfx/foo"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() err = %v, want ErrNotFound", err)
+	}
+}
+
+type memStore struct {
+	m map[string][]byte
+}
+
+func (s *memStore) Get(_ context.Context, key string) ([]byte, error) {
+	v, ok := s.m[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memStore) Put(_ context.Context, key string, data []byte) error {
+	s.m[key] = data
+	return nil
+}
+
+func (s *memStore) Delete(_ context.Context, key string) error {
+	delete(s.m, key)
+	return nil
+}
+
+func (s *memStore) Keys(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for k := range s.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+type xorEncrypter byte
+
+func (x xorEncrypter) Encrypt(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ byte(x)
+	}
+	return out, nil
+}
+
+func (x xorEncrypter) Decrypt(data []byte) ([]byte, error) {
+	return x.Encrypt(data)
+}
+
+// fakeRedisServer implements the few commands that Redis uses.
+func fakeRedisServer(l net.Listener, password string) {
+	var mu sync.Mutex
+	data := make(map[string]string)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			authenticated := false
+			for {
+				v, err := readRESP(r)
+				if err != nil {
+					return
+				}
+				arr, _ := v.([]any)
+				var args []string
+				for _, a := range arr {
+					b, _ := a.([]byte)
+					args = append(args, string(b))
+				}
+				if len(args) == 0 {
+					return
+				}
+				if args[0] == "AUTH" {
+					if args[1] != password {
+						io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+						continue
+					}
+					authenticated = true
+					io.WriteString(conn, "+OK\r\n")
+					continue
+				}
+				if !authenticated {
+					io.WriteString(conn, "-NOAUTH Authentication required\r\n")
+					continue
+				}
+				mu.Lock()
+				switch args[0] {
+				case "GET":
+					if v, ok := data[args[1]]; ok {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+					} else {
+						io.WriteString(conn, "$-1\r\n")
+					}
+				case "SET":
+					data[args[1]] = args[2]
+					io.WriteString(conn, "+OK\r\n")
+				case "DEL":
+					_, ok := data[args[1]]
+					delete(data, args[1])
+					fmt.Fprintf(conn, ":%d\r\n", map[bool]int{true: 1}[ok])
+				case "SCAN":
+					// The pattern is always an escaped prefix followed by *.
+					prefix := strings.ReplaceAll(strings.TrimSuffix(args[3], "*"), `\`, "")
+					var keys []string
+					for k := range data {
+						if strings.HasPrefix(k, prefix) {
+							keys = append(keys, k)
+						}
+					}
+					fmt.Fprintf(conn, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+					for _, k := range keys {
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(k), k)
+					}
+				default:
+					io.WriteString(conn, "-ERR unknown command\r\n")
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+}
+
+func init() {
+	sql.Register("certstore-fake", &fakeDriver{data: make(map[string]string)})
+}
+
+// fakeDriver is a database/sql driver that understands the statements used
+// by SQL.
+type fakeDriver struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{d: d}, nil
+}
+
+type fakeConn struct {
+	d *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{d: c.d, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE"):
+	case strings.HasPrefix(s.query, "DELETE"):
+		delete(s.d.data, args[0].(string))
+	case strings.HasPrefix(s.query, "INSERT"):
+		if _, exists := s.d.data[args[0].(string)]; exists {
+			return nil, errors.New("duplicate key")
+		}
+		s.d.data[args[0].(string)] = args[1].(string)
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	rows := &fakeRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT v "):
+		if v, ok := s.d.data[args[0].(string)]; ok {
+			rows.values = append(rows.values, v)
+		}
+	case strings.HasPrefix(s.query, "SELECT k "):
+		for k := range s.d.data {
+			rows.values = append(rows.values, k)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"c"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
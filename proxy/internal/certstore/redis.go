@@ -0,0 +1,273 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package certstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis is a Store that uses a Redis server. It implements just enough of the
+// RESP protocol to get, set, delete, and scan keys.
+type Redis struct {
+	addr      string
+	password  string
+	db        int
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedis returns a new Redis Store. The connection to the server is opened
+// when it is first needed. If tlsConfig is nil, the connection is not
+// encrypted.
+func NewRedis(addr, password string, db int, tlsConfig *tls.Config) *Redis {
+	return &Redis{
+		addr:      addr,
+		password:  password,
+		db:        db,
+		tlsConfig: tlsConfig,
+	}
+}
+
+// Close closes the connection to the server.
+func (r *Redis) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// Get implements Store.
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	v, err := r.do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %T", v)
+	}
+	return b, nil
+}
+
+// Put implements Store.
+func (r *Redis) Put(ctx context.Context, key string, data []byte) error {
+	_, err := r.do(ctx, "SET", key, string(data))
+	return err
+}
+
+// Delete implements Store.
+func (r *Redis) Delete(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", key)
+	return err
+}
+
+// Keys implements Store.
+func (r *Redis) Keys(ctx context.Context, prefix string) ([]string, error) {
+	pattern := redisGlobEscape(prefix) + "*"
+	var keys []string
+	cursor := "0"
+	for {
+		v, err := r.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := v.([]any)
+		if !ok || len(arr) != 2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		c, ok1 := arr[0].([]byte)
+		list, ok2 := arr[1].([]any)
+		if !ok1 || !ok2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		for _, k := range list {
+			if b, ok := k.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if cursor = string(c); cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+func (r *Redis) do(ctx context.Context, args ...string) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	v, err := r.roundTrip(ctx, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state.
+		r.conn.Close()
+		r.conn = nil
+	}
+	return v, err
+}
+
+func (r *Redis) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if r.tlsConfig != nil {
+		td := &tls.Dialer{NetDialer: dialer, Config: r.tlsConfig}
+		conn, err = td.DialContext(ctx, "tcp", r.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn = conn
+	r.r = bufio.NewReader(conn)
+	if r.password != "" {
+		if _, err := r.roundTrip(ctx, "AUTH", r.password); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	if r.db != 0 {
+		if _, err := r.roundTrip(ctx, "SELECT", strconv.Itoa(r.db)); err != nil {
+			r.conn.Close()
+			r.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redis) roundTrip(ctx context.Context, args ...string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(30 * time.Second)
+	}
+	r.conn.SetDeadline(deadline)
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(r.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(r.r)
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRESP reads one reply. Simple strings and bulk strings are returned as
+// []byte, integers as int64, arrays as []any, and null values as nil.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]any, 0, n)
+		for range n {
+			v, err := readRESP(r)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("redis: invalid reply %q", line)
+	}
+}
+
+// redisGlobEscape escapes the characters that have a special meaning in SCAN
+// patterns.
+func redisGlobEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
@@ -0,0 +1,155 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package certstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQL is a Store that uses a table in a SQL database. The values are stored
+// base64-encoded so that the same schema works with all databases.
+//
+// No database drivers are linked into tlsproxy. Programs that use the proxy
+// package can register the one they need, e.g. by importing
+// github.com/lib/pq or github.com/go-sql-driver/mysql.
+type SQL struct {
+	db    *sql.DB
+	table string
+	// dollar is true when the driver uses $1, $2, etc as placeholders,
+	// instead of ?.
+	dollar bool
+}
+
+// NewSQL opens the database and creates the table if it doesn't already
+// exist.
+func NewSQL(ctx context.Context, driver, dsn, table string) (*SQL, error) {
+	if !validTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name %q", table)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQL{
+		db:     db,
+		table:  table,
+		dollar: driver == "postgres" || driver == "pgx",
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+table+" (k VARCHAR(255) PRIMARY KEY, v TEXT NOT NULL)"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database.
+func (s *SQL) Close() error {
+	return s.db.Close()
+}
+
+// Get implements Store.
+func (s *SQL) Get(ctx context.Context, key string) ([]byte, error) {
+	var v string
+	err := s.db.QueryRowContext(ctx, s.query("SELECT v FROM %s WHERE k = ?"), key).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(v)
+}
+
+// Put implements Store. There is no portable upsert statement. So, the old
+// value is deleted and the new one is inserted in the same transaction.
+func (s *SQL) Put(ctx context.Context, key string, data []byte) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s WHERE k = ?"), key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, s.query("INSERT INTO %s (k, v) VALUES (?, ?)"), key, base64.StdEncoding.EncodeToString(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete implements Store.
+func (s *SQL) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s WHERE k = ?"), key)
+	return err
+}
+
+// Keys implements Store.
+func (s *SQL) Keys(ctx context.Context, prefix string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.query("SELECT k FROM %s"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		// The prefix is matched here to avoid having to escape the
+		// LIKE wildcards, which varies between databases.
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, rows.Err()
+}
+
+// query inserts the table name in q and rewrites the placeholders for the
+// driver.
+func (s *SQL) query(q string) string {
+	q = fmt.Sprintf(q, s.table)
+	if !s.dollar {
+		return q
+	}
+	var sb strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
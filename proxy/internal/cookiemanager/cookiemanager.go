@@ -50,6 +50,7 @@ type CookieManager struct {
 	provider string
 	domain   string
 	issuer   string
+	onLogin  func(provider, email, host string)
 }
 
 func New(tm *tokenmanager.TokenManager, provider, domain, issuer string) *CookieManager {
@@ -61,6 +62,12 @@ func New(tm *tokenmanager.TokenManager, provider, domain, issuer string) *Cookie
 	}
 }
 
+// OnLogin sets a function that is called when a user logs in, i.e. when a new
+// auth token cookie is set.
+func (cm *CookieManager) OnLogin(f func(provider, email, host string)) {
+	cm.onLogin = f
+}
+
 func (cm *CookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error {
 	if userID == "" || email == "" {
 		return errors.New("userID and email cannot be empty")
@@ -102,6 +109,9 @@ func (cm *CookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email
 		HttpOnly: true,
 	}
 	http.SetCookie(w, cookie)
+	if cm.onLogin != nil {
+		cm.onLogin(cm.provider, email, host)
+	}
 	return nil
 }
 
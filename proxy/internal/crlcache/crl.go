@@ -0,0 +1,206 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package crlcache fetches and caches Certificate Revocation Lists.
+package crlcache
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCRLAge is the maximum amount of time that a CRL is cached, even
+	// if its NextUpdate is later.
+	maxCRLAge = time.Hour
+	// retryInterval is the amount of time to wait before trying to fetch
+	// a CRL again after an error.
+	retryInterval = time.Minute
+	maxCRLSize    = 16 << 20
+)
+
+var (
+	// ErrRevoked is returned when the certificate is revoked.
+	ErrRevoked = errors.New("revoked cert")
+	// ErrUnavailable is returned when a CRL can't be fetched or parsed.
+	ErrUnavailable = errors.New("crl unavailable")
+)
+
+// New returns a new CRLCache.
+func New() *CRLCache {
+	return &CRLCache{
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		crls: make(map[string]*entry),
+	}
+}
+
+// CRLCache fetches and caches Certificate Revocation Lists from files or
+// http(s) URLs.
+type CRLCache struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	crls map[string]*entry
+}
+
+type entry struct {
+	mu      sync.Mutex
+	state   *crlState
+	expires time.Time
+}
+
+// crlState is never modified after it is created, except for the verified
+// map, which is safe for concurrent use.
+type crlState struct {
+	crl     *x509.RevocationList
+	revoked map[string]bool
+	err     error
+	// verified contains the issuers whose signatures were verified.
+	verified sync.Map
+}
+
+func (s *crlState) issuedBy(issuer *x509.Certificate) bool {
+	if !bytes.Equal(s.crl.RawIssuer, issuer.RawSubject) {
+		return false
+	}
+	key := string(issuer.Raw)
+	if v, ok := s.verified.Load(key); ok {
+		return v.(bool)
+	}
+	ok := s.crl.CheckSignatureFrom(issuer) == nil
+	s.verified.Store(key, ok)
+	return ok
+}
+
+// Check checks whether cert is revoked according to the CRLs from sources.
+// Only the CRLs issued by issuer are considered. It returns ErrRevoked if
+// cert is revoked, and an error that wraps ErrUnavailable if any of the CRLs
+// can't be fetched.
+func (c *CRLCache) Check(cert, issuer *x509.Certificate, sources []string) error {
+	var lastErr error
+	for _, src := range sources {
+		s := c.get(src)
+		if s.err != nil {
+			lastErr = s.err
+			continue
+		}
+		if !s.issuedBy(issuer) {
+			continue
+		}
+		if s.revoked[cert.SerialNumber.String()] {
+			log.Printf("BAD CRL: %q is revoked", cert.Subject.String())
+			return ErrRevoked
+		}
+	}
+	return lastErr
+}
+
+func (c *CRLCache) get(src string) *crlState {
+	c.mu.Lock()
+	e, ok := c.crls[src]
+	if !ok {
+		e = &entry{}
+		c.crls[src] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if now.Before(e.expires) {
+		return e.state
+	}
+	crl, err := c.fetch(src)
+	if err != nil {
+		log.Printf("ERR CRL %s: %v", src, err)
+		e.expires = now.Add(retryInterval)
+		// Keep using the last good CRL until it expires.
+		if e.state == nil || e.state.err != nil || now.After(e.state.crl.NextUpdate) {
+			e.state = &crlState{err: fmt.Errorf("%w: %s", ErrUnavailable, src)}
+		}
+		return e.state
+	}
+	s := &crlState{
+		crl:     crl,
+		revoked: make(map[string]bool, len(crl.RevokedCertificateEntries)),
+	}
+	for _, r := range crl.RevokedCertificateEntries {
+		s.revoked[r.SerialNumber.String()] = true
+	}
+	e.state = s
+	e.expires = now.Add(maxCRLAge)
+	if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(e.expires) {
+		e.expires = crl.NextUpdate
+	}
+	return s
+}
+
+func (c *CRLCache) fetch(src string) (*x509.RevocationList, error) {
+	var b []byte
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		req, err := http.NewRequest(http.MethodGet, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("user-agent", "tlsproxy")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		if b, err = io.ReadAll(io.LimitReader(resp.Body, maxCRLSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if b, err = os.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+	if block, _ := pem.Decode(b); block != nil && block.Type == "X509 CRL" {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, err
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return nil, errors.New("crl is expired")
+	}
+	return crl, nil
+}
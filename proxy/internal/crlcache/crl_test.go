@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package crlcache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	templ := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, templ, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return &testCA{key: key, cert: cert}
+}
+
+func (ca *testCA) issue(t *testing.T, sn int64) *x509.Certificate {
+	t.Helper()
+	templ := &x509.Certificate{
+		SerialNumber: big.NewInt(sn),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, ca.cert, ca.key.Public(), ca.key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, revoked ...int64) []byte {
+	t.Helper()
+	templ := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, sn := range revoked {
+		templ.RevokedCertificateEntries = append(templ.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(sn),
+			RevocationTime: time.Now(),
+		})
+	}
+	raw, err := x509.CreateRevocationList(rand.Reader, templ, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("x509.CreateRevocationList: %v", err)
+	}
+	return raw
+}
+
+func TestCheck(t *testing.T) {
+	ca := newTestCA(t, "CA")
+	otherCA := newTestCA(t, "Other CA")
+
+	dir := t.TempDir()
+	pemFile := filepath.Join(dir, "crl.pem")
+	if err := os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: ca.crl(t, 2)}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	otherFile := filepath.Join(dir, "other.crl")
+	if err := os.WriteFile(otherFile, otherCA.crl(t, 3), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	derCRL := ca.crl(t, 3)
+	var fetches int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches++
+		w.Write(derCRL)
+	}))
+	defer srv.Close()
+
+	c := New()
+	for _, tc := range []struct {
+		name    string
+		sn      int64
+		sources []string
+		want    error
+	}{
+		{"good", 1, []string{pemFile, srv.URL}, nil},
+		{"revoked in file", 2, []string{pemFile, srv.URL}, ErrRevoked},
+		{"revoked in url", 3, []string{pemFile, srv.URL}, ErrRevoked},
+		{"other issuer", 3, []string{pemFile, otherFile}, nil},
+		{"missing file", 1, []string{filepath.Join(dir, "missing")}, ErrUnavailable},
+		{"revoked with missing file", 2, []string{filepath.Join(dir, "missing"), pemFile}, ErrRevoked},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := c.Check(ca.issue(t, tc.sn), ca.cert, tc.sources); !errors.Is(err, tc.want) {
+				t.Errorf("Check() = %v, want %v", err, tc.want)
+			}
+		})
+	}
+	if fetches != 1 {
+		t.Errorf("CRL was fetched %d times, want 1", fetches)
+	}
+}
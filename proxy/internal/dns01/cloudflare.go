@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+var _ Provider = (*Cloudflare)(nil)
+
+// Cloudflare is a Provider that uses the Cloudflare API.
+// https://developers.cloudflare.com/api/operations/dns-records-for-a-zone-create-dns-record
+type Cloudflare struct {
+	// APIToken is an API token with the Zone.DNS edit permission.
+	APIToken string
+	// ZoneID is the ID of the zone that contains the records.
+	ZoneID string
+	// BaseURL is the URL of the API. The default is the public API.
+	BaseURL string
+	// Client is the HTTP client to use. The default is a client with a
+	// 30 second timeout.
+	Client *http.Client
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+type cloudflareResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result json.RawMessage `json:"result"`
+}
+
+func (cf *Cloudflare) Present(ctx context.Context, fqdn string, values []string) error {
+	for _, v := range values {
+		rec := cloudflareRecord{
+			Type:    "TXT",
+			Name:    strings.TrimSuffix(fqdn, "."),
+			Content: v,
+			TTL:     120,
+		}
+		if err := cf.call(ctx, http.MethodPost, "/dns_records", rec, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf *Cloudflare) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	var records []cloudflareRecord
+	q := url.Values{}
+	q.Set("type", "TXT")
+	q.Set("name", strings.TrimSuffix(fqdn, "."))
+	if err := cf.call(ctx, http.MethodGet, "/dns_records?"+q.Encode(), nil, &records); err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if !slices.Contains(values, strings.Trim(rec.Content, `"`)) {
+			continue
+		}
+		if err := cf.call(ctx, http.MethodDelete, "/dns_records/"+url.PathEscape(rec.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cf *Cloudflare) call(ctx context.Context, method, path string, in, out any) error {
+	base := cf.BaseURL
+	if base == "" {
+		base = cloudflareAPI
+	}
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, base+"/zones/"+url.PathEscape(cf.ZoneID)+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cf.APIToken)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := cf.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var r cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("cloudflare: %s: %w", resp.Status, err)
+	}
+	if !r.Success {
+		var msgs []string
+		for _, e := range r.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("cloudflare: %s: %s", resp.Status, strings.Join(msgs, ", "))
+	}
+	if out != nil {
+		return json.Unmarshal(r.Result, out)
+	}
+	return nil
+}
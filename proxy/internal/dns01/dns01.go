@@ -0,0 +1,487 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package dns01 obtains certificates from an ACME server using the dns-01
+// challenge. Unlike the http-01 and tls-alpn-01 challenges, dns-01 can be
+// used to get wildcard certificates.
+//
+// See https://letsencrypt.org/docs/challenge-types/#dns-01-challenge
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	// accountKey is the same key that autocert uses for its account so
+	// that all the certificates are issued to the same ACME account.
+	accountKey   = "acme_account+key"
+	certKeyPfx   = "dns01+"
+	renewBefore  = 30 * 24 * time.Hour
+	renewalCheck = time.Hour
+	issueTimeout = 10 * time.Minute
+	defaultDelay = 30 * time.Second
+)
+
+var errNotCovered = errors.New("server name not covered by dns-01")
+
+// Provider is the interface implemented by DNS providers. Present must
+// create TXT records with the given values, and CleanUp must delete them.
+// fqdn is fully qualified, i.e. it ends with a dot.
+type Provider interface {
+	Present(ctx context.Context, fqdn string, values []string) error
+	CleanUp(ctx context.Context, fqdn string, values []string) error
+}
+
+// Domain is a domain for which certificates are obtained with the dns-01
+// challenge. The certificate for a domain covers the domain itself and all
+// its direct subdomains, e.g. example.com and *.example.com.
+type Domain struct {
+	Name             string
+	Provider         Provider
+	PropagationDelay time.Duration
+}
+
+// Manager obtains and renews certificates using the dns-01 challenge.
+type Manager struct {
+	cache autocert.Cache
+	email string
+
+	mu           sync.Mutex
+	directoryURL string
+	eab          *acme.ExternalAccountBinding
+	httpClient   *http.Client
+	client       *acme.Client
+	domains      map[string]*domainState
+}
+
+type domainState struct {
+	Domain
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+	// issuing is closed when the certificate that is being obtained in
+	// the background, if any, is ready or when issuance failed with err.
+	issuing chan struct{}
+	err     error
+}
+
+// New returns a new Manager. Account keys and certificates are stored in
+// cache.
+func New(cache autocert.Cache, directoryURL, email string) *Manager {
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+	return &Manager{
+		cache:        cache,
+		directoryURL: directoryURL,
+		email:        email,
+		domains:      make(map[string]*domainState),
+	}
+}
+
+// SetAccount sets the ACME directory URL, the optional External Account
+// Binding, and the optional HTTP client used to talk to the ACME server. The
+// next request uses a new ACME client, e.g. after the account key was rotated.
+func (m *Manager) SetAccount(directoryURL string, eab *acme.ExternalAccountBinding, httpClient *http.Client) {
+	if directoryURL == "" {
+		directoryURL = autocert.DefaultACMEDirectory
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.directoryURL = directoryURL
+	m.eab = eab
+	m.httpClient = httpClient
+	m.client = nil
+}
+
+// SetDomains sets the list of domains managed by m. Certificates that were
+// already obtained for the domains are kept.
+func (m *Manager) SetDomains(domains []Domain) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	newDomains := make(map[string]*domainState, len(domains))
+	for _, d := range domains {
+		if d.PropagationDelay == 0 {
+			d.PropagationDelay = defaultDelay
+		}
+		ds, ok := m.domains[d.Name]
+		if !ok {
+			ds = &domainState{}
+		}
+		ds.mu.Lock()
+		ds.Domain = d
+		ds.mu.Unlock()
+		newDomains[d.Name] = ds
+	}
+	m.domains = newDomains
+}
+
+// Covers returns true if the certificate for serverName is obtained by m.
+func (m *Manager) Covers(serverName string) bool {
+	return m.domain(serverName) != nil
+}
+
+func (m *Manager) domain(serverName string) *domainState {
+	serverName = strings.TrimSuffix(strings.ToLower(serverName), ".")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if d, ok := m.domains[serverName]; ok {
+		return d
+	}
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		return m.domains[parent]
+	}
+	return nil
+}
+
+// GetCertificate returns the certificate for hello.ServerName, obtaining
+// a new one from the ACME server if necessary.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	d := m.domain(hello.ServerName)
+	if d == nil {
+		return nil, errNotCovered
+	}
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return m.cert(ctx, d, 0)
+}
+
+// RenewalLoop obtains missing certificates and renews the ones that are
+// about to expire, until ctx is canceled.
+func (m *Manager) RenewalLoop(ctx context.Context) {
+	for {
+		m.mu.Lock()
+		domains := make([]*domainState, 0, len(m.domains))
+		for _, d := range m.domains {
+			domains = append(domains, d)
+		}
+		m.mu.Unlock()
+
+		for _, d := range domains {
+			if _, err := m.cert(ctx, d, renewBefore); err != nil && ctx.Err() == nil {
+				log.Printf("ERR dns01 %s: %v", d.Name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(renewalCheck):
+		}
+	}
+}
+
+// cert returns the certificate of domain d. A new certificate is obtained
+// if there is none, or if the current one expires within minValidity.
+// Only one certificate is obtained at a time for each domain, in the
+// background, and d.mu isn't held while that happens so that the current
+// certificate can still be served.
+func (m *Manager) cert(ctx context.Context, d *domainState, minValidity time.Duration) (*tls.Certificate, error) {
+	deadline := time.Now().Add(minValidity)
+	d.mu.Lock()
+	if d.cert != nil && d.cert.Leaf.NotAfter.After(deadline) {
+		defer d.mu.Unlock()
+		return d.cert, nil
+	}
+	if d.issuing == nil {
+		d.issuing = make(chan struct{})
+		go m.issue(d, d.Domain, deadline, d.issuing)
+	}
+	done := d.issuing
+	d.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		// Keep using the current certificate until it expires.
+		if d.cert != nil && d.cert.Leaf.NotAfter.After(time.Now()) {
+			log.Printf("ERR dns01 %s: renewal failed: %v", d.Name, d.err)
+			return d.cert, nil
+		}
+		return nil, d.err
+	}
+	return d.cert, nil
+}
+
+// issue loads the certificate of domain d from the cache, or obtains a new
+// one if the cached certificate expires before deadline. It closes done
+// when the result is stored in d.
+func (m *Manager) issue(d *domainState, dom Domain, deadline time.Time, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), issueTimeout)
+	defer cancel()
+
+	cert, err := m.load(ctx, dom.Name)
+	if err == nil && !cert.Leaf.NotAfter.After(deadline) {
+		cert, err = nil, autocert.ErrCacheMiss
+	} else if err != nil && !errors.Is(err, autocert.ErrCacheMiss) {
+		log.Printf("ERR dns01 %s: %v", dom.Name, err)
+	}
+	if err != nil {
+		cert, err = m.obtain(ctx, dom)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		d.cert = cert
+	}
+	d.err = err
+	d.issuing = nil
+	close(done)
+}
+
+func (m *Manager) load(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := m.cache.Get(ctx, certKeyPfx+name)
+	if err != nil {
+		return nil, err
+	}
+	var cert tls.Certificate
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		switch b.Type {
+		case "EC PRIVATE KEY":
+			if cert.PrivateKey, err = x509.ParseECPrivateKey(b.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			cert.Certificate = append(cert.Certificate, b.Bytes)
+		}
+	}
+	if cert.PrivateKey == nil || len(cert.Certificate) == 0 {
+		return nil, errors.New("invalid cached certificate")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (m *Manager) obtain(ctx context.Context, d Domain) (*tls.Certificate, error) {
+	log.Printf("INF dns01: requesting certificate for %s", d.Name)
+	client, err := m.acmeClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{d.Name, "*." + d.Name}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string][]string)
+	var challenges []*acme.Challenge
+	var authzURLs []string
+	for _, u := range order.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return nil, fmt.Errorf("%s: no dns-01 challenge offered", z.Identifier.Value)
+		}
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		fqdn := "_acme-challenge." + z.Identifier.Value + "."
+		records[fqdn] = append(records[fqdn], value)
+		challenges = append(challenges, chal)
+		authzURLs = append(authzURLs, z.URI)
+	}
+
+	for fqdn, values := range records {
+		defer func() {
+			// Use a fresh context so that records get removed even
+			// when ctx is canceled.
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			if err := d.Provider.CleanUp(ctx, fqdn, values); err != nil {
+				log.Printf("ERR dns01 CleanUp %s: %v", fqdn, err)
+			}
+		}()
+		if err := d.Provider.Present(ctx, fqdn, values); err != nil {
+			return nil, fmt.Errorf("%s: %w", fqdn, err)
+		}
+	}
+	if len(records) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d.PropagationDelay):
+		}
+	}
+	for _, chal := range challenges {
+		if _, err := client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range authzURLs {
+		if _, err := client.WaitAuthorization(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+	for _, b := range der {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+	if err := m.cache.Put(ctx, certKeyPfx+d.Name, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	log.Printf("INF dns01: got certificate for %s, expires %s", d.Name, leaf.NotAfter.Format(time.DateOnly))
+	return &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func (m *Manager) acmeClient(ctx context.Context) (*acme.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client != nil {
+		return m.client, nil
+	}
+	key, err := m.accountKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: m.directoryURL,
+		HTTPClient:   m.httpClient,
+		UserAgent:    "tlsproxy",
+	}
+	var contact []string
+	if m.email != "" {
+		contact = []string{"mailto:" + m.email}
+	}
+	if _, err := client.Register(ctx, &acme.Account{Contact: contact, ExternalAccountBinding: m.eab}, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+	m.client = client
+	return client, nil
+}
+
+func (m *Manager) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := m.cache.Get(ctx, accountKey)
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.cache.Put(ctx, accountKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, _ := pem.Decode(data)
+	if b == nil {
+		return nil, errors.New("invalid account key")
+	}
+	switch b.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(b.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := key.(crypto.Signer); ok {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected account key type %q", b.Type)
+}
@@ -0,0 +1,384 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCovers(t *testing.T) {
+	m := New(nil, "", "")
+	m.SetDomains([]Domain{
+		{Name: "example.com"},
+		{Name: "sub.example.org"},
+	})
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"WWW.Example.COM.", true},
+		{"a.b.example.com", false},
+		{"example.org", false},
+		{"sub.example.org", true},
+		{"foo.sub.example.org", true},
+		{"com", false},
+	} {
+		if got := m.Covers(tc.name); got != tc.want {
+			t.Errorf("Covers(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// blockingCache is an autocert.Cache whose Get blocks until a value is sent
+// on its channel.
+type blockingCache chan []byte
+
+func (c blockingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case b := <-c:
+		return b, nil
+	}
+}
+
+func (blockingCache) Put(context.Context, string, []byte) error { return nil }
+func (blockingCache) Delete(context.Context, string) error      { return nil }
+
+func newTestCert(t *testing.T, notAfter time.Time) (*tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.com", "*.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey: %v", err)
+	}
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pemData
+}
+
+func TestRenewalDoesNotBlock(t *testing.T) {
+	cache := make(blockingCache)
+	m := New(cache, "", "")
+	m.SetDomains([]Domain{{Name: "example.com"}})
+	d := m.domain("example.com")
+	oldCert, _ := newTestCert(t, time.Now().Add(24*time.Hour))
+	d.cert = oldCert
+	newCert, newPEM := newTestCert(t, time.Now().Add(90*24*time.Hour))
+
+	ch := make(chan *tls.Certificate)
+	for range 2 {
+		go func() {
+			cert, err := m.cert(context.Background(), d, renewBefore)
+			if err != nil {
+				t.Errorf("cert: %v", err)
+			}
+			ch <- cert
+		}()
+	}
+
+	// The current certificate is served while the renewal is blocked.
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if err != nil || cert != oldCert {
+		t.Fatalf("GetCertificate = %v, %v, want old cert", cert, err)
+	}
+
+	// Only one renewal happens for both callers.
+	cache <- newPEM
+	for range 2 {
+		if cert := <-ch; cert == nil || !bytes.Equal(cert.Certificate[0], newCert.Certificate[0]) {
+			t.Errorf("renewed cert = %v, want new cert", cert)
+		}
+	}
+	if cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"}); err != nil || !bytes.Equal(cert.Certificate[0], newCert.Certificate[0]) {
+		t.Errorf("GetCertificate = %v, %v, want new cert", cert, err)
+	}
+}
+
+func TestCloudflare(t *testing.T) {
+	var mu sync.Mutex
+	records := make(map[string]cloudflareRecord)
+	nextID := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zones/ZONE/dns_records", func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.Header.Get("Authorization"), "Bearer TOKEN"; got != want {
+			t.Errorf("Authorization = %q, want %q", got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Method {
+		case http.MethodPost:
+			var rec cloudflareRecord
+			if err := json.NewDecoder(req.Body).Decode(&rec); err != nil {
+				t.Errorf("Decode: %v", err)
+			}
+			nextID++
+			rec.ID = string(rune('a' + nextID))
+			records[rec.ID] = rec
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "result": rec})
+		case http.MethodGet:
+			var out []cloudflareRecord
+			for _, rec := range records {
+				if rec.Name == req.URL.Query().Get("name") {
+					rec.Content = `"` + rec.Content + `"`
+					out = append(out, rec)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]any{"success": true, "result": out})
+		}
+	})
+	mux.HandleFunc("DELETE /zones/ZONE/dns_records/{id}", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(records, req.PathValue("id"))
+		json.NewEncoder(w).Encode(map[string]any{"success": true})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cf := &Cloudflare{APIToken: "TOKEN", ZoneID: "ZONE", BaseURL: srv.URL}
+	ctx := context.Background()
+	if err := cf.Present(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if err := cf.Present(ctx, "_acme-challenge.example.org.", []string{"baz"}); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("len(records) = %d, want %d", got, want)
+	}
+	if err := cf.CleanUp(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got, want := len(records), 1; got != want {
+		t.Fatalf("len(records) = %d, want %d", got, want)
+	}
+	for _, rec := range records {
+		if rec.Name != "_acme-challenge.example.org" || rec.Content != "baz" || rec.Type != "TXT" {
+			t.Errorf("Unexpected record: %#v", rec)
+		}
+	}
+
+	cf.APIToken = "WRONG"
+	mux.HandleFunc("/zones/ZONE2/dns_records", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"success":false,"errors":[{"code":9109,"message":"Invalid access token"}]}`)
+	})
+	cf.ZoneID = "ZONE2"
+	if err := cf.Present(ctx, "_acme-challenge.example.com.", []string{"foo"}); err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("Present() = %v, want Invalid access token", err)
+	}
+}
+
+func TestRoute53(t *testing.T) {
+	var got []route53Change
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != "/2013-04-01/hostedzone/Z123/rrset" {
+			t.Errorf("Unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+		if auth := req.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=KEYID/") {
+			t.Errorf("Authorization = %q", auth)
+		}
+		var r route53ChangeRequest
+		if err := xml.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		got = append(got, r.Changes...)
+		io.WriteString(w, "<ChangeResourceRecordSetsResponse/>")
+	}))
+	defer srv.Close()
+
+	r := &Route53{
+		AccessKeyID:     "KEYID",
+		SecretAccessKey: "SECRET",
+		HostedZoneID:    "/hostedzone/Z123",
+		BaseURL:         srv.URL,
+	}
+	ctx := context.Background()
+	if err := r.Present(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if err := r.CleanUp(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	want := []route53Change{
+		{Action: "UPSERT", Name: "_acme-challenge.example.com.", Type: "TXT", TTL: 60, Values: []string{`"foo"`, `"bar"`}},
+		{Action: "DELETE", Name: "_acme-challenge.example.com.", Type: "TXT", TTL: 60, Values: []string{`"foo"`, `"bar"`}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v, want %#v", got, want)
+	}
+}
+
+func TestRFC2136(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	type update struct {
+		class  dnsmessage.Class
+		values []string
+	}
+	ch := make(chan update, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var sz [2]byte
+			io.ReadFull(conn, sz[:])
+			msg := make([]byte, binary.BigEndian.Uint16(sz[:]))
+			io.ReadFull(conn, msg)
+
+			var p dnsmessage.Parser
+			h, err := p.Start(msg)
+			if err != nil {
+				t.Errorf("Start: %v", err)
+			}
+			if h.OpCode != dnsOpCodeUpdate {
+				t.Errorf("OpCode = %d", h.OpCode)
+			}
+			q, _ := p.AllQuestions()
+			if len(q) != 1 || q[0].Name.String() != "example.com." || q[0].Type != dnsmessage.TypeSOA {
+				t.Errorf("Zone = %v", q)
+			}
+			p.SkipAllAnswers()
+			var u update
+			for {
+				rh, err := p.AuthorityHeader()
+				if err == dnsmessage.ErrSectionDone {
+					break
+				}
+				if rh.Name.String() != "_acme-challenge.example.com." {
+					t.Errorf("Name = %v", rh.Name)
+				}
+				txt, err := p.TXTResource()
+				if err != nil {
+					t.Errorf("TXTResource: %v", err)
+				}
+				u.class = rh.Class
+				u.values = append(u.values, txt.TXT...)
+			}
+			// The TSIG record is the last one. Verify the MAC.
+			add, err := p.AllAdditionals()
+			if err != nil || len(add) != 1 || add[0].Header.Type != dnsTypeTSIG {
+				t.Errorf("Additionals = %v, %v", add, err)
+			}
+			rdata := add[0].Body.(*dnsmessage.UnknownResource).Data
+			algo := rdata[:len("\x0bhmac-sha256\x00")]
+			macSize := binary.BigEndian.Uint16(rdata[len(algo)+8:])
+			gotMAC := rdata[len(algo)+10 : len(algo)+10+int(macSize)]
+
+			keyName, _ := wireName("key.example.com.")
+			tsigStart := len(msg) - (len(keyName) + 10 + len(rdata))
+			unsigned := append([]byte(nil), msg[:tsigStart]...)
+			binary.BigEndian.PutUint16(unsigned[10:], 0)
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(unsigned)
+			mac.Write(keyName)
+			mac.Write([]byte{0, 255, 0, 0, 0, 0})
+			mac.Write(algo)
+			mac.Write(rdata[len(algo) : len(algo)+8])
+			mac.Write([]byte{0, 0, 0, 0})
+			if !hmac.Equal(mac.Sum(nil), gotMAC) {
+				t.Error("TSIG MAC mismatch")
+			}
+			ch <- u
+
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, OpCode: dnsOpCodeUpdate})
+			resp, _ := b.Finish()
+			conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(resp))))
+			conn.Write(resp)
+			conn.Close()
+		}
+	}()
+
+	r := &RFC2136{
+		Nameserver:    l.Addr().String(),
+		Zone:          "example.com",
+		TSIGKeyName:   "key.example.com",
+		TSIGSecret:    secret,
+		TSIGAlgorithm: "hmac-sha256",
+	}
+	ctx := context.Background()
+	if err := r.Present(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("Present: %v", err)
+	}
+	if got, want := <-ch, (update{dnsmessage.ClassINET, []string{"foo", "bar"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Present: got %v, want %v", got, want)
+	}
+	if err := r.CleanUp(ctx, "_acme-challenge.example.com.", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if got, want := <-ch, (update{dnsClassNone, []string{"foo", "bar"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("CleanUp: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,255 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package dns01
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsOpCodeUpdate = 5
+	dnsTypeTSIG     = dnsmessage.Type(250)
+	dnsClassNone    = dnsmessage.Class(254)
+	dnsClassAny     = dnsmessage.Class(255)
+	tsigFudge       = 300
+)
+
+var _ Provider = (*RFC2136)(nil)
+
+// TSIGAlgorithms are the supported TSIG algorithms.
+var TSIGAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+// RFC2136 is a Provider that uses DNS UPDATE messages authenticated with
+// TSIG.
+// https://datatracker.ietf.org/doc/html/rfc2136
+// https://datatracker.ietf.org/doc/html/rfc8945
+type RFC2136 struct {
+	// Nameserver is the address of the primary name server, host:port.
+	Nameserver string
+	// Zone is the name of the zone that contains the records.
+	Zone string
+	// TSIGKeyName is the name of the TSIG key.
+	TSIGKeyName string
+	// TSIGSecret is the TSIG key.
+	TSIGSecret []byte
+	// TSIGAlgorithm is the name of the TSIG algorithm, e.g. hmac-sha256.
+	TSIGAlgorithm string
+}
+
+func (r *RFC2136) Present(ctx context.Context, fqdn string, values []string) error {
+	return r.update(ctx, fqdn, values, dnsmessage.ClassINET, 60)
+}
+
+func (r *RFC2136) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	// Class NONE deletes the RRs that match the rdata.
+	// https://datatracker.ietf.org/doc/html/rfc2136#section-2.5.4
+	return r.update(ctx, fqdn, values, dnsClassNone, 0)
+}
+
+func (r *RFC2136) update(ctx context.Context, fqdn string, values []string, class dnsmessage.Class, ttl uint32) error {
+	msg, id, err := r.buildUpdate(fqdn, values, class, ttl)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", r.Nameserver)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(msg)))); err != nil {
+		return err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var sz [2]byte
+	if _, err := io.ReadFull(conn, sz[:]); err != nil {
+		return err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(sz[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return err
+	}
+	if h.ID != id {
+		return errors.New("rfc2136: unexpected response id")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rfc2136: update failed: %v", h.RCode)
+	}
+	return nil
+}
+
+func (r *RFC2136) buildUpdate(fqdn string, values []string, class dnsmessage.Class, ttl uint32) ([]byte, uint16, error) {
+	zone, err := dnsmessage.NewName(fqdnOf(r.Zone))
+	if err != nil {
+		return nil, 0, err
+	}
+	name, err := dnsmessage.NewName(fqdnOf(fqdn))
+	if err != nil {
+		return nil, 0, err
+	}
+	var idb [2]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idb[:])
+
+	// The sections of an UPDATE message are named Zone, Prerequisite,
+	// Update, and Additional. They map to Question, Answer, Authority, and
+	// Additional.
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: dnsOpCodeUpdate})
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: zone, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return nil, 0, err
+	}
+	for _, v := range values {
+		hdr := dnsmessage.ResourceHeader{Name: name, Class: class, TTL: ttl}
+		if err := b.TXTResource(hdr, dnsmessage.TXTResource{TXT: []string{v}}); err != nil {
+			return nil, 0, err
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.TSIGKeyName == "" {
+		return msg, id, nil
+	}
+	msg, err = r.sign(msg, id, time.Now())
+	return msg, id, err
+}
+
+// sign appends a TSIG record to msg.
+// https://datatracker.ietf.org/doc/html/rfc8945#section-4.3
+func (r *RFC2136) sign(msg []byte, id uint16, now time.Time) ([]byte, error) {
+	algo := fqdnOf(strings.ToLower(r.TSIGAlgorithm))
+	if algo == "." {
+		algo = "hmac-sha256."
+	}
+	newHash, ok := TSIGAlgorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %q", r.TSIGAlgorithm)
+	}
+	keyName, err := wireName(strings.ToLower(fqdnOf(r.TSIGKeyName)))
+	if err != nil {
+		return nil, err
+	}
+	algoName, err := wireName(algo)
+	if err != nil {
+		return nil, err
+	}
+	timeSigned := uint64(now.Unix())
+	timeBytes := []byte{
+		byte(timeSigned >> 40), byte(timeSigned >> 32), byte(timeSigned >> 24),
+		byte(timeSigned >> 16), byte(timeSigned >> 8), byte(timeSigned),
+	}
+
+	mac := hmac.New(newHash, r.TSIGSecret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write(binary.BigEndian.AppendUint16(nil, uint16(dnsClassAny)))
+	mac.Write(binary.BigEndian.AppendUint32(nil, 0)) // TTL
+	mac.Write(algoName)
+	mac.Write(timeBytes)
+	mac.Write(binary.BigEndian.AppendUint16(nil, tsigFudge))
+	mac.Write(binary.BigEndian.AppendUint16(nil, 0)) // Error
+	mac.Write(binary.BigEndian.AppendUint16(nil, 0)) // Other Len
+	sum := mac.Sum(nil)
+
+	var rdata []byte
+	rdata = append(rdata, algoName...)
+	rdata = append(rdata, timeBytes...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Error
+	rdata = binary.BigEndian.AppendUint16(rdata, 0) // Other Len
+
+	out := append([]byte(nil), msg...)
+	out = append(out, keyName...)
+	out = binary.BigEndian.AppendUint16(out, uint16(dnsTypeTSIG))
+	out = binary.BigEndian.AppendUint16(out, uint16(dnsClassAny))
+	out = binary.BigEndian.AppendUint32(out, 0)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(rdata)))
+	out = append(out, rdata...)
+	// Increment ARCOUNT.
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(out[10:])+1)
+	return out, nil
+}
+
+func fqdnOf(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// wireName returns the uncompressed wire format of name.
+func wireName(name string) ([]byte, error) {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		out = append(out, byte(len(label)))
+		out = append(out, label...)
+	}
+	return append(out, 0), nil
+}
@@ -0,0 +1,137 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package dns01
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/awssig"
+)
+
+const (
+	route53API     = "https://route53.amazonaws.com"
+	route53Region  = "us-east-1"
+	route53Service = "route53"
+)
+
+var _ Provider = (*Route53)(nil)
+
+// Route53 is a Provider that uses the AWS Route 53 API.
+// https://docs.aws.amazon.com/Route53/latest/APIReference/API_ChangeResourceRecordSets.html
+type Route53 struct {
+	// AccessKeyID and SecretAccessKey are the AWS credentials. They need
+	// the route53:ChangeResourceRecordSets permission on the hosted zone.
+	AccessKeyID     string
+	SecretAccessKey string
+	// HostedZoneID is the ID of the hosted zone that contains the records.
+	HostedZoneID string
+	// BaseURL is the URL of the API. The default is the public API.
+	BaseURL string
+	// Client is the HTTP client to use. The default is a client with a
+	// 30 second timeout.
+	Client *http.Client
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Change struct {
+	Action string   `xml:"Action"`
+	Name   string   `xml:"ResourceRecordSet>Name"`
+	Type   string   `xml:"ResourceRecordSet>Type"`
+	TTL    int      `xml:"ResourceRecordSet>TTL"`
+	Values []string `xml:"ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (r *Route53) Present(ctx context.Context, fqdn string, values []string) error {
+	return r.change(ctx, "UPSERT", fqdn, values)
+}
+
+func (r *Route53) CleanUp(ctx context.Context, fqdn string, values []string) error {
+	return r.change(ctx, "DELETE", fqdn, values)
+}
+
+func (r *Route53) change(ctx context.Context, action, fqdn string, values []string) error {
+	change := route53Change{
+		Action: action,
+		Name:   fqdn,
+		Type:   "TXT",
+		TTL:    60,
+	}
+	for _, v := range values {
+		change.Values = append(change.Values, strconv.Quote(v))
+	}
+	body, err := xml.Marshal(route53ChangeRequest{Changes: []route53Change{change}})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+
+	base := r.BaseURL
+	if base == "" {
+		base = route53API
+	}
+	zone := strings.TrimPrefix(r.HostedZoneID, "/hostedzone/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/2013-04-01/hostedzone/"+url.PathEscape(zone)+"/rrset", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	awssig.Sign(req, body, r.AccessKeyID, r.SecretAccessKey, route53Region, route53Service, time.Now())
+
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var e route53Error
+	if err := xml.Unmarshal(respBody, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("route53: %s", resp.Status)
+	}
+	return fmt.Errorf("route53: %s: %s: %s", resp.Status, e.Code, e.Message)
+}
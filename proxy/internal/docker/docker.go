@@ -0,0 +1,209 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package docker implements a minimal client for the Docker Engine API, enough
+// to discover running containers and to watch for container events.
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultEndpoint is the default address of the Docker API.
+const DefaultEndpoint = "unix:///var/run/docker.sock"
+
+// Client is a Docker API client.
+type Client struct {
+	baseURL string
+	client  *http.Client
+}
+
+// Container is a running container.
+type Container struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+	// Networks maps network names to the container's IP address on that
+	// network.
+	Networks map[string]string
+	// Ports are the TCP ports exposed by the container.
+	Ports []int
+}
+
+// New returns a new Client for the Docker API at endpoint, e.g.
+// unix:///var/run/docker.sock or tcp://127.0.0.1:2375.
+func New(endpoint string) (*Client, error) {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		c.baseURL = "http://docker"
+		c.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		}
+	case "tcp", "http":
+		c.baseURL = "http://" + u.Host
+		c.client = &http.Client{}
+	default:
+		return nil, fmt.Errorf("unsupported endpoint %q", endpoint)
+	}
+	return c, nil
+}
+
+// Containers returns the running containers that have the label.
+func (c *Client) Containers(ctx context.Context, label string) ([]Container, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	resp, err := c.get(ctx, "/containers/json", url.Values{
+		"filters": {filters(map[string][]string{"label": {label}})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list []struct {
+		ID              string            `json:"Id"`
+		Names           []string          `json:"Names"`
+		Labels          map[string]string `json:"Labels"`
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+		Ports []struct {
+			PrivatePort int    `json:"PrivatePort"`
+			Type        string `json:"Type"`
+		} `json:"Ports"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	out := make([]Container, 0, len(list))
+	for _, e := range list {
+		ct := Container{
+			ID:       e.ID,
+			Labels:   e.Labels,
+			Networks: make(map[string]string),
+		}
+		if len(e.Names) > 0 {
+			ct.Name = strings.TrimPrefix(e.Names[0], "/")
+		}
+		for name, n := range e.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				ct.Networks[name] = n.IPAddress
+			}
+		}
+		seen := make(map[int]bool)
+		for _, p := range e.Ports {
+			if p.Type == "tcp" && !seen[p.PrivatePort] {
+				seen[p.PrivatePort] = true
+				ct.Ports = append(ct.Ports, p.PrivatePort)
+			}
+		}
+		out = append(out, ct)
+	}
+	return out, nil
+}
+
+// WaitForEvent waits for a container with the label to change state, e.g.
+// start or stop. It returns true when that happens, and false when ctx is
+// canceled or the deadline is reached.
+func (c *Client) WaitForEvent(ctx context.Context, label string, deadline time.Time) (bool, error) {
+	now := time.Now()
+	if !deadline.After(now) {
+		return false, nil
+	}
+	resp, err := c.get(ctx, "/events", url.Values{
+		"since": {strconv.FormatInt(now.Unix(), 10)},
+		"until": {strconv.FormatInt(deadline.Unix(), 10)},
+		"filters": {filters(map[string][]string{
+			"type":  {"container"},
+			"event": {"start", "die", "stop", "kill", "pause", "unpause", "destroy", "update", "rename"},
+			"label": {label},
+		})},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// The API server closes the stream at the deadline.
+	if _, err := bufio.NewReader(resp.Body).ReadByte(); err != nil {
+		if err == io.EOF || ctx.Err() != nil {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&e)
+		resp.Body.Close()
+		if e.Message == "" {
+			e.Message = resp.Status
+		}
+		return nil, errors.New(e.Message)
+	}
+	return resp, nil
+}
+
+func filters(f map[string][]string) string {
+	b, _ := json.Marshal(f)
+	return string(b)
+}
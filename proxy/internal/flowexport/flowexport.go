@@ -0,0 +1,284 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package flowexport sends flow records, one per connection, to a collector
+// in IPFIX (RFC 7011) or JSON format, e.g. for network accounting.
+package flowexport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// FormatJSON sends one JSON object per line, or per datagram with
+	// udp.
+	FormatJSON = "json"
+	// FormatIPFIX sends IPFIX messages.
+	FormatIPFIX = "ipfix"
+
+	defaultQueueSize = 1024
+	maxBatchSize     = 100
+	dialTimeout      = 5 * time.Second
+	writeTimeout     = 5 * time.Second
+)
+
+// Record is a flow record. It describes one connection.
+type Record struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Protocol is tcp or udp.
+	Protocol string         `json:"protocol"`
+	Src      netip.AddrPort `json:"src"`
+	Dst      netip.AddrPort `json:"dst"`
+	// BackendAddr is the address of the backend, if any.
+	BackendAddr string `json:"backendAddr,omitempty"`
+	ServerName  string `json:"serverName,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	// Subject is the subject of the client certificate, if any.
+	Subject string `json:"subject,omitempty"`
+	// BytesReceived is the number of bytes received from the client, and
+	// BytesSent the number of bytes sent to the client.
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+}
+
+type jsonRecord struct {
+	*Record
+	DurationMS float64 `json:"durationMs"`
+}
+
+// Options contains the parameters of an Exporter.
+type Options struct {
+	// Network is udp or tcp.
+	Network string
+	// Address is the address of the collector.
+	Address string
+	// Format is FormatJSON or FormatIPFIX.
+	Format string
+	// ObservationDomainID is the observation domain ID of the IPFIX
+	// messages.
+	ObservationDomainID uint32
+	// EnterpriseNumber is the private enterprise number of the IPFIX
+	// information elements that don't have a standard equivalent. When
+	// it is 0, these elements are omitted.
+	EnterpriseNumber uint32
+	// QueueSize is the maximum number of records waiting to be sent.
+	// The records are dropped when the queue is full.
+	QueueSize int
+}
+
+// Stats contains the number of records that were exported, dropped because
+// the queue was full, or that couldn't be sent.
+type Stats struct {
+	Exported uint64
+	Dropped  uint64
+	Failed   uint64
+}
+
+// Exporter sends flow records to a collector in the background. The
+// connection to the collector is established when the first records are
+// sent, and re-established after errors.
+type Exporter struct {
+	opts  Options
+	ch    chan *Record
+	stop  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+	ipfix *ipfixEncoder
+
+	exported atomic.Uint64
+	dropped  atomic.Uint64
+	failed   atomic.Uint64
+
+	// Only used by the run goroutine.
+	conn net.Conn
+}
+
+// New returns a new Exporter.
+func New(opts Options) (*Exporter, error) {
+	if opts.Network != "udp" && opts.Network != "tcp" {
+		return nil, fmt.Errorf("invalid network %q", opts.Network)
+	}
+	if opts.Address == "" {
+		return nil, errors.New("address must be set")
+	}
+	if opts.Format != FormatJSON && opts.Format != FormatIPFIX {
+		return nil, fmt.Errorf("invalid format %q", opts.Format)
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	e := &Exporter{
+		opts: opts,
+		ch:   make(chan *Record, opts.QueueSize),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if opts.Format == FormatIPFIX {
+		e.ipfix = &ipfixEncoder{
+			domain: opts.ObservationDomainID,
+			pen:    opts.EnterpriseNumber,
+		}
+	}
+	go e.run()
+	return e, nil
+}
+
+// Export queues r to be sent to the collector. It doesn't block.
+func (e *Exporter) Export(r *Record) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.ch <- r:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Stats returns the exporter's counters.
+func (e *Exporter) Stats() Stats {
+	return Stats{
+		Exported: e.exported.Load(),
+		Dropped:  e.dropped.Load(),
+		Failed:   e.failed.Load(),
+	}
+}
+
+// Close sends the queued records and stops the exporter.
+func (e *Exporter) Close() error {
+	e.once.Do(func() {
+		close(e.stop)
+	})
+	<-e.done
+	return nil
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	defer func() {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-e.stop:
+			for {
+				batch := e.batch(nil)
+				if len(batch) == 0 {
+					return
+				}
+				e.send(batch)
+			}
+		case r := <-e.ch:
+			e.send(e.batch([]*Record{r}))
+		}
+	}
+}
+
+// batch adds the queued records to batch, without waiting.
+func (e *Exporter) batch(batch []*Record) []*Record {
+	for len(batch) < maxBatchSize {
+		select {
+		case r := <-e.ch:
+			batch = append(batch, r)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (e *Exporter) send(batch []*Record) {
+	if e.ipfix != nil {
+		// With udp, the templates are sent in every message, since
+		// the collector may have missed them. With tcp, they are sent
+		// once per connection.
+		for _, m := range e.ipfix.encode(time.Now(), batch, e.opts.Network == "udp") {
+			e.writeMessage(m)
+		}
+		return
+	}
+	var tcpMsg message
+	for _, r := range batch {
+		line, err := json.Marshal(jsonRecord{Record: r, DurationMS: float64(r.End.Sub(r.Start)) / float64(time.Millisecond)})
+		if err != nil {
+			e.failed.Add(1)
+			continue
+		}
+		line = append(line, '\n')
+		if e.opts.Network == "udp" {
+			e.writeMessage(message{b: line, n: 1})
+			continue
+		}
+		tcpMsg.b = append(tcpMsg.b, line...)
+		tcpMsg.n++
+	}
+	if tcpMsg.n > 0 {
+		e.writeMessage(tcpMsg)
+	}
+}
+
+// message is an encoded message with n records.
+type message struct {
+	b []byte
+	n int
+}
+
+func (e *Exporter) writeMessage(m message) {
+	if err := e.write(m.b); err != nil {
+		e.failed.Add(uint64(m.n))
+		return
+	}
+	e.exported.Add(uint64(m.n))
+}
+
+func (e *Exporter) write(b []byte) error {
+	if e.conn == nil {
+		conn, err := net.DialTimeout(e.opts.Network, e.opts.Address, dialTimeout)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+		if e.ipfix != nil && e.opts.Network == "tcp" {
+			if err := e.write(e.ipfix.templates(time.Now())); err != nil {
+				return err
+			}
+		}
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := e.conn.Write(b); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+	return nil
+}
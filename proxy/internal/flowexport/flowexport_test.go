@@ -0,0 +1,235 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package flowexport
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var (
+	testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	testV4    = &Record{
+		Start:         testStart,
+		End:           testStart.Add(1500 * time.Millisecond),
+		Protocol:      "tcp",
+		Src:           netip.MustParseAddrPort("192.168.0.1:12345"),
+		Dst:           netip.MustParseAddrPort("10.0.0.1:443"),
+		BackendAddr:   "10.0.0.2:8080",
+		ServerName:    "example.com",
+		Mode:          "TLS",
+		Subject:       "SUBJECT:CN=bob",
+		BytesReceived: 100,
+		BytesSent:     2000,
+	}
+	testV6 = &Record{
+		Start:         testStart,
+		End:           testStart.Add(time.Second),
+		Protocol:      "udp",
+		Src:           netip.MustParseAddrPort("[2001:db8::1]:12345"),
+		Dst:           netip.MustParseAddrPort("[::ffff:10.0.0.1]:443"),
+		BytesReceived: 10,
+		BytesSent:     20,
+	}
+)
+
+func TestJSON(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+	e, err := New(Options{Network: "udp", Address: pc.LocalAddr().String(), Format: FormatJSON})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	e.Export(testV4)
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	e.Close()
+
+	var got map[string]any
+	if err := json.Unmarshal(buf[:n], &got); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", buf[:n], err)
+	}
+	for k, v := range map[string]any{
+		"start":         "2024-05-01T12:00:00Z",
+		"protocol":      "tcp",
+		"src":           "192.168.0.1:12345",
+		"dst":           "10.0.0.1:443",
+		"backendAddr":   "10.0.0.2:8080",
+		"serverName":    "example.com",
+		"subject":       "SUBJECT:CN=bob",
+		"bytesReceived": float64(100),
+		"bytesSent":     float64(2000),
+		"durationMs":    float64(1500),
+	} {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if got, want := e.Stats(), (Stats{Exported: 1}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+// ipfixSet is a decoded set.
+type ipfixSet struct {
+	id   uint16
+	data []byte
+}
+
+func readIPFIX(t *testing.T, r io.Reader) (seq uint32, sets []ipfixSet) {
+	t.Helper()
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if v := binary.BigEndian.Uint16(hdr); v != 10 {
+		t.Fatalf("version = %d", v)
+	}
+	if d := binary.BigEndian.Uint32(hdr[12:]); d != 7 {
+		t.Errorf("domain = %d", d)
+	}
+	body := make([]byte, int(binary.BigEndian.Uint16(hdr[2:]))-16)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	for len(body) > 0 {
+		n := int(binary.BigEndian.Uint16(body[2:]))
+		sets = append(sets, ipfixSet{id: binary.BigEndian.Uint16(body), data: body[4:n]})
+		body = body[n:]
+	}
+	return binary.BigEndian.Uint32(hdr[8:]), sets
+}
+
+func TestIPFIX(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	e, err := New(Options{
+		Network:             "tcp",
+		Address:             l.Addr().String(),
+		Format:              FormatIPFIX,
+		ObservationDomainID: 7,
+		EnterpriseNumber:    12345,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	e.Export(testV4)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+
+	// The templates are sent first.
+	_, sets := readIPFIX(t, conn)
+	if len(sets) != 1 || sets[0].id != 2 {
+		t.Fatalf("sets = %v", sets)
+	}
+	tmpl := sets[0].data
+	if id, n := binary.BigEndian.Uint16(tmpl), binary.BigEndian.Uint16(tmpl[2:]); id != 256 || n != 13 {
+		t.Errorf("template = %d with %d fields", id, n)
+	}
+
+	seq, sets := readIPFIX(t, conn)
+	if seq != 0 || len(sets) != 1 || sets[0].id != 256 {
+		t.Fatalf("seq = %d, sets = %v", seq, sets)
+	}
+	b := sets[0].data
+	if got := time.UnixMilli(int64(binary.BigEndian.Uint64(b))); !got.Equal(testV4.Start) {
+		t.Errorf("flowStartMilliseconds = %v", got)
+	}
+	if got := netip.AddrFrom4([4]byte(b[16:20])); got.String() != "192.168.0.1" {
+		t.Errorf("sourceIPv4Address = %v", got)
+	}
+	if got := binary.BigEndian.Uint16(b[20:]); got != 12345 {
+		t.Errorf("sourceTransportPort = %d", got)
+	}
+	if got := netip.AddrFrom4([4]byte(b[22:26])); got.String() != "10.0.0.1" {
+		t.Errorf("destinationIPv4Address = %v", got)
+	}
+	if b[28] != 6 {
+		t.Errorf("protocolIdentifier = %d", b[28])
+	}
+	if in, out := binary.BigEndian.Uint64(b[29:]), binary.BigEndian.Uint64(b[37:]); in != 100 || out != 2000 {
+		t.Errorf("octetDeltaCount = %d, reverseOctetDeltaCount = %d", in, out)
+	}
+	if got := string(b[46 : 46+b[45]]); got != "example.com" {
+		t.Errorf("server name = %q", got)
+	}
+
+	e.Export(testV6)
+	seq, sets = readIPFIX(t, conn)
+	if seq != 1 || len(sets) != 1 || sets[0].id != 257 {
+		t.Fatalf("seq = %d, sets = %v", seq, sets)
+	}
+	if got := netip.AddrFrom16([16]byte(sets[0].data[34:50])); got.String() != "::ffff:10.0.0.1" {
+		t.Errorf("destinationIPv6Address = %v", got)
+	}
+	e.Close()
+	if got, want := e.Stats(), (Stats{Exported: 2}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestIPFIXMessageSize(t *testing.T) {
+	enc := &ipfixEncoder{domain: 7}
+	var records []*Record
+	for i := 0; i < 100; i++ {
+		records = append(records, testV4, testV6)
+	}
+	msgs := enc.encode(time.Now(), records, true)
+	if len(msgs) < 2 {
+		t.Fatalf("encode() returned %d messages", len(msgs))
+	}
+	var total uint32
+	for _, m := range msgs {
+		if len(m.b) > maxMessageSize {
+			t.Errorf("message size = %d", len(m.b))
+		}
+		if got := binary.BigEndian.Uint16(m.b[2:]); int(got) != len(m.b) {
+			t.Errorf("message length = %d, want %d", got, len(m.b))
+		}
+		if got := binary.BigEndian.Uint32(m.b[8:]); got != total {
+			t.Errorf("sequence number = %d, want %d", got, total)
+		}
+		total += uint32(m.n)
+	}
+	if total != 200 || enc.seq != 200 {
+		t.Errorf("total = %d, seq = %d", total, enc.seq)
+	}
+}
@@ -0,0 +1,228 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package flowexport
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	ipfixVersion   = 10
+	templateSetID  = 2
+	templateIDv4   = 256
+	templateIDv6   = 257
+	maxMessageSize = 1400
+	// maxStringSize is the maximum size of the strings in the records.
+	maxStringSize = 1024
+	// varLen is the length of variable-length information elements.
+	varLen = 65535
+	// reversePEN is the private enterprise number of the reverse
+	// information elements, from RFC 5103.
+	reversePEN = 29305
+)
+
+// ipfixField is a field specifier.
+type ipfixField struct {
+	id     uint16
+	length uint16
+	pen    uint32
+}
+
+// ipfixEncoder encodes flow records in IPFIX messages. The records of IPv4
+// and IPv6 flows use different templates.
+type ipfixEncoder struct {
+	domain uint32
+	pen    uint32
+	// seq is the number of data records sent so far.
+	seq uint32
+}
+
+func (enc *ipfixEncoder) fields(v6 bool) []ipfixField {
+	src, dst := ipfixField{id: 8, length: 4}, ipfixField{id: 12, length: 4}
+	if v6 {
+		src, dst = ipfixField{id: 27, length: 16}, ipfixField{id: 28, length: 16}
+	}
+	fields := []ipfixField{
+		{id: 152, length: 8},                // flowStartMilliseconds
+		{id: 153, length: 8},                // flowEndMilliseconds
+		src,                                 // sourceIPv4Address or sourceIPv6Address
+		{id: 7, length: 2},                  // sourceTransportPort
+		dst,                                 // destinationIPv4Address or destinationIPv6Address
+		{id: 11, length: 2},                 // destinationTransportPort
+		{id: 4, length: 1},                  // protocolIdentifier
+		{id: 1, length: 8},                  // octetDeltaCount, from the client
+		{id: 1, length: 8, pen: reversePEN}, // reverseOctetDeltaCount, to the client
+	}
+	if enc.pen != 0 {
+		fields = append(fields,
+			ipfixField{id: 1, length: varLen, pen: enc.pen}, // server name
+			ipfixField{id: 2, length: varLen, pen: enc.pen}, // client certificate subject
+			ipfixField{id: 3, length: varLen, pen: enc.pen}, // mode
+			ipfixField{id: 4, length: varLen, pen: enc.pen}, // backend address
+		)
+	}
+	return fields
+}
+
+// templateSet returns the template set with the templates of IPv4 and IPv6
+// flows.
+func (enc *ipfixEncoder) templateSet() []byte {
+	b := binary.BigEndian.AppendUint16(nil, templateSetID)
+	b = append(b, 0, 0)
+	for _, tid := range []uint16{templateIDv4, templateIDv6} {
+		fields := enc.fields(tid == templateIDv6)
+		b = binary.BigEndian.AppendUint16(b, tid)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			if f.pen == 0 {
+				b = binary.BigEndian.AppendUint16(b, f.id)
+				b = binary.BigEndian.AppendUint16(b, f.length)
+				continue
+			}
+			b = binary.BigEndian.AppendUint16(b, f.id|0x8000)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+			b = binary.BigEndian.AppendUint32(b, f.pen)
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+// record returns the template ID and the encoded data record of r.
+func (enc *ipfixEncoder) record(r *Record) (uint16, []byte) {
+	src, dst := r.Src.Addr().Unmap(), r.Dst.Addr().Unmap()
+	v6 := !src.Is4() || !dst.Is4()
+	b := binary.BigEndian.AppendUint64(nil, uint64(r.Start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.End.UnixMilli()))
+	var sa, da []byte
+	if v6 {
+		s, d := src.As16(), dst.As16()
+		sa, da = s[:], d[:]
+	} else {
+		s, d := src.As4(), dst.As4()
+		sa, da = s[:], d[:]
+	}
+	b = binary.BigEndian.AppendUint16(append(b, sa...), r.Src.Port())
+	b = binary.BigEndian.AppendUint16(append(b, da...), r.Dst.Port())
+	var proto byte = 6
+	if r.Protocol == "udp" {
+		proto = 17
+	}
+	b = append(b, proto)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.BytesReceived))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.BytesSent))
+	if enc.pen != 0 {
+		for _, s := range []string{r.ServerName, r.Subject, r.Mode, r.BackendAddr} {
+			b = appendVarLen(b, s)
+		}
+	}
+	if v6 {
+		return templateIDv6, b
+	}
+	return templateIDv4, b
+}
+
+// appendVarLen appends a variable-length string, with a 1-byte length, or
+// 255 followed by a 2-byte length.
+func appendVarLen(b []byte, s string) []byte {
+	if len(s) > maxStringSize {
+		s = s[:maxStringSize]
+	}
+	if len(s) < 255 {
+		b = append(b, byte(len(s)))
+	} else {
+		b = append(b, 255)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	}
+	return append(b, s...)
+}
+
+// header fills in the header of message b.
+func (enc *ipfixEncoder) header(b []byte, now time.Time) {
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], enc.seq)
+	binary.BigEndian.PutUint32(b[12:], enc.domain)
+}
+
+// templates returns a message that only contains the templates.
+func (enc *ipfixEncoder) templates(now time.Time) []byte {
+	b := append(make([]byte, 16), enc.templateSet()...)
+	enc.header(b, now)
+	return b
+}
+
+// encode encodes the records in messages of at most maxMessageSize bytes,
+// unless a single record is larger.
+func (enc *ipfixEncoder) encode(now time.Time, records []*Record, withTemplates bool) []message {
+	var msgs []message
+	var cur message
+	var setStart int
+	var setID uint16
+	start := func() {
+		cur = message{b: make([]byte, 16)}
+		if withTemplates {
+			cur.b = append(cur.b, enc.templateSet()...)
+		}
+		setID = 0
+	}
+	finishSet := func() {
+		if setID != 0 {
+			binary.BigEndian.PutUint16(cur.b[setStart+2:], uint16(len(cur.b)-setStart))
+		}
+		setID = 0
+	}
+	finish := func() {
+		finishSet()
+		enc.header(cur.b, now)
+		enc.seq += uint32(cur.n)
+		msgs = append(msgs, cur)
+	}
+	start()
+	for _, r := range records {
+		tid, rb := enc.record(r)
+		size := len(rb)
+		if tid != setID {
+			size += 4
+		}
+		if cur.n > 0 && len(cur.b)+size > maxMessageSize {
+			finish()
+			start()
+		}
+		if tid != setID {
+			finishSet()
+			setStart, setID = len(cur.b), tid
+			cur.b = binary.BigEndian.AppendUint16(cur.b, tid)
+			cur.b = append(cur.b, 0, 0)
+		}
+		cur.b = append(cur.b, rb...)
+		cur.n++
+	}
+	if cur.n > 0 {
+		finish()
+	}
+	return msgs
+}
@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package histogram implements a simple histogram with fixed buckets.
+package histogram
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets used
+// to record latencies.
+var DefaultLatencyBuckets = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30,
+}
+
+// New returns a new Histogram with the given bucket upper bounds. The bounds
+// must be sorted in increasing order. An implicit +Inf bucket is always added.
+func New(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: slices.Clone(bounds),
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// NewLatency returns a new Histogram with DefaultLatencyBuckets.
+func NewLatency() *Histogram {
+	return New(DefaultLatencyBuckets)
+}
+
+// Histogram counts observed values in buckets.
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Bucket is the cumulative count of observations less than or equal to
+// UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Snapshot is a point in time copy of a Histogram.
+type Snapshot struct {
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+}
+
+// Observe records one value.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// ObserveDuration records one duration in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Snapshot returns a copy of the current state of the histogram with
+// cumulative bucket counts. The last bucket's UpperBound is +Inf.
+func (h *Histogram) Snapshot() Snapshot {
+	if h == nil {
+		return Snapshot{}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := Snapshot{
+		Buckets: make([]Bucket, len(h.counts)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		ub := math.Inf(1)
+		if i < len(h.bounds) {
+			ub = h.bounds[i]
+		}
+		s.Buckets[i] = Bucket{UpperBound: ub, Count: cum}
+	}
+	return s
+}
+
+// Percentile returns an estimate of the p-th percentile (0 < p <= 100) of the
+// observed values using linear interpolation within buckets. It returns 0 if
+// there are no observations.
+func (s Snapshot) Percentile(p float64) float64 {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(s.Count)
+	var prevBound float64
+	var prevCount uint64
+	for _, b := range s.Buckets {
+		if float64(b.Count) >= rank {
+			if math.IsInf(b.UpperBound, 1) {
+				return prevBound
+			}
+			n := b.Count - prevCount
+			if n == 0 {
+				return b.UpperBound
+			}
+			return prevBound + (b.UpperBound-prevBound)*(rank-float64(prevCount))/float64(n)
+		}
+		prevBound = b.UpperBound
+		prevCount = b.Count
+	}
+	return prevBound
+}
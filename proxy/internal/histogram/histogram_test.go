@@ -0,0 +1,81 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package histogram
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := New([]float64{1, 2, 5})
+	for _, v := range []float64{0.5, 1, 1.5, 3, 4, 10} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	if got, want := s.Count, uint64(6); got != want {
+		t.Errorf("Count = %d, want %d", got, want)
+	}
+	if got, want := s.Sum, 20.0; got != want {
+		t.Errorf("Sum = %f, want %f", got, want)
+	}
+	want := []Bucket{
+		{1, 2},
+		{2, 3},
+		{5, 5},
+		{math.Inf(1), 6},
+	}
+	if len(s.Buckets) != len(want) {
+		t.Fatalf("Buckets = %v, want %v", s.Buckets, want)
+	}
+	for i := range want {
+		if s.Buckets[i] != want[i] {
+			t.Errorf("Buckets[%d] = %v, want %v", i, s.Buckets[i], want[i])
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	h := NewLatency()
+	if got := h.Snapshot().Percentile(50); got != 0 {
+		t.Errorf("Percentile(50) of empty histogram = %f, want 0", got)
+	}
+	for i := 0; i < 100; i++ {
+		h.ObserveDuration(time.Duration(i) * time.Millisecond)
+	}
+	s := h.Snapshot()
+	for _, tc := range []struct {
+		p        float64
+		min, max float64
+	}{
+		{50, 0.025, 0.05},
+		{95, 0.05, 0.1},
+		{99, 0.05, 0.1},
+	} {
+		if got := s.Percentile(tc.p); got < tc.min || got > tc.max {
+			t.Errorf("Percentile(%v) = %f, want [%f, %f]", tc.p, got, tc.min, tc.max)
+		}
+	}
+}
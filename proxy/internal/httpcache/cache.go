@@ -0,0 +1,444 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package httpcache implements a shared HTTP cache, as specified in RFC 9111.
+// The responses are kept in memory, and optionally spilled to disk when they
+// are evicted from memory.
+package httpcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is where the entries that are evicted from memory are saved. It is
+// implemented by github.com/c2FmZQ/storage.
+type Store interface {
+	Dir() string
+	ReadDataFile(name string, obj any) error
+	SaveDataFile(name string, obj any) error
+}
+
+// Options are the parameters of a Cache.
+type Options struct {
+	// MaxSize is the maximum number of bytes kept in memory.
+	MaxSize int64
+	// MaxObjectSize is the maximum size of a response body that can be
+	// stored.
+	MaxObjectSize int64
+	// DiskSize is the maximum number of bytes kept on disk. Zero means
+	// that entries evicted from memory are discarded.
+	DiskSize int64
+	// Store is where the entries are saved on disk. It is required when
+	// DiskSize is set.
+	Store Store
+	// Dir is the name of the directory, relative to Store.Dir(), where
+	// the entries are saved on disk. Its content is deleted by New and
+	// Close.
+	Dir string
+}
+
+// Stats contains the cache's statistics.
+type Stats struct {
+	Entries     int   `json:"entries"`
+	Size        int64 `json:"size"`
+	DiskEntries int   `json:"diskEntries"`
+	DiskSize    int64 `json:"diskSize"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Stores      int64 `json:"stores"`
+	Evictions   int64 `json:"evictions"`
+}
+
+// Entry is a stored response.
+type Entry struct {
+	Key        string
+	Primary    string
+	Host       string
+	Path       string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// ResponseTime is when the response was received.
+	ResponseTime time.Time
+	// InitialAge is the corrected initial age of the response, as
+	// defined in RFC 9111 section 4.2.3.
+	InitialAge time.Duration
+	// Lifetime is the freshness lifetime of the response.
+	Lifetime time.Duration
+	// Size is the approximate number of bytes used by the entry.
+	Size int64
+}
+
+func (e *Entry) age(now time.Time) time.Duration {
+	return e.InitialAge + max(0, now.Sub(e.ResponseTime))
+}
+
+// Cache is a size-bounded LRU cache of HTTP responses.
+type Cache struct {
+	opts Options
+
+	mu       sync.Mutex
+	mem      *lruList
+	disk     *lruList
+	variants map[string]*variants
+	stats    Stats
+}
+
+// variants contains the Vary header names of the responses stored for a
+// primary cache key, and the number of stored variants.
+type variants struct {
+	names []string
+	refs  int
+}
+
+// New returns a new Cache.
+func New(opts Options) *Cache {
+	c := &Cache{opts: opts}
+	c.reset()
+	if c.diskEnabled() {
+		if err := os.RemoveAll(c.diskDir()); err != nil {
+			log.Printf("ERR httpcache: %v", err)
+		}
+	}
+	return c
+}
+
+// Close deletes the entries that are saved on disk.
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+	if !c.diskEnabled() {
+		return nil
+	}
+	return os.RemoveAll(c.diskDir())
+}
+
+func (c *Cache) reset() {
+	c.mem = newLRUList(c.countVariant)
+	c.disk = newLRUList(c.countVariant)
+	c.variants = make(map[string]*variants)
+}
+
+// countVariant keeps track of the number of stored variants for each
+// primary key, so that the Vary header names are forgotten when there are
+// none left.
+func (c *Cache) countVariant(e *Entry, delta int) {
+	v, ok := c.variants[e.Primary]
+	if !ok {
+		return
+	}
+	if v.refs += delta; v.refs <= 0 {
+		delete(c.variants, e.Primary)
+	}
+}
+
+// Stats returns the cache's statistics.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.mem.len()
+	s.Size = c.mem.size
+	s.DiskEntries = c.disk.len()
+	s.DiskSize = c.disk.size
+	return s
+}
+
+// Purge removes the entries for host whose path starts with pathPrefix. An
+// empty host matches all hosts. It returns the number of entries removed.
+func (c *Cache) Purge(host, pathPrefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	match := func(e *Entry) bool {
+		return (host == "" || e.Host == host) && strings.HasPrefix(e.Path, pathPrefix)
+	}
+	n := 0
+	for _, e := range c.mem.filter(match) {
+		c.mem.remove(e.Key)
+		n++
+	}
+	for _, e := range c.disk.filter(match) {
+		c.removeFromDisk(e)
+		n++
+	}
+	return n
+}
+
+func (c *Cache) diskEnabled() bool {
+	return c.opts.DiskSize > 0 && c.opts.Store != nil && c.opts.Dir != ""
+}
+
+func (c *Cache) diskDir() string {
+	return filepath.Join(c.opts.Store.Dir(), c.opts.Dir)
+}
+
+func (c *Cache) diskFile(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(c.opts.Dir, hex.EncodeToString(h[:]))
+}
+
+// variantKey returns the key of the variant of primary that matches the
+// request headers, using the Vary header names of the stored response.
+func variantKey(primary string, names []string, h http.Header) string {
+	var sb strings.Builder
+	sb.WriteString(primary)
+	sb.WriteByte(0)
+	for _, n := range names {
+		sb.WriteString(n)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(h.Values(n), ","))
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// get returns the stored response for primary that matches the request
+// headers h, or nil.
+func (c *Cache) get(primary string, h http.Header) *Entry {
+	c.mu.Lock()
+	v, ok := c.variants[primary]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	key := variantKey(primary, v.names, h)
+	if e := c.mem.get(key); e != nil {
+		c.mu.Unlock()
+		return e
+	}
+	stub := c.disk.get(key)
+	c.mu.Unlock()
+	if stub == nil {
+		return nil
+	}
+
+	var e Entry
+	if err := c.opts.Store.ReadDataFile(c.diskFile(key), &e); err != nil {
+		log.Printf("ERR httpcache: %v", err)
+		c.mu.Lock()
+		c.removeFromDisk(stub)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Lock()
+	if c.disk.get(key) != stub {
+		c.mu.Unlock()
+		return nil
+	}
+	spill := c.addLocked(&e)
+	c.mu.Unlock()
+	c.spill(spill)
+	return &e
+}
+
+// put stores e. The Vary header names are recorded so that the same variant
+// can be found by get.
+func (c *Cache) put(e *Entry, varyNames []string) {
+	c.mu.Lock()
+	if v, ok := c.variants[e.Primary]; ok {
+		v.names = varyNames
+	} else {
+		c.variants[e.Primary] = &variants{names: varyNames}
+	}
+	c.stats.Stores++
+	spill := c.addLocked(e)
+	c.mu.Unlock()
+	c.spill(spill)
+}
+
+// invalidate removes all the variants of primary.
+func (c *Cache) invalidate(primary string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.variants[primary]; !ok {
+		return
+	}
+	match := func(e *Entry) bool {
+		return e.Primary == primary
+	}
+	for _, e := range c.mem.filter(match) {
+		c.mem.remove(e.Key)
+	}
+	for _, e := range c.disk.filter(match) {
+		c.removeFromDisk(e)
+	}
+	delete(c.variants, primary)
+}
+
+func (c *Cache) countHit(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+}
+
+// addLocked adds e to the memory cache, and returns the entries that were
+// evicted and need to be saved on disk. The variants of these entries remain
+// counted until spill is done with them.
+func (c *Cache) addLocked(e *Entry) []*Entry {
+	c.mem.add(e)
+	if old := c.disk.get(e.Key); old != nil {
+		c.removeFromDisk(old)
+	}
+	var spill []*Entry
+	for c.mem.size > c.opts.MaxSize {
+		old := c.mem.oldest()
+		c.stats.Evictions++
+		if c.diskEnabled() && old.Size <= c.opts.DiskSize {
+			c.countVariant(old, 1)
+			spill = append(spill, old)
+		}
+		c.mem.remove(old.Key)
+	}
+	return spill
+}
+
+// spill saves entries on disk. It must be called without holding c.mu.
+func (c *Cache) spill(entries []*Entry) {
+	for _, e := range entries {
+		err := c.opts.Store.SaveDataFile(c.diskFile(e.Key), e)
+		c.mu.Lock()
+		if err != nil {
+			log.Printf("ERR httpcache: %v", err)
+			c.countVariant(e, -1)
+			c.mu.Unlock()
+			continue
+		}
+		_, ok := c.variants[e.Primary]
+		if !ok || c.mem.get(e.Key) != nil {
+			// The entry was invalidated, or stored again, in the
+			// meantime.
+			c.countVariant(e, -1)
+			c.mu.Unlock()
+			c.removeFile(e.Key)
+			continue
+		}
+		c.disk.add(&Entry{
+			Key:     e.Key,
+			Primary: e.Primary,
+			Host:    e.Host,
+			Path:    e.Path,
+			Size:    e.Size,
+		})
+		c.countVariant(e, -1)
+		for c.disk.size > c.opts.DiskSize {
+			c.removeFromDisk(c.disk.oldest())
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *Cache) removeFromDisk(e *Entry) {
+	c.disk.remove(e.Key)
+	c.removeFile(e.Key)
+}
+
+func (c *Cache) removeFile(key string) {
+	if err := os.Remove(filepath.Join(c.opts.Store.Dir(), c.diskFile(key))); err != nil && !os.IsNotExist(err) {
+		log.Printf("ERR httpcache: %v", err)
+	}
+}
+
+// lruList is a list of entries in least recently used order.
+type lruList struct {
+	ll       *list.List
+	items    map[string]*list.Element
+	size     int64
+	onChange func(e *Entry, delta int)
+}
+
+func newLRUList(onChange func(*Entry, int)) *lruList {
+	return &lruList{
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		onChange: onChange,
+	}
+}
+
+func (l *lruList) len() int {
+	return l.ll.Len()
+}
+
+func (l *lruList) get(key string) *Entry {
+	el, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*Entry)
+}
+
+// add adds e to the list, or replaces the entry with the same key.
+func (l *lruList) add(e *Entry) {
+	if el, ok := l.items[e.Key]; ok {
+		l.size += e.Size - el.Value.(*Entry).Size
+		el.Value = e
+		l.ll.MoveToFront(el)
+		return
+	}
+	l.items[e.Key] = l.ll.PushFront(e)
+	l.size += e.Size
+	l.onChange(e, 1)
+}
+
+func (l *lruList) remove(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.ll.Remove(el)
+	delete(l.items, key)
+	e := el.Value.(*Entry)
+	l.size -= e.Size
+	l.onChange(e, -1)
+}
+
+func (l *lruList) oldest() *Entry {
+	if el := l.ll.Back(); el != nil {
+		return el.Value.(*Entry)
+	}
+	return nil
+}
+
+func (l *lruList) filter(f func(*Entry) bool) []*Entry {
+	var out []*Entry
+	for el := l.ll.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*Entry); f(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
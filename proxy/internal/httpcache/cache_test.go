@@ -0,0 +1,298 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package httpcache
+
+import (
+	"encoding/gob"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	calls   int
+	lastReq *http.Request
+	handler func(req *http.Request) (int, http.Header, string)
+}
+
+func (b *fakeBackend) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.calls++
+	b.lastReq = req
+	code, h, body := b.handler(req)
+	if h == nil {
+		h = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode:    code,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+type fileStore struct {
+	dir string
+}
+
+func (s fileStore) Dir() string {
+	return s.dir
+}
+
+func (s fileStore) ReadDataFile(name string, obj any) error {
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewDecoder(f).Decode(obj)
+}
+
+func (s fileStore) SaveDataFile(name string, obj any) error {
+	name = filepath.Join(s.dir, name)
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(obj)
+}
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func newTestTransport(opts Options, be *fakeBackend) (*Transport, *testClock) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = 1 << 20
+	}
+	if opts.MaxObjectSize == 0 {
+		opts.MaxObjectSize = 1 << 10
+	}
+	clock := &testClock{t: time.Now()}
+	return &Transport{Cache: New(opts), Next: be, now: clock.now}, clock
+}
+
+func get(t *testing.T, tr *Transport, method, path string, h http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, "https://www.example.com"+path, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	resp.Body.Close()
+	return resp, string(b)
+}
+
+func TestFreshAndRevalidate(t *testing.T) {
+	n := 0
+	be := &fakeBackend{handler: func(req *http.Request) (int, http.Header, string) {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return http.StatusNotModified, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}, ""
+		}
+		n++
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Etag": {`"v1"`}}, "hello"
+	}}
+	tr, clock := newTestTransport(Options{}, be)
+
+	if resp, body := get(t, tr, "GET", "/foo", nil); body != "hello" || !strings.Contains(resp.Header.Get(cacheStatusHeader), "fwd=miss") {
+		t.Fatalf("got %q, %q", body, resp.Header.Get(cacheStatusHeader))
+	}
+	clock.t = clock.t.Add(10 * time.Second)
+	resp, body := get(t, tr, "GET", "/foo", nil)
+	if body != "hello" || resp.Header.Get(cacheStatusHeader) != "tlsproxy; hit" || resp.Header.Get("Age") != "10" {
+		t.Errorf("got %q, %q, age %q", body, resp.Header.Get(cacheStatusHeader), resp.Header.Get("Age"))
+	}
+	if be.calls != 1 {
+		t.Errorf("backend calls = %d, want 1", be.calls)
+	}
+
+	// The client's validator matches.
+	if resp, _ := get(t, tr, "GET", "/foo", http.Header{"If-None-Match": {`W/"v1"`}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want 304", resp.StatusCode)
+	}
+
+	// The response is stale, and revalidated.
+	clock.t = clock.t.Add(time.Minute)
+	resp, body = get(t, tr, "GET", "/foo", nil)
+	if body != "hello" || !strings.Contains(resp.Header.Get(cacheStatusHeader), "fwd-status=304") {
+		t.Errorf("got %q, %q", body, resp.Header.Get(cacheStatusHeader))
+	}
+	if be.calls != 2 || n != 1 {
+		t.Errorf("backend calls = %d, full responses = %d, want 2, 1", be.calls, n)
+	}
+
+	// Request directives.
+	get(t, tr, "GET", "/foo", http.Header{"Cache-Control": {"no-cache"}})
+	if be.calls != 3 || n != 1 {
+		t.Errorf("no-cache: backend calls = %d, full responses = %d, want 3, 1", be.calls, n)
+	}
+	get(t, tr, "GET", "/foo", http.Header{"Cache-Control": {"no-store"}})
+	if be.calls != 4 {
+		t.Errorf("no-store: backend calls = %d, want 4", be.calls)
+	}
+	if resp, _ := get(t, tr, "GET", "/bar", http.Header{"Cache-Control": {"only-if-cached"}}); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached: status = %d, want 504", resp.StatusCode)
+	}
+
+	// Unsafe methods invalidate the stored response.
+	get(t, tr, "POST", "/foo", nil)
+	get(t, tr, "GET", "/foo", nil)
+	if be.calls != 6 || n != 4 {
+		t.Errorf("POST: backend calls = %d, full responses = %d, want 6, 4", be.calls, n)
+	}
+
+	s := tr.Cache.Stats()
+	if s.Entries != 1 || s.Hits != 4 || s.Misses != 3 {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+func TestNotStored(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		reqH   http.Header
+		status int
+		respH  http.Header
+		auth   bool
+		stored bool
+	}{
+		{"max-age", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, true},
+		{"no-store", nil, 200, http.Header{"Cache-Control": {"no-store, max-age=60"}}, false, false},
+		{"private", nil, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false, false},
+		{"set-cookie", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false, false},
+		{"vary-star", nil, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false, false},
+		{"no-freshness", nil, 200, nil, false, false},
+		{"status-500", nil, 500, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{"authorization", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{"authorization-public", http.Header{"Authorization": {"Bearer x"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, false, true},
+		{"cookie", http.Header{"Cookie": {"session=x"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{"cookie-public", http.Header{"Cookie": {"session=x"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, false, true},
+		{"cookie-must-revalidate", http.Header{"Cookie": {"session=x"}}, 200, http.Header{"Cache-Control": {"max-age=60, must-revalidate"}}, false, true},
+		{"authenticated", nil, 200, http.Header{"Cache-Control": {"max-age=60"}}, true, false},
+		{"authenticated-s-maxage", nil, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := &fakeBackend{handler: func(req *http.Request) (int, http.Header, string) {
+				return tc.status, tc.respH.Clone(), "body"
+			}}
+			tr, _ := newTestTransport(Options{}, be)
+			tr.Authenticated = func(*http.Request) bool { return tc.auth }
+			get(t, tr, "GET", "/", tc.reqH)
+			get(t, tr, "GET", "/", tc.reqH)
+			if got := be.calls == 1; got != tc.stored {
+				t.Errorf("stored = %v, want %v", got, tc.stored)
+			}
+		})
+	}
+}
+
+func TestVaryAndTTL(t *testing.T) {
+	be := &fakeBackend{handler: func(req *http.Request) (int, http.Header, string) {
+		return http.StatusOK, http.Header{"Vary": {"Accept-Encoding"}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}}, "enc:" + req.Header.Get("Accept-Encoding")
+	}}
+	tr, clock := newTestTransport(Options{}, be)
+	tr.TTL = func(req *http.Request) (time.Duration, bool) {
+		return time.Hour, strings.HasPrefix(req.URL.Path, "/static/")
+	}
+	for _, enc := range []string{"gzip", "br", "gzip", "br"} {
+		if _, body := get(t, tr, "GET", "/static/x", http.Header{"Accept-Encoding": {enc}}); body != "enc:"+enc {
+			t.Errorf("got %q, want %q", body, "enc:"+enc)
+		}
+	}
+	if be.calls != 2 {
+		t.Errorf("backend calls = %d, want 2", be.calls)
+	}
+	clock.t = clock.t.Add(2 * time.Hour)
+	get(t, tr, "GET", "/static/x", http.Header{"Accept-Encoding": {"gzip"}})
+	if be.calls != 3 {
+		t.Errorf("backend calls = %d, want 3", be.calls)
+	}
+	if be.lastReq.Header.Get("If-Modified-Since") == "" {
+		t.Error("If-Modified-Since not set")
+	}
+}
+
+func TestEvictionAndPurge(t *testing.T) {
+	be := &fakeBackend{handler: func(req *http.Request) (int, http.Header, string) {
+		return http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("x", 500)
+	}}
+	store := fileStore{dir: t.TempDir()}
+	tr, _ := newTestTransport(Options{MaxSize: 1500, DiskSize: 1500, Store: store, Dir: "cache"}, be)
+
+	for _, p := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		get(t, tr, "GET", p, nil)
+	}
+	s := tr.Cache.Stats()
+	if s.Entries != 2 || s.DiskEntries != 2 || s.Evictions != 3 {
+		t.Errorf("Stats = %+v", s)
+	}
+	files, _ := os.ReadDir(filepath.Join(store.dir, "cache"))
+	if len(files) != 2 {
+		t.Errorf("files = %d, want 2", len(files))
+	}
+	// /a was evicted from disk. /b and /c are on disk.
+	for _, p := range []string{"/b", "/c", "/d", "/e"} {
+		if resp, _ := get(t, tr, "GET", p, nil); resp.Header.Get(cacheStatusHeader) != "tlsproxy; hit" {
+			t.Errorf("%s: Cache-Status = %q", p, resp.Header.Get(cacheStatusHeader))
+		}
+	}
+	if be.calls != 5 {
+		t.Errorf("backend calls = %d, want 5", be.calls)
+	}
+
+	if n := tr.Cache.Purge("www.example.com", "/"); n != 4 {
+		t.Errorf("Purge() = %d, want 4", n)
+	}
+	if s := tr.Cache.Stats(); s.Entries != 0 || s.DiskEntries != 0 || s.Size != 0 || s.DiskSize != 0 {
+		t.Errorf("Stats = %+v", s)
+	}
+	if err := tr.Cache.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(store.dir, "cache")); !os.IsNotExist(err) {
+		t.Errorf("Stat: %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package httpcache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cacheStatusHeader is defined in RFC 9211.
+	cacheStatusHeader = "Cache-Status"
+	cacheName         = "tlsproxy"
+
+	maxHeuristicLifetime = 24 * time.Hour
+)
+
+// heuristicallyCacheable is the list of status codes that can be stored
+// without explicit freshness information. RFC 9110 section 15.1. Partial
+// content isn't stored.
+var heuristicallyCacheable = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// Transport is a http.RoundTripper that serves responses from a Cache when
+// they are fresh, revalidates them when they are stale, and stores the
+// responses that it receives from Next when they are allowed to be stored.
+type Transport struct {
+	Cache *Cache
+	Next  http.RoundTripper
+	// Authenticated returns true when the request was authenticated by
+	// the caller, e.g. with a client certificate. Responses to
+	// authenticated requests are stored only when they are explicitly
+	// public, like responses to requests with an Authorization or Cookie
+	// header.
+	Authenticated func(*http.Request) bool
+	// TTL returns the freshness lifetime to use for the response to the
+	// request, instead of the one specified by the response. It returns
+	// false when there is no override.
+	TTL func(*http.Request) (time.Duration, bool)
+
+	now func() time.Time
+}
+
+func (t *Transport) timeNow() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		resp, err := t.Next.RoundTrip(req)
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < 400 {
+			t.Cache.invalidate(primaryKey(req))
+		}
+		return resp, err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := req.Header["Cache-Control"]; !ok && strings.Contains(strings.ToLower(req.Header.Get("Pragma")), "no-cache") {
+		reqCC["no-cache"] = ""
+	}
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" ||
+		req.Header.Get("If-Match") != "" || req.Header.Get("If-Unmodified-Since") != "" || req.Header.Get("If-Range") != "" {
+		return t.Next.RoundTrip(req)
+	}
+
+	primary := primaryKey(req)
+	now := t.timeNow()
+	e := t.Cache.get(primary, req.Header)
+	if e != nil {
+		age := e.age(now)
+		fresh := age < e.Lifetime && !reqCC.has("no-cache")
+		if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+			fresh = false
+		}
+		if minFresh, ok := reqCC.seconds("min-fresh"); ok && e.Lifetime-age < minFresh {
+			fresh = false
+		}
+		if fresh {
+			t.Cache.countHit(true)
+			return cachedResponse(req, e, now, "hit"), nil
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		t.Cache.countHit(false)
+		return &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{cacheStatusHeader: []string{cacheName + "; fwd=miss"}},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	// Revalidate the stored response, unless the client sent its own
+	// validators.
+	outReq := req
+	clientConditional := req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+	revalidating := false
+	if e != nil && !clientConditional {
+		etag, lastMod := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+		if etag != "" || lastMod != "" {
+			outReq = req.Clone(req.Context())
+			if etag != "" {
+				outReq.Header.Set("If-None-Match", etag)
+			}
+			if lastMod != "" {
+				outReq.Header.Set("If-Modified-Since", lastMod)
+			}
+			revalidating = true
+		}
+	}
+
+	reqTime := t.timeNow()
+	resp, err := t.Next.RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+	respTime := t.timeNow()
+
+	if revalidating && resp.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		ne := t.updateEntry(req, e, resp.Header, reqTime, respTime)
+		t.Cache.put(ne, varyNames(ne.Header))
+		t.Cache.countHit(true)
+		return cachedResponse(req, ne, respTime, "hit; fwd=stale; fwd-status=304"), nil
+	}
+	t.Cache.countHit(false)
+	fwd := "miss"
+	if e != nil {
+		fwd = "stale"
+	}
+	resp.Header.Set(cacheStatusHeader, fmt.Sprintf("%s; fwd=%s; fwd-status=%d", cacheName, fwd, resp.StatusCode))
+	t.store(req, resp, primary, reqTime, respTime)
+	return resp, nil
+}
+
+// store arranges for resp to be stored when its body is read completely,
+// if the response is allowed to be stored.
+func (t *Transport) store(req *http.Request, resp *http.Response, primary string, reqTime, respTime time.Time) {
+	if !slices.Contains(heuristicallyCacheable, resp.StatusCode) {
+		return
+	}
+	respCC := parseCacheControl(resp.Header)
+	if respCC.has("no-store") || respCC.has("private") || resp.Header.Get("Set-Cookie") != "" {
+		return
+	}
+	vary := varyNames(resp.Header)
+	if slices.Contains(vary, "*") {
+		return
+	}
+	// Requests with cookies are treated like authenticated requests, since
+	// the response is likely personalized, even without Vary: Cookie.
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" || (t.Authenticated != nil && t.Authenticated(req)) {
+		if _, ok := respCC.seconds("s-maxage"); !ok && !respCC.has("public") && !respCC.has("must-revalidate") {
+			return
+		}
+	}
+	if resp.ContentLength > t.Cache.opts.MaxObjectSize {
+		return
+	}
+	header := resp.Header.Clone()
+	header.Del(cacheStatusHeader)
+	e := &Entry{
+		Primary:    primary,
+		Host:       hostname(req.Host),
+		Path:       req.URL.Path,
+		StatusCode: resp.StatusCode,
+		Header:     header,
+	}
+	t.setFreshness(req, e, reqTime, respTime)
+	if e.Lifetime <= 0 && header.Get("ETag") == "" && header.Get("Last-Modified") == "" {
+		return
+	}
+	e.Key = variantKey(primary, vary, req.Header)
+	resp.Body = &storingBody{
+		ReadCloser: resp.Body,
+		max:        t.Cache.opts.MaxObjectSize,
+		done: func(body []byte) {
+			e.Body = body
+			e.Size = entrySize(e)
+			t.Cache.put(e, vary)
+		},
+	}
+}
+
+// updateEntry returns a copy of e with the header fields from a 304 Not
+// Modified response. RFC 9111 section 4.3.4.
+func (t *Transport) updateEntry(req *http.Request, e *Entry, h http.Header, reqTime, respTime time.Time) *Entry {
+	ne := *e
+	ne.Header = e.Header.Clone()
+	for k, v := range h {
+		if k == "Content-Length" || k == cacheStatusHeader {
+			continue
+		}
+		ne.Header[k] = slices.Clone(v)
+	}
+	t.setFreshness(req, &ne, reqTime, respTime)
+	ne.Size = entrySize(&ne)
+	return &ne
+}
+
+// setFreshness sets the response time, the initial age, and the freshness
+// lifetime of e. RFC 9111 section 4.2.
+func (t *Transport) setFreshness(req *http.Request, e *Entry, reqTime, respTime time.Time) {
+	h := e.Header
+	date, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		date = respTime
+	}
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	apparentAge := max(0, respTime.Sub(date))
+	correctedAgeValue := ageValue + respTime.Sub(reqTime)
+	e.ResponseTime = respTime
+	e.InitialAge = max(apparentAge, correctedAgeValue)
+
+	cc := parseCacheControl(h)
+	if cc.has("no-cache") {
+		e.Lifetime = 0
+		return
+	}
+	if t.TTL != nil {
+		if ttl, ok := t.TTL(req); ok {
+			e.Lifetime = ttl
+			return
+		}
+	}
+	if v, ok := cc.seconds("s-maxage"); ok {
+		e.Lifetime = v
+		return
+	}
+	if v, ok := cc.seconds("max-age"); ok {
+		e.Lifetime = v
+		return
+	}
+	if v := h.Get("Expires"); v != "" {
+		// Invalid dates, e.g. "0", represent a time in the past.
+		if exp, err := http.ParseTime(v); err == nil {
+			e.Lifetime = max(0, exp.Sub(date))
+		}
+		return
+	}
+	if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && lm.Before(date) {
+		e.Lifetime = min(date.Sub(lm)/10, maxHeuristicLifetime)
+	}
+}
+
+// cachedResponse returns a response from e. When the request has validators
+// that match e, the response is 304 Not Modified.
+func cachedResponse(req *http.Request, e *Entry, now time.Time, status string) *http.Response {
+	h := e.Header.Clone()
+	h.Set("Age", strconv.FormatInt(int64(e.age(now)/time.Second), 10))
+	h.Set(cacheStatusHeader, cacheName+"; "+status)
+	code := e.StatusCode
+	body := e.Body
+	if e.StatusCode == http.StatusOK && notModified(req, h) {
+		code = http.StatusNotModified
+		body = nil
+		h.Del("Content-Length")
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since
+// preconditions. RFC 9110 section 13.2.2.
+func notModified(req *http.Request, h http.Header) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, v := range strings.Split(inm, ",") {
+			v = strings.TrimSpace(v)
+			if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// primaryKey returns the primary cache key of req, i.e. the target URI. The
+// URL's host is included because it identifies the destination.
+func primaryKey(req *http.Request) string {
+	return req.URL.Host + " " + req.Host + " " + req.URL.RequestURI()
+}
+
+func hostname(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, n := range strings.Split(v, ",") {
+			if n = strings.TrimSpace(n); n != "" {
+				names = append(names, http.CanonicalHeaderKey(n))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+func isSafeMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions || m == http.MethodTrace
+}
+
+func entrySize(e *Entry) int64 {
+	n := int64(len(e.Key) + len(e.Host) + len(e.Path) + len(e.Body))
+	for k, v := range e.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// storingBody calls done with the body when it is read completely, if it
+// isn't larger than max.
+type storingBody struct {
+	io.ReadCloser
+	max  int64
+	buf  bytes.Buffer
+	done func([]byte)
+	skip bool
+}
+
+func (b *storingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.skip && n > 0 {
+		if int64(b.buf.Len()+n) > b.max {
+			b.skip = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.skip {
+		b.skip = true
+		b.done(b.buf.Bytes())
+	}
+	return n, err
+}
@@ -0,0 +1,283 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package jwks fetches and caches the JSON Web Key Sets (JWKS) of token
+// issuers.
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is the amount of time that a key set is
+	// cached by default.
+	DefaultRefreshInterval = time.Hour
+	// minFetchInterval is the minimum amount of time between two fetches
+	// of the same key set, e.g. when the tokens have unknown key IDs, or
+	// after an error.
+	minFetchInterval = time.Minute
+	maxJWKSSize      = 1 << 20
+	minRSAKeySize    = 2048
+)
+
+// ErrKeyNotFound is returned when the key set doesn't have the requested key.
+var ErrKeyNotFound = errors.New("key not found")
+
+// New returns a new Cache.
+func New() *Cache {
+	return &Cache{
+		client: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+		sets: make(map[string]*entry),
+	}
+}
+
+// Cache fetches and caches JSON Web Key Sets from files or http(s) URLs.
+type Cache struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	sets map[string]*entry
+}
+
+type entry struct {
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+// Key returns the public key with the key ID kid from the key set at src. The
+// key set is fetched again when it is older than refresh, and when it doesn't
+// have kid, at most once per minute. When the key set can't be fetched, the
+// last one is used. An empty kid matches the only key of a key set.
+func (c *Cache) Key(src, kid string, refresh time.Duration) (crypto.PublicKey, error) {
+	if refresh <= 0 {
+		refresh = DefaultRefreshInterval
+	}
+	c.mu.Lock()
+	e, ok := c.sets[src]
+	if !ok {
+		e = &entry{}
+		c.sets[src] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	key, found := e.lookup(kid)
+	if (!found || now.Sub(e.fetched) >= refresh) && (e.lastAttempt.IsZero() || now.Sub(e.lastAttempt) >= minFetchInterval) {
+		e.lastAttempt = now
+		keys, err := c.fetch(src)
+		if err != nil {
+			log.Printf("ERR JWKS %s: %v", src, err)
+		} else {
+			e.keys = keys
+			e.fetched = now
+		}
+		key, found = e.lookup(kid)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, kid)
+	}
+	return key, nil
+}
+
+func (e *entry) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(e.keys) == 1 {
+		for _, k := range e.keys {
+			return k, true
+		}
+	}
+	k, ok := e.keys[kid]
+	return k, ok
+}
+
+func (c *Cache) fetch(src string) (map[string]crypto.PublicKey, error) {
+	var b []byte
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		req, err := http.NewRequest(http.MethodGet, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("user-agent", "tlsproxy")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		if b, err = io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if b, err = os.ReadFile(src); err != nil {
+			return nil, err
+		}
+	}
+	return Parse(b)
+}
+
+type jsonKeySet struct {
+	Keys []jsonKey `json:"keys"`
+}
+
+type jsonKey struct {
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	ID    string `json:"kid"`
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+}
+
+// Parse parses a JSON Web Key Set, and returns its signature verification
+// keys by key ID. The keys that can't be used, e.g. the ones with unknown
+// types or curves, and the ones whose key ID isn't unique, are ignored, so
+// that the issuers can add new kinds of keys. It returns an error when no
+// keys are left.
+func Parse(b []byte) (map[string]crypto.PublicKey, error) {
+	var set jsonKeySet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	duplicates := make(map[string]bool)
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("WRN JWKS keys[%d]: %v", i, err)
+			continue
+		}
+		if _, exists := keys[k.ID]; exists {
+			log.Printf("WRN JWKS keys[%d]: duplicate kid %q", i, k.ID)
+			duplicates[k.ID] = true
+			continue
+		}
+		keys[k.ID] = pub
+	}
+	for kid := range duplicates {
+		delete(keys, kid)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable keys")
+	}
+	return keys, nil
+}
+
+func (k jsonKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Type {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("y: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, err
+		}
+		return pub, nil
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("n: %w", err)
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("e: %w", err)
+		}
+		if n.BitLen() < minRSAKeySize {
+			return nil, fmt.Errorf("rsa key is too small: %d bits", n.BitLen())
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("x: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Type)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
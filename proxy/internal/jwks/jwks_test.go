@@ -0,0 +1,156 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestCache(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	set := jsonKeySet{Keys: []jsonKey{
+		{Type: "EC", Use: "sig", ID: "ec", Curve: "P-256", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())},
+		{Type: "RSA", ID: "rsa", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Type: "OKP", ID: "ed", Curve: "Ed25519", X: b64(edPub)},
+		{Type: "RSA", Use: "enc", ID: "enc", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{Type: "oct", ID: "secret"},
+	}}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches.Add(1)
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	c := New()
+	for _, tc := range []struct {
+		kid  string
+		want any
+	}{
+		{"ec", &ecKey.PublicKey},
+		{"rsa", &rsaKey.PublicKey},
+		{"ed", edPub},
+	} {
+		got, err := c.Key(srv.URL, tc.kid, 0)
+		if err != nil {
+			t.Fatalf("Key(%q): %v", tc.kid, err)
+		}
+		if !tc.want.(interface{ Equal(crypto.PublicKey) bool }).Equal(got) {
+			t.Errorf("Key(%q) = %v, want %v", tc.kid, got, tc.want)
+		}
+	}
+	for _, kid := range []string{"enc", "secret", "unknown", ""} {
+		if _, err := c.Key(srv.URL, kid, 0); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Key(%q) = %v, want ErrKeyNotFound", kid, err)
+		}
+	}
+	// The key set is only fetched again after minFetchInterval.
+	if got, want := fetches.Load(), int32(1); got != want {
+		t.Errorf("fetches = %d, want %d", got, want)
+	}
+
+	// A key set with only one key matches tokens without kid.
+	set.Keys = set.Keys[:1]
+	if content, err = json.Marshal(set); err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, content, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if _, err := c.Key(file, "", 0); err != nil {
+		t.Errorf("Key(%q): %v", "", err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	good := `{"kty":"OKP","kid":"good","crv":"Ed25519","x":"` + b64(make([]byte, 32)) + `"}`
+	for _, bad := range []string{
+		`{"kty":"EC","kid":"a","crv":"P-256","x":"AQ","y":"AQ"}`,
+		`{"kty":"EC","kid":"a","crv":"P-192","x":"AQ","y":"AQ"}`,
+		`{"kty":"OKP","kid":"a","crv":"Ed25519","x":"AQ"}`,
+		`{"kty":"OKP","kid":"a","crv":"X448","x":"AQ"}`,
+		`{"kty":"RSA","kid":"a","n":"` + b64(rsaKey.N.Bytes()) + `","e":"AQAB"}`,
+		`{"kty":"oct","kid":"a","k":"AQ"}`,
+		`{"kty":"OKP","kid":"a","crv":"Ed25519","x":"` + b64(make([]byte, 32)) + `"},{"kty":"OKP","kid":"a","crv":"Ed25519","x":"` + b64(make([]byte, 32)) + `"}`,
+	} {
+		// The keys that can't be used are skipped.
+		keys, err := Parse([]byte(`{"keys":[` + bad + `,` + good + `]}`))
+		if err != nil {
+			t.Errorf("Parse(%s) = %v", bad, err)
+		} else if _, ok := keys["a"]; ok || len(keys) != 1 {
+			t.Errorf("Parse(%s) = %v", bad, keys)
+		}
+		// Without usable keys, the key set is invalid.
+		if _, err := Parse([]byte(`{"keys":[` + bad + `]}`)); err == nil {
+			t.Errorf("Parse(%s) succeeded unexpectedly", bad)
+		}
+	}
+	for _, tc := range []string{
+		`not json`,
+		`{"keys":[]}`,
+	} {
+		if _, err := Parse([]byte(tc)); err == nil {
+			t.Errorf("Parse(%s) succeeded unexpectedly", tc)
+		}
+	}
+}
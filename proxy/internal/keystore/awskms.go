@@ -0,0 +1,177 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/awssig"
+)
+
+// AWSKMS is a Provider that uses asymmetric keys in the AWS Key Management
+// Service. The key IDs are key IDs, key ARNs, or alias names.
+type AWSKMS struct {
+	endpoint string
+	region   string
+	keyID    string
+	secret   string
+	client   *http.Client
+}
+
+// NewAWSKMS returns a new AWSKMS provider. The default endpoint is
+// https://kms.<region>.amazonaws.com/.
+func NewAWSKMS(endpoint, region, accessKeyID, secretAccessKey string) (*AWSKMS, error) {
+	if endpoint == "" {
+		endpoint = "https://kms." + region + ".amazonaws.com/"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	return &AWSKMS{
+		endpoint: endpoint,
+		region:   region,
+		keyID:    accessKeyID,
+		secret:   secretAccessKey,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Signer implements Provider. It fetches the public key of keyID.
+func (k *AWSKMS) Signer(ctx context.Context, keyID string) (crypto.Signer, error) {
+	var resp struct {
+		PublicKey []byte
+	}
+	if err := k.call(ctx, "GetPublicKey", map[string]any{"KeyId": keyID}, &resp); err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("kms: %w", err)
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("kms: unsupported key type %T", pub)
+	}
+	return &kmsSigner{kms: k, keyID: keyID, pub: pub}, nil
+}
+
+type kmsSigner struct {
+	kms   *AWSKMS
+	keyID string
+	pub   crypto.PublicKey
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var alg string
+	switch s.pub.(type) {
+	case *ecdsa.PublicKey:
+		alg = "ECDSA_SHA_"
+	case *rsa.PublicKey:
+		alg = "RSASSA_PKCS1_V1_5_SHA_"
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			alg = "RSASSA_PSS_SHA_"
+		}
+	}
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		alg += "256"
+	case crypto.SHA384:
+		alg += "384"
+	case crypto.SHA512:
+		alg += "512"
+	default:
+		return nil, fmt.Errorf("kms: unsupported hash %v", opts.HashFunc())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var resp struct {
+		Signature []byte
+	}
+	if err := s.kms.call(ctx, "Sign", map[string]any{
+		"KeyId":            s.keyID,
+		"Message":          digest,
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": alg,
+	}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// call calls a KMS API action. []byte values are base64-encoded by
+// encoding/json, which is what the API expects.
+func (k *AWSKMS) call(ctx context.Context, action string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("content-type", "application/x-amz-json-1.1")
+	httpReq.Header.Set("x-amz-target", "TrentService."+action)
+	httpReq.Header.Set("user-agent", "tlsproxy")
+	awssig.Sign(httpReq, body, k.keyID, k.secret, k.region, "kms", time.Now())
+	httpResp, err := k.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Type != "" {
+			return fmt.Errorf("kms %s: %s: %s", action, e.Type, e.Message)
+		}
+		return fmt.Errorf("kms %s: %s", action, httpResp.Status)
+	}
+	if err := json.Unmarshal(b, resp); err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+	return nil
+}
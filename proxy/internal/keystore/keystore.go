@@ -0,0 +1,86 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package keystore provides private keys that are kept in hardware security
+// modules, Trusted Platform Modules, or cloud key management services, instead
+// of on disk. The keys are used with the crypto.Signer interface.
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Provider is a key store.
+type Provider interface {
+	// Signer returns the key with the given ID. The format of the ID
+	// depends on the provider.
+	Signer(ctx context.Context, keyID string) (crypto.Signer, error)
+}
+
+// Opener returns a new Provider. The options are provider-specific, e.g. the
+// path of a PKCS#11 module, a token label, and a PIN.
+type Opener func(options map[string]string) (Provider, error)
+
+var (
+	mu      sync.Mutex
+	openers = make(map[string]Opener)
+)
+
+// Register makes a key store type available. It is meant to be called by
+// programs that embed the proxy to add providers that aren't built in, e.g.
+// PKCS#11, which requires cgo.
+func Register(typ string, f Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, exists := openers[typ]; exists {
+		panic("keystore: Register called twice for " + typ)
+	}
+	openers[typ] = f
+}
+
+// Registered returns the key store types that were registered.
+func Registered() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]string, 0, len(openers))
+	for typ := range openers {
+		out = append(out, typ)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Open opens a key store of a registered type.
+func Open(typ string, options map[string]string) (Provider, error) {
+	mu.Lock()
+	f, ok := openers[typ]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("keystore: unknown type %q", typ)
+	}
+	return f(options)
+}
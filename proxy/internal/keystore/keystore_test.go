@@ -0,0 +1,209 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tpm"
+	"github.com/google/go-tpm-tools/simulator"
+)
+
+func TestAWSKMS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	keys := map[string]crypto.Signer{
+		"ec-key":  ecKey,
+		"rsa-key": rsaKey,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("authorization"), "AWS4-HMAC-SHA256 Credential=keyid/") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"UnrecognizedClientException","message":"bad credentials"}`))
+			return
+		}
+		var in struct {
+			KeyId            string
+			Message          []byte
+			SigningAlgorithm string
+		}
+		if err := json.NewDecoder(req.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key, ok := keys[in.KeyId]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"NotFoundException","message":"key not found"}`))
+			return
+		}
+		switch req.Header.Get("x-amz-target") {
+		case "TrentService.GetPublicKey":
+			der, _ := x509.MarshalPKIXPublicKey(key.Public())
+			json.NewEncoder(w).Encode(map[string]any{"KeyId": in.KeyId, "PublicKey": der})
+		case "TrentService.Sign":
+			var opts crypto.SignerOpts = crypto.SHA256
+			if strings.HasPrefix(in.SigningAlgorithm, "RSASSA_PSS_") {
+				opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+			}
+			if !strings.HasSuffix(in.SigningAlgorithm, "_SHA_256") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			sig, err := key.Sign(rand.Reader, in.Message, opts)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Signature": sig, "SigningAlgorithm": in.SigningAlgorithm})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	kms, err := NewAWSKMS(srv.URL, "us-east-1", "keyid", "secret")
+	if err != nil {
+		t.Fatalf("NewAWSKMS: %v", err)
+	}
+	ctx := context.Background()
+	digest := sha256.Sum256([]byte("hello"))
+
+	ec, err := kms.Signer(ctx, "ec-key")
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	sig, err := ec.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(ec.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("invalid ECDSA signature")
+	}
+
+	rs, err := kms.Signer(ctx, "rsa-key")
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	if sig, err = rs.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(rs.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("VerifyPKCS1v15: %v", err)
+	}
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	if sig, err = rs.Sign(rand.Reader, digest[:], pss); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if err := rsa.VerifyPSS(rs.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig, pss); err != nil {
+		t.Errorf("VerifyPSS: %v", err)
+	}
+
+	if _, err := kms.Signer(ctx, "unknown"); err == nil || !strings.Contains(err.Error(), "NotFoundException") {
+		t.Errorf("Signer(unknown) err = %v, want NotFoundException", err)
+	}
+}
+
+func TestTPM(t *testing.T) {
+	rwc, err := simulator.Get()
+	if err != nil {
+		t.Fatalf("simulator.Get: %v", err)
+	}
+	tp, err := tpm.New(tpm.WithTPM(rwc))
+	if err != nil {
+		t.Fatalf("tpm.New: %v", err)
+	}
+	defer tp.Close()
+
+	p := NewTPM(tp)
+	ctx := context.Background()
+	keyFile := filepath.Join(t.TempDir(), "key.tpm")
+	if _, err := p.Signer(ctx, "key.tpm"); err == nil {
+		t.Error("Signer() with relative file name succeeded")
+	}
+	s1, err := p.Signer(ctx, keyFile)
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	// The second time, the key is loaded from the file.
+	s2, err := p.Signer(ctx, keyFile)
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	if !s1.Public().(*ecdsa.PublicKey).Equal(s2.Public()) {
+		t.Error("public keys are different")
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := s2.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(s1.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("invalid signature")
+	}
+}
+
+type fakeProvider struct{}
+
+func (fakeProvider) Signer(context.Context, string) (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func TestRegister(t *testing.T) {
+	Register("keystore-test", func(opts map[string]string) (Provider, error) {
+		return fakeProvider{}, nil
+	})
+	if got := Registered(); len(got) != 1 || got[0] != "keystore-test" {
+		t.Errorf("Registered() = %q", got)
+	}
+	p, err := Open("keystore-test", nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := p.Signer(context.Background(), "foo"); err != nil {
+		t.Errorf("Signer: %v", err)
+	}
+	if _, err := Open("nonexistent", nil); err == nil {
+		t.Error("Open(nonexistent) succeeded")
+	}
+}
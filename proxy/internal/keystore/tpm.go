@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package keystore
+
+import (
+	"context"
+	"crypto"
+	"crypto/elliptic"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/c2FmZQ/tpm"
+)
+
+// TPM is a Provider that uses keys in the Trusted Platform Module. The key
+// IDs are the names of files where the keys are stored, wrapped by the TPM.
+// The keys can only be used with the TPM that created them. A new ECDSA P-256
+// key is created when the file doesn't exist.
+type TPM struct {
+	open func() (*tpm.TPM, error)
+
+	mu  sync.Mutex
+	tpm *tpm.TPM
+}
+
+// NewTPM returns a new TPM provider. The TPM is opened when it is first
+// needed. If t is not nil, it is used instead of the default TPM device.
+func NewTPM(t *tpm.TPM) *TPM {
+	return &TPM{
+		tpm: t,
+		open: func() (*tpm.TPM, error) {
+			return tpm.New()
+		},
+	}
+}
+
+// Signer implements Provider.
+func (p *TPM) Signer(_ context.Context, keyID string) (crypto.Signer, error) {
+	if len(keyID) == 0 || keyID[0] != '/' {
+		return nil, errors.New("tpm: the key ID must be an absolute file name")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tpm == nil {
+		t, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+		p.tpm = t
+	}
+	b, err := os.ReadFile(keyID)
+	if err == nil {
+		return p.tpm.UnmarshalKey(b)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := p.tpm.CreateKey(tpm.WithECC(elliptic.P256()))
+	if err != nil {
+		return nil, err
+	}
+	if b, err = key.Marshal(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyID, b, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,159 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package logging converts the messages from the standard log package into
+// structured log records. The proxy's log messages start with a three-letter
+// tag, e.g. INF or ERR, which is used to determine the level of the records.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Options contains the parameters of a Writer.
+type Options struct {
+	// Handler receives the log records.
+	Handler slog.Handler
+	// Level is the minimum level of the records that are sent to the
+	// handler.
+	Level slog.Level
+	// ComponentLevels optionally overrides Level for some components.
+	ComponentLevels map[string]slog.Level
+	// Component returns the name of the component that logged a message,
+	// given the function that called the log package.
+	Component func(frame runtime.Frame) string
+}
+
+// Writer is an io.Writer to use with log.SetOutput. It sends each message to
+// a slog.Handler. The log flags should be set to 0, since the records have
+// their own timestamps.
+type Writer struct {
+	opts Options
+}
+
+// New returns a new Writer.
+func New(opts Options) *Writer {
+	return &Writer{opts: opts}
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(b []byte) (int, error) {
+	n := len(b)
+	msg := string(bytes.TrimRight(b, "\n"))
+	level := slog.LevelInfo
+	var tag string
+	if t, rest, ok := strings.Cut(msg, " "); ok && isTag(t) {
+		tag, msg = t, rest
+		level = LevelFromTag(tag)
+	}
+	var pc uintptr
+	component := "proxy"
+	if frame, ok := caller(); ok {
+		pc = frame.PC
+		if w.opts.Component != nil {
+			component = w.opts.Component(frame)
+		}
+	}
+	minLevel := w.opts.Level
+	if l, ok := w.opts.ComponentLevels[component]; ok {
+		minLevel = l
+	}
+	ctx := context.Background()
+	if level < minLevel || !w.opts.Handler.Enabled(ctx, level) {
+		return n, nil
+	}
+	r := slog.NewRecord(time.Now(), level, msg, pc)
+	r.AddAttrs(slog.String("component", component))
+	if tag != "" {
+		r.AddAttrs(slog.String("tag", tag))
+	}
+	if err := w.opts.Handler.Handle(ctx, r); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// caller returns the frame of the function that called the log package.
+func caller() (runtime.Frame, bool) {
+	var pcs [16]uintptr
+	// Skip runtime.Callers, caller, and Writer.Write.
+	n := runtime.Callers(3, pcs[:])
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "log.") {
+			return frame, true
+		}
+		if !more {
+			return runtime.Frame{}, false
+		}
+	}
+}
+
+func isTag(s string) bool {
+	if len(s) < 3 || len(s) > 5 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// LevelFromTag returns the level that corresponds to a message tag.
+func LevelFromTag(tag string) slog.Level {
+	switch tag {
+	case "DBG":
+		return slog.LevelDebug
+	case "WRN", "BAD":
+		return slog.LevelWarn
+	case "ERR", "FATAL":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// ParseLevel parses a level name: debug, info, warn, or error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid level %q", s)
+	}
+}
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := New(Options{
+		Handler: slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		Level:   slog.LevelInfo,
+		ComponentLevels: map[string]slog.Level{
+			"noisy": slog.LevelError,
+		},
+		Component: func(frame runtime.Frame) string {
+			if strings.HasSuffix(frame.Function, ".noisy") {
+				return "noisy"
+			}
+			return "test"
+		},
+	})
+	logger := log.New(w, "", 0)
+	logger.Print("INF hello world")
+	logger.Print("DBG not logged")
+	logger.Printf("ERR %s", "failed")
+	logger.Print("no tag")
+	noisy(logger)
+
+	var got []map[string]any
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var m map[string]any
+		if err := dec.Decode(&m); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		delete(m, "time")
+		got = append(got, m)
+	}
+	want := []map[string]any{
+		{"level": "INFO", "msg": "hello world", "component": "test", "tag": "INF"},
+		{"level": "ERROR", "msg": "failed", "component": "test", "tag": "ERR"},
+		{"level": "INFO", "msg": "no tag", "component": "test"},
+		{"level": "ERROR", "msg": "noisy error", "component": "noisy", "tag": "ERR"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d records, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		for k, v := range want[i] {
+			if got[i][k] != v {
+				t.Errorf("[%d] %s = %v, want %v", i, k, got[i][k], v)
+			}
+		}
+		if len(got[i]) != len(want[i]) {
+			t.Errorf("[%d] Got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func noisy(logger *log.Logger) {
+	logger.Print("WRN noisy warning")
+	logger.Print("ERR noisy error")
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want slog.Level
+	}{
+		{"", slog.LevelInfo},
+		{"debug", slog.LevelDebug},
+		{"WARN", slog.LevelWarn},
+		{"error", slog.LevelError},
+	} {
+		got, err := ParseLevel(tc.in)
+		if err != nil || got != tc.want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		}
+	}
+	if _, err := ParseLevel("foo"); err == nil {
+		t.Error("ParseLevel(foo) succeeded unexpectedly")
+	}
+}
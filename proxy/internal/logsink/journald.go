@@ -0,0 +1,99 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+// DefaultJournaldSocket is the path of journald's native protocol socket.
+const DefaultJournaldSocket = "/run/systemd/journal/socket"
+
+// Journald is a Sink that sends messages to systemd-journald with its native
+// protocol. Each message is a datagram with the MESSAGE, PRIORITY,
+// SYSLOG_FACILITY, SYSLOG_IDENTIFIER, and SYSLOG_PID fields. Messages that
+// don't fit in a datagram are rejected.
+type Journald struct {
+	conn   net.Conn
+	fields []byte
+}
+
+// DialJournald connects to journald's socket. If socket is empty, the default
+// socket is used.
+func DialJournald(socket, tag string, facility Facility) (*Journald, error) {
+	if socket == "" {
+		socket = DefaultJournaldSocket
+	}
+	if tag == "" {
+		tag = "tlsproxy"
+	}
+	conn, err := net.DialTimeout("unixgram", socket, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("journald: %w", err)
+	}
+	var fields []byte
+	fields = appendJournalField(fields, "SYSLOG_FACILITY", []byte(strconv.Itoa(int(facility))))
+	fields = appendJournalField(fields, "SYSLOG_IDENTIFIER", []byte(tag))
+	fields = appendJournalField(fields, "SYSLOG_PID", []byte(strconv.Itoa(os.Getpid())))
+	return &Journald{conn: conn, fields: fields}, nil
+}
+
+// Send implements Sink.
+func (j *Journald) Send(level slog.Level, msg []byte) error {
+	b := appendJournalField(nil, "PRIORITY", []byte(strconv.Itoa(Severity(level))))
+	b = append(b, j.fields...)
+	b = appendJournalField(b, "MESSAGE", msg)
+	if _, err := j.conn.Write(b); err != nil {
+		return fmt.Errorf("journald: %w", err)
+	}
+	return nil
+}
+
+// Close implements Sink.
+func (j *Journald) Close() error {
+	return j.conn.Close()
+}
+
+// appendJournalField appends a field in the native protocol's format: KEY=value
+// followed by a newline, or, when the value contains newlines, KEY followed by
+// a newline, the value's length as a 64-bit little-endian integer, the value,
+// and a newline.
+func appendJournalField(b []byte, key string, value []byte) []byte {
+	b = append(b, key...)
+	if !bytes.ContainsRune(value, '\n') {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+	return append(b, '\n')
+}
@@ -0,0 +1,192 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package logsink sends log messages to syslog servers, with the RFC 5424
+// protocol, and to systemd-journald, with its native protocol. The levels of
+// the messages are mapped to syslog severities.
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Sink is the destination of log messages.
+type Sink interface {
+	// Send sends one message with the given level.
+	Send(level slog.Level, msg []byte) error
+	io.Closer
+}
+
+// Facility is a syslog facility.
+type Facility int
+
+// The syslog facilities, from RFC 5424.
+var facilities = map[string]Facility{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// FacilityDaemon is the default facility.
+const FacilityDaemon Facility = 3
+
+// ParseFacility parses a facility name, e.g. daemon or local0. The empty
+// string is the daemon facility.
+func ParseFacility(s string) (Facility, error) {
+	if s == "" {
+		return FacilityDaemon, nil
+	}
+	f, ok := facilities[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid facility %q", s)
+	}
+	return f, nil
+}
+
+// Severity returns the syslog severity of a log level: debug (7), info (6),
+// warning (4), or err (3).
+func Severity(level slog.Level) int {
+	switch {
+	case level < slog.LevelInfo:
+		return 7
+	case level < slog.LevelWarn:
+		return 6
+	case level < slog.LevelError:
+		return 4
+	default:
+		return 3
+	}
+}
+
+// Writer is an io.Writer that sends each write to a Sink as one message.
+type Writer struct {
+	sink  Sink
+	level slog.Level
+}
+
+// NewWriter returns a Writer that sends messages to s with the given level.
+func NewWriter(s Sink, level slog.Level) *Writer {
+	return &Writer{sink: s, level: level}
+}
+
+// Write implements io.Writer.
+func (w *Writer) Write(b []byte) (int, error) {
+	return w.WriteLevel(w.level, b)
+}
+
+// WriteLevel sends b to the sink with a different level.
+func (w *Writer) WriteLevel(level slog.Level, b []byte) (int, error) {
+	if err := w.sink.Send(level, bytes.TrimRight(b, "\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the sink.
+func (w *Writer) Close() error {
+	return w.sink.Close()
+}
+
+// NewHandler returns a slog.Handler that formats the records in text or JSON
+// format, and sends them to s with their level. The time of the records is
+// omitted, since syslog and journald have their own timestamps.
+func NewHandler(s Sink, json bool) slog.Handler {
+	out := &handlerOutput{sink: s}
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	var h slog.Handler
+	if json {
+		h = slog.NewJSONHandler(out, opts)
+	} else {
+		h = slog.NewTextHandler(out, opts)
+	}
+	return &handler{h: h, out: out}
+}
+
+type handlerOutput struct {
+	mu    sync.Mutex
+	sink  Sink
+	level slog.Level
+}
+
+// Write is called by the inner handler while out.mu is locked.
+func (out *handlerOutput) Write(b []byte) (int, error) {
+	if err := out.sink.Send(out.level, bytes.TrimRight(b, "\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+type handler struct {
+	h   slog.Handler
+	out *handlerOutput
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.h.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{h: h.h.WithAttrs(attrs), out: h.out}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h: h.h.WithGroup(name), out: h.out}
+}
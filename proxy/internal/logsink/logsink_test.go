@@ -0,0 +1,266 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package logsink
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+type testSink struct {
+	levels []slog.Level
+	msgs   []string
+}
+
+func (s *testSink) Send(level slog.Level, msg []byte) error {
+	s.levels = append(s.levels, level)
+	s.msgs = append(s.msgs, string(msg))
+	return nil
+}
+
+func (s *testSink) Close() error { return nil }
+
+func TestSeverity(t *testing.T) {
+	for _, tc := range []struct {
+		level slog.Level
+		want  int
+	}{
+		{slog.LevelDebug, 7},
+		{slog.LevelInfo, 6},
+		{slog.LevelWarn, 4},
+		{slog.LevelError, 3},
+		{slog.LevelError + 4, 3},
+	} {
+		if got := Severity(tc.level); got != tc.want {
+			t.Errorf("Severity(%v) = %d, want %d", tc.level, got, tc.want)
+		}
+	}
+	if f, err := ParseFacility("LOCAL3"); err != nil || f != 19 {
+		t.Errorf("ParseFacility(LOCAL3) = %d, %v", f, err)
+	}
+	if f, err := ParseFacility(""); err != nil || f != FacilityDaemon {
+		t.Errorf("ParseFacility('') = %d, %v", f, err)
+	}
+	if _, err := ParseFacility("local8"); err == nil {
+		t.Error("ParseFacility(local8) didn't fail")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := &testSink{}
+	logger := slog.New(NewHandler(s, false)).With("component", "proxy")
+	logger.Warn("hello", "n", 1)
+	logger.Debug("world")
+	want := []string{
+		"level=WARN msg=hello component=proxy n=1",
+		"level=DEBUG msg=world component=proxy",
+	}
+	if fmt.Sprint(s.msgs) != fmt.Sprint(want) {
+		t.Errorf("msgs = %q, want %q", s.msgs, want)
+	}
+	if fmt.Sprint(s.levels) != fmt.Sprint([]slog.Level{slog.LevelWarn, slog.LevelDebug}) {
+		t.Errorf("levels = %v", s.levels)
+	}
+
+	s = &testSink{}
+	w := NewWriter(s, slog.LevelInfo)
+	fmt.Fprintln(w, "line 1")
+	w.WriteLevel(slog.LevelWarn, []byte("line 2\n"))
+	if fmt.Sprint(s.msgs) != "[line 1 line 2]" || fmt.Sprint(s.levels) != "[INFO WARN]" {
+		t.Errorf("msgs = %q levels = %v", s.msgs, s.levels)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+	s, err := DialSyslog(SyslogOptions{
+		Network:  "udp",
+		Address:  pc.LocalAddr().String(),
+		Facility: 16,
+		Hostname: "my host",
+	})
+	if err != nil {
+		t.Fatalf("DialSyslog: %v", err)
+	}
+	defer s.Close()
+	if err := s.Send(slog.LevelWarn, []byte("hello world")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	re := regexp.MustCompile(`^<132>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) myhost tlsproxy \d+ - - hello world$`)
+	if got := string(buf[:n]); !re.MatchString(got) {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestSyslogStream(t *testing.T) {
+	cm, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	for _, network := range []string{"tcp", "tls"} {
+		t.Run(network, func(t *testing.T) {
+			var l net.Listener
+			var err error
+			if network == "tls" {
+				l, err = tls.Listen("tcp", "127.0.0.1:0", cm.TLSConfig())
+			} else {
+				l, err = net.Listen("tcp", "127.0.0.1:0")
+			}
+			if err != nil {
+				t.Fatalf("Listen: %v", err)
+			}
+			defer l.Close()
+
+			ch := make(chan net.Conn, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					t.Errorf("Accept: %v", err)
+					close(ch)
+					return
+				}
+				if tc, ok := conn.(*tls.Conn); ok {
+					tc.Handshake()
+				}
+				ch <- conn
+			}()
+
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			s, err := DialSyslog(SyslogOptions{
+				Network:   network,
+				Address:   net.JoinHostPort("localhost", port),
+				TLSConfig: &tls.Config{RootCAs: cm.RootCACertPool()},
+				Tag:       "test",
+				Facility:  FacilityDaemon,
+			})
+			if err != nil {
+				t.Fatalf("DialSyslog: %v", err)
+			}
+			defer s.Close()
+
+			conn := <-ch
+			if conn == nil {
+				t.FailNow()
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for _, msg := range []string{"one", "two\nlines"} {
+				if err := s.Send(slog.LevelError, []byte(msg)); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				size, err := r.ReadString(' ')
+				if err != nil {
+					t.Fatalf("ReadString: %v", err)
+				}
+				n, err := strconv.Atoi(strings.TrimSpace(size))
+				if err != nil {
+					t.Fatalf("Atoi(%q): %v", size, err)
+				}
+				b := make([]byte, n)
+				if _, err := io.ReadFull(r, b); err != nil {
+					t.Fatalf("ReadFull: %v", err)
+				}
+				if got := string(b); !strings.HasPrefix(got, "<27>1 ") || !strings.HasSuffix(got, " test "+strconv.Itoa(os.Getpid())+" - - "+msg) {
+					t.Errorf("Got %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestSyslogLocal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+	s, err := DialSyslog(SyslogOptions{Address: path, Facility: FacilityDaemon})
+	if err != nil {
+		t.Fatalf("DialSyslog: %v", err)
+	}
+	defer s.Close()
+	if err := s.Send(slog.LevelInfo, []byte("hello")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	re := regexp.MustCompile(`^<30>[A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d tlsproxy\[\d+\]: hello$`)
+	if got := string(buf[:n]); !re.MatchString(got) {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestJournald(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skipf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+	j, err := DialJournald(path, "", 17)
+	if err != nil {
+		t.Fatalf("DialJournald: %v", err)
+	}
+	defer j.Close()
+	if err := j.Send(slog.LevelDebug, []byte("two\nlines")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], 9)
+	want := "PRIORITY=7\nSYSLOG_FACILITY=17\nSYSLOG_IDENTIFIER=tlsproxy\nSYSLOG_PID=" + strconv.Itoa(os.Getpid()) + "\nMESSAGE\n" + string(size[:]) + "two\nlines\n"
+	if got := string(buf[:n]); got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
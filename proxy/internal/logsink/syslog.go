@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package logsink
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 5 * time.Second
+)
+
+// The paths of the local syslog socket on different systems.
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// SyslogOptions contains the parameters of a Syslog sink.
+type SyslogOptions struct {
+	// Network is one of udp, tcp, tls, unix, or unixgram. When Network
+	// and Address are empty, the local syslog server is used.
+	Network string
+	// Address is the address of the syslog server, e.g. 192.168.0.1:514,
+	// or the path of a unix socket.
+	Address string
+	// TLSConfig is used with the tls network.
+	TLSConfig *tls.Config
+	// Tag is the APP-NAME of the messages. The default is tlsproxy.
+	Tag string
+	// Facility is the facility of the messages.
+	Facility Facility
+	// Hostname is the HOSTNAME of the messages. The default is the
+	// system's hostname.
+	Hostname string
+}
+
+// Syslog is a Sink that sends messages to a syslog server. Remote servers
+// receive RFC 5424 messages, in datagrams with udp, and with octet-counting
+// framing (RFC 6587, RFC 5425) with tcp and tls. The local server receives
+// the traditional format that local syslog daemons expect. After an error,
+// the connection is re-established on the next message.
+type Syslog struct {
+	opts  SyslogOptions
+	local bool
+	pid   int
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// DialSyslog connects to a syslog server.
+func DialSyslog(opts SyslogOptions) (*Syslog, error) {
+	switch opts.Network {
+	case "", "unix", "unixgram":
+	case "udp", "tcp", "tls":
+		if opts.Address == "" {
+			return nil, fmt.Errorf("syslog: %s network requires an address", opts.Network)
+		}
+	default:
+		return nil, fmt.Errorf("syslog: invalid network %q", opts.Network)
+	}
+	if opts.Tag == "" {
+		opts.Tag = "tlsproxy"
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	s := &Syslog{
+		opts:  opts,
+		local: opts.Network == "" || opts.Network == "unix" || opts.Network == "unixgram",
+		pid:   os.Getpid(),
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	var err error
+	switch s.opts.Network {
+	case "":
+		s.conn, err = dialLocalSyslog(s.opts.Address)
+	case "tls":
+		d := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: dialTimeout},
+			Config:    s.opts.TLSConfig,
+		}
+		s.conn, err = d.Dial("tcp", s.opts.Address)
+	default:
+		s.conn, err = net.DialTimeout(s.opts.Network, s.opts.Address, dialTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	return nil
+}
+
+func dialLocalSyslog(addr string) (net.Conn, error) {
+	paths := localSyslogPaths
+	if addr != "" {
+		paths = []string{addr}
+	}
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range paths {
+			if conn, err := net.DialTimeout(network, path, dialTimeout); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, errors.New("local syslog server not found")
+}
+
+// Send implements Sink.
+func (s *Syslog) Send(level slog.Level, msg []byte) error {
+	b := s.format(time.Now(), level, msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = s.conn.Write(b); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// Close implements Sink.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Syslog) format(now time.Time, level slog.Level, msg []byte) []byte {
+	pri := int(s.opts.Facility)*8 + Severity(level)
+	if s.local {
+		// <PRI>TIMESTAMP TAG[PID]: MSG
+		b := fmt.Appendf(nil, "<%d>%s %s[%d]: ", pri, now.Format(time.Stamp), s.opts.Tag, s.pid)
+		b = append(b, msg...)
+		if s.opts.Network == "unix" {
+			b = append(b, '\n')
+		}
+		return b
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	b := fmt.Appendf(nil, "<%d>1 %s %s %s %d - - ", pri,
+		now.Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(s.opts.Hostname, 255),
+		headerField(s.opts.Tag, 48),
+		s.pid)
+	b = append(b, msg...)
+	if s.opts.Network == "udp" {
+		return b
+	}
+	// Octet-counting framing.
+	return append(strconv.AppendInt(nil, int64(len(b)), 10), append([]byte{' '}, b...)...)
+}
+
+// headerField returns s as a valid RFC 5424 header field: printable US-ASCII
+// characters, without spaces, and at most maxLen characters.
+func headerField(s string, maxLen int) string {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(b) < maxLen; i++ {
+		if c := s[i]; c > ' ' && c < 0x7f {
+			b = append(b, c)
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
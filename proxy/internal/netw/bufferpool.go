@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package netw
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBufferSize is the size of the copy buffers when no size is specified.
+const DefaultBufferSize = 32 * 1024
+
+var bufferPools sync.Map // map[int]*BufferPool
+
+// BufferPool is a pool of copy buffers that all have the same size. The pools
+// are shared by all the connections that use the same buffer size.
+type BufferPool struct {
+	size   int
+	pool   sync.Pool
+	gets   atomic.Int64
+	allocs atomic.Int64
+}
+
+// BufferPoolStats contains the statistics of a BufferPool.
+type BufferPoolStats struct {
+	// Size is the size of the buffers.
+	Size int
+	// Gets is the number of buffers taken from the pool.
+	Gets int64
+	// Allocs is the number of buffers that were allocated because the
+	// pool was empty.
+	Allocs int64
+}
+
+// BufferPoolFor returns the pool of buffers of the given size. If size is 0,
+// DefaultBufferSize is used.
+func BufferPoolFor(size int) *BufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if p, ok := bufferPools.Load(size); ok {
+		return p.(*BufferPool)
+	}
+	bp := &BufferPool{size: size}
+	bp.pool.New = func() any {
+		bp.allocs.Add(1)
+		b := make([]byte, size)
+		return &b
+	}
+	p, _ := bufferPools.LoadOrStore(size, bp)
+	return p.(*BufferPool)
+}
+
+// AllBufferPoolStats returns the statistics of all the buffer pools, sorted
+// by buffer size.
+func AllBufferPoolStats() []BufferPoolStats {
+	var out []BufferPoolStats
+	bufferPools.Range(func(_, v any) bool {
+		out = append(out, v.(*BufferPool).Stats())
+		return true
+	})
+	slices.SortFunc(out, func(a, b BufferPoolStats) int {
+		return a.Size - b.Size
+	})
+	return out
+}
+
+// Stats returns the pool's statistics.
+func (p *BufferPool) Stats() BufferPoolStats {
+	return BufferPoolStats{
+		Size:   p.size,
+		Gets:   p.gets.Load(),
+		Allocs: p.allocs.Load(),
+	}
+}
+
+func (p *BufferPool) get() *[]byte {
+	p.gets.Add(1)
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *BufferPool) put(b *[]byte) {
+	p.pool.Put(b)
+}
@@ -0,0 +1,103 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package netw
+
+import (
+	"io"
+	"net"
+)
+
+// spliceChunkSize is the maximum number of bytes moved by each splice. It
+// keeps the byte counters up to date on long-lived connections.
+const spliceChunkSize = 1 << 20
+
+// Copy copies data from src to dst until EOF or an error occurs. It returns
+// the number of bytes copied.
+//
+// When both connections are plain TCP connections without rate limits, the
+// data is moved inside the kernel with splice(2) on Linux. Otherwise, or on
+// other platforms, the data is copied through a buffer from pool, like
+// io.CopyBuffer. If pool is nil, the pool of DefaultBufferSize buffers is
+// used.
+func Copy(dst, src net.Conn, pool *BufferPool) (int64, error) {
+	d, dok := dst.(*Conn)
+	s, sok := src.(*Conn)
+	if !dok || !sok {
+		return copyBuffer(dst, src, pool)
+	}
+	dtcp, stcp, ok := spliceable(d, s)
+	if !ok {
+		return copyBuffer(dst, src, pool)
+	}
+
+	var total int64
+	if len(s.peekBuf) > 0 {
+		buf := s.peekBuf
+		s.peekBuf = nil
+		s.bytesReceived.Incr(int64(len(buf)))
+		s.upBytesReceived.Incr(int64(len(buf)))
+		n, err := d.Write(buf)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	for {
+		n, err := dtcp.ReadFrom(&io.LimitedReader{R: stcp, N: spliceChunkSize})
+		total += n
+		s.bytesReceived.Incr(n)
+		s.upBytesReceived.Incr(n)
+		d.bytesSent.Incr(n)
+		d.upBytesSent.Incr(n)
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+	}
+}
+
+func copyBuffer(dst, src net.Conn, pool *BufferPool) (int64, error) {
+	if pool == nil {
+		pool = BufferPoolFor(DefaultBufferSize)
+	}
+	buf := pool.get()
+	defer pool.put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func spliceable(dst, src *Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if dst.egressLimiter != nil || src.ingressLimiter != nil {
+		return nil, nil, false
+	}
+	d, ok := dst.Conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	s, ok := src.Conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	return d, s, true
+}
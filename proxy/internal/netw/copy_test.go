@@ -0,0 +1,160 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package netw_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"golang.org/x/time/rate"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// tcpPair returns the two ends of a TCP connection.
+func tcpPair(t testing.TB) (*netw.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+		}
+		ch <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	return netw.NewConn(<-ch), c
+}
+
+func TestCopy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		limiter  *rate.Limiter
+		bufSize  int
+		wantGets bool
+	}{
+		{name: "splice", bufSize: 1024},
+		{name: "userspace", limiter: rate.NewLimiter(rate.Inf, 0), bufSize: 2048, wantGets: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, client := tcpPair(t)
+			defer src.Close()
+			defer client.Close()
+			dst, server := tcpPair(t)
+			defer dst.Close()
+			defer server.Close()
+			src.SetLimiters(tc.limiter, nil)
+
+			data := make([]byte, 3<<20)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatalf("rand.Read: %v", err)
+			}
+			go func() {
+				client.Write(data)
+				client.Close()
+			}()
+			// Peeked data must be copied too.
+			peek := make([]byte, 10)
+			if _, err := src.Peek(peek); err != nil {
+				t.Fatalf("Peek: %v", err)
+			}
+
+			ch := make(chan []byte)
+			go func() {
+				b, _ := io.ReadAll(server)
+				ch <- b
+			}()
+			pool := netw.BufferPoolFor(tc.bufSize)
+			n, err := netw.Copy(dst, src, pool)
+			if err != nil {
+				t.Fatalf("Copy: %v", err)
+			}
+			dst.Close()
+			if got, want := n, int64(len(data)); got != want {
+				t.Errorf("Copy() = %d, want %d", got, want)
+			}
+			if got := <-ch; !bytes.Equal(got, data) {
+				t.Errorf("Received %d bytes, want %d bytes", len(got), len(data))
+			}
+			if got, want := src.BytesReceived(), int64(len(data)); got != want {
+				t.Errorf("BytesReceived() = %d, want %d", got, want)
+			}
+			if got, want := dst.BytesSent(), int64(len(data)); got != want {
+				t.Errorf("BytesSent() = %d, want %d", got, want)
+			}
+			stats := pool.Stats()
+			if got, want := stats.Size, tc.bufSize; got != want {
+				t.Errorf("Stats().Size = %d, want %d", got, want)
+			}
+			if got, want := stats.Gets > 0, tc.wantGets; got != want {
+				t.Errorf("Stats().Gets = %d, want > 0: %v", stats.Gets, want)
+			}
+			if got := netw.AllBufferPoolStats(); !slices.Contains(got, stats) {
+				t.Errorf("AllBufferPoolStats() = %v, want %v", got, stats)
+			}
+		})
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		copy func(dst, src net.Conn) (int64, error)
+	}{
+		{name: "netw.Copy", copy: func(dst, src net.Conn) (int64, error) { return netw.Copy(dst, src, nil) }},
+		{name: "io.Copy", copy: func(dst, src net.Conn) (int64, error) { return io.Copy(dst, src) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			src, client := tcpPair(b)
+			defer src.Close()
+			dst, server := tcpPair(b)
+			defer dst.Close()
+
+			buf := make([]byte, 1<<20)
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			go func() {
+				for i := 0; i < b.N; i++ {
+					client.Write(buf)
+				}
+				client.Close()
+			}()
+			go io.Copy(io.Discard, server)
+			b.ResetTimer()
+			if _, err := bc.copy(dst, src); err != nil {
+				b.Fatalf("Copy: %v", err)
+			}
+		})
+	}
+}
@@ -27,8 +27,10 @@ package netw
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -47,6 +49,11 @@ func Listen(network, laddr string) (net.Listener, error) {
 	return listener{l}, nil
 }
 
+// NewListener returns a wrapper around l that returns *Conn connections.
+func NewListener(l net.Listener) net.Listener {
+	return listener{l}
+}
+
 type listener struct {
 	net.Listener
 }
@@ -92,7 +99,8 @@ type Conn struct {
 	upBytesSent     *counter.Counter
 	upBytesReceived *counter.Counter
 
-	peekBuf []byte
+	peekBuf      []byte
+	peekDeadline time.Time
 
 	mu          sync.Mutex
 	onClose     func()
@@ -180,13 +188,25 @@ func (c *Conn) OnClose(f func()) {
 	c.onClose = f
 }
 
+// SetPeekDeadline sets the deadline for future Peek calls. A zero value
+// means that each Peek call has 30 seconds to complete.
+func (c *Conn) SetPeekDeadline(t time.Time) {
+	c.peekDeadline = t
+}
+
 func (c *Conn) Peek(b []byte) (int, error) {
 	want := len(b)
 	have := len(c.peekBuf)
+	var readErr error
 	if want > have {
-		c.Conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		deadline := c.peekDeadline
+		if deadline.IsZero() {
+			deadline = time.Now().Add(30 * time.Second)
+		}
+		c.Conn.SetReadDeadline(deadline)
 		bb := make([]byte, want-have)
-		n, _ := io.ReadFull(c.Conn, bb)
+		var n int
+		n, readErr = io.ReadFull(c.Conn, bb)
 		c.peekBuf = append(c.peekBuf, bb[:n]...)
 		c.Conn.SetReadDeadline(time.Time{})
 	}
@@ -194,6 +214,9 @@ func (c *Conn) Peek(b []byte) (int, error) {
 	var err error
 	if n < want {
 		err = io.ErrUnexpectedEOF
+		if errors.Is(readErr, os.ErrDeadlineExceeded) {
+			err = readErr
+		}
 	}
 	return n, err
 }
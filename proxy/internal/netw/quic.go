@@ -49,22 +49,14 @@ var quicConfig = &quic.Config{
 }
 
 // NewQUIC returns a wrapper around a quic.Transport to keep track of metrics
-// and annotations.
-func NewQUIC(addr string, statelessResetKey quic.StatelessResetKey) (*QUICTransport, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return nil, err
-	}
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return nil, err
-	}
+// and annotations. conn is the UDP socket to use.
+func NewQUIC(conn net.PacketConn, statelessResetKey quic.StatelessResetKey) *QUICTransport {
 	return &QUICTransport{
 		qt: quic.Transport{
 			Conn:              conn,
 			StatelessResetKey: &statelessResetKey,
 		},
-	}, nil
+	}
 }
 
 // QUICTransport is a wrapper around quic.Transport.
@@ -441,12 +433,35 @@ func (c *QUICConn) Context() context.Context {
 	return c.qc.Context()
 }
 
+// SendDatagram sends a datagram and counts its bytes. The datagram is dropped
+// when the egress limiter doesn't allow it.
 func (c *QUICConn) SendDatagram(b []byte) error {
-	return c.qc.SendDatagram(b)
+	if l := c.egressLimiter; l != nil && !l.AllowN(time.Now(), len(b)) {
+		return nil
+	}
+	if err := c.qc.SendDatagram(b); err != nil {
+		return err
+	}
+	c.bytesSent.Incr(int64(len(b)))
+	c.upBytesSent.Incr(int64(len(b)))
+	return nil
 }
 
+// ReceiveDatagram receives a datagram and counts its bytes. Datagrams are
+// dropped when the ingress limiter doesn't allow them.
 func (c *QUICConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
-	return c.qc.ReceiveDatagram(ctx)
+	for {
+		b, err := c.qc.ReceiveDatagram(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.bytesReceived.Incr(int64(len(b)))
+		c.upBytesReceived.Incr(int64(len(b)))
+		if l := c.ingressLimiter; l != nil && !l.AllowN(time.Now(), len(b)) {
+			continue
+		}
+		return b, nil
+	}
 }
 
 var _ quic.Stream = (*SendOnlyStream)(nil)
@@ -244,3 +244,9 @@ func (c *OCSPCache) fetchOneOCSP(cert, issuer *x509.Certificate, ocspReq []byte,
 	}
 	return ocspResp, nil
 }
+
+// IsRevoked returns true if err indicates that the certificate is revoked, as
+// opposed to its status being unknown or unavailable.
+func IsRevoked(err error) bool {
+	return errors.Is(err, errOCSPRevoked)
+}
@@ -24,6 +24,7 @@
 package oidc
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -31,12 +32,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/c2FmZQ/storage"
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
@@ -68,6 +71,11 @@ type Config struct {
 	// HostedDomain specifies that the HD param should be used.
 	// https://developers.google.com/identity/openid-connect/openid-connect#hd-param
 	HostedDomain string
+	// Store is used to share the login states with other proxies, so
+	// that the callback can be handled by a different proxy than the one
+	// that started the login. If nil, the login states are only kept in
+	// memory.
+	Store *storage.Storage
 }
 
 // CookieManager is the interface to set and clear the auth token.
@@ -91,8 +99,9 @@ type ProviderClient struct {
 	cm  CookieManager
 	er  EventRecorder
 
-	mu     sync.Mutex
-	states map[string]*oauthState
+	mu        sync.Mutex
+	states    map[string]*oauthState
+	stateFile string
 }
 
 type oauthState struct {
@@ -103,6 +112,34 @@ type oauthState struct {
 	Seen         bool
 }
 
+// Discovery contains the endpoints from an OIDC discovery document.
+type Discovery struct {
+	AuthEndpoint     string `json:"authorization_endpoint"`
+	TokenEndpoint    string `json:"token_endpoint"`
+	UserinfoEndpoint string `json:"userinfo_endpoint"`
+}
+
+// Discover fetches the OIDC discovery document at discoveryURL.
+func Discover(ctx context.Context, client *http.Client, discoveryURL string) (*Discovery, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http get(%s): %s", discoveryURL, resp.Status)
+	}
+	var disc Discovery
+	if err := json.NewDecoder(resp.Body).Decode(&disc); err != nil {
+		return nil, fmt.Errorf("discovery document: %v", err)
+	}
+	return &disc, nil
+}
+
 // New returns a new ProviderClient.
 func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error) {
 	p := &ProviderClient{
@@ -111,23 +148,15 @@ func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error
 		er:     er,
 		states: make(map[string]*oauthState),
 	}
+	if s := p.cfg.Store; s != nil {
+		p.stateFile = "oidc-states/" + s.HashString(p.cfg.ClientID+" "+p.cfg.RedirectURL)
+		s.CreateEmptyFile(p.stateFile, &p.states)
+	}
 	if p.cfg.DiscoveryURL != "" {
-		resp, err := http.Get(p.cfg.DiscoveryURL)
+		disc, err := Discover(context.Background(), http.DefaultClient, p.cfg.DiscoveryURL)
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("http get(%s): %s", cfg.DiscoveryURL, resp.Status)
-		}
-		var disc struct {
-			AuthEndpoint     string `json:"authorization_endpoint"`
-			TokenEndpoint    string `json:"token_endpoint"`
-			UserinfoEndpoint string `json:"userinfo_endpoint"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&disc); err != nil {
-			return nil, fmt.Errorf("discovery document: %v", err)
-		}
 		p.cfg.AuthEndpoint = disc.AuthEndpoint
 		p.cfg.TokenEndpoint = disc.TokenEndpoint
 		p.cfg.UserinfoEndpoint = disc.UserinfoEndpoint
@@ -144,6 +173,28 @@ func New(cfg Config, er EventRecorder, cm CookieManager) (*ProviderClient, error
 	return p, nil
 }
 
+// updateStates calls f with the login states. The changes made by f are saved
+// in the Store, if there is one.
+func (p *ProviderClient) updateStates(f func(map[string]*oauthState)) (retErr error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfg.Store == nil {
+		f(p.states)
+		return nil
+	}
+	var states map[string]*oauthState
+	commit, err := p.cfg.Store.OpenForUpdate(p.stateFile, &states)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if states == nil {
+		states = make(map[string]*oauthState)
+	}
+	f(states)
+	return commit(true, nil)
+}
+
 func (p *ProviderClient) RequestLogin(w http.ResponseWriter, req *http.Request, originalURL string) {
 	ou, err := url.Parse(originalURL)
 	if err != nil {
@@ -163,14 +214,18 @@ func (p *ProviderClient) RequestLogin(w http.ResponseWriter, req *http.Request,
 	}
 	codeVerifierStr := base64.RawURLEncoding.EncodeToString(codeVerifier[:])
 	cvh := sha256.Sum256([]byte(codeVerifierStr))
-	p.mu.Lock()
-	p.states[nonceStr] = &oauthState{
-		Created:      time.Now(),
-		OriginalURL:  originalURL,
-		Host:         ou.Host,
-		CodeVerifier: codeVerifierStr,
+	if err := p.updateStates(func(states map[string]*oauthState) {
+		states[nonceStr] = &oauthState{
+			Created:      time.Now(),
+			OriginalURL:  originalURL,
+			Host:         ou.Host,
+			CodeVerifier: codeVerifierStr,
+		}
+	}); err != nil {
+		log.Printf("ERR oidc states: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
-	p.mu.Unlock()
 	scopes := p.cfg.Scopes
 	if len(scopes) == 0 {
 		scopes = []string{"openid", "email"}
@@ -196,19 +251,25 @@ func (p *ProviderClient) HandleCallback(w http.ResponseWriter, req *http.Request
 	p.er.Record("oidc auth callback")
 	req.ParseForm()
 
-	p.mu.Lock()
-	for k, v := range p.states {
-		if time.Since(v.Created) > 5*time.Minute {
-			delete(p.states, k)
-		}
-	}
 	nonce := req.Form.Get("state")
-	state, ok := p.states[nonce]
-	invalid := !ok || state.Seen || nonce != p.cm.Nonce(w, req)
-	if ok {
-		state.Seen = true
+	var state *oauthState
+	var ok, invalid bool
+	if err := p.updateStates(func(states map[string]*oauthState) {
+		for k, v := range states {
+			if time.Since(v.Created) > 5*time.Minute {
+				delete(states, k)
+			}
+		}
+		state, ok = states[nonce]
+		invalid = !ok || state.Seen || nonce != p.cm.Nonce(w, req)
+		if ok {
+			state.Seen = true
+		}
+	}); err != nil {
+		log.Printf("ERR oidc states: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
-	p.mu.Unlock()
 
 	if invalid {
 		p.er.Record("invalid state")
@@ -294,10 +355,14 @@ func (p *ProviderClient) HandleCallback(w http.ResponseWriter, req *http.Request
 	if claims.Nonce == "" {
 		claims.Nonce = nonce
 	}
-	p.mu.Lock()
-	state, ok = p.states[claims.Nonce]
-	delete(p.states, claims.Nonce)
-	p.mu.Unlock()
+	if err := p.updateStates(func(states map[string]*oauthState) {
+		state, ok = states[claims.Nonce]
+		delete(states, claims.Nonce)
+	}); err != nil {
+		log.Printf("ERR oidc states: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
 	if !ok {
 		p.er.Record("invalid nonce")
 		http.Error(w, "timeout", http.StatusForbidden)
@@ -85,6 +85,7 @@ type userKey struct {
 	PublicKey  Bytes
 	RPIDHash   Bytes
 	Transports []string
+	SignCount  uint32
 	CreatedAt  time.Time
 	LastSeen   time.Time
 }
@@ -383,7 +384,7 @@ func (m *Manager) HandleCallback(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "invalid request", http.StatusBadRequest)
 			return
 		}
-		claims, err := m.processAssertion(req.Form.Get("args"), token)
+		claims, err := m.processAssertion(req.Host, req.Form.Get("args"), token)
 		if err != nil {
 			log.Printf("ERR processAssertion: %v", err)
 			http.Error(w, "internal error", http.StatusInternalServerError)
@@ -874,6 +875,7 @@ func (m *Manager) processAttestation(claims map[string]any, host, jsargs string,
 		PublicKey:  creds.COSEKey,
 		RPIDHash:   ao.AuthData.RPIDHash,
 		Transports: args.Transports,
+		SignCount:  ao.AuthData.SignCount,
 		CreatedAt:  now,
 		LastSeen:   now,
 	})
@@ -898,7 +900,7 @@ func (m *Manager) assertionOptions() (*AssertionOptions, error) {
 	return opts, nil
 }
 
-func (m *Manager) processAssertion(jsargs string, token *jwt.Token) (claims map[string]any, retErr error) {
+func (m *Manager) processAssertion(host, jsargs string, token *jwt.Token) (claims map[string]any, retErr error) {
 	m.vacuum()
 	var args struct {
 		ID                string `json:"id"`
@@ -917,6 +919,10 @@ func (m *Manager) processAssertion(jsargs string, token *jwt.Token) (claims map[
 	if cd.Type != "webauthn.get" {
 		return nil, errors.New("unexpected clientData.type")
 	}
+	if origin := "https://" + host; cd.Origin != origin {
+		log.Printf("ERR cd.Origin: %q != %q", cd.Origin, origin)
+		return nil, errors.New("unexpected clientData.origin")
+	}
 	var authData authenticatorData
 	if err := parseAuthenticatorData(args.AuthenticatorData, &authData); err != nil {
 		return nil, err
@@ -966,6 +972,15 @@ func (m *Manager) processAssertion(jsargs string, token *jwt.Token) (claims map[
 	if err := verifySignature(key.PublicKey, args.AuthenticatorData, args.ClientDataJSON, args.Signature); err != nil {
 		return nil, err
 	}
+	// https://www.w3.org/TR/webauthn-2/#sctn-sign-counter
+	// A signature counter that doesn't increase may indicate that the
+	// authenticator was cloned. Authenticators that don't implement a
+	// counter always return 0.
+	if (authData.SignCount != 0 || key.SignCount != 0) && authData.SignCount <= key.SignCount {
+		m.cfg.EventRecorder.Record("passkey sign count error")
+		return nil, fmt.Errorf("signCount %d <= %d, possible cloned authenticator", authData.SignCount, key.SignCount)
+	}
+	key.SignCount = authData.SignCount
 	key.LastSeen = time.Now().UTC()
 
 	if token != nil {
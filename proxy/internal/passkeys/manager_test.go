@@ -0,0 +1,124 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package passkeys
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+type fakeEventRecorder struct{}
+
+func (fakeEventRecorder) Record(string) {}
+
+func TestSignCount(t *testing.T) {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateAESMasterKeyForTest: %v", err)
+	}
+	m, err := NewManager(Config{
+		Store:         storage.New(t.TempDir(), mk),
+		Endpoint:      "https://login.example.com/.sso/passkeys",
+		EventRecorder: fakeEventRecorder{},
+	})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	auth, err := NewFakeAuthenticator()
+	if err != nil {
+		t.Fatalf("NewFakeAuthenticator: %v", err)
+	}
+	auth.SetOrigin("https://login.example.com")
+
+	claims := map[string]any{"email": "bob@example.com"}
+	attestOpts, err := m.attestationOptions(claims)
+	if err != nil {
+		t.Fatalf("attestationOptions: %v", err)
+	}
+	clientDataJSON, attestationObject, err := auth.Create(attestOpts)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	ao, err := parseAttestationObject(attestationObject)
+	if err != nil {
+		t.Fatalf("parseAttestationObject: %v", err)
+	}
+	args, _ := json.Marshal(struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AttestationObject Bytes `json:"attestationObject"`
+	}{clientDataJSON, attestationObject})
+	if _, err := m.processAttestation(claims, "login.example.com", string(args), false); err != nil {
+		t.Fatalf("processAttestation: %v", err)
+	}
+	keyID := ao.AuthData.AttestedCredentials.ID
+
+	login := func(a *FakeAuthenticator) error {
+		opts, err := m.assertionOptions()
+		if err != nil {
+			t.Fatalf("assertionOptions: %v", err)
+		}
+		opts.AllowCredentials = []CredentialID{{ID: keyID}}
+		id, clientDataJSON, authData, signature, _, err := a.Get(opts)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		args, _ := json.Marshal(struct {
+			ID                string `json:"id"`
+			ClientDataJSON    Bytes  `json:"clientDataJSON"`
+			AuthenticatorData Bytes  `json:"authenticatorData"`
+			Signature         Bytes  `json:"signature"`
+			UserHandle        Bytes  `json:"userHandle"`
+		}{base64.RawURLEncoding.EncodeToString(id), clientDataJSON, authData, signature, attestOpts.User.ID})
+		_, err = m.processAssertion("login.example.com", string(args), nil)
+		return err
+	}
+
+	clone := &FakeAuthenticator{
+		keys:     maps.Clone(auth.keys),
+		rpIDHash: auth.rpIDHash,
+		origin:   auth.origin,
+	}
+	for i := 0; i < 2; i++ {
+		if err := login(auth); err != nil {
+			t.Fatalf("login #%d: %v", i, err)
+		}
+	}
+	// The clone's signature counter is behind.
+	if err := login(clone); err == nil || !strings.Contains(err.Error(), "signCount") {
+		t.Errorf("login with cloned authenticator: %v", err)
+	}
+	if err := login(auth); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+
+	auth.SetOrigin("https://evil.example.com")
+	if err := login(auth); err == nil {
+		t.Error("login with wrong origin succeeded unexpectedly")
+	}
+}
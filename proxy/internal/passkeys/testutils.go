@@ -129,10 +129,12 @@ func (a *FakeAuthenticator) Create(options *AttestationOptions) (clientDataJSON,
 // Get mimics the behavior of the WebAuthn create call.
 func (a *FakeAuthenticator) Get(options *AssertionOptions) (id []byte, clientDataJSON, authData, signature, userHandle []byte, err error) {
 	var authKey fakeAuthKey
+	var keyID string
 	if len(options.AllowCredentials) > 0 {
 		for _, k := range options.AllowCredentials {
 			if ak, ok := a.keys[base64.RawURLEncoding.EncodeToString(k.ID)]; ok {
 				id = k.ID
+				keyID = base64.RawURLEncoding.EncodeToString(k.ID)
 				authKey = ak
 				break
 			}
@@ -141,6 +143,7 @@ func (a *FakeAuthenticator) Get(options *AssertionOptions) (id []byte, clientDat
 		for kid, key := range a.keys {
 			if key.rk {
 				id, _ = base64.RawURLEncoding.DecodeString(kid)
+				keyID = kid
 				authKey = key
 				userHandle = key.uid
 				break
@@ -154,12 +157,13 @@ func (a *FakeAuthenticator) Get(options *AssertionOptions) (id []byte, clientDat
 	cd := clientData{
 		Type:      "webauthn.get",
 		Challenge: base64.RawURLEncoding.EncodeToString(options.Challenge),
-		Origin:    "https://example.com/",
+		Origin:    a.origin,
 	}
 	if clientDataJSON, err = json.Marshal(cd); err != nil {
 		return
 	}
 	authKey.signCount++
+	a.keys[keyID] = authKey
 	if authData, err = authKey.makeAuthData(a.rpIDHash, nil); err != nil {
 		return
 	}
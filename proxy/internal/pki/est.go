@@ -0,0 +1,151 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// The Enrollment over Secure Transport (EST) protocol is defined in RFC 7030.
+// Only the mandatory operations are implemented: /cacerts and /simpleenroll.
+
+const maxESTRequestSize = 65536
+
+var (
+	oidData       = []int{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = []int{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// ServeESTCACerts implements the EST /cacerts operation. It sends the CA's
+// certificate in a certs-only PKCS#7 message.
+func (m *PKIManager) ServeESTCACerts(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cert, err := m.CACert()
+	if err != nil {
+		log.Printf("ERR CACert: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	sendCertsOnly(w, cert.Raw)
+}
+
+// ServeESTSimpleEnroll implements the EST /simpleenroll operation. The request
+// body is a base64-encoded PKCS#10 certificate signing request. The issued
+// certificate is for the authenticated user, regardless of the subject in the
+// request, in the same way as certificates requested with the web interface.
+func (m *PKIManager) ServeESTSimpleEnroll(w http.ResponseWriter, req *http.Request) {
+	claims := m.opts.ClaimsFromCtx(req.Context())
+	if claims == nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := req.Header.Get("content-type"); !strings.HasPrefix(ct, "application/pkcs10") {
+		log.Printf("ERR content-type: %v", ct)
+		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+	defer req.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxESTRequestSize))
+	if err != nil {
+		log.Printf("ERR body: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	// The body is base64 encoded, possibly with line breaks.
+	csr, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		log.Printf("ERR base64: %v", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	in, err := m.ValidateCertificateRequest(csr)
+	if err != nil {
+		log.Printf("ERR ValidateCertificateRequest: %v", err)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	cert, err := m.IssueCertificate(userCertificateRequest(in, email))
+	if err != nil {
+		log.Printf("ERR IssueCertificate: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	sendCertsOnly(w, cert)
+}
+
+func sendCertsOnly(w http.ResponseWriter, certs ...[]byte) {
+	b, err := certsOnlyPKCS7(certs...)
+	if err != nil {
+		log.Printf("ERR certsOnlyPKCS7: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(b)))
+}
+
+// certsOnlyPKCS7 returns a degenerate PKCS#7 SignedData message that contains
+// only certificates (RFC 2315, section 9.1).
+func certsOnlyPKCS7(certs ...[]byte) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidSignedData)
+		b.AddASN1(cbasn1.Tag(0).Constructed().ContextSpecific(), func(b *cryptobyte.Builder) {
+			b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)                                   // version
+				b.AddASN1(cbasn1.SET, func(*cryptobyte.Builder) {}) // digestAlgorithms
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidData)
+				})
+				b.AddASN1(cbasn1.Tag(0).Constructed().ContextSpecific(), func(b *cryptobyte.Builder) {
+					for _, c := range certs {
+						b.AddBytes(c)
+					}
+				})
+				b.AddASN1(cbasn1.SET, func(*cryptobyte.Builder) {}) // signerInfos
+			})
+		})
+	})
+	return b.Bytes()
+}
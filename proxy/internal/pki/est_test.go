@@ -0,0 +1,148 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package pki
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// parseCertsOnly extracts the certificates from a certs-only PKCS#7 message.
+func parseCertsOnly(t *testing.T, body string) []*x509.Certificate {
+	t.Helper()
+	der, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatalf("base64: %v", err)
+	}
+	var ci struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatalf("asn1.Unmarshal(ContentInfo): %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("ContentType = %v, want %v", ci.ContentType, oidSignedData)
+	}
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("asn1.Unmarshal(SignedData): %v", err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificates: %v", err)
+	}
+	return certs
+}
+
+func TestEST(t *testing.T) {
+	m := newPKI(t, nil)
+	m.opts.ClaimsFromCtx = func(context.Context) jwt.MapClaims {
+		return jwt.MapClaims{"email": "bob@example.com"}
+	}
+	caCert, err := m.CACert()
+	if err != nil {
+		t.Fatalf("CACert: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeESTCACerts(w, httptest.NewRequest(http.MethodGet, "/.well-known/est/cacerts", nil))
+	if got, want := w.Code, http.StatusOK; got != want {
+		t.Fatalf("cacerts Code = %d, want %d", got, want)
+	}
+	if got, want := w.Header().Get("Content-Type"), "application/pkcs7-mime; smime-type=certs-only"; got != want {
+		t.Errorf("cacerts Content-Type = %q, want %q", got, want)
+	}
+	if certs := parseCertsOnly(t, w.Body.String()); len(certs) != 1 || !certs[0].Equal(caCert) {
+		t.Errorf("cacerts returned unexpected certs: %v", certs)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "laptop"},
+	}, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificateRequest: %v", err)
+	}
+	enc := base64.StdEncoding.EncodeToString(csr)
+
+	for _, tc := range []struct {
+		name string
+		ct   string
+		body string
+		want int
+	}{
+		{"wrong content type", "text/plain", enc, http.StatusUnsupportedMediaType},
+		{"bad base64", "application/pkcs10", "!!!", http.StatusBadRequest},
+		{"bad csr", "application/pkcs10", base64.StdEncoding.EncodeToString([]byte("foo")), http.StatusBadRequest},
+		{"ok", "application/pkcs10", enc[:40] + "\r\n" + enc[40:], http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/.well-known/est/simpleenroll", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.ct)
+			w := httptest.NewRecorder()
+			m.ServeESTSimpleEnroll(w, req)
+			if got := w.Code; got != tc.want {
+				t.Fatalf("Code = %d, want %d", got, tc.want)
+			}
+			if tc.want != http.StatusOK {
+				return
+			}
+			certs := parseCertsOnly(t, w.Body.String())
+			if len(certs) != 1 {
+				t.Fatalf("Got %d certs, want 1", len(certs))
+			}
+			if err := certs[0].CheckSignatureFrom(caCert); err != nil {
+				t.Errorf("CheckSignatureFrom: %v", err)
+			}
+			if got, want := certs[0].Subject.CommonName, "bob@example.com::laptop"; got != want {
+				t.Errorf("CommonName = %q, want %q", got, want)
+			}
+			if got, want := certs[0].ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}; len(got) != 1 || got[0] != want[0] {
+				t.Errorf("ExtKeyUsage = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -384,6 +384,23 @@ func (m *PKIManager) handleRequestCert(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "invalid request", http.StatusBadRequest)
 		return
 	}
+	cert, err := m.IssueCertificate(userCertificateRequest(in, email))
+	if err != nil {
+		log.Printf("ERR body: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"result": "ok",
+		"cert":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
+	})
+}
+
+// userCertificateRequest returns the certificate request to use for a user's
+// certificate. Only the public key and DNS names are copied from the user's
+// request. The subject is always derived from the user's email address.
+func userCertificateRequest(in *x509.CertificateRequest, email string) *x509.CertificateRequest {
 	cr := &x509.CertificateRequest{
 		PublicKeyAlgorithm: in.PublicKeyAlgorithm,
 		PublicKey:          in.PublicKey,
@@ -396,17 +413,7 @@ func (m *PKIManager) handleRequestCert(w http.ResponseWriter, req *http.Request)
 	if in.Subject.CommonName != "" {
 		cr.Subject.CommonName += "::" + in.Subject.CommonName
 	}
-	cert, err := m.IssueCertificate(cr)
-	if err != nil {
-		log.Printf("ERR body: %v", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("content-type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"result": "ok",
-		"cert":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
-	})
+	return cr
 }
 
 func (m *PKIManager) handleRevokeCert(w http.ResponseWriter, req *http.Request, isAdmin bool) {
@@ -722,6 +722,12 @@ func (m *PKIManager) ValidateCertificateRequest(csr []byte) (*x509.CertificateRe
 
 // IssueCertificate issues a new certificate.
 func (m *PKIManager) IssueCertificate(cr *x509.CertificateRequest) (cert []byte, retErr error) {
+	return m.IssueCertificateWithLifetime(cr, issuedCertsLifetime)
+}
+
+// IssueCertificateWithLifetime issues a new certificate that expires after
+// lifetime.
+func (m *PKIManager) IssueCertificateWithLifetime(cr *x509.CertificateRequest, lifetime time.Duration) (cert []byte, retErr error) {
 	now := time.Now().UTC()
 	sn, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 160))
 	if err != nil {
@@ -740,7 +746,7 @@ func (m *PKIManager) IssueCertificate(cr *x509.CertificateRequest) (cert []byte,
 		PublicKey:             cr.PublicKey,
 		Subject:               cr.Subject,
 		NotBefore:             now,
-		NotAfter:              now.Add(issuedCertsLifetime),
+		NotAfter:              now.Add(lifetime),
 		KeyUsage:              x509.KeyUsageDataEncipherment | x509.KeyUsageDigitalSignature,
 		BasicConstraintsValid: true,
 		ExtKeyUsage:           eku,
@@ -0,0 +1,318 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package quicinitial decrypts the Initial packets of QUIC connections to
+// extract the TLS ClientHello, without terminating the connections.
+//
+// The Initial packets are encrypted with keys derived from the Destination
+// Connection ID. Anyone who can see the packets can decrypt them.
+// https://www.rfc-editor.org/rfc/rfc9001.html#section-5.2
+package quicinitial
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	version1 = 0x00000001
+	version2 = 0x6b3343cf
+
+	// maxCryptoData is the maximum size of the ClientHello.
+	maxCryptoData = 65536
+)
+
+var (
+	// ErrNotInitial is returned when a packet isn't a QUIC Initial packet.
+	ErrNotInitial = errors.New("not a quic initial packet")
+
+	errInvalid = errors.New("invalid packet")
+
+	// https://www.rfc-editor.org/rfc/rfc9001.html#section-5.2
+	saltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	// https://www.rfc-editor.org/rfc/rfc9369.html#section-3.3.1
+	saltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+// Assembler collects the CRYPTO frames of a client's Initial packets until
+// the ClientHello is complete.
+type Assembler struct {
+	dcid    []byte
+	version uint32
+	aead    cipher.AEAD
+	iv      []byte
+	hp      cipher.Block
+
+	data []byte
+	have []bool
+}
+
+// Add decrypts the Initial packets in a UDP datagram and records their CRYPTO
+// frames. Other packets in the datagram, e.g. 0-RTT, are ignored.
+func (a *Assembler) Add(datagram []byte) error {
+	var found bool
+	for len(datagram) > 0 {
+		n, err := a.addPacket(datagram)
+		if errors.Is(err, ErrNotInitial) && found {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		datagram = datagram[n:]
+	}
+	return nil
+}
+
+// ClientHello returns the ClientHello handshake message, when it has been
+// fully received.
+func (a *Assembler) ClientHello() ([]byte, bool) {
+	if len(a.have) < 4 || !allTrue(a.have[:4]) {
+		return nil, false
+	}
+	if a.data[0] != 0x01 { // ClientHello
+		return nil, false
+	}
+	n := 4 + (int(a.data[1])<<16 | int(a.data[2])<<8 | int(a.data[3]))
+	if len(a.have) < n || !allTrue(a.have[:n]) {
+		return nil, false
+	}
+	return a.data[:n], true
+}
+
+func allTrue(s []bool) bool {
+	return !slices.Contains(s, false)
+}
+
+// addPacket decrypts one packet and returns its length.
+func (a *Assembler) addPacket(pkt []byte) (int, error) {
+	// https://www.rfc-editor.org/rfc/rfc9000.html#section-17.2.2
+	//
+	// Initial Packet {
+	//   Header Form (1) = 1,
+	//   Fixed Bit (1) = 1,
+	//   Long Packet Type (2) = 0,
+	//   Reserved Bits (2),
+	//   Packet Number Length (2),
+	//   Version (32),
+	//   Destination Connection ID Length (8),
+	//   Destination Connection ID (0..160),
+	//   Source Connection ID Length (8),
+	//   Source Connection ID (0..160),
+	//   Token Length (i),
+	//   Token (..),
+	//   Length (i),
+	//   Packet Number (8..32),
+	//   Packet Payload (8..),
+	// }
+	s := cryptobyte.String(pkt)
+	var first uint8
+	var version uint32
+	var dcid, scid cryptobyte.String
+	if !s.ReadUint8(&first) || first&0xc0 != 0xc0 || !s.ReadUint32(&version) {
+		return 0, ErrNotInitial
+	}
+	var initialType uint8
+	switch version {
+	case version1:
+		initialType = 0
+	case version2:
+		initialType = 1
+	default:
+		return 0, ErrNotInitial
+	}
+	if (first>>4)&0x03 != initialType {
+		return 0, ErrNotInitial
+	}
+	var tokenLen, length uint64
+	if !s.ReadUint8LengthPrefixed(&dcid) || !s.ReadUint8LengthPrefixed(&scid) ||
+		!readVarint(&s, &tokenLen) || !s.Skip(int(tokenLen)) || !readVarint(&s, &length) {
+		return 0, errInvalid
+	}
+	pnOffset := len(pkt) - len(s)
+	if length < 20 || uint64(len(s)) < length {
+		return 0, errInvalid
+	}
+	if a.aead == nil {
+		if err := a.setKeys(version, dcid); err != nil {
+			return 0, err
+		}
+	} else if version != a.version || !slices.Equal(a.dcid, dcid) {
+		return 0, errors.New("unexpected connection id")
+	}
+	pktLen := pnOffset + int(length)
+	hdr := slices.Clone(pkt[:pnOffset+4])
+
+	// https://www.rfc-editor.org/rfc/rfc9001.html#section-5.4
+	sample := pkt[pnOffset+4 : pnOffset+4+16]
+	mask := make([]byte, 16)
+	a.hp.Encrypt(mask, sample)
+	hdr[0] ^= mask[0] & 0x0f
+	pnLen := int(hdr[0]&0x03) + 1
+	var pn uint64
+	for i := range pnLen {
+		hdr[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOffset+i])
+	}
+	hdr = hdr[:pnOffset+pnLen]
+
+	// https://www.rfc-editor.org/rfc/rfc9001.html#section-5.3
+	nonce := slices.Clone(a.iv)
+	var pnb [8]byte
+	binary.BigEndian.PutUint64(pnb[:], pn)
+	for i := range 8 {
+		nonce[len(nonce)-8+i] ^= pnb[i]
+	}
+	payload, err := a.aead.Open(nil, nonce, pkt[pnOffset+pnLen:pktLen], hdr)
+	if err != nil {
+		return 0, fmt.Errorf("decrypt: %w", err)
+	}
+	if err := a.readFrames(payload); err != nil {
+		return 0, err
+	}
+	return pktLen, nil
+}
+
+func (a *Assembler) setKeys(version uint32, dcid []byte) error {
+	salt, prefix := saltV1, "quic "
+	if version == version2 {
+		salt, prefix = saltV2, "quicv2 "
+	}
+	initialSecret := hkdf.Extract(sha256.New, dcid, salt)
+	clientSecret := expandLabel(initialSecret, "client in", 32)
+	key := expandLabel(clientSecret, prefix+"key", 16)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if a.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	if a.hp, err = aes.NewCipher(expandLabel(clientSecret, prefix+"hp", 16)); err != nil {
+		return err
+	}
+	a.iv = expandLabel(clientSecret, prefix+"iv", 12)
+	a.version = version
+	a.dcid = slices.Clone(dcid)
+	return nil
+}
+
+// expandLabel implements HKDF-Expand-Label.
+// https://www.rfc-editor.org/rfc/rfc8446.html#section-7.1
+func expandLabel(secret []byte, label string, length int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(uint16(length))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte("tls13 " + label))
+	})
+	b.AddUint8LengthPrefixed(func(*cryptobyte.Builder) {})
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(sha256.New, secret, b.BytesOrPanic()).Read(out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// readFrames parses the frames that are allowed in Initial packets and
+// records the content of the CRYPTO frames.
+// https://www.rfc-editor.org/rfc/rfc9000.html#section-12.4
+func (a *Assembler) readFrames(payload []byte) error {
+	s := cryptobyte.String(payload)
+	for !s.Empty() {
+		var frameType uint64
+		if !readVarint(&s, &frameType) {
+			return errInvalid
+		}
+		switch frameType {
+		case 0x00, 0x01: // PADDING, PING
+		case 0x02, 0x03: // ACK
+			var largest, delay, count, firstRange uint64
+			if !readVarint(&s, &largest) || !readVarint(&s, &delay) || !readVarint(&s, &count) || !readVarint(&s, &firstRange) {
+				return errInvalid
+			}
+			n := 2 * count
+			if frameType == 0x03 {
+				n += 3
+			}
+			for range n {
+				var v uint64
+				if !readVarint(&s, &v) {
+					return errInvalid
+				}
+			}
+		case 0x06: // CRYPTO
+			var offset, length uint64
+			var data []byte
+			if !readVarint(&s, &offset) || !readVarint(&s, &length) || !s.ReadBytes(&data, int(length)) {
+				return errInvalid
+			}
+			end := offset + length
+			if end > maxCryptoData {
+				return errors.New("crypto data too large")
+			}
+			if int(end) > len(a.data) {
+				a.data = append(a.data, make([]byte, int(end)-len(a.data))...)
+				a.have = append(a.have, make([]bool, int(end)-len(a.have))...)
+			}
+			copy(a.data[offset:end], data)
+			for i := offset; i < end; i++ {
+				a.have[i] = true
+			}
+		case 0x1c: // CONNECTION_CLOSE
+			var code, ft, reasonLen uint64
+			if !readVarint(&s, &code) || !readVarint(&s, &ft) || !readVarint(&s, &reasonLen) || !s.Skip(int(reasonLen)) {
+				return errInvalid
+			}
+		default:
+			return fmt.Errorf("unexpected frame type 0x%x", frameType)
+		}
+	}
+	return nil
+}
+
+// readVarint reads a variable-length integer.
+// https://www.rfc-editor.org/rfc/rfc9000.html#section-16
+func readVarint(s *cryptobyte.String, out *uint64) bool {
+	var b uint8
+	if !s.ReadUint8(&b) {
+		return false
+	}
+	v := uint64(b & 0x3f)
+	for range (1 << (b >> 6)) - 1 {
+		if !s.ReadUint8(&b) {
+			return false
+		}
+		v = v<<8 | uint64(b)
+	}
+	*out = v
+	return true
+}
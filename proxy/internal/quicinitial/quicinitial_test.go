@@ -0,0 +1,88 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package quicinitial
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestClientHello(t *testing.T) {
+	for _, version := range []quic.Version{quic.Version1, quic.Version2} {
+		t.Run(version.String(), func(t *testing.T) {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("ListenPacket: %v", err)
+			}
+			defer pc.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go quic.DialAddr(ctx, pc.LocalAddr().String(), &tls.Config{
+				ServerName: "www.example.com",
+				NextProtos: []string{"foo"},
+			}, &quic.Config{Versions: []quic.Version{version}})
+
+			var a Assembler
+			buf := make([]byte, 65536)
+			for {
+				pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("ReadFrom: %v", err)
+				}
+				if err := a.Add(buf[:n]); err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+				if hello, ok := a.ClientHello(); ok {
+					if hello[0] != 0x01 || !bytes.Contains(hello, []byte("www.example.com")) {
+						t.Errorf("Unexpected ClientHello: %x", hello)
+					}
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestNotInitial(t *testing.T) {
+	var a Assembler
+	for _, pkt := range [][]byte{
+		{0x40, 0x01, 0x02, 0x03},
+		{0xc0, 0x00, 0x00, 0x00, 0x02},
+	} {
+		if err := a.Add(pkt); err != ErrNotInitial {
+			t.Errorf("Add(%x) = %v, want ErrNotInitial", pkt, err)
+		}
+	}
+	if _, ok := a.ClientHello(); ok {
+		t.Error("ClientHello() returned true")
+	}
+}
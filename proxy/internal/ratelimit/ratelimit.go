@@ -0,0 +1,167 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ratelimit implements rate limiters keyed by arbitrary strings, e.g.
+// IP addresses, and a list of temporarily banned keys.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// maxKeys is the maximum number of keys that are tracked. When more keys
+// are seen, the least recently used ones are forgotten.
+const maxKeys = 10000
+
+// Limiter is a rate limiter keyed by strings.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters *lru.Cache[string, *rate.Limiter]
+}
+
+// NewLimiter returns a new Limiter that allows events at rate r per key, with
+// bursts of at most b events.
+func NewLimiter(r float64, b int) *Limiter {
+	c, err := lru.New[string, *rate.Limiter](maxKeys)
+	if err != nil {
+		panic(err)
+	}
+	return &Limiter{
+		limit:    rate.Limit(r),
+		burst:    max(b, 1),
+		limiters: c,
+	}
+}
+
+// Allow reports whether an event for key may happen now.
+func (l *Limiter) Allow(key string) bool {
+	l.mu.Lock()
+	rl, ok := l.limiters.Get(key)
+	if !ok {
+		rl = rate.NewLimiter(l.limit, l.burst)
+		l.limiters.Add(key, rl)
+	}
+	l.mu.Unlock()
+	return rl.Allow()
+}
+
+// BanList keeps track of failures per key, and bans keys that have too many
+// failures in a given amount of time.
+type BanList struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	mu       sync.Mutex
+	failures *lru.Cache[string, []time.Time]
+	banned   map[string]time.Time
+}
+
+// NewBanList returns a new BanList. Keys are banned for duration after
+// threshold failures within window.
+func NewBanList(threshold int, window, duration time.Duration) *BanList {
+	c, err := lru.New[string, []time.Time](maxKeys)
+	if err != nil {
+		panic(err)
+	}
+	return &BanList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		failures:  c,
+		banned:    make(map[string]time.Time),
+	}
+}
+
+// Fail records a failure for key. It returns true if key is banned as a
+// result.
+func (b *BanList) Fail(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	f, _ := b.failures.Get(key)
+	// Only keep the failures that are still within the window.
+	for len(f) > 0 && now.Sub(f[0]) > b.window {
+		f = f[1:]
+	}
+	f = append(f, now)
+	if len(f) < b.threshold {
+		b.failures.Add(key, f)
+		return false
+	}
+	b.failures.Remove(key)
+	b.banned[key] = now.Add(b.duration)
+	return true
+}
+
+// IsBanned returns true if key is currently banned.
+func (b *BanList) IsBanned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.banned[key]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(until) {
+		return true
+	}
+	delete(b.banned, key)
+	return false
+}
+
+// Merge adds bans to the ban list, e.g. bans from another proxy. Existing bans
+// are extended if needed.
+func (b *BanList) Merge(bans map[string]time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for k, v := range bans {
+		if v.After(now) && v.After(b.banned[k]) {
+			b.banned[k] = v
+		}
+	}
+}
+
+// Banned returns the keys that are currently banned, and when their bans
+// expire.
+func (b *BanList) Banned() map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	out := make(map[string]time.Time, len(b.banned))
+	for k, v := range b.banned {
+		if now.After(v) {
+			delete(b.banned, k)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
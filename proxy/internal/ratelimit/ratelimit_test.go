@@ -0,0 +1,91 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(0.001, 2)
+	for i, want := range []bool{true, true, false} {
+		if got := l.Allow("a"); got != want {
+			t.Errorf("[%d] Allow(a) = %v, want %v", i, got, want)
+		}
+	}
+	if !l.Allow("b") {
+		t.Error("Allow(b) = false, want true")
+	}
+}
+
+func TestBanList(t *testing.T) {
+	b := NewBanList(3, time.Minute, 50*time.Millisecond)
+	for i, want := range []bool{false, false, true} {
+		if got := b.Fail("a"); got != want {
+			t.Errorf("[%d] Fail(a) = %v, want %v", i, got, want)
+		}
+	}
+	if !b.IsBanned("a") {
+		t.Error("IsBanned(a) = false, want true")
+	}
+	if b.IsBanned("b") {
+		t.Error("IsBanned(b) = true, want false")
+	}
+	if got := b.Banned(); len(got) != 1 {
+		t.Errorf("Banned() = %v, want a", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if b.IsBanned("a") {
+		t.Error("IsBanned(a) = true after ban expired")
+	}
+
+	// Failures outside of the window don't count.
+	b = NewBanList(2, 10*time.Millisecond, time.Minute)
+	b.Fail("a")
+	time.Sleep(20 * time.Millisecond)
+	if b.Fail("a") {
+		t.Error("Fail(a) = true, want false")
+	}
+}
+
+func TestBanListMerge(t *testing.T) {
+	b := NewBanList(3, time.Minute, time.Minute)
+	now := time.Now()
+	b.Merge(map[string]time.Time{
+		"a": now.Add(time.Minute),
+		"b": now.Add(-time.Minute),
+	})
+	if !b.IsBanned("a") {
+		t.Error("IsBanned(a) = false, want true")
+	}
+	if b.IsBanned("b") {
+		t.Error("IsBanned(b) = true, want false")
+	}
+	// Merge doesn't shorten existing bans.
+	b.Merge(map[string]time.Time{"a": now.Add(time.Second)})
+	if got, want := b.Banned()["a"], now.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Banned()[a] = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,584 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package resolver is a DNS stub resolver with a cache. It sends queries to
+// specific DNS servers over UDP, TCP, TLS (RFC 7858), or HTTPS (RFC 8484), and
+// caches the answers for their TTL, including the negative answers
+// (RFC 2308).
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultTimeout     = 5 * time.Second
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+	defaultCacheSize   = 1024
+
+	// maxUDPSize is the EDNS(0) UDP payload size, from the DNS flag day
+	// 2020 recommendation.
+	maxUDPSize = 1232
+)
+
+var resolvConf = "/etc/resolv.conf"
+
+// Options contains the parameters of a Resolver.
+type Options struct {
+	// Servers are the DNS servers to query, in order. Each one is either
+	// an IP address with an optional port, or a URL:
+	//   - udp://host[:port] (default port 53)
+	//   - tcp://host[:port] (default port 53)
+	//   - tls://host[:port] (DNS over TLS, default port 853)
+	//   - https://host/path (DNS over HTTPS)
+	// When it is empty, the nameservers from /etc/resolv.conf are used.
+	Servers []string
+	// TLSConfig is used with the tls and https servers. The ServerName is
+	// set automatically.
+	TLSConfig *tls.Config
+	// Timeout is the maximum amount of time to wait for an answer from
+	// each server. The default is 5 seconds.
+	Timeout time.Duration
+	// MinTTL and MaxTTL are the minimum and maximum amount of time to
+	// cache the answers, regardless of their TTL. The default MaxTTL is
+	// 1 hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is the maximum amount of time to cache the negative
+	// answers, i.e. when a name doesn't exist or doesn't have records of
+	// the requested type. It is also used when the answer doesn't
+	// include a SOA record. The default is 30 seconds.
+	NegativeTTL time.Duration
+	// CacheSize is the maximum number of answers in the cache. The
+	// default is 1024.
+	CacheSize int
+}
+
+// Stats contains the number of lookups that were answered from the cache,
+// and the number of queries that were sent to the servers.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// Resolver resolves host names with specific DNS servers. It is safe for
+// concurrent use. Concurrent lookups of the same name share the same query.
+type Resolver struct {
+	opts    Options
+	servers []server
+	client  *http.Client
+	cache   *lru.Cache[cacheKey, *entry]
+
+	mu       sync.Mutex
+	inflight map[cacheKey]*call
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+
+	// now is a variable for tests.
+	now func() time.Time
+}
+
+type server struct {
+	// network is udp, tcp, tls, or https.
+	network string
+	// addr is host:port, or the URL with https.
+	addr string
+	// host is the server name for TLS.
+	host string
+}
+
+func (s server) String() string {
+	if s.network == "https" {
+		return s.addr
+	}
+	return s.network + "://" + s.addr
+}
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type entry struct {
+	addrs    []netip.Addr
+	srvs     []net.SRV
+	notFound bool
+	expires  time.Time
+}
+
+type call struct {
+	done chan struct{}
+	e    *entry
+	err  error
+}
+
+// CheckServer returns an error if s isn't a valid server for Options.Servers.
+func CheckServer(s string) error {
+	_, err := parseServer(s)
+	return err
+}
+
+func parseServer(s string) (server, error) {
+	if ip, err := netip.ParseAddr(s); err == nil {
+		return server{network: "udp", addr: net.JoinHostPort(ip.String(), "53")}, nil
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return server{network: "udp", addr: ap.String()}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return server{}, err
+	}
+	if u.Hostname() == "" {
+		return server{}, fmt.Errorf("invalid server %q", s)
+	}
+	var port string
+	switch u.Scheme {
+	case "udp", "tcp":
+		port = "53"
+	case "tls":
+		port = "853"
+	case "https":
+		return server{network: "https", addr: u.String(), host: u.Hostname()}, nil
+	default:
+		return server{}, fmt.Errorf("invalid server %q: scheme must be udp, tcp, tls, or https", s)
+	}
+	if u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return server{}, fmt.Errorf("invalid server %q", s)
+	}
+	if p := u.Port(); p != "" {
+		port = p
+	}
+	return server{network: u.Scheme, addr: net.JoinHostPort(u.Hostname(), port), host: u.Hostname()}, nil
+}
+
+// systemServers returns the nameservers from /etc/resolv.conf.
+func systemServers() ([]server, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var servers []server
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		servers = append(servers, server{network: "udp", addr: net.JoinHostPort(ip.String(), "53")})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s: no nameservers", resolvConf)
+	}
+	return servers, nil
+}
+
+// New returns a new Resolver.
+func New(opts Options) (*Resolver, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.MaxTTL <= 0 {
+		opts.MaxTTL = defaultMaxTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.MinTTL > opts.MaxTTL {
+		return nil, errors.New("MinTTL must not be greater than MaxTTL")
+	}
+	r := &Resolver{
+		opts:     opts,
+		inflight: make(map[cacheKey]*call),
+		now:      time.Now,
+	}
+	for _, s := range opts.Servers {
+		srv, err := parseServer(s)
+		if err != nil {
+			return nil, err
+		}
+		r.servers = append(r.servers, srv)
+	}
+	if len(r.servers) == 0 {
+		servers, err := systemServers()
+		if err != nil {
+			return nil, err
+		}
+		r.servers = servers
+	}
+	var err error
+	if r.cache, err = lru.New[cacheKey, *entry](opts.CacheSize); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if opts.TLSConfig != nil {
+		transport.TLSClientConfig = opts.TLSConfig.Clone()
+	}
+	r.client = &http.Client{Transport: transport}
+	return r, nil
+}
+
+// Close releases the resources used by the resolver.
+func (r *Resolver) Close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
+
+// Stats returns the cache statistics.
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Hits:   r.hits.Load(),
+		Misses: r.misses.Load(),
+	}
+}
+
+// LookupNetIP looks up host, like net.Resolver.LookupNetIP. The network must
+// be ip, ip4, or ip6.
+func (r *Resolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip}, nil
+	}
+	var types []dnsmessage.Type
+	switch network {
+	case "ip":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case "ip4":
+		types = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	entries := make([]*entry, len(types))
+	errs := make([]error, len(types))
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entries[i], errs[i] = r.lookup(ctx, host, t)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var err error
+	for i, e := range entries {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		addrs = append(addrs, e.addrs...)
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if err != nil {
+		return nil, dnsError(ctx, host, err)
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// LookupSRV looks up an SRV record, like net.Resolver.LookupSRV. The records
+// are sorted by priority, and by weight in descending order.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	target := name
+	if service != "" || proto != "" {
+		target = "_" + service + "._" + proto + "." + name
+	}
+	e, err := r.lookup(ctx, target, dnsmessage.TypeSRV)
+	if err != nil {
+		return "", nil, dnsError(ctx, target, err)
+	}
+	if e.notFound {
+		return "", nil, &net.DNSError{Err: "no such host", Name: target, IsNotFound: true}
+	}
+	srvs := make([]*net.SRV, 0, len(e.srvs))
+	for _, s := range e.srvs {
+		s := s
+		srvs = append(srvs, &s)
+	}
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+		return srvs[i].Weight > srvs[j].Weight
+	})
+	return fqdn(target), srvs, nil
+}
+
+func dnsError(ctx context.Context, name string, err error) error {
+	return &net.DNSError{
+		Err:       err.Error(),
+		Name:      name,
+		IsTimeout: errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded),
+	}
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// lookup returns the cached answer for name and qtype, or sends a query to
+// the servers.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) (*entry, error) {
+	key := cacheKey{name: strings.ToLower(fqdn(name)), qtype: qtype}
+	r.mu.Lock()
+	if e, ok := r.cache.Get(key); ok && r.now().Before(e.expires) {
+		r.mu.Unlock()
+		r.hits.Add(1)
+		return e, nil
+	}
+	if c, ok := r.inflight[key]; ok {
+		r.mu.Unlock()
+		select {
+		case <-c.done:
+			return c.e, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &call{done: make(chan struct{})}
+	r.inflight[key] = c
+	r.mu.Unlock()
+
+	r.misses.Add(1)
+	c.e, c.err = r.query(ctx, key.name, qtype)
+
+	r.mu.Lock()
+	delete(r.inflight, key)
+	if c.err == nil {
+		r.cache.Add(key, c.e)
+	}
+	r.mu.Unlock()
+	close(c.done)
+	return c.e, c.err
+}
+
+// query sends the question to the servers, in order, until one of them
+// answers.
+func (r *Resolver) query(ctx context.Context, name string, qtype dnsmessage.Type) (*entry, error) {
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	question := dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}
+	var errs []error
+	for _, s := range r.servers {
+		var id uint16
+		if s.network != "https" {
+			// RFC 8484 recommends using 0 with DNS over HTTPS.
+			id = newID()
+		}
+		msg, err := newQuery(id, question, s.network == "udp")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.exchange(ctx, s, msg)
+		if err == nil {
+			var e *entry
+			if e, err = r.parseResponse(resp, id, question); err == nil {
+				return e, nil
+			}
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", s, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func newQuery(id uint16, q dnsmessage.Question, udp bool) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if udp {
+		if err := b.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		var hdr dnsmessage.ResourceHeader
+		if err := hdr.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		if err := b.OPTResource(hdr, dnsmessage.OPTResource{}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// parseResponse parses the response to question, and returns the cache
+// entry.
+func (r *Resolver) parseResponse(resp []byte, id uint16, question dnsmessage.Question) (*entry, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, err
+	}
+	if !h.Response || h.ID != id {
+		return nil, errors.New("invalid response")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if q.Type != question.Type || !strings.EqualFold(q.Name.String(), question.Name.String()) {
+		return nil, errors.New("response doesn't match the question")
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		e.notFound = true
+	default:
+		return nil, fmt.Errorf("server error: %s", h.RCode)
+	}
+
+	ttl := r.opts.MaxTTL
+	minTTL := func(v uint32) {
+		ttl = min(ttl, time.Duration(v)*time.Second)
+	}
+	for !e.notFound {
+		hdr, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The records of the CNAME chain, if any, aren't checked. They
+		// come from the same server.
+		switch {
+		case hdr.Type == dnsmessage.TypeA && question.Type == dnsmessage.TypeA:
+			rr, err := p.AResource()
+			if err != nil {
+				return nil, err
+			}
+			e.addrs = append(e.addrs, netip.AddrFrom4(rr.A))
+			minTTL(hdr.TTL)
+		case hdr.Type == dnsmessage.TypeAAAA && question.Type == dnsmessage.TypeAAAA:
+			rr, err := p.AAAAResource()
+			if err != nil {
+				return nil, err
+			}
+			e.addrs = append(e.addrs, netip.AddrFrom16(rr.AAAA))
+			minTTL(hdr.TTL)
+		case hdr.Type == dnsmessage.TypeSRV && question.Type == dnsmessage.TypeSRV:
+			rr, err := p.SRVResource()
+			if err != nil {
+				return nil, err
+			}
+			e.srvs = append(e.srvs, net.SRV{
+				Target:   rr.Target.String(),
+				Port:     rr.Port,
+				Priority: rr.Priority,
+				Weight:   rr.Weight,
+			})
+			minTTL(hdr.TTL)
+		case hdr.Type == dnsmessage.TypeCNAME:
+			minTTL(hdr.TTL)
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(e.addrs) > 0 || len(e.srvs) > 0 {
+		e.expires = r.now().Add(max(ttl, r.opts.MinTTL))
+		return e, nil
+	}
+
+	// Negative answer. The TTL is the minimum of the SOA record's TTL and
+	// its MINIMUM field, per RFC 2308.
+	e.notFound = true
+	ttl = r.opts.NegativeTTL
+	if err := p.SkipAllAnswers(); err != nil && err != dnsmessage.ErrSectionDone {
+		return nil, err
+	}
+	for {
+		hdr, err := p.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if hdr.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				break
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			break
+		}
+		minTTL(min(hdr.TTL, soa.MinTTL))
+		break
+	}
+	e.expires = r.now().Add(max(ttl, r.opts.MinTTL))
+	return e, nil
+}
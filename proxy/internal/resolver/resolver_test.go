@@ -0,0 +1,425 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer is a DNS server for tests. It answers the queries with the
+// records in its zone.
+type testServer struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries atomic.Int32
+	// truncate sets the TC bit in the UDP responses.
+	truncate atomic.Bool
+}
+
+func newTestServer(t *testing.T) *testServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &testServer{udp: udp, tcp: tcp}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp := s.answer(buf[:n], s.truncate.Load())
+			udp.WriteTo(resp, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveStream(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serveStream(conn net.Conn) {
+	defer conn.Close()
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return
+	}
+	resp := s.answer(msg, false)
+	binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+	conn.Write(append(size[:], resp...))
+}
+
+func (s *testServer) addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testServer) answer(msg []byte, truncate bool) []byte {
+	s.queries.Add(1)
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	rh := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true, Truncated: truncate}
+	hdr := func(ttl uint32) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+	name := q.Name.String()
+	if name == "nxdomain.example.com." {
+		rh.RCode = dnsmessage.RCodeNameError
+	}
+	if name == "servfail.example.com." {
+		rh.RCode = dnsmessage.RCodeServerFailure
+	}
+	b := dnsmessage.NewBuilder(nil, rh)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if !truncate {
+		switch {
+		case name == "www.example.com." && q.Type == dnsmessage.TypeA:
+			b.AResource(hdr(60), dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+			b.AResource(hdr(30), dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}})
+		case name == "www.example.com." && q.Type == dnsmessage.TypeAAAA:
+			b.AAAAResource(hdr(60), dnsmessage.AAAAResource{AAAA: netip.MustParseAddr("2001:db8::1").As16()})
+		case name == "_https._tcp.example.com." && q.Type == dnsmessage.TypeSRV:
+			b.SRVResource(hdr(60), dnsmessage.SRVResource{Priority: 10, Weight: 1, Port: 443, Target: dnsmessage.MustNewName("b.example.com.")})
+			b.SRVResource(hdr(60), dnsmessage.SRVResource{Priority: 5, Weight: 1, Port: 8443, Target: dnsmessage.MustNewName("a.example.com.")})
+		}
+	}
+	b.StartAuthorities()
+	if name == "v4only.example.com." || name == "nxdomain.example.com." {
+		b.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("ns.example.com."),
+			MBox:   dnsmessage.MustNewName("admin.example.com."),
+			MinTTL: 10,
+		})
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+func TestLookupNetIP(t *testing.T) {
+	srv := newTestServer(t)
+	r, err := New(Options{Servers: []string{srv.addr()}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		network string
+		want    []string
+	}{
+		{"ip", []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}},
+		{"ip4", []string{"192.0.2.1", "192.0.2.2"}},
+		{"ip6", []string{"2001:db8::1"}},
+	} {
+		addrs, err := r.LookupNetIP(ctx, tc.network, "www.example.com")
+		if err != nil {
+			t.Fatalf("LookupNetIP(%s): %v", tc.network, err)
+		}
+		var got []string
+		for _, a := range addrs {
+			got = append(got, a.String())
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("LookupNetIP(%s) = %v, want %v", tc.network, got, tc.want)
+		}
+	}
+	if got, want := srv.queries.Load(), int32(2); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	if got, want := r.Stats(), (Stats{Hits: 2, Misses: 2}); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+
+	// The A records expire after 30s, the lowest TTL.
+	now = now.Add(31 * time.Second)
+	if _, err := r.LookupNetIP(ctx, "ip6", "www.example.com"); err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	if got, want := srv.queries.Load(), int32(2); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	if _, err := r.LookupNetIP(ctx, "ip4", "WWW.example.com."); err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	if got, want := srv.queries.Load(), int32(3); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+
+	// IP addresses aren't resolved.
+	if addrs, err := r.LookupNetIP(ctx, "ip", "10.0.0.1"); err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("10.0.0.1") {
+		t.Errorf("LookupNetIP(10.0.0.1) = %v, %v", addrs, err)
+	}
+	if got, want := srv.queries.Load(), int32(3); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	srv := newTestServer(t)
+	r, err := New(Options{Servers: []string{srv.addr()}, NegativeTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for _, name := range []string{"nxdomain.example.com", "v4only.example.com", "nodata.example.com"} {
+		_, err := r.LookupNetIP(ctx, "ip6", name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupNetIP(%s) err = %v, want not found", name, err)
+		}
+	}
+	if got, want := srv.queries.Load(), int32(3); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+	// The negative answers with a SOA record expire after 10s, the SOA
+	// MINIMUM. The one without SOA record expires after NegativeTTL.
+	now = now.Add(11 * time.Second)
+	for _, name := range []string{"nxdomain.example.com", "v4only.example.com", "nodata.example.com"} {
+		r.LookupNetIP(ctx, "ip6", name)
+	}
+	if got, want := srv.queries.Load(), int32(5); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+
+	// Server errors aren't cached.
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupNetIP(ctx, "ip4", "servfail.example.com")
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+			t.Errorf("LookupNetIP(servfail) err = %v, want server error", err)
+		}
+	}
+	if got, want := srv.queries.Load(), int32(7); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+}
+
+func TestLookupSRV(t *testing.T) {
+	srv := newTestServer(t)
+	// The first server doesn't respond.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer dead.Close()
+	r, err := New(Options{
+		Servers: []string{"udp://" + dead.LocalAddr().String(), "tcp://" + srv.addr()},
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+
+	cname, srvs, err := r.LookupSRV(context.Background(), "https", "tcp", "example.com")
+	if err != nil {
+		t.Fatalf("LookupSRV: %v", err)
+	}
+	if want := "_https._tcp.example.com."; cname != want {
+		t.Errorf("cname = %q, want %q", cname, want)
+	}
+	if len(srvs) != 2 || srvs[0].Target != "a.example.com." || srvs[0].Port != 8443 || srvs[1].Target != "b.example.com." {
+		t.Errorf("LookupSRV = %+v", srvs)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	srv := newTestServer(t)
+	srv.truncate.Store(true)
+	r, err := New(Options{Servers: []string{srv.addr()}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+
+	addrs, err := r.LookupNetIP(context.Background(), "ip6", "www.example.com")
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("2001:db8::1") {
+		t.Errorf("LookupNetIP = %v", addrs)
+	}
+	if got, want := srv.queries.Load(), int32(2); got != want {
+		t.Errorf("Queries = %d, want %d", got, want)
+	}
+}
+
+func TestDNSOverHTTPS(t *testing.T) {
+	dns := newTestServer(t)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("content-type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		msg, _ := io.ReadAll(req.Body)
+		if binary.BigEndian.Uint16(msg) != 0 {
+			http.Error(w, "id must be 0", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("content-type", "application/dns-message")
+		w.Write(dns.answer(msg, false))
+	}))
+	defer ts.Close()
+
+	r, err := New(Options{
+		Servers:   []string{ts.URL + "/dns-query"},
+		TLSConfig: &tls.Config{RootCAs: ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "www.example.com")
+	if err != nil {
+		t.Fatalf("LookupNetIP: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Errorf("LookupNetIP = %v", addrs)
+	}
+}
+
+func TestConcurrentLookups(t *testing.T) {
+	srv := newTestServer(t)
+	r, err := New(Options{Servers: []string{srv.addr()}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := r.LookupNetIP(context.Background(), "ip4", "www.example.com"); err != nil {
+				t.Errorf("LookupNetIP: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := srv.queries.Load(); got != 1 {
+		t.Errorf("Queries = %d, want 1", got)
+	}
+}
+
+func TestServers(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"192.0.2.53", "udp://192.0.2.53:53"},
+		{"192.0.2.53:5353", "udp://192.0.2.53:5353"},
+		{"2001:db8::53", "udp://[2001:db8::53]:53"},
+		{"tcp://192.0.2.53", "tcp://192.0.2.53:53"},
+		{"tls://dns.example.com", "tls://dns.example.com:853"},
+		{"tls://dns.example.com:8853", "tls://dns.example.com:8853"},
+		{"https://dns.example.com/dns-query", "https://dns.example.com/dns-query"},
+		{"ftp://dns.example.com", ""},
+		{"udp://192.0.2.53/foo", ""},
+		{"dns.example.com", ""},
+	} {
+		s, err := parseServer(tc.in)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("parseServer(%q) = %s, want error", tc.in, s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseServer(%q): %v", tc.in, err)
+			continue
+		}
+		if got := s.String(); got != tc.want {
+			t.Errorf("parseServer(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+
+	defer func(f string) { resolvConf = f }(resolvConf)
+	resolvConf = filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte("# comment\nsearch example.com\nnameserver 192.0.2.1\nnameserver 2001:db8::1\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	r, err := New(Options{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var got []string
+	for _, s := range r.servers {
+		got = append(got, s.String())
+	}
+	if want := []string{"udp://192.0.2.1:53", "udp://[2001:db8::1]:53"}; !slices.Equal(got, want) {
+		t.Errorf("servers = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,186 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const maxResponseSize = 65535
+
+func newID() uint16 {
+	return uint16(rand.Uint32())
+}
+
+// exchange sends msg to the server and returns the response.
+func (r *Resolver) exchange(ctx context.Context, s server, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.opts.Timeout)
+	defer cancel()
+	switch s.network {
+	case "udp":
+		resp, err := r.exchangeUDP(ctx, s, msg)
+		if err != nil {
+			return nil, err
+		}
+		var h dnsmessage.Header
+		var p dnsmessage.Parser
+		if h, err = p.Start(resp); err == nil && h.Truncated {
+			// Retry with TCP, without the OPT record.
+			var q dnsmessage.Question
+			if q, err = p.Question(); err != nil {
+				return nil, err
+			}
+			if msg, err = newQuery(h.ID, q, false); err != nil {
+				return nil, err
+			}
+			return r.exchangeStream(ctx, server{network: "tcp", addr: s.addr}, msg)
+		}
+		return resp, nil
+	case "tcp", "tls":
+		return r.exchangeStream(ctx, s, msg)
+	case "https":
+		return r.exchangeHTTPS(ctx, s, msg)
+	default:
+		return nil, fmt.Errorf("invalid network %q", s.network)
+	}
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, s server, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(msg)
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore the responses that don't match the query, e.g. late
+		// responses to a previous query.
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (r *Resolver) exchangeStream(ctx context.Context, s server, msg []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if s.network == "tls" {
+		var tc *tls.Config
+		if r.opts.TLSConfig != nil {
+			tc = r.opts.TLSConfig.Clone()
+		} else {
+			tc = &tls.Config{}
+		}
+		tc.ServerName = s.host
+		d := tls.Dialer{Config: tc}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	// RFC 1035, Section 4.2.2: the message is prefixed with a two byte
+	// length field.
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *Resolver) exchangeHTTPS(ctx context.Context, s server, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.addr, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/dns-message")
+	req.Header.Set("accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("content-type"); ct != "application/dns-message" {
+		return nil, fmt.Errorf("unexpected content-type %q", ct)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxResponseSize {
+		return nil, errors.New("response too large")
+	}
+	return b, nil
+}
+
+// watchContext sets the deadline of conn to the deadline of ctx, and unblocks
+// the reads and writes when ctx is canceled.
+func watchContext(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
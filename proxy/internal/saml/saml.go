@@ -32,6 +32,7 @@ import (
 	"encoding/hex"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -245,11 +246,23 @@ func (p *Provider) HandleCallback(w http.ResponseWriter, req *http.Request) {
 			continue
 		}
 		key := attr.Value
-		value := findElementText(a, "./AttributeValue")
 		// Example:
 		// Key: firstname
 		// Value: Bob
-		extraClaims[key] = value
+		// Attributes with multiple values, e.g. groups, are added as
+		// lists.
+		var values []any
+		for _, av := range a.FindElements("./AttributeValue") {
+			values = append(values, av.Text())
+		}
+		switch len(values) {
+		case 0:
+			extraClaims[key] = ""
+		case 1:
+			extraClaims[key] = values[0]
+		default:
+			extraClaims[key] = values
+		}
 	}
 	if err := p.cm.SetAuthTokenCookie(w, sub, sub, id, state.Host, extraClaims); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -271,6 +284,9 @@ func readCerts(s string) ([]*x509.Certificate, error) {
 	var certs []*x509.Certificate
 	for len(b) > 0 {
 		block, rest := pem.Decode(b)
+		if block == nil {
+			break
+		}
 		b = rest
 		if block.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(block.Bytes)
@@ -280,6 +296,9 @@ func readCerts(s string) ([]*x509.Certificate, error) {
 			certs = append(certs, cert)
 		}
 	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
 	return certs, nil
 }
 
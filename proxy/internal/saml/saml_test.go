@@ -0,0 +1,229 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+type fakeEventRecorder struct{}
+
+func (fakeEventRecorder) Record(string) {}
+
+type fakeCookieManager struct {
+	userID      string
+	host        string
+	extraClaims map[string]any
+}
+
+func (cm *fakeCookieManager) SetAuthTokenCookie(w http.ResponseWriter, userID, email, sessionID, host string, extraClaims map[string]any) error {
+	cm.userID = userID
+	cm.host = host
+	cm.extraClaims = extraClaims
+	return nil
+}
+
+func (cm *fakeCookieManager) ClearCookies(w http.ResponseWriter) error {
+	return nil
+}
+
+const (
+	testSSOURL = "https://idp.example.com/sso"
+	testACSURL = "https://login.example.com/.sso/acs"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *fakeCookieManager, *dsig.SigningContext) {
+	t.Helper()
+	ks := dsig.RandomKeyStoreForTest()
+	_, cert, err := ks.GetKeyPair()
+	if err != nil {
+		t.Fatalf("GetKeyPair: %v", err)
+	}
+	cm := &fakeCookieManager{}
+	p, err := New(Config{
+		SSOURL:   testSSOURL,
+		EntityID: "https://login.example.com/",
+		Certs:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})),
+		ACSURL:   testACSURL,
+	}, fakeEventRecorder{}, cm)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p, cm, newSigningContext(ks)
+}
+
+func newSigningContext(ks dsig.X509KeyStore) *dsig.SigningContext {
+	sc := dsig.NewDefaultSigningContext(ks)
+	sc.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	return sc
+}
+
+func requestLogin(t *testing.T, p *Provider) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://www.example.com/foo", nil)
+	p.RequestLogin(w, req, "https://www.example.com/foo")
+	if got, want := w.Code, http.StatusFound; got != want {
+		t.Fatalf("RequestLogin: status = %d, want %d", got, want)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Location: %v", err)
+	}
+	if got, want := loc.Scheme+"://"+loc.Host+loc.Path, testSSOURL; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if loc.Query().Get("SAMLRequest") == "" {
+		t.Error("SAMLRequest is missing")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.states {
+		return id
+	}
+	t.Fatal("no state")
+	return ""
+}
+
+func makeResponse(t *testing.T, sc *dsig.SigningContext, id string, tamper bool) string {
+	t.Helper()
+	now := time.Now().UTC()
+	doc := etree.NewDocument()
+	resp := doc.CreateElement("samlp:Response")
+	resp.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	resp.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+
+	a := resp.CreateElement("saml:Assertion")
+	a.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	a.CreateAttr("ID", "assertion-"+id)
+	a.CreateAttr("Version", "2.0")
+	a.CreateElement("saml:Issuer").SetText("https://idp.example.com/")
+	subject := a.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText("bob@example.com")
+	scd := subject.CreateElement("saml:SubjectConfirmation").CreateElement("saml:SubjectConfirmationData")
+	scd.CreateAttr("InResponseTo", id)
+	scd.CreateAttr("Recipient", testACSURL)
+	cond := a.CreateElement("saml:Conditions")
+	cond.CreateAttr("NotBefore", now.Add(-time.Minute).Format(time.RFC3339Nano))
+	cond.CreateAttr("NotOnOrAfter", now.Add(5*time.Minute).Format(time.RFC3339Nano))
+	cond.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText("https://login.example.com/")
+	attrs := a.CreateElement("saml:AttributeStatement")
+	attr := attrs.CreateElement("saml:Attribute")
+	attr.CreateAttr("Name", "firstname")
+	attr.CreateElement("saml:AttributeValue").SetText("Bob")
+	attr = attrs.CreateElement("saml:Attribute")
+	attr.CreateAttr("Name", "groups")
+	attr.CreateElement("saml:AttributeValue").SetText("admins")
+	attr.CreateElement("saml:AttributeValue").SetText("users")
+
+	signed, err := sc.SignEnveloped(a)
+	if err != nil {
+		t.Fatalf("SignEnveloped: %v", err)
+	}
+	resp.RemoveChild(a)
+	resp.AddChild(signed)
+	if tamper {
+		signed.FindElement("./Subject/NameID").SetText("mallory@example.com")
+	}
+	b, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("WriteToBytes: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func postCallback(p *Provider, samlResponse string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	form := url.Values{"SAMLResponse": {samlResponse}}
+	req := httptest.NewRequest(http.MethodPost, testACSURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	p.HandleCallback(w, req)
+	return w
+}
+
+func TestLogin(t *testing.T) {
+	p, cm, sc := newTestProvider(t)
+	id := requestLogin(t, p)
+
+	w := postCallback(p, makeResponse(t, sc, id, false))
+	if got, want := w.Code, http.StatusFound; got != want {
+		t.Fatalf("HandleCallback: status = %d, want %d (%s)", got, want, w.Body)
+	}
+	if got, want := w.Header().Get("Location"), "https://www.example.com/foo"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if got, want := cm.userID, "bob@example.com"; got != want {
+		t.Errorf("userID = %q, want %q", got, want)
+	}
+	if got, want := cm.host, "www.example.com"; got != want {
+		t.Errorf("host = %q, want %q", got, want)
+	}
+	wantClaims := map[string]any{
+		"source":    "https://idp.example.com/",
+		"firstname": "Bob",
+		"groups":    []any{"admins", "users"},
+	}
+	if !reflect.DeepEqual(cm.extraClaims, wantClaims) {
+		t.Errorf("extraClaims = %#v, want %#v", cm.extraClaims, wantClaims)
+	}
+
+	// The state can only be used once.
+	if got, want := postCallback(p, makeResponse(t, sc, id, false)).Code, http.StatusForbidden; got != want {
+		t.Errorf("HandleCallback (replay): status = %d, want %d", got, want)
+	}
+}
+
+func TestLoginInvalidSignature(t *testing.T) {
+	p, cm, sc := newTestProvider(t)
+	id := requestLogin(t, p)
+
+	if got, want := postCallback(p, makeResponse(t, sc, id, true)).Code, http.StatusForbidden; got != want {
+		t.Errorf("HandleCallback: status = %d, want %d", got, want)
+	}
+	if cm.userID != "" {
+		t.Errorf("userID = %q, want empty", cm.userID)
+	}
+
+	// A response signed by another key is rejected.
+	other := newSigningContext(dsig.RandomKeyStoreForTest())
+	if got, want := postCallback(p, makeResponse(t, other, id, false)).Code, http.StatusForbidden; got != want {
+		t.Errorf("HandleCallback: status = %d, want %d", got, want)
+	}
+}
+
+func TestReadCerts(t *testing.T) {
+	if _, err := readCerts("not a cert"); err == nil {
+		t.Error("readCerts() succeeded unexpectedly")
+	}
+}
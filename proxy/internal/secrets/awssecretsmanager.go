@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/awssig"
+)
+
+const secretsManagerService = "secretsmanager"
+
+// AWSSecretsManager is a Provider that reads secrets from AWS Secrets
+// Manager. The path is the name or the ARN of the secret.
+// https://docs.aws.amazon.com/secretsmanager/latest/apireference/API_GetSecretValue.html
+type AWSSecretsManager struct {
+	// AccessKeyID and SecretAccessKey are the AWS credentials. They need
+	// the secretsmanager:GetSecretValue permission.
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is the session token of temporary credentials, if
+	// any.
+	SessionToken string
+	// Region is the AWS region. The default is the region of the ARN.
+	Region string
+	// BaseURL is the URL of the API. The default is the regional
+	// endpoint.
+	BaseURL string
+	// Client is the HTTP client to use. The default is a client with a
+	// 30 second timeout.
+	Client *http.Client
+}
+
+type getSecretValueResponse struct {
+	SecretString *string `json:"SecretString"`
+	SecretBinary []byte  `json:"SecretBinary"`
+}
+
+type secretsManagerError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (a *AWSSecretsManager) Get(ctx context.Context, name string) (string, error) {
+	if a.AccessKeyID == "" || a.SecretAccessKey == "" {
+		return "", errNotConfigured
+	}
+	region := a.Region
+	// arn:aws:secretsmanager:<region>:<account>:secret:<name>
+	if parts := strings.Split(name, ":"); len(parts) >= 7 && parts[0] == "arn" {
+		region = parts[3]
+	}
+	if region == "" {
+		return "", fmt.Errorf("%s: region is not set", name)
+	}
+	body, err := json.Marshal(map[string]string{"SecretId": name})
+	if err != nil {
+		return "", err
+	}
+	base := a.BaseURL
+	if base == "" {
+		base = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	awssig.Sign(req, body, a.AccessKeyID, a.SecretAccessKey, region, secretsManagerService, time.Now())
+
+	client := a.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e secretsManagerError
+		if err := json.Unmarshal(respBody, &e); err != nil || e.Type == "" {
+			return "", fmt.Errorf("%s: %s", name, resp.Status)
+		}
+		return "", fmt.Errorf("%s: %s: %s: %s", name, resp.Status, e.Type, e.Message)
+	}
+	var r getSecretValueResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return "", err
+	}
+	if r.SecretString != nil {
+		return *r.SecretString, nil
+	}
+	if r.SecretBinary != nil {
+		return string(r.SecretBinary), nil
+	}
+	return "", fmt.Errorf("%s: empty secret", name)
+}
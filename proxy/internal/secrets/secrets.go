@@ -0,0 +1,213 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package secrets retrieves secrets from external stores. A secret is
+// referenced with <provider>:<path>[#<key>], e.g. vault:secret/data/app#key.
+// When the key is set, the secret is a JSON object and the reference is
+// resolved to the value of key.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Provider retrieves secrets from one store.
+type Provider interface {
+	// Get returns the secret at path.
+	Get(ctx context.Context, path string) (string, error)
+}
+
+// Resolver resolves secret references.
+type Resolver struct {
+	// Providers are the secret providers, by name.
+	Providers map[string]Provider
+
+	cache map[string]string
+}
+
+// New returns a Resolver with the default providers:
+//   - file:<path> is the content of a file, without the trailing newline.
+//     The path is relative to dir, or to $TLSPROXY_SECRETS_DIR.
+//   - env:<name> is the value of an environment variable.
+//   - vault:<path> is a secret in HashiCorp Vault, with the KV secrets
+//     engine. The address and token are read from the VAULT_ADDR,
+//     VAULT_TOKEN, and VAULT_NAMESPACE environment variables.
+//   - aws-secretsmanager:<name> is a secret in AWS Secrets Manager. The
+//     credentials and region are read from the AWS_ACCESS_KEY_ID,
+//     AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, and AWS_REGION environment
+//     variables.
+func New(dir string) *Resolver {
+	client := &http.Client{Timeout: 30 * time.Second}
+	dirs := []string{dir}
+	if d := os.Getenv("TLSPROXY_SECRETS_DIR"); d != "" {
+		dirs = append(dirs, d)
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return &Resolver{
+		Providers: map[string]Provider{
+			"file": &File{Dirs: dirs},
+			"env":  &Env{},
+			"vault": &Vault{
+				Address:   os.Getenv("VAULT_ADDR"),
+				Token:     os.Getenv("VAULT_TOKEN"),
+				Namespace: os.Getenv("VAULT_NAMESPACE"),
+				Client:    client,
+			},
+			"aws-secretsmanager": &AWSSecretsManager{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+				Region:          region,
+				Client:          client,
+			},
+		},
+	}
+}
+
+// IsRef returns true if s is a reference to a secret.
+func (r *Resolver) IsRef(s string) bool {
+	name, path, ok := strings.Cut(s, ":")
+	if !ok || path == "" {
+		return false
+	}
+	_, exists := r.Providers[name]
+	return exists
+}
+
+// Resolve returns the secret that ref refers to. The secrets are cached
+// for the lifetime of the Resolver, so that each one is retrieved only
+// once.
+func (r *Resolver) Resolve(ctx context.Context, ref string) (string, error) {
+	name, path, _ := strings.Cut(ref, ":")
+	p, exists := r.Providers[name]
+	if !exists || path == "" {
+		return "", fmt.Errorf("invalid secret reference %q", ref)
+	}
+	var key string
+	if i := strings.LastIndexByte(path, '#'); i >= 0 {
+		path, key = path[:i], path[i+1:]
+	}
+	cacheKey := name + ":" + path
+	v, ok := r.cache[cacheKey]
+	if !ok {
+		var err error
+		if v, err = p.Get(ctx, path); err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		if r.cache == nil {
+			r.cache = make(map[string]string)
+		}
+		r.cache[cacheKey] = v
+	}
+	if key == "" {
+		return v, nil
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(v), &obj); err != nil {
+		return "", fmt.Errorf("%s: %s is not a JSON object", name, path)
+	}
+	value, exists := obj[key]
+	if !exists {
+		return "", fmt.Errorf("%s: %s doesn't have key %q", name, path, key)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// File is a Provider that reads secrets from files, e.g. Docker or
+// Kubernetes secrets. The paths are relative to one of the directories,
+// and can't refer to files outside of them, including with symbolic links.
+type File struct {
+	// Dirs are the directories where the files are, in the order in
+	// which they are searched.
+	Dirs []string
+}
+
+func (f *File) Get(_ context.Context, path string) (string, error) {
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("%s is not a local path", path)
+	}
+	var b []byte
+	err := fs.ErrNotExist
+	for _, dir := range f.Dirs {
+		if b, err = readFileIn(dir, path); !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	s := strings.TrimSuffix(string(b), "\n")
+	return strings.TrimSuffix(s, "\r"), nil
+}
+
+// readFileIn reads the file at the local path in dir, after checking that
+// the symbolic links don't lead outside of dir.
+func readFileIn(dir, path string) ([]byte, error) {
+	file, err := filepath.EvalSymlinks(filepath.Join(dir, path))
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(dir, file); err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("%s is outside of %s", path, dir)
+	}
+	return os.ReadFile(file)
+}
+
+// Env is a Provider that reads secrets from environment variables. The
+// variables that start with TLSPROXY_ can't be used.
+type Env struct{}
+
+func (Env) Get(_ context.Context, name string) (string, error) {
+	if strings.HasPrefix(name, "TLSPROXY_") {
+		return "", fmt.Errorf("variable %s can't be used", name)
+	}
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("variable %s is not set", name)
+	}
+	return v, nil
+}
+
+var errNotConfigured = errors.New("not configured")
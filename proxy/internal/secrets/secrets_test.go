@@ -0,0 +1,204 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{"a":"A","n":1}`), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	secretsDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(secretsDir, "other-secret"), []byte("other-file-secret\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside")
+	if err := os.WriteFile(outside, []byte("outside-secret\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "link-out")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if err := os.Symlink("secret", filepath.Join(dir, "link-in")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	t.Setenv("TLSPROXY_SECRETS_DIR", secretsDir)
+	t.Setenv("TEST_SECRET", "env-secret")
+	t.Setenv("TLSPROXY_TEST_SECRET", "reserved")
+
+	r := New(dir)
+	for _, tc := range []struct {
+		ref, want, wantErr string
+	}{
+		{ref: "file:secret", want: "file-secret"},
+		{ref: "file:" + filepath.Join(dir, "secret"), wantErr: "not a local path"},
+		{ref: "file:../" + filepath.Base(dir) + "/secret", wantErr: "not a local path"},
+		{ref: "file:other-secret", want: "other-file-secret"},
+		{ref: "file:missing", wantErr: "no such file"},
+		{ref: "file:link-in", want: "file-secret"},
+		{ref: "file:link-out", wantErr: "is outside of"},
+		{ref: "file:secret.json#a", want: "A"},
+		{ref: "file:secret.json#n", want: "1"},
+		{ref: "file:secret.json#b", wantErr: `doesn't have key "b"`},
+		{ref: "file:secret#a", wantErr: "not a JSON object"},
+		{ref: "env:TEST_SECRET", want: "env-secret"},
+		{ref: "env:TEST_UNDEFINED_SECRET", wantErr: "is not set"},
+		{ref: "env:TLSPROXY_TEST_SECRET", wantErr: "can't be used"},
+		{ref: "foo:bar", wantErr: "invalid secret reference"},
+	} {
+		got, err := r.Resolve(context.Background(), tc.ref)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Resolve(%q) err = %v, want %q", tc.ref, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("Resolve(%q) = %q, %v, want %q", tc.ref, got, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		s    string
+		want bool
+	}{
+		{"file:secret", true},
+		{"vault:secret/data/app#key", true},
+		{"aws-secretsmanager:app", true},
+		{"env:", false},
+		{"foo:bar", false},
+		{"plaintext", false},
+	} {
+		if got := r.IsRef(tc.s); got != tc.want {
+			t.Errorf("IsRef(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestVault(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/app":
+			w.Write([]byte(`{"data":{"data":{"clientSecret":"v2-secret"},"metadata":{"version":1}}}`))
+		case "/v1/kv/app":
+			w.Write([]byte(`{"data":{"clientSecret":"v1-secret"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer srv.Close()
+
+	r := &Resolver{
+		Providers: map[string]Provider{
+			"vault": &Vault{Address: srv.URL, Token: "token"},
+		},
+	}
+	ctx := context.Background()
+	if got, err := r.Resolve(ctx, "vault:secret/data/app#clientSecret"); err != nil || got != "v2-secret" {
+		t.Errorf("Resolve(v2) = %q, %v", got, err)
+	}
+	if got, err := r.Resolve(ctx, "vault:secret/data/app#clientSecret"); err != nil || got != "v2-secret" {
+		t.Errorf("Resolve(v2) = %q, %v", got, err)
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+	if got, err := r.Resolve(ctx, "vault:kv/app#clientSecret"); err != nil || got != "v1-secret" {
+		t.Errorf("Resolve(v1) = %q, %v", got, err)
+	}
+	if _, err := r.Resolve(ctx, "vault:kv/missing#clientSecret"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Resolve(missing) err = %v", err)
+	}
+
+	r.Providers["vault"] = &Vault{Address: srv.URL, Token: "wrong"}
+	if _, err := r.Resolve(ctx, "vault:kv/other#clientSecret"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("Resolve(wrong token) err = %v", err)
+	}
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got, want := req.Header.Get("X-Amz-Target"), "secretsmanager.GetSecretValue"; got != want {
+			t.Errorf("X-Amz-Target = %q, want %q", got, want)
+		}
+		if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "Credential=key-id/") || !strings.Contains(auth, "/us-west-2/secretsmanager/aws4_request") {
+			t.Errorf("Authorization = %q", auth)
+		}
+		if got, want := req.Header.Get("X-Amz-Security-Token"), "session"; got != want {
+			t.Errorf("X-Amz-Security-Token = %q, want %q", got, want)
+		}
+		body, _ := io.ReadAll(req.Body)
+		var in struct{ SecretId string }
+		json.Unmarshal(body, &in)
+		switch in.SecretId {
+		case "app":
+			w.Write([]byte(`{"Name":"app","SecretString":"{\"apiToken\":\"aws-secret\"}"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceNotFoundException","message":"Secrets Manager can't find the specified secret."}`))
+		}
+	}))
+	defer srv.Close()
+
+	r := &Resolver{
+		Providers: map[string]Provider{
+			"aws-secretsmanager": &AWSSecretsManager{
+				AccessKeyID:     "key-id",
+				SecretAccessKey: "secret",
+				SessionToken:    "session",
+				Region:          "us-west-2",
+				BaseURL:         srv.URL,
+			},
+		},
+	}
+	ctx := context.Background()
+	if got, err := r.Resolve(ctx, "aws-secretsmanager:app#apiToken"); err != nil || got != "aws-secret" {
+		t.Errorf("Resolve(app) = %q, %v", got, err)
+	}
+	if _, err := r.Resolve(ctx, "aws-secretsmanager:missing"); err == nil || !strings.Contains(err.Error(), "ResourceNotFoundException") {
+		t.Errorf("Resolve(missing) err = %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Vault is a Provider that reads secrets from the KV secrets engine of
+// HashiCorp Vault, version 1 or 2. With version 2, the path includes
+// data/, e.g. secret/data/app. The secret is returned as a JSON object.
+// https://developer.hashicorp.com/vault/api-docs/secret/kv
+type Vault struct {
+	// Address is the URL of the Vault server.
+	Address string
+	// Token is the Vault token.
+	Token string
+	// Namespace is the Vault namespace, if any.
+	Namespace string
+	// Client is the HTTP client to use. The default is a client with a
+	// 30 second timeout.
+	Client *http.Client
+}
+
+type vaultResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+func (v *Vault) Get(ctx context.Context, path string) (string, error) {
+	if v.Address == "" || v.Token == "" {
+		return "", errNotConfigured
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(v.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	var r vaultResponse
+	if err := json.Unmarshal(body, &r); err != nil && resp.StatusCode == http.StatusOK {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(r.Errors) > 0 {
+			return "", fmt.Errorf("%s: %s", resp.Status, strings.Join(r.Errors, ", "))
+		}
+		return "", fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	// With version 2 of the KV engine, the secret is in data.data, next
+	// to data.metadata.
+	var v2 struct {
+		Data     json.RawMessage `json:"data"`
+		Metadata json.RawMessage `json:"metadata"`
+	}
+	if err := json.Unmarshal(r.Data, &v2); err == nil && v2.Data != nil && v2.Metadata != nil {
+		return string(v2.Data), nil
+	}
+	return string(r.Data), nil
+}
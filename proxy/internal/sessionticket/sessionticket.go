@@ -0,0 +1,188 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package sessionticket manages the keys that encrypt TLS session tickets. The
+// keys are stored encrypted, rotated on a schedule, and can be shared by
+// multiple proxies that use the same storage.
+package sessionticket
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	keyFile = "session-ticket-keys"
+
+	// DefaultRotationPeriod is the default amount of time between key
+	// rotations.
+	DefaultRotationPeriod = 24 * time.Hour
+)
+
+type ticketKeys struct {
+	Keys []*ticketKey
+}
+
+type ticketKey struct {
+	Key          []byte
+	CreationTime time.Time
+}
+
+// Manager manages the session ticket keys. New keys are created every
+// rotation period. The old keys are kept for one more period so that recent
+// session tickets can still be decrypted.
+type Manager struct {
+	store *storage.Storage
+
+	mu       sync.Mutex
+	rotation time.Duration
+	keys     []*ticketKey // newest first
+}
+
+// New returns a new Manager.
+func New(store *storage.Storage) (*Manager, error) {
+	m := &Manager{
+		store:    store,
+		rotation: DefaultRotationPeriod,
+	}
+	store.CreateEmptyFile(keyFile, &ticketKeys{})
+	if _, err := m.rotateKeys(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetRotationPeriod sets the amount of time between key rotations. If d is 0,
+// DefaultRotationPeriod is used.
+func (m *Manager) SetRotationPeriod(d time.Duration) {
+	if d <= 0 {
+		d = DefaultRotationPeriod
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rotation = d
+}
+
+// KeyRotationLoop takes care of key rotation. It also reloads the keys from
+// storage, to pick up the keys that were created by other proxies. The
+// onChange function is called when the keys change. It runs until ctx is
+// canceled.
+func (m *Manager) KeyRotationLoop(ctx context.Context, onChange func()) {
+	for {
+		m.mu.Lock()
+		interval := min(m.rotation/10, 10*time.Minute)
+		m.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			changed, err := m.rotateKeys()
+			if err != nil && err != storage.ErrRolledBack {
+				log.Printf("ERR sessionticket.rotateKeys(): %v", err)
+			}
+			if changed && onChange != nil {
+				onChange()
+			}
+		}
+	}
+}
+
+// Keys returns the session ticket keys to use with tls.Config's
+// SetSessionTicketKeys. The keys are derived from the stored keys and the
+// label, so that each label gets a different set of keys. The first key is
+// used to encrypt new session tickets.
+func (m *Manager) Keys(label string) [][32]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([][32]byte, 0, len(m.keys))
+	for _, k := range m.keys {
+		var key [32]byte
+		r := hkdf.New(sha256.New, k.Key, nil, []byte("tlsproxy session ticket key: "+label))
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			panic(err)
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// rotateKeys creates a new key if the newest key is older than the rotation
+// period, and removes the keys that are no longer needed. It returns true if
+// the set of keys changed since the last call.
+func (m *Manager) rotateKeys() (changed bool, retErr error) {
+	m.mu.Lock()
+	rotation := m.rotation
+	m.mu.Unlock()
+
+	var keys ticketKeys
+	commit, err := m.store.OpenForUpdate(keyFile, &keys)
+	if err != nil {
+		return false, err
+	}
+	defer commit(false, &retErr)
+	var updated bool
+
+	now := time.Now().UTC()
+	slices.SortFunc(keys.Keys, func(a, b *ticketKey) int {
+		return b.CreationTime.Compare(a.CreationTime)
+	})
+	if len(keys.Keys) == 0 || keys.Keys[0].CreationTime.Add(rotation).Before(now) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return false, err
+		}
+		keys.Keys = slices.Insert(keys.Keys, 0, &ticketKey{
+			Key:          key,
+			CreationTime: now,
+		})
+		updated = true
+	}
+	// Keep the newest key, and the keys that may still have been used
+	// to encrypt tickets during the last rotation period.
+	n, newest := len(keys.Keys), keys.Keys[0]
+	keys.Keys = slices.DeleteFunc(keys.Keys, func(k *ticketKey) bool {
+		return k != newest && k.CreationTime.Add(2*rotation).Before(now)
+	})
+	if len(keys.Keys) != n {
+		updated = true
+	}
+	if err := commit(updated, nil); err != nil && err != storage.ErrRolledBack {
+		return false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed = !slices.EqualFunc(m.keys, keys.Keys, func(a, b *ticketKey) bool {
+		return string(a.Key) == string(b.Key)
+	})
+	m.keys = keys.Keys
+	return changed, nil
+}
@@ -0,0 +1,94 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package sessionticket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestManager(t *testing.T) {
+	dir := t.TempDir()
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	store := storage.New(dir, mk)
+	m1, err := New(store)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	m2, err := New(store)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	keys1 := m1.Keys("foo")
+	if len(keys1) != 1 {
+		t.Fatalf("Keys() returned %d keys, want 1", len(keys1))
+	}
+	if keys2 := m2.Keys("foo"); keys2[0] != keys1[0] {
+		t.Error("Managers with the same storage should have the same keys")
+	}
+	if keys := m1.Keys("bar"); keys[0] == keys1[0] {
+		t.Error("Different labels should have different keys")
+	}
+
+	// Rotate.
+	m1.SetRotationPeriod(200 * time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	changed, err := m1.rotateKeys()
+	if err != nil {
+		t.Fatalf("rotateKeys: %v", err)
+	}
+	if !changed {
+		t.Error("rotateKeys() should have changed the keys")
+	}
+	keys := m1.Keys("foo")
+	if len(keys) != 2 || keys[1] != keys1[0] {
+		t.Fatalf("Keys() after rotation = %d keys, want the new key and the old key", len(keys))
+	}
+
+	// The other manager picks up the new key.
+	if changed, err := m2.rotateKeys(); err != nil || !changed {
+		t.Fatalf("rotateKeys() = %v, %v", changed, err)
+	}
+	if keys2 := m2.Keys("foo"); len(keys2) != 2 || keys2[0] != keys[0] {
+		t.Error("Managers with the same storage should have the same keys")
+	}
+	if changed, err := m2.rotateKeys(); err != nil || changed {
+		t.Fatalf("rotateKeys() = %v, %v", changed, err)
+	}
+
+	// The oldest key expires after two rotation periods.
+	time.Sleep(250 * time.Millisecond)
+	if _, err := m1.rotateKeys(); err != nil {
+		t.Fatalf("rotateKeys: %v", err)
+	}
+	if got := m1.Keys("foo"); len(got) != 2 || got[1] != keys[0] {
+		t.Errorf("Keys() after expiration = %d keys, want 2", len(got))
+	}
+}
@@ -0,0 +1,271 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package sshca implements a simple SSH certificate authority that issues
+// short-lived user certificates to authenticated users.
+package sshca
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki/keys"
+)
+
+const (
+	// DefaultMaximumCertificateLifetime is the default maximum lifetime of
+	// the certificates issued by the CA.
+	DefaultMaximumCertificateLifetime = 10 * time.Minute
+
+	maxPublicKeySize = 16384
+)
+
+//go:embed ssh-cert.html
+var certEmbed string
+var certTemplate *template.Template
+
+func init() {
+	certTemplate = template.Must(template.New("ssh-cert").Parse(certEmbed))
+}
+
+// Options contains the parameters of the SSH certificate authority.
+type Options struct {
+	// Name is the name of the CA.
+	Name string
+	// KeyType is one of ed25519, ecdsa-p256, ecdsa-p384, ecdsa-p521,
+	// rsa-2048, rsa-3072, or rsa-4096. Defaults to ed25519.
+	KeyType string
+	// MaximumCertificateLifetime is the maximum lifetime of the
+	// certificates. Defaults to DefaultMaximumCertificateLifetime.
+	MaximumCertificateLifetime time.Duration
+	// Store is used to store the CA's private key.
+	Store *storage.Storage
+	// EventRecorder is used to record events.
+	EventRecorder interface {
+		Record(string)
+	}
+	// ClaimsFromCtx returns jwt claims for the current user.
+	ClaimsFromCtx func(context.Context) jwt.MapClaims
+}
+
+// SSHCA is an SSH certificate authority.
+type SSHCA struct {
+	opts   Options
+	signer ssh.Signer
+}
+
+type caData struct {
+	Name       string
+	PrivateKey []byte
+}
+
+// New returns a new initialized SSH certificate authority. The CA's key is
+// created the first time New is called for a given name.
+func New(opts Options) (*SSHCA, error) {
+	if opts.KeyType == "" {
+		opts.KeyType = "ed25519"
+	}
+	if opts.MaximumCertificateLifetime <= 0 {
+		opts.MaximumCertificateLifetime = DefaultMaximumCertificateLifetime
+	}
+	fileName := "sshca-" + url.PathEscape(opts.Name)
+	var db caData
+	opts.Store.CreateEmptyFile(fileName, &db)
+	commit, err := opts.Store.OpenForUpdate(fileName, &db)
+	if err != nil {
+		return nil, err
+	}
+	var changed bool
+	if len(db.PrivateKey) == 0 {
+		key, err := keys.GenerateKey(opts.KeyType)
+		if err != nil {
+			commit(false, nil)
+			return nil, err
+		}
+		if db.PrivateKey, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			commit(false, nil)
+			return nil, fmt.Errorf("x509.MarshalPKCS8PrivateKey: %w", err)
+		}
+		db.Name = opts.Name
+		changed = true
+	}
+	key, err := x509.ParsePKCS8PrivateKey(db.PrivateKey)
+	if err != nil {
+		commit(false, nil)
+		return nil, err
+	}
+	if err := commit(changed, nil); err != nil && err != storage.ErrRolledBack {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHCA{
+		opts:   opts,
+		signer: signer,
+	}, nil
+}
+
+// PublicKey returns the CA's public key.
+func (ca *SSHCA) PublicKey() ssh.PublicKey {
+	return ca.signer.PublicKey()
+}
+
+// ServePublicKey sends the CA's public key in authorized_keys format. SSH
+// servers can trust the CA with the TrustedUserCAKeys option in sshd_config.
+func (ca *SSHCA) ServePublicKey(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+}
+
+// ServeCertificate lets authenticated users get a certificate for their SSH
+// public key. A GET request returns a web page where users can paste their
+// public key. A POST request with the public key in the body returns the
+// certificate.
+func (ca *SSHCA) ServeCertificate(w http.ResponseWriter, req *http.Request) {
+	claims := ca.opts.ClaimsFromCtx(req.Context())
+	if claims == nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	email, _ := claims["email"].(string)
+	if email == "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("X-Frame-Options", "DENY")
+		certTemplate.Execute(w, struct {
+			Name     string
+			Email    string
+			Lifetime time.Duration
+		}{
+			Name:     ca.opts.Name,
+			Email:    email,
+			Lifetime: ca.opts.MaximumCertificateLifetime,
+		})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if v := req.Header.Get("x-csrf-check"); v != "1" {
+		log.Printf("ERR x-csrf-check: %v", v)
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPublicKeySize))
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	if _, ok := pub.(*ssh.Certificate); ok {
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+	ttl := ca.opts.MaximumCertificateLifetime
+	if v := req.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = min(d, ttl)
+	}
+	cert, err := ca.SignUserCertificate(pub, email, ttl)
+	if err != nil {
+		log.Printf("ERR SignUserCertificate: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	ca.opts.EventRecorder.Record("sshca cert issued")
+	log.Printf("INF SSH CA %q issued certificate %d to %s", ca.opts.Name, cert.Serial, email)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(ssh.MarshalAuthorizedKey(cert))
+}
+
+// SignUserCertificate issues a user certificate for pub. The certificate's
+// key ID is email, and its principals are email and the part of email before
+// the @.
+func (ca *SSHCA) SignUserCertificate(pub ssh.PublicKey, email string, ttl time.Duration) (*ssh.Certificate, error) {
+	if email == "" {
+		return nil, errors.New("email is required")
+	}
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	principals := []string{email}
+	if user, _, ok := strings.Cut(email, "@"); ok && user != "" {
+		principals = append(principals, user)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           email,
+		ValidPrincipals: principals,
+		// Allow for some clock skew.
+		ValidAfter:  uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(ttl).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-X11-forwarding":   "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
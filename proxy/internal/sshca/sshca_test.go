@@ -0,0 +1,186 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sshca
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/ssh"
+)
+
+type eventRecorder struct {
+	events []string
+}
+
+func (er *eventRecorder) Record(s string) {
+	er.events = append(er.events, s)
+}
+
+func newTestOptions(t *testing.T, claims jwt.MapClaims) Options {
+	mk, err := crypto.CreateAESMasterKeyForTest()
+	if err != nil {
+		t.Fatalf("crypto.CreateMasterKey: %v", err)
+	}
+	return Options{
+		Name:          "ssh-test",
+		Store:         storage.New(t.TempDir(), mk),
+		EventRecorder: &eventRecorder{},
+		ClaimsFromCtx: func(context.Context) jwt.MapClaims {
+			return claims
+		},
+	}
+}
+
+func newUserKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("ssh.NewPublicKey: %v", err)
+	}
+	return sshPub
+}
+
+func TestKeyPersistence(t *testing.T) {
+	opts := newTestOptions(t, nil)
+	ca1, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ca2, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if got, want := ssh.FingerprintSHA256(ca2.PublicKey()), ssh.FingerprintSHA256(ca1.PublicKey()); got != want {
+		t.Errorf("PublicKey() = %s, want %s", got, want)
+	}
+
+	opts.Name = "other"
+	ca3, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if ssh.FingerprintSHA256(ca3.PublicKey()) == ssh.FingerprintSHA256(ca1.PublicKey()) {
+		t.Error("different CAs have the same key")
+	}
+}
+
+func TestSignUserCertificate(t *testing.T) {
+	ca, err := New(newTestOptions(t, nil))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	cert, err := ca.SignUserCertificate(newUserKey(t), "bob@example.com", time.Minute)
+	if err != nil {
+		t.Fatalf("SignUserCertificate: %v", err)
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return ssh.FingerprintSHA256(auth) == ssh.FingerprintSHA256(ca.PublicKey())
+		},
+	}
+	for _, p := range []string{"bob", "bob@example.com"} {
+		if err := checker.CheckCert(p, cert); err != nil {
+			t.Errorf("CheckCert(%q): %v", p, err)
+		}
+	}
+	if err := checker.CheckCert("alice", cert); err == nil {
+		t.Error("CheckCert(alice) succeeded unexpectedly")
+	}
+	checker.Clock = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := checker.CheckCert("bob", cert); err == nil {
+		t.Error("CheckCert succeeded after expiration")
+	}
+}
+
+func TestServeCertificate(t *testing.T) {
+	opts := newTestOptions(t, jwt.MapClaims{"email": "bob@example.com"})
+	ca, err := New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	userKey := string(ssh.MarshalAuthorizedKey(newUserKey(t)))
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		csrf   bool
+		body   string
+		want   int
+	}{
+		{"form", http.MethodGet, "/", false, "", http.StatusOK},
+		{"no csrf header", http.MethodPost, "/", false, userKey, http.StatusBadRequest},
+		{"bad key", http.MethodPost, "/", true, "foo", http.StatusBadRequest},
+		{"bad ttl", http.MethodPost, "/?ttl=foo", true, userKey, http.StatusBadRequest},
+		{"ok", http.MethodPost, "/?ttl=1h", true, userKey, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.csrf {
+				req.Header.Set("x-csrf-check", "1")
+			}
+			w := httptest.NewRecorder()
+			ca.ServeCertificate(w, req)
+			if got := w.Code; got != tc.want {
+				t.Fatalf("Code = %d, want %d", got, tc.want)
+			}
+			if tc.method != http.MethodPost || tc.want != http.StatusOK {
+				return
+			}
+			body, _ := io.ReadAll(w.Body)
+			pub, _, _, _, err := ssh.ParseAuthorizedKey(body)
+			if err != nil {
+				t.Fatalf("ssh.ParseAuthorizedKey: %v", err)
+			}
+			cert, ok := pub.(*ssh.Certificate)
+			if !ok {
+				t.Fatalf("Got %T, want *ssh.Certificate", pub)
+			}
+			if got, want := cert.KeyId, "bob@example.com"; got != want {
+				t.Errorf("KeyId = %q, want %q", got, want)
+			}
+			// The requested ttl is capped by the maximum lifetime.
+			if lifetime := time.Until(time.Unix(int64(cert.ValidBefore), 0)); lifetime > DefaultMaximumCertificateLifetime {
+				t.Errorf("Certificate lifetime = %v, want <= %v", lifetime, DefaultMaximumCertificateLifetime)
+			}
+		})
+	}
+	if got, want := opts.EventRecorder.(*eventRecorder).events, []string{"sshca cert issued"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,483 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package tracing implements a minimal OpenTelemetry tracer that exports
+// spans with the OTLP/HTTP protocol, in JSON encoding.
+// https://opentelemetry.io/docs/specs/otlp/
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueueSize  = 2048
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+)
+
+// Span kinds.
+// https://opentelemetry.io/docs/specs/otel/trace/api/#spankind
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Config is the configuration of a Tracer.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces endpoint, e.g.
+	// http://localhost:4318/v1/traces
+	Endpoint string
+	// Headers are added to the export requests, e.g. for authentication.
+	Headers map[string]string
+	// ServiceName is the value of the service.name resource attribute.
+	ServiceName string
+	// SampleRatio is the fraction of traces to sample, between 0 and 1.
+	// Spans with a sampled remote parent are always sampled.
+	SampleRatio float64
+	// Client is the HTTP client used to export spans. The default is a
+	// client with a 10 second timeout.
+	Client *http.Client
+}
+
+// Tracer creates spans and exports them in the background.
+type Tracer struct {
+	cfg       Config
+	threshold uint64
+
+	mu     sync.Mutex
+	queue  []*Span
+	closed bool
+	flush  chan struct{}
+	done   chan struct{}
+}
+
+// New returns a new Tracer. Close must be called to release its resources.
+func New(cfg Config) *Tracer {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "tlsproxy"
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	t := &Tracer{
+		cfg:   cfg,
+		flush: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	switch {
+	case cfg.SampleRatio >= 1:
+		t.threshold = math.MaxUint64
+	case cfg.SampleRatio > 0:
+		t.threshold = uint64(cfg.SampleRatio * math.MaxUint64)
+	}
+	go t.exportLoop()
+	return t
+}
+
+// Close exports the remaining spans and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	t.mu.Unlock()
+	close(t.flush)
+	<-t.done
+}
+
+// Start starts a new span. If parent is valid, the new span is its child.
+// Otherwise, the new span is the root of a new trace. The span is only
+// recorded and exported if it is sampled.
+func (t *Tracer) Start(name string, kind int, parent SpanContext, start time.Time) *Span {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  start,
+	}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.parentID = parent.SpanID
+		s.ctx.Sampled = parent.Sampled || t.sample(parent.TraceID)
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = t.sample(s.ctx.TraceID)
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return s
+}
+
+func (t *Tracer) sample(id [16]byte) bool {
+	if t == nil || t.threshold == 0 {
+		return false
+	}
+	var v uint64
+	for _, b := range id[8:] {
+		v = v<<8 | uint64(b)
+	}
+	return v <= t.threshold
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || len(t.queue) >= maxQueueSize {
+		return
+	}
+	t.queue = append(t.queue, s)
+	if len(t.queue) >= maxBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		var stop bool
+		select {
+		case <-ticker.C:
+		case _, ok := <-t.flush:
+			stop = !ok
+		}
+		for {
+			t.mu.Lock()
+			n := min(len(t.queue), maxBatchSize)
+			batch := t.queue[:n:n]
+			t.queue = t.queue[n:]
+			t.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if err := t.export(batch); err != nil {
+				log.Printf("ERR Tracing: %v", err)
+				break
+			}
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("export: %s", resp.Status)
+	}
+	return nil
+}
+
+// SpanContext identifies a span.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns true if sc has non-zero trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the value of the traceparent header for sc.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses the value of a traceparent header.
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	// version-traceid-parentid-flags
+	if len(v) < 55 || v[2] != '-' || v[35] != '-' || v[52] != '-' || (len(v) > 55 && v[55] != '-') {
+		return sc, false
+	}
+	version, err := hex.DecodeString(v[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(v) != 55) {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(v[53:55])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span is a single operation within a trace.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     int
+	ctx      SpanContext
+	parentID [8]byte
+	start    time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []attribute
+	events   []event
+	errorMsg string
+	ended    bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+type event struct {
+	name string
+	time time.Time
+}
+
+// Context returns the span's context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute sets an attribute on the span. The value must be a string,
+// a bool, an int, an int64, or a float64.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// AddEvent adds a named event to the span.
+func (s *Span) AddEvent(name string, t time.Time) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event{name, t})
+}
+
+// SetError sets the span's status to error.
+func (s *Span) SetError(msg string) {
+	if s == nil || !s.ctx.Sampled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorMsg = msg
+}
+
+// End ends the span. Only the first call has any effect.
+func (s *Span) End(t time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = t
+	s.mu.Unlock()
+	if s.ctx.Sampled && s.tracer != nil {
+		s.tracer.enqueue(s)
+	}
+}
+
+// The OTLP JSON encoding.
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string `json:"timeUnixNano"`
+	Name         string `json:"name"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func newValue(v any) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (t *Tracer) encode(spans []*Span) otlpRequest {
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "tlsproxy"}}
+	for _, s := range spans {
+		s.mu.Lock()
+		os := otlpSpan{
+			TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+		}
+		if s.parentID != [8]byte{} {
+			os.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			os.Attributes = append(os.Attributes, otlpKeyValue{Key: a.key, Value: newValue(a.value)})
+		}
+		for _, e := range s.events {
+			os.Events = append(os.Events, otlpEvent{TimeUnixNano: unixNano(e.time), Name: e.name})
+		}
+		if s.errorMsg != "" {
+			os.Status = &otlpStatus{Code: 2, Message: s.errorMsg}
+		}
+		s.mu.Unlock()
+		ss.Spans = append(ss.Spans, os)
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: newValue(t.cfg.ServiceName)}},
+			},
+			ScopeSpans: []otlpScopeSpans{ss},
+		}},
+	}
+}
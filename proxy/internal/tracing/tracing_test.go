@@ -0,0 +1,164 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01", false, false},
+		{"", false, false},
+	} {
+		sc, ok := ParseTraceparent(tc.in)
+		if ok != tc.ok {
+			t.Errorf("ParseTraceparent(%q) = %v, want %v", tc.in, ok, tc.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sc.Sampled != tc.sampled {
+			t.Errorf("ParseTraceparent(%q).Sampled = %v, want %v", tc.in, sc.Sampled, tc.sampled)
+		}
+		if tc.in[:2] == "00" {
+			if got := sc.Traceparent(); got != tc.in {
+				t.Errorf("Traceparent() = %q, want %q", got, tc.in)
+			}
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	never := New(Config{Endpoint: "http://localhost:0", SampleRatio: 0})
+	defer never.Close()
+	always := New(Config{Endpoint: "http://localhost:0", SampleRatio: 1})
+	defer always.Close()
+
+	if s := never.Start("x", KindServer, SpanContext{}, time.Now()); s.Context().Sampled {
+		t.Error("span should not be sampled")
+	}
+	if s := always.Start("x", KindServer, SpanContext{}, time.Now()); !s.Context().Sampled {
+		t.Error("span should be sampled")
+	}
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s := never.Start("x", KindServer, parent, time.Now())
+	if !s.Context().Sampled {
+		t.Error("span with sampled parent should be sampled")
+	}
+	if s.Context().TraceID != parent.TraceID {
+		t.Error("span should have the parent's trace ID")
+	}
+}
+
+func TestExport(t *testing.T) {
+	var mu sync.Mutex
+	var got []otlpRequest
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		var r otlpRequest
+		if err := json.Unmarshal(b, &r); err != nil {
+			t.Errorf("json.Unmarshal: %v", err)
+		}
+		mu.Lock()
+		got = append(got, r)
+		auth = req.Header.Get("Authorization")
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	tr := New(Config{
+		Endpoint:    srv.URL,
+		Headers:     map[string]string{"Authorization": "Bearer foo"},
+		ServiceName: "test",
+		SampleRatio: 1,
+	})
+	start := time.Unix(1000, 0)
+	root := tr.Start("conn", KindServer, SpanContext{}, start)
+	root.SetAttribute("server.address", "example.com")
+	root.SetAttribute("bytes", int64(123))
+	root.AddEvent("handshake", start.Add(time.Millisecond))
+	child := tr.Start("GET", KindServer, root.Context(), start.Add(2*time.Millisecond))
+	child.SetError("oops")
+	child.End(start.Add(3 * time.Millisecond))
+	root.End(start.Add(4 * time.Millisecond))
+	root.End(start.Add(5 * time.Millisecond))
+	tr.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if auth != "Bearer foo" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if len(got) != 1 || len(got[0].ResourceSpans) != 1 || len(got[0].ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Unexpected export: %#v", got)
+	}
+	rs := got[0].ResourceSpans[0]
+	if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "test" {
+		t.Errorf("service.name = %v", v)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Got %d spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "GET" || r.Name != "conn" {
+		t.Errorf("Unexpected span names %q, %q", c.Name, r.Name)
+	}
+	if c.TraceID != r.TraceID || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("Unexpected span relationship: %#v %#v", c, r)
+	}
+	if c.Status == nil || c.Status.Code != 2 || c.Status.Message != "oops" {
+		t.Errorf("Unexpected status: %#v", c.Status)
+	}
+	if r.StartTimeUnixNano != "1000000000000" || r.EndTimeUnixNano != "1000004000000" {
+		t.Errorf("Unexpected times: %s %s", r.StartTimeUnixNano, r.EndTimeUnixNano)
+	}
+	if len(r.Attributes) != 2 || r.Attributes[1].Value.IntValue == nil || *r.Attributes[1].Value.IntValue != "123" {
+		t.Errorf("Unexpected attributes: %#v", r.Attributes)
+	}
+	if len(r.Events) != 1 || r.Events[0].Name != "handshake" {
+		t.Errorf("Unexpected events: %#v", r.Events)
+	}
+}
@@ -0,0 +1,188 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxIPListSize       = 16 << 20
+	ipListRetryInterval = time.Minute
+)
+
+// ipList is a list of IP network addresses that is loaded from a file or a
+// URL, and refreshed periodically. The list is replaced atomically so that
+// reloads don't affect the connections being checked.
+type ipList struct {
+	cfg    ConfigIPList
+	nets   atomic.Pointer[[]*net.IPNet]
+	cancel context.CancelFunc
+	// drops is the number of connections dropped because their IP
+	// address is in this list, when it is used as a threat feed.
+	drops atomic.Int64
+}
+
+func newIPList(cfg ConfigIPList) *ipList {
+	return &ipList{cfg: cfg}
+}
+
+// start loads the list and refreshes it periodically until ctx is canceled
+// or stop is called.
+func (l *ipList) start(ctx context.Context) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	err := l.load(ctx)
+	go func() {
+		for {
+			interval := l.cfg.RefreshInterval
+			if err != nil {
+				interval = min(interval, ipListRetryInterval)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			err = l.load(ctx)
+		}
+	}()
+}
+
+func (l *ipList) stop() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+}
+
+func (l *ipList) load(ctx context.Context) error {
+	nets, err := fetchIPList(ctx, l.cfg.Source)
+	if err != nil {
+		log.Printf("ERR IP list %q: %v", l.cfg.Name, err)
+		return err
+	}
+	if old := l.nets.Load(); old == nil || len(*old) != len(nets) {
+		log.Printf("INF IP list %q has %d entries", l.cfg.Name, len(nets))
+	}
+	l.nets.Store(&nets)
+	return nil
+}
+
+// contains returns true if ip is in the list. The list is empty until it
+// is loaded successfully.
+func (l *ipList) contains(ip net.IP) bool {
+	nets := l.nets.Load()
+	if nets == nil {
+		return false
+	}
+	for _, n := range *nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// size returns the number of entries in the list.
+func (l *ipList) size() int {
+	if nets := l.nets.Load(); nets != nil {
+		return len(*nets)
+	}
+	return 0
+}
+
+func fetchIPList(ctx context.Context, source string) ([]*net.IPNet, error) {
+	if isFileName(source) {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseIPList(io.LimitReader(f, maxIPListSize))
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("user-agent", "tlsproxy")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return parseIPList(io.LimitReader(resp.Body, maxIPListSize))
+}
+
+// parseIPList parses a list of IP addresses or network addresses in CIDR
+// format, one per line. Empty lines and comments are ignored.
+func parseIPList(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		s := fields[0]
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: invalid IP address %q", n, s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nets, nil
+}
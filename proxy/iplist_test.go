@@ -0,0 +1,123 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIPList(t *testing.T) {
+	in := `# Comment
+10.0.0.0/8 ; SBL123
+192.168.1.1
+
+2001:db8::/32
+2001:db8::1 # single address
+`
+	nets, err := parseIPList(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("parseIPList: %v", err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "2001:db8::1/128"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("parseIPList() = %v, want %v", got, want)
+	}
+
+	if _, err := parseIPList(strings.NewReader("10.0.0.0/8\nfoo\n")); err == nil {
+		t.Error("parseIPList(foo) succeeded unexpectedly")
+	}
+}
+
+func TestIPListCheckIP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(file, []byte("10.1.0.0/16\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("10.0.0.0/8\n"))
+	}))
+	defer srv.Close()
+
+	allow := newIPList(ConfigIPList{Name: "allow", Source: srv.URL, RefreshInterval: time.Hour})
+	allow.start(ctx)
+	defer allow.stop()
+	deny := newIPList(ConfigIPList{Name: "deny", Source: file, RefreshInterval: time.Hour})
+	deny.start(ctx)
+	defer deny.stop()
+
+	be := &Backend{
+		allowIPLists: []*ipList{allow},
+		denyIPLists:  []*ipList{deny},
+	}
+	for _, tc := range []struct {
+		ip   string
+		want error
+	}{
+		{"10.0.0.1", nil},
+		{"10.1.0.1", errAccessDenied},
+		{"192.168.0.1", errAccessDenied},
+	} {
+		if got := be.checkIP(&net.TCPAddr{IP: net.ParseIP(tc.ip)}); got != tc.want {
+			t.Errorf("checkIP(%s) = %v, want %v", tc.ip, got, tc.want)
+		}
+	}
+
+	// Reloading the list replaces it.
+	if err := os.WriteFile(file, []byte("10.2.0.0/16\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := deny.load(ctx); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if got := be.checkIP(&net.TCPAddr{IP: net.ParseIP("10.1.0.1")}); got != nil {
+		t.Errorf("checkIP(10.1.0.1) = %v, want nil", got)
+	}
+	if got := be.checkIP(&net.TCPAddr{IP: net.ParseIP("10.2.0.1")}); got != errAccessDenied {
+		t.Errorf("checkIP(10.2.0.1) = %v, want %v", got, errAccessDenied)
+	}
+
+	// A failed reload keeps the previous list.
+	os.Remove(file)
+	if err := deny.load(ctx); err == nil {
+		t.Fatal("load succeeded unexpectedly")
+	}
+	if got := be.checkIP(&net.TCPAddr{IP: net.ParseIP("10.2.0.1")}); got != errAccessDenied {
+		t.Errorf("checkIP(10.2.0.1) = %v, want %v", got, errAccessDenied)
+	}
+}
@@ -0,0 +1,149 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/http/httpguts"
+)
+
+// jwtClaimsCtxKey is the context key of the claims of the request's bearer
+// token, when JWTAuth is enabled.
+var jwtClaimsCtxKey ctxKey = 3
+
+var jwtAuthMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// jwtAuthHandler validates the bearer tokens of the requests according to
+// be.JWTAuth, and forwards their claims to next in be.JWTAuth.ClaimHeaders.
+func (be *Backend) jwtAuthHandler(next http.Handler) http.Handler {
+	ja := be.JWTAuth
+	if ja == nil {
+		return next
+	}
+	issuers := make(map[string]*JWTIssuer, len(ja.Issuers))
+	for _, iss := range ja.Issuers {
+		issuers[iss.Issuer] = iss
+	}
+	keyFunc := func(tok *jwt.Token) (any, error) {
+		iss, err := tok.Claims.GetIssuer()
+		if err != nil {
+			return nil, err
+		}
+		issuer, ok := issuers[iss]
+		if !ok {
+			return nil, errors.New("unknown issuer")
+		}
+		kid, _ := tok.Header["kid"].(string)
+		return be.jwksCache.Key(issuer.JWKS, kid, issuer.RefreshInterval)
+	}
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(jwtAuthMethods),
+		jwt.WithLeeway(ja.ClockSkew),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range ja.ClaimHeaders {
+			req.Header.Del(h)
+		}
+		auth := req.Header.Get("Authorization")
+		if auth == "" && ja.Optional {
+			next.ServeHTTP(w, req)
+			return
+		}
+		scheme, token, _ := strings.Cut(auth, " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			be.recordEvent("missing bearer token")
+			log.Printf("REQ %s ➔ %s %s ➔ status:%d missing bearer token (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusUnauthorized, userAgent(req))
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims := jwt.MapClaims{}
+		_, err := parser.ParseWithClaims(strings.TrimSpace(token), claims, keyFunc)
+		if err == nil && len(ja.Audiences) > 0 {
+			if aud, _ := claims.GetAudience(); !slices.ContainsFunc(aud, func(a string) bool { return slices.Contains(ja.Audiences, a) }) {
+				err = jwt.ErrTokenInvalidAudience
+			}
+		}
+		if err != nil {
+			be.recordEvent("invalid bearer token")
+			log.Printf("REQ %s ➔ %s %s ➔ status:%d invalid bearer token: %v (%q)", formatReqDesc(req), req.Method, req.URL.Path, http.StatusUnauthorized, err, userAgent(req))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for claim, h := range ja.ClaimHeaders {
+			if v, ok := claims[claim]; ok {
+				if s := claimHeaderValue(v); s != "" && httpguts.ValidHeaderFieldValue(s) {
+					req.Header.Set(h, s)
+				}
+			}
+		}
+		if ja.StripToken {
+			req.Header.Del("Authorization")
+		}
+		if rw, ok := w.(*responseRecorder); ok {
+			if sub, _ := claims.GetSubject(); sub != "" {
+				rw.user = sub
+			}
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), jwtClaimsCtxKey, claims)))
+	})
+}
+
+// claimHeaderValue formats the value of a claim for a request header.
+func claimHeaderValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				b, _ := json.Marshal(v)
+				return string(b)
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ", ")
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,158 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/jwks"
+)
+
+func TestJWTAuthHandler(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	content := fmt.Sprintf(`{"keys":[{"kty":"EC","use":"sig","kid":"key1","crv":"P-256","x":%q,"y":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.Y.Bytes()))
+	if err := os.WriteFile(jwksFile, []byte(content), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	be := &Backend{
+		JWTAuth: &JWTAuth{
+			Issuers: []*JWTIssuer{
+				{Issuer: "https://idp.example.com", JWKS: jwksFile},
+			},
+			Audiences: []string{"api"},
+			ClockSkew: time.Minute,
+			ClaimHeaders: map[string]string{
+				"sub":    "X-User",
+				"groups": "X-Groups",
+			},
+			StripToken: true,
+		},
+		jwksCache:   jwks.New(),
+		recordEvent: func(string) {},
+	}
+	handler := be.jwtAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "user=%s groups=%s auth=%s", req.Header.Get("X-User"), req.Header.Get("X-Groups"), req.Header.Get("Authorization"))
+	}))
+
+	now := time.Now()
+	token := func(k *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		tok.Header["kid"] = "key1"
+		s, err := tok.SignedString(k)
+		if err != nil {
+			t.Fatalf("SignedString: %v", err)
+		}
+		return "Bearer " + s
+	}
+	valid := jwt.MapClaims{
+		"iss":    "https://idp.example.com",
+		"aud":    "api",
+		"sub":    "alice",
+		"groups": []string{"admin", "dev"},
+		"iat":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+	}
+	with := func(k string, v any) jwt.MapClaims {
+		c := jwt.MapClaims{}
+		for kk, vv := range valid {
+			c[kk] = vv
+		}
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		desc, auth string
+		want       int
+		body       string
+	}{
+		{"valid", token(key, valid), 200, "user=alice groups=admin, dev auth="},
+		{"clock skew", token(key, with("exp", now.Add(-30*time.Second).Unix())), 200, "user=alice groups=admin, dev auth="},
+		{"no token", "", 401, ""},
+		{"not bearer", "Basic Zm9vOmJhcg==", 401, ""},
+		{"garbage", "Bearer foo", 401, ""},
+		{"wrong key", token(otherKey, valid), 401, ""},
+		{"expired", token(key, with("exp", now.Add(-2*time.Minute).Unix())), 401, ""},
+		{"no exp", token(key, with("exp", nil)), 401, ""},
+		{"wrong issuer", token(key, with("iss", "https://evil.example.com")), 401, ""},
+		{"wrong audience", token(key, with("aud", "other")), 401, ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", "mallory")
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.desc, w.Code, tc.want)
+			continue
+		}
+		if tc.want == 200 && w.Body.String() != tc.body {
+			t.Errorf("%s: body = %q, want %q", tc.desc, w.Body.String(), tc.body)
+		}
+		if tc.want == 401 && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate header is missing", tc.desc)
+		}
+	}
+
+	be.JWTAuth.Optional = true
+	handler = be.jwtAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(w, "user=%s", req.Header.Get("X-User"))
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "mallory")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if got, want := w.Body.String(), "user="; w.Code != 200 || got != want {
+		t.Errorf("optional: status = %d, body = %q, want 200, %q", w.Code, got, want)
+	}
+}
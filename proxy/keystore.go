@@ -0,0 +1,57 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/keystore"
+)
+
+// tpmKeyStore is shared by all the key stores of type tpm, so that the TPM
+// device is opened only once.
+var tpmKeyStore = keystore.NewTPM(nil)
+
+// newKeyStoreProvider returns the keystore.Provider for ks.
+func newKeyStoreProvider(ks *ConfigKeyStore) (keystore.Provider, error) {
+	switch ks.Type {
+	case "awskms":
+		if ks.Region == "" {
+			return nil, errors.New("Region: must be set")
+		}
+		if ks.AccessKeyID == "" || ks.SecretAccessKey == "" {
+			return nil, errors.New("AccessKeyID, SecretAccessKey: must be set")
+		}
+		return keystore.NewAWSKMS(ks.Endpoint, ks.Region, ks.AccessKeyID, ks.SecretAccessKey)
+	case "tpm":
+		return tpmKeyStore, nil
+	default:
+		if !slices.Contains(keystore.Registered(), ks.Type) {
+			return nil, fmt.Errorf("Type: unexpected value %q", ks.Type)
+		}
+		return keystore.Open(ks.Type, ks.Options)
+	}
+}
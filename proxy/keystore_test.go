@@ -0,0 +1,235 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/keystore"
+)
+
+// testHSM is a key store that keeps its keys in memory.
+type testHSM map[string]*ecdsa.PrivateKey
+
+func (h testHSM) Signer(_ context.Context, keyID string) (crypto.Signer, error) {
+	key, ok := h[keyID]
+	if !ok {
+		return nil, errNotFound
+	}
+	// Hide the concrete type so that the proxy can only sign.
+	return struct{ crypto.Signer }{key}, nil
+}
+
+func TestKeyStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	hsm := testHSM{"key1": key}
+	keystore.Register("test-hsm", func(opts map[string]string) (keystore.Provider, error) {
+		if opts["pin"] != "1234" {
+			return nil, errNotFound
+		}
+		return hsm, nil
+	})
+
+	signer, err := hsm.Signer(ctx, "key1")
+	if err != nil {
+		t.Fatalf("Signer: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hsm.example.com"},
+		DNSNames:     []string{"hsm.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		KeyStores: []*ConfigKeyStore{
+			{
+				Name:    "hsm",
+				Type:    "test-hsm",
+				Options: map[string]string{"pin": "1234"},
+			},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"hsm.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				CertFile:    certPEM,
+				KeyStore:    "hsm",
+				KeyID:       "key1",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName:         "hsm.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	certs := conn.ConnectionState().PeerCertificates
+	conn.Close()
+	if len(certs) == 0 || string(certs[0].Raw) != string(der) {
+		t.Errorf("peer certificate isn't the one with the HSM key")
+	}
+
+	if got := proxy.cfg.redacted().KeyStores[0].Options["pin"]; got != "**REDACTED**" {
+		t.Errorf("redacted pin = %q", got)
+	}
+
+	// The admin API creates CSRs for keys in the key stores.
+	var csrHandler *localHandler
+	for _, h := range proxy.adminHandlers() {
+		if h.path == "/api/keystores/csr" {
+			csrHandler = &h
+		}
+	}
+	form := url.Values{"keyStore": {"hsm"}, "keyId": {"key1"}, "serverName": {"hsm.example.com"}}
+	req := httptest.NewRequest("POST", "/api/keystores/csr", strings.NewReader(form.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.Header.Set("x-csrf-check", "1")
+	w := httptest.NewRecorder()
+	csrHandler.handler.ServeHTTP(w, req)
+	var resp struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("csr response %d %q: %v", w.Code, w.Body.String(), err)
+	}
+	block, _ := pem.Decode([]byte(resp.CSR))
+	if block == nil {
+		t.Fatalf("csr = %q", resp.CSR)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificateRequest: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil || !key.PublicKey.Equal(csr.PublicKey) {
+		t.Errorf("CSR: %v, %v", err, csr.PublicKey)
+	}
+}
+
+func TestKeyStoreConfig(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		ks      []*ConfigKeyStore
+		be      *Backend
+		wantErr bool
+	}{
+		{
+			desc:    "unknown type",
+			ks:      []*ConfigKeyStore{{Name: "ks", Type: "foo"}},
+			wantErr: true,
+		},
+		{
+			desc:    "awskms without region",
+			ks:      []*ConfigKeyStore{{Name: "ks", Type: "awskms", AccessKeyID: "id", SecretAccessKey: "secret"}},
+			wantErr: true,
+		},
+		{
+			desc: "duplicate name",
+			ks: []*ConfigKeyStore{
+				{Name: "ks", Type: "tpm"},
+				{Name: "ks", Type: "tpm"},
+			},
+			wantErr: true,
+		},
+		{
+			desc:    "unknown key store",
+			be:      &Backend{ServerNames: []string{"example.com"}, CertFile: "/cert.pem", KeyStore: "foo", KeyID: "key"},
+			wantErr: true,
+		},
+		{
+			desc:    "key file and key store",
+			ks:      []*ConfigKeyStore{{Name: "ks", Type: "tpm"}},
+			be:      &Backend{ServerNames: []string{"example.com"}, CertFile: "/cert.pem", KeyFile: "/key.pem", KeyStore: "ks", KeyID: "key"},
+			wantErr: true,
+		},
+		{
+			desc:    "key id without key store",
+			be:      &Backend{ServerNames: []string{"example.com"}, CertFile: "/cert.pem", KeyID: "key"},
+			wantErr: true,
+		},
+		{
+			desc: "ok",
+			ks:   []*ConfigKeyStore{{Name: "kms", Type: "awskms", Region: "us-east-1", AccessKeyID: "id", SecretAccessKey: "secret"}},
+		},
+	} {
+		cfg := &Config{
+			CacheDir:  t.TempDir(),
+			MaxOpen:   100,
+			KeyStores: tc.ks,
+		}
+		if tc.be != nil {
+			tc.be.Addresses = []string{"192.168.0.1:80"}
+			cfg.Backends = []*Backend{tc.be}
+		}
+		if err := cfg.Check(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: Check() = %v, want error %v", tc.desc, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/activation"
+)
+
+// Names of the sockets that can be passed to the proxy with systemd socket
+// activation, i.e. the FileDescriptorName of the socket units.
+const (
+	socketNameHTTP            = "http"
+	socketNameTLS             = "tls"
+	socketNameQUIC            = "quic"
+	socketNameQUICPassthrough = "quicpassthrough"
+	socketNameMySQL           = "mysql"
+)
+
+// fileSocket is a socket that can be passed to another process.
+type fileSocket interface {
+	File() (*os.File, error)
+}
+
+type namedSocket struct {
+	name string
+	sock fileSocket
+}
+
+// listen returns a TCP listener for addr. It uses a socket that was passed to
+// the process, e.g. by systemd, when there is one.
+func (p *Proxy) listen(name, addr string) (net.Listener, error) {
+	l, err := activation.Listener(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		log.Printf("INF Using %s socket %s from parent process", name, l.Addr())
+	} else if l, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	p.addSocket(name, l)
+	return l, nil
+}
+
+// listenPacket returns a UDP socket for addr. It uses a socket that was passed
+// to the process, e.g. by systemd, when there is one.
+func (p *Proxy) listenPacket(name, addr string) (net.PacketConn, error) {
+	c, err := activation.PacketConn(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		log.Printf("INF Using %s socket %s from parent process", name, c.LocalAddr())
+	} else if c, err = net.ListenPacket("udp", addr); err != nil {
+		return nil, err
+	}
+	p.addSocket(name, c)
+	return c, nil
+}
+
+func (p *Proxy) addSocket(name string, s any) {
+	fs, ok := s.(fileSocket)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sockets = append(p.sockets, namedSocket{name: name, sock: fs})
+}
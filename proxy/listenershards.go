@@ -0,0 +1,180 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/activation"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const maxTLSListenerShards = 256
+
+// listenerShard is one of the sockets that receive the TLS connections, with
+// its own accept loop.
+type listenerShard struct {
+	index    int
+	total    int
+	listener net.Listener
+	// workers limits the number of connections that are doing their TLS
+	// handshake at the same time. It is nil when there is no limit.
+	workers chan struct{}
+
+	accepted     atomic.Int64
+	acceptErrors atomic.Int64
+	// handshakes is the number of connections that are holding a worker.
+	handshakes atomic.Int64
+}
+
+func newListenerShards(listeners []net.Listener, workers int) []*listenerShard {
+	shards := make([]*listenerShard, 0, len(listeners))
+	for i, l := range listeners {
+		s := &listenerShard{
+			index:    i,
+			total:    len(listeners),
+			listener: netw.NewListener(l),
+		}
+		if workers > 0 {
+			s.workers = make(chan struct{}, workers)
+		}
+		shards = append(shards, s)
+	}
+	return shards
+}
+
+// listenShards returns n TCP listeners for addr. When n is greater than 1,
+// the sockets are opened with SO_REUSEPORT. A socket that was passed to the
+// process, e.g. by systemd, is used as the first one. It must also have
+// SO_REUSEPORT.
+func (p *Proxy) listenShards(name, addr string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := p.listen(name, addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+	l, err := activation.Listener(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	if l != nil {
+		log.Printf("INF Using %s socket %s from parent process", name, l.Addr())
+	} else if l, err = listenReusePort(addr); err != nil {
+		return nil, err
+	}
+	p.addSocket(name, l)
+	listeners := []net.Listener{l}
+	for i := 1; i < n; i++ {
+		sl, err := listenReusePort(l.Addr().String())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		listeners = append(listeners, sl)
+	}
+	return listeners, nil
+}
+
+// closeListeners closes the listeners of all the shards.
+func (p *Proxy) closeListeners() {
+	for _, s := range p.shards {
+		s.listener.Close()
+	}
+}
+
+func (p *Proxy) acceptLoop(s *listenerShard) {
+	var desc string
+	if s.total > 1 {
+		desc = fmt.Sprintf(" (shard %d/%d)", s.index+1, s.total)
+	}
+	log.Printf("INF Accepting TLS connections on %s %s%s", s.listener.Addr().Network(), s.listener.Addr(), desc)
+	for {
+		acquired := false
+		if s.workers != nil {
+			// Wait for a worker to be available before accepting
+			// the next connection.
+			select {
+			case s.workers <- struct{}{}:
+				acquired = true
+			case <-p.ctx.Done():
+			}
+		}
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if acquired {
+				<-s.workers
+			}
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("INF TLS Accept loop terminated%s", desc)
+				break
+			}
+			s.acceptErrors.Add(1)
+			log.Printf("ERR TLS Accept%s: %v", desc, err)
+			continue
+		}
+		s.accepted.Add(1)
+		if acquired {
+			s.handshakes.Add(1)
+			var once sync.Once
+			onHandshakeDone(conn.(*netw.Conn), func() {
+				once.Do(func() {
+					s.handshakes.Add(-1)
+					<-s.workers
+				})
+			})
+		}
+		go p.handleConnection(conn.(*netw.Conn))
+	}
+}
+
+// onHandshakeDone registers a function to call when conn's TLS handshake is
+// done, or when conn is closed before that.
+func onHandshakeDone(conn anyConn, f func()) {
+	ac := annotatedConn(conn)
+	funcs, _ := ac.Annotation(handshakeWorkerKey, []func(){}).([]func())
+	ac.SetAnnotation(handshakeWorkerKey, append(funcs, f))
+}
+
+// releaseHandshakeWorker is called when conn's TLS handshake is done, or when
+// conn is closed before that, to release its handshake workers.
+func releaseHandshakeWorker(conn anyConn) {
+	ac := annotatedConn(conn)
+	funcs, _ := ac.Annotation(handshakeWorkerKey, []func(){}).([]func())
+	if len(funcs) == 0 {
+		return
+	}
+	ac.SetAnnotation(handshakeWorkerKey, []func(){})
+	for _, f := range funcs {
+		f()
+	}
+}
@@ -0,0 +1,180 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestListenerShards(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_REUSEPORT is only supported on linux")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr:          "localhost:0",
+		TLSAddr:           "localhost:0",
+		TLSListenerShards: 4,
+		HandshakeWorkers:  1,
+		CacheDir:          t.TempDir(),
+		MaxOpen:           100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	if got, want := len(proxy.shards), 4; got != want {
+		t.Fatalf("len(shards) = %d, want %d", got, want)
+	}
+	addr := proxy.listener.Addr().String()
+	for i, s := range proxy.shards {
+		if got := s.listener.Addr().String(); got != addr {
+			t.Errorf("shard[%d] addr = %s, want %s", i, got, addr)
+		}
+	}
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		got, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+		if want := "Hello from backend\n"; got != want {
+			t.Errorf("tlsGet() = %q, want %q", got, want)
+		}
+	}
+	var total int64
+	for _, s := range proxy.shards {
+		total += s.accepted.Load()
+		if n := s.handshakes.Load(); n != 0 {
+			t.Errorf("busy workers = %d, want 0", n)
+		}
+	}
+	if total != n {
+		t.Errorf("accepted = %d, want %d", total, n)
+	}
+}
+
+func TestHandshakeWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr:         "localhost:0",
+		TLSAddr:          "localhost:0",
+		HandshakeWorkers: 1,
+		CacheDir:         t.TempDir(),
+		MaxOpen:          100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	// This connection doesn't send a ClientHello. It uses the only
+	// handshake worker.
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer idle.Close()
+
+	ch := make(chan error)
+	go func() {
+		_, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil)
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		t.Fatalf("tlsGet returned before a worker was available: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	idle.Close()
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("tlsGet: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tlsGet timed out")
+	}
+}
+
+func TestListenerShardsCheck(t *testing.T) {
+	for _, tc := range []struct {
+		shards, workers int
+		ok              bool
+	}{
+		{0, 0, true},
+		{1, 10, true},
+		{-1, 0, false},
+		{1000, 0, false},
+		{1, -1, false},
+	} {
+		cfg := &Config{
+			HTTPAddr:          "localhost:0",
+			TLSAddr:           "localhost:0",
+			TLSListenerShards: tc.shards,
+			HandshakeWorkers:  tc.workers,
+			CacheDir:          t.TempDir(),
+		}
+		if err := cfg.Check(); (err == nil) != tc.ok {
+			t.Errorf("Check(%d, %d) = %v", tc.shards, tc.workers, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"io"
+	"log"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logging"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logsink"
+)
+
+var (
+	validLogComponents = []string{
+		"acme",
+		"bridge",
+		"handshake",
+		"http",
+		"oidc",
+		"passkeys",
+		"pki",
+		"proxy",
+		"quic",
+		"revocation",
+		"sso",
+		"tokenmanager",
+		"tracing",
+	}
+
+	// logFuncComponents maps functions of this package to log
+	// components.
+	logFuncComponents = map[string]string{
+		"handleACMEConnection":           "acme",
+		"handleConnection":               "handshake",
+		"authorizeTLSConnection":         "handshake",
+		"checkIP":                        "handshake",
+		"allowIP":                        "handshake",
+		"allowSubject":                   "handshake",
+		"reportFailure":                  "handshake",
+		"handleTLSConnection":            "bridge",
+		"handleTLSPassthroughConnection": "bridge",
+		"handleQUICTCPStream":            "bridge",
+		"handleQUICQUICStream":           "bridge",
+		"bridgeConns":                    "bridge",
+		"dial":                           "bridge",
+		"dialQUICBackend":                "bridge",
+		"logConnEnd":                     "bridge",
+	}
+	// logFileComponents maps files of this package to log components.
+	logFileComponents = map[string]string{
+		"acme.go":         "acme",
+		"revoke.go":       "acme",
+		"backend-http.go": "http",
+		"http.go":         "http",
+		"backend-sso.go":  "sso",
+		"jwtauth.go":      "sso",
+		"quic.go":         "quic",
+		"revocation.go":   "revocation",
+		"staticcert.go":   "handshake",
+	}
+	// logPackageComponents maps other packages to log components.
+	logPackageComponents = map[string]string{
+		"dns01":     "acme",
+		"autocert":  "acme",
+		"ocspcache": "revocation",
+		"crlcache":  "revocation",
+		"jwks":      "sso",
+		"sshca":     "pki",
+	}
+)
+
+var logState struct {
+	sync.Mutex
+	handler    slog.Handler
+	cfg        *ConfigLog
+	baseOutput io.Writer
+	baseFlags  int
+	installed  bool
+	writer     *logging.Writer
+	// sink is the syslog or journald destination, and sinkCfg its
+	// parameters.
+	sink    logsink.Sink
+	sinkCfg logSink
+}
+
+// SetLogHandler sends the proxy's log messages to h, e.g. to integrate with
+// an application's own log/slog configuration. Each record has a "component"
+// attribute, and a "tag" attribute with the message's original tag, e.g. INF
+// or ERR. The levels from the log config section are still applied. A nil
+// handler restores the default behavior.
+//
+// Since the proxy uses the standard log package, this affects all the
+// messages logged with the standard logger.
+func SetLogHandler(h slog.Handler) {
+	logState.Lock()
+	defer logState.Unlock()
+	logState.handler = h
+	applyLogConfigLocked()
+}
+
+// setLogConfig applies the log config section. When the syslog or journald
+// destination can't be opened, the messages are written to the standard
+// error instead.
+func setLogConfig(cfg *ConfigLog) error {
+	logState.Lock()
+	defer logState.Unlock()
+	logState.cfg = cfg
+	sc := cfg.sink()
+	if logState.sink != nil && logState.sinkCfg == sc {
+		applyLogConfigLocked()
+		return nil
+	}
+	if logState.sink != nil {
+		logState.sink.Close()
+		logState.sink = nil
+	}
+	sink, err := sc.open()
+	if err == nil {
+		logState.sink, logState.sinkCfg = sink, sc
+	}
+	applyLogConfigLocked()
+	return err
+}
+
+func applyLogConfigLocked() {
+	cfg := logState.cfg
+	if logState.installed && log.Writer() != io.Writer(logState.writer) {
+		// Someone else changed the log output, e.g. to turn off
+		// logging. Use the new output.
+		logState.baseOutput = log.Writer()
+	}
+	if logState.handler == nil && cfg == nil {
+		if logState.installed {
+			log.SetOutput(logState.baseOutput)
+			log.SetFlags(logState.baseFlags)
+			logState.installed = false
+		}
+		return
+	}
+	if !logState.installed {
+		logState.baseOutput = log.Writer()
+		logState.baseFlags = log.Flags()
+	}
+	if cfg == nil {
+		cfg = &ConfigLog{}
+	}
+	h := logState.handler
+	if h == nil && logState.sink != nil {
+		h = logsink.NewHandler(logState.sink, cfg.Format == LogFormatJSON)
+	}
+	if h == nil {
+		hOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+		if cfg.Format == LogFormatJSON {
+			h = slog.NewJSONHandler(logState.baseOutput, hOpts)
+		} else {
+			h = slog.NewTextHandler(logState.baseOutput, hOpts)
+		}
+	}
+	// The values were validated in Config.Check.
+	level, _ := logging.ParseLevel(cfg.Level)
+	levels := make(map[string]slog.Level, len(cfg.Components))
+	for c, l := range cfg.Components {
+		levels[c], _ = logging.ParseLevel(l)
+	}
+	logState.writer = logging.New(logging.Options{
+		Handler:         h,
+		Level:           level,
+		ComponentLevels: levels,
+		Component:       logComponent,
+	})
+	log.SetOutput(logState.writer)
+	log.SetFlags(0)
+	logState.installed = true
+}
+
+// logComponent returns the name of the component that logged a message from
+// the function that called the log package.
+func logComponent(frame runtime.Frame) string {
+	// e.g. github.com/c2FmZQ/tlsproxy/proxy.(*Proxy).handleConnection
+	dir, fn := path.Split(frame.Function)
+	pkg, fn, _ := strings.Cut(fn, ".")
+	if dir+pkg != "github.com/c2FmZQ/tlsproxy/proxy" {
+		if c, ok := logPackageComponents[pkg]; ok {
+			return c
+		}
+		if slices.Contains(validLogComponents, pkg) {
+			return pkg
+		}
+		return "proxy"
+	}
+	// Remove the receiver and closure suffixes, e.g. (*Proxy).Foo.func1
+	if i := strings.LastIndex(fn, ")."); i >= 0 {
+		fn = fn[i+2:]
+	}
+	fn, _, _ = strings.Cut(fn, ".")
+	if c, ok := logFuncComponents[fn]; ok {
+		return c
+	}
+	if c, ok := logFileComponents[filepath.Base(frame.File)]; ok {
+		return c
+	}
+	return "proxy"
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"net"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testLogHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *testLogHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *testLogHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *testLogHandler) WithGroup(string) slog.Handler            { return h }
+func (h *testLogHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func TestLogComponent(t *testing.T) {
+	for _, tc := range []struct {
+		function, file, want string
+	}{
+		{"github.com/c2FmZQ/tlsproxy/proxy.(*Proxy).handleConnection", "/src/proxy/proxy.go", "handshake"},
+		{"github.com/c2FmZQ/tlsproxy/proxy.(*Proxy).handleTLSConnection.func2", "/src/proxy/proxy.go", "bridge"},
+		{"github.com/c2FmZQ/tlsproxy/proxy.logConnEnd", "/src/proxy/accesslog.go", "bridge"},
+		{"github.com/c2FmZQ/tlsproxy/proxy.(*Proxy).RevokeAllCertificates", "/src/proxy/revoke.go", "acme"},
+		{"github.com/c2FmZQ/tlsproxy/proxy.(*Backend).reverseProxyModifyResponse", "/src/proxy/backend-http.go", "http"},
+		{"github.com/c2FmZQ/tlsproxy/proxy.(*Proxy).Reconfigure", "/src/proxy/proxy.go", "proxy"},
+		{"github.com/c2FmZQ/tlsproxy/proxy/internal/oidc.(*ProviderClient).HandleCallback", "/src/proxy/internal/oidc/oidc.go", "oidc"},
+		{"github.com/c2FmZQ/tlsproxy/proxy/internal/dns01.(*Manager).RenewalLoop", "/src/proxy/internal/dns01/dns01.go", "acme"},
+		{"github.com/c2FmZQ/storage.(*Storage).OpenForUpdate", "/src/storage/storage.go", "proxy"},
+	} {
+		if got := logComponent(runtime.Frame{Function: tc.function, File: tc.file}); got != tc.want {
+			t.Errorf("logComponent(%q) = %q, want %q", tc.function, got, tc.want)
+		}
+	}
+}
+
+func TestSetLogHandler(t *testing.T) {
+	h := &testLogHandler{}
+	SetLogHandler(h)
+	setLogConfig(&ConfigLog{Level: "warn"})
+	defer func() {
+		SetLogHandler(nil)
+		setLogConfig(nil)
+	}()
+
+	log.Print("INF not logged")
+	log.Print("BAD logged")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.records) != 1 {
+		t.Fatalf("Got %d records, want 1", len(h.records))
+	}
+	r := h.records[0]
+	if r.Message != "logged" || r.Level != slog.LevelWarn {
+		t.Errorf("Got record %q %v, want %q %v", r.Message, r.Level, "logged", slog.LevelWarn)
+	}
+	attrs := make(map[string]string)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	if attrs["component"] != "proxy" || attrs["tag"] != "BAD" {
+		t.Errorf("Got attrs %v", attrs)
+	}
+}
+
+func TestLogSyslog(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer pc.Close()
+	if err := setLogConfig(&ConfigLog{
+		Syslog: true,
+		SyslogConfig: SyslogConfig{
+			SyslogNetwork:  "udp",
+			SyslogAddress:  pc.LocalAddr().String(),
+			SyslogFacility: "local1",
+		},
+	}); err != nil {
+		t.Fatalf("setLogConfig: %v", err)
+	}
+	defer setLogConfig(nil)
+
+	log.Print("DBG not logged")
+	log.Print("WRN hello")
+
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	// local1 (17) * 8 + warning (4) = 140
+	re := regexp.MustCompile(`^<140>1 \S+ \S+ tlsproxy \d+ - - level=WARN msg=hello component=proxy tag=WRN$`)
+	if got := string(buf[:n]); !re.MatchString(got) {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestLogSinkCheck(t *testing.T) {
+	for _, tc := range []struct {
+		sink    logSink
+		wantErr string
+	}{
+		{sink: logSink{}},
+		{sink: logSink{Syslog: true}},
+		{sink: logSink{Syslog: true, Network: "tls", Address: "syslog.example.com:6514", CACert: "/ca.pem", Facility: "local7"}},
+		{sink: logSink{Journald: true, Tag: "proxy", Facility: "daemon", journaldOK: true}},
+		{sink: logSink{Syslog: true, Journald: true}, wantErr: "can't both be set"},
+		{sink: logSink{Address: "localhost:514"}, wantErr: "require syslog"},
+		{sink: logSink{Facility: "local0"}, wantErr: "require syslog"},
+		{sink: logSink{Syslog: true, Facility: "local9"}, wantErr: "invalid facility"},
+		{sink: logSink{Syslog: true, Network: "tcp"}, wantErr: "must be set"},
+		{sink: logSink{Syslog: true, Network: "http", Address: "localhost:514"}, wantErr: "invalid value"},
+		{sink: logSink{Syslog: true, Network: "udp", Address: "localhost:514", CACert: "/ca.pem"}, wantErr: "requires the tls network"},
+	} {
+		err := tc.sink.check("log")
+		if tc.wantErr == "" && err != nil {
+			t.Errorf("%+v: check() = %v", tc.sink, err)
+		}
+		if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%+v: check() = %v, want %q", tc.sink, err, tc.wantErr)
+		}
+	}
+}
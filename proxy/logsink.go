@@ -0,0 +1,160 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/logsink"
+)
+
+// logSink contains the syslog and journald parameters of a log config
+// section.
+type logSink struct {
+	Syslog   bool
+	Journald bool
+	Network  string
+	Address  string
+	CACert   string
+	Tag      string
+	Facility string
+
+	// journaldOK indicates that the section supports journald.
+	journaldOK bool
+}
+
+func (l *ConfigLog) sink() logSink {
+	if l == nil {
+		return logSink{}
+	}
+	return logSink{
+		Syslog:     l.Syslog,
+		Journald:   l.Journald,
+		Network:    l.SyslogNetwork,
+		Address:    l.SyslogAddress,
+		CACert:     l.SyslogCACert,
+		Tag:        l.SyslogTag,
+		Facility:   l.SyslogFacility,
+		journaldOK: true,
+	}
+}
+
+func (l *ConfigAccessLog) sink() logSink {
+	return logSink{
+		Syslog:     l.Syslog,
+		Journald:   l.Journald,
+		Network:    l.SyslogNetwork,
+		Address:    l.SyslogAddress,
+		CACert:     l.SyslogCACert,
+		Tag:        l.SyslogTag,
+		Facility:   l.SyslogFacility,
+		journaldOK: true,
+	}
+}
+
+func (l *ConfigAuditLog) sink() logSink {
+	return logSink{
+		Syslog:   l.Syslog,
+		Network:  l.SyslogNetwork,
+		Address:  l.SyslogAddress,
+		CACert:   l.SyslogCACert,
+		Tag:      l.SyslogTag,
+		Facility: l.SyslogFacility,
+	}
+}
+
+// check validates the parameters. section is the name of the config section,
+// e.g. accessLog.
+func (s logSink) check(section string) error {
+	if s.Syslog && s.Journald {
+		return fmt.Errorf("%s: syslog and journald can't both be set", section)
+	}
+	if !s.Syslog && (s.Network != "" || s.Address != "" || s.CACert != "") {
+		return fmt.Errorf("%s: syslogNetwork, syslogAddress, and syslogCACert require syslog", section)
+	}
+	if !s.Syslog && !s.Journald && (s.Tag != "" || s.Facility != "") {
+		if s.journaldOK {
+			return fmt.Errorf("%s: syslogTag and syslogFacility require syslog or journald", section)
+		}
+		return fmt.Errorf("%s: syslogTag and syslogFacility require syslog", section)
+	}
+	if _, err := logsink.ParseFacility(s.Facility); err != nil {
+		return fmt.Errorf("%s.syslogFacility: %w", section, err)
+	}
+	switch s.Network {
+	case "", "unix", "unixgram":
+	case "udp", "tcp", "tls":
+		if s.Address == "" {
+			return fmt.Errorf("%s.syslogAddress: must be set with the %s network", section, s.Network)
+		}
+	default:
+		return fmt.Errorf("%s.syslogNetwork: invalid value %q", section, s.Network)
+	}
+	if s.CACert != "" && s.Network != "tls" {
+		return fmt.Errorf("%s.syslogCACert: requires the tls network", section)
+	}
+	return nil
+}
+
+// open connects to syslog or journald. It returns nil when neither is
+// enabled.
+func (s logSink) open() (logsink.Sink, error) {
+	// The facility was validated in Config.Check.
+	facility, _ := logsink.ParseFacility(s.Facility)
+	switch {
+	case s.Syslog:
+		opts := logsink.SyslogOptions{
+			Network:  s.Network,
+			Address:  s.Address,
+			Tag:      s.Tag,
+			Facility: facility,
+		}
+		if s.CACert != "" {
+			b, err := os.ReadFile(s.CACert)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("%s: no certificates found", s.CACert)
+			}
+			opts.TLSConfig = &tls.Config{RootCAs: pool}
+		}
+		sl, err := logsink.DialSyslog(opts)
+		if err != nil {
+			return nil, err
+		}
+		return sl, nil
+	case s.Journald:
+		j, err := logsink.DialJournald("", s.Tag, facility)
+		if err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,132 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !noquic
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// serveConnectUDP handles an authorized CONNECT-UDP request (RFC 9298). The
+// UDP payloads are exchanged with the client in HTTP datagrams (RFC 9297) with
+// context ID 0, and with the destination on a new UDP socket. The flow ends
+// when the client closes the request stream.
+func (be *Backend) serveConnectUDP(w http.ResponseWriter, req *http.Request, addr string) {
+	streamer := httpStreamer(w)
+	if streamer == nil {
+		log.Printf("REQ %s ➔ CONNECT-UDP %s ➔ status:%d (%q)", formatReqDesc(req), addr, http.StatusNotImplemented, userAgent(req))
+		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		return
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	intConn, err := be.dialDestination(ctx, "udp", addr)
+	if err != nil {
+		be.recordEvent("dial error")
+		log.Printf("ERR %s ➔ CONNECT-UDP %s Dial: %v", formatReqDesc(req), addr, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer intConn.Close()
+
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	str := streamer.HTTPStream()
+	defer str.Close()
+
+	startTime := time.Now()
+	desc := formatReqDesc(req)
+	log.Printf("STR %s ➔ CONNECT-UDP ➔ %s", desc, intConn.RemoteAddr())
+
+	go func() {
+		defer cancel()
+		for {
+			b, err := str.ReceiveDatagram(ctx)
+			if err != nil {
+				return
+			}
+			// Datagrams with other context IDs are dropped.
+			id, n, err := quicvarint.Parse(b)
+			if err != nil || id != 0 {
+				continue
+			}
+			if _, err := intConn.Write(b[n:]); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer cancel()
+		buf := make([]byte, 65536)
+		for {
+			n, err := intConn.Read(buf[1:])
+			if err != nil {
+				return
+			}
+			// Context ID 0, followed by the UDP payload. Datagrams
+			// that are too large are dropped.
+			buf[0] = 0
+			str.SendDatagram(buf[:n+1])
+		}
+	}()
+	go func() {
+		defer cancel()
+		// The capsules sent by the client are ignored.
+		io.Copy(io.Discard, str)
+	}()
+	<-ctx.Done()
+
+	var sent, recv int64
+	if c, ok := intConn.(*netw.Conn); ok {
+		sent, recv = c.BytesReceived(), c.BytesSent()
+	}
+	log.Printf("END %s ➔ CONNECT-UDP ➔ %s; Dur:%s Recv:%d Sent:%d", desc, intConn.RemoteAddr(),
+		time.Since(startTime).Truncate(time.Millisecond), recv, sent)
+}
+
+// httpStreamer returns the http3.HTTPStreamer that w wraps, if any.
+func httpStreamer(w http.ResponseWriter) http3.HTTPStreamer {
+	for {
+		if s, ok := w.(http3.HTTPStreamer); ok {
+			return s
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,187 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+//go:build !noquic
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+func TestConnectUDP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo([]byte("Echo: "+string(buf[:n])), addr)
+		}
+	}()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"proxy.example.com"},
+				Mode:        ModeProxy,
+				ForwardProxy: &ForwardProxy{
+					Users: []*ForwardProxyUser{
+						{Name: "alice", PasswordHash: string(hash)},
+						{Name: "bob", PasswordHash: string(hash)},
+					},
+					Rules: []*ForwardProxyRule{
+						{
+							ACL:          &[]string{"USER:alice"},
+							Destinations: []string{"127.0.0.0/8:*"},
+							AllowUDP:     true,
+						},
+						{
+							ACL:          &[]string{"USER:bob"},
+							Destinations: []string{"127.0.0.0/8:*"},
+						},
+					},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := quic.DialAddr(ctx, proxy.quicTransport.(*netw.QUICTransport).Addr().String(), &tls.Config{
+		ServerName: "proxy.example.com",
+		RootCAs:    ca.RootCACertPool(),
+		NextProtos: []string{"h3"},
+	}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatalf("quic.DialAddr: %v", err)
+	}
+	defer conn.CloseWithError(0, "")
+	rt := &http3.SingleDestinationRoundTripper{Connection: conn, EnableDatagrams: true}
+
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	connectUDP := func(user string) (http3.RequestStream, int, error) {
+		str, err := rt.OpenRequestStream(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+		u, _ := url.Parse("https://proxy.example.com/.well-known/masque/udp/127.0.0.1/" + port + "/")
+		req := &http.Request{
+			Method: http.MethodConnect,
+			Proto:  connectUDPProtocol,
+			Host:   u.Host,
+			URL:    u,
+			Header: http.Header{
+				"Capsule-Protocol":    []string{"?1"},
+				"Proxy-Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(user))},
+			},
+		}
+		if err := str.SendRequestHeader(req); err != nil {
+			return nil, 0, err
+		}
+		resp, err := str.ReadResponse()
+		if err != nil {
+			return nil, 0, err
+		}
+		return str, resp.StatusCode, nil
+	}
+
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"bob:secret", http.StatusForbidden},
+		{"alice:wrong", http.StatusProxyAuthRequired},
+	} {
+		str, code, err := connectUDP(tc.user)
+		if err != nil {
+			t.Fatalf("connectUDP(%q): %v", tc.user, err)
+		}
+		str.Close()
+		if code != tc.want {
+			t.Errorf("connectUDP(%q) = %d, want %d", tc.user, code, tc.want)
+		}
+	}
+
+	str, code, err := connectUDP("alice:secret")
+	if err != nil {
+		t.Fatalf("connectUDP(alice): %v", err)
+	}
+	defer str.Close()
+	if code != http.StatusOK {
+		t.Fatalf("connectUDP(alice) = %d, want %d", code, http.StatusOK)
+	}
+	for i := 0; i < 3; i++ {
+		msg := fmt.Sprintf("Hello %d", i)
+		if err := str.SendDatagram(append([]byte{0}, msg...)); err != nil {
+			t.Fatalf("SendDatagram: %v", err)
+		}
+		rctx, rcancel := context.WithTimeout(ctx, 5*time.Second)
+		b, err := str.ReceiveDatagram(rctx)
+		rcancel()
+		if err != nil {
+			t.Fatalf("ReceiveDatagram: %v", err)
+		}
+		if got, want := string(b), "\x00Echo: "+msg; got != want {
+			t.Errorf("ReceiveDatagram = %q, want %q", got, want)
+		}
+	}
+}
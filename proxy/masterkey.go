@@ -0,0 +1,436 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/storage"
+	"github.com/c2FmZQ/storage/crypto"
+	"github.com/c2FmZQ/tpm"
+)
+
+// storageEncryptedFlag is the bit in the header of the storage files that
+// indicates that the file is encrypted. The header is "KRIN" followed by one
+// byte of flags, and the encrypted file key.
+const storageEncryptedFlag = 0x10
+
+// rotatingKey is the master key of the local storage. The key can be replaced
+// while the proxy is running. During a rotation, the file keys that were
+// encrypted with the previous key can still be decrypted, and the new file
+// keys are encrypted with the new key.
+//
+// Hash always uses the current key. The only file names that depend on it are
+// those of the OIDC login states, which are short-lived.
+type rotatingKey struct {
+	mu   sync.RWMutex
+	cur  crypto.MasterKey
+	prev crypto.MasterKey
+}
+
+var _ crypto.EncryptionKey = (*rotatingKey)(nil)
+
+func newRotatingKey(mk crypto.MasterKey) *rotatingKey {
+	return &rotatingKey{cur: mk}
+}
+
+func (k *rotatingKey) keys() (cur, prev crypto.MasterKey) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cur, k.prev
+}
+
+func (k *rotatingKey) current() crypto.MasterKey {
+	cur, _ := k.keys()
+	return cur
+}
+
+// rotate makes mk the current key. The previous key is kept until finish is
+// called.
+func (k *rotatingKey) rotate(mk crypto.MasterKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.prev != nil {
+		k.prev.Wipe()
+	}
+	k.prev = k.cur
+	k.cur = mk
+}
+
+// finish forgets the previous key.
+func (k *rotatingKey) finish() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.prev != nil {
+		k.prev.Wipe()
+		k.prev = nil
+	}
+}
+
+func (k *rotatingKey) Logger() crypto.Logger {
+	return k.current().Logger()
+}
+
+func (k *rotatingKey) Encrypt(data []byte) ([]byte, error) {
+	return k.current().Encrypt(data)
+}
+
+func (k *rotatingKey) Decrypt(data []byte) ([]byte, error) {
+	cur, prev := k.keys()
+	out, err := cur.Decrypt(data)
+	if err != nil && prev != nil {
+		return prev.Decrypt(data)
+	}
+	return out, err
+}
+
+func (k *rotatingKey) Hash(b []byte) []byte {
+	return k.current().Hash(b)
+}
+
+func (k *rotatingKey) StartReader(ctx []byte, r io.Reader) (crypto.StreamReader, error) {
+	return k.current().StartReader(ctx, r)
+}
+
+func (k *rotatingKey) StartWriter(ctx []byte, w io.Writer) (crypto.StreamWriter, error) {
+	return k.current().StartWriter(ctx, w)
+}
+
+func (k *rotatingKey) NewKey() (crypto.EncryptionKey, error) {
+	return k.current().NewKey()
+}
+
+func (k *rotatingKey) DecryptKey(encryptedKey []byte) (crypto.EncryptionKey, error) {
+	cur, prev := k.keys()
+	ek, err := cur.DecryptKey(encryptedKey)
+	if err != nil && prev != nil {
+		return prev.DecryptKey(encryptedKey)
+	}
+	return ek, err
+}
+
+func (k *rotatingKey) ReadEncryptedKey(r io.Reader) (crypto.EncryptionKey, error) {
+	cur, prev := k.keys()
+	if prev == nil {
+		return cur.ReadEncryptedKey(r)
+	}
+	// Both keys use the same algorithm, so the encrypted keys have the
+	// same size.
+	var buf bytes.Buffer
+	ek, err := cur.ReadEncryptedKey(io.TeeReader(r, &buf))
+	if err != nil {
+		return prev.DecryptKey(buf.Bytes())
+	}
+	return ek, nil
+}
+
+func (k *rotatingKey) WriteEncryptedKey(w io.Writer) error {
+	return k.current().WriteEncryptedKey(w)
+}
+
+func (k *rotatingKey) Wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cur.Wipe()
+	if k.prev != nil {
+		k.prev.Wipe()
+		k.prev = nil
+	}
+}
+
+// masterKeyFile is a master key other than the one of the local storage, and
+// the file where it is saved.
+type masterKeyFile struct {
+	mk   crypto.MasterKey
+	file string
+	// upload, if set, is called with the content of the file after it
+	// changes, e.g. to store it in the certificate store.
+	upload func(data []byte) error
+}
+
+// masterKeyOptions returns the options to use with the master keys.
+func masterKeyOptions(cfg *Config, passphrase []byte) ([]crypto.Option, *tpm.TPM, error) {
+	opts := []crypto.Option{
+		crypto.WithLogger(logger{}),
+	}
+	if !cfg.HWBacked {
+		return append(opts, crypto.WithAlgo(crypto.PickFastest)), nil, nil
+	}
+	t, err := tpm.New(tpm.WithObjectAuth(passphrase))
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(opts, crypto.WithTPM(t)), t, nil
+}
+
+// saveMasterKey atomically replaces file with mk encrypted with passphrase.
+func saveMasterKey(mk crypto.MasterKey, passphrase []byte, file string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", file, time.Now().UnixNano())
+	if err := mk.Save(passphrase, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// createMasterKeyLike creates a new master key that uses the same algorithm as
+// the key saved in file.
+func createMasterKeyLike(file string, opts ...crypto.Option) (crypto.MasterKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == 2 {
+		return crypto.CreateChacha20Poly1305MasterKey(opts...)
+	}
+	return crypto.CreateAESMasterKey(opts...)
+}
+
+// RotateMasterKey replaces the master key of the local storage with a new
+// one, and re-encrypts the keys of all the files in the cache directory. The
+// proxy can be running. The passphrase must be the one that protects the
+// current master key. It returns the number of files that were re-encrypted.
+//
+// The master keys of SharedCacheDir and of the CertificateStore are shared
+// with other proxies and are not rotated.
+func (p *Proxy) RotateMasterKey(passphrase []byte) (int, error) {
+	p.masterKeyMu.Lock()
+	defer p.masterKeyMu.Unlock()
+	if p.mk == nil {
+		return 0, errors.New("proxy is stopped")
+	}
+	mkFile := filepath.Join(p.store.Dir(), "masterkey")
+	old, err := crypto.ReadMasterKey(passphrase, mkFile, p.mkOpts...)
+	if err != nil {
+		return 0, fmt.Errorf("masterkey: %w", err)
+	}
+	old.Wipe()
+	mk, err := createMasterKeyLike(mkFile, p.mkOpts...)
+	if err != nil {
+		return 0, err
+	}
+	if err := saveMasterKey(mk, passphrase, mkFile+".next"); err != nil {
+		mk.Wipe()
+		return 0, err
+	}
+	p.mk.rotate(mk)
+	n, err := finishMasterKeyRotation(p.store, p.mk)
+	if err != nil {
+		return n, err
+	}
+	log.Printf("INF Rotated the master key, %d files re-encrypted", n)
+	p.recordEvent("master key rotated")
+	return n, nil
+}
+
+// finishMasterKeyRotation re-encrypts the file keys of all the files in the
+// storage with the current key, and then replaces the master key file with
+// masterkey.next. If the proxy is interrupted before the end, the rotation
+// resumes when it restarts.
+func finishMasterKeyRotation(store *storage.Storage, rk *rotatingKey) (int, error) {
+	cur, prev := rk.keys()
+	dir := store.Dir()
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			// Skip other storages with their own master key, e.g.
+			// the one of the test proxy.
+			if path != dir {
+				if _, err := os.Stat(filepath.Join(path, "masterkey")); err == nil {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), "masterkey") || strings.HasSuffix(d.Name(), ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := store.Lock(rel); err != nil {
+			return err
+		}
+		defer store.Unlock(rel)
+		changed, err := reencryptFileKey(path, cur, prev)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		if changed {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	mkFile := filepath.Join(dir, "masterkey")
+	if err := os.Rename(mkFile+".next", mkFile); err != nil {
+		return count, err
+	}
+	rk.finish()
+	return count, nil
+}
+
+// reencryptFileKey replaces the file key in the header of a storage file,
+// encrypted with prev, with the same file key encrypted with cur. The rest of
+// the file is unchanged.
+func reencryptFileKey(path string, cur, prev crypto.MasterKey) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if len(b) < 5 || string(b[:4]) != "KRIN" || b[4]&storageEncryptedFlag == 0 {
+		return false, nil
+	}
+	if k, err := cur.ReadEncryptedKey(bytes.NewReader(b[5:])); err == nil {
+		k.Wipe()
+		return false, nil
+	}
+	var buf bytes.Buffer
+	k, err := prev.ReadEncryptedKey(io.TeeReader(bytes.NewReader(b[5:]), &buf))
+	if err != nil {
+		return false, err
+	}
+	k.Wipe()
+	fileKey, err := prev.Decrypt(buf.Bytes())
+	if err != nil {
+		return false, err
+	}
+	encKey, err := cur.Encrypt(fileKey)
+	clear(fileKey)
+	if err != nil {
+		return false, err
+	}
+	out := make([]byte, 0, len(b)-buf.Len()+len(encKey))
+	out = append(out, b[:5]...)
+	out = append(out, encKey...)
+	out = append(out, b[5+buf.Len():]...)
+
+	tmp := fmt.Sprintf("%s.tmp-%d", path, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, out, 0o600); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// ChangePassphrase re-encrypts all the master keys of the proxy with a new
+// passphrase, i.e. the key of the local storage, and the keys of
+// SharedCacheDir and CertificateStore if they are used. The other proxies that
+// share the same keys must use the new passphrase when they restart.
+func (p *Proxy) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	if len(newPassphrase) == 0 {
+		return errors.New("new passphrase must not be empty")
+	}
+	p.masterKeyMu.Lock()
+	defer p.masterKeyMu.Unlock()
+	if p.mk == nil {
+		return errors.New("proxy is stopped")
+	}
+	mkFile := filepath.Join(p.store.Dir(), "masterkey")
+	old, err := crypto.ReadMasterKey(oldPassphrase, mkFile, p.mkOpts...)
+	if err != nil {
+		return fmt.Errorf("masterkey: %w", err)
+	}
+	old.Wipe()
+	if err := saveMasterKey(p.mk.current(), newPassphrase, mkFile); err != nil {
+		return err
+	}
+	for _, k := range p.otherKeys {
+		if err := saveMasterKey(k.mk, newPassphrase, k.file); err != nil {
+			return err
+		}
+		if k.upload == nil {
+			continue
+		}
+		b, err := os.ReadFile(k.file)
+		if err != nil {
+			return err
+		}
+		if err := k.upload(b); err != nil {
+			return err
+		}
+	}
+	log.Print("INF Changed the master key passphrase")
+	p.recordEvent("master key passphrase changed")
+	return nil
+}
+
+// ExportMasterKey returns the master key of the local storage, encrypted with
+// the passphrase, e.g. for disaster recovery. It can be restored with
+// ImportMasterKey.
+func (p *Proxy) ExportMasterKey() ([]byte, error) {
+	p.masterKeyMu.Lock()
+	defer p.masterKeyMu.Unlock()
+	if p.mk == nil {
+		return nil, errors.New("proxy is stopped")
+	}
+	return os.ReadFile(filepath.Join(p.store.Dir(), "masterkey"))
+}
+
+// ImportMasterKey restores a master key that was exported with
+// ExportMasterKey into the cache directory. The key must be protected by
+// passphrase. It must be called before New, and the cache directory must not
+// already have a master key.
+func ImportMasterKey(cfg *Config, passphrase, data []byte) error {
+	mkFile := filepath.Join(cfg.CacheDir, "masterkey")
+	if _, err := os.Stat(mkFile); err == nil {
+		return fmt.Errorf("%s already exists", mkFile)
+	}
+	if err := os.MkdirAll(cfg.CacheDir, 0o700); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%d", mkFile, time.Now().UnixNano())
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	opts, t, err := masterKeyOptions(cfg, passphrase)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		defer t.Close()
+	}
+	mk, err := crypto.ReadMasterKey(passphrase, tmp, opts...)
+	if err != nil {
+		return fmt.Errorf("masterkey: %w", err)
+	}
+	mk.Wipe()
+	return os.Rename(tmp, mkFile)
+}
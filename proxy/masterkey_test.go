@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c2FmZQ/storage/crypto"
+)
+
+func TestMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	shared := t.TempDir()
+	newConfig := func(dir string) *Config {
+		cfg := &Config{
+			HTTPAddr:       "localhost:0",
+			TLSAddr:        "localhost:0",
+			CacheDir:       dir,
+			SharedCacheDir: shared,
+			AcceptTOS:      true,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{"192.168.0.1:443"},
+					Mode:        ModeTCP,
+				},
+			},
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("cfg.Check: %v", err)
+		}
+		return cfg
+	}
+	readFoo := func(p *Proxy) {
+		t.Helper()
+		var got string
+		if err := p.store.ReadDataFile("foo", &got); err != nil || got != "bar" {
+			t.Fatalf("ReadDataFile() = %q, %v", got, err)
+		}
+	}
+	mkFile := filepath.Join(dir, "masterkey")
+
+	p, err := New(newConfig(dir), []byte("test"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	v := "bar"
+	if err := p.store.SaveDataFile("foo", &v); err != nil {
+		t.Fatalf("SaveDataFile: %v", err)
+	}
+	before, err := os.ReadFile(mkFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if _, err := p.RotateMasterKey([]byte("wrong")); err == nil {
+		t.Fatal("RotateMasterKey() with wrong passphrase succeeded")
+	}
+	n, err := p.RotateMasterKey([]byte("test"))
+	if err != nil {
+		t.Fatalf("RotateMasterKey: %v", err)
+	}
+	if n < 2 {
+		t.Errorf("RotateMasterKey() = %d, want at least 2", n)
+	}
+	after, err := os.ReadFile(mkFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if bytes.Equal(before, after) {
+		t.Error("masterkey didn't change")
+	}
+	if _, err := os.Stat(mkFile + ".next"); err == nil {
+		t.Error("masterkey.next still exists")
+	}
+	readFoo(p)
+
+	// A new proxy reads the same data with the new key.
+	p, err = New(newConfig(dir), []byte("test"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	readFoo(p)
+
+	if err := p.ChangePassphrase([]byte("wrong"), []byte("new")); err == nil {
+		t.Fatal("ChangePassphrase() with wrong passphrase succeeded")
+	}
+	if err := p.ChangePassphrase([]byte("test"), []byte("new")); err != nil {
+		t.Fatalf("ChangePassphrase: %v", err)
+	}
+	exported, err := p.ExportMasterKey()
+	if err != nil {
+		t.Fatalf("ExportMasterKey: %v", err)
+	}
+
+	if _, err := New(newConfig(dir), []byte("test")); err == nil {
+		t.Fatal("New() with old passphrase succeeded")
+	}
+	p, err = New(newConfig(dir), []byte("new"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	readFoo(p)
+
+	// An interrupted rotation is finished when the proxy starts.
+	mk, err := crypto.CreateAESMasterKey()
+	if err != nil {
+		t.Fatalf("CreateAESMasterKey: %v", err)
+	}
+	if err := mk.Save([]byte("new"), mkFile+".next"); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	mk.Wipe()
+	p, err = New(newConfig(dir), []byte("new"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	readFoo(p)
+	if _, err := os.Stat(mkFile + ".next"); err == nil {
+		t.Error("masterkey.next still exists")
+	}
+
+	// Import the exported key, e.g. after losing the cache directory.
+	if err := ImportMasterKey(newConfig(dir), []byte("new"), exported); err == nil {
+		t.Error("ImportMasterKey() succeeded with existing masterkey")
+	}
+	if err := ImportMasterKey(newConfig(t.TempDir()), []byte("wrong"), exported); err == nil {
+		t.Error("ImportMasterKey() succeeded with wrong passphrase")
+	}
+	restored := t.TempDir()
+	if err := ImportMasterKey(newConfig(restored), []byte("new"), exported); err != nil {
+		t.Fatalf("ImportMasterKey: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(restored, "masterkey"))
+	if err != nil || !bytes.Equal(got, exported) {
+		t.Errorf("imported masterkey = %v, %v", got, err)
+	}
+}
@@ -36,11 +36,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	yaml "gopkg.in/yaml.v3"
 
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/counter"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/histogram"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 )
 
@@ -58,12 +60,83 @@ func init() {
 }
 
 func (p *Proxy) recordEvent(msg string) {
+	p.addEvent(Event{Time: time.Now(), Description: msg})
+}
+
+// recordConnEvent records an event caused by conn.
+func (p *Proxy) recordConnEvent(conn anyConn, msg string) {
+	addTranscriptStep(conn, "event", msg)
+	p.addEvent(Event{Time: time.Now(), Description: msg, ConnID: connID(conn), Conn: formatConnDesc(conn)})
+}
+
+func (p *Proxy) addEvent(e Event) {
+	e.Severity = eventSeverity(e.Description)
 	p.eventsmu.Lock()
 	defer p.eventsmu.Unlock()
 	if p.events == nil {
 		p.events = make(map[string]int64)
 	}
-	p.events[msg]++
+	p.events[e.Description]++
+	if e.Severity != SeverityDebug {
+		p.eventHistory.add(e)
+	}
+	if len(p.eventWatchers) > 0 {
+		for w := range p.eventWatchers {
+			select {
+			case w.ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+func (p *Proxy) observeHandshake(serverName string, d time.Duration, resumed bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if m := p.metrics[serverName]; m != nil {
+		m.handshakeLatency.ObserveDuration(d)
+		if resumed {
+			m.numResumed.Incr(1)
+		}
+	}
+}
+
+// observeDial records how long it took to connect to the backend, as recorded
+// in the connection's annotations. The dial latency is measured from the end
+// of the TLS handshake, or from the start of the connection when the proxy
+// doesn't terminate TLS.
+func (p *Proxy) observeDial(conn anyConn, be *Backend) {
+	ac := annotatedConn(conn)
+	start := ac.Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	if start.IsZero() {
+		start = ac.Annotation(startTimeKey, time.Time{}).(time.Time)
+	}
+	dialTime := ac.Annotation(dialDoneKey, time.Time{}).(time.Time)
+	if start.IsZero() || dialTime.Before(start) {
+		return
+	}
+	serverName := be.metricsServerName(connServerName(conn))
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if m := p.metrics[serverName]; m != nil {
+		m.dialLatency.ObserveDuration(dialTime.Sub(start))
+	}
+}
+
+// countWebSocket counts a WebSocket connection to serverName. The returned
+// function must be called when the WebSocket connection is closed.
+func (p *Proxy) countWebSocket(serverName string) func() {
+	p.mu.RLock()
+	m := p.metrics[serverName]
+	p.mu.RUnlock()
+	if m == nil {
+		return func() {}
+	}
+	m.numWebSockets.Incr(1)
+	m.openWebSockets.Add(1)
+	return func() {
+		m.openWebSockets.Add(-1)
+	}
 }
 
 type counterSetter interface {
@@ -93,6 +166,11 @@ func (p *Proxy) setCounters(c counterSetter, serverName string) {
 			numConnections:   counter.New(time.Minute, time.Second),
 			numBytesSent:     counter.New(time.Minute, time.Second),
 			numBytesReceived: counter.New(time.Minute, time.Second),
+			handshakeLatency: histogram.NewLatency(),
+			dialLatency:      histogram.NewLatency(),
+			numResumed:       counter.New(time.Minute, time.Second),
+			numWebSockets:    counter.New(time.Minute, time.Second),
+			openWebSockets:   new(atomic.Int64),
 		}
 		p.metrics[serverName] = m
 	}
@@ -115,6 +193,8 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		Ingress        string
 		EgressRate     string
 		IngressRate    string
+		Handshake      []string
+		Dial           []string
 	}
 	type proxyEvent struct {
 		Description string
@@ -126,6 +206,7 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		Direction string
 	}
 	type connection struct {
+		ID           uint64
 		SourceAddr   string
 		ViaAddr      string
 		Type         string
@@ -139,6 +220,21 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		IngressBytes string
 		IngressRate  string
 		ClientID     string
+		JA4          string
+		Transcript   []transcriptStep
+	}
+	type certificate struct {
+		ServerName string
+		Source     string
+		NotAfter   string
+		DaysLeft   int
+	}
+	type issuance struct {
+		ServerName  string
+		CA          string
+		Status      string
+		Error       string
+		NextAttempt string
 	}
 	type beConnection struct {
 		SourceAddr      string
@@ -182,6 +278,7 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		HeapAlloc    uint64
 		NextGC       uint64
 		NumGC        uint32
+		BufferPools  []netw.BufferPoolStats
 	}
 	type memoryProf struct {
 		Size  int64
@@ -202,8 +299,11 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		Version            string
 		Metrics            []backendMetric
 		Events             []proxyEvent
+		Certificates       []certificate
+		Issuance           []issuance
 		Connections        []connection
 		BackendConnections []beConnectionList
+		Transcripts        []*handshakeTranscript
 		Backends           []backend
 		Runtime            runtimeData
 		Memory             []memoryProf
@@ -253,6 +353,8 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 			Ingress:        formatSize10(totals[s].numBytesReceived.Value()),
 			EgressRate:     formatSize10(totals[s].numBytesSent.Rate(time.Minute)) + "/s",
 			IngressRate:    formatSize10(totals[s].numBytesReceived.Rate(time.Minute)) + "/s",
+			Handshake:      formatPercentiles(totals[s].handshakeLatency.Snapshot()),
+			Dial:           formatPercentiles(totals[s].dialLatency.Snapshot()),
 		})
 	}
 
@@ -271,6 +373,30 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	p.eventsmu.Unlock()
 
+	for _, ce := range p.certificateExpiry() {
+		data.Certificates = append(data.Certificates, certificate{
+			ServerName: ce.ServerName,
+			Source:     ce.Source,
+			NotAfter:   ce.NotAfter.UTC().Format(time.RFC3339),
+			DaysLeft:   int(ce.DaysLeft),
+		})
+	}
+
+	if m, ok := p.certManager.(*acmeManager); ok {
+		for _, st := range m.queue.status() {
+			is := issuance{
+				ServerName: st.ServerName,
+				CA:         st.CA,
+				Status:     st.Status,
+				Error:      st.Error,
+			}
+			if !st.NextAttempt.IsZero() {
+				is.NextAttempt = st.NextAttempt.UTC().Format(time.RFC3339)
+			}
+			data.Issuance = append(data.Issuance, is)
+		}
+	}
+
 	conns := p.inConns.slice()
 	sort.Slice(conns, func(i, j int) bool {
 		sa := conns[i].Annotation(serverNameKey, "").(string)
@@ -289,7 +415,9 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		remote := c.RemoteAddr().Network() + ":" + c.RemoteAddr().String()
 
 		connection := connection{
+			ID:         connID(c),
 			SourceAddr: remote,
+			JA4:        connJA4(c),
 			ServerName: idnaToUnicode(connServerName(c)),
 			Mode:       connMode(c),
 			Proto:      connProto(c),
@@ -354,6 +482,9 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		if cert := connClientCert(c); cert != nil {
 			connection.ClientID = certSummary(cert)
 		}
+		if t := connTranscript(c); t != nil {
+			connection.Transcript = t.clone().Steps
+		}
 		connection.Time = totalTime.Truncate(100 * time.Millisecond).String()
 		connection.EgressBytes = formatSize10(c.BytesSent())
 		connection.EgressRate = formatSize10(c.ByteRateSent()) + "/s"
@@ -395,6 +526,11 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		})
 	}
 
+	transcripts := p.transcripts.all()
+	for i := len(transcripts) - 1; i >= 0; i-- {
+		data.Transcripts = append(data.Transcripts, transcripts[i].clone())
+	}
+
 	for _, be := range p.cfg.Backends {
 		backend := backend{
 			Mode: be.Mode,
@@ -404,6 +540,9 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		}
 		if be.ClientAuth != nil {
 			backend.ClientAuth = " TLS ClientAuth"
+			if be.ClientAuth.Mode == ClientAuthRequest {
+				backend.ClientAuth += " (optional)"
+			}
 		}
 		if be.ALPNProtos != nil {
 			protos := " ALPN[" + strings.Join(*be.ALPNProtos, ",") + "]"
@@ -416,7 +555,7 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		for _, sn := range be.ServerNames {
 			backend.ServerNames = append(backend.ServerNames, idnaToUnicode(sn))
 		}
-		backend.Addresses = slices.Clone(be.Addresses)
+		backend.Addresses = slices.Clone(be.addresses())
 		for _, h := range be.localHandlers {
 			host := "<any>"
 			if h.host != "" {
@@ -442,6 +581,7 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	data.Runtime.HeapAlloc = memStats.HeapAlloc
 	data.Runtime.NextGC = memStats.NextGC
 	data.Runtime.NumGC = memStats.NumGC
+	data.Runtime.BufferPools = netw.AllBufferPoolStats()
 
 	getFunc := func(stack [32]uintptr, n int) string {
 		var out []string
@@ -564,18 +704,7 @@ func (p *Proxy) metricsHandler(w http.ResponseWriter, req *http.Request) {
 		log.Printf("ERR GoroutineProfile n=%d", n)
 	}
 
-	cfg := p.cfg.clone()
-	for _, p := range cfg.OIDCProviders {
-		p.ClientSecret = "**REDACTED**"
-	}
-	for _, be := range cfg.Backends {
-		if be.SSO == nil || be.SSO.LocalOIDCServer == nil {
-			continue
-		}
-		for _, client := range be.SSO.LocalOIDCServer.Clients {
-			client.Secret = "**REDACTED**"
-		}
-	}
+	cfg := p.cfg.redacted()
 	var cfgbuf bytes.Buffer
 	enc := yaml.NewEncoder(&cfgbuf)
 	enc.SetIndent(2)
@@ -594,3 +723,17 @@ func (p *Proxy) faviconHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Cache-Control", "public, max-age=86400, immutable")
 	w.Write(iconBytes)
 }
+
+// formatPercentiles returns the p50, p95, and p99 latencies of s, rounded to
+// the millisecond, or "-" when nothing was observed.
+func formatPercentiles(s histogram.Snapshot) []string {
+	out := make([]string, 0, 3)
+	for _, p := range []float64{50, 95, 99} {
+		if s.Count == 0 {
+			out = append(out, "-")
+			continue
+		}
+		out = append(out, secondsToDuration(s.Percentile(p)).Round(time.Millisecond).String())
+	}
+	return out
+}
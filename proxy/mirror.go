@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// mirror sends copies of the requests to a backend's shadow backend.
+type mirror struct {
+	cfg       *Mirror
+	director  func(*http.Request)
+	transport *http.Transport
+	sem       chan struct{}
+
+	sent    atomic.Int64
+	errors  atomic.Int64
+	dropped atomic.Int64
+}
+
+func (be *Backend) newMirror() *mirror {
+	m := be.Mirror
+	if m == nil {
+		return nil
+	}
+	return &mirror{
+		cfg:      m,
+		director: be.reverseProxyDirector,
+		transport: &http.Transport{
+			DialContext: be.netDialer("tcp", 5*time.Second).DialContext,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: m.InsecureSkipVerify,
+			},
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		sem: make(chan struct{}, m.MaxConcurrentRequests),
+	}
+}
+
+// send sends a copy of req to the shadow backend, in the background. The
+// request body, if any, is read into memory and replaced with a new reader
+// with the same content.
+func (m *mirror) send(req *http.Request, host string) {
+	if m == nil || (*m.cfg.Percent < 100 && rand.Float64()*100 >= *m.cfg.Percent) {
+		return
+	}
+	// Connection upgrades, e.g. websocket, and gRPC streams can't be
+	// replayed.
+	if req.Header.Get("Upgrade") != "" || isGRPCRequest(req) {
+		return
+	}
+	if req.ContentLength > m.cfg.MaxBodySize {
+		m.dropped.Add(1)
+		return
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		m.dropped.Add(1)
+		return
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(io.LimitReader(req.Body, m.cfg.MaxBodySize+1))
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		if err != nil || int64(len(b)) > m.cfg.MaxBodySize {
+			<-m.sem
+			m.dropped.Add(1)
+			return
+		}
+		body = b
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	mreq := req.Clone(ctx)
+	mreq.RequestURI = ""
+	mreq.Host = host
+	mreq.URL.Host = m.cfg.Addresses[rand.IntN(len(m.cfg.Addresses))]
+	mreq.URL.Scheme = "http"
+	if m.cfg.Mode == ModeHTTPS {
+		mreq.URL.Scheme = "https"
+	}
+	mreq.ContentLength = int64(len(body))
+	mreq.Body = http.NoBody
+	if len(body) > 0 {
+		mreq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	removeHopHeaders(mreq.Header)
+	mreq.Close = false
+	mreq.TransferEncoding = nil
+	m.director(mreq)
+	appendClientIP(mreq.Header, req.RemoteAddr)
+
+	go func() {
+		defer func() { <-m.sem }()
+		defer cancel()
+		resp, err := m.transport.RoundTrip(mreq)
+		if err != nil {
+			m.errors.Add(1)
+			log.Printf("ERR %s ➔ %s %s ➔ mirror %s: %v", formatReqDesc(req), req.Method, host, mreq.URL.Host, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		m.sent.Add(1)
+	}()
+}
@@ -0,0 +1,159 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestMirror(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		w.Write([]byte("primary"))
+	}))
+	defer be.Close()
+
+	type mirrored struct {
+		method, host, path, body, xff string
+	}
+	ch := make(chan mirrored, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		ch <- mirrored{req.Method, req.Host, req.URL.Path, string(b), req.Header.Get(xForwardedForHeader)}
+		w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	zero := 0.0
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+				Mode:        "HTTP",
+				Mirror: &Mirror{
+					Addresses:   []string{strings.TrimPrefix(shadow.URL, "http://")},
+					MaxBodySize: 10,
+				},
+			},
+			{
+				ServerNames: []string{"other.example.com"},
+				Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+				Mode:        "HTTP",
+				Mirror: &Mirror{
+					Addresses: []string{strings.TrimPrefix(shadow.URL, "http://")},
+					Percent:   &zero,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, _, _ := net.SplitHostPort(addr)
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: host,
+					RootCAs:    extCA.RootCACertPool(),
+				})
+			},
+		},
+	}
+	post := func(host, path, body string) {
+		t.Helper()
+		resp, err := client.Post("https://"+host+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Post: %v", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if got, want := string(b), "primary"; got != want {
+			t.Errorf("POST %s%s: body = %q, want %q", host, path, got, want)
+		}
+	}
+	expect := func(want *mirrored) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			if want == nil {
+				t.Fatalf("Unexpected mirrored request: %+v", got)
+			}
+			if got != *want {
+				t.Errorf("Mirrored request = %+v, want %+v", got, *want)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if want != nil {
+				t.Fatal("Mirrored request not received")
+			}
+		}
+	}
+
+	post("www.example.com", "/foo", "hello")
+	expect(&mirrored{"POST", "www.example.com", "/foo", "hello", "127.0.0.1"})
+
+	// The body is too large to be mirrored, but it is still forwarded
+	// to the primary backend.
+	post("www.example.com", "/bar", "hello world!")
+	expect(nil)
+
+	post("other.example.com", "/foo", "hello")
+	expect(nil)
+
+	m := proxy.cfg.Backends[0].mirror
+	if got, want := m.sent.Load(), int64(1); got != want {
+		t.Errorf("sent = %d, want %d", got, want)
+	}
+	if got, want := m.dropped.Load(), int64(1); got != want {
+		t.Errorf("dropped = %d, want %d", got, want)
+	}
+}
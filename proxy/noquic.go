@@ -50,6 +50,14 @@ func (be *Backend) http3Transport() http.RoundTripper {
 	return nil
 }
 
-func http3Server(http.Handler) io.Closer {
+func http3Server(http.Handler, *HTTPLimits) io.Closer {
 	return nil
 }
+
+func http3DatagramServer(http.Handler, *HTTPLimits) io.Closer {
+	return nil
+}
+
+func (be *Backend) serveConnectUDP(w http.ResponseWriter, _ *http.Request, _ string) {
+	http.Error(w, "Not Implemented", http.StatusNotImplemented)
+}
@@ -21,9 +21,17 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 // SOFTWARE.
 
-//go:build !pprof
+//go:build !linux
 
 package proxy
 
-func addPProfHandlers(*[]localHandler) {
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenReusePort(string) (net.Listener, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
 }
@@ -0,0 +1,295 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/histogram"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// prometheusHandler exports the proxy's metrics in the Prometheus text-based
+// exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (p *Proxy) prometheusHandler(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	defer buf.WriteTo(w)
+
+	type metric struct {
+		labels string
+		value  float64
+	}
+	writeMetrics := func(name, typ, help string, values []metric) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, typ)
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s%s %s\n", name, v.labels, formatPromValue(v.value))
+		}
+	}
+	writeHistograms := func(name, help string, labelName string, values map[string]histogram.Snapshot) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(&buf, "# TYPE %s histogram\n", name)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := values[k]
+			lv := labelName + "=" + promLabelValue(k)
+			for _, b := range s.Buckets {
+				fmt.Fprintf(&buf, "%s_bucket{%s,le=%q} %d\n", name, lv, formatPromValue(b.UpperBound), b.Count)
+			}
+			fmt.Fprintf(&buf, "%s_sum{%s} %s\n", name, lv, formatPromValue(s.Sum))
+			fmt.Fprintf(&buf, "%s_count{%s} %d\n", name, lv, s.Count)
+		}
+	}
+
+	p.mu.RLock()
+	serverNames := make([]string, 0, len(p.metrics))
+	for k := range p.metrics {
+		serverNames = append(serverNames, k)
+	}
+	sort.Strings(serverNames)
+	var conns, sent, received, resumed, webSockets, openWebSockets []metric
+	handshakes := make(map[string]histogram.Snapshot)
+	dials := make(map[string]histogram.Snapshot)
+	for _, sn := range serverNames {
+		m := p.metrics[sn]
+		sn = idnaToUnicode(sn)
+		labels := "{server_name=" + promLabelValue(sn) + "}"
+		conns = append(conns, metric{labels, float64(m.numConnections.Value())})
+		sent = append(sent, metric{labels, float64(m.numBytesSent.Value())})
+		received = append(received, metric{labels, float64(m.numBytesReceived.Value())})
+		resumed = append(resumed, metric{labels, float64(m.numResumed.Value())})
+		webSockets = append(webSockets, metric{labels, float64(m.numWebSockets.Value())})
+		openWebSockets = append(openWebSockets, metric{labels, float64(m.openWebSockets.Load())})
+		handshakes[sn] = m.handshakeLatency.Snapshot()
+		dials[sn] = m.dialLatency.Snapshot()
+	}
+	startTime := p.startTime
+	var quotas []metric
+	addQuota := func(q *connQuota) {
+		if q == nil {
+			return
+		}
+		active, queued := q.stats()
+		quotas = append(quotas,
+			metric{"{quota=" + promLabelValue(q.name) + `,state="active"}`, float64(active)},
+			metric{"{quota=" + promLabelValue(q.name) + `,state="queued"}`, float64(queued)},
+		)
+	}
+	addQuota(p.quota)
+	var queues, unhealthy, cacheRequests, cacheSize, mirrored []metric
+	var splitRequests, splitErrors, splitWeights, dialFamilies, earlyData []metric
+	for _, be := range p.cfg.Backends {
+		addQuota(be.quota)
+		if v4, v6 := be.state.dialsIPv4.Load(), be.state.dialsIPv6.Load(); v4 > 0 || v6 > 0 {
+			name := promLabelValue(be.displayName())
+			dialFamilies = append(dialFamilies,
+				metric{"{backend=" + name + `,family="ipv4"}`, float64(v4)},
+				metric{"{backend=" + name + `,family="ipv6"}`, float64(v6)},
+			)
+		}
+		if a, r := be.state.earlyDataAccepted.Load(), be.state.earlyDataRejected.Load(); a > 0 || r > 0 {
+			name := promLabelValue(be.displayName())
+			earlyData = append(earlyData,
+				metric{"{backend=" + name + `,result="accepted"}`, float64(a)},
+				metric{"{backend=" + name + `,result="rejected"}`, float64(r)},
+			)
+		}
+		if be.respCache != nil {
+			st := be.respCache.Stats()
+			name := promLabelValue(be.displayName())
+			cacheRequests = append(cacheRequests,
+				metric{"{backend=" + name + `,result="hit"}`, float64(st.Hits)},
+				metric{"{backend=" + name + `,result="miss"}`, float64(st.Misses)},
+			)
+			cacheSize = append(cacheSize,
+				metric{"{backend=" + name + `,tier="memory"}`, float64(st.Size)},
+				metric{"{backend=" + name + `,tier="disk"}`, float64(st.DiskSize)},
+			)
+		}
+		if m := be.mirror; m != nil {
+			name := promLabelValue(be.displayName())
+			mirrored = append(mirrored,
+				metric{"{backend=" + name + `,result="sent"}`, float64(m.sent.Load())},
+				metric{"{backend=" + name + `,result="error"}`, float64(m.errors.Load())},
+				metric{"{backend=" + name + `,result="dropped"}`, float64(m.dropped.Load())},
+			)
+		}
+		if be.split != nil {
+			st := be.split.status(be.displayName())
+			for _, g := range st.Groups {
+				labels := "{backend=" + promLabelValue(st.Backend) + ",group=" + promLabelValue(g.Name) + "}"
+				splitRequests = append(splitRequests, metric{labels, float64(g.Requests)})
+				splitErrors = append(splitErrors, metric{labels, float64(g.Errors)})
+				splitWeights = append(splitWeights, metric{labels, float64(g.Weight)})
+			}
+		}
+		if be.Backpressure != nil {
+			queues = append(queues, metric{"{backend=" + promLabelValue(be.displayName()) + "}", float64(be.queueLen())})
+		}
+		if be.CircuitBreaker != nil {
+			unhealthy = append(unhealthy, metric{"{backend=" + promLabelValue(be.displayName()) + "}", float64(len(be.unhealthyAddresses()))})
+		}
+	}
+	var feedDrops, feedSizes []metric
+	for _, l := range p.threatFeeds {
+		labels := "{feed=" + promLabelValue(l.cfg.Name) + "}"
+		feedDrops = append(feedDrops, metric{labels, float64(l.drops.Load())})
+		feedSizes = append(feedSizes, metric{labels, float64(l.size())})
+	}
+	var shardAccepted, shardErrors, shardBusy []metric
+	for _, sh := range p.shards {
+		labels := `{shard="` + strconv.Itoa(sh.index) + `"}`
+		shardAccepted = append(shardAccepted, metric{labels, float64(sh.accepted.Load())})
+		shardErrors = append(shardErrors, metric{labels, float64(sh.acceptErrors.Load())})
+		if sh.workers != nil {
+			shardBusy = append(shardBusy, metric{labels, float64(sh.handshakes.Load())})
+		}
+	}
+	p.mu.RUnlock()
+
+	writeMetrics("tlsproxy_connections_total", "counter", "Number of incoming connections per server name.", conns)
+	writeMetrics("tlsproxy_bytes_sent_total", "counter", "Number of bytes sent to clients per server name.", sent)
+	writeMetrics("tlsproxy_bytes_received_total", "counter", "Number of bytes received from clients per server name.", received)
+	writeMetrics("tlsproxy_tls_resumptions_total", "counter", "Number of TLS handshakes that resumed a previous session per server name.", resumed)
+	writeMetrics("tlsproxy_websocket_connections_total", "counter", "Number of WebSocket connections per server name.", webSockets)
+	writeMetrics("tlsproxy_open_websocket_connections", "gauge", "Number of open WebSocket connections per server name.", openWebSockets)
+	writeHistograms("tlsproxy_handshake_duration_seconds", "Time from the start of the connection to the end of the TLS handshake.", "server_name", handshakes)
+	writeHistograms("tlsproxy_dial_duration_seconds", "Time it took to connect to the backend.", "server_name", dials)
+
+	writeMetrics("tlsproxy_open_connections", "gauge", "Number of open connections.", []metric{
+		{`{direction="incoming"}`, float64(len(p.inConns.slice()))},
+		{`{direction="outgoing"}`, float64(len(p.outConns.slice()))},
+	})
+	writeMetrics("tlsproxy_listener_accepted_connections_total", "counter", "Number of TLS connections accepted by each listener shard.", shardAccepted)
+	writeMetrics("tlsproxy_listener_accept_errors_total", "counter", "Number of errors from the accept loop of each listener shard.", shardErrors)
+	writeMetrics("tlsproxy_listener_busy_handshake_workers", "gauge", "Number of handshake workers of each listener shard that are in use.", shardBusy)
+	writeMetrics("tlsproxy_tarpit_connections", "gauge", "Number of connections from banned IP addresses that are being tarpitted.", []metric{
+		{"", float64(p.tarpitted.Load())},
+	})
+	writeMetrics("tlsproxy_backend_queue_length", "gauge", "Number of connections and requests waiting for the forward rate limit of each backend with backpressure.", queues)
+	writeMetrics("tlsproxy_backend_unhealthy_addresses", "gauge", "Number of addresses of each backend with a circuit breaker that are skipped because they failed recently.", unhealthy)
+	writeMetrics("tlsproxy_threat_feed_drops_total", "counter", "Number of connections dropped because the client's IP address is in each threat feed.", feedDrops)
+	writeMetrics("tlsproxy_threat_feed_entries", "gauge", "Number of entries in each threat feed.", feedSizes)
+	writeMetrics("tlsproxy_response_cache_requests_total", "counter", "Number of requests that were served from the response cache of each backend, or that were forwarded to the backend.", cacheRequests)
+	writeMetrics("tlsproxy_response_cache_size_bytes", "gauge", "Size of the responses stored in the response cache of each backend.", cacheSize)
+	writeMetrics("tlsproxy_mirror_requests_total", "counter", "Number of requests that were mirrored to the shadow backend of each backend, that failed, or that were dropped because of the mirror's limits.", mirrored)
+	writeMetrics("tlsproxy_address_group_requests_total", "counter", "Number of HTTP requests, or connections in the other modes, sent to each address group of each backend.", splitRequests)
+	writeMetrics("tlsproxy_address_group_errors_total", "counter", "Number of HTTP requests that failed or got a 5xx response, or connections that couldn't be established in the other modes, for each address group of each backend.", splitErrors)
+	writeMetrics("tlsproxy_address_group_weight", "gauge", "Current weight of each address group of each backend.", splitWeights)
+	writeMetrics("tlsproxy_backend_dials_total", "counter", "Number of connections to the backend servers of each backend, by address family.", dialFamilies)
+	writeMetrics("tlsproxy_early_data_requests_total", "counter", "Number of HTTP requests received in TLS early data by each backend that were accepted, or rejected with 425 (Too Early).", earlyData)
+	writeMetrics("tlsproxy_quota_connections", "gauge", "Number of connections counted by each connection quota, and number of connections waiting in its queue.", quotas)
+	if hp := p.handshakePool.Load(); hp != nil {
+		active, queued := hp.stats()
+		writeMetrics("tlsproxy_handshake_admission_total", "counter", "Number of connections that got a handshake worker right away, after waiting in the queue, or that were dropped because the queue was full or because they waited too long.", []metric{
+			{`{result="admitted"}`, float64(hp.admitted.Load())},
+			{`{result="queued"}`, float64(hp.queued.Load())},
+			{`{result="rejected"}`, float64(hp.rejected.Load())},
+			{`{result="timeout"}`, float64(hp.timedOut.Load())},
+		})
+		writeMetrics("tlsproxy_handshake_admission_connections", "gauge", "Number of TLS handshakes in progress, and number of connections waiting for a handshake worker.", []metric{
+			{`{state="active"}`, float64(active)},
+			{`{state="queued"}`, float64(queued)},
+		})
+	}
+	if e := p.flowExporter.Load(); e != nil {
+		st := e.Stats()
+		writeMetrics("tlsproxy_flow_records_total", "counter", "Number of flow records that were exported, dropped because the queue was full, or that couldn't be sent to the collector.", []metric{
+			{`{result="exported"}`, float64(st.Exported)},
+			{`{result="dropped"}`, float64(st.Dropped)},
+			{`{result="failed"}`, float64(st.Failed)},
+		})
+	}
+
+	p.eventsmu.Lock()
+	events := make([]string, 0, len(p.events))
+	for k := range p.events {
+		events = append(events, k)
+	}
+	sort.Strings(events)
+	eventMetrics := make([]metric, 0, len(events))
+	for _, e := range events {
+		eventMetrics = append(eventMetrics, metric{"{event=" + promLabelValue(e) + "}", float64(p.events[e])})
+	}
+	p.eventsmu.Unlock()
+	writeMetrics("tlsproxy_events_total", "counter", "Number of events recorded by the proxy, e.g. ACME certificates issued, access denied.", eventMetrics)
+
+	var certExpiry []metric
+	for _, ce := range p.certificateExpiry() {
+		labels := "{server_name=" + promLabelValue(ce.ServerName) + ",source=" + promLabelValue(ce.Source) + "}"
+		certExpiry = append(certExpiry, metric{labels, ce.DaysLeft})
+	}
+	writeMetrics("tlsproxy_certificate_expiry_days", "gauge", "Number of days before the certificate of each server name expires.", certExpiry)
+
+	var bufGets, bufAllocs []metric
+	for _, s := range netw.AllBufferPoolStats() {
+		labels := "{size=" + promLabelValue(strconv.Itoa(s.Size)) + "}"
+		bufGets = append(bufGets, metric{labels, float64(s.Gets)})
+		bufAllocs = append(bufAllocs, metric{labels, float64(s.Allocs)})
+	}
+	writeMetrics("tlsproxy_copy_buffer_gets_total", "counter", "Number of copy buffers taken from the pool, per buffer size.", bufGets)
+	writeMetrics("tlsproxy_copy_buffer_allocs_total", "counter", "Number of copy buffers allocated because the pool was empty, per buffer size.", bufAllocs)
+
+	writeMetrics("tlsproxy_uptime_seconds", "gauge", "Time since the proxy started.", []metric{
+		{"", time.Since(startTime).Truncate(time.Second).Seconds()},
+	})
+	writeMetrics("tlsproxy_goroutines", "gauge", "Number of goroutines.", []metric{
+		{"", float64(runtime.NumGoroutine())},
+	})
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("content-length", strconv.Itoa(buf.Len()))
+}
+
+func promLabelValue(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,108 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{be1.listener.Addr().String()},
+				},
+				{
+					ServerNames: []string{"metrics.example.com"},
+					Mode:        "CONSOLE",
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	if _, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	proxy.recordEvent(`weird "event"`)
+
+	got, _, err := httpGet("metrics.example.com", proxy.listener.Addr().String(), "/metrics", extCA, nil)
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE tlsproxy_connections_total counter\n",
+		`tlsproxy_connections_total{server_name="example.com"} 1` + "\n",
+		`tlsproxy_bytes_sent_total{server_name="example.com"} `,
+		`tlsproxy_handshake_duration_seconds_bucket{server_name="example.com",le="+Inf"} 1` + "\n",
+		`tlsproxy_handshake_duration_seconds_count{server_name="example.com"} 1` + "\n",
+		`tlsproxy_dial_duration_seconds_count{server_name="example.com"} 1` + "\n",
+		`tlsproxy_events_total{event="tcp connection"} `,
+		`tlsproxy_events_total{event="weird \"event\""} 1` + "\n",
+		`tlsproxy_copy_buffer_gets_total{size="32768"} `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Metrics missing %q. Got:\n%s", want, got)
+		}
+	}
+}
+
+func TestIsACMECertKey(t *testing.T) {
+	for _, tc := range []struct {
+		key  string
+		want bool
+	}{
+		{"example.com", true},
+		{"example.com+rsa", true},
+		{"example.com+token", false},
+		{"abcdef+http-01", false},
+		{"acme_account+key", false},
+	} {
+		if got := isACMECertKey(tc.key); got != tc.want {
+			t.Errorf("isACMECertKey(%q) = %v, want %v", tc.key, got, tc.want)
+		}
+	}
+}
@@ -31,6 +31,7 @@ package proxy
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -44,10 +45,13 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/c2FmZQ/storage"
@@ -61,31 +65,55 @@ import (
 	"golang.org/x/time/rate"
 
 	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/accesslog"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/activation"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/auditlog"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/cookiemanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/counter"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/crlcache"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/dns01"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/flowexport"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/histogram"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/jwks"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/oidc"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/passkeys"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/resolver"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/saml"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/sessionticket"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/sshca"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tracing"
 )
 
 const (
-	startTimeKey     = "s"
-	handshakeDoneKey = "h"
-	dialDoneKey      = "d"
-	serverNameKey    = "sn"
-	protoKey         = "p"
-	clientCertKey    = "c"
-	internalConnKey  = "ic"
-	reportEndKey     = "re"
-	backendKey       = "be"
-	modeKey          = "m"
-	requestFlagKey   = "rf"
-	proxyProtoKey    = "pp"
-	httpUpgradeKey   = "hu"
+	startTimeKey       = "s"
+	handshakeDoneKey   = "h"
+	dialDoneKey        = "d"
+	serverNameKey      = "sn"
+	protoKey           = "p"
+	clientCertKey      = "c"
+	internalConnKey    = "ic"
+	reportEndKey       = "re"
+	backendKey         = "be"
+	modeKey            = "m"
+	requestFlagKey     = "rf"
+	proxyProtoKey      = "pp"
+	httpUpgradeKey     = "hu"
+	tlsConnKey         = "tc"
+	traceSpanKey       = "ts"
+	connIDKey          = "id"
+	ja3Key             = "j3"
+	ja4Key             = "j4"
+	quotaReleaseKey    = "qr"
+	dialAttemptsKey    = "da"
+	dialFamilyKey      = "df"
+	mySQLKey           = "my"
+	pgSSLRequestKey    = "pg"
+	handshakeWorkerKey = "hw"
+	transcriptKey      = "ht"
 
 	tlsBadCertificate      = tls.AlertError(0x2a)
 	tlsCertificateRevoked  = tls.AlertError(0x2c)
@@ -106,15 +134,26 @@ type Proxy struct {
 		TLSConfig() *tls.Config
 		GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
 	}
-	cfg           *Config
-	ctx           context.Context
-	cancel        func()
-	listener      net.Listener
-	quicTransport io.Closer
-	tpm           *tpm.TPM
-	mk            crypto.MasterKey
-	store         *storage.Storage
-	tokenManager  *tokenmanager.TokenManager
+	cfg             *Config
+	ctx             context.Context
+	cancel          func()
+	listener        net.Listener
+	shards          []*listenerShard
+	mySQLListener   net.Listener
+	quicTransport   io.Closer
+	quicPassthrough *quicPassthrough
+	tpm             *tpm.TPM
+	masterKeyMu     sync.Mutex
+	mk              *rotatingKey
+	mkOpts          []crypto.Option
+	otherKeys       []masterKeyFile
+	store           *storage.Storage
+	sharedStore     *storage.Storage // nil without SharedCacheDir
+	tokenManager    *tokenmanager.TokenManager
+	ticketKeys      *sessionticket.Manager
+	dns01           *dns01.Manager
+	accessLog       *accesslog.Logger
+	tracer          *tracing.Tracer
 
 	mu            sync.RWMutex
 	connClosed    *sync.Cond
@@ -122,15 +161,52 @@ type Proxy struct {
 	backends      map[beKey]*Backend
 	pkis          map[string]*pki.PKIManager
 	ocspCache     *ocspcache.OCSPCache
+	crlCache      *crlcache.CRLCache
+	jwksCache     *jwks.Cache
+	limits        *connLimits
+	quota         *connQuota
+	ipLists       map[string]*ipList
+	threatFeeds   []*ipList
+	respCaches    map[string]*responseCache
+	trafficSplits map[string]*trafficSplit
+	sockets       []namedSocket
+	addrResolvers map[addrResolverKey]*addressResolver
+	dnsResolvers  map[string]*resolver.Resolver
+	drained       map[string]bool
+	routeFunc     RouteFunc
+	dialFuncs     map[string]DialFunc
+	tlsListener   net.Listener
 	bwLimits      map[string]*bwLimit
 	inConns       *connTracker
 	outConns      *connTracker
+	tarpitted     atomic.Int64
+
+	accessLogWriter io.Writer
+	accessLogCloser io.Closer
+	auditLog        *auditlog.Logger
+	auditLogCloser  io.Closer
+	flowExporter    atomic.Pointer[flowexport.Exporter]
+	flowExportCfg   *ConfigFlowExport
+	handshakePool   atomic.Pointer[handshakePool]
+	keyLog          *keyLogWriter
+	transcripts     transcriptLog
 
 	metrics   map[string]*backendMetrics
 	startTime time.Time
 
-	eventsmu sync.Mutex
-	events   map[string]int64
+	eventsmu      sync.Mutex
+	events        map[string]int64
+	eventWatchers map[*eventWatcher]bool
+	eventHistory  eventLog
+
+	discovery   discoveryState
+	certMonitor certMonitorState
+	prewarmCh   chan struct{}
+
+	// configFile and configEditMu are used by the admin API to change
+	// the config.
+	configFile   string
+	configEditMu sync.Mutex
 }
 
 type beKey struct {
@@ -147,6 +223,11 @@ type backendMetrics struct {
 	numConnections   *counter.Counter
 	numBytesSent     *counter.Counter
 	numBytesReceived *counter.Counter
+	handshakeLatency *histogram.Histogram
+	dialLatency      *histogram.Histogram
+	numResumed       *counter.Counter
+	numWebSockets    *counter.Counter
+	openWebSockets   *atomic.Int64
 }
 
 type eventRecorder struct {
@@ -164,61 +245,118 @@ type identityProvider interface {
 
 // New returns a new initialized Proxy.
 func New(cfg *Config, passphrase []byte) (*Proxy, error) {
-	opts := []crypto.Option{
-		crypto.WithLogger(logger{}),
+	opts, pTPM, err := masterKeyOptions(cfg, passphrase)
+	if err != nil {
+		return nil, err
 	}
-	var pTPM *tpm.TPM
-	if cfg.HWBacked {
-		t, err := tpm.New(tpm.WithObjectAuth(passphrase))
+	mkFile := filepath.Join(cfg.CacheDir, "masterkey")
+	mk, err := readOrCreateMasterKey(passphrase, mkFile, opts...)
+	if err != nil {
+		return nil, err
+	}
+	rk := newRotatingKey(mk)
+	var next crypto.MasterKey
+	if next, err = crypto.ReadMasterKey(passphrase, mkFile+".next", opts...); err == nil {
+		rk.rotate(next)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s.next: %w", mkFile, err)
+	}
+	store := storage.New(cfg.CacheDir, rk)
+	if next != nil {
+		n, err := finishMasterKeyRotation(store, rk)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("master key rotation: %w", err)
 		}
-		opts = append(opts, crypto.WithTPM(t))
-		pTPM = t
-	} else {
-		opts = append(opts, crypto.WithAlgo(crypto.PickFastest))
+		log.Printf("INF Finished the master key rotation, %d files re-encrypted", n)
 	}
-	mkFile := filepath.Join(cfg.CacheDir, "masterkey")
-	mk, err := crypto.ReadMasterKey(passphrase, mkFile, opts...)
-	if errors.Is(err, os.ErrNotExist) {
-		if mk, err = crypto.CreateMasterKey(opts...); err != nil {
-			return nil, errors.New("failed to create master key")
+	var otherKeys []masterKeyFile
+	if !cfg.AcceptTOS {
+		return nil, errors.New("AcceptTOS must be set to true")
+	}
+	// The data that can be shared with other proxies is in stateStore.
+	var sharedStore *storage.Storage
+	stateStore := store
+	if cfg.SharedCacheDir != "" {
+		if cfg.HWBacked {
+			return nil, errors.New("SharedCacheDir cannot be used with HWBacked")
 		}
-		err = mk.Save(passphrase, mkFile)
+		smkFile := filepath.Join(cfg.SharedCacheDir, "masterkey")
+		smk, err := readOrCreateMasterKey(passphrase, smkFile, opts...)
+		if err != nil {
+			return nil, err
+		}
+		otherKeys = append(otherKeys, masterKeyFile{mk: smk, file: smkFile})
+		sharedStore = storage.New(cfg.SharedCacheDir, smk)
+		sharedStore.CreateEmptyFile(banListFile, map[string]time.Time{})
+		stateStore = sharedStore
 	}
+	tm, err := tokenmanager.New(stateStore, pTPM)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", mkFile, err)
-	}
-	store := storage.New(cfg.CacheDir, mk)
-	if !cfg.AcceptTOS {
-		return nil, errors.New("AcceptTOS must be set to true")
+		return nil, err
 	}
-	tm, err := tokenmanager.New(store, pTPM)
+	tk, err := sessionticket.New(stateStore)
 	if err != nil {
 		return nil, err
 	}
+	localCache := autocertcache.New("autocert", stateStore)
+	cache := &acmeCache{Cache: localCache}
+	if cfg.CertificateStore != nil {
+		if cfg.HWBacked {
+			return nil, errors.New("CertificateStore cannot be used with HWBacked")
+		}
+		cs, csKey, err := openCertificateStore(cfg, passphrase, localCache, opts...)
+		if err != nil {
+			return nil, err
+		}
+		cache.Cache = cs
+		otherKeys = append(otherKeys, csKey)
+	}
+	am := newACMEManager(cache, cfg.Email)
 	p := &Proxy{
-		certManager: &autocert.Manager{
-			Prompt: autocert.AcceptTOS,
-			Cache:  autocertcache.New("autocert", store),
-			Email:  cfg.Email,
-		},
+		certManager:  am,
+		prewarmCh:    make(chan struct{}, 1),
 		tpm:          pTPM,
-		mk:           mk,
+		mk:           rk,
+		mkOpts:       opts,
+		otherKeys:    otherKeys,
 		store:        store,
+		sharedStore:  sharedStore,
 		tokenManager: tm,
+		ticketKeys:   tk,
+		dns01:        dns01.New(cache, autocert.DefaultACMEDirectory, cfg.Email),
 		pkis:         make(map[string]*pki.PKIManager),
 		ocspCache:    ocspcache.New(store),
+		crlCache:     crlcache.New(),
+		jwksCache:    jwks.New(),
 		bwLimits:     make(map[string]*bwLimit),
 		inConns:      newConnTracker(),
 		outConns:     newConnTracker(),
 	}
+	cache.recordEvent = p.recordEvent
+	am.queue.recordEvent = p.recordEvent
+	am.queue.onDemand = p.acmeOnDemand
 	if err := p.Reconfigure(cfg); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// readOrCreateMasterKey reads the master key from mkFile, or creates a new one
+// if the file doesn't exist.
+func readOrCreateMasterKey(passphrase []byte, mkFile string, opts ...crypto.Option) (crypto.MasterKey, error) {
+	mk, err := crypto.ReadMasterKey(passphrase, mkFile, opts...)
+	if errors.Is(err, os.ErrNotExist) {
+		if mk, err = crypto.CreateMasterKey(opts...); err != nil {
+			return nil, errors.New("failed to create master key")
+		}
+		err = mk.Save(passphrase, mkFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mkFile, err)
+	}
+	return mk, nil
+}
+
 // NewTestProxy returns a test Proxy that uses an internal certificate manager
 // instead of letsencrypt.
 func NewTestProxy(cfg *Config) (*Proxy, error) {
@@ -244,18 +382,27 @@ func NewTestProxy(cfg *Config) (*Proxy, error) {
 	if err != nil {
 		return nil, fmt.Errorf("masterkey: %w", err)
 	}
-	store := storage.New(filepath.Join(cfg.CacheDir, "test"), mk)
+	rk := newRotatingKey(mk)
+	store := storage.New(filepath.Join(cfg.CacheDir, "test"), rk)
 	tm, err := tokenmanager.New(store, nil)
 	if err != nil {
 		return nil, err
 	}
+	tk, err := sessionticket.New(store)
+	if err != nil {
+		return nil, err
+	}
 	p := &Proxy{
 		certManager:  cm,
-		mk:           mk,
+		mk:           rk,
+		mkOpts:       opts,
 		store:        store,
 		tokenManager: tm,
+		ticketKeys:   tk,
 		pkis:         make(map[string]*pki.PKIManager),
 		ocspCache:    ocspcache.New(store),
+		crlCache:     crlcache.New(),
+		jwksCache:    jwks.New(),
 		bwLimits:     make(map[string]*bwLimit),
 		inConns:      newConnTracker(),
 		outConns:     newConnTracker(),
@@ -266,9 +413,37 @@ func NewTestProxy(cfg *Config) (*Proxy, error) {
 	return p, nil
 }
 
+// checkRestartOptions returns an error if cfg changes the options that are
+// only used when the proxy starts. The caller must hold p.mu.
+func (p *Proxy) checkRestartOptions(cfg *Config) error {
+	if p.quicTransport != nil && cfg.QUICAddr != p.cfg.QUICAddr {
+		return errors.New("QUICAddr: can't be changed without a restart")
+	}
+	if p.mySQLListener != nil && cfg.MySQLAddr != p.cfg.MySQLAddr {
+		return errors.New("MySQLAddr: can't be changed without a restart")
+	}
+	if p.shards != nil && max(cfg.TLSListenerShards, 1) != max(p.cfg.TLSListenerShards, 1) {
+		return errors.New("TLSListenerShards: can't be changed without a restart")
+	}
+	if p.shards != nil && cfg.HandshakeWorkers != p.cfg.HandshakeWorkers {
+		return errors.New("HandshakeWorkers: can't be changed without a restart")
+	}
+	return nil
+}
+
 // Reconfigure updates the proxy's configuration. Some parameters cannot be
 // changed after Start has been called, e.g. HTTPAddr, TLSAddr, CacheDir.
 func (p *Proxy) Reconfigure(cfg *Config) error {
+	p.discovery.mu.Lock()
+	defer p.discovery.mu.Unlock()
+	if err := p.reconfigure(p.discovery.merge(cfg)); err != nil {
+		return err
+	}
+	p.discovery.cfg = cfg.clone()
+	return nil
+}
+
+func (p *Proxy) reconfigure(cfg *Config) error {
 	p.mu.RLock()
 	curCfg := p.cfg
 	p.mu.RUnlock()
@@ -281,9 +456,31 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 	if err := cfg.Check(); err != nil {
 		return err
 	}
+	if err := p.checkRestartOptions(cfg); err != nil {
+		return err
+	}
+	if err := cfg.loadStaticCerts(); err != nil {
+		return err
+	}
+	if p.accessLog == nil {
+		p.accessLog, _ = accesslog.New(nil, "")
+	}
+	if p.auditLog == nil {
+		p.auditLog = auditlog.New(nil, nil)
+	}
+	p.ticketKeys.SetRotationPeriod(cfg.SessionTicketKeyRotation)
 	if p.cfg != nil {
 		log.Print("INF Configuration changed")
+		diff := configDiff(p.cfg, cfg)
+		for _, line := range diff {
+			log.Printf("INF Config %s", line)
+		}
 		p.recordEvent("config change")
+		p.audit(&auditlog.Entry{
+			Type:    auditlog.TypeConfig,
+			Action:  "reconfigure",
+			Details: diff,
+		})
 	}
 
 	type idp struct {
@@ -294,12 +491,18 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		cm               *cookiemanager.CookieManager
 		actualIDP        string
 	}
+	dnsDomains, err := dns01Domains(cfg.DNSProviders)
+	if err != nil {
+		return err
+	}
+
 	er := eventRecorder{record: p.recordEvent}
 	identityProviders := make(map[string]idp)
 	for _, pp := range cfg.OIDCProviders {
 		_, host, _, _ := hostAndPath(pp.RedirectURL)
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		cm.OnLogin(p.auditLogin)
 		oidcCfg := oidc.Config{
 			DiscoveryURL:     pp.DiscoveryURL,
 			AuthEndpoint:     pp.AuthEndpoint,
@@ -310,6 +513,7 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 			ClientID:         pp.ClientID,
 			ClientSecret:     pp.ClientSecret,
 			HostedDomain:     pp.HostedDomain,
+			Store:            p.sharedStore,
 		}
 		provider, err := oidc.New(oidcCfg, er, cm)
 		if err != nil {
@@ -328,6 +532,7 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		_, host, _, _ := hostAndPath(pp.ACSURL)
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		cm.OnLogin(p.auditLogin)
 		samlCfg := saml.Config{
 			SSOURL:   pp.SSOURL,
 			EntityID: pp.EntityID,
@@ -355,6 +560,7 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		_, host, _, _ := hostAndPath(pp.Endpoint)
 		issuer := "https://" + host + "/"
 		cm := cookiemanager.New(p.tokenManager, pp.Name, pp.Domain, issuer)
+		cm.OnLogin(p.auditLogin)
 		cfg := passkeys.Config{
 			Store:              p.store,
 			Other:              other.identityProvider,
@@ -401,6 +607,27 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		pkis[pp.Name] = m
 	}
 
+	sshCAs := make(map[string]*sshca.SSHCA)
+	for _, c := range cfg.SSHCertificateAuthorities {
+		ca, err := sshca.New(sshca.Options{
+			Name:                       c.Name,
+			KeyType:                    c.KeyType,
+			MaximumCertificateLifetime: c.MaximumCertificateLifetime,
+			Store:                      p.store,
+			EventRecorder:              er,
+			ClaimsFromCtx:              claimsFromCtx,
+		})
+		if err != nil {
+			return err
+		}
+		sshCAs[c.Name] = ca
+	}
+
+	dnsResolvers, err := p.newDNSResolvers(cfg)
+	if err != nil {
+		return err
+	}
+
 	for _, bwl := range cfg.BWLimits {
 		const minBurst = 1 << 17 // 128 KB
 		name := strings.ToLower(bwl.Name)
@@ -417,14 +644,115 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		}
 	}
 
+	ipListCtx := p.ctx
+	if ipListCtx == nil {
+		ipListCtx = context.Background()
+	}
+	ipLists := make(map[string]*ipList, len(cfg.IPLists))
+	for _, c := range cfg.IPLists {
+		if l, ok := p.ipLists[c.Name]; ok && l.cfg == *c {
+			ipLists[c.Name] = l
+			continue
+		}
+		l := newIPList(*c)
+		l.start(ipListCtx)
+		ipLists[c.Name] = l
+	}
+	for name, l := range p.ipLists {
+		if ipLists[name] != l {
+			l.stop()
+		}
+	}
+	p.ipLists = ipLists
+	p.threatFeeds = nil
+	if tf := cfg.ThreatFeeds; tf != nil {
+		for _, n := range tf.IPLists {
+			p.threatFeeds = append(p.threatFeeds, ipLists[n])
+		}
+	}
+
+	addrResolvers := make(map[addrResolverKey]*addressResolver)
+	for _, be := range cfg.Backends {
+		ad := be.AddressDiscovery
+		if ad == nil {
+			continue
+		}
+		key := addrResolverKey{cfg: *ad, dns: be.dnsResolver}
+		if r, ok := addrResolvers[key]; ok {
+			be.addrResolver = r
+			continue
+		}
+		if r, ok := p.addrResolvers[key]; ok {
+			addrResolvers[key] = r
+			be.addrResolver = r
+			continue
+		}
+		r := newAddressResolver(*ad)
+		if be.dnsResolver != nil {
+			r.lookupSRV = be.dnsResolver.LookupSRV
+		}
+		r.start(ipListCtx)
+		addrResolvers[key] = r
+		be.addrResolver = r
+	}
+	for k, r := range p.addrResolvers {
+		if addrResolvers[k] != r {
+			r.stop()
+		}
+	}
+	p.addrResolvers = addrResolvers
+	for k, r := range p.dnsResolvers {
+		if dnsResolvers[k] != r {
+			r.Close()
+		}
+	}
+	p.dnsResolvers = dnsResolvers
+	p.setResponseCaches(cfg)
+	p.setTrafficSplits(cfg)
+	p.eventsmu.Lock()
+	p.eventHistory.resize(cfg.EventHistorySize)
+	p.eventsmu.Unlock()
+
+	var altSvcPort int
+	if cfg.QUICAddr != "" {
+		if _, port, err := net.SplitHostPort(cfg.QUICAddr); err == nil {
+			altSvcPort, _ = strconv.Atoi(port)
+		}
+	}
+
 	backends := make(map[beKey]*Backend, len(cfg.Backends))
 	for _, be := range cfg.Backends {
 		be.recordEvent = p.recordEvent
+		be.reportFailure = p.reportFailure
+		be.countWebSocket = p.countWebSocket
+		be.audit = p.audit
 		be.tm = p.tokenManager
 		be.quicTransport = p.quicTransport
+		be.altSvcPort = altSvcPort
 		be.ocspCache = p.ocspCache
+		be.jwksCache = p.jwksCache
+		be.allowIPLists = nil
+		for _, n := range be.AllowIPLists {
+			be.allowIPLists = append(be.allowIPLists, ipLists[n])
+		}
+		be.denyIPLists = nil
+		for _, n := range be.DenyIPLists {
+			be.denyIPLists = append(be.denyIPLists, ipLists[n])
+		}
+		be.setDialFunc(p.dialFuncs)
+		be.quota = nil
+		if be.ConnectionQuota != nil {
+			be.quota = newConnQuota(be.displayName(), be.ConnectionQuota, p.recordEvent)
+		}
+		be.accessLog = nil
+		if cfg.AccessLog != nil && (be.AccessLog == nil || *be.AccessLog) {
+			be.accessLog = p.accessLog
+		}
 
 		for _, sn := range be.ServerNames {
+			if be.Mode == ModeQUICPassthrough {
+				break
+			}
 			key := beKey{serverName: sn}
 			if backends[key] == nil {
 				backends[key] = be
@@ -553,8 +881,15 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		}
 		be.pkiMap = make(map[string]*pki.PKIManager)
 		tc := p.baseTLSConfig()
+		p.setKeyLogWriter(tc, cfg.TLSDebug)
+		if be.staticCert != nil {
+			tc.GetCertificate = p.getCertificateWithStaple(be.staticCert.getCertificate)
+		}
 		if be.ClientAuth != nil {
 			tc.ClientAuth = tls.RequireAndVerifyClientCert
+			if be.ClientAuth.Mode == ClientAuthRequest {
+				tc.ClientAuth = tls.VerifyClientCertIfGiven
+			}
 			for _, n := range be.ClientAuth.RootCAs {
 				if tc.ClientCAs == nil {
 					tc.ClientCAs = x509.NewCertPool()
@@ -573,13 +908,20 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				}
 			}
 			tc.VerifyConnection = func(cs tls.ConnectionState) error {
-				be, err := p.backend(cs.ServerName, cs.NegotiatedProtocol)
+				serverName := cs.ServerName
+				if serverName == "" && be.Mode == ModeMySQL {
+					serverName = be.ServerNames[0]
+				}
+				be, err := p.backend(serverName, cs.NegotiatedProtocol)
 				if err != nil {
 					return tlsUnrecognizedName
 				}
 				if be.ClientAuth == nil {
 					return nil
 				}
+				if len(cs.PeerCertificates) == 0 && be.ClientAuth.Mode == ClientAuthRequest {
+					return nil
+				}
 				if len(cs.PeerCertificates) == 0 || len(cs.VerifiedChains) == 0 {
 					p.recordEvent(fmt.Sprintf("deny no cert to %s", idnaToUnicode(cs.ServerName)))
 					if cs.Version == tls.VersionTLS12 {
@@ -589,33 +931,40 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				}
 				cert := cs.PeerCertificates[0]
 				sum := certSummary(cert)
-				if m, ok := be.pkiMap[hex.EncodeToString(cert.AuthorityKeyId)]; ok {
-					if m.IsRevoked(cert.SerialNumber) {
-						p.recordEvent(fmt.Sprintf("deny X509 [%s] to %s (revoked)", sum, idnaToUnicode(cs.ServerName)))
-						return tlsCertificateRevoked
-					}
-				} else if len(cert.OCSPServer) > 0 {
-					if err := p.ocspCache.VerifyChains(cs.VerifiedChains, cs.OCSPResponse); err != nil {
-						p.recordEvent(fmt.Sprintf("deny X509 [%s] to %s (OCSP:%v)", sum, idnaToUnicode(cs.ServerName), err))
-						return tlsCertificateRevoked
-					}
+				if err := p.checkClientCertRevocation(be, cs); err != nil {
+					p.recordEvent(fmt.Sprintf("deny X509 [%s] to %s (%v)", sum, idnaToUnicode(cs.ServerName), err))
+					p.auditClientCert(cs.ServerName, sum, auditlog.ResultDeny, err.Error())
+					return tlsCertificateRevoked
 				}
 				if err := be.authorize(cert); err != nil {
 					p.recordEvent(fmt.Sprintf("deny X509 [%s] to %s", sum, idnaToUnicode(cs.ServerName)))
+					p.auditClientCert(cs.ServerName, sum, auditlog.ResultDeny)
 					return tlsAccessDenied
 				}
 				if sum != "" {
 					p.recordEvent(fmt.Sprintf("allow X509 [%s] to %s", sum, idnaToUnicode(cs.ServerName)))
+					p.auditClientCert(cs.ServerName, sum, auditlog.ResultAllow)
 				}
 				return nil
 			}
 		}
+		tc.SetSessionTicketKeys(p.ticketKeys.Keys(be.sessionTicketLabel()))
 		if be.ALPNProtos != nil {
 			tc.NextProtos = slices.Clone(*be.ALPNProtos)
 			tc.NextProtos = slices.DeleteFunc(tc.NextProtos, func(p string) bool {
 				return quicOnlyProtocols[p] && (be.Mode == ModeTLS || be.Mode == ModeTCP)
 			})
 		}
+		if be.Mode == ModeMySQL {
+			// MySQL clients usually don't send SNI.
+			getCert, name := tc.GetCertificate, be.ServerNames[0]
+			tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "" {
+					hello.ServerName = name
+				}
+				return getCert(hello)
+			}
+		}
 		be.tlsConfigQUIC = tc.Clone()
 		be.tlsConfigQUIC.MinVersion = tls.VersionTLS13
 		// http/3 requires QUIC. Offering it on a TCP connection could
@@ -645,6 +994,18 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				return p.certManager.GetCertificate(hello)
 			}
 		}
+		if be.staticCert != nil && slices.Contains(be.ServerNames, CatchAllServerName) {
+			// Don't ask Let's Encrypt for certificates for the
+			// arbitrary server names of the catch-all backend.
+			be.getClientCert = func(context.Context) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return be.staticCert.getCertificate(nil)
+				}
+			}
+		}
+		if be.ForwardClientCert != nil {
+			be.getClientCert = p.forwardClientCertFunc(be, pkis)
+		}
 
 		for _, n := range be.ForwardRootCAs {
 			if be.forwardRootCAs == nil {
@@ -690,37 +1051,95 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				ssoBypass: true,
 			})
 		}
+		if be.WhoAmI {
+			be.localHandlers = append(be.localHandlers, localHandler{
+				desc:    "Who Am I",
+				path:    whoAmIPath,
+				handler: logHandler(http.HandlerFunc(p.whoAmIHandler)),
+			})
+		}
 		switch be.Mode {
 		case ModeConsole:
 			be := be
+			// Without ConsoleAuth, the metrics are only protected by
+			// the backend's SSO and ClientAuth, like before roles
+			// existed, and the admin API isn't available.
+			metricsRole := consoleRoleNone
+			if be.ConsoleAuth != nil {
+				metricsRole = consoleRoleViewer
+			}
 			be.localHandlers = append(be.localHandlers,
-				localHandler{desc: "Metrics", path: "/", handler: logHandler(http.HandlerFunc(p.metricsHandler))},
+				localHandler{desc: "Metrics", path: "/", handler: logHandler(http.HandlerFunc(p.metricsHandler)), role: metricsRole},
+				localHandler{desc: "Prometheus Metrics", path: "/metrics", handler: logHandler(http.HandlerFunc(p.prometheusHandler)), role: metricsRole},
 				localHandler{desc: "Icon", path: "/favicon.ico", handler: logHandler(http.HandlerFunc(p.faviconHandler))},
 			)
-			addPProfHandlers(&be.localHandlers)
+			if be.ConsoleAuth != nil {
+				be.localHandlers = append(be.localHandlers, be.ConsoleDebug.handlers()...)
+				be.localHandlers = append(be.localHandlers, p.adminHandlers()...)
+			}
 
+			be.httpHandler = be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.localHandler())))
+			handler := be.hostRoutingHandler()
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(handler, be.httpConnChan, be.HTTPLimits)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
-				be.http3Server = http3Server(be.localHandler())
+				be.http3Server = http3Server(handler, be.HTTPLimits)
+			}
+
+		case ModeWebSocket:
+			be.httpHandler = be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.webSocketHandler())))
+			be.httpConnChan = make(chan net.Conn)
+			be.httpServer = startInternalHTTPServer(be.hostRoutingHandler(), be.httpConnChan, be.HTTPLimits)
+
+		case ModeProxy:
+			handler := be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.forwardProxyHandler())))
+			be.httpConnChan = make(chan net.Conn)
+			be.httpServer = startInternalHTTPServer(handler, be.httpConnChan, be.HTTPLimits)
+			if *cfg.EnableQUIC && slices.Contains(*be.ALPNProtos, "h3") {
+				be.http3Server = http3DatagramServer(handler, be.HTTPLimits)
+			}
+
+		case ModeRedirect:
+			be.httpHandler = be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.redirectHandler())))
+			handler := be.hostRoutingHandler()
+			be.httpConnChan = make(chan net.Conn)
+			be.httpServer = startInternalHTTPServer(handler, be.httpConnChan, be.HTTPLimits)
+			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
+				be.http3Server = http3Server(handler, be.HTTPLimits)
 			}
 
 		case ModeLocal:
+			be.httpHandler = be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.localHandler())))
+			handler := be.hostRoutingHandler()
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.localHandler(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(handler, be.httpConnChan, be.HTTPLimits)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
-				be.http3Server = http3Server(be.localHandler())
+				be.http3Server = http3Server(handler, be.HTTPLimits)
 			}
 
 		case ModeHTTPS, ModeHTTP:
+			be.httpTransport = be.reverseProxyTransport()
+			be.mirror = be.newMirror()
+			be.httpHandler = be.tracingHandler(be.accessLogHandler(be.earlyDataHandler(be.httpLimitsHandler(be.jwtAuthHandler(be.reverseProxy())))))
+			handler := be.hostRoutingHandler()
 			be.httpConnChan = make(chan net.Conn)
-			be.httpServer = startInternalHTTPServer(be.reverseProxy(), be.httpConnChan)
+			be.httpServer = startInternalHTTPServer(handler, be.httpConnChan, be.HTTPLimits)
 			if *cfg.EnableQUIC && be.ALPNProtos != nil && slices.Contains(*be.ALPNProtos, "h3") {
-				be.http3Server = http3Server(be.reverseProxy())
+				be.http3Server = http3Server(handler, be.HTTPLimits)
 			}
 		}
 	}
 
+	for _, be := range cfg.Backends {
+		if be.HostRouting == nil || len(be.HostRouting.RouteTo) == 0 {
+			continue
+		}
+		be.hostRoutes = make(map[string]*Backend, len(be.HostRouting.RouteTo))
+		for _, sn := range be.HostRouting.RouteTo {
+			be.hostRoutes[sn] = backends[beKey{serverName: sn}]
+		}
+	}
+
 	addLocalHandler := func(h localHandler, urls ...string) {
 		for _, v := range urls {
 			host, _, path, err := hostAndPath(v)
@@ -779,8 +1198,48 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 				handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeCertificateManagement)),
 			}, pp.Endpoint)
 		}
+		if pp.ESTEndpoint != "" {
+			est := strings.TrimSuffix(pp.ESTEndpoint, "/")
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("PKI EST CA Certs (%s)", pp.Name),
+				handler:   logHandler(http.HandlerFunc(pkis[pp.Name].ServeESTCACerts)),
+				ssoBypass: true,
+			}, est+"/cacerts")
+			addLocalHandler(localHandler{
+				desc:    fmt.Sprintf("PKI EST Enroll (%s)", pp.Name),
+				handler: logHandler(http.HandlerFunc(pkis[pp.Name].ServeESTSimpleEnroll)),
+			}, est+"/simpleenroll")
+		}
+	}
+	for _, c := range cfg.SSHCertificateAuthorities {
+		if c.PublicKeyEndpoint != "" {
+			addLocalHandler(localHandler{
+				desc:      fmt.Sprintf("SSH CA Public Key (%s)", c.Name),
+				handler:   logHandler(http.HandlerFunc(sshCAs[c.Name].ServePublicKey)),
+				ssoBypass: true,
+			}, c.PublicKeyEndpoint)
+		}
+		addLocalHandler(localHandler{
+			desc:    fmt.Sprintf("SSH CA Certificate (%s)", c.Name),
+			handler: logHandler(http.HandlerFunc(sshCAs[c.Name].ServeCertificate)),
+		}, c.CertificateEndpoint)
+	}
+	// Keep the current tracer if the tracing config didn't change so that
+	// the spans of existing connections are still exported.
+	tracer := p.tracer
+	if p.cfg == nil || !reflect.DeepEqual(cfg.Tracing, p.cfg.Tracing) {
+		tracer = nil
+	}
+	if tc := cfg.Tracing; tc != nil && tracer == nil {
+		tracer = tracing.New(tracing.Config{
+			Endpoint:    tc.Endpoint,
+			Headers:     tc.Headers,
+			ServiceName: tc.ServiceName,
+			SampleRatio: *tc.SampleRatio,
+		})
 	}
 	for _, be := range backends {
+		be.tracer = tracer
 		sort.Slice(be.localHandlers, func(i, j int) bool {
 			a := be.localHandlers[i].host
 			b := be.localHandlers[j].host
@@ -796,36 +1255,110 @@ func (p *Proxy) Reconfigure(cfg *Config) error {
 		})
 		be.outConns = p.outConns
 	}
+	if err := p.setAccessLogOutput(cfg.AccessLog); err != nil {
+		if tracer != p.tracer {
+			tracer.Close()
+		}
+		return err
+	}
+	if err := p.setAuditLogOutput(cfg.AuditLog); err != nil {
+		if tracer != p.tracer {
+			tracer.Close()
+		}
+		return err
+	}
+	if err := p.setFlowExport(cfg.FlowExport); err != nil {
+		if tracer != p.tracer {
+			tracer.Close()
+		}
+		return err
+	}
+	if err := p.setTLSDebug(cfg.TLSDebug); err != nil {
+		if tracer != p.tracer {
+			tracer.Close()
+		}
+		return err
+	}
+	p.setHandshakePool(cfg)
+	if tracer != p.tracer {
+		go p.tracer.Close()
+		p.tracer = tracer
+	}
 	if p.cfg != nil {
+		ctx := p.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		time.AfterFunc(*cfg.DrainTimeout, cancel)
 		for _, be := range p.cfg.Backends {
-			be.close(p.ctx)
+			be.close(ctx)
+		}
+	}
+	if p.dns01 != nil {
+		p.dns01.SetDomains(dnsDomains)
+	}
+	if m, ok := p.certManager.(*acmeManager); ok {
+		m.setConfig(cfg.ACME, cfg.Email)
+		m.setNames(p.acmeServerNames(cfg))
+		select {
+		case p.prewarmCh <- struct{}{}:
+		default:
+		}
+		if p.dns01 != nil {
+			p.dns01.SetAccount(m.defaultAccount())
 		}
 	}
 	p.defServerName = cfg.DefaultServerName
 	p.backends = backends
 	p.pkis = pkis
+	if cfg.RateLimit == nil {
+		p.limits = nil
+	} else if p.limits == nil || !reflect.DeepEqual(p.limits.cfg, cfg.RateLimit) {
+		p.limits = newConnLimits(cfg.RateLimit)
+	}
+	if cfg.ConnectionQuota == nil {
+		p.quota = nil
+	} else if p.quota == nil {
+		p.quota = newConnQuota("client ip", cfg.ConnectionQuota, p.recordEvent)
+	} else {
+		p.quota.setConfig(cfg.ConnectionQuota)
+	}
+	if err := setLogConfig(cfg.Log); err != nil {
+		log.Printf("ERR Log: %v", err)
+	}
 	p.cfg = cfg
-	go p.reAuthorize()
+	go p.reAuthorize(*cfg.DrainTimeout)
 	return nil
 }
 
-func (p *Proxy) reAuthorize() {
+// reAuthorize checks that all the existing connections are still allowed
+// after a config change. Connections that are denied are closed immediately.
+// Connections whose backend was removed or changed mode are closed after
+// drainTimeout.
+func (p *Proxy) reAuthorize(drainTimeout time.Duration) {
 	for _, conn := range p.inConns.slice() {
 		if !connServerNameIsSet(conn) {
 			continue
 		}
+		oldBE := connBackend(conn)
+		if oldBE == nil {
+			// The connection is still being set up, e.g. waiting in
+			// a connection quota queue.
+			continue
+		}
 		serverName := connServerName(conn)
 		proto := connProto(conn)
 		be, err := p.backend(serverName, proto)
 		if err != nil {
 			p.recordEvent(err.Error())
-			log.Printf("BAD [-] ReAuth %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
-			conn.Close()
+			log.Printf("INF [-] ReAuth %s ➔ %q: %v, draining", conn.RemoteAddr(), serverName, err)
+			time.AfterFunc(drainTimeout, func() { closeConnGracefully(conn) })
 			continue
 		}
-		if oldBE := connBackend(conn); be.Mode != oldBE.Mode {
-			log.Printf("INF [-] ReAuth %s ➔  %q backend mode changed %s->%s", conn.RemoteAddr(), idnaToUnicode(serverName), oldBE.Mode, be.Mode)
-			conn.Close()
+		if be.Mode != oldBE.Mode {
+			log.Printf("INF [-] ReAuth %s ➔  %q backend mode changed %s->%s, draining", conn.RemoteAddr(), idnaToUnicode(serverName), oldBE.Mode, be.Mode)
+			time.AfterFunc(drainTimeout, func() { closeConnGracefully(conn) })
 			continue
 		}
 		if err := be.checkIP(conn.RemoteAddr()); err != nil {
@@ -834,12 +1367,26 @@ func (p *Proxy) reAuthorize() {
 			conn.Close()
 			continue
 		}
+		if err := be.checkFingerprint(connJA3(conn), connJA4(conn)); err != nil {
+			p.recordEvent(serverName + " CheckFingerprint " + err.Error())
+			log.Printf("BAD [-] ReAuth %s ➔ %q CheckFingerprint: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
+			conn.Close()
+			continue
+		}
 		if be.ClientAuth == nil {
 			continue
 		}
 		clientCert := connClientCert(conn)
 		if err := be.authorize(clientCert); err != nil {
 			p.recordEvent(err.Error())
+			p.audit(&auditlog.Entry{
+				Type:       auditlog.TypeClientCert,
+				Actor:      certSummary(clientCert),
+				RemoteAddr: conn.RemoteAddr().String(),
+				ServerName: idnaToUnicode(serverName),
+				Action:     "reauthorize",
+				Result:     auditlog.ResultDeny,
+			})
 			log.Printf("BAD [-] ReAuth %s ➔ %q Authorize(%q): %v", conn.RemoteAddr(), idnaToUnicode(serverName), certSummary(clientCert), err)
 			conn.Close()
 			continue
@@ -849,15 +1396,21 @@ func (p *Proxy) reAuthorize() {
 
 // Start starts a TLS proxy with the given configuration. The proxy runs
 // in background until the context is canceled.
+//
+// When the process is started with systemd socket activation, the sockets
+// that are passed to it are used instead of new ones. They are matched with
+// HTTPAddr, TLSAddr, QUICAddr, QUICPassthroughAddr, and MySQLAddr by
+// FileDescriptorName, i.e. http, tls, quic, quicpassthrough, and mysql, or by
+// address.
 func (p *Proxy) Start(ctx context.Context) error {
 	p.startTime = time.Now()
 	p.connClosed = sync.NewCond(&p.mu)
 	var httpServer *http.Server
 	if p.cfg.HTTPAddr != "" {
 		httpServer = &http.Server{
-			Handler: p.certManager.HTTPHandler(nil),
+			Handler: p.certManager.HTTPHandler(p.plaintextHTTPHandler()),
 		}
-		httpListener, err := net.Listen("tcp", p.cfg.HTTPAddr)
+		httpListener, err := p.listen(socketNameHTTP, p.cfg.HTTPAddr)
 		if err != nil {
 			return err
 		}
@@ -869,22 +1422,66 @@ func (p *Proxy) Start(ctx context.Context) error {
 			return err
 		}
 	}
+	if p.cfg.QUICPassthroughAddr != "" {
+		if err := p.startQUICPassthrough(p.cfg.QUICPassthroughAddr); err != nil {
+			return err
+		}
+	}
 
-	listener, err := netw.Listen("tcp", p.cfg.TLSAddr)
-	if err != nil {
-		return err
+	listeners := []net.Listener{p.tlsListener}
+	if p.tlsListener == nil {
+		ls, err := p.listenShards(socketNameTLS, p.cfg.TLSAddr, p.cfg.TLSListenerShards)
+		if err != nil {
+			return err
+		}
+		listeners = ls
+	}
+	p.shards = newListenerShards(listeners, p.cfg.HandshakeWorkers)
+	p.listener = p.shards[0].listener
+	if p.cfg.MySQLAddr != "" {
+		l, err := p.listen(socketNameMySQL, p.cfg.MySQLAddr)
+		if err != nil {
+			return err
+		}
+		p.mySQLListener = netw.NewListener(l)
 	}
-	p.listener = listener
 	p.ctx, p.cancel = context.WithCancel(ctx)
 
 	go p.revokeUnusedCertificates(p.ctx)
+	go p.acmeKeyRotationLoop(p.ctx)
+	go p.prewarmLoop(p.ctx)
 	go p.ctxWait(httpServer)
 	go p.tokenManager.KeyRotationLoop(p.ctx)
+	go p.ticketKeys.KeyRotationLoop(p.ctx, p.updateSessionTicketKeys)
+	if p.sharedStore != nil {
+		go p.banListSyncLoop(p.ctx)
+	}
+	if p.dns01 != nil {
+		go p.dns01.RenewalLoop(p.ctx)
+	}
 	go p.ocspCache.FlushLoop(p.ctx)
-	go p.acceptLoop()
+	go p.dockerDiscoveryLoop(p.ctx)
+	go p.certMonitorLoop(p.ctx)
+	for _, s := range p.shards {
+		go p.acceptLoop(s)
+	}
+	if p.mySQLListener != nil {
+		go p.mySQLAcceptLoop()
+	}
+	if err := activation.NotifyReady(); err != nil {
+		log.Printf("ERR NotifyReady: %v", err)
+	}
 	return nil
 }
 
+// StartWithListener is like Start, but the proxy accepts the TLS connections
+// from l instead of listening on TLSAddr, e.g. to receive connections over a
+// VPN, or in memory in tests. l is closed when the proxy stops.
+func (p *Proxy) StartWithListener(ctx context.Context, l net.Listener) error {
+	p.tlsListener = l
+	return p.Start(ctx)
+}
+
 func (p *Proxy) ctxWait(s *http.Server) {
 	<-p.ctx.Done()
 	if s != nil {
@@ -893,18 +1490,19 @@ func (p *Proxy) ctxWait(s *http.Server) {
 	p.Stop()
 }
 
-func (p *Proxy) acceptLoop() {
-	log.Printf("INF Accepting TLS connections on %s %s", p.listener.Addr().Network(), p.listener.Addr())
+func (p *Proxy) mySQLAcceptLoop() {
+	log.Printf("INF Accepting MySQL connections on %s %s", p.mySQLListener.Addr().Network(), p.mySQLListener.Addr())
 	for {
-		conn, err := p.listener.Accept()
+		conn, err := p.mySQLListener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				log.Print("INF TLS Accept loop terminated")
+				log.Print("INF MySQL Accept loop terminated")
 				break
 			}
-			log.Printf("ERR TLS Accept: %v", err)
+			log.Printf("ERR MySQL Accept: %v", err)
 			continue
 		}
+		conn.(*netw.Conn).SetAnnotation(mySQLKey, true)
 		go p.handleConnection(conn.(*netw.Conn))
 	}
 }
@@ -915,14 +1513,34 @@ func (p *Proxy) Stop() {
 	if p.cancel != nil {
 		p.cancel()
 	}
-	p.listener.Close()
+	for _, l := range p.ipLists {
+		l.stop()
+	}
+	for _, r := range p.addrResolvers {
+		r.stop()
+	}
+	for _, r := range p.dnsResolvers {
+		r.Close()
+	}
+	for _, rc := range p.respCaches {
+		rc.cache.Close()
+	}
+	p.closeListeners()
+	if p.mySQLListener != nil {
+		p.mySQLListener.Close()
+	}
 	if p.quicTransport != nil {
 		p.quicTransport.Close()
 	}
+	if p.quicPassthrough != nil {
+		p.quicPassthrough.close()
+	}
+	p.masterKeyMu.Lock()
 	if p.mk != nil {
 		p.mk.Wipe()
 		p.mk = nil
 	}
+	p.masterKeyMu.Unlock()
 	backends := p.cfg.Backends
 	p.cfg.Backends = nil
 	conns := p.inConns.slice()
@@ -932,21 +1550,50 @@ func (p *Proxy) Stop() {
 		be.close(nil)
 	}
 	for _, conn := range conns {
-		conn.Close()
+		closeConnGracefully(conn)
+	}
+	p.mu.Lock()
+	tracer := p.tracer
+	p.tracer = nil
+	if p.accessLogCloser != nil {
+		p.accessLogCloser.Close()
+		p.accessLogCloser = nil
+	}
+	if p.auditLogCloser != nil {
+		p.auditLogCloser.Close()
+		p.auditLogCloser = nil
+	}
+	flowExporter := p.flowExporter.Swap(nil)
+	p.flowExportCfg = nil
+	if p.keyLog != nil {
+		p.keyLog.setPath("")
+	}
+	p.mu.Unlock()
+	tracer.Close()
+	if flowExporter != nil {
+		flowExporter.Close()
 	}
 	if p.tpm != nil {
 		p.tpm.Close()
 	}
 }
 
-// Shutdown gracefully shuts down the proxy, waiting for all existing
-// connections to close or ctx to be canceled.
+// Shutdown gracefully shuts down the proxy. It stops accepting new
+// connections, asks HTTP clients to go away, and waits for all existing
+// connections to close or ctx to be canceled. Then, the remaining connections
+// are closed.
 func (p *Proxy) Shutdown(ctx context.Context) {
 	p.mu.Lock()
-	p.listener.Close()
+	p.closeListeners()
+	if p.mySQLListener != nil {
+		p.mySQLListener.Close()
+	}
 	if p.quicTransport != nil {
 		p.quicTransport.Close()
 	}
+	if p.quicPassthrough != nil {
+		p.quicPassthrough.close()
+	}
 	for _, be := range p.cfg.Backends {
 		be.close(ctx)
 	}
@@ -954,17 +1601,10 @@ func (p *Proxy) Shutdown(ctx context.Context) {
 
 	done := make(chan struct{})
 	go func() {
-		connLeft := func() bool {
-			for _, c := range p.inConns.slice() {
-				if mode := connMode(c); mode != ModeTCP && mode != ModeTLS && mode != ModeTLSPassthrough {
-					return true
-				}
-			}
-			return false
-		}
 		p.mu.Lock()
 		defer p.mu.Unlock()
-		for connLeft() {
+		for n := len(p.inConns.slice()); n > 0; n = len(p.inConns.slice()) {
+			log.Printf("INF Draining %d connection(s)", n)
 			p.connClosed.Wait()
 		}
 		close(done)
@@ -979,7 +1619,25 @@ func (p *Proxy) Shutdown(ctx context.Context) {
 func (p *Proxy) baseTLSConfig() *tls.Config {
 	tc := p.certManager.TLSConfig()
 	getCert := tc.GetCertificate
-	tc.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if p.dns01 != nil {
+		acmeGetCert := getCert
+		getCert = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if !slices.Contains(hello.SupportedProtos, acme.ALPNProto) && p.dns01.Covers(hello.ServerName) {
+				return p.dns01.GetCertificate(hello)
+			}
+			return acmeGetCert(hello)
+		}
+	}
+	tc.GetCertificate = p.getCertificateWithStaple(getCert)
+	tc.NextProtos = *defaultALPNProtos
+	tc.MinVersion = tls.VersionTLS12
+	return tc
+}
+
+// getCertificateWithStaple wraps getCert to add an OCSP staple to the
+// certificate.
+func (p *Proxy) getCertificateWithStaple(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		if hello.ServerName == "" {
 			hello.ServerName = p.defaultServerName()
 		}
@@ -997,6 +1655,9 @@ func (p *Proxy) baseTLSConfig() *tls.Config {
 			}
 			cert.Leaf = c
 		}
+		if len(cert.Leaf.OCSPServer) == 0 {
+			return cert, nil
+		}
 		issuer, err := x509.ParseCertificate(cert.Certificate[1])
 		if err != nil {
 			return nil, err
@@ -1008,9 +1669,6 @@ func (p *Proxy) baseTLSConfig() *tls.Config {
 		}
 		return cert, nil
 	}
-	tc.NextProtos = *defaultALPNProtos
-	tc.MinVersion = tls.VersionTLS12
-	return tc
 }
 
 func (p *Proxy) acceptProxyHeader(addr net.Addr) bool {
@@ -1028,11 +1686,19 @@ func (p *Proxy) acceptProxyHeader(addr net.Addr) bool {
 	return false
 }
 
+// clientHelloLimits returns the maximum amount of time to wait for the
+// ClientHello, and its maximum size.
+func (p *Proxy) clientHelloLimits() (time.Duration, int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return cmp.Or(p.cfg.ClientHelloTimeout, defaultClientHelloTimeout), cmp.Or(p.cfg.MaxClientHelloSize, maxClientHelloSize)
+}
+
 func (p *Proxy) handleConnection(conn *netw.Conn) {
 	p.recordEvent("tcp connection")
 	defer func() {
 		if r := recover(); r != nil {
-			p.recordEvent("panic")
+			p.recordConnEvent(conn, "panic")
 			log.Printf("ERR [%s] %s: PANIC: %v", certSummary(connClientCert(conn)), conn.RemoteAddr(), r)
 			conn.Close()
 		}
@@ -1043,17 +1709,26 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 			conn.Close()
 		}
 	}()
+	defer releaseHandshakeWorker(conn)
 	conn.SetAnnotation(startTimeKey, time.Now())
+	helloTimeout, helloMaxSize := p.clientHelloLimits()
+	conn.SetPeekDeadline(time.Now().Add(helloTimeout))
 	if p.acceptProxyHeader(conn.RemoteAddr()) {
+		// The PROXY header is read on first use, e.g. by RemoteAddr().
+		conn.Conn.SetReadDeadline(time.Now().Add(helloTimeout))
 		cc := proxyproto.NewConn(conn.Conn)
 		conn.Conn = cc
 	}
 	numOpen := p.inConns.add(conn)
+	p.startTranscript(conn, "TLS")
 	conn.OnClose(func() {
 		p.inConns.remove(conn)
+		p.endTranscript(conn)
+		releaseConnectionQuota(conn)
+		p.exportFlow(conn)
 		if conn.Annotation(reportEndKey, false).(bool) {
 			startTime := conn.Annotation(startTimeKey, time.Time{}).(time.Time)
-			log.Printf("END %s; Dur:%s Recv:%d Sent:%d",
+			logConnEnd(conn, "END %s; Dur:%s Recv:%d Sent:%d",
 				formatConnDesc(conn), time.Since(startTime).Truncate(time.Millisecond),
 				conn.BytesReceived(), conn.BytesSent())
 		}
@@ -1063,80 +1738,249 @@ func (p *Proxy) handleConnection(conn *netw.Conn) {
 		p.connClosed.Broadcast()
 	})
 	if numOpen >= p.cfg.MaxOpen {
-		p.recordEvent("too many open connections")
+		p.recordConnEvent(conn, "too many open connections")
 		log.Printf("ERR [-] %s: too many open connections: %d >= %d", conn.RemoteAddr(), numOpen, p.cfg.MaxOpen)
 		sendCloseNotify(conn)
 		return
 	}
+	if p.threatFeedDrop(conn) {
+		return
+	}
+	if err := p.allowIP(conn.RemoteAddr()); err != nil {
+		log.Printf("BAD [-] %s: %v", conn.RemoteAddr(), err)
+		if err == errBanned {
+			p.tarpit(conn)
+		}
+		return
+	}
 	setKeepAlive(conn)
 
-	hello, err := peekClientHello(conn)
-	if err != nil {
-		p.recordEvent("invalid ClientHello")
+	var be *Backend
+	if conn.Annotation(mySQLKey, false).(bool) {
+		// MySQL servers speak first. The connection to the backend is
+		// needed before the TLS handshake.
+		mbe, intConn, err := p.mySQLPreamble(conn)
+		if err != nil {
+			log.Printf("ERR [-] %s MySQL: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer intConn.Close()
+		be = mbe
+		conn.SetAnnotation(internalConnKey, intConn)
+		// The server greeting doesn't count against the client's time.
+		conn.SetPeekDeadline(time.Now().Add(helloTimeout))
+	} else if ok, err := peekPostgresSSLRequest(conn); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			p.recordConnEvent(conn, "ClientHello timeout")
+		}
+		log.Printf("BAD [-] %s: SSLRequest: %v", conn.RemoteAddr(), err)
+		return
+	} else if ok {
+		conn.SetAnnotation(pgSSLRequestKey, true)
+	}
+
+	hello, err := peekClientHello(conn, helloMaxSize)
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		p.recordConnEvent(conn, "ClientHello timeout")
+		log.Printf("BAD [-] %s: ClientHello timeout: %v", conn.RemoteAddr(), err)
+		return
+	case errors.Is(err, errClientHelloTooLarge):
+		p.recordConnEvent(conn, "ClientHello too large")
+		p.reportFailure(conn.RemoteAddr())
+		log.Printf("BAD [-] %s: %v", conn.RemoteAddr(), err)
+		return
+	case err != nil:
+		p.recordConnEvent(conn, "invalid ClientHello")
+		p.reportFailure(conn.RemoteAddr())
 		log.Printf("BAD [-] %s ➔ %q: invalid ClientHello: %v", conn.RemoteAddr(), hello.ServerName, err)
 		return
 	}
+	conn.SetPeekDeadline(time.Time{})
 	serverName := hello.ServerName
-	if serverName == "" {
-		p.recordEvent("no SNI")
+	if serverName == "" && be != nil {
+		serverName = be.ServerNames[0]
+	} else if serverName == "" {
+		p.recordConnEvent(conn, "no SNI")
 		serverName = p.defaultServerName()
 	}
 	conn.SetAnnotation(serverNameKey, serverName)
-
-	be, err := p.backend(serverName, hello.ALPNProtos...)
-	if err != nil {
-		p.recordEvent(err.Error())
+	ja3, ja4 := hello.ja3(), hello.ja4('t')
+	conn.SetAnnotation(ja3Key, ja3)
+	conn.SetAnnotation(ja4Key, ja4)
+	transcriptClientHello(conn, hello)
+
+	if be != nil {
+		if !be.hasServerName(serverName) {
+			p.recordConnEvent(conn, "mismatched server name")
+			log.Printf("BAD [-] %s ➔ %q MySQL: mismatched server name", conn.RemoteAddr(), serverName)
+			return
+		}
+	} else if be, err = p.route(&ClientHelloInfo{
+		ServerName: serverName,
+		ALPNProtos: hello.ALPNProtos,
+		RemoteAddr: conn.RemoteAddr(),
+		LocalAddr:  conn.LocalAddr(),
+		JA3:        ja3,
+		JA4:        ja4,
+		p:          p,
+	}); err != nil {
+		p.recordConnEvent(conn, err.Error())
 		log.Printf("BAD [-] %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
-		sendUnrecognizedName(conn)
+		if be = p.rejectConn(conn); be == nil {
+			return
+		}
+	}
+	isACME := len(hello.ALPNProtos) == 1 && hello.ALPNProtos[0] == acme.ALPNProto && hello.ServerName != ""
+	if !isACME && p.checkClient(conn, be) != nil {
+		if be = p.rejectConn(conn); be == nil || p.checkClient(conn, be) != nil {
+			return
+		}
+	}
+	if err := p.checkConnectionQuota(p.ctx, conn, be); err != nil {
+		log.Printf("ERR [-] %s ➔ %q: %v", conn.RemoteAddr(), serverName, err)
+		sendCloseNotify(conn)
 		return
 	}
+	if be.Mode != ModeTLSPassthrough {
+		if err := p.admitHandshake(conn, hello.Resumption); err != nil {
+			p.recordConnEvent(conn, "handshake overload")
+			log.Printf("ERR [-] %s ➔ %q: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
+			sendCloseNotify(conn)
+			return
+		}
+	}
 	conn.SetAnnotation(backendKey, be)
+	addTranscriptStep(conn, "backend", "server name: "+idnaToUnicode(serverName), "mode: "+be.Mode)
 	be.incInFlight(1)
-	p.setCounters(conn, serverName)
+	p.setCounters(conn, be.metricsServerName(serverName))
 	if l := be.bwLimit; l != nil {
 		conn.SetLimiters(l.ingress, l.egress)
 	}
+	isMySQL, isPostgres := conn.Annotation(mySQLKey, false).(bool), conn.Annotation(pgSSLRequestKey, false).(bool)
+	if !isACME && (isMySQL != (be.Mode == ModeMySQL) || (isPostgres && be.Mode != ModePostgres)) {
+		p.recordConnEvent(conn, "wrong mode")
+		log.Printf("ERR [-] %s ➔  %q: unexpected database connection in mode %s", conn.RemoteAddr(), idnaToUnicode(serverName), be.Mode)
+		return
+	}
 	switch {
 	case be.Mode == ModeTLSPassthrough:
-		if err := p.checkIP(conn); err != nil {
-			return
-		}
+		// The TLS handshake is done by the backend.
+		releaseHandshakeWorker(conn)
 		p.handleTLSPassthroughConnection(conn)
 
-	case len(hello.ALPNProtos) == 1 && hello.ALPNProtos[0] == acme.ALPNProto && hello.ServerName != "":
+	case isACME:
 		tc := p.baseTLSConfig()
 		tc.NextProtos = []string{acme.ALPNProto}
 		p.handleACMEConnection(tls.Server(conn, tc))
 
-	case be.Mode == ModeConsole || be.Mode == ModeLocal || be.Mode == ModeHTTP || be.Mode == ModeHTTPS:
-		if err := p.checkIP(conn); err != nil {
-			return
-		}
-		p.handleHTTPConnection(tls.Server(conn, be.tlsConfig))
+	case hello.ServerName == "" && be.canSniff() && p.sniffers() != nil:
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		closeConnNeeded = !p.handleSniffedConnection(conn, tc)
+
+	case be.Mode == ModeConsole || be.Mode == ModeLocal || be.Mode == ModeHTTP || be.Mode == ModeHTTPS || be.Mode == ModeWebSocket || be.Mode == ModeRedirect || be.Mode == ModeProxy:
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		p.handleHTTPConnection(tc)
 		closeConnNeeded = false
 
 	case be.Mode == ModeTCP || be.Mode == ModeTLS || be.Mode == ModeQUIC:
-		if err := p.checkIP(conn); err != nil {
-			return
-		}
-		p.handleTLSConnection(tls.Server(conn, be.tlsConfig))
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		p.handleTLSConnection(tc)
+
+	case be.Mode == ModeSOCKS5:
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		p.handleSOCKS5Connection(tc)
+
+	case be.Mode == ModePostgres:
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		p.handleDatabaseConnection(tc, nil)
+
+	case be.Mode == ModeMySQL:
+		tc := tls.Server(conn, be.tlsConfig)
+		conn.SetAnnotation(tlsConnKey, tc)
+		p.handleDatabaseConnection(tc, conn.Annotation(internalConnKey, nil).(net.Conn))
 
 	default:
 		log.Printf("ERR [-] %s: unhandled connection %q", conn.RemoteAddr(), be.Mode)
 	}
 }
 
-// checkIP is just a wrapper around be.checkIP. It must be called before the TLS
-// handshake completes.
-func (p *Proxy) checkIP(conn *netw.Conn) error {
-	be := connBackend(conn)
+// updateSessionTicketKeys sets the current session ticket keys on all the
+// backends' TLS configs. It is called when the keys are rotated.
+func (p *Proxy) updateSessionTicketKeys() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, be := range p.cfg.Backends {
+		if be.tlsConfig == nil {
+			continue
+		}
+		keys := p.ticketKeys.Keys(be.sessionTicketLabel())
+		be.tlsConfig.SetSessionTicketKeys(keys)
+		be.tlsConfigQUIC.SetSessionTicketKeys(keys)
+	}
+}
+
+// checkClient is a wrapper around be.checkIP and be.checkFingerprint. It must
+// be called before the TLS handshake completes. The caller is responsible for
+// rejecting the connection when an error is returned.
+func (p *Proxy) checkClient(conn *netw.Conn, be *Backend) error {
 	if err := be.checkIP(conn.RemoteAddr()); err != nil {
 		serverName := idnaToUnicode(connServerName(conn))
-		p.recordEvent(serverName + " CheckIP " + err.Error())
+		p.recordConnEvent(conn, serverName+" CheckIP "+err.Error())
+		p.auditIPDenied(conn.RemoteAddr(), serverName)
 		log.Printf("BAD [-] %s ➔ %q CheckIP: %v", conn.RemoteAddr(), serverName, err)
-		sendUnrecognizedName(conn)
 		return err
 	}
+	if err := be.checkFingerprint(connJA3(conn), connJA4(conn)); err != nil {
+		serverName := idnaToUnicode(connServerName(conn))
+		p.recordConnEvent(conn, serverName+" CheckFingerprint "+err.Error())
+		p.reportFailure(conn.RemoteAddr())
+		log.Printf("BAD [-] %s ➔ %q CheckFingerprint(%s %s): %v", conn.RemoteAddr(), serverName, connJA3(conn), connJA4(conn), err)
+		return err
+	}
+	return nil
+}
+
+// rejectConn handles a connection with an unknown server name, or from a
+// client that isn't allowed, according to the RejectPolicy. It returns the
+// backend that should handle the connection instead, or nil if the connection
+// should be closed.
+func (p *Proxy) rejectConn(conn *netw.Conn) *Backend {
+	p.mu.RLock()
+	rp := p.cfg.RejectPolicy
+	p.mu.RUnlock()
+	if rp == nil {
+		sendUnrecognizedName(conn)
+		return nil
+	}
+	switch rp.Action {
+	case RejectClose:
+		p.recordConnEvent(conn, "reject close")
+	case RejectTarpit:
+		p.recordConnEvent(conn, "reject tarpit")
+		timer := time.NewTimer(rp.TarpitDelay)
+		defer timer.Stop()
+		select {
+		case <-p.ctx.Done():
+		case <-timer.C:
+		}
+	case RejectRoute:
+		be, err := p.backend(rp.ServerName)
+		if err != nil {
+			log.Printf("ERR [-] %s ➔ %q RejectPolicy: %v", conn.RemoteAddr(), rp.ServerName, err)
+			sendUnrecognizedName(conn)
+			return nil
+		}
+		p.recordConnEvent(conn, "reject route")
+		return be
+	default:
+		sendUnrecognizedName(conn)
+	}
 	return nil
 }
 
@@ -1146,35 +1990,49 @@ func (p *Proxy) handleACMEConnection(conn *tls.Conn) {
 	serverName := idnaToUnicode(connServerName(conn))
 	log.Printf("INF ACME %s ➔  %s", conn.RemoteAddr(), serverName)
 	if err := conn.HandshakeContext(ctx); err != nil {
-		p.recordEvent("tls handshake failed")
+		p.recordConnEvent(conn, "tls handshake failed")
 		log.Printf("BAD [-] %s ➔ %q Handshake: %v", conn.RemoteAddr(), serverName, unwrapErr(err))
 	}
 }
 
-func (p *Proxy) authorizeTLSConnection(conn *tls.Conn) bool {
+func (p *Proxy) authorizeTLSConnection(conn tlsConn) bool {
+	if _, ok := conn.(*sniffedConn); ok {
+		// The connection was authorized before sniffing.
+		return true
+	}
 	serverName := connServerName(conn)
 	be := connBackend(conn)
 
 	ctx, cancel := context.WithTimeout(p.ctx, 2*time.Minute)
 	defer cancel()
-	if err := conn.HandshakeContext(ctx); err != nil {
+	err := conn.HandshakeContext(ctx)
+	releaseHandshakeWorker(conn)
+	if err != nil {
 		switch {
 		case err.Error() == "tls: client didn't provide a certificate":
-			p.recordEvent(fmt.Sprintf("deny no cert to %s", idnaToUnicode(serverName)))
+			p.recordConnEvent(conn, fmt.Sprintf("deny no cert to %s", idnaToUnicode(serverName)))
 		case errors.Is(err, tlsAccessDenied):
-			p.recordEvent("access denied")
+			p.recordConnEvent(conn, "access denied")
 		case errors.Is(err, tlsCertificateRevoked):
-			p.recordEvent("cert is revoked")
+			p.recordConnEvent(conn, "cert is revoked")
 		default:
-			p.recordEvent("tls handshake failed")
+			p.recordConnEvent(conn, "tls handshake failed")
 		}
+		p.reportFailure(conn.RemoteAddr())
+		addTranscriptStep(conn, "handshake failed", unwrapErr(err).Error())
 		log.Printf("BAD [-] %s ➔ %q Handshake: %v", conn.RemoteAddr(), idnaToUnicode(serverName), unwrapErr(err))
 		return false
 	}
-	annotatedConn(conn).SetAnnotation(handshakeDoneKey, time.Now())
+	hsTime := time.Now()
+	annotatedConn(conn).SetAnnotation(handshakeDoneKey, hsTime)
+	startTime := annotatedConn(conn).Annotation(startTimeKey, time.Time{}).(time.Time)
 	cs := conn.ConnectionState()
-	if (cs.ServerName == "" && serverName != p.defaultServerName()) || (cs.ServerName != "" && cs.ServerName != serverName) {
-		p.recordEvent("mismatched server name")
+	transcriptHandshake(conn, cs)
+	p.observeHandshake(be.metricsServerName(serverName), hsTime.Sub(startTime), cs.DidResume)
+	// MySQL connections are received on MySQLAddr, and their backend is
+	// chosen before the handshake, with or without SNI.
+	if (cs.ServerName == "" && serverName != p.defaultServerName() && be.Mode != ModeMySQL) || (cs.ServerName != "" && cs.ServerName != serverName) {
+		p.recordConnEvent(conn, "mismatched server name")
 		log.Printf("BAD [-] %s ➔ %q Mismatched server name", conn.RemoteAddr(), serverName)
 		return false
 	}
@@ -1187,37 +2045,44 @@ func (p *Proxy) authorizeTLSConnection(conn *tls.Conn) bool {
 	annotatedConn(conn).SetAnnotation(clientCertKey, clientCert)
 
 	// The check below is also done in VerifyConnection.
-	if be.ClientAuth != nil && be.ClientAuth.ACL != nil {
+	if be.ClientAuth != nil {
 		if err := be.authorize(clientCert); err != nil {
-			p.recordEvent(err.Error())
+			p.recordConnEvent(conn, err.Error())
+			p.reportFailure(conn.RemoteAddr())
 			log.Printf("BAD [-] %s ➔ %q Authorize(%q): %v", conn.RemoteAddr(), idnaToUnicode(serverName), certSummary(clientCert), err)
 			return false
 		}
 	}
+	if err := p.allowSubject(clientCert); err != nil {
+		log.Printf("BAD [-] %s ➔ %q [%s]: %v", conn.RemoteAddr(), idnaToUnicode(serverName), certSummary(clientCert), err)
+		return false
+	}
 	return true
 }
 
-func (p *Proxy) handleHTTPConnection(conn *tls.Conn) {
+func (p *Proxy) handleHTTPConnection(conn tlsConn) {
 	if !p.authorizeTLSConnection(conn) {
 		conn.Close()
 		return
 	}
 	serverName := connServerName(conn)
 	be := connBackend(conn)
-	if err := be.connLimit.Wait(p.ctx); err != nil {
-		p.recordEvent(err.Error())
+	if be.perRequestForwardLimit() {
+		annotatedConn(conn).SetAnnotation(requestFlagKey, true)
+	} else if err := be.waitForward(p.ctx); err != nil {
+		p.recordConnEvent(conn, err.Error())
 		log.Printf("ERR [-] %s ➔  %q Wait: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
 		conn.Close()
 		return
 	}
-	if be.Mode != ModeConsole && be.Mode != ModeLocal && be.Mode != ModeHTTP && be.Mode != ModeHTTPS {
-		p.recordEvent("wrong mode")
-		log.Printf("ERR [-] %s ➔  %q Mode is not [CONSOLE, LOCAL, HTTP, HTTPS]", conn.RemoteAddr(), idnaToUnicode(serverName))
+	if be.Mode != ModeConsole && be.Mode != ModeLocal && be.Mode != ModeHTTP && be.Mode != ModeHTTPS && be.Mode != ModeWebSocket && be.Mode != ModeRedirect && be.Mode != ModeProxy {
+		p.recordConnEvent(conn, "wrong mode")
+		log.Printf("ERR [-] %s ➔  %q Mode is not [CONSOLE, LOCAL, HTTP, HTTPS, WEBSOCKET, REDIRECT, PROXY]", conn.RemoteAddr(), idnaToUnicode(serverName))
 		conn.Close()
 		return
 	}
 	if be.httpConnChan == nil {
-		p.recordEvent("conn chan nil")
+		p.recordConnEvent(conn, "conn chan nil")
 		log.Printf("ERR [-] %s ➔  %q conn channel is nil", conn.RemoteAddr(), idnaToUnicode(serverName))
 		conn.Close()
 		return
@@ -1227,14 +2092,14 @@ func (p *Proxy) handleHTTPConnection(conn *tls.Conn) {
 	be.httpConnChan <- conn
 }
 
-func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
+func (p *Proxy) handleTLSConnection(extConn tlsConn) {
 	if !p.authorizeTLSConnection(extConn) {
 		return
 	}
 	serverName := connServerName(extConn)
 	be := connBackend(extConn)
-	if err := be.connLimit.Wait(p.ctx); err != nil {
-		p.recordEvent(err.Error())
+	if err := be.waitForward(p.ctx); err != nil {
+		p.recordConnEvent(extConn, err.Error())
 		log.Printf("ERR [-] %s ➔  %q Wait: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
 		return
 	}
@@ -1244,15 +2109,16 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 		protos = []string{proto}
 	}
 
-	intConn, err := be.dial(context.WithValue(p.ctx, connCtxKey, extConn), protos...)
+	intConn, err := be.dialRetry(context.WithValue(p.ctx, connCtxKey, extConn), protos...)
 	if err != nil {
-		p.recordEvent("dial error")
+		p.recordConnEvent(extConn, "dial error")
 		log.Printf("ERR [-] %s ➔  %q Dial: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
 		return
 	}
 	defer intConn.Close()
 	setKeepAlive(intConn)
 	annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
+	p.observeDial(extConn, be)
 
 	desc := formatConnDesc(annotatedConn(extConn))
 	log.Printf("CON %s", desc)
@@ -1266,7 +2132,7 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
 	totalTime := time.Since(startTime).Truncate(time.Millisecond)
 
-	log.Printf("END %s; HS:%s Dial:%s Dur:%s Recv:%d Sent:%d", desc,
+	logConnEnd(extConn, "END %s; HS:%s Dial:%s Dur:%s Recv:%d Sent:%d", desc,
 		hsTime.Sub(startTime).Truncate(time.Millisecond),
 		dialTime.Sub(hsTime).Truncate(time.Millisecond), totalTime,
 		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
@@ -1275,16 +2141,16 @@ func (p *Proxy) handleTLSConnection(extConn *tls.Conn) {
 func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) {
 	serverName := connServerName(extConn)
 	be := connBackend(extConn)
-	if err := be.connLimit.Wait(p.ctx); err != nil {
-		p.recordEvent(err.Error())
+	if err := be.waitForward(p.ctx); err != nil {
+		p.recordConnEvent(extConn, err.Error())
 		log.Printf("ERR [-] %s ➔  %q Wait: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
 		sendInternalError(extConn)
 		return
 	}
 
-	intConn, err := be.dial(context.WithValue(p.ctx, connCtxKey, extConn))
+	intConn, err := be.dialRetry(context.WithValue(p.ctx, connCtxKey, extConn))
 	if err != nil {
-		p.recordEvent("dial error")
+		p.recordConnEvent(extConn, "dial error")
 		log.Printf("ERR [-] %s ➔  %q Dial: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
 		sendInternalError(extConn)
 		return
@@ -1293,6 +2159,7 @@ func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) {
 	setKeepAlive(intConn)
 
 	annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
+	p.observeDial(extConn, be)
 
 	desc := formatConnDesc(annotatedConn(extConn))
 	log.Printf("CON %s", desc)
@@ -1305,7 +2172,7 @@ func (p *Proxy) handleTLSPassthroughConnection(extConn net.Conn) {
 	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
 	totalTime := time.Since(startTime).Truncate(time.Millisecond)
 
-	log.Printf("END %s; Dial:%s Dur:%s Recv:%d Sent:%d", desc,
+	logConnEnd(extConn, "END %s; Dial:%s Dur:%s Recv:%d Sent:%d", desc,
 		dialTime.Sub(startTime).Truncate(time.Millisecond), totalTime,
 		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
 }
@@ -1329,6 +2196,29 @@ func (p *Proxy) backend(serverName string, protos ...string) (*Backend, error) {
 	if !ok {
 		be, ok = p.backends[beKey{serverName: serverName}]
 	}
+	if wildcard := wildcardServerName(serverName); !ok && wildcard != "" {
+		for _, proto := range protos {
+			if be, ok = p.backends[beKey{serverName: wildcard, proto: proto}]; ok {
+				break
+			}
+		}
+		if !ok {
+			be, ok = p.backends[beKey{serverName: wildcard}]
+		}
+	}
+	if !ok {
+		be, ok = p.backendByRegexp(serverName, protos, false)
+	}
+	if !ok {
+		for _, proto := range protos {
+			if be, ok = p.backends[beKey{serverName: CatchAllServerName, proto: proto}]; ok {
+				break
+			}
+		}
+		if !ok {
+			be, ok = p.backends[beKey{serverName: CatchAllServerName}]
+		}
+	}
 	if !ok {
 		return nil, errors.New("unexpected SNI")
 	}
@@ -1337,9 +2227,39 @@ func (p *Proxy) backend(serverName string, protos ...string) (*Backend, error) {
 	if be.state.shutdown {
 		return nil, errors.New("backend shutdown")
 	}
+	if be.isDrained(p.drained) {
+		return nil, errors.New("backend drained")
+	}
 	return be, nil
 }
 
+// backendByRegexp returns the first backend with a ServerNameRegexps that
+// matches serverName. Backends that accept one of protos are preferred. When
+// requireProto is true, only those backends are returned.
+// p.mu must be held.
+func (p *Proxy) backendByRegexp(serverName string, protos []string, requireProto bool) (*Backend, bool) {
+	var first *Backend
+	for _, be := range p.cfg.Backends {
+		if be.Mode == ModeQUICPassthrough || !be.matchServerNameRegexp(serverName) {
+			continue
+		}
+		if be.ALPNProtos != nil {
+			for _, proto := range protos {
+				if slices.Contains(*be.ALPNProtos, proto) {
+					return be, true
+				}
+			}
+		}
+		if first == nil {
+			first = be
+		}
+	}
+	if first == nil || requireProto {
+		return nil, false
+	}
+	return first, true
+}
+
 func formatReqDesc(req *http.Request) string {
 	var ids []string
 	if claims := claimsFromCtx(req.Context()); claims != nil {
@@ -1411,14 +2331,9 @@ func setKeepAlive(conn net.Conn) {
 }
 
 func loadCerts(p *x509.CertPool, s string) error {
-	var b []byte
-	if len(s) > 0 && s[0] == '/' {
-		var err error
-		if b, err = os.ReadFile(s); err != nil {
-			return err
-		}
-	} else {
-		b = []byte(s)
+	b, err := fileOrPEM(s)
+	if err != nil {
+		return err
 	}
 	if !p.AppendCertsFromPEM(b) {
 		return errors.New("invalid certs")
@@ -53,6 +53,7 @@ import (
 	"github.com/c2FmZQ/tlsproxy/certmanager"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/pki"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/sessionticket"
 	"github.com/c2FmZQ/tlsproxy/proxy/internal/tokenmanager"
 )
 
@@ -460,6 +461,19 @@ func TestAuthnAuthz(t *testing.T) {
 					},
 				},
 			},
+			{
+				ServerNames: []string{
+					"optional.example.com",
+				},
+				Mode: "CONSOLE",
+				ClientAuth: &ClientAuth{
+					Mode:    ClientAuthRequest,
+					RootCAs: []string{intCA.RootCAPEM()},
+					ACL: &[]string{
+						"CN=client1",
+					},
+				},
+			},
 			{
 				ServerNames: []string{
 					"pkitest.example.com",
@@ -533,6 +547,9 @@ func TestAuthnAuthz(t *testing.T) {
 		{desc: "ACL, client2", host: "acl.example.com", certName: "client2", want: "HTTP/2.0 200 OK"},
 		{desc: "ACL, wrong cert", host: "acl.example.com", certName: "foo", expError: true},
 		{desc: "PKI client", host: "pkitest.example.com", certName: "pki", want: "HTTP/2.0 200 OK"},
+		{desc: "optional, no cert", host: "optional.example.com", want: "HTTP/2.0 200 OK"},
+		{desc: "optional, client1", host: "optional.example.com", certName: "client1", want: "HTTP/2.0 200 OK"},
+		{desc: "optional, wrong cert", host: "optional.example.com", certName: "foo", expError: true},
 		{desc: "Check console1", host: "acl.example.com", certName: "client1", want: "allow X509 [SUBJECT:CN=client1;DNS:client1] to acl.example.com"},
 		{desc: "Check console2", host: "acl.example.com", certName: "client1", want: "allow X509 [SUBJECT:CN=client2;DNS:client2] to acl.example.com"},
 		{desc: "Check console3", host: "acl.example.com", certName: "client1", want: "allow X509 [SUBJECT:CN=foo;DNS:foo] to noacl.example.com"},
@@ -948,7 +965,7 @@ func TestProxyTPM(t *testing.T) {
 	}
 
 	mkFile := filepath.Join(dir, "mk")
-	if err := proxy.mk.Save([]byte("foo"), mkFile); err != nil {
+	if err := proxy.mk.current().Save([]byte("foo"), mkFile); err != nil {
 		t.Fatalf("mk.Save: %v", err)
 	}
 	if _, err := crypto.ReadMasterKey([]byte("foo"), mkFile); err == nil {
@@ -1069,17 +1086,24 @@ func newTestProxy(cfg *Config, cm *certmanager.CertManager) *Proxy {
 	if err != nil {
 		panic(err)
 	}
-	store := storage.New(filepath.Join(cfg.CacheDir, "test"), mk)
+	rk := newRotatingKey(mk)
+	store := storage.New(filepath.Join(cfg.CacheDir, "test"), rk)
 	tm, err := tokenmanager.New(store, tpmSim)
 	if err != nil {
 		panic(err)
 	}
+	tk, err := sessionticket.New(store)
+	if err != nil {
+		panic(err)
+	}
 	p := &Proxy{
 		certManager:  cm,
-		mk:           mk,
+		mk:           rk,
+		mkOpts:       mkOpts,
 		tpm:          tpmSim,
 		store:        store,
 		tokenManager: tm,
+		ticketKeys:   tk,
 		ocspCache:    ocspcache.New(store),
 		bwLimits:     make(map[string]*bwLimit),
 		inConns:      newConnTracker(),
@@ -1399,3 +1423,392 @@ func (c *pkiCert) TLSConfig() *tls.Config {
 		Certificates: []tls.Certificate{c.cert},
 	}
 }
+
+func TestWildcardBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com", "www.example.com"},
+					Addresses:   []string{"192.168.0.1:80"},
+				},
+				{
+					ServerNames: []string{"*.example.com"},
+					Addresses:   []string{"192.168.0.2:80"},
+				},
+				{
+					ServerNameRegexps: []string{`.*\.example\.com`},
+					Addresses:         []string{"192.168.0.3:80"},
+				},
+				{
+					ServerNameRegexps: []string{`[a-z]+-[0-9]+\.example\.org`},
+					Addresses:         []string{"192.168.0.4:80"},
+					ALPNProtos:        &[]string{"http/1.1"},
+				},
+				{
+					ServerNameRegexps: []string{`[a-z]+-[0-9]+\.example\.org`},
+					Addresses:         []string{"192.168.0.5:80"},
+					ALPNProtos:        &[]string{"h2"},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	for _, tc := range []struct {
+		serverName string
+		want       string
+	}{
+		{"example.com", "192.168.0.1:80"},
+		{"www.example.com", "192.168.0.1:80"},
+		{"foo.example.com", "192.168.0.2:80"},
+		{"a.b.example.com", "192.168.0.3:80"},
+		{"example.com.example.net", ""},
+		{"foo-123.example.org", "192.168.0.5:80"},
+		{"foo.example.org", ""},
+		{"example.org", ""},
+	} {
+		be, err := proxy.backend(tc.serverName, "h2")
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("backend(%q) = %v, want error", tc.serverName, be.Addresses)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("backend(%q): %v", tc.serverName, err)
+			continue
+		}
+		if got := be.Addresses[0]; got != tc.want {
+			t.Errorf("backend(%q) = %s, want %s", tc.serverName, got, tc.want)
+		}
+		if !be.hasServerName(tc.serverName) {
+			t.Errorf("hasServerName(%q) = false", tc.serverName)
+		}
+	}
+	// Without a matching proto, the first matching regexp is used.
+	be, err := proxy.backend("foo-123.example.org", "foo")
+	if err != nil {
+		t.Fatalf("backend(foo-123.example.org): %v", err)
+	}
+	if got, want := be.Addresses[0], "192.168.0.4:80"; got != want {
+		t.Errorf("backend(foo-123.example.org) = %s, want %s", got, want)
+	}
+}
+
+func TestCatchAllBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	defaultCA, err := certmanager.New("default-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertFiles(t, defaultCA, "default.example.com", certFile, keyFile)
+
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "catch-all", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+				Mode:        "TCP",
+			},
+			{
+				ServerNames: []string{"*"},
+				Addresses:   []string{be2.listener.Addr().String()},
+				Mode:        "TCP",
+			},
+		},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("cfg.Check() should fail without CertFile")
+	} else if !strings.Contains(err.Error(), "CertFile") {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	cfg.Backends[1].CertFile = certFile
+	cfg.Backends[1].KeyFile = keyFile
+
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	if got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil || got != "Hello from backend1\n" {
+		t.Errorf("example.com: got %q, %v", got, err)
+	}
+
+	for _, name := range []string{"unknown.example.net", ""} {
+		conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("[%q] tls.Dial: %v", name, err)
+		}
+		if got, want := conn.ConnectionState().PeerCertificates[0].Subject.CommonName, "default.example.com"; got != want {
+			t.Errorf("[%q] certificate = %q, want %q", name, got, want)
+		}
+		b, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("[%q] ReadAll: %v", name, err)
+		}
+		if got, want := string(b), "Hello from catch-all\n"; got != want {
+			t.Errorf("[%q] got %q, want %q", name, got, want)
+		}
+	}
+
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	if proxy.metrics[CatchAllServerName] == nil {
+		t.Errorf("metrics[%q] is missing", CatchAllServerName)
+	}
+	if proxy.metrics["unknown.example.net"] != nil {
+		t.Error("metrics[unknown.example.net] should not exist")
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertFiles(t, extCA, "rejected.example.com", certFile, keyFile)
+
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "rejected", nil)
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+				Mode:        "TCP",
+			},
+			{
+				ServerNames: []string{"private.example.com"},
+				Addresses:   []string{be1.listener.Addr().String()},
+				Mode:        "TCP",
+				AllowIPs:    &[]string{"10.0.0.0/8"},
+			},
+			{
+				ServerNames: []string{"rejected.example.com"},
+				Addresses:   []string{be2.listener.Addr().String()},
+				Mode:        "TCP",
+			},
+		},
+		RejectPolicy: &ConfigRejectPolicy{
+			Action:     "route",
+			ServerName: "rejected.example.com",
+		},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("cfg.Check() should fail without CertFile")
+	} else if !strings.Contains(err.Error(), "CertFile") {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	cfg.Backends[2].CertFile = certFile
+	cfg.Backends[2].KeyFile = keyFile
+
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	dial := func(name string) (string, error) {
+		conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		b, err := io.ReadAll(conn)
+		return string(b), err
+	}
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"example.com", "Hello from backend1\n"},
+		{"unknown.example.net", "Hello from rejected\n"},
+		{"private.example.com", "Hello from rejected\n"},
+	} {
+		if got, err := dial(tc.name); err != nil || got != tc.want {
+			t.Errorf("[%s] got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+
+	cfg = cfg.clone()
+	cfg.RejectPolicy = &ConfigRejectPolicy{Action: "close"}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	for _, name := range []string{"unknown.example.net", "private.example.com"} {
+		if _, err := dial(name); err == nil || strings.Contains(err.Error(), "unrecognized name") {
+			t.Errorf("[%s] got %v, want connection closed without alert", name, err)
+		}
+	}
+
+	cfg = cfg.clone()
+	cfg.RejectPolicy = &ConfigRejectPolicy{Action: "tarpit", TarpitDelay: 500 * time.Millisecond}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	start := time.Now()
+	if _, err := dial("unknown.example.net"); err == nil {
+		t.Error("tarpit: dial should fail")
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("tarpit: connection closed after %s", d)
+	}
+
+	cfg = cfg.clone()
+	cfg.RejectPolicy = nil
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if _, err := dial("unknown.example.net"); err == nil || !strings.Contains(err.Error(), "unrecognized name") {
+		t.Errorf("alert: got %v, want unrecognized name", err)
+	}
+}
+
+func TestDrainOnReconfigure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// An echo server that keeps its connections open.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(conn)
+		}
+	}()
+
+	drainTimeout := 500 * time.Millisecond
+	cacheDir := t.TempDir()
+	newCfg := func(backends ...*Backend) *Config {
+		return &Config{
+			HTTPAddr:     "localhost:0",
+			TLSAddr:      "localhost:0",
+			CacheDir:     cacheDir,
+			MaxOpen:      100,
+			DrainTimeout: &drainTimeout,
+			Backends:     backends,
+		}
+	}
+	proxy := newTestProxy(newCfg(&Backend{
+		ServerNames: []string{"echo.example.com"},
+		Addresses:   []string{l.Addr().String()},
+	}), extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	c, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+		ServerName: "echo.example.com",
+		RootCAs:    extCA.RootCACertPool(),
+	})
+	if err != nil {
+		t.Fatalf("tls.Dial: %v", err)
+	}
+	defer c.Close()
+	echo := func(msg string) error {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return err
+		}
+		if got := string(buf); got != msg {
+			return fmt.Errorf("got %q, want %q", got, msg)
+		}
+		return nil
+	}
+	if err := echo("hello"); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+
+	// Remove the backend. The existing connection should keep working
+	// until the drain timeout.
+	cfg := newCfg(&Backend{
+		ServerNames: []string{"other.example.com"},
+		Addresses:   []string{l.Addr().String()},
+	})
+	cfg.HTTPAddr = proxy.cfg.HTTPAddr
+	cfg.TLSAddr = proxy.cfg.TLSAddr
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	start := time.Now()
+	if err := echo("still here"); err != nil {
+		t.Fatalf("echo after Reconfigure: %v", err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if d := time.Since(start); d < drainTimeout/2 {
+		t.Errorf("connection closed after %s, want ~%s", d, drainTimeout)
+	}
+	proxy.Stop()
+}
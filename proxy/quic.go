@@ -37,6 +37,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -75,18 +76,37 @@ func (p *Proxy) startQUIC(ctx context.Context) error {
 	tc.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
 		p.mu.RLock()
 		defer p.mu.RUnlock()
+		// QUIC connections are routed like TLS connections, with
+		// exact server names taking precedence over wildcards,
+		// wildcards taking precedence over regular expressions, and
+		// regular expressions taking precedence over the catch-all.
+		for _, sn := range []string{hello.ServerName, wildcardServerName(hello.ServerName)} {
+			for _, proto := range hello.SupportedProtos {
+				if be, ok := p.backends[beKey{serverName: sn, proto: proto}]; ok && be.Mode != ModeTLSPassthrough {
+					return be.tlsConfigQUIC, nil
+				}
+			}
+		}
+		if be, ok := p.backendByRegexp(hello.ServerName, hello.SupportedProtos, true); ok && be.Mode != ModeTLSPassthrough {
+			return be.tlsConfigQUIC, nil
+		}
 		for _, proto := range hello.SupportedProtos {
-			if be, ok := p.backends[beKey{serverName: hello.ServerName, proto: proto}]; ok && be.Mode != ModeTLSPassthrough {
+			if be, ok := p.backends[beKey{serverName: CatchAllServerName, proto: proto}]; ok && be.Mode != ModeTLSPassthrough {
 				return be.tlsConfigQUIC, nil
 			}
 		}
 		log.Printf("ERR QUIC connection %s %s", hello.ServerName, hello.SupportedProtos)
 		return nil, tlsUnrecognizedName
 	}
-	qt, err := netw.NewQUIC(p.cfg.TLSAddr, statelessResetKey)
+	addr := p.cfg.QUICAddr
+	if addr == "" {
+		addr = p.cfg.TLSAddr
+	}
+	pc, err := p.listenPacket(socketNameQUIC, addr)
 	if err != nil {
 		return err
 	}
+	qt := netw.NewQUIC(pc, statelessResetKey)
 	quicListener, err := qt.Listen(tc)
 	if err != nil {
 		return err
@@ -130,8 +150,11 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 	numOpen := p.inConns.add(qc)
 	qc.OnClose(func() {
 		p.inConns.remove(qc)
+		p.endTranscript(qc)
+		releaseConnectionQuota(qc)
+		p.exportFlow(qc)
 		startTime := qc.Annotation(startTimeKey, time.Time{}).(time.Time)
-		log.Printf("END %s; Dur:%s Recv:%d Sent:%d",
+		logConnEnd(qc, "END %s; Dur:%s Recv:%d Sent:%d",
 			formatConnDesc(qc), time.Since(startTime).Truncate(time.Millisecond),
 			qc.BytesReceived(), qc.BytesSent())
 		if be := connBackend(qc); be != nil {
@@ -141,7 +164,9 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 	})
 	qc.SetAnnotation(startTimeKey, time.Now())
 
+	p.startTranscript(qc, "QUIC")
 	cs := qc.TLSConnectionState()
+	transcriptHandshake(qc, cs)
 	qc.SetAnnotation(serverNameKey, cs.ServerName)
 	qc.SetAnnotation(protoKey, cs.NegotiatedProtocol)
 
@@ -165,7 +190,7 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 	}
 	be.incInFlight(1)
 	qc.SetAnnotation(backendKey, be)
-	p.setCounters(qc, cs.ServerName)
+	p.setCounters(qc, be.metricsServerName(cs.ServerName))
 
 	if numOpen >= p.cfg.MaxOpen {
 		p.recordEvent("too many open connections")
@@ -177,15 +202,39 @@ func (p *Proxy) handleQUICConnection(qc *netw.QUICConn) {
 		qc.SetLimiters(l.ingress, l.egress)
 	}
 
+	if l, _ := p.threatFeed(qc.RemoteAddr()); l != nil {
+		log.Printf("BAD [%s] %s:%s ➔ %q: in threat feed %q", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), l.cfg.Name)
+		qc.CloseWithError(quicAccessDenied, "access denied")
+		return
+	}
+	if err := p.allowIP(qc.RemoteAddr()); err != nil {
+		log.Printf("BAD [%s] %s:%s ➔ %q: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
+		qc.CloseWithError(quicAccessDenied, err.Error())
+		return
+	}
+	if err := p.allowSubject(clientCert); err != nil {
+		log.Printf("BAD [%s] %s:%s ➔ %q: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
+		qc.CloseWithError(quicAccessDenied, err.Error())
+		return
+	}
+
 	if err := be.checkIP(qc.RemoteAddr()); err != nil {
 		p.recordEvent(idnaToUnicode(cs.ServerName) + " CheckIP " + err.Error())
+		p.auditIPDenied(qc.RemoteAddr(), idnaToUnicode(cs.ServerName))
 		log.Printf("BAD [%s] %s:%s ➔ %q CheckIP: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
 		qc.CloseWithError(quicAccessDenied, "access denied")
 		return
 	}
+	if err := p.checkConnectionQuota(ctx, qc, be); err != nil {
+		log.Printf("ERR [%s] %s:%s ➔ %q: %v", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
+		qc.CloseWithError(quicTooBusy, "too busy")
+		return
+	}
 
 	log.Printf("QUC [%s] %s:%s ➔ %s|%s:%s", sum, qc.RemoteAddr().Network(), qc.RemoteAddr(), idnaToUnicode(cs.ServerName), be.Mode, cs.NegotiatedProtocol)
-	if err := be.connLimit.Wait(ctx); err != nil {
+	if be.perRequestForwardLimit() {
+		qc.SetAnnotation(requestFlagKey, true)
+	} else if err := be.waitForward(ctx); err != nil {
 		if !errors.Is(err, context.Canceled) {
 			p.recordEvent(err.Error())
 			log.Printf("ERR [%s] %s ➔  %q Wait: %v", sum, qc.RemoteAddr(), idnaToUnicode(cs.ServerName), err)
@@ -369,13 +418,13 @@ func (p *Proxy) handleQUICTCPStream(ctx context.Context, be *Backend, conn *netw
 	conn.SetAnnotation(startTimeKey, time.Now())
 
 	switch be.Mode {
-	case ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS:
+	case ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS, ModeRedirect:
 		log.Printf("STR %s", formatConnDesc(conn))
 		closeConnNeeded = false
 		be.httpConnChan <- conn
 
 	case ModeTCP, ModeTLS:
-		intConn, err := be.dial(ctx, connProto(conn))
+		intConn, err := be.dialRetry(ctx, connProto(conn))
 		if err != nil {
 			p.recordEvent("dial error")
 			log.Printf("ERR [-] %s:%s ➔  %q Dial: %v", conn.RemoteAddr().Network(), conn.RemoteAddr(), serverName, err)
@@ -385,6 +434,7 @@ func (p *Proxy) handleQUICTCPStream(ctx context.Context, be *Backend, conn *netw
 		setKeepAlive(intConn)
 
 		conn.SetAnnotation(dialDoneKey, time.Now())
+		p.observeDial(conn, be)
 		if cc, ok := conn.Conn.(interface {
 			SetBridgeAddr(string)
 		}); ok {
@@ -400,7 +450,7 @@ func (p *Proxy) handleQUICTCPStream(ctx context.Context, be *Backend, conn *netw
 		dialTime := conn.Annotation(dialDoneKey, time.Time{}).(time.Time)
 		totalTime := time.Since(startTime).Truncate(time.Millisecond)
 
-		log.Printf("END %s; Dial:%s Dur:%s Recv:%d Sent:%d", formatConnDesc(conn),
+		logConnEnd(conn, "END %s; Dial:%s Dur:%s Recv:%d Sent:%d", formatConnDesc(conn),
 			dialTime.Sub(startTime).Truncate(time.Millisecond), totalTime,
 			conn.BytesReceived(), conn.BytesSent())
 
@@ -459,7 +509,7 @@ func (be *Backend) handleQUICQUICStream(ctx context.Context, dest *netw.QUICConn
 	dialTime := conn.Annotation(dialDoneKey, time.Time{}).(time.Time)
 	totalTime := time.Since(startTime).Truncate(time.Millisecond)
 
-	log.Printf("END %s; Dial:%s Dur:%s Recv:%d Sent:%d", desc,
+	logConnEnd(conn, "END %s; Dial:%s Dur:%s Recv:%d Sent:%d", desc,
 		dialTime.Sub(startTime).Truncate(time.Millisecond), totalTime,
 		conn.BytesReceived(), conn.BytesSent())
 }
@@ -469,7 +519,7 @@ func (be *Backend) dialQUIC(ctx context.Context, addr string, tc *tls.Config) (*
 	if !ok {
 		return nil, errors.New("invalid QUIC transport")
 	}
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	udpAddr, err := be.resolveUDPAddr(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -498,7 +548,7 @@ func (be *Backend) dialQUICStream(ctx context.Context, addr string, tc *tls.Conf
 
 func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUICConn, error) {
 	var (
-		addresses          = be.Addresses
+		addresses          = be.addresses()
 		timeout            = be.ForwardTimeout
 		insecureSkipVerify = be.InsecureSkipVerify
 		serverName         = be.ForwardServerName
@@ -513,16 +563,23 @@ func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUI
 		serverName = po.ForwardServerName
 		rootCAs = po.forwardRootCAs
 		next = &be.state.oNext[id]
+	} else if g, _ := be.addressGroup(ctx); g != nil {
+		addresses = g.addresses
+		next = &be.state.gNext[g.index]
 	}
 
 	if len(addresses) == 0 {
 		return nil, errors.New("no backend addresses")
 	}
+	protos := []string{proto}
+	if be.ForwardALPNProtos != nil && be.Mode == ModeQUIC {
+		protos = *be.ForwardALPNProtos
+	}
 
 	tc := &tls.Config{
 		InsecureSkipVerify:   insecureSkipVerify,
 		ServerName:           serverName,
-		NextProtos:           []string{proto},
+		NextProtos:           protos,
 		RootCAs:              rootCAs,
 		GetClientCertificate: be.getClientCert(ctx),
 		VerifyConnection: func(cs tls.ConnectionState) error {
@@ -544,40 +601,40 @@ func (be *Backend) dialQUICBackend(ctx context.Context, proto string) (*netw.QUI
 		},
 	}
 
-	var max int
-	for {
-		be.state.mu.Lock()
-		sz := len(addresses)
-		if max == 0 {
-			max = sz
-		}
-		addr := addresses[*next]
-		*next = (*next + 1) % sz
-		be.state.mu.Unlock()
+	be.state.mu.Lock()
+	addrs := be.orderAddresses(ctx, addresses, next)
+	be.state.mu.Unlock()
 
-		ctx, cancel := context.WithTimeout(ctx, timeout)
-		conn, err := be.dialQUIC(ctx, addr, tc)
+	for i, addr := range addrs {
+		dctx, cancel := context.WithTimeout(ctx, timeout)
+		conn, err := be.dialQUIC(dctx, addr, tc)
 		cancel()
+		be.reportDial(ctx, addr, err)
 		if err != nil {
-			if max--; max > 0 {
+			if i < len(addrs)-1 {
 				log.Printf("ERR dialQUIC %q: %v", addr, err)
 				continue
 			}
 			return nil, err
 		}
+		if i > 0 {
+			log.Printf("INF dialQUIC %s: failed over to %q after %d attempt(s)", be.displayName(), addr, i+1)
+		}
 		conn.OnClose(func() {
 			be.outConns.remove(conn)
 		})
 		be.outConns.add(conn)
 		conn.SetAnnotation(startTimeKey, time.Now())
 		conn.SetAnnotation(modeKey, be.Mode)
-		conn.SetAnnotation(protoKey, proto)
+		conn.SetAnnotation(protoKey, strings.Join(protos, ","))
 		if cc, ok := ctx.Value(connCtxKey).(net.Conn); ok {
 			conn.SetAnnotation(serverNameKey, connServerName(cc))
 			annotatedConn(cc).SetAnnotation(internalConnKey, conn)
+			annotatedConn(cc).SetAnnotation(dialAttemptsKey, i+1)
 		}
 		return conn, nil
 	}
+	return nil, errors.New("no backend addresses")
 }
 
 func (be *Backend) http3Transport() http.RoundTripper {
@@ -593,9 +650,13 @@ func (be *Backend) http3Transport() http.RoundTripper {
 	}
 }
 
-func http3Server(handler http.Handler) *http3.Server {
+func http3Server(handler http.Handler, limits *HTTPLimits) *http3.Server {
+	if limits == nil {
+		limits = defaultHTTPLimits
+	}
 	return &http3.Server{
-		Handler: handler,
+		Handler:        handler,
+		MaxHeaderBytes: limits.MaxHeaderBytes,
 		ConnContext: func(ctx context.Context, c quic.Connection) context.Context {
 			if _, ok := c.(*netw.QUICConn); !ok {
 				panic(fmt.Sprintf("http3.Server.ConnContext called with: %#v", c))
@@ -605,3 +666,11 @@ func http3Server(handler http.Handler) *http3.Server {
 		EnableDatagrams: false,
 	}
 }
+
+// http3DatagramServer returns an HTTP/3 server with HTTP datagrams (RFC 9297)
+// enabled, for CONNECT-UDP.
+func http3DatagramServer(handler http.Handler, limits *HTTPLimits) *http3.Server {
+	s := http3Server(handler, limits)
+	s.EnableDatagrams = true
+	return s
+}
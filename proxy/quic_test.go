@@ -167,6 +167,155 @@ func TestQUICConnections(t *testing.T) {
 	}
 }
 
+func TestQUICAddr(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// Find an available UDP port.
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	quicAddr := uc.LocalAddr().String()
+	_, quicPort, _ := net.SplitHostPort(quicAddr)
+	uc.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		QUICAddr: quicAddr,
+		CacheDir: t.TempDir(),
+		MaxOpen:  1000,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{
+					"*.example.com",
+				},
+				Mode:         "LOCAL",
+				DocumentRoot: ".",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	if got, want := proxy.quicTransport.(*netw.QUICTransport).Addr().String(), quicAddr; got != want {
+		t.Errorf("QUIC addr = %q, want %q", got, want)
+	}
+	got, err := h3Get("www.example.com", quicAddr, "/proxy.go", extCA)
+	if err != nil {
+		t.Fatalf("h3Get: %v", err)
+	}
+	if want := "HTTP/3.0 200 OK"; !strings.HasPrefix(got, want) {
+		t.Errorf("h3Get() = %q, want %q", got, want)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: "www.example.com",
+					RootCAs:    extCA.RootCACertPool(),
+					NextProtos: []string{"h2"},
+				})
+			},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get("https://www.example.com/proxy.go")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if got, want := resp.Header.Get("Alt-Svc"), `h3=":`+quicPort+`"; ma=2592000;`; got != want {
+		t.Errorf("Alt-Svc = %q, want %q", got, want)
+	}
+
+	// The QUIC listener isn't moved to a new address on reload.
+	newCfg := cfg.clone()
+	newCfg.QUICAddr = "127.0.0.1:1"
+	if err := proxy.Reconfigure(newCfg); err == nil {
+		t.Error("Reconfigure with a new QUICAddr didn't fail")
+	}
+}
+
+func TestQUICPassthrough(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newQUICServer(t, ctx, "backend1", []string{"imap"}, intCA)
+	be2 := newQUICServer(t, ctx, "backend2", []string{"imap"}, intCA)
+
+	cfg := &Config{
+		HTTPAddr:            "localhost:0",
+		TLSAddr:             "localhost:0",
+		QUICPassthroughAddr: "localhost:0",
+		CacheDir:            t.TempDir(),
+		MaxOpen:             1000,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "QUICPASSTHROUGH",
+				Addresses:   []string{be1.listener.Addr().String()},
+			},
+			{
+				ServerNames: []string{"*.example.com"},
+				Mode:        "QUICPASSTHROUGH",
+				Addresses:   []string{be2.listener.Addr().String()},
+			},
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "LOCAL",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.quicPassthrough.pc.LocalAddr().String()
+
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "Hello from backend1\n"},
+		{"foo.example.com", "Hello from backend2\n"},
+	} {
+		// The backend's certificate is from the internal CA.
+		got, err := quicGet(tc.name, addr, "Hello!\n", intCA, []string{"imap"})
+		if err != nil {
+			t.Fatalf("quicGet(%q): %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("quicGet(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+	proxy.eventsmu.Lock()
+	n := proxy.events["quic passthrough connection"]
+	proxy.eventsmu.Unlock()
+	if n != 2 {
+		t.Errorf("quic passthrough connections = %d, want 2", n)
+	}
+}
+
 func TestQUICMultiStream(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -0,0 +1,330 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/counter"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/quicinitial"
+)
+
+const (
+	// quicPassthroughIdleTimeout is how long a session is kept when no
+	// packets are received in either direction.
+	quicPassthroughIdleTimeout = 2 * time.Minute
+	// quicPassthroughHelloTimeout is how long to wait for the client's
+	// Initial packets to contain the whole ClientHello.
+	quicPassthroughHelloTimeout = 10 * time.Second
+	// maxPendingQUICPackets is the number of packets that are buffered
+	// while waiting for the ClientHello.
+	maxPendingQUICPackets = 16
+)
+
+// quicPassthrough receives QUIC connections and forwards the UDP datagrams to
+// QUICPASSTHROUGH backends, without decrypting them. The backend is selected
+// with the server name from the ClientHello, which is extracted from the
+// client's Initial packets.
+type quicPassthrough struct {
+	p  *Proxy
+	pc net.PacketConn
+
+	mu       sync.Mutex
+	sessions map[string]*quicSession
+}
+
+// quicSession is a UDP flow between a client address and a backend address.
+type quicSession struct {
+	qp        *quicPassthrough
+	client    net.Addr
+	startTime time.Time
+
+	// The following fields are only used by the read loop.
+	asm     quicinitial.Assembler
+	pending [][]byte
+
+	routed     atomic.Bool
+	backend    net.Conn
+	serverName string
+	lastActive atomic.Int64
+	sent       *counter.Counter
+	received   *counter.Counter
+}
+
+func (p *Proxy) startQUICPassthrough(addr string) error {
+	pc, err := p.listenPacket(socketNameQUICPassthrough, addr)
+	if err != nil {
+		return err
+	}
+	qp := &quicPassthrough{
+		p:        p,
+		pc:       pc,
+		sessions: make(map[string]*quicSession),
+	}
+	p.quicPassthrough = qp
+	go qp.readLoop()
+	return nil
+}
+
+func (qp *quicPassthrough) close() {
+	qp.pc.Close()
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+	for _, s := range qp.sessions {
+		if s.routed.Load() {
+			s.backend.Close()
+		}
+	}
+}
+
+func (qp *quicPassthrough) readLoop() {
+	log.Printf("INF Accepting QUIC passthrough connections on %s %s", qp.pc.LocalAddr().Network(), qp.pc.LocalAddr())
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := qp.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Print("INF QUIC passthrough loop terminated")
+				return
+			}
+			log.Printf("ERR QUIC passthrough ReadFrom: %v", err)
+			continue
+		}
+		qp.handlePacket(addr, buf[:n])
+	}
+}
+
+func (qp *quicPassthrough) handlePacket(addr net.Addr, pkt []byte) {
+	key := addr.String()
+	qp.mu.Lock()
+	s := qp.sessions[key]
+	if s == nil {
+		if l, _ := qp.p.threatFeed(addr); l != nil {
+			qp.mu.Unlock()
+			return
+		}
+		if err := qp.p.allowIP(addr); err != nil {
+			qp.mu.Unlock()
+			return
+		}
+		s = &quicSession{
+			qp:        qp,
+			client:    addr,
+			startTime: time.Now(),
+		}
+		qp.sessions[key] = s
+		time.AfterFunc(quicPassthroughHelloTimeout, func() {
+			if !s.routed.Load() {
+				qp.remove(s)
+			}
+		})
+	}
+	qp.mu.Unlock()
+
+	if s.routed.Load() {
+		s.lastActive.Store(time.Now().UnixNano())
+		if _, err := s.backend.Write(pkt); err == nil {
+			s.received.Incr(int64(len(pkt)))
+		}
+		return
+	}
+	if err := s.route(slices.Clone(pkt)); err != nil {
+		qp.remove(s)
+		qp.p.reportFailure(addr)
+		log.Printf("BAD [-] %s:%s ➔ %q: %v", addr.Network(), addr, s.serverName, err)
+	}
+}
+
+func (qp *quicPassthrough) remove(s *quicSession) {
+	qp.mu.Lock()
+	defer qp.mu.Unlock()
+	if qp.sessions[s.client.String()] == s {
+		delete(qp.sessions, s.client.String())
+	}
+}
+
+func (s *quicSession) SetCounters(sent, received *counter.Counter) {
+	s.sent = sent
+	s.received = received
+}
+
+// route buffers the client's packets until the ClientHello is complete. Then,
+// it opens a UDP socket to the backend and sends it the buffered packets.
+func (s *quicSession) route(pkt []byte) error {
+	p := s.qp.p
+	if len(s.pending) >= maxPendingQUICPackets {
+		p.recordEvent("quic passthrough too many initial packets")
+		return errors.New("too many initial packets")
+	}
+	if err := s.asm.Add(pkt); err != nil {
+		p.recordEvent("quic passthrough invalid initial packet")
+		return err
+	}
+	s.pending = append(s.pending, pkt)
+	buf, ok := s.asm.ClientHello()
+	if !ok {
+		return nil
+	}
+	hello, err := parseClientHello(buf)
+	if err != nil {
+		p.recordEvent("invalid ClientHello")
+		return err
+	}
+	s.serverName = hello.ServerName
+	if s.serverName == "" {
+		p.recordEvent("no SNI")
+		s.serverName = p.defaultServerName()
+	}
+	be, err := p.quicPassthroughBackend(s.serverName)
+	if err != nil {
+		p.recordEvent(err.Error())
+		return err
+	}
+	if err := be.checkIP(s.client); err != nil {
+		p.recordEvent(idnaToUnicode(s.serverName) + " CheckIP " + err.Error())
+		return err
+	}
+	if err := be.checkFingerprint(hello.ja3(), hello.ja4('q')); err != nil {
+		p.recordEvent(idnaToUnicode(s.serverName) + " CheckFingerprint " + err.Error())
+		return err
+	}
+
+	addresses, next := be.addresses(), &be.state.next
+	if g, _ := be.addressGroup(context.Background()); g != nil {
+		addresses, next = g.addresses, &be.state.gNext[g.index]
+	}
+	if len(addresses) == 0 {
+		return errors.New("no backend addresses")
+	}
+	be.state.mu.Lock()
+	addrs := be.orderAddresses(context.Background(), addresses, next)
+	be.state.mu.Unlock()
+	for _, addr := range addrs {
+		target := addr
+		if be.dnsResolver != nil {
+			var ua *net.UDPAddr
+			if ua, err = be.resolveUDPAddr(context.Background(), addr); err != nil {
+				log.Printf("ERR dial %q: %v", addr, err)
+				continue
+			}
+			target = ua.String()
+		}
+		if s.backend, err = be.netDialer("udp", be.ForwardTimeout).Dial("udp", target); err == nil {
+			break
+		}
+		log.Printf("ERR dial %q: %v", addr, err)
+	}
+	if err != nil {
+		p.recordEvent("dial error")
+		return err
+	}
+	p.setCounters(s, s.serverName)
+	for _, pkt := range s.pending {
+		if _, err := s.backend.Write(pkt); err != nil {
+			s.backend.Close()
+			return err
+		}
+		s.received.Incr(int64(len(pkt)))
+	}
+	s.pending = nil
+	s.lastActive.Store(time.Now().UnixNano())
+	s.routed.Store(true)
+	p.recordEvent("quic passthrough connection")
+	log.Printf("CON [-] %s:%s ➔ %s|%s|%s:%s ➔ %s:%s", s.client.Network(), s.client, idnaToUnicode(s.serverName), be.Mode, s.backend.LocalAddr().Network(), s.backend.LocalAddr(), s.backend.RemoteAddr().Network(), s.backend.RemoteAddr())
+	go s.backendLoop()
+	return nil
+}
+
+// backendLoop forwards the packets from the backend to the client until the
+// session is idle for too long.
+func (s *quicSession) backendLoop() {
+	defer func() {
+		s.backend.Close()
+		s.qp.remove(s)
+		log.Printf("END [-] %s:%s ➔ %s; Dur:%s Recv:%d Sent:%d", s.client.Network(), s.client, idnaToUnicode(s.serverName), time.Since(s.startTime).Truncate(time.Millisecond), s.received.Value(), s.sent.Value())
+	}()
+	buf := make([]byte, 65536)
+	for {
+		s.backend.SetReadDeadline(time.Now().Add(quicPassthroughIdleTimeout))
+		n, err := s.backend.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(time.Unix(0, s.lastActive.Load())) < quicPassthroughIdleTimeout {
+				continue
+			}
+			return
+		}
+		s.lastActive.Store(time.Now().UnixNano())
+		if _, err := s.qp.pc.WriteTo(buf[:n], s.client); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		s.sent.Incr(int64(n))
+	}
+}
+
+// quicPassthroughBackend returns the QUICPASSTHROUGH backend for serverName.
+func (p *Proxy) quicPassthroughBackend(serverName string) (*Backend, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var found *Backend
+	for _, sn := range []string{serverName, wildcardServerName(serverName)} {
+		if sn == "" {
+			continue
+		}
+		for _, be := range p.cfg.Backends {
+			if be.Mode == ModeQUICPassthrough && slices.Contains(be.ServerNames, sn) {
+				found = be
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	if found == nil {
+		for _, be := range p.cfg.Backends {
+			if be.Mode == ModeQUICPassthrough && be.matchServerNameRegexp(serverName) {
+				found = be
+				break
+			}
+		}
+	}
+	if found == nil {
+		return nil, errors.New("unexpected SNI")
+	}
+	if found.isDrained(p.drained) {
+		return nil, errors.New("backend drained")
+	}
+	return found, nil
+}
@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errQuotaExceeded = errors.New("connection quota exceeded")
+	errQuotaTimeout  = errors.New("connection quota queue timeout")
+)
+
+// connQuota enforces the limits of a ConnectionQuota. It counts the
+// concurrent connections, in total and per client IP address.
+type connQuota struct {
+	name        string
+	recordEvent func(string)
+
+	mu      sync.Mutex
+	cfg     *ConnectionQuota
+	total   int
+	perIP   map[string]int
+	queued  int
+	changed chan struct{}
+}
+
+func newConnQuota(name string, cfg *ConnectionQuota, recordEvent func(string)) *connQuota {
+	return &connQuota{
+		name:        name,
+		recordEvent: recordEvent,
+		cfg:         cfg,
+		perIP:       make(map[string]int),
+		changed:     make(chan struct{}),
+	}
+}
+
+// setConfig changes the limits. The connections that are already counted
+// are not affected.
+func (q *connQuota) setConfig(cfg *ConnectionQuota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cfg = cfg
+	q.notifyLocked()
+}
+
+// stats returns the number of connections that are counted, and the number of
+// connections that are waiting in the queue.
+func (q *connQuota) stats() (active, queued int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total, q.queued
+}
+
+func (q *connQuota) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+func (q *connQuota) allowLocked(ip string) bool {
+	if q.cfg == nil {
+		return true
+	}
+	if n := q.cfg.MaxConnections; n > 0 && q.total >= n {
+		return false
+	}
+	if n := q.cfg.MaxConnectionsPerIP; n > 0 && ip != "" && q.perIP[ip] >= n {
+		return false
+	}
+	return true
+}
+
+// acquire counts a new connection from addr. When the connection is over the
+// limits and Action is queue, it waits up to QueueTimeout for other
+// connections to end. The returned function must be called when the
+// connection ends.
+func (q *connQuota) acquire(ctx context.Context, addr net.Addr) (func(), error) {
+	ip := quotaIP(addr)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.allowLocked(ip) {
+		if q.cfg.Action != QuotaQueue {
+			q.recordEvent(q.name + " " + errQuotaExceeded.Error())
+			return nil, errQuotaExceeded
+		}
+		q.recordEvent(q.name + " connection quota queued")
+		q.queued++
+		defer func() { q.queued-- }()
+		timer := time.NewTimer(q.cfg.QueueTimeout)
+		defer timer.Stop()
+		for !q.allowLocked(ip) {
+			ch := q.changed
+			q.mu.Unlock()
+			var err error
+			select {
+			case <-ch:
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-timer.C:
+				err = errQuotaTimeout
+			}
+			q.mu.Lock()
+			if err == errQuotaTimeout && q.allowLocked(ip) {
+				break
+			}
+			if err == errQuotaTimeout {
+				q.recordEvent(q.name + " " + err.Error())
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	q.total++
+	if ip != "" {
+		q.perIP[ip]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.total--
+			if ip != "" {
+				if q.perIP[ip]--; q.perIP[ip] <= 0 {
+					delete(q.perIP, ip)
+				}
+			}
+			q.notifyLocked()
+		})
+	}, nil
+}
+
+func quotaIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// checkConnectionQuota counts conn against the global connection quota and
+// the quota of its backend, if any. The connection is no longer counted after
+// releaseConnectionQuota is called.
+func (p *Proxy) checkConnectionQuota(ctx context.Context, conn annotatedConnection, be *Backend) error {
+	var quotas []*connQuota
+	p.mu.RLock()
+	if p.quota != nil {
+		quotas = append(quotas, p.quota)
+	}
+	p.mu.RUnlock()
+	if be != nil && be.quota != nil {
+		quotas = append(quotas, be.quota)
+	}
+	for _, q := range quotas {
+		release, err := q.acquire(ctx, conn.RemoteAddr())
+		if err != nil {
+			return err
+		}
+		releases, _ := conn.Annotation(quotaReleaseKey, []func(){}).([]func())
+		conn.SetAnnotation(quotaReleaseKey, append(releases, release))
+	}
+	return nil
+}
+
+// releaseConnectionQuota is called when conn is closed.
+func releaseConnectionQuota(conn annotatedConnection) {
+	releases, _ := conn.Annotation(quotaReleaseKey, []func(){}).([]func())
+	for _, release := range releases {
+		release()
+	}
+}
@@ -0,0 +1,255 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestConnQuota(t *testing.T) {
+	var events []string
+	q := newConnQuota("test", &ConnectionQuota{
+		MaxConnections:      3,
+		MaxConnectionsPerIP: 2,
+		Action:              QuotaClose,
+	}, func(e string) { events = append(events, e) })
+
+	ctx := context.Background()
+	addr1 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	addr2 := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	r1, err := q.acquire(ctx, addr1)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	r2, err := q.acquire(ctx, addr1)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := q.acquire(ctx, addr1); err != errQuotaExceeded {
+		t.Fatalf("acquire: %v, want %v", err, errQuotaExceeded)
+	}
+	if _, err := q.acquire(ctx, addr2); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if _, err := q.acquire(ctx, addr2); err != errQuotaExceeded {
+		t.Fatalf("acquire: %v, want %v", err, errQuotaExceeded)
+	}
+	r1()
+	r1()
+	if active, _ := q.stats(); active != 2 {
+		t.Errorf("active = %d, want 2", active)
+	}
+
+	q.setConfig(&ConnectionQuota{
+		MaxConnections: 2,
+		Action:         QuotaQueue,
+		QueueTimeout:   100 * time.Millisecond,
+	})
+	start := time.Now()
+	if _, err := q.acquire(ctx, addr1); err != errQuotaTimeout {
+		t.Fatalf("acquire: %v, want %v", err, errQuotaTimeout)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("acquire returned after %s", d)
+	}
+
+	q.setConfig(&ConnectionQuota{
+		MaxConnections: 2,
+		Action:         QuotaQueue,
+		QueueTimeout:   10 * time.Second,
+	})
+	r2()
+	r3, err := q.acquire(ctx, addr2)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := q.acquire(ctx, addr1)
+		done <- err
+	}()
+	for {
+		if _, queued := q.stats(); queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	r3()
+	if err := <-done; err != nil {
+		t.Fatalf("queued acquire: %v", err)
+	}
+
+	want := []string{
+		"test connection quota exceeded",
+		"test connection quota exceeded",
+		"test connection quota queued",
+		"test connection quota queue timeout",
+		"test connection quota queued",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("events = %q, want %q", events, want)
+	}
+}
+
+func TestConnectionQuota(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	// An echo server that keeps its connections open.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(conn)
+		}
+	}()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"echo.example.com"},
+				Addresses:   []string{l.Addr().String()},
+				ConnectionQuota: &ConnectionQuota{
+					MaxConnections: 1,
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	dial := func() (net.Conn, error) {
+		c, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName: "echo.example.com",
+			RootCAs:    ca.RootCACertPool(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write([]byte("hello")); err != nil {
+			c.Close()
+			return nil, err
+		}
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	c1, err := dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, err := dial(); err == nil {
+		t.Fatal("second dial should fail")
+	}
+	c1.Close()
+
+	cfg = cfg.clone()
+	cfg.Backends[0].ConnectionQuota.Action = QuotaQueue
+	cfg.Backends[0].ConnectionQuota.QueueTimeout = 5 * time.Second
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	c1, err = dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	time.AfterFunc(200*time.Millisecond, func() { c1.Close() })
+	start := time.Now()
+	c2, err := dial()
+	if err != nil {
+		t.Fatalf("queued dial: %v", err)
+	}
+	c2.Close()
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("queued connection was accepted after %s", d)
+	}
+}
+
+func TestConnectionQuotaConfig(t *testing.T) {
+	for _, tc := range []struct {
+		desc    string
+		global  *ConnectionQuota
+		backend *ConnectionQuota
+		wantErr error
+	}{
+		{desc: "ok", global: &ConnectionQuota{MaxConnectionsPerIP: 10}, backend: &ConnectionQuota{MaxConnections: 10, Action: "QUEUE"}},
+		{desc: "global max", global: &ConnectionQuota{MaxConnections: 10}, wantErr: errors.New("connectionQuota.MaxConnections: must be zero, use MaxOpen instead")},
+		{desc: "negative", backend: &ConnectionQuota{MaxConnectionsPerIP: -1}, wantErr: errors.New("backend[0].ConnectionQuota.MaxConnectionsPerIP: value cannot be negative")},
+		{desc: "action", backend: &ConnectionQuota{Action: "drop"}, wantErr: errors.New(`backend[0].ConnectionQuota.Action: value "drop" must be one of [close queue]`)},
+	} {
+		cfg := &Config{
+			CacheDir:        t.TempDir(),
+			MaxOpen:         100,
+			ConnectionQuota: tc.global,
+			Backends: []*Backend{{
+				ServerNames:     []string{"example.com"},
+				Addresses:       []string{"192.168.0.1:80"},
+				ConnectionQuota: tc.backend,
+			}},
+		}
+		err := cfg.Check()
+		if fmt.Sprint(err) != fmt.Sprint(tc.wantErr) {
+			t.Errorf("%s: Check() = %v, want %v", tc.desc, err, tc.wantErr)
+		}
+		if err == nil && tc.backend != nil && (tc.backend.Action != QuotaQueue || tc.backend.QueueTimeout != 10*time.Second) {
+			t.Errorf("%s: backend quota = %+v", tc.desc, tc.backend)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ratelimit"
+)
+
+const banListFile = "ban-list"
+
+var (
+	errBanned      = errors.New("banned")
+	errRateLimited = errors.New("rate limited")
+)
+
+// connLimits implements the rate limits and the ban list from the rateLimit
+// config section.
+type connLimits struct {
+	cfg     *ConfigRateLimit
+	ip      *ratelimit.Limiter
+	subject *ratelimit.Limiter
+	bans    *ratelimit.BanList
+}
+
+func newConnLimits(cfg *ConfigRateLimit) *connLimits {
+	l := &connLimits{cfg: cfg}
+	if cfg.ConnectionsPerIP > 0 {
+		l.ip = ratelimit.NewLimiter(cfg.ConnectionsPerIP, cfg.Burst)
+	}
+	if cfg.ConnectionsPerSubject > 0 {
+		l.subject = ratelimit.NewLimiter(cfg.ConnectionsPerSubject, cfg.Burst)
+	}
+	if cfg.BanThreshold > 0 {
+		l.bans = ratelimit.NewBanList(cfg.BanThreshold, cfg.BanWindow, cfg.BanDuration)
+	}
+	return l
+}
+
+func (p *Proxy) connLimits() *connLimits {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.limits
+}
+
+// limitsKey returns the IP address of addr, and whether it is subject to
+// rate limits and bans.
+func (l *connLimits) limitsKey(addr net.Addr) (string, bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+	for _, n := range l.cfg.exemptIPs {
+		if n.Contains(ip) {
+			return "", false
+		}
+	}
+	return ip.String(), true
+}
+
+// allowIP checks whether a new connection from addr is allowed. It must be
+// called before the TLS handshake completes.
+func (p *Proxy) allowIP(addr net.Addr) error {
+	l := p.connLimits()
+	if l == nil {
+		return nil
+	}
+	ip, ok := l.limitsKey(addr)
+	if !ok {
+		return nil
+	}
+	if l.bans != nil && l.bans.IsBanned(ip) {
+		p.recordEvent("banned ip")
+		return errBanned
+	}
+	if l.ip != nil && !l.ip.Allow(ip) {
+		p.recordEvent("ip rate limit")
+		return errRateLimited
+	}
+	return nil
+}
+
+// allowSubject checks whether a new connection with this client certificate
+// is allowed.
+func (p *Proxy) allowSubject(cert *x509.Certificate) error {
+	l := p.connLimits()
+	if l == nil || l.subject == nil || cert == nil {
+		return nil
+	}
+	if !l.subject.Allow(cert.Subject.String()) {
+		p.recordEvent("subject rate limit")
+		return errRateLimited
+	}
+	return nil
+}
+
+// tarpit keeps conn open and reads from it at 1 byte per second, until the
+// client closes it or TarpitDuration expires. It returns immediately when
+// tarpitting isn't enabled, or when MaxTarpitConnections are already
+// tarpitted. The caller closes the connection.
+func (p *Proxy) tarpit(conn net.Conn) {
+	l := p.connLimits()
+	if l == nil || !l.cfg.Tarpit {
+		return
+	}
+	if n := p.tarpitted.Add(1); n > int64(l.cfg.MaxTarpitConnections) {
+		p.tarpitted.Add(-1)
+		p.recordEvent("tarpit full")
+		return
+	}
+	defer p.tarpitted.Add(-1)
+	p.recordEvent("tarpit")
+
+	conn.SetReadDeadline(time.Now().Add(l.cfg.TarpitDuration))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var buf [1]byte
+	for {
+		if _, err := conn.Read(buf[:]); err != nil {
+			return
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportFailure records an error caused by the client at addr. The IP address
+// is banned when there are too many errors.
+func (p *Proxy) reportFailure(addr net.Addr) {
+	l := p.connLimits()
+	if l == nil || l.bans == nil {
+		return
+	}
+	ip, ok := l.limitsKey(addr)
+	if !ok {
+		return
+	}
+	if l.bans.Fail(ip) {
+		p.recordEvent("ip banned")
+		log.Printf("WRN %s is banned for %s", ip, l.cfg.BanDuration)
+		if p.sharedStore != nil {
+			go p.syncBanList()
+		}
+	}
+}
+
+// banListSyncLoop periodically shares the ban list with the other proxies that
+// use the same SharedCacheDir. It runs until ctx is canceled.
+func (p *Proxy) banListSyncLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(15 * time.Second):
+			if err := p.syncBanList(); err != nil {
+				log.Printf("ERR syncBanList: %v", err)
+			}
+		}
+	}
+}
+
+// syncBanList merges the local ban list with the shared ban list.
+func (p *Proxy) syncBanList() (retErr error) {
+	l := p.connLimits()
+	if l == nil || l.bans == nil {
+		return nil
+	}
+	var bans map[string]time.Time
+	commit, err := p.sharedStore.OpenForUpdate(banListFile, &bans)
+	if err != nil {
+		return err
+	}
+	defer commit(false, &retErr)
+	if bans == nil {
+		bans = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for k, v := range l.bans.Banned() {
+		if v.After(bans[k]) {
+			bans[k] = v
+		}
+	}
+	for k, v := range bans {
+		if v.Before(now) {
+			delete(bans, k)
+		}
+	}
+	l.bans.Merge(bans)
+	return commit(true, nil)
+}
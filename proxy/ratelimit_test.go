@@ -0,0 +1,214 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	backend := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{backend.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+		RateLimit: &ConfigRateLimit{
+			BanThreshold: 2,
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	dial := func() error {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    ca.RootCACertPool(),
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	for range 2 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("net.Dial: %v", err)
+		}
+		conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err := dial(); err == nil {
+		t.Fatal("dial succeeded after ban")
+	}
+	proxy.eventsmu.Lock()
+	got := proxy.events["ip banned"]
+	proxy.eventsmu.Unlock()
+	if got != 1 {
+		t.Errorf("ip banned events = %d, want 1", got)
+	}
+
+	cfg = cfg.clone()
+	cfg.RateLimit = &ConfigRateLimit{
+		ConnectionsPerIP: 0.001,
+		Burst:            1,
+	}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if err := dial(); err == nil {
+		t.Fatal("dial succeeded after rate limit")
+	}
+
+	cfg = cfg.clone()
+	cfg.RateLimit.ExemptIPs = []string{"127.0.0.0/8", "::1/128"}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	for range 3 {
+		if err := dial(); err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	backend := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{backend.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+		RateLimit: &ConfigRateLimit{
+			Tarpit: true,
+		},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Fatal("cfg.Check() should fail without BanThreshold")
+	}
+	cfg.RateLimit.BanThreshold = 1
+	cfg.RateLimit.MaxTarpitConnections = 1
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+
+	// The first connection after the ban is tarpitted.
+	conn1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer conn1.Close()
+	conn1.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn1.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("tarpitted conn: Read() = %v, want deadline exceeded", err)
+	}
+	if got, want := proxy.tarpitted.Load(), int64(1); got != want {
+		t.Errorf("tarpitted = %d, want %d", got, want)
+	}
+
+	// The second one is over MaxTarpitConnections.
+	conn2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	defer conn2.Close()
+	conn2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn2.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("conn2: Read() = %v, want closed", err)
+	}
+
+	conn1.Close()
+	for i := 0; proxy.tarpitted.Load() != 0; i++ {
+		if i == 50 {
+			t.Fatal("tarpitted connection not released")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	proxy.eventsmu.Lock()
+	defer proxy.eventsmu.Unlock()
+	if got, want := proxy.events["tarpit"], int64(1); got != want {
+		t.Errorf("tarpit events = %d, want %d", got, want)
+	}
+	if got, want := proxy.events["tarpit full"], int64(1); got != want {
+		t.Errorf("tarpit full events = %d, want %d", got, want)
+	}
+}
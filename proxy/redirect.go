@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// redirectHandler returns a handler that responds to all the requests with a
+// redirect to the location specified by be.Redirect. Local endpoints, e.g.
+// SSO, are handled first.
+func (be *Backend) redirectHandler() http.Handler {
+	code := be.Redirect.StatusCode
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(req, r)
+			}
+		}()
+		if !be.authenticateUser(w, &req) {
+			return
+		}
+		if !be.handleLocalEndpointsAndAuthorize(w, req) {
+			return
+		}
+		var query string
+		if req.URL.RawQuery != "" {
+			query = "?" + req.URL.RawQuery
+		}
+		loc := be.Redirect.expand(hostFromReq(req), req.URL.EscapedPath(), query)
+		log.Printf("REQ %s ➔ %s %s ➔ status:%d %s (%q)", formatReqDesc(req), req.Method, req.URL.Path, code, loc, userAgent(req))
+		http.Redirect(w, req, loc, code)
+	})
+}
+
+// expand returns the redirect location with the placeholders replaced by the
+// given values.
+func (r *Redirect) expand(host, path, query string) string {
+	return strings.NewReplacer(
+		"{host}", host,
+		"{path}", path,
+		"{query}", query,
+		"{uri}", path+query,
+	).Replace(r.URL)
+}
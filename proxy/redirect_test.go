@@ -0,0 +1,96 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	for _, tc := range []struct {
+		redirect Redirect
+		target   string
+		wantCode int
+		wantLoc  string
+	}{
+		{
+			redirect: Redirect{URL: "https://www.{host}{uri}"},
+			target:   "https://example.com:8443/foo/bar?a=b",
+			wantCode: http.StatusMovedPermanently,
+			wantLoc:  "https://www.example.com/foo/bar?a=b",
+		},
+		{
+			redirect: Redirect{URL: "https://new.example.com{path}", StatusCode: http.StatusPermanentRedirect},
+			target:   "https://old.example.com/foo%20bar?a=b",
+			wantCode: http.StatusPermanentRedirect,
+			wantLoc:  "https://new.example.com/foo%20bar",
+		},
+		{
+			redirect: Redirect{URL: "https://example.com/moved{query}", StatusCode: http.StatusFound},
+			target:   "https://example.com/",
+			wantCode: http.StatusFound,
+			wantLoc:  "https://example.com/moved",
+		},
+		{
+			redirect: Redirect{URL: "/new{uri}"},
+			target:   "https://example.com/x?y",
+			wantCode: http.StatusMovedPermanently,
+			wantLoc:  "/new/x?y",
+		},
+	} {
+		be := &Backend{Mode: ModeRedirect, Redirect: &tc.redirect}
+		req := httptest.NewRequest("GET", tc.target, nil)
+		w := httptest.NewRecorder()
+		be.redirectHandler().ServeHTTP(w, req)
+		if got, want := w.Code, tc.wantCode; got != want {
+			t.Errorf("%s: Code = %d, want %d", tc.target, got, want)
+		}
+		if got, want := w.Header().Get("Location"), tc.wantLoc; got != want {
+			t.Errorf("%s: Location = %q, want %q", tc.target, got, want)
+		}
+	}
+}
+
+func TestRedirectCheck(t *testing.T) {
+	for _, tc := range []struct {
+		redirect Redirect
+		wantErr  bool
+	}{
+		{redirect: Redirect{URL: "https://www.{host}{uri}"}},
+		{redirect: Redirect{URL: "/elsewhere", StatusCode: 307}},
+		{redirect: Redirect{URL: "http://example.com{path}", StatusCode: 302}},
+		{redirect: Redirect{URL: ""}, wantErr: true},
+		{redirect: Redirect{URL: "relative/path"}, wantErr: true},
+		{redirect: Redirect{URL: "//example.com/"}, wantErr: true},
+		{redirect: Redirect{URL: "ftp://example.com/"}, wantErr: true},
+		{redirect: Redirect{URL: "https://{hostname}/"}, wantErr: true},
+		{redirect: Redirect{URL: "https://example.com/", StatusCode: 200}, wantErr: true},
+	} {
+		if err := tc.redirect.check(); (err != nil) != tc.wantErr {
+			t.Errorf("check(%+v) = %v, want err %v", tc.redirect, err, tc.wantErr)
+		}
+	}
+}
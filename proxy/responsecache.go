@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/httpcache"
+)
+
+// responseCache is the response cache of a backend. It is kept across config
+// changes when the backend's ResponseCache config doesn't change.
+type responseCache struct {
+	cfg   ResponseCache
+	cache *httpcache.Cache
+}
+
+// setResponseCaches creates the response caches of the backends, and closes
+// the ones that are no longer used. It must be called with p.mu held.
+func (p *Proxy) setResponseCaches(cfg *Config) {
+	caches := make(map[string]*responseCache)
+	for _, be := range cfg.Backends {
+		be.respCache = nil
+		if be.ResponseCache == nil {
+			continue
+		}
+		name := be.displayName()
+		if rc, ok := p.respCaches[name]; ok && reflect.DeepEqual(rc.cfg, *be.ResponseCache) {
+			caches[name] = rc
+			be.respCache = rc.cache
+			continue
+		}
+		h := sha256.Sum256([]byte(name))
+		c := httpcache.New(httpcache.Options{
+			MaxSize:       int64(be.ResponseCache.MaxSize) << 20,
+			MaxObjectSize: int64(be.ResponseCache.MaxObjectSize) << 10,
+			DiskSize:      int64(be.ResponseCache.DiskSize) << 20,
+			Store:         p.store,
+			Dir:           path.Join("http-cache", hex.EncodeToString(h[:16])),
+		})
+		caches[name] = &responseCache{cfg: *be.ResponseCache, cache: c}
+		be.respCache = c
+	}
+	for name, rc := range p.respCaches {
+		if caches[name] != rc {
+			if err := rc.cache.Close(); err != nil {
+				log.Printf("ERR response cache %s: %v", name, err)
+			}
+		}
+	}
+	p.respCaches = caches
+}
+
+// cacheTransport returns the transport that serves the responses from the
+// backend's response cache, or next if the cache isn't enabled.
+func (be *Backend) cacheTransport(next http.RoundTripper) http.RoundTripper {
+	if be.respCache == nil {
+		return next
+	}
+	rc := be.ResponseCache
+	return &httpcache.Transport{
+		Cache: be.respCache,
+		Next:  next,
+		Authenticated: func(req *http.Request) bool {
+			return claimsFromCtx(req.Context()) != nil || req.Context().Value(jwtClaimsCtxKey) != nil || (req.TLS != nil && len(req.TLS.PeerCertificates) > 0)
+		},
+		TTL: func(req *http.Request) (time.Duration, bool) {
+			return rc.ttl(req.URL.Path)
+		},
+	}
+}
+
+type adminCacheStats struct {
+	Backend string `json:"backend"`
+	httpcache.Stats
+}
+
+// adminCacheStats returns the statistics of the response caches.
+func (p *Proxy) adminCacheStats(*http.Request) (any, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := []adminCacheStats{}
+	for _, be := range p.cfg.Backends {
+		if be.respCache == nil {
+			continue
+		}
+		out = append(out, adminCacheStats{Backend: be.displayName(), Stats: be.respCache.Stats()})
+	}
+	return out, nil
+}
+
+// adminPurgeCache removes the responses for serverName, and optionally only
+// the ones whose path starts with the path parameter, from the response
+// cache.
+func (p *Proxy) adminPurgeCache(req *http.Request) (any, error) {
+	serverName := idnaToASCII(req.Form.Get("serverName"))
+	if serverName == "" {
+		return nil, errors.New("serverName must be set")
+	}
+	prefix := req.Form.Get("path")
+	if prefix == "" {
+		prefix = "/"
+	}
+	be, err := p.backend(serverName)
+	if err != nil || be.respCache == nil {
+		return nil, errNotFound
+	}
+	n := be.respCache.Purge(serverName, prefix)
+	log.Printf("INF Admin API: purged %d responses from the cache of %s", n, be.displayName())
+	p.recordEvent("response cache purged")
+	return map[string]any{"serverName": idnaToUnicode(serverName), "purged": n}, nil
+}
@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestResponseCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	var count atomic.Int32
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := count.Add(1)
+		if strings.HasPrefix(req.URL.Path, "/static/") {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprintf(w, "%s %d", req.URL.Path, n)
+	}))
+	defer be.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+				Mode:        "HTTP",
+				ResponseCache: &ResponseCache{
+					TTLOverrides: []*CacheTTLOverride{
+						{Paths: []string{"/override/"}, TTL: -time.Hour},
+					},
+				},
+			},
+		},
+	}
+	if err := cfg.Check(); err == nil || !strings.Contains(err.Error(), "TTLOverrides[0].TTL") {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	cfg.Backends[0].ResponseCache.TTLOverrides[0].TTL = time.Hour
+
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(path string) string {
+		t.Helper()
+		body, _, err := httpGet("www.example.com", proxy.listener.Addr().String(), path, extCA, nil)
+		if err != nil {
+			t.Fatalf("httpGet: %v", err)
+		}
+		return body
+	}
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/static/a", "HTTP/2.0 200 OK\n/static/a 1"},
+		{"/static/a", "HTTP/2.0 200 OK\n/static/a 1"},
+		{"/dynamic", "HTTP/2.0 200 OK\n/dynamic 2"},
+		{"/dynamic", "HTTP/2.0 200 OK\n/dynamic 3"},
+		{"/override/x", "HTTP/2.0 200 OK\n/override/x 4"},
+		{"/override/x", "HTTP/2.0 200 OK\n/override/x 4"},
+	} {
+		if got := get(tc.path); got != tc.want {
+			t.Errorf("GET %s = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+
+	// The cache is kept when the config changes, unless the cache config
+	// changes.
+	cfg = cfg.clone()
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if got, want := get("/static/a"), "HTTP/2.0 200 OK\n/static/a 1"; got != want {
+		t.Errorf("GET /static/a = %q, want %q", got, want)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/cache/purge", nil)
+	req.Form = url.Values{"serverName": {"www.example.com"}, "path": {"/static/"}}
+	v, err := proxy.adminPurgeCache(req)
+	if err != nil {
+		t.Fatalf("adminPurgeCache: %v", err)
+	}
+	if got := v.(map[string]any)["purged"]; got != 1 {
+		t.Errorf("purged = %v, want 1", got)
+	}
+	if got, want := get("/static/a"), "HTTP/2.0 200 OK\n/static/a 5"; got != want {
+		t.Errorf("GET /static/a = %q, want %q", got, want)
+	}
+	if got, want := get("/override/x"), "HTTP/2.0 200 OK\n/override/x 4"; got != want {
+		t.Errorf("GET /override/x = %q, want %q", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.prometheusHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`tlsproxy_response_cache_requests_total{backend="www.example.com",result="hit"} 4`,
+		`tlsproxy_response_cache_requests_total{backend="www.example.com",result="miss"} 5`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
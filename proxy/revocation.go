@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/crlcache"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/ocspcache"
+)
+
+var errRevoked = errors.New("revoked")
+
+// checkClientCertRevocation checks the revocation status of the client
+// certificate with the PKI that issued it, OCSP, and the backend's CRLs. It
+// returns an error if the certificate is revoked, or if its status can't be
+// determined and the backend's revocation policy is hard-fail.
+func (p *Proxy) checkClientCertRevocation(be *Backend, cs tls.ConnectionState) error {
+	cert := cs.PeerCertificates[0]
+	if m, ok := be.pkiMap[hex.EncodeToString(cert.AuthorityKeyId)]; ok {
+		if m.IsRevoked(cert.SerialNumber) {
+			return errRevoked
+		}
+		return nil
+	}
+	softFail := be.ClientAuth.RevocationPolicy == RevocationSoftFail
+	if len(cert.OCSPServer) > 0 {
+		if err := p.ocspCache.VerifyChains(cs.VerifiedChains, cs.OCSPResponse); err != nil {
+			if !softFail || ocspcache.IsRevoked(err) {
+				return fmt.Errorf("OCSP:%w", err)
+			}
+			p.recordEvent(fmt.Sprintf("revocation soft-fail [%s] (OCSP:%v)", certSummary(cert), err))
+		}
+	}
+	if len(be.ClientAuth.CRLs) > 0 && len(cs.VerifiedChains) > 0 && len(cs.VerifiedChains[0]) > 1 {
+		if err := p.crlCache.Check(cert, cs.VerifiedChains[0][1], be.ClientAuth.CRLs); err != nil {
+			if !softFail || errors.Is(err, crlcache.ErrRevoked) {
+				return fmt.Errorf("CRL:%w", err)
+			}
+			p.recordEvent(fmt.Sprintf("revocation soft-fail [%s] (CRL:%v)", certSummary(cert), err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/crlcache"
+)
+
+func TestCheckClientCertRevocation(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	caTempl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caRaw, err := x509.CreateCertificate(rand.Reader, caTempl, caTempl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caRaw)
+
+	conn := func(sn int64) tls.ConnectionState {
+		templ := &x509.Certificate{
+			SerialNumber: big.NewInt(sn),
+			Subject:      pkix.Name{CommonName: "Bob"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, templ, caCert, key.Public(), key)
+		if err != nil {
+			t.Fatalf("x509.CreateCertificate: %v", err)
+		}
+		cert, _ := x509.ParseCertificate(raw)
+		return tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert, caCert}},
+		}
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{
+			{SerialNumber: big.NewInt(2), RevocationTime: time.Now()},
+		},
+	}, caCert, key)
+	if err != nil {
+		t.Fatalf("x509.CreateRevocationList: %v", err)
+	}
+	crlFile := filepath.Join(t.TempDir(), "ca.crl")
+	if err := os.WriteFile(crlFile, crl, 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	unavailable := "http://127.0.0.1:1/ca.crl"
+
+	p := &Proxy{crlCache: crlcache.New()}
+	for _, tc := range []struct {
+		name    string
+		sn      int64
+		crls    []string
+		policy  string
+		wantErr bool
+	}{
+		{"good", 1, []string{crlFile}, "", false},
+		{"revoked", 2, []string{crlFile}, "", true},
+		{"revoked soft-fail", 2, []string{crlFile}, RevocationSoftFail, true},
+		{"unavailable", 1, []string{unavailable}, "", true},
+		{"unavailable hard-fail", 1, []string{unavailable}, RevocationHardFail, true},
+		{"unavailable soft-fail", 1, []string{unavailable}, RevocationSoftFail, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := &Backend{
+				ClientAuth: &ClientAuth{
+					CRLs:             tc.crls,
+					RevocationPolicy: tc.policy,
+				},
+			}
+			err := p.checkClientCertRevocation(be, conn(tc.sn))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("checkClientCertRevocation() = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
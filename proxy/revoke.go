@@ -36,9 +36,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/c2FmZQ/storage/autocertcache"
 	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
 )
 
 const acmeAccountKey = "acme_account+key"
@@ -63,15 +61,6 @@ func (p *Proxy) RevokeAllCertificates(ctx context.Context, reason string) error
 		return nil
 	}
 
-	accountKey, err := p.acmeAccountKey(ctx)
-	if err != nil {
-		return err
-	}
-	client := &acme.Client{
-		DirectoryURL: autocert.DefaultACMEDirectory,
-		Key:          accountKey,
-		UserAgent:    "tlsproxy",
-	}
 	log.Print("!!!")
 	log.Print("!!! WARNING")
 	log.Print("!!!")
@@ -95,12 +84,20 @@ func (p *Proxy) RevokeAllCertificates(ctx context.Context, reason string) error
 			log.Printf("!!! Expired: %s", key)
 			continue
 		}
+		client, err := p.acmeClient(ctx, key)
+		if err != nil {
+			return err
+		}
 		if err := client.RevokeCert(ctx, certs[key].PrivateKey.(crypto.Signer), certs[key].Certificate[0], reasonCode); err != nil {
 			return err
 		}
 		log.Printf("!!! Revoked: %s", key)
 	}
-	return p.certManager.(*autocert.Manager).Cache.(*autocertcache.Cache).DeleteKeys(ctx, toRevoke)
+	cache, err := p.autocertCache()
+	if err != nil {
+		return err
+	}
+	return cache.DeleteKeys(ctx, toRevoke)
 }
 
 func (p *Proxy) revokeUnusedCertificates(ctx context.Context) error {
@@ -111,6 +108,11 @@ func (p *Proxy) revokeUnusedCertificates(ctx context.Context) error {
 	for _, be := range p.cfg.Backends {
 		for _, n := range be.ServerNames {
 			names[n] = true
+			// Wildcard certificates, obtained with the dns-01
+			// challenge, can be used for any subdomain.
+			if w := wildcardServerName(n); w != "" {
+				names[w] = true
+			}
 		}
 	}
 	p.mu.Unlock()
@@ -141,61 +143,58 @@ L:
 		return nil
 	}
 
-	accountKey, err := p.acmeAccountKey(ctx)
-	if err != nil {
-		return err
-	}
-	client := &acme.Client{
-		DirectoryURL: autocert.DefaultACMEDirectory,
-		Key:          accountKey,
-		UserAgent:    "tlsproxy",
-	}
 	now := time.Now()
 	for _, key := range toRevoke {
 		if now.After(certs[key].Leaf.NotAfter) {
 			log.Printf("INF Expired certificate: %s", key)
 			continue
 		}
+		client, err := p.acmeClient(ctx, key)
+		if err != nil {
+			return err
+		}
 		if err := client.RevokeCert(ctx, certs[key].PrivateKey.(crypto.Signer), certs[key].Certificate[0], acme.CRLReasonUnspecified); err != nil {
 			return err
 		}
 		log.Printf("INF Revoked unused certificate: %s", key)
 	}
-	return p.certManager.(*autocert.Manager).Cache.(*autocertcache.Cache).DeleteKeys(ctx, toRevoke)
+	cache, err := p.autocertCache()
+	if err != nil {
+		return err
+	}
+	return cache.DeleteKeys(ctx, toRevoke)
 }
 
-func (p *Proxy) acmeAccountKey(ctx context.Context) (crypto.Signer, error) {
-	m, ok := p.certManager.(*autocert.Manager)
+func (p *Proxy) autocertCache() (keyedCache, error) {
+	m, ok := p.certManager.(*acmeManager)
 	if !ok {
 		return nil, fmt.Errorf("not implemented with %T", p.certManager)
 	}
-	cache, ok := m.Cache.(*autocertcache.Cache)
-	if !ok {
-		return nil, fmt.Errorf("not implemented with %T", m.Cache)
+	c := m.cache
+	if ac, ok := c.(*acmeCache); ok {
+		c = ac.Cache
 	}
-	pemAccountKey, err := cache.Get(ctx, acmeAccountKey)
-	if err != nil {
-		return nil, fmt.Errorf("invalid account key: %w", err)
-	}
-	derAccountKey, _ := pem.Decode(pemAccountKey)
-	if derAccountKey == nil {
-		return nil, errors.New("invalid account key")
-	}
-	accountKey, err := parsePrivateKey(derAccountKey.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("invalid account key: %w", err)
+	cache, ok := c.(keyedCache)
+	if !ok {
+		return nil, fmt.Errorf("not implemented with %T", c)
 	}
-	return accountKey, nil
+	return cache, nil
 }
 
-func (p *Proxy) acmeAllCerts(ctx context.Context) (map[string]*tls.Certificate, error) {
-	m, ok := p.certManager.(*autocert.Manager)
+// acmeClient returns an ACME client for the account that issued the
+// certificate with the cache key.
+func (p *Proxy) acmeClient(ctx context.Context, key string) (*acme.Client, error) {
+	m, ok := p.certManager.(*acmeManager)
 	if !ok {
 		return nil, fmt.Errorf("not implemented with %T", p.certManager)
 	}
-	cache, ok := m.Cache.(*autocertcache.Cache)
-	if !ok {
-		return nil, fmt.Errorf("not implemented with %T", m.Cache)
+	return m.accountClient(ctx, strings.TrimSuffix(key, "+rsa"))
+}
+
+func (p *Proxy) acmeAllCerts(ctx context.Context) (map[string]*tls.Certificate, error) {
+	cache, err := p.autocertCache()
+	if err != nil {
+		return nil, err
 	}
 	keys, err := cache.Keys(ctx)
 	if err != nil {
@@ -204,7 +203,7 @@ func (p *Proxy) acmeAllCerts(ctx context.Context) (map[string]*tls.Certificate,
 	out := make(map[string]*tls.Certificate)
 L:
 	for _, k := range keys {
-		if k == acmeAccountKey {
+		if !isACMECertKey(k) || strings.HasPrefix(k, acmeStagingPrefix) {
 			continue
 		}
 		data, err := cache.Get(ctx, k)
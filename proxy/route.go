@@ -0,0 +1,101 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"slices"
+)
+
+// ClientHelloInfo contains the information that is available to route an
+// incoming TLS connection, before the TLS handshake.
+type ClientHelloInfo struct {
+	// ServerName is the server name requested by the client with SNI, or
+	// the default server name.
+	ServerName string
+	// ALPNProtos is the list of protocols offered by the client.
+	ALPNProtos []string
+	// RemoteAddr is the client's address.
+	RemoteAddr net.Addr
+	// LocalAddr is the address where the connection was received.
+	LocalAddr net.Addr
+	// JA3 and JA4 are the client's TLS fingerprints.
+	JA3 string
+	JA4 string
+
+	p *Proxy
+}
+
+// Lookup returns the backend that would be selected for serverName and
+// protos by the default routing policy.
+func (h *ClientHelloInfo) Lookup(serverName string, protos ...string) (*Backend, error) {
+	return h.p.backend(idnaToASCII(serverName), protos...)
+}
+
+// RouteFunc selects the backend for an incoming connection. It returns nil
+// and no error to use the default routing policy. When it returns an error,
+// the connection is rejected.
+type RouteFunc func(hello *ClientHelloInfo) (*Backend, error)
+
+// SetRouteFunc sets a function that decides which backend receives each
+// incoming TLS connection. The returned backend must be one of the backends
+// of the current config, e.g. returned by ClientHelloInfo.Lookup. It only
+// applies to connections received on TLSAddr.
+func (p *Proxy) SetRouteFunc(f RouteFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.routeFunc = f
+}
+
+// route returns the backend for an incoming connection.
+func (p *Proxy) route(hello *ClientHelloInfo) (*Backend, error) {
+	p.mu.RLock()
+	f := p.routeFunc
+	p.mu.RUnlock()
+	if f == nil {
+		return p.backend(hello.ServerName, hello.ALPNProtos...)
+	}
+	be, err := f(hello)
+	if err != nil {
+		return nil, err
+	}
+	if be == nil {
+		return p.backend(hello.ServerName, hello.ALPNProtos...)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if !slices.Contains(p.cfg.Backends, be) {
+		return nil, errors.New("route func returned an unknown backend")
+	}
+	if be.isDrained(p.drained) {
+		return nil, errors.New("backend drained")
+	}
+	be.state.mu.Lock()
+	defer be.state.mu.Unlock()
+	if be.state.shutdown {
+		return nil, errors.New("backend shutdown")
+	}
+	return be, nil
+}
@@ -0,0 +1,102 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestRouteFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be1 := newTCPServer(t, ctx, "backend1", nil)
+	be2 := newTCPServer(t, ctx, "backend2", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"www.example.com"},
+					Addresses:   []string{be1.listener.Addr().String()},
+				},
+				{
+					ServerNames: []string{"other.example.com"},
+					ALPNProtos:  &[]string{"other"},
+					Addresses:   []string{be2.listener.Addr().String()},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	proxy.SetRouteFunc(func(hello *ClientHelloInfo) (*Backend, error) {
+		if slices.Contains(hello.ALPNProtos, "deny") {
+			return nil, errors.New("denied")
+		}
+		if slices.Contains(hello.ALPNProtos, "other") {
+			return hello.Lookup("other.example.com")
+		}
+		if slices.Contains(hello.ALPNProtos, "unknown") {
+			return &Backend{}, nil
+		}
+		return nil, nil
+	})
+
+	for _, tc := range []struct {
+		protos  []string
+		want    string
+		wantErr bool
+	}{
+		{protos: nil, want: "Hello from backend1\n"},
+		{protos: []string{"other"}, want: "Hello from backend2\n"},
+		{protos: []string{"deny"}, wantErr: true},
+		{protos: []string{"unknown"}, wantErr: true},
+	} {
+		got, _, err := tlsGet("www.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, tc.protos)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("tlsGet(%v) err = %v, want %v", tc.protos, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("tlsGet(%v) = %q, want %q", tc.protos, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/sessionticket"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	newProxy := func() *Proxy {
+		p := newTestProxy(
+			&Config{
+				HTTPAddr: "localhost:0",
+				TLSAddr:  "localhost:0",
+				CacheDir: t.TempDir(),
+				MaxOpen:  100,
+				Backends: []*Backend{
+					{
+						ServerNames: []string{"www.example.com"},
+						Addresses:   []string{be.listener.Addr().String()},
+					},
+					{
+						ServerNames: []string{"other.example.com"},
+						Addresses:   []string{be.listener.Addr().String()},
+					},
+					{
+						ServerNameRegexps: []string{`^a[0-9]+\.example\.com$`},
+						Addresses:         []string{be.listener.Addr().String()},
+					},
+					{
+						ServerNameRegexps: []string{`^b[0-9]+\.example\.com$`},
+						Addresses:         []string{be.listener.Addr().String()},
+					},
+				},
+			},
+			extCA,
+		)
+		if err := p.Start(ctx); err != nil {
+			t.Fatalf("proxy.Start: %v", err)
+		}
+		return p
+	}
+	proxy1 := newProxy()
+	defer proxy1.Stop()
+	proxy2 := newProxy()
+	defer proxy2.Stop()
+	proxy3 := newProxy()
+	defer proxy3.Stop()
+
+	// proxy1 and proxy2 share the same storage for session ticket keys.
+	if proxy2.ticketKeys, err = sessionticket.New(proxy1.store); err != nil {
+		t.Fatalf("sessionticket.New: %v", err)
+	}
+	proxy2.updateSessionTicketKeys()
+
+	// The cache ignores the server name so that the client tries to
+	// resume its session with other backends too.
+	cache := &singleSessionCache{}
+	get := func(p *Proxy, name string) bool {
+		c, err := tls.Dial("tcp", p.listener.Addr().String(), &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: name != "www.example.com",
+			RootCAs:            extCA.RootCACertPool(),
+			ClientSessionCache: cache,
+		})
+		if err != nil {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		defer c.Close()
+		// Read the response to receive the session ticket.
+		if _, err := io.ReadAll(c); err != nil {
+			t.Fatalf("io.ReadAll: %v", err)
+		}
+		return c.ConnectionState().DidResume
+	}
+
+	for _, tc := range []struct {
+		desc        string
+		proxy       *Proxy
+		name        string
+		wantResumed bool
+	}{
+		{"first connection", proxy1, "www.example.com", false},
+		{"same proxy", proxy1, "www.example.com", true},
+		{"shared keys", proxy2, "www.example.com", true},
+		{"other backend", proxy1, "other.example.com", false},
+		{"other keys", proxy3, "www.example.com", false},
+		{"regexp backend", proxy1, "a1.example.com", false},
+		{"same regexp backend", proxy1, "a2.example.com", true},
+		{"other regexp backend", proxy1, "b1.example.com", false},
+	} {
+		if got := get(tc.proxy, tc.name); got != tc.wantResumed {
+			t.Errorf("%s: DidResume = %v, want %v", tc.desc, got, tc.wantResumed)
+		}
+	}
+
+	proxy1.mu.RLock()
+	m := proxy1.metrics["www.example.com"]
+	proxy1.mu.RUnlock()
+	if got, want := m.numResumed.Value(), int64(1); got != want {
+		t.Errorf("numResumed = %d, want %d", got, want)
+	}
+}
+
+type singleSessionCache struct {
+	cs *tls.ClientSessionState
+}
+
+func (c *singleSessionCache) Get(string) (*tls.ClientSessionState, bool) {
+	return c.cs, c.cs != nil
+}
+
+func (c *singleSessionCache) Put(_ string, cs *tls.ClientSessionState) {
+	if cs != nil {
+		c.cs = cs
+	}
+}
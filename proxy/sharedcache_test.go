@@ -0,0 +1,92 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestSharedCacheDir(t *testing.T) {
+	shared := t.TempDir()
+	newProxy := func() *Proxy {
+		cfg := &Config{
+			HTTPAddr:       "localhost:0",
+			TLSAddr:        "localhost:0",
+			CacheDir:       t.TempDir(),
+			SharedCacheDir: shared,
+			AcceptTOS:      true,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"example.com"},
+					Addresses:   []string{"192.168.0.1:443"},
+					Mode:        ModeTCP,
+				},
+			},
+			RateLimit: &ConfigRateLimit{
+				BanThreshold: 1,
+			},
+		}
+		if err := cfg.Check(); err != nil {
+			t.Fatalf("cfg.Check: %v", err)
+		}
+		p, err := New(cfg, []byte("test"))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return p
+	}
+	p1 := newProxy()
+	p2 := newProxy()
+
+	if k1, k2 := p1.ticketKeys.Keys("example.com"), p2.ticketKeys.Keys("example.com"); !slices.Equal(k1, k2) {
+		t.Error("Session ticket keys are different")
+	}
+
+	tok, err := p1.tokenManager.CreateToken(jwt.MapClaims{"sub": "test"}, "ES256")
+	if err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	if _, err := p2.tokenManager.ValidateToken(tok); err != nil {
+		t.Errorf("ValidateToken: %v", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	p1.reportFailure(addr)
+	if err := p1.syncBanList(); err != nil {
+		t.Fatalf("p1.syncBanList: %v", err)
+	}
+	if p2.connLimits().bans.IsBanned("10.0.0.1") {
+		t.Fatal("IsBanned = true before sync")
+	}
+	if err := p2.syncBanList(); err != nil {
+		t.Fatalf("p2.syncBanList: %v", err)
+	}
+	if !p2.connLimits().bans.IsBanned("10.0.0.1") {
+		t.Error("IsBanned = false after sync")
+	}
+}
@@ -0,0 +1,172 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"sort"
+	"time"
+)
+
+// MetricsSnapshot is a point in time copy of the proxy's metrics, for
+// programs that embed the proxy. It contains the same information as the
+// CONSOLE backend.
+type MetricsSnapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+	// Uptime is how long the proxy has been running.
+	Uptime time.Duration
+	// OpenConnections is the number of incoming connections that are
+	// currently open.
+	OpenConnections int
+	// Backends contains the metrics of each server name, sorted by server
+	// name.
+	Backends []BackendMetrics
+	// Events contains the number of times that each event was recorded,
+	// e.g. "tcp connection" or "tls handshake failed".
+	Events map[string]int64
+}
+
+// BackendMetrics are the metrics of one server name.
+type BackendMetrics struct {
+	// ServerName is the server name of the connections, in unicode.
+	ServerName string
+	// NumConnections is the total number of connections.
+	NumConnections int64
+	// BytesSent and BytesReceived are the total number of bytes sent to,
+	// and received from, the clients.
+	BytesSent     int64
+	BytesReceived int64
+	// SendRate and ReceiveRate are the average number of bytes per second
+	// sent to, and received from, the clients in the last minute.
+	SendRate    float64
+	ReceiveRate float64
+	// NumHandshakes is the number of TLS handshakes, and NumResumed is the
+	// number of handshakes that resumed a TLS session.
+	NumHandshakes uint64
+	NumResumed    int64
+	// HandshakeLatencyP50, P95, and P99 are estimates of the percentiles
+	// of the TLS handshake latency.
+	HandshakeLatencyP50 time.Duration
+	HandshakeLatencyP95 time.Duration
+	HandshakeLatencyP99 time.Duration
+	// NumDials is the number of connections to the backend whose latency
+	// was recorded, and DialLatencyP50, P95, and P99 are estimates of the
+	// percentiles of the time it took to connect to the backend.
+	NumDials       uint64
+	DialLatencyP50 time.Duration
+	DialLatencyP95 time.Duration
+	DialLatencyP99 time.Duration
+	// NumWebSockets is the total number of WebSocket connections, and
+	// OpenWebSockets is the number of WebSocket connections that are
+	// open.
+	NumWebSockets  int64
+	OpenWebSockets int64
+}
+
+// Event is an event recorded by the proxy.
+type Event struct {
+	Time        time.Time
+	Description string
+	// Severity is the event's severity: info, warning, or error.
+	Severity EventSeverity
+	// ConnID and Conn are the ID and the description of the connection
+	// that caused the event, if any.
+	ConnID uint64
+	Conn   string
+}
+
+// Metrics returns a snapshot of the proxy's metrics.
+func (p *Proxy) Metrics() *MetricsSnapshot {
+	now := time.Now()
+	s := &MetricsSnapshot{
+		Time:            now,
+		OpenConnections: len(p.inConns.slice()),
+		Events:          make(map[string]int64),
+	}
+	p.mu.RLock()
+	if !p.startTime.IsZero() {
+		s.Uptime = now.Sub(p.startTime)
+	}
+	for k, m := range p.metrics {
+		hs := m.handshakeLatency.Snapshot()
+		dl := m.dialLatency.Snapshot()
+		s.Backends = append(s.Backends, BackendMetrics{
+			ServerName:          idnaToUnicode(k),
+			NumConnections:      m.numConnections.Value(),
+			BytesSent:           m.numBytesSent.Value(),
+			BytesReceived:       m.numBytesReceived.Value(),
+			SendRate:            m.numBytesSent.Rate(time.Minute),
+			ReceiveRate:         m.numBytesReceived.Rate(time.Minute),
+			NumHandshakes:       hs.Count,
+			NumResumed:          m.numResumed.Value(),
+			HandshakeLatencyP50: secondsToDuration(hs.Percentile(50)),
+			HandshakeLatencyP95: secondsToDuration(hs.Percentile(95)),
+			HandshakeLatencyP99: secondsToDuration(hs.Percentile(99)),
+			NumDials:            dl.Count,
+			DialLatencyP50:      secondsToDuration(dl.Percentile(50)),
+			DialLatencyP95:      secondsToDuration(dl.Percentile(95)),
+			DialLatencyP99:      secondsToDuration(dl.Percentile(99)),
+			NumWebSockets:       m.numWebSockets.Value(),
+			OpenWebSockets:      m.openWebSockets.Load(),
+		})
+	}
+	p.mu.RUnlock()
+	sort.Slice(s.Backends, func(i, j int) bool {
+		return s.Backends[i].ServerName < s.Backends[j].ServerName
+	})
+
+	p.eventsmu.Lock()
+	defer p.eventsmu.Unlock()
+	for k, v := range p.events {
+		s.Events[k] = v
+	}
+	return s
+}
+
+// WatchEvents sends the events that the proxy records to ch, until the
+// returned function is called. Events are dropped when ch isn't ready to
+// receive them, so that a slow watcher doesn't slow down the proxy. ch is
+// never closed by the proxy.
+func (p *Proxy) WatchEvents(ch chan<- Event) (cancel func()) {
+	p.eventsmu.Lock()
+	defer p.eventsmu.Unlock()
+	if p.eventWatchers == nil {
+		p.eventWatchers = make(map[*eventWatcher]bool)
+	}
+	w := &eventWatcher{ch: ch}
+	p.eventWatchers[w] = true
+	return func() {
+		p.eventsmu.Lock()
+		defer p.eventsmu.Unlock()
+		delete(p.eventWatchers, w)
+	}
+}
+
+type eventWatcher struct {
+	ch chan<- Event
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
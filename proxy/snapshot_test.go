@@ -0,0 +1,103 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestMetricsSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	ch := make(chan Event, 100)
+	stop := proxy.WatchEvents(ch)
+
+	for i := 0; i < 3; i++ {
+		if got, _, err := tlsGet("example.com", proxy.listener.Addr().String(), "", ca, nil, nil); err != nil || got != "Hello from backend\n" {
+			t.Fatalf("tlsGet: %q, %v", got, err)
+		}
+	}
+	stop()
+	proxy.recordEvent("after stop")
+
+	m := proxy.Metrics()
+	if len(m.Backends) != 1 {
+		t.Fatalf("Backends = %+v", m.Backends)
+	}
+	b := m.Backends[0]
+	if b.ServerName != "example.com" || b.NumConnections != 3 || b.NumHandshakes != 3 || b.BytesSent == 0 || b.BytesReceived == 0 {
+		t.Errorf("Backends[0] = %+v", b)
+	}
+	if b.HandshakeLatencyP50 <= 0 || b.HandshakeLatencyP99 < b.HandshakeLatencyP50 {
+		t.Errorf("HandshakeLatency = %s, %s", b.HandshakeLatencyP50, b.HandshakeLatencyP99)
+	}
+	if b.NumDials != 3 || b.DialLatencyP50 <= 0 || b.DialLatencyP99 < b.DialLatencyP50 {
+		t.Errorf("DialLatency = %d, %s, %s", b.NumDials, b.DialLatencyP50, b.DialLatencyP99)
+	}
+	if got := m.Events["tcp connection"]; got != 3 {
+		t.Errorf("Events[tcp connection] = %d, want 3", got)
+	}
+
+	var n int
+	for len(ch) > 0 {
+		e := <-ch
+		if e.Description == "after stop" {
+			t.Errorf("Unexpected event after stop: %+v", e)
+		}
+		if e.Description == "tcp connection" && time.Since(e.Time) < time.Minute {
+			n++
+		}
+	}
+	if n != 3 {
+		t.Errorf("Watched %d tcp connection events, want 3", n)
+	}
+}
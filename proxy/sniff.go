@@ -0,0 +1,265 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+const (
+	sniffHTTP   = "http"
+	sniffSSH    = "ssh"
+	sniffPrefix = "prefix"
+
+	defaultSniffTimeout = time.Second
+	maxSniffSize        = 8192
+)
+
+// tlsConn is a TLS connection terminated by the proxy, i.e. a *tls.Conn or a
+// *sniffedConn.
+type tlsConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+	HandshakeContext(context.Context) error
+	NetConn() net.Conn
+}
+
+// sniffedConn is a TLS connection whose first bytes were read to choose its
+// backend. The bytes are returned again by Read.
+type sniffedConn struct {
+	*tls.Conn
+	buf []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// sniffResult is the result of a sniffer.
+type sniffResult int
+
+const (
+	sniffNoMatch sniffResult = iota
+	sniffMatch
+	sniffNeedMore
+)
+
+// sniff checks whether data matches s. When it does, it returns the server
+// name of the backend to use.
+func (s *Sniffer) sniff(data []byte) (string, sniffResult) {
+	switch s.Protocol {
+	case sniffHTTP:
+		host, res := sniffHTTPHost(data)
+		if res == sniffMatch && s.ServerName != "" {
+			host = s.ServerName
+		}
+		return host, res
+	case sniffSSH:
+		return s.ServerName, sniffPrefixMatch(data, "SSH-")
+	case sniffPrefix:
+		return s.ServerName, sniffPrefixMatch(data, s.Prefix)
+	}
+	return "", sniffNoMatch
+}
+
+func sniffPrefixMatch(data []byte, prefix string) sniffResult {
+	if len(data) < len(prefix) {
+		if strings.HasPrefix(prefix, string(data)) {
+			return sniffNeedMore
+		}
+		return sniffNoMatch
+	}
+	if bytes.HasPrefix(data, []byte(prefix)) {
+		return sniffMatch
+	}
+	return sniffNoMatch
+}
+
+// sniffHTTPHost returns the value of the Host header of an HTTP/1 request.
+func sniffHTTPHost(data []byte) (string, sniffResult) {
+	// The request line starts with a method, e.g. GET, POST.
+	for i, c := range data {
+		if c == ' ' && i > 0 {
+			break
+		}
+		if c < 'A' || c > 'Z' || i >= 16 {
+			return "", sniffNoMatch
+		}
+	}
+	header, _, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		return "", sniffNeedMore
+	}
+	lines := strings.Split(string(header), "\r\n")
+	if !strings.Contains(lines[0], " HTTP/1.") {
+		return "", sniffNoMatch
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			return "", sniffNoMatch
+		}
+		return idnaToASCII(strings.ToLower(host)), sniffMatch
+	}
+	return "", sniffNoMatch
+}
+
+// sniffers returns the NoSNISniffing config.
+func (p *Proxy) sniffers() *ConfigNoSNISniffing {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cfg.NoSNISniffing
+}
+
+// canSniff returns true if the connections of be can be moved to another
+// backend after sniffing, or be can receive such connections.
+func (be *Backend) canSniff() bool {
+	switch be.Mode {
+	case ModeConsole, ModeLocal, ModeHTTP, ModeHTTPS, ModeWebSocket, ModeRedirect, ModeProxy, ModeTCP, ModeTLS:
+		return true
+	}
+	return false
+}
+
+// handleSniffedConnection completes the TLS handshake of a connection without
+// SNI, and chooses its backend with the NoSNISniffing sniffers. It returns true
+// if the connection was handed to an HTTP server.
+func (p *Proxy) handleSniffedConnection(conn *netw.Conn, tc *tls.Conn) bool {
+	if !p.authorizeTLSConnection(tc) {
+		return false
+	}
+	sc, ok := p.sniffBackend(conn, tc, p.sniffers())
+	if !ok {
+		return false
+	}
+	if be := connBackend(conn); be.Mode == ModeTCP || be.Mode == ModeTLS {
+		p.handleTLSConnection(sc)
+		return false
+	}
+	p.handleHTTPConnection(sc)
+	return true
+}
+
+// sniffBackend reads the first bytes of tc to choose its backend. It returns
+// a connection that returns the same bytes again, and false if the connection
+// should be closed.
+func (p *Proxy) sniffBackend(conn *netw.Conn, tc *tls.Conn, cfg *ConfigNoSNISniffing) (*sniffedConn, bool) {
+	sc := &sniffedConn{Conn: tc}
+	if proto := connProto(conn); cfg == nil || (proto != "" && proto != "http/1.1") {
+		return sc, true
+	}
+	tc.SetReadDeadline(time.Now().Add(cmp.Or(cfg.Timeout, defaultSniffTimeout)))
+	defer tc.SetReadDeadline(time.Time{})
+
+	var serverName, sniffer string
+	buf := make([]byte, maxSniffSize)
+	var n int
+loop:
+	for {
+		final := n == len(buf)
+		if !final {
+			m, err := tc.Read(buf[n:])
+			n += m
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				final = true
+			} else if err != nil {
+				return nil, false
+			}
+		}
+		for _, s := range cfg.Sniffers {
+			name, res := s.sniff(buf[:n])
+			if res == sniffNeedMore && !final {
+				continue loop
+			}
+			if res == sniffMatch {
+				serverName, sniffer = name, s.Protocol
+				break loop
+			}
+		}
+		break
+	}
+	sc.buf = buf[:n]
+	if serverName == "" {
+		addTranscriptStep(conn, "sniffing", "no match")
+		return sc, true
+	}
+	addTranscriptStep(conn, "sniffing", "protocol: "+sniffer, "server name: "+idnaToUnicode(serverName))
+
+	oldBE := connBackend(conn)
+	be, err := p.backend(serverName, connProto(conn))
+	if err != nil || be == oldBE {
+		return sc, true
+	}
+	if !be.canSniff() || be.ClientAuth != nil {
+		p.recordConnEvent(conn, "sniffed backend not allowed")
+		log.Printf("BAD [-] %s ➔ %q: sniffed backend not allowed", conn.RemoteAddr(), idnaToUnicode(serverName))
+		return sc, true
+	}
+	conn.SetAnnotation(serverNameKey, serverName)
+	if p.checkClient(conn, be) != nil {
+		return nil, false
+	}
+	if be.quota != nil {
+		release, err := be.quota.acquire(p.ctx, conn.RemoteAddr())
+		if err != nil {
+			log.Printf("ERR [-] %s ➔ %q: %v", conn.RemoteAddr(), idnaToUnicode(serverName), err)
+			return nil, false
+		}
+		releases, _ := conn.Annotation(quotaReleaseKey, []func(){}).([]func())
+		conn.SetAnnotation(quotaReleaseKey, append(releases, release))
+	}
+	p.recordConnEvent(conn, "sniffed "+sniffer)
+	addTranscriptStep(conn, "backend", "server name: "+idnaToUnicode(serverName), "mode: "+be.Mode)
+	conn.SetAnnotation(backendKey, be)
+	oldBE.incInFlight(-1)
+	be.incInFlight(1)
+	p.setCounters(conn, be.metricsServerName(serverName))
+	if l := be.bwLimit; l != nil {
+		conn.SetLimiters(l.ingress, l.egress)
+	}
+	return sc, true
+}
@@ -0,0 +1,135 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestSniffer(t *testing.T) {
+	for _, tc := range []struct {
+		sniffer *Sniffer
+		data    string
+		name    string
+		res     sniffResult
+	}{
+		{&Sniffer{Protocol: sniffSSH, ServerName: "ssh"}, "SSH-2.0-OpenSSH\r\n", "ssh", sniffMatch},
+		{&Sniffer{Protocol: sniffSSH, ServerName: "ssh"}, "SS", "ssh", sniffNeedMore},
+		{&Sniffer{Protocol: sniffSSH, ServerName: "ssh"}, "GET /", "ssh", sniffNoMatch},
+		{&Sniffer{Protocol: sniffPrefix, Prefix: "HELLO", ServerName: "foo"}, "HELLO WORLD", "foo", sniffMatch},
+		{&Sniffer{Protocol: sniffPrefix, Prefix: "HELLO", ServerName: "foo"}, "HELL", "foo", sniffNeedMore},
+		{&Sniffer{Protocol: sniffHTTP}, "GET / HTTP/1.1\r\nHost: WWW.Example.com:8443\r\n\r\n", "www.example.com", sniffMatch},
+		{&Sniffer{Protocol: sniffHTTP, ServerName: "foo"}, "GET / HTTP/1.1\r\nhost: www.example.com\r\n\r\n", "foo", sniffMatch},
+		{&Sniffer{Protocol: sniffHTTP}, "POST / HTTP/1.1\r\nHost: www.example.com\r\n", "", sniffNeedMore},
+		{&Sniffer{Protocol: sniffHTTP}, "GET / HTTP/1.0\r\n\r\n", "", sniffNoMatch},
+		{&Sniffer{Protocol: sniffHTTP}, "SSH-2.0-OpenSSH\r\n", "", sniffNoMatch},
+	} {
+		name, res := tc.sniffer.sniff([]byte(tc.data))
+		if res != tc.res || (res == sniffMatch && name != tc.name) {
+			t.Errorf("%s.sniff(%q) = %q, %d, want %q, %d", tc.sniffer.Protocol, tc.data, name, res, tc.name, tc.res)
+		}
+	}
+}
+
+func TestNoSNISniffing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	sshBE := newTCPServer(t, ctx, "ssh", nil)
+	defaultBE := newHTTPServer(t, ctx, "default", nil)
+	wwwBE := newHTTPServer(t, ctx, "www", nil)
+
+	proxy := newTestProxy(&Config{
+		HTTPAddr:          "localhost:0",
+		TLSAddr:           "localhost:0",
+		CacheDir:          t.TempDir(),
+		MaxOpen:           100,
+		DefaultServerName: "default.example.com",
+		NoSNISniffing: &ConfigNoSNISniffing{
+			Sniffers: []*Sniffer{
+				{Protocol: sniffSSH, ServerName: "ssh.example.com"},
+				{Protocol: sniffHTTP},
+			},
+			Timeout: 200 * time.Millisecond,
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"default.example.com"},
+				Addresses:   []string{defaultBE.String()},
+				Mode:        ModeHTTP,
+			},
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{wwwBE.String()},
+				Mode:        ModeHTTP,
+			},
+			{
+				ServerNames: []string{"ssh.example.com"},
+				Addresses:   []string{sshBE.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	for _, tc := range []struct {
+		name, msg, want string
+	}{
+		{"", "SSH-2.0-Test\r\n", "Hello from ssh\n"},
+		{"", "GET /foo HTTP/1.0\r\nHost: www.example.com\r\n\r\n", "[www] /foo\n"},
+		{"", "GET /foo HTTP/1.0\r\nHost: unknown.example.com\r\n\r\n", "Misdirected Request\n"},
+		{"", "GET /bar HTTP/1.0\r\n\r\n", "[default] /bar\n"},
+		{"www.example.com", "GET /foo HTTP/1.0\r\nHost: default.example.com\r\n\r\n", "Misdirected Request\n"},
+	} {
+		got, _, err := tlsGet(tc.name, addr, tc.msg, ca, nil, nil)
+		if err != nil {
+			t.Fatalf("tlsGet(%q, %q): %v", tc.name, tc.msg, err)
+		}
+		if !strings.HasSuffix(got, tc.want) {
+			t.Errorf("tlsGet(%q, %q) = %q, want %q", tc.name, tc.msg, got, tc.want)
+		}
+	}
+
+	proxy.eventsmu.Lock()
+	defer proxy.eventsmu.Unlock()
+	if got, want := proxy.events["sniffed ssh"], int64(1); got != want {
+		t.Errorf("events[sniffed ssh] = %d, want %d", got, want)
+	}
+	if got, want := proxy.events["sniffed http"], int64(1); got != want {
+		t.Errorf("events[sniffed http] = %d, want %d", got, want)
+	}
+}
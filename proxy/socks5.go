@@ -0,0 +1,285 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS protocol version 5 (RFC 1928), with the username/password
+// authentication method (RFC 1929).
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded        = 0x00
+	socks5GeneralFailure   = 0x01
+	socks5NotAllowed       = 0x02
+	socks5HostUnreachable  = 0x04
+	socks5ConnRefused      = 0x05
+	socks5CmdNotSupported  = 0x07
+	socks5AddrNotSupported = 0x08
+
+	socks5HandshakeTimeout = 30 * time.Second
+)
+
+var errSOCKS5AuthFailed = errors.New("authentication failed")
+
+// handleSOCKS5Connection handles a connection to a SOCKS5 backend. After the
+// TLS handshake, the client authenticates and requests a connection to a
+// destination, which is bridged to the client if the ForwardProxy rules allow
+// it.
+func (p *Proxy) handleSOCKS5Connection(extConn *tls.Conn) {
+	if !p.authorizeTLSConnection(extConn) {
+		return
+	}
+	serverName := connServerName(extConn)
+	be := connBackend(extConn)
+	if err := be.waitForward(p.ctx); err != nil {
+		p.recordEvent(err.Error())
+		log.Printf("ERR [-] %s ➔  %q Wait: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+		return
+	}
+
+	extConn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	userID, addr, err := be.socks5Handshake(extConn)
+	if err != nil {
+		if errors.Is(err, errSOCKS5AuthFailed) {
+			p.reportFailure(extConn.RemoteAddr())
+		}
+		log.Printf("BAD [-] %s ➔ %q SOCKS5: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+		return
+	}
+
+	intConn, err := be.dialDestination(context.WithValue(p.ctx, connCtxKey, extConn), "tcp", addr)
+	if err != nil {
+		be.recordEvent("dial error")
+		log.Printf("ERR [-] %s ➔  %q Dial %s: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), addr, err)
+		code := byte(socks5HostUnreachable)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = socks5ConnRefused
+		}
+		writeSOCKS5Reply(extConn, code, nil)
+		return
+	}
+	defer intConn.Close()
+	if err := writeSOCKS5Reply(extConn, socks5Succeeded, intConn.LocalAddr()); err != nil {
+		log.Printf("ERR [-] %s ➔  %q SOCKS5: %v", extConn.RemoteAddr(), idnaToUnicode(serverName), err)
+		return
+	}
+	extConn.SetDeadline(time.Time{})
+	setKeepAlive(intConn)
+	annotatedConn(extConn).SetAnnotation(dialDoneKey, time.Now())
+	p.observeDial(extConn, be)
+
+	desc := formatConnDesc(annotatedConn(extConn), userID)
+	log.Printf("CON %s", desc)
+
+	if err := be.bridgeConns(extConn, intConn); err != nil {
+		log.Printf("DBG %s %v", desc, err)
+	}
+
+	startTime := annotatedConn(extConn).Annotation(startTimeKey, time.Time{}).(time.Time)
+	hsTime := annotatedConn(extConn).Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	dialTime := annotatedConn(extConn).Annotation(dialDoneKey, time.Time{}).(time.Time)
+	totalTime := time.Since(startTime).Truncate(time.Millisecond)
+
+	logConnEnd(extConn, "END %s; HS:%s Dial:%s Dur:%s Recv:%d Sent:%d", desc,
+		hsTime.Sub(startTime).Truncate(time.Millisecond),
+		dialTime.Sub(hsTime).Truncate(time.Millisecond), totalTime,
+		annotatedConn(extConn).BytesReceived(), annotatedConn(extConn).BytesSent())
+}
+
+// socks5Handshake authenticates the client and reads its request. It returns
+// the client's identity and the destination address, if the request is
+// allowed. Otherwise, the error reply is sent to the client.
+func (be *Backend) socks5Handshake(conn *tls.Conn) (string, string, error) {
+	fp := be.ForwardProxy
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", "", fmt.Errorf("unexpected version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	cert := connClientCert(conn)
+	method := byte(socks5AuthNoAcceptable)
+	switch {
+	case len(fp.Users) > 0 && slices.Contains(methods, socks5AuthPassword):
+		method = socks5AuthPassword
+	case cert != nil && slices.Contains(methods, socks5AuthNone):
+		method = socks5AuthNone
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return "", "", err
+	}
+	if method == socks5AuthNoAcceptable {
+		be.recordEvent("SOCKS5 no acceptable auth method")
+		return "", "", fmt.Errorf("%w: no acceptable method in %v", errSOCKS5AuthFailed, methods)
+	}
+	var user, password string
+	if method == socks5AuthPassword {
+		var err error
+		if user, password, err = readSOCKS5Password(conn); err != nil {
+			return "", "", err
+		}
+	}
+	userID, matchTerm, ok := fp.authenticate(cert, user, password, method == socks5AuthPassword)
+	if method == socks5AuthPassword {
+		status := byte(0)
+		if !ok {
+			status = 1
+		}
+		if _, err := conn.Write([]byte{0x01, status}); err != nil {
+			return "", "", err
+		}
+	}
+	if !ok {
+		be.recordEvent("SOCKS5 auth failed")
+		return "", "", fmt.Errorf("%w for %q", errSOCKS5AuthFailed, user)
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", "", err
+	}
+	if req[0] != socks5Version {
+		return "", "", fmt.Errorf("unexpected version %d", req[0])
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKS5Reply(conn, socks5AddrNotSupported, nil)
+		return "", "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", "", err
+	}
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(conn, socks5CmdNotSupported, nil)
+		return "", "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	if host == "" {
+		writeSOCKS5Reply(conn, socks5GeneralFailure, nil)
+		return "", "", errors.New("empty host name")
+	}
+	host = normalizeDestinationHost(host)
+	portStr := strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))
+	if !fp.allows(matchTerm, "tcp", host, portStr) {
+		be.recordEvent(fmt.Sprintf("deny SOCKS5 %s to %s", userID, idnaToUnicode(host)))
+		writeSOCKS5Reply(conn, socks5NotAllowed, nil)
+		return "", "", fmt.Errorf("%s is not allowed to connect to %s", userID, net.JoinHostPort(host, portStr))
+	}
+	be.recordEvent(fmt.Sprintf("allow SOCKS5 %s to %s", userID, idnaToUnicode(host)))
+	return userID, net.JoinHostPort(host, portStr), nil
+}
+
+// readSOCKS5Password reads a username/password request (RFC 1929).
+func readSOCKS5Password(r io.Reader) (string, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != 0x01 {
+		return "", "", fmt.Errorf("unexpected auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, n[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+	return string(user), string(password), nil
+}
+
+// writeSOCKS5Reply sends a reply to the client's request. addr is the local
+// address of the connection to the destination, if there is one.
+func writeSOCKS5Reply(w io.Writer, code byte, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	if a, ok := addr.(*net.TCPAddr); ok && a.IP != nil {
+		ip, port = a.IP, a.Port
+	}
+	b := []byte{socks5Version, code, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := w.Write(b)
+	return err
+}
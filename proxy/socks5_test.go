@@ -0,0 +1,126 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	xproxy "golang.org/x/net/proxy"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+type tlsDialer struct {
+	tc *tls.Config
+}
+
+func (d tlsDialer) Dial(network, addr string) (net.Conn, error) {
+	return tls.Dial(network, addr, d.tc)
+}
+
+func TestSOCKS5(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	dest := newTCPServer(t, ctx, "destination", nil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt.GenerateFromPassword: %v", err)
+	}
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"socks.example.com"},
+				Mode:        ModeSOCKS5,
+				ForwardProxy: &ForwardProxy{
+					Users: []*ForwardProxyUser{
+						{Name: "alice", PasswordHash: string(hash)},
+						{Name: "bob", PasswordHash: string(hash)},
+					},
+					Rules: []*ForwardProxyRule{
+						{
+							ACL:          &[]string{"USER:alice"},
+							Destinations: []string{"127.0.0.0/8:*", "[::1]:*"},
+						},
+					},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(user, password string) (string, error) {
+		var auth *xproxy.Auth
+		if user != "" {
+			auth = &xproxy.Auth{User: user, Password: password}
+		}
+		d, err := xproxy.SOCKS5("tcp", proxy.listener.Addr().String(), auth, tlsDialer{tc: &tls.Config{
+			ServerName: "socks.example.com",
+			RootCAs:    ca.RootCACertPool(),
+		}})
+		if err != nil {
+			return "", err
+		}
+		c, err := d.Dial("tcp", dest.listener.Addr().String())
+		if err != nil {
+			return "", err
+		}
+		defer c.Close()
+		b, err := io.ReadAll(c)
+		return string(b), err
+	}
+
+	if got, err := get("alice", "secret"); err != nil || got != "Hello from destination\n" {
+		t.Errorf("get(alice) = %q, %v", got, err)
+	}
+	for _, tc := range []struct {
+		user, password, wantErr string
+	}{
+		{"bob", "secret", "connection not allowed by ruleset"},
+		{"alice", "wrong", "username/password authentication failed"},
+		{"", "", "no acceptable authentication methods"},
+	} {
+		if _, err := get(tc.user, tc.password); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("get(%q, %q) = %v, want %q", tc.user, tc.password, err, tc.wantErr)
+		}
+	}
+}
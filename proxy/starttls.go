@@ -0,0 +1,299 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+const (
+	// ldapStartTLSOID is the name of the StartTLS extended operation
+	// (RFC 4511, section 4.14).
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	// maxStartTLSLine is the maximum length of the lines that the backend
+	// server sends before the TLS handshake.
+	maxStartTLSLine = 4096
+)
+
+// startTLS performs the protocol-specific preamble that asks the backend
+// server to start a TLS handshake on conn. It returns the server's greeting,
+// if any, which should be sent to the client after the handshake.
+func (st *StartTLS) startTLS(conn net.Conn) ([]byte, error) {
+	r := bufio.NewReaderSize(conn, maxStartTLSLine)
+	var greeting []byte
+	var err error
+	switch st.Protocol {
+	case StartTLSSMTP:
+		greeting, err = st.startTLSSMTP(conn, r)
+	case StartTLSIMAP:
+		greeting, err = startTLSIMAP(conn, r)
+	case StartTLSPOP3:
+		greeting, err = startTLSPOP3(conn, r)
+	case StartTLSLDAP:
+		err = startTLSLDAP(conn, r)
+	default:
+		err = fmt.Errorf("unexpected protocol %q", st.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s starttls: %w", st.Protocol, err)
+	}
+	if r.Buffered() > 0 {
+		return nil, fmt.Errorf("%s starttls: unexpected data before handshake", st.Protocol)
+	}
+	return greeting, nil
+}
+
+func (st *StartTLS) startTLSSMTP(w io.Writer, r *bufio.Reader) ([]byte, error) {
+	greeting, err := readSMTPReply(r, "220")
+	if err != nil {
+		return nil, err
+	}
+	name := st.EHLOName
+	if name == "" {
+		name = "localhost"
+	}
+	if _, err := fmt.Fprintf(w, "EHLO %s\r\n", name); err != nil {
+		return nil, err
+	}
+	ehlo, err := readSMTPReply(r, "250")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(bytes.ToUpper(ehlo), []byte("STARTTLS")) {
+		return nil, errors.New("server doesn't support STARTTLS")
+	}
+	if _, err := io.WriteString(w, "STARTTLS\r\n"); err != nil {
+		return nil, err
+	}
+	if _, err := readSMTPReply(r, "220"); err != nil {
+		return nil, err
+	}
+	return greeting, nil
+}
+
+// readSMTPReply reads a reply, which can span multiple lines, and checks its
+// status code.
+func readSMTPReply(r *bufio.Reader, code string) ([]byte, error) {
+	var reply []byte
+	for {
+		line, err := readStartTLSLine(r)
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, line...)
+		if len(line) < 4 || string(line[:3]) != code {
+			return nil, fmt.Errorf("unexpected reply %q", strings.TrimSpace(string(line)))
+		}
+		if line[3] != '-' {
+			return reply, nil
+		}
+	}
+}
+
+func startTLSIMAP(w io.Writer, r *bufio.Reader) ([]byte, error) {
+	greeting, err := readStartTLSLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(greeting, []byte("* OK")) {
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(string(greeting)))
+	}
+	if _, err := io.WriteString(w, "A1 STARTTLS\r\n"); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := readStartTLSLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(line, []byte("* ")) {
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("A1 OK")) {
+			return nil, fmt.Errorf("unexpected response %q", strings.TrimSpace(string(line)))
+		}
+		return greeting, nil
+	}
+}
+
+func startTLSPOP3(w io.Writer, r *bufio.Reader) ([]byte, error) {
+	greeting, err := readStartTLSLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(greeting, []byte("+OK")) {
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(string(greeting)))
+	}
+	if _, err := io.WriteString(w, "STLS\r\n"); err != nil {
+		return nil, err
+	}
+	line, err := readStartTLSLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(line, []byte("+OK")) {
+		return nil, fmt.Errorf("unexpected response %q", strings.TrimSpace(string(line)))
+	}
+	return greeting, nil
+}
+
+// startTLSLDAP sends a StartTLS extended request and checks that the result
+// code of the extended response is success.
+func startTLSLDAP(w io.Writer, r *bufio.Reader) error {
+	var b cryptobyte.Builder
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(1)
+		b.AddASN1(ldapApplicationTag(23), func(b *cryptobyte.Builder) {
+			b.AddASN1(cbasn1.Tag(0).ContextSpecific(), func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(ldapStartTLSOID))
+			})
+		})
+	})
+	req, err := b.Bytes()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(req); err != nil {
+		return err
+	}
+	msg, err := readLDAPMessage(r)
+	if err != nil {
+		return err
+	}
+	var (
+		s        = cryptobyte.String(msg)
+		seq      cryptobyte.String
+		id       int64
+		resp     cryptobyte.String
+		respTag  cbasn1.Tag
+		result   cryptobyte.String
+		resultOK bool
+	)
+	if !s.ReadASN1(&seq, cbasn1.SEQUENCE) || !seq.ReadASN1Integer(&id) || !seq.ReadAnyASN1(&resp, &respTag) {
+		return errors.New("invalid response")
+	}
+	if id != 1 || respTag != ldapApplicationTag(24) {
+		return fmt.Errorf("unexpected response, id %d tag %#x", id, uint8(respTag))
+	}
+	if resp.ReadASN1(&result, cbasn1.ENUM) && len(result) == 1 {
+		resultOK = result[0] == 0
+	}
+	if !resultOK {
+		return fmt.Errorf("unexpected result code %v", []byte(result))
+	}
+	return nil
+}
+
+// ldapApplicationTag returns the constructed APPLICATION tag n, e.g. 23 for
+// ExtendedRequest and 24 for ExtendedResponse.
+func ldapApplicationTag(n uint8) cbasn1.Tag {
+	return cbasn1.Tag(n).Constructed() | 0x40
+}
+
+// readLDAPMessage reads one BER-encoded LDAPMessage. Only the definite
+// length form is supported, as required by RFC 4511.
+func readLDAPMessage(r *bufio.Reader) ([]byte, error) {
+	hdr, err := r.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != byte(cbasn1.SEQUENCE) {
+		return nil, fmt.Errorf("unexpected tag %#x", hdr[0])
+	}
+	hdrLen, length := 2, int(hdr[1])
+	if hdr[1]&0x80 != 0 {
+		n := int(hdr[1] & 0x7f)
+		if n == 0 || n > 2 {
+			return nil, errors.New("unsupported length")
+		}
+		if hdr, err = r.Peek(2 + n); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, c := range hdr[2:] {
+			length = length<<8 | int(c)
+		}
+		hdrLen += n
+	}
+	if hdrLen+length > maxStartTLSLine {
+		return nil, errors.New("response too long")
+	}
+	msg := make([]byte, hdrLen+length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func readStartTLSLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errors.New("line too long")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(line), nil
+}
+
+// dialStartTLS upgrades the plaintext connection c to TLS after the
+// protocol-specific preamble, e.g. STARTTLS, and returns a connection whose
+// first bytes are the backend server's greeting, if any, so that the client
+// sees the same thing as with implicit TLS.
+func (be *Backend) dialStartTLS(ctx context.Context, c net.Conn, tc *tls.Config, timeout time.Duration, preamble func(net.Conn) ([]byte, error)) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	greeting, err := preamble(c)
+	if err != nil {
+		c.Close()
+		be.recordEvent("starttls error")
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConn := tls.Client(c, tc)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(greeting) == 0 {
+		return tlsConn, nil
+	}
+	return &bufferedConn{
+		Conn: tlsConn,
+		r:    io.MultiReader(bytes.NewReader(greeting), tlsConn),
+	}, nil
+}
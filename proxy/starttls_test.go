@@ -0,0 +1,226 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+// newStartTLSServer starts a backend server that speaks just enough of the
+// protocol to accept STARTTLS.
+func newStartTLSServer(t *testing.T, ctx context.Context, protocol string, tc *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	serve := func(conn net.Conn) error {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		expect := func(want string) error {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if line != want {
+				return fmt.Errorf("got %q, want %q", line, want)
+			}
+			return nil
+		}
+		switch protocol {
+		case StartTLSSMTP:
+			io.WriteString(conn, "220 smtp.example.com ESMTP\r\n")
+			if err := expect("EHLO localhost\r\n"); err != nil {
+				return err
+			}
+			io.WriteString(conn, "250-smtp.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+			if err := expect("STARTTLS\r\n"); err != nil {
+				return err
+			}
+			io.WriteString(conn, "220 Go ahead\r\n")
+		case StartTLSIMAP:
+			io.WriteString(conn, "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n")
+			if err := expect("A1 STARTTLS\r\n"); err != nil {
+				return err
+			}
+			io.WriteString(conn, "A1 OK Begin TLS negotiation now\r\n")
+		case StartTLSPOP3:
+			io.WriteString(conn, "+OK POP3 ready\r\n")
+			if err := expect("STLS\r\n"); err != nil {
+				return err
+			}
+			io.WriteString(conn, "+OK Begin TLS negotiation\r\n")
+		case StartTLSLDAP:
+			msg, err := readLDAPMessage(r)
+			if err != nil {
+				return err
+			}
+			if want := "\x30\x1d\x02\x01\x01\x77\x18\x80\x16" + ldapStartTLSOID; string(msg) != want {
+				return fmt.Errorf("got %q, want %q", msg, want)
+			}
+			conn.Write([]byte("\x30\x0c\x02\x01\x01\x78\x07\x0a\x01\x00\x04\x00\x04\x00"))
+		}
+		tlsConn := tls.Server(conn, tc)
+		fmt.Fprintf(tlsConn, "Hello from %s\n", protocol)
+		return tlsConn.Close()
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					t.Errorf("[%s] Accept: %v", protocol, err)
+				}
+				return
+			}
+			go func() {
+				if err := serve(conn); err != nil {
+					t.Errorf("[%s] %v", protocol, err)
+				}
+			}()
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	return l
+}
+
+func TestStartTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+	}
+	for _, protocol := range validStartTLSProtocols {
+		l := newStartTLSServer(t, ctx, protocol, intCA.TLSConfig())
+		cfg.Backends = append(cfg.Backends, &Backend{
+			ServerNames:       []string{protocol + ".example.com"},
+			Addresses:         []string{l.Addr().String()},
+			Mode:              ModeTLS,
+			ForwardRootCAs:    []string{intCA.RootCAPEM()},
+			ForwardServerName: protocol + "-internal.example.com",
+			StartTLS:          &StartTLS{Protocol: protocol},
+		})
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for _, tc := range []struct {
+		protocol, want string
+	}{
+		{StartTLSSMTP, "220 smtp.example.com ESMTP\r\nHello from smtp\n"},
+		{StartTLSIMAP, "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\nHello from imap\n"},
+		{StartTLSPOP3, "+OK POP3 ready\r\nHello from pop3\n"},
+		{StartTLSLDAP, "Hello from ldap\n"},
+	} {
+		got, _, err := tlsGet(tc.protocol+".example.com", proxy.listener.Addr().String(), "", extCA, nil, nil)
+		if err != nil {
+			t.Fatalf("[%s] tlsGet: %v", tc.protocol, err)
+		}
+		if got != tc.want {
+			t.Errorf("[%s] Got %q, want %q", tc.protocol, got, tc.want)
+		}
+	}
+}
+
+func TestStartTLSFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	// The bad server doesn't send the SMTP greeting.
+	bad := newTCPServer(t, ctx, "bad", nil)
+	good := newStartTLSServer(t, ctx, StartTLSSMTP, intCA.TLSConfig())
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames:       []string{"smtp.example.com"},
+				Addresses:         []string{bad.listener.Addr().String(), good.Addr().String()},
+				Mode:              ModeTLS,
+				ForwardRootCAs:    []string{intCA.RootCAPEM()},
+				ForwardServerName: "smtp-internal.example.com",
+				StartTLS:          &StartTLS{Protocol: StartTLSSMTP},
+				CircuitBreaker:    &CircuitBreaker{},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	for i := range 4 {
+		got, _, err := tlsGet("smtp.example.com", proxy.listener.Addr().String(), "", extCA, nil, nil)
+		if err != nil {
+			t.Fatalf("[%d] tlsGet: %v", i, err)
+		}
+		if want := "220 smtp.example.com ESMTP\r\nHello from smtp\n"; got != want {
+			t.Errorf("[%d] Got %q, want %q", i, got, want)
+		}
+	}
+	badAddr := bad.listener.Addr().String()
+	if got, want := proxy.cfg.Backends[0].unhealthyAddresses(), []string{badAddr}; !slices.Equal(got, want) {
+		t.Errorf("unhealthyAddresses() = %v, want %v", got, want)
+	}
+}
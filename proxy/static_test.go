@@ -32,6 +32,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/c2FmZQ/tlsproxy/certmanager"
@@ -209,6 +210,127 @@ func TestStaticFiles(t *testing.T) {
 	}
 }
 
+func TestStaticFilesOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+
+	docRoot := t.TempDir()
+	for name, content := range map[string]string{
+		"default.html":     "default",
+		"foo/bar.txt":      "0123456789",
+		"foo/baz/file.txt": "baz",
+		"foo/.secret":      "secret",
+		"foo/<b>.txt":      "html",
+	} {
+		fname := filepath.Join(docRoot, name)
+		os.MkdirAll(filepath.Dir(fname), 0o755)
+		if err := os.WriteFile(fname, []byte(content), 0o644); err != nil {
+			t.Fatalf("os.WriteFile(%s): %v", name, err)
+		}
+	}
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{
+						"www.example.com",
+					},
+					Mode:         "LOCAL",
+					DocumentRoot: docRoot,
+					StaticFiles: &StaticFiles{
+						IndexFiles:       []string{"index.html", "default.html"},
+						DirectoryListing: true,
+						CacheControl:     "public, max-age=60",
+					},
+				},
+			},
+		},
+		ca,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs: ca.RootCACertPool(),
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", proxy.listener.Addr().String())
+	}
+	client := http.Client{
+		Transport: transport,
+	}
+	get := func(path string, header http.Header) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "https://www.example.com"+path, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest: %v", err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: get failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: body read: %v", path, err)
+		}
+		return resp, string(body)
+	}
+
+	resp, body := get("/", nil)
+	if got, want := body, "default"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	if got, want := resp.Header.Get("Cache-Control"), "public, max-age=60"; got != want {
+		t.Errorf("Cache-Control = %q, want %q", got, want)
+	}
+
+	resp, body = get("/foo/", nil)
+	if got, want := resp.StatusCode, 200; got != want {
+		t.Errorf("Code = %v, want %v", got, want)
+	}
+	for _, want := range []string{`href="bar.txt"`, `href="baz/"`, `href="%3Cb%3E.txt">&lt;b&gt;.txt</a>`, `href="../"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Directory listing doesn't contain %q: %s", want, body)
+		}
+	}
+	if strings.Contains(body, "secret") {
+		t.Errorf("Directory listing contains hidden file: %s", body)
+	}
+
+	resp, body = get("/foo/bar.txt", http.Header{"Range": {"bytes=2-4"}})
+	if got, want := resp.StatusCode, http.StatusPartialContent; got != want {
+		t.Errorf("Code = %v, want %v", got, want)
+	}
+	if got, want := body, "234"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+	etag := resp.Header.Get("Etag")
+	if etag == "" {
+		t.Fatal("Etag is not set")
+	}
+	resp, _ = get("/foo/bar.txt", http.Header{"If-None-Match": {etag}})
+	if got, want := resp.StatusCode, http.StatusNotModified; got != want {
+		t.Errorf("Code = %v, want %v", got, want)
+	}
+}
+
 func TestPathClean(t *testing.T) {
 	for _, tc := range []struct {
 		in, out string
@@ -0,0 +1,259 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/keystore"
+)
+
+// staticCertCheckInterval is how often the certificate and key files are
+// checked for changes.
+const staticCertCheckInterval = 10 * time.Second
+
+// staticCert is a certificate and private key that are configured by the
+// user, as opposed to being obtained with ACME. They are reloaded when the
+// files change.
+type staticCert struct {
+	certFile string
+	keyFile  string
+	// signer is the private key when it is in a key store, instead of
+	// keyFile.
+	signer crypto.Signer
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTimes  [2]time.Time
+	lastCheck time.Time
+}
+
+func newStaticCert(certFile, keyFile string) (*staticCert, error) {
+	sc := &staticCert{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	sc.modTimes = sc.fileModTimes()
+	if err := sc.load(); err != nil {
+		return nil, err
+	}
+	sc.lastCheck = time.Now()
+	return sc, nil
+}
+
+// loadStaticCerts loads the certificates of the backends, and of their
+// ForwardClientCert, that have a CertFile. The key stores must already be
+// set up by cfg.Check().
+func (cfg *Config) loadStaticCerts() error {
+	keyStores := make(map[string]*ConfigKeyStore)
+	for _, ks := range cfg.KeyStores {
+		keyStores[ks.Name] = ks
+	}
+	load := func(certFile, keyFile, keyStore, keyID string) (*staticCert, error) {
+		if ks := keyStores[keyStore]; ks != nil {
+			return newStaticCertWithKeyStore(certFile, ks.provider, keyID)
+		}
+		return newStaticCert(certFile, keyFile)
+	}
+	for i, be := range cfg.Backends {
+		be.staticCert = nil
+		if be.CertFile != "" {
+			sc, err := load(be.CertFile, be.KeyFile, be.KeyStore, be.KeyID)
+			if err != nil {
+				return fmt.Errorf("backend[%d].CertFile: %w", i, err)
+			}
+			be.staticCert = sc
+		}
+		if fc := be.ForwardClientCert; fc != nil {
+			fc.staticCert = nil
+			if fc.CertFile != "" {
+				sc, err := load(fc.CertFile, fc.KeyFile, fc.KeyStore, fc.KeyID)
+				if err != nil {
+					return fmt.Errorf("backend[%d].ForwardClientCert.CertFile: %w", i, err)
+				}
+				fc.staticCert = sc
+			}
+		}
+	}
+	return nil
+}
+
+// newStaticCertWithKeyStore returns a staticCert whose private key is keyID
+// in a key store. Only the certificate file is reloaded when it changes.
+func newStaticCertWithKeyStore(certFile string, ks keystore.Provider, keyID string) (*staticCert, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	signer, err := ks.Signer(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	sc := &staticCert{
+		certFile: certFile,
+		signer:   signer,
+	}
+	sc.modTimes = sc.fileModTimes()
+	if err := sc.load(); err != nil {
+		return nil, err
+	}
+	sc.lastCheck = time.Now()
+	return sc, nil
+}
+
+func (sc *staticCert) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if time.Since(sc.lastCheck) < staticCertCheckInterval {
+		return sc.cert, nil
+	}
+	sc.lastCheck = time.Now()
+	if mt := sc.fileModTimes(); mt != sc.modTimes {
+		if err := sc.load(); err != nil {
+			// Keep using the previous certificate. The files may be
+			// in the middle of being updated.
+			log.Printf("ERR Reloading %s: %v", sc.certFile, err)
+			return sc.cert, nil
+		}
+		sc.modTimes = mt
+		log.Printf("INF Reloaded %s", sc.certFile)
+	}
+	return sc.cert, nil
+}
+
+// reload loads the certificate and key files immediately, without waiting
+// for the next check interval.
+func (sc *staticCert) reload() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	mt := sc.fileModTimes()
+	if err := sc.load(); err != nil {
+		return err
+	}
+	sc.modTimes = mt
+	sc.lastCheck = time.Now()
+	return nil
+}
+
+// current returns the certificate that is currently in use.
+func (sc *staticCert) current() *tls.Certificate {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.cert
+}
+
+func (sc *staticCert) fileModTimes() [2]time.Time {
+	var mt [2]time.Time
+	for i, f := range []string{sc.certFile, sc.keyFile} {
+		if !isFileName(f) {
+			continue
+		}
+		if fi, err := os.Stat(f); err == nil {
+			mt[i] = fi.ModTime()
+		}
+	}
+	return mt
+}
+
+func (sc *staticCert) load() error {
+	certPEM, err := fileOrPEM(sc.certFile)
+	if err != nil {
+		return err
+	}
+	var cert tls.Certificate
+	if sc.signer != nil {
+		cert, err = certificateWithSigner(certPEM, sc.signer)
+	} else {
+		var keyPEM []byte
+		if keyPEM, err = fileOrPEM(sc.keyFile); err != nil {
+			return err
+		}
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	}
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return errors.New("certificate is expired")
+	}
+	sc.cert = &cert
+	return nil
+}
+
+// certificateWithSigner returns a tls.Certificate with the certificate chain in
+// certPEM and signer as private key.
+func certificateWithSigner(certPEM []byte, signer crypto.Signer) (tls.Certificate, error) {
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		if block, certPEM = pem.Decode(certPEM); block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return cert, errors.New("private key does not match public key")
+	}
+	cert.Leaf = leaf
+	cert.PrivateKey = signer
+	return cert, nil
+}
+
+// isFileName returns true if s is the name of a file, as opposed to
+// PEM-encoded data.
+func isFileName(s string) bool {
+	return len(s) > 0 && s[0] == '/'
+}
+
+// fileOrPEM returns the content of the file if s is a file name, or s itself
+// otherwise.
+func fileOrPEM(s string) ([]byte, error) {
+	if isFileName(s) {
+		return os.ReadFile(s)
+	}
+	return []byte(s), nil
+}
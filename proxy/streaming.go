@@ -0,0 +1,81 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// streamWriter flushes the streamed responses after each write, starting with
+// the headers, so that server-sent events and long-polling responses reach the
+// clients without delay. A response is streamed when stream is set, when its
+// content type is text/event-stream, or when the backend sets the
+// X-Accel-Buffering: no header, like with nginx.
+type streamWriter struct {
+	http.ResponseWriter
+	stream      bool
+	wroteHeader bool
+}
+
+func (w *streamWriter) WriteHeader(code int) {
+	if code >= 200 && !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if strings.EqualFold(h.Get(xAccelBufferingHeader), "no") {
+			w.stream = true
+		}
+		h.Del(xAccelBufferingHeader)
+		if mt, _, _ := mime.ParseMediaType(h.Get("Content-Type")); mt == "text/event-stream" {
+			w.stream = true
+		}
+		w.ResponseWriter.WriteHeader(code)
+		if w.stream {
+			w.Flush()
+		}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil && w.stream {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *streamWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController.
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestStreaming(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	release := make(chan struct{})
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+		case req.URL.Path == "/accel":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(xAccelBufferingHeader, "no")
+			w.Header().Set("Content-Length", "10")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "10")
+		}
+		w.Write([]byte("hello"))
+		http.NewResponseController(w).Flush()
+		select {
+		case <-release:
+		case <-req.Context().Done():
+			return
+		}
+		w.Write([]byte("world"))
+	}))
+	defer be.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{strings.TrimPrefix(be.URL, "http://")},
+				Mode:        "HTTP",
+				Compression: &Compression{MinSize: 1},
+				Streaming: &Streaming{
+					Paths: []string{"/stream/"},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+					ServerName: "www.example.com",
+					RootCAs:    extCA.RootCACertPool(),
+				})
+			},
+			DisableCompression: true,
+		},
+	}
+	// readFirst returns the first bytes of the response, or an empty
+	// string if they don't arrive while the backend is blocked.
+	readFirst := func(path string) (string, http.Header) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://www.example.com"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", nil
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, 5)
+		n, _ := io.ReadFull(resp.Body, buf)
+		return string(buf[:n]), resp.Header
+	}
+
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/events", "hello"},
+		{"/accel", "hello"},
+		{"/stream/foo", "hello"},
+		{"/foo", ""},
+	} {
+		got, h := readFirst(tc.path)
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.path, got, tc.want)
+		}
+		if h == nil {
+			continue
+		}
+		if v := h.Get("Content-Encoding"); v != "" {
+			t.Errorf("%s: Content-Encoding = %q", tc.path, v)
+		}
+		if v := h.Get(xAccelBufferingHeader); v != "" {
+			t.Errorf("%s: %s = %q", tc.path, xAccelBufferingHeader, v)
+		}
+	}
+	close(release)
+	client.CloseIdleConnections()
+}
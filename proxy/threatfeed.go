@@ -0,0 +1,86 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/netw"
+)
+
+// threatFeed returns the threat feed that contains addr's IP address, or nil.
+// The match is counted as a drop.
+func (p *Proxy) threatFeed(addr net.Addr) (*ipList, *ConfigThreatFeeds) {
+	p.mu.RLock()
+	tf := p.cfg.ThreatFeeds
+	feeds := p.threatFeeds
+	p.mu.RUnlock()
+	if tf == nil || len(feeds) == 0 {
+		return nil, nil
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return nil, nil
+	}
+	for _, n := range tf.exemptIPs {
+		if n.Contains(ip) {
+			return nil, nil
+		}
+	}
+	for _, l := range feeds {
+		if l.contains(ip) {
+			l.drops.Add(1)
+			p.recordEvent("threat feed " + l.cfg.Name)
+			return l, tf
+		}
+	}
+	return nil, nil
+}
+
+// threatFeedDrop returns true when conn must be closed because the client's
+// IP address is in a threat feed. With the tarpit action, it returns after
+// TarpitDelay.
+func (p *Proxy) threatFeedDrop(conn *netw.Conn) bool {
+	l, tf := p.threatFeed(conn.RemoteAddr())
+	if l == nil {
+		return false
+	}
+	log.Printf("BAD [-] %s: in threat feed %q", conn.RemoteAddr(), l.cfg.Name)
+	if tf.Action == RejectTarpit {
+		timer := time.NewTimer(tf.TarpitDelay)
+		defer timer.Stop()
+		select {
+		case <-p.ctx.Done():
+		case <-timer.C:
+		}
+	}
+	return true
+}
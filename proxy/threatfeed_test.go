@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestThreatFeeds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	file := filepath.Join(t.TempDir(), "drop.txt")
+	if err := os.WriteFile(file, []byte("; Spamhaus DROP List\n192.0.2.0/24 ; SBL1\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        "TCP",
+			},
+		},
+		IPLists: []*ConfigIPList{
+			{Name: "drop", Source: file},
+		},
+		ThreatFeeds: &ConfigThreatFeeds{
+			IPLists: []string{"nope"},
+		},
+	}
+	if err := cfg.Check(); err == nil || !strings.Contains(err.Error(), "threatFeeds.IPLists[0]") {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	cfg.ThreatFeeds.IPLists = []string{"drop"}
+	cfg.ThreatFeeds.Action = "alert"
+	if err := cfg.Check(); err == nil || !strings.Contains(err.Error(), "threatFeeds.Action") {
+		t.Fatalf("cfg.Check() = %v", err)
+	}
+	cfg.ThreatFeeds.Action = ""
+
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	dial := func() error {
+		conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	if err := dial(); err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	// Add the loopback address to the feed.
+	if err := os.WriteFile(file, []byte("192.0.2.0/24\n127.0.0.0/8\n::1\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	if err := proxy.ipLists["drop"].load(ctx); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := dial(); err == nil {
+		t.Fatal("dial should fail")
+	}
+	if got, want := proxy.ipLists["drop"].drops.Load(), int64(1); got != want {
+		t.Errorf("drops = %d, want %d", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.prometheusHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		`tlsproxy_threat_feed_drops_total{feed="drop"} 1`,
+		`tlsproxy_threat_feed_entries{feed="drop"} 3`,
+		`tlsproxy_events_total{event="threat feed drop"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+
+	cfg = cfg.clone()
+	cfg.ThreatFeeds.Action = "tarpit"
+	cfg.ThreatFeeds.TarpitDelay = 500 * time.Millisecond
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	start := time.Now()
+	if err := dial(); err == nil {
+		t.Error("tarpit: dial should fail")
+	}
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("tarpit: connection closed after %s", d)
+	}
+
+	cfg = cfg.clone()
+	cfg.ThreatFeeds.ExemptIPs = []string{"127.0.0.1/32", "::1/128"}
+	if err := proxy.Reconfigure(cfg); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	if err := dial(); err != nil {
+		t.Errorf("exempt: dial: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxTranscriptHistorySize = 10000
+
+// keyLogWriter writes the TLS session secrets to TLSDebug.KeyLogFile, in
+// the NSS key log format. The same writer is used by all the TLS configs,
+// and its file changes when the config is reloaded.
+type keyLogWriter struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func (w *keyLogWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return len(b), nil
+	}
+	return w.f.Write(b)
+}
+
+// setPath opens the key log file. An empty path closes the current file.
+func (w *keyLogWriter) setPath(path string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if path == w.path {
+		return nil
+	}
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return fmt.Errorf("tlsDebug.keyLogFile: %w", err)
+		}
+		log.Printf("WRN TLS key log enabled: the TLS traffic can be decrypted with the secrets in %s", path)
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.path, w.f = path, f
+	return nil
+}
+
+// setTLSDebug applies the TLSDebug config. It is called after the rest of
+// the config is accepted, so that a config that is rejected doesn't change
+// the key log file.
+func (p *Proxy) setTLSDebug(cfg *ConfigTLSDebug) error {
+	var path string
+	var size int
+	if cfg != nil {
+		path, size = cfg.KeyLogFile, cfg.Transcripts
+	}
+	if path != "" && p.keyLog == nil {
+		p.keyLog = &keyLogWriter{}
+	}
+	if p.keyLog != nil {
+		if err := p.keyLog.setPath(path); err != nil {
+			return err
+		}
+	}
+	p.transcripts.resize(size)
+	return nil
+}
+
+// setKeyLogWriter makes tc write its session secrets to the key log file,
+// if there is one.
+func (p *Proxy) setKeyLogWriter(tc *tls.Config, cfg *ConfigTLSDebug) {
+	if cfg != nil && cfg.KeyLogFile != "" {
+		if p.keyLog == nil {
+			p.keyLog = &keyLogWriter{}
+		}
+		tc.KeyLogWriter = p.keyLog
+	}
+}
+
+// handshakeTranscript is a record of the steps of the TLS handshake of one
+// connection, to debug interop problems with clients.
+type handshakeTranscript struct {
+	ConnID     uint64           `json:"connId"`
+	Type       string           `json:"type"`
+	SourceAddr string           `json:"sourceAddr"`
+	StartTime  time.Time        `json:"startTime"`
+	Closed     bool             `json:"closed"`
+	Steps      []transcriptStep `json:"steps"`
+
+	mu sync.Mutex
+}
+
+type transcriptStep struct {
+	Elapsed string   `json:"elapsed"`
+	Name    string   `json:"name"`
+	Details []string `json:"details,omitempty"`
+}
+
+func (t *handshakeTranscript) add(name string, details ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Steps = append(t.Steps, transcriptStep{
+		Elapsed: time.Since(t.StartTime).Truncate(time.Microsecond).String(),
+		Name:    name,
+		Details: details,
+	})
+}
+
+func (t *handshakeTranscript) clone() *handshakeTranscript {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &handshakeTranscript{
+		ConnID:     t.ConnID,
+		Type:       t.Type,
+		SourceAddr: t.SourceAddr,
+		StartTime:  t.StartTime,
+		Closed:     t.Closed,
+		Steps:      append([]transcriptStep(nil), t.Steps...),
+	}
+}
+
+// transcriptLog keeps the transcripts of the most recent connections.
+type transcriptLog struct {
+	mu   sync.Mutex
+	buf  []*handshakeTranscript
+	next int
+	full bool
+}
+
+func (l *transcriptLog) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buf) > 0
+}
+
+func (l *transcriptLog) resize(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n == len(l.buf) {
+		return
+	}
+	if n == 0 {
+		l.buf, l.next, l.full = nil, 0, false
+		return
+	}
+	all := l.allLocked()
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	l.buf = make([]*handshakeTranscript, n)
+	l.next = copy(l.buf, all) % n
+	l.full = len(all) == n
+}
+
+func (l *transcriptLog) add(t *handshakeTranscript) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) == 0 {
+		return
+	}
+	l.buf[l.next] = t
+	l.next = (l.next + 1) % len(l.buf)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// all returns the transcripts, from oldest to newest.
+func (l *transcriptLog) all() []*handshakeTranscript {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.allLocked()
+}
+
+func (l *transcriptLog) allLocked() []*handshakeTranscript {
+	if !l.full {
+		return append([]*handshakeTranscript(nil), l.buf[:l.next]...)
+	}
+	return append(append([]*handshakeTranscript(nil), l.buf[l.next:]...), l.buf[:l.next]...)
+}
+
+// startTranscript starts recording the handshake of conn, when transcripts
+// are enabled. The transcript is added to the history when the connection
+// is closed.
+func (p *Proxy) startTranscript(conn annotatedConnection, connType string) {
+	if !p.transcripts.enabled() {
+		return
+	}
+	t := &handshakeTranscript{
+		ConnID:     connID(conn),
+		Type:       connType,
+		SourceAddr: conn.RemoteAddr().Network() + ":" + conn.RemoteAddr().String(),
+		StartTime:  conn.Annotation(startTimeKey, time.Now()).(time.Time),
+	}
+	conn.SetAnnotation(transcriptKey, t)
+}
+
+// endTranscript adds the transcript of conn to the history.
+func (p *Proxy) endTranscript(conn anyConn) {
+	t := connTranscript(conn)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.Closed = true
+	t.mu.Unlock()
+	t.add("closed")
+	p.transcripts.add(t)
+}
+
+func connTranscript(c anyConn) *handshakeTranscript {
+	if v, ok := annotatedConn(c).Annotation(transcriptKey, (*handshakeTranscript)(nil)).(*handshakeTranscript); ok {
+		return v
+	}
+	return nil
+}
+
+// addTranscriptStep adds a step to the transcript of conn, if it has one.
+func addTranscriptStep(conn anyConn, name string, details ...string) {
+	if t := connTranscript(conn); t != nil {
+		t.add(name, details...)
+	}
+}
+
+func transcriptClientHello(conn anyConn, hello clientHello) {
+	if connTranscript(conn) == nil {
+		return
+	}
+	versions := make([]string, 0, len(hello.SupportedVersions))
+	for _, v := range hello.SupportedVersions {
+		versions = append(versions, tlsVersionName(v))
+	}
+	suites := make([]string, 0, len(hello.CipherSuites))
+	for _, v := range hello.CipherSuites {
+		suites = append(suites, tls.CipherSuiteName(v))
+	}
+	groups := make([]string, 0, len(hello.SupportedGroups))
+	for _, v := range hello.SupportedGroups {
+		groups = append(groups, tls.CurveID(v).String())
+	}
+	sigAlgs := make([]string, 0, len(hello.SignatureAlgorithms))
+	for _, v := range hello.SignatureAlgorithms {
+		sigAlgs = append(sigAlgs, tls.SignatureScheme(v).String())
+	}
+	exts := make([]string, 0, len(hello.Extensions))
+	for _, v := range hello.Extensions {
+		exts = append(exts, strconv.Itoa(int(v)))
+	}
+	addTranscriptStep(conn, "ClientHello",
+		"server name: "+hello.ServerName,
+		"legacy version: "+tlsVersionName(hello.Version),
+		"supported versions: "+strings.Join(versions, ", "),
+		"ALPN: "+strings.Join(hello.ALPNProtos, ", "),
+		"cipher suites: "+strings.Join(suites, ", "),
+		"groups: "+strings.Join(groups, ", "),
+		"signature algorithms: "+strings.Join(sigAlgs, ", "),
+		"extensions: "+strings.Join(exts, ", "),
+		"resumption: "+strconv.FormatBool(hello.Resumption),
+		"JA3: "+hello.ja3(),
+		"JA4: "+hello.ja4('t'),
+	)
+}
+
+func transcriptHandshake(conn anyConn, cs tls.ConnectionState) {
+	if connTranscript(conn) == nil {
+		return
+	}
+	client := "none"
+	if len(cs.PeerCertificates) > 0 {
+		client = cs.PeerCertificates[0].Subject.String()
+	}
+	addTranscriptStep(conn, "handshake complete",
+		"version: "+tlsVersionName(cs.Version),
+		"cipher suite: "+tls.CipherSuiteName(cs.CipherSuite),
+		"ALPN: "+cs.NegotiatedProtocol,
+		"resumed: "+strconv.FormatBool(cs.DidResume),
+		"client certificate: "+client,
+	)
+}
+
+func tlsVersionName(v uint16) string {
+	if v&0x0f0f == 0x0a0a {
+		return fmt.Sprintf("GREASE (0x%04X)", v)
+	}
+	return tls.VersionName(v)
+}
+
+// adminTranscripts returns the handshake transcripts of the open connections
+// and of the most recent closed connections. The connId parameter selects
+// the transcript of one connection.
+func (p *Proxy) adminTranscripts(req *http.Request) (any, error) {
+	var id uint64
+	if v := req.Form.Get("connId"); v != "" {
+		var err error
+		if id, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, errors.New("invalid connId")
+		}
+	}
+	var out []*handshakeTranscript
+	seen := make(map[*handshakeTranscript]bool)
+	for _, t := range p.transcripts.all() {
+		seen[t] = true
+		if id == 0 || t.ConnID == id {
+			out = append(out, t.clone())
+		}
+	}
+	for _, c := range p.inConns.slice() {
+		t := connTranscript(c)
+		if t == nil || seen[t] || (id != 0 && t.ConnID != id) {
+			continue
+		}
+		out = append(out, t.clone())
+	}
+	if id != 0 && len(out) == 0 {
+		return nil, errNotFound
+	}
+	if out == nil {
+		out = []*handshakeTranscript{}
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestTranscriptLog(t *testing.T) {
+	var l transcriptLog
+	l.add(&handshakeTranscript{ConnID: 1})
+	if got := len(l.all()); got != 0 {
+		t.Fatalf("len(all()) = %d, want 0", got)
+	}
+	l.resize(3)
+	for i := uint64(1); i <= 5; i++ {
+		l.add(&handshakeTranscript{ConnID: i})
+	}
+	ids := func() []uint64 {
+		var out []uint64
+		for _, tr := range l.all() {
+			out = append(out, tr.ConnID)
+		}
+		return out
+	}
+	if got, want := ids(), []uint64{3, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("all() = %v, want %v", got, want)
+	}
+	l.resize(2)
+	if got, want := ids(), []uint64{4, 5}; !slices.Equal(got, want) {
+		t.Errorf("all() = %v, want %v", got, want)
+	}
+	l.resize(0)
+	if l.enabled() {
+		t.Error("enabled() = true, want false")
+	}
+}
+
+func TestTLSDebug(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	keyLogFile := filepath.Join(t.TempDir(), "keylog")
+	be := newTCPServer(t, ctx, "backend", nil)
+	proxy := newTestProxy(&Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		TLSDebug: &ConfigTLSDebug{
+			KeyLogFile:  keyLogFile,
+			Transcripts: 10,
+		},
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+	addr := proxy.listener.Addr().String()
+
+	if _, _, err := tlsGet("www.example.com", addr, "", ca, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial: %v", err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	conn.Close()
+
+	for i := 0; len(proxy.transcripts.all()) < 2; i++ {
+		if i == 100 {
+			t.Fatalf("transcripts = %d, want 2", len(proxy.transcripts.all()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	keyLog, err := os.ReadFile(keyLogFile)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !strings.Contains(string(keyLog), "CLIENT_TRAFFIC_SECRET_0 ") {
+		t.Errorf("key log = %q, want CLIENT_TRAFFIC_SECRET_0", keyLog)
+	}
+
+	req := httptest.NewRequest("GET", "/api/transcripts", nil)
+	req.ParseForm()
+	v, err := proxy.adminTranscripts(req)
+	if err != nil {
+		t.Fatalf("adminTranscripts: %v", err)
+	}
+	var steps [][]string
+	for _, tr := range v.([]*handshakeTranscript) {
+		if !tr.Closed {
+			t.Errorf("transcript %d: closed = false, want true", tr.ConnID)
+		}
+		var names []string
+		for _, s := range tr.Steps {
+			names = append(names, s.Name)
+		}
+		steps = append(steps, names)
+	}
+	want := [][]string{
+		{"ClientHello", "backend", "handshake complete", "closed"},
+		{"event", "closed"},
+	}
+	if len(steps) != len(want) || strings.Join(steps[0], ",") != strings.Join(want[0], ",") || strings.Join(steps[1], ",") != strings.Join(want[1], ",") {
+		t.Errorf("transcript steps = %v, want %v", steps, want)
+	}
+
+	// A config that is rejected doesn't change the key log file.
+	otherKeyLogFile := filepath.Join(t.TempDir(), "other-keylog")
+	cfg := proxy.cfg.clone()
+	cfg.TLSDebug.KeyLogFile = otherKeyLogFile
+	cfg.AccessLog = &ConfigAccessLog{File: filepath.Join(keyLogFile, "access.log")}
+	if err := proxy.Reconfigure(cfg); err == nil {
+		t.Fatal("Reconfigure() succeeded, want error")
+	}
+	if _, err := os.Stat(otherKeyLogFile); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q) = %v, want not exist", otherKeyLogFile, err)
+	}
+	if got := proxy.keyLog.path; got != keyLogFile {
+		t.Errorf("key log path = %q, want %q", got, keyLogFile)
+	}
+
+	// The key log file can't be changed with the admin API.
+	cfg.AccessLog = nil
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("yaml.Marshal: %v", err)
+	}
+	req = httptest.NewRequest("POST", "/api/config/update", strings.NewReader(url.Values{"config": {string(b)}}.Encode()))
+	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	if _, err := proxy.adminUpdateConfig(req); err == nil || !strings.Contains(err.Error(), "can't be changed with the admin API") {
+		t.Errorf("adminUpdateConfig() = %v, want keyLogFile error", err)
+	}
+}
@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/tracing"
+)
+
+var connSpanMu sync.Mutex
+
+// connSpan returns the trace span of conn. The span is created when it is
+// first needed, with the connection's start time.
+func connSpan(conn anyConn) *tracing.Span {
+	be := connBackend(conn)
+	if be == nil || be.tracer == nil {
+		return nil
+	}
+	ac := annotatedConn(conn)
+	connSpanMu.Lock()
+	defer connSpanMu.Unlock()
+	if span, ok := ac.Annotation(traceSpanKey, nil).(*tracing.Span); ok {
+		return span
+	}
+	startTime := ac.Annotation(startTimeKey, time.Time{}).(time.Time)
+	span := be.tracer.Start("connection", tracing.KindServer, tracing.SpanContext{}, startTime)
+	span.SetAttribute("client.address", conn.RemoteAddr().String())
+	span.SetAttribute("server.address", idnaToUnicode(connServerName(conn)))
+	span.SetAttribute("tlsproxy.mode", connMode(conn))
+	if proto := connProto(conn); proto != "" {
+		span.SetAttribute("tls.alpn", proto)
+	}
+	if sum := certSummary(connClientCert(conn)); sum != "" {
+		span.SetAttribute("tls.client.subject", sum)
+	}
+	ac.SetAnnotation(traceSpanKey, span)
+	return span
+}
+
+// endConnSpan records the handshake, dial, and bridge phases of conn in its
+// trace span, and ends it.
+func endConnSpan(conn anyConn) {
+	span := connSpan(conn)
+	if span == nil {
+		return
+	}
+	ac := annotatedConn(conn)
+	hsTime := ac.Annotation(handshakeDoneKey, time.Time{}).(time.Time)
+	dialTime := ac.Annotation(dialDoneKey, time.Time{}).(time.Time)
+	if !hsTime.IsZero() {
+		span.AddEvent("handshake done", hsTime)
+	}
+	if !dialTime.IsZero() {
+		span.AddEvent("dial done", dialTime)
+	}
+	if intConn := connIntConn(conn); intConn != nil {
+		span.SetAttribute("tlsproxy.backend.address", intConn.RemoteAddr().String())
+	}
+	span.SetAttribute("tlsproxy.bytes_received", ac.BytesReceived())
+	span.SetAttribute("tlsproxy.bytes_sent", ac.BytesSent())
+	span.End(time.Now())
+}
+
+// tracingHandler creates a trace span for each HTTP request. The span is a
+// child of the request's traceparent, if any, or of the connection's span.
+// The span's context is forwarded to the backend with the traceparent
+// header.
+func (be *Backend) tracingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if be.tracer == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		parent, ok := tracing.ParseTraceparent(req.Header.Get(traceparentHeader))
+		if !ok {
+			if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+				parent = connSpan(conn).Context()
+			}
+		}
+		span := be.tracer.Start(req.Method, tracing.KindServer, parent, start)
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		span.SetAttribute("server.address", req.Host)
+		span.SetAttribute("network.protocol.version", req.Proto)
+		span.SetAttribute("user_agent.original", userAgent(req))
+
+		rw := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			span.SetAttribute("http.response.status_code", status)
+			if status >= 500 {
+				span.SetError(http.StatusText(status))
+			}
+			span.End(time.Now())
+		}()
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), ctxSpanKey, span)))
+	})
+}
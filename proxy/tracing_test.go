@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestTracing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Events       []struct {
+			Name string `json:"name"`
+		} `json:"events"`
+	}
+	var mu sync.Mutex
+	var spans []span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var r struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			t.Errorf("Decode: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range r.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	var traceparent string
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		traceparent = req.Header.Get(traceparentHeader)
+		mu.Unlock()
+		fmt.Fprintln(w, "Hello")
+	}))
+	defer l.Close()
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Tracing: &ConfigTracing{
+				Endpoint: collector.URL + "/v1/traces",
+			},
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"http.example.com"},
+					Addresses:   []string{l.Addr().String()},
+					Mode:        "HTTP",
+				},
+				{
+					ServerNames: []string{"tcp.example.com"},
+					Addresses:   []string{be.listener.Addr().String()},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+
+	if _, _, err := httpGet("http.example.com", proxy.listener.Addr().String(), "/", extCA, nil); err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	if _, _, err := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil {
+		t.Fatalf("tlsGet: %v", err)
+	}
+	// Stop flushes the spans.
+	proxy.Stop()
+
+	var gotReq, gotConn bool
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		mu.Lock()
+		n := len(spans)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 {
+		t.Fatalf("Backend got traceparent %q", traceparent)
+	}
+	for _, s := range spans {
+		if s.Name == "GET" {
+			gotReq = true
+			if s.TraceID != parts[1] || s.SpanID != parts[2] {
+				t.Errorf("Request span %+v doesn't match traceparent %q", s, traceparent)
+			}
+			if s.ParentSpanID == "" {
+				t.Errorf("Request span %+v should have a parent", s)
+			}
+		}
+		if s.Name == "connection" && len(s.Events) == 2 {
+			gotConn = true
+			if s.Events[0].Name != "handshake done" || s.Events[1].Name != "dial done" {
+				t.Errorf("Unexpected events: %+v", s.Events)
+			}
+		}
+	}
+	if !gotReq || !gotConn {
+		t.Errorf("Missing spans: %+v", spans)
+	}
+}
@@ -0,0 +1,218 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// trafficSplit distributes a backend's traffic between its AddressGroups. It
+// is kept across config changes when the backend's AddressGroups don't
+// change, so that the weights set with the admin API and the counters are
+// preserved.
+type trafficSplit struct {
+	cfg    []AddressGroup
+	mu     sync.Mutex
+	groups []*splitGroup
+}
+
+type splitGroup struct {
+	index     int
+	name      string
+	addresses []string
+	// weight is protected by trafficSplit.mu.
+	weight   int
+	requests atomic.Int64
+	errors   atomic.Int64
+}
+
+// setTrafficSplits creates the traffic splits of the backends. It must be
+// called with p.mu held.
+func (p *Proxy) setTrafficSplits(cfg *Config) {
+	splits := make(map[string]*trafficSplit)
+	for _, be := range cfg.Backends {
+		be.split = nil
+		if len(be.AddressGroups) == 0 {
+			continue
+		}
+		groups := make([]AddressGroup, 0, len(be.AddressGroups))
+		for _, g := range be.AddressGroups {
+			groups = append(groups, *g)
+		}
+		name := be.displayName()
+		if s, ok := p.trafficSplits[name]; ok && reflect.DeepEqual(s.cfg, groups) {
+			splits[name] = s
+			be.split = s
+			continue
+		}
+		s := &trafficSplit{cfg: groups}
+		for i, g := range groups {
+			s.groups = append(s.groups, &splitGroup{
+				index:     i,
+				name:      g.Name,
+				addresses: g.Addresses,
+				weight:    g.Weight,
+			})
+		}
+		splits[name] = s
+		be.split = s
+	}
+	p.trafficSplits = splits
+}
+
+// pick returns a group chosen randomly according to the weights.
+func (s *trafficSplit) pick() *splitGroup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int
+	for _, g := range s.groups {
+		total += g.weight
+	}
+	if total > 0 {
+		n := rand.IntN(total)
+		for _, g := range s.groups {
+			if n < g.weight {
+				return g
+			}
+			n -= g.weight
+		}
+	}
+	return s.groups[0]
+}
+
+// addressGroup returns the address group of the request or connection in
+// ctx, or picks one if the HTTP request handler didn't. The second return
+// value is true if the group was picked here.
+func (be *Backend) addressGroup(ctx context.Context) (*splitGroup, bool) {
+	if be.split == nil {
+		return nil, false
+	}
+	if g, ok := ctx.Value(ctxAddressGroupKey).(*splitGroup); ok {
+		return g, false
+	}
+	g := be.split.pick()
+	g.requests.Add(1)
+	return g, true
+}
+
+// countGroupError counts an error for the address group of req, if any.
+func countGroupError(req *http.Request) {
+	if g, ok := req.Context().Value(ctxAddressGroupKey).(*splitGroup); ok {
+		g.errors.Add(1)
+	}
+}
+
+type adminSplitGroup struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Weight    int      `json:"weight"`
+	Requests  int64    `json:"requests"`
+	Errors    int64    `json:"errors"`
+}
+
+type adminTrafficSplit struct {
+	Backend string            `json:"backend"`
+	Groups  []adminSplitGroup `json:"groups"`
+}
+
+func (s *trafficSplit) status(backend string) adminTrafficSplit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := adminTrafficSplit{Backend: backend}
+	for _, g := range s.groups {
+		out.Groups = append(out.Groups, adminSplitGroup{
+			Name:      g.name,
+			Addresses: g.addresses,
+			Weight:    g.weight,
+			Requests:  g.requests.Load(),
+			Errors:    g.errors.Load(),
+		})
+	}
+	return out
+}
+
+// adminTrafficSplits returns the weights and the counters of the address
+// groups of the backends.
+func (p *Proxy) adminTrafficSplits(*http.Request) (any, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := []adminTrafficSplit{}
+	for _, be := range p.cfg.Backends {
+		if be.split != nil {
+			out = append(out, be.split.status(be.displayName()))
+		}
+	}
+	return out, nil
+}
+
+// adminSetSplitWeight changes the weight of an address group of the backend
+// for serverName, until the backend's AddressGroups are changed in the
+// config.
+func (p *Proxy) adminSetSplitWeight(req *http.Request) (any, error) {
+	serverName := idnaToASCII(req.Form.Get("serverName"))
+	if serverName == "" {
+		return nil, errors.New("serverName must be set")
+	}
+	name := req.Form.Get("group")
+	weight, err := strconv.Atoi(req.Form.Get("weight"))
+	if err != nil || weight < 0 {
+		return nil, errors.New("weight must be a non-negative integer")
+	}
+	be, err := p.backend(serverName)
+	if err != nil || be.split == nil {
+		return nil, errNotFound
+	}
+	s := be.split
+	s.mu.Lock()
+	i := slices.IndexFunc(s.groups, func(g *splitGroup) bool { return g.name == name })
+	if i < 0 {
+		s.mu.Unlock()
+		return nil, errNotFound
+	}
+	total := weight
+	for j, g := range s.groups {
+		if j != i {
+			total += g.weight
+		}
+	}
+	if total == 0 {
+		s.mu.Unlock()
+		return nil, errors.New("at least one group must have a positive weight")
+	}
+	s.groups[i].weight = weight
+	s.mu.Unlock()
+
+	log.Printf("INF Admin API: set the weight of group %s of %s to %d", name, be.displayName(), weight)
+	p.recordEvent("traffic split changed")
+	return s.status(be.displayName()), nil
+}
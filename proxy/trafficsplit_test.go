@@ -0,0 +1,161 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestTrafficSplit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	stable := newHTTPServer(t, ctx, "stable", nil)
+	canary := newHTTPServer(t, ctx, "canary", nil)
+	tcpStable := newTCPServer(t, ctx, "tcp-stable", nil)
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Mode:        "HTTP",
+				AddressGroups: []*AddressGroup{
+					{Name: "stable", Addresses: []string{stable.String()}, Weight: 100},
+					{Name: "canary", Addresses: []string{canary.String()}, Weight: 0},
+				},
+			},
+			{
+				ServerNames: []string{"tcp.example.com"},
+				Mode:        "TCP",
+				AddressGroups: []*AddressGroup{
+					{Name: "stable", Addresses: []string{tcpStable.listener.Addr().String()}, Weight: 0},
+					{Name: "broken", Addresses: []string{closedAddr}, Weight: 1},
+				},
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	get := func(want string) {
+		t.Helper()
+		for range 5 {
+			got, _, err := httpGet("www.example.com", proxy.listener.Addr().String(), "/", extCA, nil)
+			if err != nil {
+				t.Fatalf("httpGet: %v", err)
+			}
+			if want := "HTTP/2.0 200 OK\n[" + want + "] /\n"; got != want {
+				t.Fatalf("Got %q, want %q", got, want)
+			}
+		}
+	}
+	setWeight := func(serverName, group, weight string) error {
+		req := httptest.NewRequest("POST", "/api/traffic-split/weight", nil)
+		req.Form = url.Values{"serverName": {serverName}, "group": {group}, "weight": {weight}}
+		_, err := proxy.adminSetSplitWeight(req)
+		return err
+	}
+	status := func(i int) adminTrafficSplit {
+		t.Helper()
+		v, err := proxy.adminTrafficSplits(nil)
+		if err != nil {
+			t.Fatalf("adminTrafficSplits: %v", err)
+		}
+		return v.([]adminTrafficSplit)[i]
+	}
+
+	get("stable")
+	if err := setWeight("www.example.com", "canary", "100"); err != nil {
+		t.Fatalf("setWeight: %v", err)
+	}
+	if err := setWeight("www.example.com", "stable", "0"); err != nil {
+		t.Fatalf("setWeight: %v", err)
+	}
+	if err := setWeight("www.example.com", "canary", "0"); err == nil {
+		t.Fatal("setWeight: expected error when all the weights are zero")
+	}
+	if err := setWeight("www.example.com", "nonexistent", "1"); err != errNotFound {
+		t.Fatalf("setWeight: got %v, want errNotFound", err)
+	}
+	get("canary")
+
+	// The weights set with the admin API are kept when the config is
+	// reloaded, as long as the address groups don't change.
+	if err := proxy.Reconfigure(cfg.clone()); err != nil {
+		t.Fatalf("proxy.Reconfigure: %v", err)
+	}
+	get("canary")
+
+	st := status(0)
+	if got, want := st.Groups[0].Requests, int64(5); got != want {
+		t.Errorf("stable requests = %d, want %d", got, want)
+	}
+	if got, want := st.Groups[1].Requests, int64(10); got != want {
+		t.Errorf("canary requests = %d, want %d", got, want)
+	}
+	if got, want := st.Groups[1].Weight, 100; got != want {
+		t.Errorf("canary weight = %d, want %d", got, want)
+	}
+
+	if got, _, _ := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); got != "" {
+		t.Errorf("tlsGet(tcp.example.com) = %q, want empty", got)
+	}
+	if st := status(1); st.Groups[1].Requests != 1 || st.Groups[1].Errors != 1 {
+		t.Errorf("broken group = %+v, want 1 request and 1 error", st.Groups[1])
+	}
+	if err := setWeight("tcp.example.com", "stable", "1"); err != nil {
+		t.Fatalf("setWeight: %v", err)
+	}
+	if err := setWeight("tcp.example.com", "broken", "0"); err != nil {
+		t.Fatalf("setWeight: %v", err)
+	}
+	if got, _, err := tlsGet("tcp.example.com", proxy.listener.Addr().String(), "Hello!\n", extCA, nil, nil); err != nil || !strings.Contains(got, "Hello from tcp-stable") {
+		t.Errorf("tlsGet(tcp.example.com) = %q, %v", got, err)
+	}
+}
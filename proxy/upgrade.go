@@ -0,0 +1,129 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"syscall"
+
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/activation"
+)
+
+// Upgrade starts a new proxy process, e.g. with a new version of the binary,
+// and passes the proxy's listening sockets to it. It returns when the new
+// process is ready to accept connections. Then the caller should call
+// Shutdown to let the active connections finish, and exit. If the new process
+// fails to start, or doesn't become ready before ctx expires, it is killed,
+// and the current process continues to serve.
+//
+// The connections that are still active after Upgrade returns are not
+// affected, except QUIC connections, which may be reset by the new process.
+func (p *Proxy) Upgrade(ctx context.Context, path string, args ...string) error {
+	p.mu.RLock()
+	socks := p.sockets
+	p.mu.RUnlock()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var names []string
+	// The file descriptors are passed with syscall.ForkExec instead of
+	// exec.Cmd because exec puts them in blocking mode, which would also
+	// affect the proxy's own sockets.
+	fds := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd()}
+	addFile := func(name string, f *os.File) error {
+		files = append(files, f)
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := rc.Control(func(fd uintptr) { fds = append(fds, fd) }); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		names = append(names, name)
+		return nil
+	}
+	for _, s := range socks {
+		f, err := s.sock.File()
+		if err != nil {
+			return fmt.Errorf("%s socket: %w", s.name, err)
+		}
+		if err := addFile(s.name, f); err != nil {
+			return err
+		}
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := addFile(activation.ReadyName, w); err != nil {
+		return err
+	}
+
+	pid, err := syscall.ForkExec(path, append([]string{path}, args...), &syscall.ProcAttr{
+		Env:   activation.Env(names),
+		Files: fds,
+	})
+	if err != nil {
+		return err
+	}
+	w.Close()
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	log.Printf("INF Upgrade: started new process %d", pid)
+	go proc.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := io.ReadFull(r, b[:])
+		if err == io.EOF {
+			err = errors.New("new process exited")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		proc.Kill()
+		return fmt.Errorf("upgrade: %w", err)
+	}
+	log.Printf("INF Upgrade: new process %d is ready", pid)
+	p.recordEvent("upgrade")
+	return nil
+}
@@ -0,0 +1,120 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+	"github.com/c2FmZQ/tlsproxy/proxy/internal/activation"
+)
+
+// TestUpgradeHelper is the new process in TestUpgrade. It exits directly so
+// that its output doesn't get mixed with the output of the test.
+func TestUpgradeHelper(t *testing.T) {
+	switch os.Getenv("TLSPROXY_TEST_UPGRADE") {
+	case "":
+		t.Skip("Only used by TestUpgrade")
+	case "fail":
+		os.Exit(1)
+	}
+	l, err := activation.Listener(socketNameTLS, "")
+	if err != nil || l == nil {
+		t.Fatalf("activation.Listener: %v, %v", l, err)
+	}
+	if err := activation.NotifyReady(); err != nil {
+		t.Fatalf("activation.NotifyReady: %v", err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	c.Write([]byte("Hello from new process\n"))
+	c.Close()
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ca, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	backend := newTCPServer(t, ctx, "backend", nil)
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"example.com"},
+				Addresses:   []string{backend.listener.Addr().String()},
+				Mode:        ModeTCP,
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, ca)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	addr := proxy.listener.Addr().String()
+
+	// A new process that exits before it's ready.
+	t.Setenv("TLSPROXY_TEST_UPGRADE", "fail")
+	if err := proxy.Upgrade(ctx, os.Args[0], "-test.run=^TestUpgradeHelper$"); err == nil {
+		t.Fatal("Upgrade should fail")
+	}
+	if got, _, err := tlsGet("example.com", addr, "Hello!\n", ca, nil, nil); err != nil || got != "Hello from backend\n" {
+		t.Fatalf("tlsGet: %q, %v", got, err)
+	}
+
+	t.Setenv("TLSPROXY_TEST_UPGRADE", "1")
+	uctx, ucancel := context.WithTimeout(ctx, 30*time.Second)
+	defer ucancel()
+	if err := proxy.Upgrade(uctx, os.Args[0], "-test.run=^TestUpgradeHelper$"); err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	proxy.Shutdown(uctx)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(b), "Hello from new process\n"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
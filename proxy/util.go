@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/pires/go-proxyproto"
 	"golang.org/x/net/idna"
@@ -40,6 +41,8 @@ func netwConn(c anyConn) *netw.Conn {
 	switch c := c.(type) {
 	case *tls.Conn:
 		return netwConn(c.NetConn())
+	case *sniffedConn:
+		return netwConn(c.NetConn())
 	case *netw.Conn:
 		return c
 	default:
@@ -67,6 +70,8 @@ func annotatedConn(c anyConn) annotatedConnection {
 	switch c := c.(type) {
 	case *tls.Conn:
 		return netwConn(c.NetConn())
+	case *sniffedConn:
+		return netwConn(c.NetConn())
 	case *netw.Conn:
 		return c
 	case *netw.QUICConn:
@@ -80,6 +85,13 @@ func connServerNameIsSet(c anyConn) bool {
 	return annotatedConn(c).Annotation(serverNameKey, nil) != nil
 }
 
+func connID(c anyConn) uint64 {
+	if v, ok := annotatedConn(c).Annotation(connIDKey, uint64(0)).(uint64); ok {
+		return v
+	}
+	return 0
+}
+
 func connServerName(c anyConn) string {
 	if v, ok := annotatedConn(c).Annotation(serverNameKey, "").(string); ok {
 		return v
@@ -87,6 +99,20 @@ func connServerName(c anyConn) string {
 	return ""
 }
 
+func connJA3(c anyConn) string {
+	if v, ok := annotatedConn(c).Annotation(ja3Key, "").(string); ok {
+		return v
+	}
+	return ""
+}
+
+func connJA4(c anyConn) string {
+	if v, ok := annotatedConn(c).Annotation(ja4Key, "").(string); ok {
+		return v
+	}
+	return ""
+}
+
 func connProto(c anyConn) string {
 	if v, ok := annotatedConn(c).Annotation(protoKey, "").(string); ok {
 		return v
@@ -125,6 +151,15 @@ func connIntConn(c anyConn) net.Conn {
 	return nil
 }
 
+// connDialAttempts returns the number of backend addresses that were tried
+// before the connection to the backend was established.
+func connDialAttempts(c anyConn) int {
+	if v, ok := annotatedConn(c).Annotation(dialAttemptsKey, 0).(int); ok {
+		return v
+	}
+	return 0
+}
+
 func connProxyProto(c anyConn) string {
 	if v, ok := annotatedConn(c).Annotation(proxyProtoKey, nil).(string); ok {
 		return v
@@ -146,6 +181,24 @@ func idnaToASCII(h string) string {
 	return h
 }
 
+// closeConnGracefully closes conn. If conn is a TLS connection terminated by
+// the proxy, a close_notify alert is sent to the client first.
+func closeConnGracefully(conn annotatedConnection) error {
+	if tc, ok := conn.Annotation(tlsConnKey, nil).(*tls.Conn); ok {
+		return tc.Close()
+	}
+	return conn.Close()
+}
+
+// wildcardServerName returns the wildcard name that matches serverName,
+// e.g. *.example.com for www.example.com.
+func wildcardServerName(serverName string) string {
+	if _, parent, ok := strings.Cut(serverName, "."); ok && parent != "" {
+		return "*." + parent
+	}
+	return ""
+}
+
 func idnaToUnicode(h string) string {
 	if n, err := idna.Lookup.ToUnicode(h); err == nil {
 		return n
@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/websocket"
+)
+
+// webSocketHandler returns a handler that accepts WebSocket connections and
+// bridges them to the backend's TCP addresses. Each binary or text message
+// received from the client is sent to the backend as a stream of bytes, and
+// the bytes received from the backend are sent back to the client in binary
+// messages. Local endpoints, e.g. SSO, are handled first.
+func (be *Backend) webSocketHandler() http.Handler {
+	ws := be.webSocketServer()
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(req, r)
+			}
+		}()
+		if !be.authenticateUser(w, &req) {
+			return
+		}
+		if !be.handleLocalEndpointsAndAuthorize(w, req) {
+			return
+		}
+		ws.ServeHTTP(w, req)
+	})
+}
+
+func (be *Backend) webSocketServer() websocket.Server {
+	return websocket.Server{
+		Handshake: checkWebSocketOrigin,
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			req := ws.Request()
+			ctx := req.Context()
+			conn, ok := ctx.Value(connCtxKey).(anyConn)
+			if !ok {
+				log.Printf("ERR Request without connCtxKey: %v", ctx)
+				ws.Close()
+				return
+			}
+			annotatedConn(conn).SetAnnotation(httpUpgradeKey, "websocket")
+
+			intConn, err := be.dialRetry(ctx)
+			if err != nil {
+				be.recordEvent("dial error")
+				log.Printf("ERR %s ➔ WebSocket Dial: %v", formatReqDesc(req), err)
+				ws.Close()
+				return
+			}
+			annotatedConn(conn).SetAnnotation(internalConnKey, intConn)
+			if be.countWebSocket != nil {
+				defer be.countWebSocket(be.metricsServerName(connServerName(conn)))()
+			}
+			log.Printf("STR %s ➔ WebSocket ➔ %s", formatReqDesc(req), intConn.RemoteAddr())
+			if err := be.bridgeConns(ws, intConn); err != nil {
+				log.Printf("DBG %s ➔ WebSocket: %v", formatReqDesc(req), err)
+			}
+		},
+	}
+}
+
+// checkWebSocketOrigin rejects cross-origin WebSocket connections from
+// browsers. Since the connections may be authenticated with cookies, a page
+// from another origin shouldn't be able to open them. Clients that aren't
+// browsers usually don't send an Origin header.
+func checkWebSocketOrigin(cfg *websocket.Config, req *http.Request) error {
+	v := req.Header.Get("Origin")
+	if v == "" {
+		return nil
+	}
+	origin, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if origin.Host != req.Host {
+		return fmt.Errorf("cross-origin request from %s", v)
+	}
+	cfg.Origin = origin
+	return nil
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestWebSocketBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newTCPServer(t, ctx, "backend", nil)
+
+	proxy := newTestProxy(
+		&Config{
+			HTTPAddr: "localhost:0",
+			TLSAddr:  "localhost:0",
+			CacheDir: t.TempDir(),
+			MaxOpen:  100,
+			Backends: []*Backend{
+				{
+					ServerNames: []string{"ws.example.com"},
+					Mode:        "WEBSOCKET",
+					Addresses:   []string{be.listener.Addr().String()},
+				},
+			},
+		},
+		extCA,
+	)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	dial := func(origin string) (*websocket.Conn, error) {
+		cfg, err := websocket.NewConfig("wss://ws.example.com/foo", origin)
+		if err != nil {
+			t.Fatalf("websocket.NewConfig: %v", err)
+		}
+		conn, err := tls.Dial("tcp", proxy.listener.Addr().String(), &tls.Config{
+			ServerName: "ws.example.com",
+			RootCAs:    extCA.RootCACertPool(),
+			NextProtos: []string{"http/1.1"},
+		})
+		if err != nil {
+			t.Fatalf("tls.Dial: %v", err)
+		}
+		ws, err := websocket.NewClient(cfg, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ws, nil
+	}
+
+	ws, err := dial("https://ws.example.com")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+	got, err := io.ReadAll(ws)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := "Hello from backend\n"; string(got) != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+
+	if _, err := dial("https://evil.example.com"); err == nil {
+		t.Error("cross-origin dial succeeded")
+	}
+}
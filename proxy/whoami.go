@@ -0,0 +1,118 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const whoAmIPath = "/.tlsproxy/whoami"
+
+// whoAmI is the response of the whoami endpoint.
+type whoAmI struct {
+	RemoteAddr  string      `json:"remoteAddr"`
+	IP          string      `json:"ip,omitempty"`
+	ServerName  string      `json:"serverName,omitempty"`
+	TLSVersion  string      `json:"tlsVersion,omitempty"`
+	CipherSuite string      `json:"cipherSuite,omitempty"`
+	ALPNProto   string      `json:"alpnProto,omitempty"`
+	Resumed     bool        `json:"resumed,omitempty"`
+	JA3         string      `json:"ja3,omitempty"`
+	JA4         string      `json:"ja4,omitempty"`
+	HTTPProto   string      `json:"httpProto"`
+	User        string      `json:"user,omitempty"`
+	ClientCert  *whoAmICert `json:"clientCert,omitempty"`
+	IPLists     []string    `json:"ipLists,omitempty"`
+}
+
+type whoAmICert struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serialNumber"`
+	NotAfter     time.Time `json:"notAfter"`
+}
+
+// whoAmIHandler returns what the proxy knows about the client's connection.
+func (p *Proxy) whoAmIHandler(w http.ResponseWriter, req *http.Request) {
+	resp := whoAmI{
+		RemoteAddr: req.RemoteAddr,
+		HTTPProto:  req.Proto,
+	}
+	if conn, ok := req.Context().Value(connCtxKey).(anyConn); ok {
+		resp.RemoteAddr = conn.RemoteAddr().String()
+		resp.ServerName = idnaToUnicode(connServerName(conn))
+		resp.ALPNProto = connProto(conn)
+		resp.JA3 = connJA3(conn)
+		resp.JA4 = connJA4(conn)
+		if cert := connClientCert(conn); cert != nil {
+			resp.ClientCert = &whoAmICert{
+				Subject:      cert.Subject.String(),
+				Issuer:       cert.Issuer.String(),
+				SerialNumber: cert.SerialNumber.String(),
+				NotAfter:     cert.NotAfter,
+			}
+		}
+	}
+	if cs := req.TLS; cs != nil {
+		resp.TLSVersion = tls.VersionName(cs.Version)
+		resp.CipherSuite = tls.CipherSuiteName(cs.CipherSuite)
+		resp.Resumed = cs.DidResume
+		if cs.NegotiatedProtocol != "" {
+			resp.ALPNProto = cs.NegotiatedProtocol
+		}
+		if cs.ServerName != "" {
+			resp.ServerName = idnaToUnicode(cs.ServerName)
+		}
+	}
+	if claims := claimsFromCtx(req.Context()); claims != nil {
+		resp.User, _ = claims["email"].(string)
+	}
+	if host, _, err := net.SplitHostPort(resp.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			resp.IP = ip.String()
+			p.mu.RLock()
+			for name, l := range p.ipLists {
+				if l.contains(ip) {
+					resp.IPLists = append(resp.IPLists, name)
+				}
+			}
+			p.mu.RUnlock()
+			sort.Strings(resp.IPLists)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("ERR whoami: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+// MIT License
+//
+// Copyright (c) 2023 TTBT Enterprises LLC
+// Copyright (c) 2023 Robin Thellend <rthellend@rthellend.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/c2FmZQ/tlsproxy/certmanager"
+)
+
+func TestWhoAmI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	extCA, err := certmanager.New("root-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	intCA, err := certmanager.New("internal-ca.example.com", t.Logf)
+	if err != nil {
+		t.Fatalf("certmanager.New: %v", err)
+	}
+	be := newHTTPServer(t, ctx, "backend", nil)
+
+	file := filepath.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(file, []byte("127.0.0.0/8\n::1\n"), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	cfg := &Config{
+		HTTPAddr: "localhost:0",
+		TLSAddr:  "localhost:0",
+		CacheDir: t.TempDir(),
+		MaxOpen:  100,
+		IPLists: []*ConfigIPList{
+			{Name: "local", Source: file},
+		},
+		Backends: []*Backend{
+			{
+				ServerNames: []string{"www.example.com"},
+				Addresses:   []string{be.String()},
+				Mode:        "HTTP",
+				WhoAmI:      true,
+				ClientAuth: &ClientAuth{
+					RootCAs: []string{intCA.RootCAPEM()},
+				},
+			},
+			{
+				ServerNames: []string{"other.example.com"},
+				Addresses:   []string{be.String()},
+				Mode:        "HTTP",
+			},
+		},
+	}
+	proxy := newTestProxy(cfg, extCA)
+	if err := proxy.Start(ctx); err != nil {
+		t.Fatalf("proxy.Start: %v", err)
+	}
+	defer proxy.Stop()
+
+	cert, err := intCA.GetCert("client.example.com")
+	if err != nil {
+		t.Fatalf("intCA.GetCert: %v", err)
+	}
+	body, localAddr, err := httpGet("www.example.com", proxy.listener.Addr().String(), whoAmIPath, extCA, []tls.Certificate{*cert})
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	status, body, _ := strings.Cut(body, "\n")
+	if status != "HTTP/2.0 200 OK" {
+		t.Fatalf("status = %q, body = %q", status, body)
+	}
+	var got whoAmI
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if got.RemoteAddr != localAddr {
+		t.Errorf("RemoteAddr = %q, want %q", got.RemoteAddr, localAddr)
+	}
+	if got.ServerName != "www.example.com" {
+		t.Errorf("ServerName = %q", got.ServerName)
+	}
+	if got.TLSVersion != "TLS 1.3" || got.CipherSuite == "" || got.ALPNProto != "h2" || got.JA4 == "" {
+		t.Errorf("TLS info = %q, %q, %q, %q", got.TLSVersion, got.CipherSuite, got.ALPNProto, got.JA4)
+	}
+	if got.ClientCert == nil || got.ClientCert.Subject != "CN=client.example.com" {
+		t.Errorf("ClientCert = %#v", got.ClientCert)
+	}
+	if len(got.IPLists) != 1 || got.IPLists[0] != "local" {
+		t.Errorf("IPLists = %v, want [local]", got.IPLists)
+	}
+
+	// The endpoint is opt-in. The request is forwarded to the backend.
+	body, _, err = httpGet("other.example.com", proxy.listener.Addr().String(), whoAmIPath, extCA, nil)
+	if err != nil {
+		t.Fatalf("httpGet: %v", err)
+	}
+	if strings.Contains(body, "tlsVersion") {
+		t.Errorf("other.example.com: got %q", body)
+	}
+
+	cfg = cfg.clone()
+	cfg.Backends[1].Mode = "TCP"
+	cfg.Backends[1].WhoAmI = true
+	if err := cfg.Check(); err == nil || !strings.Contains(err.Error(), "WhoAmI") {
+		t.Errorf("cfg.Check() = %v", err)
+	}
+}
@@ -75,6 +75,47 @@ func addXFCCHeader(req *http.Request, which []string) {
 	req.Header.Set(xFCCHeader, strings.Join(fields, ";"))
 }
 
+// addClientCertHeaders sets the client certificate headers specified in
+// headers, a map of field names to header names. Any existing headers with the
+// same names are removed first.
+func addClientCertHeaders(req *http.Request, headers map[string]string) {
+	for _, h := range headers {
+		req.Header.Del(h)
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := req.TLS.PeerCertificates[0]
+	for f, h := range headers {
+		var v string
+		switch f {
+		case "cert":
+			v = url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: cert.Raw,
+			})))
+		case "hash":
+			sum := sha256.Sum256(cert.Raw)
+			v = hex.EncodeToString(sum[:])
+		case "subject":
+			v = cert.Subject.String()
+		case "dns":
+			v = strings.Join(cert.DNSNames, ",")
+		case "email":
+			v = strings.Join(cert.EmailAddresses, ",")
+		case "uri":
+			uris := make([]string, 0, len(cert.URIs))
+			for _, u := range cert.URIs {
+				uris = append(uris, u.String())
+			}
+			v = strings.Join(uris, ",")
+		}
+		if v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+}
+
 func encodeXFCCSubject(input string) string {
 	var parts []string
 	var esc bool
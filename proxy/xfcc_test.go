@@ -24,7 +24,20 @@
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeXFCC(t *testing.T) {
@@ -63,3 +76,82 @@ func TestEncodeXFCCSubject(t *testing.T) {
 		}
 	}
 }
+
+func newTestClientCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey: %v", err)
+	}
+	uri, _ := url.Parse("spiffe://example.com/bob")
+	templ := &x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		Subject:        pkix.Name{CommonName: "Bob", Organization: []string{"Org"}},
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(time.Hour),
+		DNSNames:       []string{"bob.example.com", "b.example.com"},
+		EmailAddresses: []string{"bob@example.com"},
+		URIs:           []*url.URL{uri},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, templ, templ, key.Public(), key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
+func TestAddClientCertHeaders(t *testing.T) {
+	cert := newTestClientCert(t).Leaf
+	headers := map[string]string{
+		"cert":    "X-Client-Cert",
+		"hash":    "X-Client-Cert-Hash",
+		"subject": "X-Client-Cert-Subject",
+		"dns":     "X-Client-Cert-DNS",
+		"email":   "X-Client-Cert-Email",
+		"uri":     "X-Client-Cert-URI",
+	}
+
+	req := &http.Request{
+		Header: http.Header{},
+		TLS:    &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}},
+	}
+	req.Header.Set("X-Client-Cert-Subject", "CN=Mallory")
+	addClientCertHeaders(req, headers)
+
+	sum := sha256.Sum256(cert.Raw)
+	for h, want := range map[string]string{
+		"X-Client-Cert-Hash":    hex.EncodeToString(sum[:]),
+		"X-Client-Cert-Subject": "CN=Bob,O=Org",
+		"X-Client-Cert-DNS":     "bob.example.com,b.example.com",
+		"X-Client-Cert-Email":   "bob@example.com",
+		"X-Client-Cert-URI":     "spiffe://example.com/bob",
+	} {
+		if got := req.Header.Values(h); len(got) != 1 || got[0] != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+	pemCert, err := url.QueryUnescape(req.Header.Get("X-Client-Cert"))
+	if err != nil {
+		t.Fatalf("QueryUnescape: %v", err)
+	}
+	if !strings.HasPrefix(pemCert, "-----BEGIN CERTIFICATE-----\n") {
+		t.Errorf("X-Client-Cert = %q", pemCert)
+	}
+
+	// Without a client certificate, headers sent by the client are removed.
+	req = &http.Request{Header: http.Header{}, TLS: &tls.ConnectionState{}}
+	req.Header.Set("X-Client-Cert-Subject", "CN=Mallory")
+	addClientCertHeaders(req, headers)
+	if got := req.Header.Values("X-Client-Cert-Subject"); got != nil {
+		t.Errorf("X-Client-Cert-Subject = %q, want nil", got)
+	}
+}